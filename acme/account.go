@@ -1,9 +1,12 @@
 package acme
 
 import (
+	"context"
 	"crypto"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"time"
 
 	"go.step.sm/crypto/jose"
 )
@@ -18,6 +21,12 @@ type Account struct {
 	OrdersURL string           `json:"orders"`
 }
 
+// AccountAllowlistFunc is a hook that decides if a client can register a new
+// account in the given provisioner. The certificate is the client certificate
+// of the request, verified by the CA, or nil if the client did not present
+// one.
+type AccountAllowlistFunc func(ctx context.Context, prov Provisioner, crt *x509.Certificate) (bool, error)
+
 // ToLog enables response logging.
 func (a *Account) ToLog() (interface{}, error) {
 	b, err := json.Marshal(a)
@@ -32,6 +41,36 @@ func (a *Account) IsValid() bool {
 	return Status(a.Status) == StatusValid
 }
 
+// IsValidAccountStatusTransition returns true if the status of an account can
+// change from the first status to the second one. A valid account can be
+// deactivated or revoked, but the deactivated and revoked statuses are final.
+func IsValidAccountStatusTransition(from, to Status) bool {
+	switch {
+	case from == to:
+		return true
+	case from == StatusValid:
+		return to == StatusDeactivated || to == StatusRevoked
+	default:
+		return false
+	}
+}
+
+// NewAccountStatusTransitionError returns the error used when the status of
+// an account cannot change from the first status to the second one.
+func NewAccountStatusTransitionError(accID string, from, to Status) *Error {
+	return NewDetailedError(ErrorUnauthorizedType, "cannot change the status of account %s from %s to %s", accID, from, to)
+}
+
+// AccountStatusChange is the audit record of a change in the status of an
+// account. KeyThumbprint is the thumbprint of the key that signed the request.
+type AccountStatusChange struct {
+	AccountID     string    `json:"accountID"`
+	OldStatus     Status    `json:"oldStatus"`
+	NewStatus     Status    `json:"newStatus"`
+	KeyThumbprint string    `json:"keyThumbprint"`
+	ChangedAt     time.Time `json:"changedAt"`
+}
+
 // KeyToID converts a JWK to a thumbprint.
 func KeyToID(jwk *jose.JSONWebKey) (string, error) {
 	kid, err := jwk.Thumbprint(crypto.SHA256)
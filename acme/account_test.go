@@ -79,3 +79,27 @@ func TestAccount_IsValid(t *testing.T) {
 		})
 	}
 }
+
+func TestIsValidAccountStatusTransition(t *testing.T) {
+	type test struct {
+		from, to Status
+		exp      bool
+	}
+	tests := map[string]test{
+		"valid":                  {from: StatusValid, to: StatusValid, exp: true},
+		"valid-to-deactivated":   {from: StatusValid, to: StatusDeactivated, exp: true},
+		"valid-to-revoked":       {from: StatusValid, to: StatusRevoked, exp: true},
+		"valid-to-pending":       {from: StatusValid, to: StatusPending, exp: false},
+		"deactivated":            {from: StatusDeactivated, to: StatusDeactivated, exp: true},
+		"deactivated-to-valid":   {from: StatusDeactivated, to: StatusValid, exp: false},
+		"deactivated-to-revoked": {from: StatusDeactivated, to: StatusRevoked, exp: false},
+		"revoked":                {from: StatusRevoked, to: StatusRevoked, exp: true},
+		"revoked-to-valid":       {from: StatusRevoked, to: StatusValid, exp: false},
+		"revoked-to-deactivated": {from: StatusRevoked, to: StatusDeactivated, exp: false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equals(t, IsValidAccountStatusTransition(tc.from, tc.to), tc.exp)
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package api
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi"
 	"github.com/smallstep/certificates/acme"
-	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/logging"
+	"go.step.sm/crypto/jose"
 )
 
 // NewAccountRequest represents the payload for a new account request.
@@ -26,6 +29,25 @@ func validateContacts(cs []string) error {
 	return nil
 }
 
+// uniqueContacts returns the contacts without duplicates, keeping the first
+// occurrence of each one. It returns an error if there are more contacts than
+// the maximum allowed by the provisioner.
+func uniqueContacts(prov acme.Provisioner, cs []string) ([]string, error) {
+	seen := make(map[string]bool, len(cs))
+	contacts := make([]string, 0, len(cs))
+	for _, c := range cs {
+		if !seen[c] {
+			seen[c] = true
+			contacts = append(contacts, c)
+		}
+	}
+	if max := prov.GetMaxContacts(); max > 0 && len(contacts) > max {
+		return nil, acme.NewError(acme.ErrorMalformedType,
+			"too many contacts; the maximum number of contacts is %d", max)
+	}
+	return contacts, nil
+}
+
 // Validate validates a new-account request body.
 func (n *NewAccountRequest) Validate() error {
 	if n.OnlyReturnExisting && len(n.Contact) > 0 {
@@ -69,17 +91,17 @@ func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	payload, err := payloadFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	var nar NewAccountRequest
 	if err := json.Unmarshal(payload.value, &nar); err != nil {
-		api.WriteError(w, acme.WrapError(acme.ErrorMalformedType, err,
+		h.writeError(w, r, acme.WrapError(acme.ErrorMalformedType, err,
 			"failed to unmarshal new-account request payload"))
 		return
 	}
 	if err := nar.Validate(); err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -89,29 +111,43 @@ func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 		acmeErr, ok := err.(*acme.Error)
 		if !ok || acmeErr.Status != http.StatusBadRequest {
 			// Something went wrong ...
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 
 		// Account does not exist //
 		if nar.OnlyReturnExisting {
-			api.WriteError(w, acme.NewError(acme.ErrorAccountDoesNotExistType,
+			h.writeError(w, r, acme.NewError(acme.ErrorAccountDoesNotExistType,
 				"account does not exist"))
 			return
 		}
 		jwk, err := jwkFromContext(ctx)
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
+			return
+		}
+		prov, err := provisionerFromContext(ctx)
+		if err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+		contacts, err := uniqueContacts(prov, nar.Contact)
+		if err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+		if err := h.authorizeNewAccount(ctx, prov, r); err != nil {
+			h.writeError(w, r, err)
 			return
 		}
 
 		acc = &acme.Account{
 			Key:     jwk,
-			Contact: nar.Contact,
+			Contact: contacts,
 			Status:  acme.StatusValid,
 		}
 		if err := h.db.CreateAccount(ctx, acc); err != nil {
-			api.WriteError(w, acme.WrapErrorISE(err, "error creating account"))
+			h.writeError(w, r, acme.WrapErrorISE(err, "error creating account"))
 			return
 		}
 	} else {
@@ -122,7 +158,64 @@ func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 	h.linker.LinkAccount(ctx, acc)
 
 	w.Header().Set("Location", h.linker.GetLink(r.Context(), AccountLinkType, acc.ID))
-	api.JSONStatus(w, acc, httpStatus)
+	h.writeJSON(w, r, acc, httpStatus)
+}
+
+// authorizeNewAccount checks that the client is allowed to register a new
+// account if the provisioner, or the allowlist hook, restricts the
+// registration. The client must present a client certificate with one of the
+// identities in the provisioner accountIdentities, or one allowed by the hook.
+func (h *Handler) authorizeNewAccount(ctx context.Context, prov acme.Provisioner, r *http.Request) error {
+	identities := prov.GetAccountIdentities()
+	if len(identities) == 0 && h.accountAllowlist == nil {
+		return nil
+	}
+
+	var crt *x509.Certificate
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		crt = r.TLS.VerifiedChains[0][0]
+	}
+	if crt != nil {
+		for _, id := range certificateIdentities(crt) {
+			for _, allowed := range identities {
+				if id == allowed {
+					return nil
+				}
+			}
+		}
+	}
+	if h.accountAllowlist != nil {
+		ok, err := h.accountAllowlist(ctx, prov, crt)
+		if err != nil {
+			return acme.WrapErrorISE(err, "error checking the account allowlist")
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	if crt == nil {
+		return acme.NewDetailedError(acme.ErrorUnauthorizedType, "a client certificate is required to register an account")
+	}
+	return acme.NewDetailedError(acme.ErrorUnauthorizedType, "client certificate %s is not allowed to register an account", crt.Subject.CommonName)
+}
+
+// certificateIdentities returns the common name and the SANs of the given
+// certificate.
+func certificateIdentities(crt *x509.Certificate) []string {
+	var ids []string
+	if crt.Subject.CommonName != "" {
+		ids = append(ids, crt.Subject.CommonName)
+	}
+	ids = append(ids, crt.DNSNames...)
+	ids = append(ids, crt.EmailAddresses...)
+	for _, ip := range crt.IPAddresses {
+		ids = append(ids, ip.String())
+	}
+	for _, u := range crt.URIs {
+		ids = append(ids, u.String())
+	}
+	return ids
 }
 
 // GetOrUpdateAccount is the api for updating an ACME account.
@@ -130,12 +223,12 @@ func (h *Handler) GetOrUpdateAccount(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	payload, err := payloadFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -144,32 +237,69 @@ func (h *Handler) GetOrUpdateAccount(w http.ResponseWriter, r *http.Request) {
 	if !payload.isPostAsGet {
 		var uar UpdateAccountRequest
 		if err := json.Unmarshal(payload.value, &uar); err != nil {
-			api.WriteError(w, acme.WrapError(acme.ErrorMalformedType, err,
+			h.writeError(w, r, acme.WrapError(acme.ErrorMalformedType, err,
 				"failed to unmarshal new-account request payload"))
 			return
 		}
 		if err := uar.Validate(); err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 		if len(uar.Status) > 0 || len(uar.Contact) > 0 {
+			oldStatus := acc.Status
 			if len(uar.Status) > 0 {
+				if !acme.IsValidAccountStatusTransition(acc.Status, uar.Status) {
+					h.writeError(w, r, acme.NewAccountStatusTransitionError(acc.ID, acc.Status, uar.Status))
+					return
+				}
 				acc.Status = uar.Status
 			} else if len(uar.Contact) > 0 {
-				acc.Contact = uar.Contact
+				prov, err := provisionerFromContext(ctx)
+				if err != nil {
+					h.writeError(w, r, err)
+					return
+				}
+				contacts, err := uniqueContacts(prov, uar.Contact)
+				if err != nil {
+					h.writeError(w, r, err)
+					return
+				}
+				acc.Contact = contacts
 			}
 
 			if err := h.db.UpdateAccount(ctx, acc); err != nil {
-				api.WriteError(w, acme.WrapErrorISE(err, "error updating account"))
+				h.writeError(w, r, acme.WrapErrorISE(err, "error updating account"))
 				return
 			}
+			if acc.Status != oldStatus {
+				change := &acme.AccountStatusChange{
+					AccountID: acc.ID,
+					OldStatus: oldStatus,
+					NewStatus: acc.Status,
+					ChangedAt: clock.Now(),
+				}
+				if jwk, err := jwkFromContext(ctx); err == nil {
+					change.KeyThumbprint, _ = acme.KeyToID(jwk)
+				}
+				logAccountStatusChange(w, change)
+			}
 		}
 	}
 
 	h.linker.LinkAccount(ctx, acc)
 
 	w.Header().Set("Location", h.linker.GetLink(ctx, AccountLinkType, acc.ID))
-	api.JSON(w, acc)
+	h.writeJSON(w, r, acc, http.StatusOK)
+}
+
+// logAccountStatusChange adds the audit record of a change in the status of
+// an account to the request log.
+func logAccountStatusChange(w http.ResponseWriter, change *acme.AccountStatusChange) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		rl.WithFields(map[string]interface{}{
+			"accountStatusChange": change,
+		})
+	}
 }
 
 func logOrdersByAccount(w http.ResponseWriter, oids []string) {
@@ -186,22 +316,176 @@ func (h *Handler) GetOrdersByAccountID(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	accID := chi.URLParam(r, "accID")
 	if acc.ID != accID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType, "account ID '%s' does not match url param '%s'", acc.ID, accID))
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType, "account ID '%s' does not match url param '%s'", acc.ID, accID))
 		return
 	}
 	orders, err := h.db.GetOrdersByAccountID(ctx, acc.ID)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 
 	h.linker.LinkOrdersByAccountID(ctx, orders)
 
-	api.JSON(w, orders)
+	h.writeJSON(w, r, orders, http.StatusOK)
 	logOrdersByAccount(w, orders)
 }
+
+func logKeyRolloverDenied(w http.ResponseWriter, acc *acme.Account, prov acme.Provisioner) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		m := map[string]interface{}{
+			"account":     acc.ID,
+			"provisioner": prov.GetName(),
+			"keyRollover": "denied",
+		}
+		rl.WithFields(m)
+	}
+}
+
+// KeyChangeRequest is the payload of the inner JWS of a key-change request.
+type KeyChangeRequest struct {
+	Account string           `json:"account"`
+	OldKey  *jose.JSONWebKey `json:"oldKey"`
+}
+
+// keyChangeError returns a malformed error with the given detail.
+func keyChangeError(format string, args ...interface{}) *acme.Error {
+	return acme.NewDetailedError(acme.ErrorMalformedType, format, args...)
+}
+
+// validateKeyChange validates the inner JWS of a key-change request, as
+// described in RFC 8555 section 7.3.5, and returns the new key of the account.
+// The inner JWS must be signed by the new key, using the same algorithm
+// checks as the outer JWS, and its payload must reference the account and its
+// current key.
+func (h *Handler) validateKeyChange(ctx context.Context, acc *acme.Account, prov acme.Provisioner) (*jose.JSONWebKey, error) {
+	outer, err := jwsFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := payloadFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := jose.ParseJWS(string(payload.value))
+	if err != nil {
+		return nil, keyChangeError("key-change payload is not a valid jws: %v", err)
+	}
+	if len(inner.Signatures) != 1 {
+		return nil, keyChangeError("key-change inner jws must contain exactly one signature")
+	}
+	sig := inner.Signatures[0]
+	uh := sig.Unprotected
+	if len(uh.KeyID) > 0 || uh.JSONWebKey != nil || len(uh.Algorithm) > 0 || len(uh.Nonce) > 0 || len(uh.ExtraHeaders) > 0 {
+		return nil, keyChangeError("key-change inner jws must not use the unprotected header")
+	}
+	hdr := sig.Protected
+	switch {
+	case hdr.JSONWebKey == nil:
+		return nil, keyChangeError("key-change inner jws must contain a jwk header")
+	case hdr.KeyID != "":
+		return nil, keyChangeError("key-change inner jws must not contain a kid header")
+	case hdr.Nonce != "":
+		return nil, keyChangeError("key-change inner jws must not contain a nonce header")
+	}
+	outerURL, _ := outer.Signatures[0].Protected.ExtraHeaders["url"].(string)
+	innerURL, _ := hdr.ExtraHeaders["url"].(string)
+	if innerURL != outerURL {
+		return nil, keyChangeError("key-change inner jws url header %q does not match the outer jws url header %q", innerURL, outerURL)
+	}
+
+	newKey := hdr.JSONWebKey
+	if !newKey.Valid() {
+		return nil, keyChangeError("key-change inner jws jwk is not valid")
+	}
+	if err := validateJWSAlgorithm(hdr); err != nil {
+		return nil, err
+	}
+	if err := validateAllowedAlgorithm(prov, hdr.Algorithm); err != nil {
+		return nil, err
+	}
+	if err := validateKeyCurve(prov, newKey); err != nil {
+		return nil, err
+	}
+	if newKey.Algorithm != "" && newKey.Algorithm != hdr.Algorithm {
+		return nil, keyChangeError("key-change inner jws jwk and signature algorithm do not match")
+	}
+	data, err := inner.Verify(newKey)
+	if err != nil {
+		return nil, keyChangeError("key-change inner jws is not signed by the key in its jwk header")
+	}
+
+	var kcr KeyChangeRequest
+	if err := json.Unmarshal(data, &kcr); err != nil {
+		return nil, keyChangeError("key-change inner jws payload is not valid: %v", err)
+	}
+	if kid := outer.Signatures[0].Protected.KeyID; kcr.Account != kid {
+		return nil, keyChangeError("key-change account %q does not match the outer jws kid %q", kcr.Account, kid)
+	}
+	if kcr.OldKey == nil {
+		return nil, keyChangeError("key-change inner jws payload must contain the oldKey")
+	}
+	oldKeyID, err := acme.KeyToID(kcr.OldKey)
+	if err != nil {
+		return nil, keyChangeError("key-change oldKey is not valid: %v", err)
+	}
+	accKeyID, err := acme.KeyToID(acc.Key)
+	if err != nil {
+		return nil, acme.WrapErrorISE(err, "error getting KeyID from the account key")
+	}
+	if oldKeyID != accKeyID {
+		return nil, keyChangeError("key-change oldKey does not match the current key of the account")
+	}
+	newKey.KeyID, err = acme.KeyToID(newKey)
+	if err != nil {
+		return nil, acme.WrapErrorISE(err, "error getting KeyID from the new key")
+	}
+	if newKey.KeyID == accKeyID {
+		return nil, keyChangeError("key-change new key must be different from the current key of the account")
+	}
+
+	other, err := h.db.GetAccountByKeyID(ctx, newKey.KeyID)
+	switch {
+	case errors.Is(err, acme.ErrNotFound):
+		return newKey, nil
+	case err != nil:
+		return nil, acme.WrapErrorISE(err, "error looking up the account of the new key")
+	default:
+		return nil, acme.NewErrorWithStatus(acme.ErrorMalformedType, http.StatusConflict, "key-change new key is already in use by account %s", other.ID)
+	}
+}
+
+// KeyChange ACME api for changing the key of an account. Requests for
+// accounts of provisioners with key rollover disabled are explicitly rejected
+// and logged. The provisioner configuration is checked on every request, so it
+// also applies to existing accounts. Otherwise the inner JWS is validated, but
+// storing the new key is not implemented yet.
+func (h *Handler) KeyChange(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	acc, err := accountFromContext(ctx)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	prov, err := provisionerFromContext(ctx)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	if prov.IsKeyRolloverDisabled() {
+		logKeyRolloverDenied(w, acc, prov)
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
+			"key rollover is disabled for the accounts of provisioner '%s'", prov.GetName()))
+		return
+	}
+	if _, err := h.validateKeyChange(ctx, acc, prov); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.NotImplemented(w, r)
+}
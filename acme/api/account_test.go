@@ -3,18 +3,26 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/logging"
 	"go.step.sm/crypto/jose"
 )
 
@@ -290,11 +298,45 @@ func TestHandler_NewAccount(t *testing.T) {
 	prov := newProv()
 	escProvName := url.PathEscape(prov.GetName())
 	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	restrictedProv := &acme.MockProvisioner{
+		MgetName: prov.GetName,
+		MgetAccountIdentities: func() []string {
+			return []string{"client.example.com"}
+		},
+	}
+	clientCert := func(cn string, dnsNames ...string) *tls.ConnectionState {
+		crt := &x509.Certificate{
+			Subject:  pkix.Name{CommonName: cn},
+			DNSNames: dnsNames,
+		}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{crt}}}
+	}
+	newAccountContext := func(t *testing.T, p acme.Provisioner) (context.Context, *jose.JSONWebKey) {
+		b, err := json.Marshal(&NewAccountRequest{Contact: []string{"foo", "bar"}})
+		assert.FatalError(t, err)
+		jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+		assert.FatalError(t, err)
+		ctx := context.WithValue(context.Background(), payloadContextKey, &payloadInfo{value: b})
+		ctx = context.WithValue(ctx, jwkContextKey, jwk)
+		ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+		ctx = context.WithValue(ctx, provisionerContextKey, p)
+		return ctx, jwk
+	}
+	createAccount := func() *acme.MockDB {
+		return &acme.MockDB{
+			MockCreateAccount: func(ctx context.Context, acc *acme.Account) error {
+				acc.ID = "accountID"
+				return nil
+			},
+		}
+	}
 
 	type test struct {
 		db         acme.DB
 		acc        *acme.Account
 		ctx        context.Context
+		connState  *tls.ConnectionState
+		allowlist  acme.AccountAllowlistFunc
 		statusCode int
 		err        *acme.Error
 	}
@@ -386,6 +428,7 @@ func TestHandler_NewAccount(t *testing.T) {
 			assert.FatalError(t, err)
 			ctx := context.WithValue(context.Background(), payloadContextKey, &payloadInfo{value: b})
 			ctx = context.WithValue(ctx, jwkContextKey, jwk)
+			ctx = context.WithValue(ctx, provisionerContextKey, prov)
 			return test{
 				db: &acme.MockDB{
 					MockCreateAccount: func(ctx context.Context, acc *acme.Account) error {
@@ -399,6 +442,90 @@ func TestHandler_NewAccount(t *testing.T) {
 				err:        acme.NewErrorISE("force"),
 			}
 		},
+		"fail/no-client-certificate": func(t *testing.T) test {
+			ctx, _ := newAccountContext(t, restrictedProv)
+			ae := acme.NewError(acme.ErrorUnauthorizedType, "")
+			ae.Detail = "a client certificate is required to register an account"
+			return test{
+				ctx:        ctx,
+				statusCode: 401,
+				err:        ae,
+			}
+		},
+		"fail/identity-not-allowed": func(t *testing.T) test {
+			ctx, _ := newAccountContext(t, restrictedProv)
+			ae := acme.NewError(acme.ErrorUnauthorizedType, "")
+			ae.Detail = "client certificate other is not allowed to register an account"
+			return test{
+				ctx:        ctx,
+				connState:  clientCert("other", "other.example.com"),
+				statusCode: 401,
+				err:        ae,
+			}
+		},
+		"fail/allowlist-denied": func(t *testing.T) test {
+			ctx, _ := newAccountContext(t, prov)
+			ae := acme.NewError(acme.ErrorUnauthorizedType, "")
+			ae.Detail = "client certificate other is not allowed to register an account"
+			return test{
+				ctx:       ctx,
+				connState: clientCert("other"),
+				allowlist: func(ctx context.Context, p acme.Provisioner, crt *x509.Certificate) (bool, error) {
+					assert.Equals(t, p, prov)
+					assert.Equals(t, crt.Subject.CommonName, "other")
+					return false, nil
+				},
+				statusCode: 401,
+				err:        ae,
+			}
+		},
+		"fail/allowlist-error": func(t *testing.T) test {
+			ctx, _ := newAccountContext(t, prov)
+			return test{
+				ctx: ctx,
+				allowlist: func(ctx context.Context, p acme.Provisioner, crt *x509.Certificate) (bool, error) {
+					assert.Nil(t, crt)
+					return false, errors.New("force")
+				},
+				statusCode: 500,
+				err:        acme.NewErrorISE("error checking the account allowlist: force"),
+			}
+		},
+		"ok/identity-allowed": func(t *testing.T) test {
+			ctx, jwk := newAccountContext(t, restrictedProv)
+			return test{
+				db:        createAccount(),
+				ctx:       ctx,
+				connState: clientCert("client", "client.example.com"),
+				acc: &acme.Account{
+					ID:        "accountID",
+					Key:       jwk,
+					Status:    acme.StatusValid,
+					Contact:   []string{"foo", "bar"},
+					OrdersURL: fmt.Sprintf("%s/acme/%s/account/accountID/orders", baseURL.String(), escProvName),
+				},
+				statusCode: 201,
+			}
+		},
+		"ok/allowlist-allowed": func(t *testing.T) test {
+			ctx, jwk := newAccountContext(t, prov)
+			return test{
+				db:        createAccount(),
+				ctx:       ctx,
+				connState: clientCert("client"),
+				allowlist: func(ctx context.Context, p acme.Provisioner, crt *x509.Certificate) (bool, error) {
+					return crt.Subject.CommonName == "client", nil
+				},
+				acc: &acme.Account{
+					ID:        "accountID",
+					Key:       jwk,
+					Status:    acme.StatusValid,
+					Contact:   []string{"foo", "bar"},
+					OrdersURL: fmt.Sprintf("%s/acme/%s/account/accountID/orders", baseURL.String(), escProvName),
+				},
+				statusCode: 201,
+			}
+		},
 		"ok/new-account": func(t *testing.T) test {
 			nar := &NewAccountRequest{
 				Contact: []string{"foo", "bar"},
@@ -459,9 +586,10 @@ func TestHandler_NewAccount(t *testing.T) {
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
-			h := &Handler{db: tc.db, linker: NewLinker("dns", "acme")}
+			h := &Handler{db: tc.db, linker: NewLinker("dns", "acme"), accountAllowlist: tc.allowlist}
 			req := httptest.NewRequest("GET", "/foo/bar", nil)
 			req = req.WithContext(tc.ctx)
+			req.TLS = tc.connState
 			w := httptest.NewRecorder()
 			h.NewAccount(w, req)
 			res := w.Result()
@@ -693,3 +821,498 @@ func TestHandler_GetOrUpdateAccount(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_GetOrUpdateAccount_statusChange(t *testing.T) {
+	prov := newProv()
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+	thumbprint, err := acme.KeyToID(&pub)
+	assert.FatalError(t, err)
+
+	updateAccount := func(acc *acme.Account, uar *UpdateAccountRequest, db acme.DB) (*http.Response, logging.ResponseLogger) {
+		b, err := json.Marshal(uar)
+		assert.FatalError(t, err)
+		ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+		ctx = context.WithValue(ctx, accContextKey, acc)
+		ctx = context.WithValue(ctx, jwkContextKey, &pub)
+		ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+		ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+		req := httptest.NewRequest("POST", "/foo/bar", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		rl := logging.NewResponseLogger(w)
+		h := &Handler{db: db, linker: NewLinker("dns", "acme")}
+		h.GetOrUpdateAccount(rl, req)
+		return w.Result(), rl
+	}
+	readError := func(res *http.Response) *acme.Error {
+		var ae acme.Error
+		assert.FatalError(t, json.NewDecoder(res.Body).Decode(&ae))
+		return &ae
+	}
+
+	t.Run("ok/deactivate", func(t *testing.T) {
+		before := clock.Now()
+		acc := &acme.Account{ID: "accID", Status: acme.StatusValid, Key: &pub}
+		res, rl := updateAccount(acc, &UpdateAccountRequest{Status: acme.StatusDeactivated}, &acme.MockDB{
+			MockUpdateAccount: func(ctx context.Context, upd *acme.Account) error {
+				assert.Equals(t, upd.Status, acme.StatusDeactivated)
+				return nil
+			},
+		})
+		assert.Equals(t, res.StatusCode, 200)
+
+		change, ok := rl.Fields()["accountStatusChange"].(*acme.AccountStatusChange)
+		if assert.True(t, ok, "accountStatusChange not found in the request log") {
+			assert.False(t, change.ChangedAt.Before(before))
+			assert.False(t, change.ChangedAt.After(clock.Now()))
+			assert.Equals(t, change, &acme.AccountStatusChange{
+				AccountID:     "accID",
+				OldStatus:     acme.StatusValid,
+				NewStatus:     acme.StatusDeactivated,
+				KeyThumbprint: thumbprint,
+				ChangedAt:     change.ChangedAt,
+			})
+		}
+	})
+
+	t.Run("ok/update-contacts", func(t *testing.T) {
+		acc := &acme.Account{ID: "accID", Status: acme.StatusValid, Key: &pub}
+		res, rl := updateAccount(acc, &UpdateAccountRequest{Contact: []string{"mailto:admin@example.com"}}, &acme.MockDB{
+			MockUpdateAccount: func(ctx context.Context, upd *acme.Account) error {
+				return nil
+			},
+		})
+		assert.Equals(t, res.StatusCode, 200)
+		_, ok := rl.Fields()["accountStatusChange"]
+		assert.False(t, ok)
+	})
+
+	t.Run("fail/db-error", func(t *testing.T) {
+		acc := &acme.Account{ID: "accID", Status: acme.StatusValid, Key: &pub}
+		res, rl := updateAccount(acc, &UpdateAccountRequest{Status: acme.StatusDeactivated}, &acme.MockDB{
+			MockUpdateAccount: func(ctx context.Context, upd *acme.Account) error {
+				return errors.New("force")
+			},
+		})
+		assert.Equals(t, res.StatusCode, 500)
+		_, ok := rl.Fields()["accountStatusChange"]
+		assert.False(t, ok)
+	})
+
+	t.Run("fail/reactivate", func(t *testing.T) {
+		acc := &acme.Account{ID: "accID", Status: acme.StatusDeactivated, Key: &pub}
+		res, _ := updateAccount(acc, &UpdateAccountRequest{Status: acme.StatusValid}, &acme.MockDB{
+			MockUpdateAccount: func(ctx context.Context, upd *acme.Account) error {
+				t.Error("db.UpdateAccount should not be called")
+				return nil
+			},
+		})
+		assert.Equals(t, res.StatusCode, 400)
+		assert.Equals(t, readError(res).Type, "urn:ietf:params:acme:error:malformed")
+		assert.Equals(t, acc.Status, acme.StatusDeactivated)
+	})
+
+	t.Run("fail/revoked", func(t *testing.T) {
+		acc := &acme.Account{ID: "accID", Status: acme.StatusRevoked, Key: &pub}
+		res, rl := updateAccount(acc, &UpdateAccountRequest{Status: acme.StatusDeactivated}, &acme.MockDB{
+			MockUpdateAccount: func(ctx context.Context, upd *acme.Account) error {
+				t.Error("db.UpdateAccount should not be called")
+				return nil
+			},
+		})
+		assert.Equals(t, res.StatusCode, 401)
+		ae := readError(res)
+		assert.Equals(t, ae.Type, "urn:ietf:params:acme:error:unauthorized")
+		assert.Equals(t, ae.Detail, "cannot change the status of account accID from revoked to deactivated")
+		assert.Equals(t, acc.Status, acme.StatusRevoked)
+		_, ok := rl.Fields()["accountStatusChange"]
+		assert.False(t, ok)
+	})
+}
+
+func TestHandler_accountContacts(t *testing.T) {
+	prov := &acme.MockProvisioner{
+		MgetName:        func() string { return "acme" },
+		MgetMaxContacts: func() int { return 2 },
+	}
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+
+	newContext := func(payload interface{}) context.Context {
+		b, err := json.Marshal(payload)
+		assert.FatalError(t, err)
+		ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+		ctx = context.WithValue(ctx, jwkContextKey, &pub)
+		ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+		return context.WithValue(ctx, baseURLContextKey, baseURL)
+	}
+	readError := func(res *http.Response) *acme.Error {
+		var ae acme.Error
+		assert.FatalError(t, json.NewDecoder(res.Body).Decode(&ae))
+		return &ae
+	}
+
+	t.Run("ok/new-account-duplicates", func(t *testing.T) {
+		var contacts []string
+		ctx := newContext(&NewAccountRequest{Contact: []string{"foo", "bar", "foo"}})
+		req := httptest.NewRequest("POST", "/foo/bar", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h := &Handler{db: &acme.MockDB{
+			MockCreateAccount: func(ctx context.Context, acc *acme.Account) error {
+				contacts = acc.Contact
+				acc.ID = "accountID"
+				return nil
+			},
+		}, linker: NewLinker("dns", "acme")}
+		h.NewAccount(w, req)
+		assert.Equals(t, w.Result().StatusCode, 201)
+		assert.Equals(t, contacts, []string{"foo", "bar"})
+	})
+
+	t.Run("fail/new-account-too-many", func(t *testing.T) {
+		ctx := newContext(&NewAccountRequest{Contact: []string{"foo", "bar", "baz"}})
+		req := httptest.NewRequest("POST", "/foo/bar", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h := &Handler{db: &acme.MockDB{
+			MockCreateAccount: func(ctx context.Context, acc *acme.Account) error {
+				t.Error("db.CreateAccount should not be called")
+				return nil
+			},
+		}, linker: NewLinker("dns", "acme")}
+		h.NewAccount(w, req)
+		res := w.Result()
+		assert.Equals(t, res.StatusCode, 400)
+		assert.Equals(t, readError(res).Type, "urn:ietf:params:acme:error:malformed")
+	})
+
+	t.Run("ok/update-duplicates", func(t *testing.T) {
+		acc := &acme.Account{ID: "accID", Status: acme.StatusValid, Key: &pub}
+		ctx := context.WithValue(newContext(&UpdateAccountRequest{Contact: []string{"foo", "bar", "foo"}}), accContextKey, acc)
+		req := httptest.NewRequest("POST", "/foo/bar", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h := &Handler{db: &acme.MockDB{
+			MockUpdateAccount: func(ctx context.Context, upd *acme.Account) error {
+				return nil
+			},
+		}, linker: NewLinker("dns", "acme")}
+		h.GetOrUpdateAccount(w, req)
+		assert.Equals(t, w.Result().StatusCode, 200)
+		assert.Equals(t, acc.Contact, []string{"foo", "bar"})
+	})
+
+	t.Run("fail/update-too-many", func(t *testing.T) {
+		acc := &acme.Account{ID: "accID", Status: acme.StatusValid, Key: &pub, Contact: []string{"foo"}}
+		ctx := context.WithValue(newContext(&UpdateAccountRequest{Contact: []string{"foo", "bar", "baz"}}), accContextKey, acc)
+		req := httptest.NewRequest("POST", "/foo/bar", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h := &Handler{db: &acme.MockDB{
+			MockUpdateAccount: func(ctx context.Context, upd *acme.Account) error {
+				t.Error("db.UpdateAccount should not be called")
+				return nil
+			},
+		}, linker: NewLinker("dns", "acme")}
+		h.GetOrUpdateAccount(w, req)
+		res := w.Result()
+		assert.Equals(t, res.StatusCode, 400)
+		assert.Equals(t, readError(res).Type, "urn:ietf:params:acme:error:malformed")
+		assert.Equals(t, acc.Contact, []string{"foo"})
+	})
+}
+
+// mustKeyChangeJWS returns the JSON serialization of a key-change inner JWS
+// signed with the given key. The options can modify the protected headers.
+func mustKeyChangeJWS(t *testing.T, key *jose.JSONWebKey, payload interface{}, opts ...func(*jose.SignerOptions)) []byte {
+	t.Helper()
+	so := new(jose.SignerOptions)
+	so.EmbedJWK = true
+	so.WithHeader("url", "https://ca.smallstep.com/acme/acme/key-change")
+	for _, fn := range opts {
+		fn(so)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(key.Algorithm),
+		Key:       key.Key,
+	}, so)
+	assert.FatalError(t, err)
+	b, err := json.Marshal(payload)
+	assert.FatalError(t, err)
+	jws, err := signer.Sign(b)
+	assert.FatalError(t, err)
+	return []byte(jws.FullSerialize())
+}
+
+func TestHandler_KeyChange(t *testing.T) {
+	accURL := "https://ca.smallstep.com/acme/acme/account/accountID"
+	keyChangeURL := "https://ca.smallstep.com/acme/acme/key-change"
+	oldJWK, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	oldPub := oldJWK.Public()
+	newJWK, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	newPub := newJWK.Public()
+	otherJWK, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	otherPub := otherJWK.Public()
+	acc := &acme.Account{ID: "accountID", Status: "valid", Key: &oldPub}
+
+	// The outer JWS is only used for its protected headers.
+	so := new(jose.SignerOptions)
+	so.WithHeader("kid", accURL)
+	so.WithHeader("url", keyChangeURL)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: oldJWK.Key}, so)
+	assert.FatalError(t, err)
+	outer, err := signer.Sign([]byte("{}"))
+	assert.FatalError(t, err)
+	raw, err := outer.CompactSerialize()
+	assert.FatalError(t, err)
+	outer, err = jose.ParseJWS(raw)
+	assert.FatalError(t, err)
+
+	validPayload := KeyChangeRequest{Account: accURL, OldKey: &oldPub}
+	keyChangeCtx := func(prov acme.Provisioner, inner []byte) context.Context {
+		ctx := context.WithValue(context.Background(), accContextKey, acc)
+		ctx = context.WithValue(ctx, provisionerContextKey, prov)
+		ctx = context.WithValue(ctx, jwsContextKey, outer)
+		return context.WithValue(ctx, payloadContextKey, &payloadInfo{value: inner})
+	}
+	notFound := &acme.MockDB{
+		MockGetAccountByKeyID: func(ctx context.Context, kid string) (*acme.Account, error) {
+			return nil, acme.ErrNotFound
+		},
+	}
+	malformed := func(msg string) *acme.Error {
+		err := acme.NewDetailedError(acme.ErrorMalformedType, msg)
+		return err
+	}
+
+	type test struct {
+		db         acme.DB
+		ctx        context.Context
+		statusCode int
+		err        *acme.Error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/no-account": func(t *testing.T) test {
+			return test{
+				ctx:        context.Background(),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorAccountDoesNotExistType, "account does not exist"),
+			}
+		},
+		"fail/no-provisioner": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), accContextKey, acc)
+			return test{
+				ctx:        ctx,
+				statusCode: 500,
+				err:        acme.NewErrorISE("provisioner expected in request context"),
+			}
+		},
+		"fail/key-rollover-disabled": func(t *testing.T) test {
+			prov := &acme.MockProvisioner{
+				MgetName:               func() string { return "acme" },
+				MisKeyRolloverDisabled: func() bool { return true },
+			}
+			ctx := context.WithValue(context.Background(), accContextKey, acc)
+			ctx = context.WithValue(ctx, provisionerContextKey, prov)
+			return test{
+				ctx:        ctx,
+				statusCode: 401,
+				err:        acme.NewError(acme.ErrorUnauthorizedType, "key rollover is disabled for the accounts of provisioner 'acme'"),
+			}
+		},
+		"fail/payload-not-jws": func(t *testing.T) test {
+			return test{
+				ctx:        keyChangeCtx(newProv(), []byte(`{"account":"foo"}`)),
+				statusCode: 400,
+				err:        malformed("key-change payload is not a valid jws: square/go-jose: missing payload in JWS message"),
+			}
+		},
+		"fail/no-jwk": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, validPayload, func(so *jose.SignerOptions) {
+				so.EmbedJWK = false
+			})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change inner jws must contain a jwk header"),
+			}
+		},
+		"fail/kid": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, validPayload, func(so *jose.SignerOptions) {
+				so.WithHeader("kid", accURL)
+			})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change inner jws must not contain a kid header"),
+			}
+		},
+		"fail/nonce": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, validPayload, func(so *jose.SignerOptions) {
+				so.WithHeader("nonce", "the-nonce")
+			})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change inner jws must not contain a nonce header"),
+			}
+		},
+		"fail/url-mismatch": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, validPayload, func(so *jose.SignerOptions) {
+				so.WithHeader("url", accURL)
+			})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed(fmt.Sprintf("key-change inner jws url header %q does not match the outer jws url header %q", accURL, keyChangeURL)),
+			}
+		},
+		"fail/unsuitable-key": func(t *testing.T) test {
+			rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+			assert.FatalError(t, err)
+			inner := mustKeyChangeJWS(t, &jose.JSONWebKey{Key: rsaKey, Algorithm: "RS256"}, validPayload)
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorMalformedType, "rsa keys must be at least 2048 bits (256 bytes) in size"),
+			}
+		},
+		"fail/curve-not-allowed": func(t *testing.T) test {
+			prov := &acme.MockProvisioner{
+				MgetName:          func() string { return "acme" },
+				MgetAllowedCurves: func() []string { return []string{"P-384"} },
+			}
+			inner := mustKeyChangeJWS(t, newJWK, validPayload)
+			return test{
+				ctx:        keyChangeCtx(prov, inner),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorBadSignatureAlgorithmType, ""),
+			}
+		},
+		"fail/algorithm-not-allowed": func(t *testing.T) test {
+			prov := &acme.MockProvisioner{
+				MgetName:              func() string { return "acme" },
+				MgetAllowedAlgorithms: func() []string { return []string{"RS256"} },
+			}
+			inner := mustKeyChangeJWS(t, newJWK, validPayload)
+			return test{
+				ctx:        keyChangeCtx(prov, inner),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorBadSignatureAlgorithmType, ""),
+			}
+		},
+		"fail/not-signed-by-jwk": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, otherJWK, validPayload, func(so *jose.SignerOptions) {
+				so.EmbedJWK = false
+				so.WithHeader("jwk", &newPub)
+			})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change inner jws is not signed by the key in its jwk header"),
+			}
+		},
+		"fail/account-mismatch": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, KeyChangeRequest{Account: accURL + "x", OldKey: &oldPub})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed(fmt.Sprintf("key-change account %q does not match the outer jws kid %q", accURL+"x", accURL)),
+			}
+		},
+		"fail/no-old-key": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, KeyChangeRequest{Account: accURL})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change inner jws payload must contain the oldKey"),
+			}
+		},
+		"fail/old-key-mismatch": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, KeyChangeRequest{Account: accURL, OldKey: &otherPub})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change oldKey does not match the current key of the account"),
+			}
+		},
+		"fail/old-key-is-new-key": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, KeyChangeRequest{Account: accURL, OldKey: &newPub})
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change oldKey does not match the current key of the account"),
+			}
+		},
+		"fail/signed-by-old-key": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, oldJWK, validPayload)
+			return test{
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 400,
+				err:        malformed("key-change new key must be different from the current key of the account"),
+			}
+		},
+		"fail/new-key-in-use": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, validPayload)
+			return test{
+				db: &acme.MockDB{
+					MockGetAccountByKeyID: func(ctx context.Context, kid string) (*acme.Account, error) {
+						return &acme.Account{ID: "otherID"}, nil
+					},
+				},
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 409,
+				err:        malformed("key-change new key is already in use by account otherID"),
+			}
+		},
+		"fail/db.GetAccountByKeyID-error": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, validPayload)
+			return test{
+				db: &acme.MockDB{
+					MockGetAccountByKeyID: func(ctx context.Context, kid string) (*acme.Account, error) {
+						return nil, errors.New("force")
+					},
+				},
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 500,
+				err:        acme.NewErrorISE("error looking up the account of the new key"),
+			}
+		},
+		"fail/key-rollover-enabled": func(t *testing.T) test {
+			inner := mustKeyChangeJWS(t, newJWK, validPayload)
+			return test{
+				db:         notFound,
+				ctx:        keyChangeCtx(newProv(), inner),
+				statusCode: 501,
+				err:        acme.NewError(acme.ErrorNotImplementedType, "this API is not implemented"),
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			h := &Handler{db: tc.db, linker: NewLinker("dns", "acme")}
+			req := httptest.NewRequest("POST", "/foo/bar", nil)
+			req = req.WithContext(tc.ctx)
+			w := httptest.NewRecorder()
+			h.KeyChange(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tc.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			var ae acme.Error
+			assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+			assert.Equals(t, ae.Type, tc.err.Type)
+			assert.Equals(t, ae.Detail, tc.err.Detail)
+			assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+	"go.step.sm/crypto/jose"
+)
+
+// GetSignedDirectory is the ACME resource for returning the directory in a JWS
+// signed by the CA. The JWS uses the flattened JSON serialization, and its
+// protected header contains the url of the resource, and the certificate chain
+// of the signer in the x5c header, so clients can verify the directory using
+// the roots of the CA. HEAD requests only get the headers, the directory is
+// not signed.
+func (h *Handler) GetSignedDirectory(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "HEAD" {
+		w.Header().Set("Content-Type", "application/jose+json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	ctx := r.Context()
+	payload, err := json.Marshal(h.directory(ctx))
+	if err != nil {
+		h.writeError(w, r, acme.WrapErrorISE(err, "error marshaling directory"))
+		return
+	}
+
+	x5c := make([]string, len(h.directoryChain))
+	for i, crt := range h.directoryChain {
+		x5c[i] = base64.StdEncoding.EncodeToString(crt.Raw)
+	}
+	so := new(jose.SignerOptions)
+	so.WithHeader("url", h.linker.GetLink(ctx, SignedDirectoryLinkType))
+	so.WithHeader("x5c", x5c)
+	signer, err := newDirectorySigner(h.directorySigner, so)
+	if err != nil {
+		h.writeError(w, r, acme.WrapErrorISE(err, "error creating directory signer"))
+		return
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		h.writeError(w, r, acme.WrapErrorISE(err, "error signing directory"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jose+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(jws.FullSerialize()))
+}
+
+// newDirectorySigner returns a jose.Signer for the given key, the algorithm is
+// the default one for the type and size of the key.
+func newDirectorySigner(key crypto.Signer, so *jose.SignerOptions) (jose.Signer, error) {
+	var alg jose.SignatureAlgorithm
+	switch k := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().Name {
+		case "P-256":
+			alg = jose.ES256
+		case "P-384":
+			alg = jose.ES384
+		case "P-521":
+			alg = jose.ES512
+		default:
+			return nil, errors.Errorf("unsupported elliptic curve %s", k.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		alg = jose.EdDSA
+	case *rsa.PublicKey:
+		alg = jose.DefaultRSASigAlgorithm
+	default:
+		return nil, errors.Errorf("unsupported key type %T", k)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, so)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating jose.Signer")
+	}
+	return signer, nil
+}
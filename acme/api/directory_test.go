@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"go.step.sm/crypto/jose"
+)
+
+func mustDirectorySigner(t *testing.T) (crypto.Signer, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return key, crt
+}
+
+func TestHandler_GetSignedDirectory(t *testing.T) {
+	linker := NewLinker("ca.smallstep.com", "acme")
+	signer, crt := mustDirectorySigner(t)
+
+	prov := newProv()
+	provName := url.PathEscape(prov.GetName())
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+	ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+
+	expDir := Directory{
+		NewNonce:   fmt.Sprintf("%s/acme/%s/new-nonce", baseURL.String(), provName),
+		NewAccount: fmt.Sprintf("%s/acme/%s/new-account", baseURL.String(), provName),
+		NewOrder:   fmt.Sprintf("%s/acme/%s/new-order", baseURL.String(), provName),
+		RevokeCert: fmt.Sprintf("%s/acme/%s/revoke-cert", baseURL.String(), provName),
+		KeyChange:  fmt.Sprintf("%s/acme/%s/key-change", baseURL.String(), provName),
+	}
+
+	h := &Handler{
+		linker:          linker,
+		directorySigner: signer,
+		directoryChain:  []*x509.Certificate{crt},
+	}
+	req := httptest.NewRequest("GET", "/foo/bar", nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+	h.GetSignedDirectory(w, req)
+	res := w.Result()
+
+	assert.Equals(t, res.StatusCode, 200)
+	assert.Equals(t, res.Header["Content-Type"], []string{"application/jose+json"})
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.FatalError(t, err)
+
+	jws, err := jose.ParseJWS(string(body))
+	assert.FatalError(t, err)
+	if !assert.Len(t, 1, jws.Signatures) {
+		return
+	}
+	hdr := jws.Signatures[0].Protected
+	assert.Equals(t, hdr.Algorithm, jose.ES256)
+	assert.Equals(t, hdr.ExtraHeaders["url"], fmt.Sprintf("%s/acme/%s/directory.jws", baseURL.String(), provName))
+
+	// The certificate in the x5c header verifies against the roots.
+	roots := x509.NewCertPool()
+	roots.AddCert(crt)
+	chains, err := hdr.Certificates(x509.VerifyOptions{Roots: roots})
+	assert.FatalError(t, err)
+	assert.Equals(t, chains[0][0].Raw, crt.Raw)
+
+	// The signature validates against the published key.
+	payload, err := jws.Verify(crt.PublicKey)
+	assert.FatalError(t, err)
+	var dir Directory
+	assert.FatalError(t, json.Unmarshal(payload, &dir))
+	assert.Equals(t, dir, expDir)
+
+	// The signature does not validate with a different key.
+	other, _ := mustDirectorySigner(t)
+	_, err = jws.Verify(other.Public())
+	assert.NotNil(t, err)
+}
+
+func TestHandler_Route_signedDirectory(t *testing.T) {
+	signer, crt := mustDirectorySigner(t)
+	tests := []struct {
+		name       string
+		handler    *Handler
+		statusCode int
+	}{
+		{"disabled", &Handler{linker: NewLinker("dns", "acme")}, http.StatusNotFound},
+		{"enabled", &Handler{
+			linker:          NewLinker("dns", "acme"),
+			directorySigner: signer,
+			directoryChain:  []*x509.Certificate{crt},
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.handler.ca = &mockProvisionerCA{
+				loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+					assert.Equals(t, name, "acme")
+					return newProv().(*provisioner.ACME), nil
+				},
+			}
+			r := chi.NewRouter()
+			tt.handler.Route(r)
+			req := httptest.NewRequest("GET", "/acme/directory.jws", nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equals(t, w.Result().StatusCode, tt.statusCode)
+		})
+	}
+}
+
+func TestHandler_Route_globalDirectory(t *testing.T) {
+	prov := newProv()
+	provName := url.PathEscape(prov.GetName())
+	newHandler := func(defaultProvisioner string) *Handler {
+		return &Handler{
+			linker:             NewLinker("ca.smallstep.com", "acme"),
+			defaultProvisioner: defaultProvisioner,
+			db: &acme.MockDB{
+				MockCreateNonce: func(ctx context.Context) (acme.Nonce, error) {
+					return acme.Nonce("nonce"), nil
+				},
+			},
+			ca: &mockProvisionerCA{
+				loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+					if name == prov.GetName() {
+						return prov.(*provisioner.ACME), nil
+					}
+					return nil, fmt.Errorf("provisioner %s: %w", name, acme.ErrNotFound)
+				},
+			},
+		}
+	}
+	serve := func(h *Handler, method, path string) *http.Response {
+		r := chi.NewRouter()
+		h.Route(r)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Result()
+	}
+	getDirectory := func(t *testing.T, res *http.Response) Directory {
+		assert.Equals(t, res.StatusCode, http.StatusOK)
+		var dir Directory
+		assert.FatalError(t, json.NewDecoder(res.Body).Decode(&dir))
+		return dir
+	}
+
+	t.Run("ok/directory", func(t *testing.T) {
+		h := newHandler(prov.GetName())
+		dir := getDirectory(t, serve(h, "GET", "/directory"))
+		// The links are the ones of the provisioner directory.
+		assert.Equals(t, dir, getDirectory(t, serve(h, "GET", "/"+provName+"/directory")))
+		assert.True(t, strings.HasSuffix(dir.NewNonce, "/acme/"+provName+"/new-nonce"))
+		assert.True(t, strings.HasSuffix(dir.NewAccount, "/acme/"+provName+"/new-account"))
+	})
+
+	t.Run("ok/new-nonce", func(t *testing.T) {
+		h := newHandler(prov.GetName())
+		for method, status := range map[string]int{"HEAD": http.StatusOK, "GET": http.StatusNoContent} {
+			res := serve(h, method, "/new-nonce")
+			assert.Equals(t, res.StatusCode, status)
+			assert.Equals(t, res.Header.Get("Replay-Nonce"), "nonce")
+			assert.True(t, strings.HasSuffix(res.Header.Get("Link"), "/acme/"+provName+"/directory>;rel=\"index\""))
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		h := newHandler("")
+		assert.Equals(t, serve(h, "GET", "/directory").StatusCode, http.StatusNotFound)
+		assert.Equals(t, serve(h, "HEAD", "/new-nonce").StatusCode, http.StatusNotFound)
+		// The provisioner paths are always served.
+		getDirectory(t, serve(h, "GET", "/"+provName+"/directory"))
+	})
+
+	t.Run("fail/unknown-provisioner", func(t *testing.T) {
+		res := serve(newHandler("foo"), "GET", "/directory")
+		assert.Equals(t, res.StatusCode, http.StatusNotFound)
+		var ae acme.Error
+		assert.FatalError(t, json.NewDecoder(res.Body).Decode(&ae))
+		assert.Equals(t, ae.Detail, "provisioner 'foo' not found")
+	})
+}
+
+func Test_newDirectorySigner(t *testing.T) {
+	ecKey := func(c elliptic.Curve) crypto.Signer {
+		k, err := ecdsa.GenerateKey(c, rand.Reader)
+		assert.FatalError(t, err)
+		return k
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.FatalError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		want    jose.SignatureAlgorithm
+		wantErr bool
+	}{
+		{"P-256", ecKey(elliptic.P256()), jose.ES256, false},
+		{"P-384", ecKey(elliptic.P384()), jose.ES384, false},
+		{"P-521", ecKey(elliptic.P521()), jose.ES512, false},
+		{"Ed25519", edKey, jose.EdDSA, false},
+		{"RSA", rsaKey, jose.DefaultRSASigAlgorithm, false},
+		{"fail/P-224", ecKey(elliptic.P224()), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := newDirectorySigner(tt.key, new(jose.SignerOptions))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newDirectorySigner() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			jws, err := signer.Sign([]byte("{}"))
+			assert.FatalError(t, err)
+			raw, err := jws.CompactSerialize()
+			assert.FatalError(t, err)
+			jws, err = jose.ParseJWS(raw)
+			assert.FatalError(t, err)
+			assert.Equals(t, jws.Signatures[0].Protected.Algorithm, string(tt.want))
+		})
+	}
+}
@@ -1,16 +1,26 @@
 package api
 
 import (
+	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority/provisioner"
@@ -20,6 +30,35 @@ func link(url, typ string) string {
 	return fmt.Sprintf("<%s>;rel=%q", url, typ)
 }
 
+// addIndexLink adds a 'Link' response header with the directory index url. RFC
+// 8555 recommends it in the responses of all the ACME resources. The header is
+// not added twice if the addDirLink middleware already added it.
+func (h *Handler) addIndexLink(ctx context.Context, w http.ResponseWriter) {
+	indexLink := link(h.linker.GetLink(ctx, DirectoryLinkType), "index")
+	for _, v := range w.Header().Values("Link") {
+		if v == indexLink {
+			return
+		}
+	}
+	w.Header().Add("Link", indexLink)
+}
+
+// writeJSON writes the JSON response of an ACME resource with the given status
+// code, adding the 'Link' header to the directory index.
+func (h *Handler) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}, status int) {
+	h.addIndexLink(r.Context(), w)
+	api.JSONStatus(w, v, status)
+}
+
+// setRetryAfter sets the Retry-After header with the given polling interval
+// rounded up to seconds if the status is pending or processing.
+func setRetryAfter(w http.ResponseWriter, status acme.Status, d time.Duration) {
+	if d <= 0 || (status != acme.StatusPending && status != acme.StatusProcessing) {
+		return
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10))
+}
+
 // Clock that returns time in UTC rounded to seconds.
 type Clock struct{}
 
@@ -43,6 +82,16 @@ type Handler struct {
 	ca                       acme.CertificateAuthority
 	linker                   Linker
 	validateChallengeOptions *acme.ValidateChallengeOptions
+	listProvisioners         bool
+	directorySigner          crypto.Signer
+	directoryChain           []*x509.Certificate
+	pathPrefix               string
+	accountAllowlist         acme.AccountAllowlistFunc
+	strictAccept             bool
+	defaultProvisioner       string
+	validations              *validationLimiter
+	errorStatusCodes         map[acme.ProblemType]int
+	registry                 *acme.Registry
 }
 
 // HandlerOptions required to create a new ACME API request handler.
@@ -59,46 +108,198 @@ type HandlerOptions struct {
 	// E.g. https://ca.smallstep.com/acme/my-acme-provisioner/new-account --
 	// "acme" is the prefix from which the ACME api is accessed.
 	Prefix string
-	CA     acme.CertificateAuthority
+	// PathPrefix is the external path prefix added by a gateway that routes
+	// the requests to the CA removing it, e.g. "/ca" if the gateway routes
+	// https://example.com/ca/acme/... to https://ca.internal/acme/.... It is
+	// added to the ACME links and to the request URL used to validate the url
+	// header of the JWS.
+	PathPrefix string
+	CA         acme.CertificateAuthority
+	// ListProvisioners adds the names of the ACME provisioners to the error
+	// returned when a request uses an unknown provisioner. It should only be
+	// enabled in debugging environments.
+	ListProvisioners bool
+	// DirectorySigner, if set, is used to sign the directory served in
+	// /directory.jws. DirectoryChain is the certificate chain of the signer,
+	// and it's added to the x5c header of the JWS.
+	DirectorySigner crypto.Signer
+	DirectoryChain  []*x509.Certificate
+	// DNSCache, if set, is used to resolve the hosts dialed to validate the
+	// http-01 and tls-alpn-01 challenges.
+	DNSCache *acme.DNSCache
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout configure the pool
+	// of connections used to validate the http-01 challenges, if they are not
+	// set the defaults are used.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// TLSALPN01MinVersion is the minimum TLS version negotiated with the hosts
+	// validated with the tls-alpn-01 challenge, TLS 1.2 if it's not set.
+	TLSALPN01MinVersion uint16
+	// HTTP01DisableRedirects fails the http-01 validations that get a redirect.
+	// By default the redirects to http on port 80 and https on port 443 are
+	// followed, and the redirects to other ports fail the validation.
+	// HTTP01MaxRedirects is the maximum number of redirects followed, 10 if
+	// it's not set, and HTTP01RedirectSchemes restricts the schemes of the
+	// redirects, http and https if it's not set.
+	HTTP01DisableRedirects bool
+	HTTP01MaxRedirects     int
+	HTTP01RedirectSchemes  []string
+	// StrictAccept rejects with a 406 the directory requests with an Accept
+	// header that does not allow application/json. By default the directory
+	// is served as JSON regardless of the Accept header.
+	StrictAccept bool
+	// DefaultProvisioner, if set, is the name of the ACME provisioner that
+	// serves the directory and the nonces without a provisioner in the path,
+	// e.g. /acme/directory. The links in that directory point to the paths of
+	// the provisioner, and the per-provisioner paths keep working.
+	DefaultProvisioner string
+	// MaxConcurrentValidations limits the number of challenge validations
+	// running at the same time. The validations beyond the limit are deferred
+	// and run in the background as soon as possible. It is unlimited by
+	// default.
+	MaxConcurrentValidations int
+	// Context, if set, is the context of the deferred validations, they are
+	// canceled when it's done. It should be canceled when the server stops.
+	Context context.Context
+	// ErrorStatusCodes overrides the HTTP status codes of the errors of the
+	// given ACME problem types, the rest of them use the defaults of RFC 8555.
+	ErrorStatusCodes map[acme.ProblemType]int
+	// AccountAllowlist, if set, restricts the registration of new accounts in
+	// all the provisioners to the clients it allows. It is called if the
+	// client certificate does not match the accountIdentities of the
+	// provisioner.
+	AccountAllowlist acme.AccountAllowlistFunc
+	// Registry, if set, contains the custom identifier types and the key
+	// authorization of the non-standard challenges supported by the handler.
+	// Only the standard identifiers and challenges are supported if it's nil.
+	Registry *acme.Registry
 }
 
 // NewHandler returns a new ACME API handler.
 func NewHandler(ops HandlerOptions) api.RouterHandler {
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-	}
+	checkRedirect := acme.HTTP01CheckRedirect(acme.HTTP01RedirectOptions{
+		Disabled:     ops.HTTP01DisableRedirects,
+		MaxRedirects: ops.HTTP01MaxRedirects,
+		Schemes:      ops.HTTP01RedirectSchemes,
+	})
 	client := http.Client{
-		Timeout:   30 * time.Second,
-		Transport: transport,
+		Timeout:       30 * time.Second,
+		Transport:     newValidationTransport(ops),
+		CheckRedirect: checkRedirect,
 	}
 	dialer := &net.Dialer{
 		Timeout: 30 * time.Second,
 	}
+	tlsDial := func(network, addr string, config *tls.Config) (*tls.Conn, error) {
+		return tls.DialWithDialer(dialer, network, addr, config)
+	}
+	if ops.DNSCache != nil {
+		tlsDial = ops.DNSCache.TLSDial
+	}
+	prefix := ops.Prefix
+	if ops.PathPrefix != "" {
+		prefix = path.Join(ops.PathPrefix, ops.Prefix)
+	}
+	ctx := ops.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	return &Handler{
-		ca:       ops.CA,
-		db:       ops.DB,
-		backdate: ops.Backdate,
-		linker:   NewLinker(ops.DNS, ops.Prefix),
+		ca:                 ops.CA,
+		db:                 ops.DB,
+		backdate:           ops.Backdate,
+		linker:             NewLinker(ops.DNS, prefix),
+		listProvisioners:   ops.ListProvisioners,
+		directorySigner:    ops.DirectorySigner,
+		directoryChain:     ops.DirectoryChain,
+		pathPrefix:         ops.PathPrefix,
+		accountAllowlist:   ops.AccountAllowlist,
+		strictAccept:       ops.StrictAccept,
+		defaultProvisioner: ops.DefaultProvisioner,
+		validations:        newValidationLimiter(ctx, ops.MaxConcurrentValidations),
+		errorStatusCodes:   ops.ErrorStatusCodes,
+		registry:           ops.Registry,
 		validateChallengeOptions: &acme.ValidateChallengeOptions{
-			HTTPGet:   client.Get,
-			LookupTxt: net.LookupTXT,
-			TLSDial: func(network, addr string, config *tls.Config) (*tls.Conn, error) {
-				return tls.DialWithDialer(dialer, network, addr, config)
-			},
+			HTTPGet:       client.Get,
+			HTTPDo:        client.Do,
+			LookupTxt:     net.LookupTXT,
+			TLSDial:       tlsDial,
+			TLSMinVersion: ops.TLSALPN01MinVersion,
+			Registry:      ops.Registry,
+		},
+	}
+}
+
+// Default values of the pool of connections used to validate the http-01
+// challenges.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newValidationTransport returns the transport used to validate the http-01
+// challenges. The idle connections are kept in a bounded pool, and reused if
+// the same host is validated again before they time out.
+func newValidationTransport(ops HandlerOptions) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
 		},
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     defaultIdleConnTimeout,
+	}
+	if ops.DNSCache != nil {
+		transport.DialContext = ops.DNSCache.DialContext
+	}
+	if ops.MaxIdleConns > 0 {
+		transport.MaxIdleConns = ops.MaxIdleConns
+	}
+	if ops.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = ops.MaxIdleConnsPerHost
 	}
+	if ops.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = ops.IdleConnTimeout
+	}
+	return transport
 }
 
 // Route traffic and implement the Router interface.
 func (h *Handler) Route(r api.Router) {
 	getPath := h.linker.GetUnescapedPathSuffix
 	// Standard ACME API
-	r.MethodFunc("GET", getPath(NewNonceLinkType, "{provisionerID}"), h.baseURLFromRequest(h.lookupProvisioner(h.addNonce(h.addDirLink(h.GetNonce)))))
-	r.MethodFunc("HEAD", getPath(NewNonceLinkType, "{provisionerID}"), h.baseURLFromRequest(h.lookupProvisioner(h.addNonce(h.addDirLink(h.GetNonce)))))
-	r.MethodFunc("GET", getPath(DirectoryLinkType, "{provisionerID}"), h.baseURLFromRequest(h.lookupProvisioner(h.GetDirectory)))
-	r.MethodFunc("HEAD", getPath(DirectoryLinkType, "{provisionerID}"), h.baseURLFromRequest(h.lookupProvisioner(h.GetDirectory)))
+	h.handle(r, getPath(NewNonceLinkType, "{provisionerID}"), methods{
+		"GET":  h.baseURLFromRequest(h.lookupProvisioner(h.addNonce(h.addDirLink(h.GetNonce)))),
+		"HEAD": h.baseURLFromRequest(h.lookupProvisioner(h.addNonce(h.addDirLink(h.GetNonce)))),
+	})
+	h.handle(r, getPath(DirectoryLinkType, "{provisionerID}"), methods{
+		"GET":  h.baseURLFromRequest(h.lookupProvisioner(h.GetDirectory)),
+		"HEAD": h.baseURLFromRequest(h.lookupProvisioner(h.GetDirectory)),
+	})
+	if h.directorySigner != nil {
+		h.handle(r, getPath(SignedDirectoryLinkType, "{provisionerID}"), methods{
+			"GET":  h.baseURLFromRequest(h.lookupProvisioner(h.GetSignedDirectory)),
+			"HEAD": h.baseURLFromRequest(h.lookupProvisioner(h.GetSignedDirectory)),
+		})
+	}
+	// Directory and nonces of the default provisioner
+	if h.defaultProvisioner != "" {
+		h.handle(r, "/"+NewNonceLinkType.String(), methods{
+			"GET":  h.baseURLFromRequest(h.lookupDefaultProvisioner(h.addNonce(h.addDirLink(h.GetNonce)))),
+			"HEAD": h.baseURLFromRequest(h.lookupDefaultProvisioner(h.addNonce(h.addDirLink(h.GetNonce)))),
+		})
+		h.handle(r, "/"+DirectoryLinkType.String(), methods{
+			"GET":  h.baseURLFromRequest(h.lookupDefaultProvisioner(h.GetDirectory)),
+			"HEAD": h.baseURLFromRequest(h.lookupDefaultProvisioner(h.GetDirectory)),
+		})
+	}
 
 	extractPayloadByJWK := func(next nextHTTP) nextHTTP {
 		return h.baseURLFromRequest(h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.extractJWK(h.verifyAndExtractJWSPayload(next)))))))))
@@ -107,16 +308,62 @@ func (h *Handler) Route(r api.Router) {
 		return h.baseURLFromRequest(h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.lookupJWK(h.verifyAndExtractJWSPayload(next)))))))))
 	}
 
-	r.MethodFunc("POST", getPath(NewAccountLinkType, "{provisionerID}"), extractPayloadByJWK(h.NewAccount))
-	r.MethodFunc("POST", getPath(AccountLinkType, "{provisionerID}", "{accID}"), extractPayloadByKid(h.GetOrUpdateAccount))
-	r.MethodFunc("POST", getPath(KeyChangeLinkType, "{provisionerID}", "{accID}"), extractPayloadByKid(h.NotImplemented))
-	r.MethodFunc("POST", getPath(NewOrderLinkType, "{provisionerID}"), extractPayloadByKid(h.NewOrder))
-	r.MethodFunc("POST", getPath(OrderLinkType, "{provisionerID}", "{ordID}"), extractPayloadByKid(h.isPostAsGet(h.GetOrder)))
-	r.MethodFunc("POST", getPath(OrdersByAccountLinkType, "{provisionerID}", "{accID}"), extractPayloadByKid(h.isPostAsGet(h.GetOrdersByAccountID)))
-	r.MethodFunc("POST", getPath(FinalizeLinkType, "{provisionerID}", "{ordID}"), extractPayloadByKid(h.FinalizeOrder))
-	r.MethodFunc("POST", getPath(AuthzLinkType, "{provisionerID}", "{authzID}"), extractPayloadByKid(h.isPostAsGet(h.GetAuthorization)))
-	r.MethodFunc("POST", getPath(ChallengeLinkType, "{provisionerID}", "{authzID}", "{chID}"), extractPayloadByKid(h.GetChallenge))
-	r.MethodFunc("POST", getPath(CertificateLinkType, "{provisionerID}", "{certID}"), extractPayloadByKid(h.isPostAsGet(h.GetCertificate)))
+	h.handle(r, getPath(NewAccountLinkType, "{provisionerID}"), methods{"POST": h.checkMaintenance(extractPayloadByJWK(h.isJSON(h.NewAccount)))})
+	h.handle(r, getPath(AccountLinkType, "{provisionerID}", "{accID}"), methods{"POST": extractPayloadByKid(h.isJSON(h.GetOrUpdateAccount))})
+	h.handle(r, getPath(KeyChangeLinkType, "{provisionerID}", "{accID}"), methods{"POST": extractPayloadByKid(h.KeyChange)})
+	h.handle(r, getPath(NewOrderLinkType, "{provisionerID}"), methods{"POST": h.checkMaintenance(extractPayloadByKid(h.isJSON(h.NewOrder)))})
+	h.handle(r, getPath(OrderLinkType, "{provisionerID}", "{ordID}"), methods{"POST": extractPayloadByKid(h.isPostAsGet(h.GetOrder))})
+	h.handle(r, getPath(OrdersByAccountLinkType, "{provisionerID}", "{accID}"), methods{"POST": extractPayloadByKid(h.isPostAsGet(h.GetOrdersByAccountID))})
+	h.handle(r, getPath(FinalizeLinkType, "{provisionerID}", "{ordID}"), methods{"POST": h.checkMaintenance(extractPayloadByKid(h.FinalizeOrder))})
+	h.handle(r, getPath(OrderAuthorizationsLinkType, "{provisionerID}", "{ordID}"), methods{"POST": extractPayloadByKid(h.isPostAsGet(h.GetOrderAuthorizations))})
+	h.handle(r, getPath(AuthzLinkType, "{provisionerID}", "{authzID}"), methods{"POST": extractPayloadByKid(h.GetAuthorization)})
+	h.handle(r, getPath(ChallengeLinkType, "{provisionerID}", "{authzID}", "{chID}"), methods{"POST": extractPayloadByKid(h.GetChallenge)})
+	h.handle(r, getPath(CertificateLinkType, "{provisionerID}", "{certID}"), methods{"POST": extractPayloadByKid(h.isPostAsGet(h.GetCertificate))})
+}
+
+// httpMethods is the list of HTTP methods that can be routed.
+var httpMethods = []string{"CONNECT", "DELETE", "GET", "HEAD", "OPTIONS", "PATCH", "POST", "PUT", "TRACE"}
+
+// methods maps the HTTP methods allowed in an ACME resource to their handlers.
+type methods map[string]nextHTTP
+
+// handle registers the handlers of an ACME resource. Requests using any other
+// method are rejected with a 405 Method Not Allowed before they reach the
+// handlers, so clients don't get confusing errors from the JWS validation.
+func (h *Handler) handle(r api.Router, pattern string, m methods) {
+	allowed := make([]string, 0, len(m))
+	for method, next := range m {
+		r.MethodFunc(method, pattern, next)
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	notAllowed := h.methodNotAllowed(allowed)
+	for _, method := range httpMethods {
+		if _, ok := m[method]; !ok {
+			r.MethodFunc(method, pattern, notAllowed)
+		}
+	}
+}
+
+// methodNotAllowed returns a handler that writes a malformed error with the
+// 405 Method Not Allowed status code and the list of allowed methods.
+func (h *Handler) methodNotAllowed(allowed []string) nextHTTP {
+	allow := strings.Join(allowed, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := acme.NewErrorWithStatus(acme.ErrorMalformedType, http.StatusMethodNotAllowed,
+			"method %s not allowed; allowed methods are %s", r.Method, allow)
+		w.Header().Set("Allow", allow)
+		h.writeError(w, r, err)
+	}
+}
+
+// writeError writes the given error, replacing the HTTP status code of the
+// ACME errors with the one configured for their problem type.
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if ae, ok := err.(*acme.Error); ok {
+		err = ae.WithStatusCodes(h.errorStatusCodes)
+	}
+	api.WriteError(w, r, err)
 }
 
 // GetNonce just sets the right header since a Nonce is added to each response
@@ -131,11 +378,71 @@ func (h *Handler) GetNonce(w http.ResponseWriter, r *http.Request) {
 
 // Directory represents an ACME directory for configuring clients.
 type Directory struct {
-	NewNonce   string `json:"newNonce"`
-	NewAccount string `json:"newAccount"`
-	NewOrder   string `json:"newOrder"`
-	RevokeCert string `json:"revokeCert"`
-	KeyChange  string `json:"keyChange"`
+	NewNonce   string         `json:"newNonce"`
+	NewAccount string         `json:"newAccount"`
+	NewOrder   string         `json:"newOrder"`
+	RevokeCert string         `json:"revokeCert"`
+	KeyChange  string         `json:"keyChange"`
+	Meta       *DirectoryMeta `json:"meta,omitempty"`
+}
+
+// DirectoryMeta is the meta object of the ACME directory, RFC 8555 section
+// 7.1.1. It's only included if the provisioner sets any of its fields. Extra
+// are the namespaced fields configured in the provisioner, e.g.
+// "myorg:profileURL", they are serialized alongside the standard fields.
+type DirectoryMeta struct {
+	Website       string            `json:"website,omitempty"`
+	CAAIdentities []string          `json:"caaIdentities,omitempty"`
+	Extra         map[string]string `json:"-"`
+}
+
+// directoryMeta is used to serialize the standard fields of the DirectoryMeta.
+type directoryMeta DirectoryMeta
+
+// MarshalJSON implements the json.Marshaler interface, the extra fields are
+// added to the object without overriding the standard ones.
+func (m DirectoryMeta) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(directoryMeta(m))
+	if err != nil || len(m.Extra) == 0 {
+		return b, err
+	}
+	fields := make(map[string]interface{}, len(m.Extra)+2)
+	for k, v := range m.Extra {
+		fields[k] = v
+	}
+	var standard map[string]json.RawMessage
+	if err := json.Unmarshal(b, &standard); err != nil {
+		return nil, err
+	}
+	for k, v := range standard {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, the namespaced
+// fields with a string value are stored in Extra.
+func (m *DirectoryMeta) UnmarshalJSON(data []byte) error {
+	var meta directoryMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		var s string
+		if !strings.Contains(k, ":") || json.Unmarshal(v, &s) != nil {
+			continue
+		}
+		if meta.Extra == nil {
+			meta.Extra = make(map[string]string)
+		}
+		meta.Extra[k] = s
+	}
+	*m = DirectoryMeta(meta)
+	return nil
 }
 
 // ToLog enables response logging for the Directory type.
@@ -148,51 +455,142 @@ func (d *Directory) ToLog() (interface{}, error) {
 }
 
 // GetDirectory is the ACME resource for returning a directory configuration
-// for client configuration.
+// for client configuration. HEAD requests only get the headers.
 func (h *Handler) GetDirectory(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	api.JSON(w, &Directory{
+	if h.strictAccept && !acceptsMediaType(r.Header.Get("Accept"), "application/json") {
+		h.writeError(w, r, acme.NewErrorWithStatus(acme.ErrorMalformedType, http.StatusNotAcceptable, "the directory is only available as application/json"))
+		return
+	}
+	if r.Method == "HEAD" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	api.JSON(w, h.directory(r.Context()))
+}
+
+// acceptsMediaType returns true if the given Accept header allows the media
+// type. An empty header accepts any media type, and the media ranges with a
+// quality of 0 are not acceptable.
+func acceptsMediaType(accept, mediaType string) bool {
+	if accept == "" {
+		return true
+	}
+	typ := strings.SplitN(mediaType, "/", 2)[0]
+	for _, v := range strings.Split(accept, ",") {
+		mr, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(q, 64); err != nil || f == 0 {
+				continue
+			}
+		}
+		if mr == mediaType || mr == typ+"/*" || mr == "*/*" {
+			return true
+		}
+	}
+	return false
+}
+
+// directory returns the directory of the provisioner in the context.
+func (h *Handler) directory(ctx context.Context) *Directory {
+	dir := &Directory{
 		NewNonce:   h.linker.GetLink(ctx, NewNonceLinkType),
 		NewAccount: h.linker.GetLink(ctx, NewAccountLinkType),
 		NewOrder:   h.linker.GetLink(ctx, NewOrderLinkType),
 		RevokeCert: h.linker.GetLink(ctx, RevokeCertLinkType),
 		KeyChange:  h.linker.GetLink(ctx, KeyChangeLinkType),
-	})
+	}
+	if prov, err := provisionerFromContext(ctx); err == nil {
+		website, caaIdentities, extra := prov.GetWebsite(), prov.GetCAAIdentities(), prov.GetDirectoryMeta()
+		if website != "" || len(caaIdentities) > 0 || len(extra) > 0 {
+			dir.Meta = &DirectoryMeta{
+				Website:       website,
+				CAAIdentities: caaIdentities,
+				Extra:         extra,
+			}
+		}
+	}
+	return dir
 }
 
 // NotImplemented returns a 501 and is generally a placeholder for functionality which
 // MAY be added at some point in the future but is not in any way a guarantee of such.
 func (h *Handler) NotImplemented(w http.ResponseWriter, r *http.Request) {
-	api.WriteError(w, acme.NewError(acme.ErrorNotImplementedType, "this API is not implemented"))
+	h.writeError(w, r, acme.NewError(acme.ErrorNotImplementedType, "this API is not implemented"))
+}
+
+// UpdateAuthorizationRequest represents an update-authorization request.
+type UpdateAuthorizationRequest struct {
+	Status acme.Status `json:"status"`
 }
 
-// GetAuthorization ACME api for retrieving an Authz.
+// Validate validates an update-authorization request body.
+func (u *UpdateAuthorizationRequest) Validate() error {
+	if u.Status != acme.StatusDeactivated {
+		return acme.NewError(acme.ErrorMalformedType, "cannot update authorization "+
+			"status to %s, only deactivated", u.Status)
+	}
+	return nil
+}
+
+// GetAuthorization ACME api for retrieving an Authz. A POST with the status
+// deactivated deactivates the authorization.
 func (h *Handler) GetAuthorization(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	az, err := h.db.GetAuthorization(ctx, chi.URLParam(r, "authzID"))
 	if err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error retrieving authorization"))
+		h.writeError(w, r, acme.WrapErrorISE(err, "error retrieving authorization"))
 		return
 	}
 	if acc.ID != az.AccountID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
 			"account '%s' does not own authorization '%s'", acc.ID, az.ID))
 		return
 	}
+
+	payload, err := payloadFromContext(ctx)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	// The update request is validated before the status is updated, so an
+	// invalid request never changes the authorization.
+	if !payload.isPostAsGet {
+		var uar UpdateAuthorizationRequest
+		if err := json.Unmarshal(payload.value, &uar); err != nil {
+			h.writeError(w, r, acme.WrapError(acme.ErrorMalformedType, err,
+				"failed to unmarshal update-authorization request payload"))
+			return
+		}
+		if err := uar.Validate(); err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+	}
 	if err = az.UpdateStatus(ctx, h.db); err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error updating authorization status"))
+		h.writeError(w, r, acme.WrapErrorISE(err, "error updating authorization status"))
 		return
 	}
+	// If PostAsGet just respond with the authorization, otherwise deactivate it.
+	if !payload.isPostAsGet {
+		if err := az.Deactivate(ctx, h.db); err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+	}
 
 	h.linker.LinkAuthorization(ctx, az)
 
 	w.Header().Set("Location", h.linker.GetLink(ctx, AuthzLinkType, az.ID))
-	api.JSON(w, az)
+	h.writeJSON(w, r, az, http.StatusOK)
 }
 
 // GetChallenge ACME api for retrieving a Challenge.
@@ -200,14 +598,14 @@ func (h *Handler) GetChallenge(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	// Just verify that the payload was set, since we're not strictly adhering
 	// to ACME V2 spec for reasons specified below.
 	_, err = payloadFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -220,22 +618,33 @@ func (h *Handler) GetChallenge(w http.ResponseWriter, r *http.Request) {
 	azID := chi.URLParam(r, "authzID")
 	ch, err := h.db.GetChallenge(ctx, chi.URLParam(r, "chID"), azID)
 	if err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error retrieving challenge"))
+		h.writeError(w, r, acme.WrapErrorISE(err, "error retrieving challenge"))
 		return
 	}
 	ch.AuthorizationID = azID
 	if acc.ID != ch.AccountID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
 			"account '%s' does not own challenge '%s'", acc.ID, ch.ID))
 		return
 	}
+	prov, err := provisionerFromContext(ctx)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
 	jwk, err := jwkFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
-	if err = ch.Validate(ctx, h.db, jwk, h.validateChallengeOptions); err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error validating challenge"))
+	var vo acme.ValidateChallengeOptions
+	if h.validateChallengeOptions != nil {
+		vo = *h.validateChallengeOptions
+	}
+	vo.HistorySize = prov.GetChallengeHistorySize()
+	vo.HTTPHeaders = prov.GetHTTP01Headers()
+	if err = h.validateChallenge(ctx, w, ch, prov, jwk, &vo); err != nil {
+		h.writeError(w, r, acme.WrapErrorISE(err, "error validating challenge"))
 		return
 	}
 
@@ -243,7 +652,8 @@ func (h *Handler) GetChallenge(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Add("Link", link(h.linker.GetLink(ctx, AuthzLinkType, azID), "up"))
 	w.Header().Set("Location", h.linker.GetLink(ctx, ChallengeLinkType, azID, ch.ID))
-	api.JSON(w, ch)
+	setRetryAfter(w, ch.Status, prov.GetChallengeRetryAfter())
+	h.writeJSON(w, r, ch, http.StatusOK)
 }
 
 // GetCertificate ACME api for retrieving a Certificate.
@@ -251,31 +661,68 @@ func (h *Handler) GetCertificate(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	certID := chi.URLParam(r, "certID")
 
 	cert, err := h.db.GetCertificate(ctx, certID)
 	if err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error retrieving certificate"))
+		h.writeError(w, r, acme.WrapErrorISE(err, "error retrieving certificate"))
 		return
 	}
 	if cert.AccountID != acc.ID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
 			"account '%s' does not own certificate '%s'", acc.ID, certID))
 		return
 	}
 
-	var certBytes []byte
-	for _, c := range append([]*x509.Certificate{cert.Leaf}, cert.Intermediates...) {
-		certBytes = append(certBytes, pem.EncodeToMemory(&pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: c.Raw,
-		})...)
-	}
+	chain := append([]*x509.Certificate{cert.Leaf}, cert.Intermediates...)
 
 	api.LogCertificate(w, cert.Leaf)
+	h.addIndexLink(ctx, w)
 	w.Header().Set("Content-Type", "application/pem-certificate-chain; charset=utf-8")
-	w.Write(certBytes)
+	w.Header().Set("Content-Length", strconv.Itoa(pemChainSize(chain)))
+	w.WriteHeader(http.StatusOK)
+
+	// The status is already sent, an error writing the chain can only be
+	// logged, the client will get a response shorter than its Content-Length.
+	if err := writePEMChain(w, chain); err != nil {
+		api.LogError(w, errors.Wrap(err, "error writing certificate chain"))
+	}
+}
+
+// pemCertificateSize is the size of the PEM armor of a certificate, the
+// "-----BEGIN CERTIFICATE-----\n" and "-----END CERTIFICATE-----\n" lines.
+const pemCertificateSize = 28 + 26
+
+// pemChainSize returns the size of the given chain encoded with pem.Encode,
+// without encoding it.
+func pemChainSize(chain []*x509.Certificate) int {
+	var size int
+	for _, c := range chain {
+		// The base64 body is split in lines of 64 characters.
+		n := base64.StdEncoding.EncodedLen(len(c.Raw))
+		size += pemCertificateSize + n + (n+63)/64
+	}
+	return size
+}
+
+// writePEMChain writes the given chain to the response one certificate at a
+// time, flushing the response after each one, so large chains are never
+// completely buffered in memory.
+func writePEMChain(w http.ResponseWriter, chain []*x509.Certificate) error {
+	flusher, _ := w.(http.Flusher)
+	for _, c := range chain {
+		if err := pem.Encode(w, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c.Raw,
+		}); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
 }
@@ -8,9 +8,11 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,10 +20,55 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/authority/provisioner"
 	"go.step.sm/crypto/jose"
 	"go.step.sm/crypto/pemutil"
 )
 
+func TestHandler_Route_methodNotAllowed(t *testing.T) {
+	r := chi.NewRouter()
+	h := &Handler{linker: NewLinker("dns", "acme")}
+	h.Route(r)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		allow  string
+	}{
+		{"new-order/GET", "GET", "/acme/new-order", "POST"},
+		{"new-order/HEAD", "HEAD", "/acme/new-order", "POST"},
+		{"new-account/PUT", "PUT", "/acme/new-account", "POST"},
+		{"order/GET", "GET", "/acme/order/ordID", "POST"},
+		{"finalize/GET", "GET", "/acme/order/ordID/finalize", "POST"},
+		{"challenge/GET", "GET", "/acme/challenge/azID/chID", "POST"},
+		{"certificate/DELETE", "DELETE", "/acme/certificate/certID", "POST"},
+		{"new-nonce/POST", "POST", "/acme/new-nonce", "GET, HEAD"},
+		{"directory/POST", "POST", "/acme/directory", "GET, HEAD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, http.StatusMethodNotAllowed)
+			assert.Equals(t, res.Header["Allow"], []string{tt.allow})
+			assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+			if tt.method != "HEAD" {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, acme.NewError(acme.ErrorMalformedType, "").Type)
+			}
+		})
+	}
+}
+
 func TestHandler_GetNonce(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -67,8 +114,10 @@ func TestHandler_GetDirectory(t *testing.T) {
 	}
 
 	type test struct {
-		statusCode int
-		err        *acme.Error
+		accept       string
+		strictAccept bool
+		statusCode   int
+		err          *acme.Error
 	}
 	var tests = map[string]func(t *testing.T) test{
 		"ok": func(t *testing.T) test {
@@ -76,13 +125,61 @@ func TestHandler_GetDirectory(t *testing.T) {
 				statusCode: 200,
 			}
 		},
+		"ok/accept": func(t *testing.T) test {
+			return test{
+				accept:       "application/json",
+				strictAccept: true,
+				statusCode:   200,
+			}
+		},
+		"ok/accept-range": func(t *testing.T) test {
+			return test{
+				accept:       "text/html;q=0.9, application/*;q=0.5",
+				strictAccept: true,
+				statusCode:   200,
+			}
+		},
+		"ok/accept-any": func(t *testing.T) test {
+			return test{
+				accept:       "*/*",
+				strictAccept: true,
+				statusCode:   200,
+			}
+		},
+		"ok/incompatible-accept-not-strict": func(t *testing.T) test {
+			return test{
+				accept:     "text/html",
+				statusCode: 200,
+			}
+		},
+		"fail/incompatible-accept": func(t *testing.T) test {
+			err := acme.NewDetailedError(acme.ErrorMalformedType, "the directory is only available as application/json")
+			return test{
+				accept:       "text/html, application/xml",
+				strictAccept: true,
+				statusCode:   406,
+				err:          err,
+			}
+		},
+		"fail/accept-quality-zero": func(t *testing.T) test {
+			err := acme.NewDetailedError(acme.ErrorMalformedType, "the directory is only available as application/json")
+			return test{
+				accept:       "text/html, application/json;q=0",
+				strictAccept: true,
+				statusCode:   406,
+				err:          err,
+			}
+		},
 	}
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
-			h := &Handler{linker: linker}
+			h := &Handler{linker: linker, strictAccept: tc.strictAccept}
 			req := httptest.NewRequest("GET", "/foo/bar", nil)
 			req = req.WithContext(ctx)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
 			w := httptest.NewRecorder()
 			h.GetDirectory(w, req)
 			res := w.Result()
@@ -112,6 +209,199 @@ func TestHandler_GetDirectory(t *testing.T) {
 	}
 }
 
+func TestHandler_GetDirectory_meta(t *testing.T) {
+	linker := NewLinker("ca.smallstep.com", "acme")
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	extra := map[string]string{
+		"myorg:profileURL": "https://ca.example.com/profile",
+		"myorg:tier":       "gold",
+	}
+
+	tests := []struct {
+		name string
+		prov acme.Provisioner
+		want *DirectoryMeta
+	}{
+		{"ok/no-meta", newProv(), nil},
+		{"ok/website", &acme.MockProvisioner{
+			MgetName:    func() string { return "acme" },
+			MgetWebsite: func() string { return "https://ca.example.com/docs" },
+		}, &DirectoryMeta{Website: "https://ca.example.com/docs"}},
+		{"ok/caa-identities", &acme.MockProvisioner{
+			MgetName:          func() string { return "acme" },
+			MgetCAAIdentities: func() []string { return []string{"ca.example.com", "example.com"} },
+		}, &DirectoryMeta{CAAIdentities: []string{"ca.example.com", "example.com"}}},
+		{"ok/all", &acme.MockProvisioner{
+			MgetName:          func() string { return "acme" },
+			MgetWebsite:       func() string { return "https://ca.example.com/docs" },
+			MgetCAAIdentities: func() []string { return []string{"ca.example.com"} },
+		}, &DirectoryMeta{Website: "https://ca.example.com/docs", CAAIdentities: []string{"ca.example.com"}}},
+		{"ok/extra", &acme.MockProvisioner{
+			MgetName:          func() string { return "acme" },
+			MgetDirectoryMeta: func() map[string]string { return extra },
+		}, &DirectoryMeta{Extra: extra}},
+		{"ok/all-extra", &acme.MockProvisioner{
+			MgetName:          func() string { return "acme" },
+			MgetWebsite:       func() string { return "https://ca.example.com/docs" },
+			MgetCAAIdentities: func() []string { return []string{"ca.example.com"} },
+			MgetDirectoryMeta: func() map[string]string { return extra },
+		}, &DirectoryMeta{
+			Website:       "https://ca.example.com/docs",
+			CAAIdentities: []string{"ca.example.com"},
+			Extra:         extra,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), provisionerContextKey, tt.prov)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			h := &Handler{linker: linker}
+			req := httptest.NewRequest("GET", "/foo/bar", nil)
+			req = req.WithContext(ctx)
+			w := httptest.NewRecorder()
+			h.GetDirectory(w, req)
+			res := w.Result()
+			assert.Equals(t, res.StatusCode, 200)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			var dir Directory
+			assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &dir))
+			assert.Equals(t, dir.Meta, tt.want)
+
+			// The meta object is omitted if it's empty.
+			var raw map[string]json.RawMessage
+			assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &raw))
+			_, ok := raw["meta"]
+			assert.Equals(t, ok, tt.want != nil)
+		})
+	}
+}
+
+func TestDirectoryMeta_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		meta DirectoryMeta
+		want string
+	}{
+		{"ok/standard", DirectoryMeta{Website: "https://ca.example.com/docs"}, `{"website":"https://ca.example.com/docs"}`},
+		{"ok/extra", DirectoryMeta{
+			Website: "https://ca.example.com/docs",
+			Extra:   map[string]string{"myorg:profileURL": "https://ca.example.com/profile"},
+		}, `{"myorg:profileURL":"https://ca.example.com/profile","website":"https://ca.example.com/docs"}`},
+		{"ok/extra-does-not-override", DirectoryMeta{
+			CAAIdentities: []string{"ca.example.com"},
+			Extra:         map[string]string{"caaIdentities": "foo", "myorg:tier": "gold"},
+		}, `{"caaIdentities":["ca.example.com"],"myorg:tier":"gold"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(&tt.meta)
+			assert.FatalError(t, err)
+			assert.Equals(t, string(b), tt.want)
+
+			// The standard fields are parsed as usual.
+			var raw struct {
+				Website       string   `json:"website"`
+				CAAIdentities []string `json:"caaIdentities"`
+			}
+			assert.FatalError(t, json.Unmarshal(b, &raw))
+			assert.Equals(t, raw.Website, tt.meta.Website)
+			assert.Equals(t, raw.CAAIdentities, tt.meta.CAAIdentities)
+		})
+	}
+}
+
+func TestHandler_Route_head(t *testing.T) {
+	signer, crt := mustDirectorySigner(t)
+	var nonces int32
+	h := &Handler{
+		linker: NewLinker("dns", "acme"),
+		db: &acme.MockDB{
+			MockCreateNonce: func(ctx context.Context) (acme.Nonce, error) {
+				atomic.AddInt32(&nonces, 1)
+				return acme.Nonce("the-nonce"), nil
+			},
+		},
+		ca: &mockProvisionerCA{
+			loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+				assert.Equals(t, name, "acme")
+				return newProv().(*provisioner.ACME), nil
+			},
+		},
+		directorySigner: signer,
+		directoryChain:  []*x509.Certificate{crt},
+	}
+	r := chi.NewRouter()
+	h.Route(r)
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		nonce       string
+	}{
+		{"new-nonce", "/acme/new-nonce", "", "the-nonce"},
+		{"directory", "/acme/directory", "application/json", ""},
+		{"signed-directory", "/acme/directory.jws", "application/jose+json", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&nonces, 0)
+			req := httptest.NewRequest("HEAD", tt.path, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, http.StatusOK)
+			assert.Equals(t, res.Header.Get("Content-Type"), tt.contentType)
+			assert.Equals(t, res.Header.Get("Replay-Nonce"), tt.nonce)
+			if tt.nonce != "" {
+				assert.Equals(t, atomic.LoadInt32(&nonces), int32(1))
+			}
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+			assert.Equals(t, len(body), 0)
+		})
+	}
+}
+
+func TestNewHandler_pathPrefix(t *testing.T) {
+	prov := newProv()
+	provName := url.PathEscape(prov.GetName())
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+	ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+
+	h := NewHandler(HandlerOptions{
+		DNS:        "ca.smallstep.com",
+		Prefix:     "acme",
+		PathPrefix: "/ca",
+	}).(*Handler)
+	assert.Equals(t, h.pathPrefix, "/ca")
+	assert.Equals(t, h.directory(ctx), &Directory{
+		NewNonce:   fmt.Sprintf("%s/ca/acme/%s/new-nonce", baseURL.String(), provName),
+		NewAccount: fmt.Sprintf("%s/ca/acme/%s/new-account", baseURL.String(), provName),
+		NewOrder:   fmt.Sprintf("%s/ca/acme/%s/new-order", baseURL.String(), provName),
+		RevokeCert: fmt.Sprintf("%s/ca/acme/%s/revoke-cert", baseURL.String(), provName),
+		KeyChange:  fmt.Sprintf("%s/ca/acme/%s/key-change", baseURL.String(), provName),
+	})
+	assert.Equals(t, h.linker.GetLink(ctx, AccountLinkType, "accID"),
+		fmt.Sprintf("%s/ca/acme/%s/account/accID", baseURL.String(), provName))
+	assert.Equals(t, h.linker.GetLink(ctx, ChallengeLinkType, "authzID", "chID"),
+		fmt.Sprintf("%s/ca/acme/%s/challenge/authzID/chID", baseURL.String(), provName))
+
+	// Without a path prefix the links are not changed.
+	h = NewHandler(HandlerOptions{DNS: "ca.smallstep.com", Prefix: "acme"}).(*Handler)
+	assert.Equals(t, h.pathPrefix, "")
+	assert.Equals(t, h.linker.GetLink(ctx, NewOrderLinkType),
+		fmt.Sprintf("%s/acme/%s/new-order", baseURL.String(), provName))
+}
+
 func TestHandler_GetAuthorization(t *testing.T) {
 	expiry := time.Now().UTC().Add(6 * time.Hour)
 	az := acme.Authorization{
@@ -237,6 +527,7 @@ func TestHandler_GetAuthorization(t *testing.T) {
 			ctx = context.WithValue(ctx, accContextKey, acc)
 			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
 			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{isPostAsGet: true})
 			return test{
 				db: &acme.MockDB{
 					MockGetAuthorization: func(ctx context.Context, id string) (*acme.Authorization, error) {
@@ -287,6 +578,105 @@ func TestHandler_GetAuthorization(t *testing.T) {
 	}
 }
 
+func TestHandler_GetAuthorization_deactivate(t *testing.T) {
+	prov := newProv()
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("authzID", "authzID")
+	deactivate := []byte(`{"status":"deactivated"}`)
+
+	newAuthz := func(status acme.Status) *acme.Authorization {
+		return &acme.Authorization{
+			ID:         "authzID",
+			AccountID:  "accID",
+			Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+			Status:     status,
+			ExpiresAt:  time.Now().UTC().Add(6 * time.Hour),
+			Challenges: []*acme.Challenge{
+				{ID: "chHTTPID", Type: "http-01", Status: acme.StatusPending, Token: "tok"},
+				{ID: "chDNSID", Type: "dns-01", Status: acme.StatusValid, Token: "tok"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		accID          string
+		payload        []byte
+		status         acme.Status
+		statusCode     int
+		errType        acme.ProblemType
+		wantChallenges []acme.Status
+	}{
+		{"ok/pending", "accID", deactivate, acme.StatusPending, 200, 0, []acme.Status{acme.StatusInvalid, acme.StatusValid}},
+		{"ok/valid", "accID", deactivate, acme.StatusValid, 200, 0, []acme.Status{acme.StatusInvalid, acme.StatusValid}},
+		{"ok/deactivated", "accID", deactivate, acme.StatusDeactivated, 200, 0, nil},
+		{"fail/unauthorized", "otherID", deactivate, acme.StatusPending, 401, acme.ErrorUnauthorizedType, nil},
+		{"fail/invalid-status", "accID", []byte(`{"status":"valid"}`), acme.StatusPending, 400, acme.ErrorMalformedType, nil},
+		{"fail/invalid-json", "accID", []byte(`{"status":`), acme.StatusPending, 400, acme.ErrorMalformedType, nil},
+		{"fail/invalid-authorization", "accID", deactivate, acme.StatusInvalid, 400, acme.ErrorMalformedType, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			az := newAuthz(tt.status)
+			var updatedAz *acme.Authorization
+			var updatedChallenges []string
+			db := &acme.MockDB{
+				MockGetAuthorization: func(ctx context.Context, id string) (*acme.Authorization, error) {
+					return az, nil
+				},
+				MockUpdateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+					updatedAz = az
+					return nil
+				},
+				MockUpdateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+					updatedChallenges = append(updatedChallenges, ch.ID)
+					return nil
+				},
+			}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: tt.accID})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: tt.payload})
+
+			h := &Handler{db: db, linker: NewLinker("dns", "acme")}
+			req := httptest.NewRequest("POST", "/foo/bar", nil)
+			w := httptest.NewRecorder()
+			h.GetAuthorization(w, req.WithContext(ctx))
+			res := w.Result()
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+			if tt.statusCode >= 400 {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, acme.NewError(tt.errType, "").Type)
+				assert.Nil(t, updatedAz)
+				assert.Len(t, 0, updatedChallenges)
+				return
+			}
+
+			var got acme.Authorization
+			assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &got))
+			assert.Equals(t, got.Status, acme.StatusDeactivated)
+			if tt.status == acme.StatusDeactivated {
+				assert.Nil(t, updatedAz)
+				return
+			}
+			if assert.NotNil(t, updatedAz) {
+				assert.Equals(t, updatedAz.Status, acme.StatusDeactivated)
+			}
+			assert.Equals(t, updatedChallenges, []string{"chHTTPID"})
+			for i, ch := range got.Challenges {
+				assert.Equals(t, ch.Status, tt.wantChallenges[i])
+			}
+		})
+	}
+}
+
 func TestHandler_GetCertificate(t *testing.T) {
 	leaf, err := pemutil.ReadCertificate("../../authority/testdata/certs/foo.crt")
 	assert.FatalError(t, err)
@@ -372,7 +762,9 @@ func TestHandler_GetCertificate(t *testing.T) {
 		},
 		"ok": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
-			ctx := context.WithValue(context.Background(), accContextKey, acc)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
 			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
 			return test{
 				db: &acme.MockDB{
@@ -395,7 +787,7 @@ func TestHandler_GetCertificate(t *testing.T) {
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
-			h := &Handler{db: tc.db}
+			h := &Handler{db: tc.db, linker: NewLinker("dns", "acme")}
 			req := httptest.NewRequest("GET", u, nil)
 			req = req.WithContext(tc.ctx)
 			w := httptest.NewRecorder()
@@ -420,11 +812,118 @@ func TestHandler_GetCertificate(t *testing.T) {
 			} else {
 				assert.Equals(t, bytes.TrimSpace(body), bytes.TrimSpace(certBytes))
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/pem-certificate-chain; charset=utf-8"})
+				assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL.String(), provName)})
 			}
 		})
 	}
 }
 
+// flushRecorder is an httptest.ResponseRecorder that records the size of the
+// body on each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes = append(r.flushes, r.Body.Len())
+	r.ResponseRecorder.Flush()
+}
+
+// failingResponseWriter is an http.ResponseWriter that fails after writing n
+// bytes.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *failingResponseWriter) Write(b []byte) (int, error) {
+	if w.Body.Len()+len(b) > w.n {
+		return 0, errors.New("force")
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestHandler_GetCertificate_longChain(t *testing.T) {
+	leaf, err := pemutil.ReadCertificate("../../authority/testdata/certs/foo.crt")
+	assert.FatalError(t, err)
+
+	// Synthetic intermediates of different sizes, only the raw bytes are
+	// written.
+	want := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	offsets := []int{len(want)}
+	intermediates := make([]*x509.Certificate, 500)
+	for i := range intermediates {
+		raw := bytes.Repeat([]byte{byte(i)}, 1000+i*7)
+		intermediates[i] = &x509.Certificate{Raw: raw}
+		want = append(want, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})...)
+		offsets = append(offsets, len(want))
+	}
+
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("certID", "certID")
+	ctx := context.WithValue(context.Background(), provisionerContextKey, newProv())
+	ctx = context.WithValue(ctx, baseURLContextKey, &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"})
+	ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "accID"})
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+	h := &Handler{linker: NewLinker("dns", "acme"), db: &acme.MockDB{
+		MockGetCertificate: func(ctx context.Context, id string) (*acme.Certificate, error) {
+			return &acme.Certificate{
+				ID:            id,
+				AccountID:     "accID",
+				Leaf:          leaf,
+				Intermediates: intermediates,
+			}, nil
+		},
+	}}
+
+	t.Run("ok", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "https://test.ca.smallstep.com/acme/certificate/certID", nil)
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.GetCertificate(w, req.WithContext(ctx))
+		res := w.Result()
+
+		assert.Equals(t, res.StatusCode, 200)
+		assert.Equals(t, res.Header.Get("Content-Type"), "application/pem-certificate-chain; charset=utf-8")
+		assert.Equals(t, res.Header.Get("Content-Length"), fmt.Sprint(len(want)))
+		body, err := io.ReadAll(res.Body)
+		assert.FatalError(t, err)
+		assert.Equals(t, body, want)
+
+		// The response is flushed after each certificate.
+		assert.Equals(t, w.flushes, offsets)
+	})
+
+	t.Run("fail/write", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "https://test.ca.smallstep.com/acme/certificate/certID", nil)
+		w := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder(), n: len(want) / 2}
+		h.GetCertificate(w, req.WithContext(ctx))
+		res := w.Result()
+
+		// The headers are already sent, so the client gets a body shorter
+		// than the Content-Length.
+		assert.Equals(t, res.StatusCode, 200)
+		assert.Equals(t, res.Header.Get("Content-Length"), fmt.Sprint(len(want)))
+		body, err := io.ReadAll(res.Body)
+		assert.FatalError(t, err)
+		assert.True(t, len(body) < len(want))
+		assert.True(t, bytes.HasPrefix(want, body))
+	})
+}
+
+func Test_pemChainSize(t *testing.T) {
+	var chain []*x509.Certificate
+	var want []byte
+	for i := 0; i < 200; i++ {
+		raw := bytes.Repeat([]byte{0xff}, i)
+		chain = append(chain, &x509.Certificate{Raw: raw})
+		want = append(want, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})...)
+		assert.Equals(t, pemChainSize(chain[i:]), len(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})))
+	}
+	assert.Equals(t, pemChainSize(nil), 0)
+	assert.Equals(t, pemChainSize(chain), len(want))
+}
+
 func TestHandler_GetChallenge(t *testing.T) {
 	chiCtx := chi.NewRouteContext()
 	chiCtx.URLParams.Add("chID", "chID")
@@ -443,6 +942,7 @@ func TestHandler_GetChallenge(t *testing.T) {
 		ctx        context.Context
 		statusCode int
 		ch         *acme.Challenge
+		retryAfter []string
 		err        *acme.Error
 	}
 	var tests = map[string]func(t *testing.T) test{
@@ -645,6 +1145,98 @@ func TestHandler_GetChallenge(t *testing.T) {
 				},
 				ctx:        ctx,
 				statusCode: 200,
+				retryAfter: []string{"5"},
+			}
+		},
+		"ok/configured-retry-after": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			p := newProv().(*provisioner.ACME)
+			p.ChallengeRetryAfter = &provisioner.Duration{Duration: 1500 * time.Millisecond}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{isEmptyJSON: true})
+			_jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			_pub := _jwk.Public()
+			ctx = context.WithValue(ctx, jwkContextKey, &_pub)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetChallenge: func(ctx context.Context, chID, azID string) (*acme.Challenge, error) {
+						assert.Equals(t, chID, "chID")
+						assert.Equals(t, azID, "authzID")
+						return &acme.Challenge{
+							ID:        "chID",
+							Status:    acme.StatusPending,
+							Type:      acme.HTTP01,
+							AccountID: "accID",
+						}, nil
+					},
+					MockUpdateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						assert.Equals(t, ch.Status, acme.StatusPending)
+						assert.Equals(t, ch.Type, acme.HTTP01)
+						assert.Equals(t, ch.AccountID, "accID")
+						assert.Equals(t, ch.AuthorizationID, "authzID")
+						assert.HasSuffix(t, ch.Error.Type, acme.ErrorConnectionType.String())
+						return nil
+					},
+				},
+				ch: &acme.Challenge{
+					ID:              "chID",
+					Status:          acme.StatusPending,
+					AuthorizationID: "authzID",
+					Type:            acme.HTTP01,
+					AccountID:       "accID",
+					URL:             u,
+					Error:           acme.NewError(acme.ErrorConnectionType, "force"),
+				},
+				vco: &acme.ValidateChallengeOptions{
+					HTTPGet: func(string) (*http.Response, error) {
+						return nil, errors.New("force")
+					},
+				},
+				ctx:        ctx,
+				statusCode: 200,
+				retryAfter: []string{"2"},
+			}
+		},
+		"ok/valid": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{isEmptyJSON: true})
+			_jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			_pub := _jwk.Public()
+			ctx = context.WithValue(ctx, jwkContextKey, &_pub)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetChallenge: func(ctx context.Context, chID, azID string) (*acme.Challenge, error) {
+						assert.Equals(t, chID, "chID")
+						assert.Equals(t, azID, "authzID")
+						return &acme.Challenge{
+							ID:          "chID",
+							Status:      acme.StatusValid,
+							Type:        acme.HTTP01,
+							AccountID:   "accID",
+							ValidatedAt: "2021-01-01T00:00:00Z",
+						}, nil
+					},
+				},
+				ch: &acme.Challenge{
+					ID:              "chID",
+					Status:          acme.StatusValid,
+					AuthorizationID: "authzID",
+					Type:            acme.HTTP01,
+					AccountID:       "accID",
+					URL:             u,
+					ValidatedAt:     "2021-01-01T00:00:00Z",
+				},
+				ctx:        ctx,
+				statusCode: 200,
 			}
 		},
 	}
@@ -677,10 +1269,66 @@ func TestHandler_GetChallenge(t *testing.T) {
 				expB, err := json.Marshal(tc.ch)
 				assert.FatalError(t, err)
 				assert.Equals(t, bytes.TrimSpace(body), expB)
-				assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<%s/acme/%s/authz/%s>;rel=\"up\"", baseURL, provName, "authzID")})
+				assert.Equals(t, res.Header["Link"], []string{
+					fmt.Sprintf("<%s/acme/%s/authz/%s>;rel=\"up\"", baseURL, provName, "authzID"),
+					fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL, provName),
+				})
 				assert.Equals(t, res.Header["Location"], []string{u})
+				assert.Equals(t, res.Header["Retry-After"], tc.retryAfter)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/json"})
 			}
 		})
 	}
 }
+
+func Test_newValidationTransport(t *testing.T) {
+	tests := []struct {
+		name                string
+		ops                 HandlerOptions
+		maxIdleConns        int
+		maxIdleConnsPerHost int
+		idleConnTimeout     time.Duration
+	}{
+		{"defaults", HandlerOptions{}, 100, 2, 90 * time.Second},
+		{"options", HandlerOptions{
+			MaxIdleConns: 1000, MaxIdleConnsPerHost: 10, IdleConnTimeout: time.Minute,
+		}, 1000, 10, time.Minute},
+		{"dnsCache", HandlerOptions{
+			DNSCache: acme.NewDNSCache(0, 0, 0, nil),
+		}, 100, 2, 90 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newValidationTransport(tt.ops)
+			assert.Equals(t, tr.MaxIdleConns, tt.maxIdleConns)
+			assert.Equals(t, tr.MaxIdleConnsPerHost, tt.maxIdleConnsPerHost)
+			assert.Equals(t, tr.IdleConnTimeout, tt.idleConnTimeout)
+			assert.True(t, tr.TLSClientConfig.InsecureSkipVerify)
+			assert.NotNil(t, tr.DialContext)
+		})
+	}
+}
+
+func Test_newValidationTransport_reusesConnections(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: newValidationTransport(HandlerOptions{})}
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(srv.URL)
+		assert.FatalError(t, err)
+		_, err = io.ReadAll(res.Body)
+		assert.FatalError(t, err)
+		res.Body.Close()
+	}
+	assert.Equals(t, atomic.LoadInt32(&conns), int32(1))
+}
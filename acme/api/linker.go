@@ -33,7 +33,7 @@ type linker struct {
 
 func (l *linker) GetUnescapedPathSuffix(typ LinkType, provisionerName string, inputs ...string) string {
 	switch typ {
-	case NewNonceLinkType, NewAccountLinkType, NewOrderLinkType, NewAuthzLinkType, DirectoryLinkType, KeyChangeLinkType, RevokeCertLinkType:
+	case NewNonceLinkType, NewAccountLinkType, NewOrderLinkType, NewAuthzLinkType, DirectoryLinkType, SignedDirectoryLinkType, KeyChangeLinkType, RevokeCertLinkType:
 		return fmt.Sprintf("/%s/%s", provisionerName, typ)
 	case AccountLinkType, OrderLinkType, AuthzLinkType, CertificateLinkType:
 		return fmt.Sprintf("/%s/%s/%s", provisionerName, typ, inputs[0])
@@ -43,6 +43,8 @@ func (l *linker) GetUnescapedPathSuffix(typ LinkType, provisionerName string, in
 		return fmt.Sprintf("/%s/%s/%s/orders", provisionerName, AccountLinkType, inputs[0])
 	case FinalizeLinkType:
 		return fmt.Sprintf("/%s/%s/%s/finalize", provisionerName, OrderLinkType, inputs[0])
+	case OrderAuthorizationsLinkType:
+		return fmt.Sprintf("/%s/%s/%s/authorizations", provisionerName, OrderLinkType, inputs[0])
 	default:
 		return ""
 	}
@@ -111,6 +113,10 @@ const (
 	RevokeCertLinkType
 	// KeyChangeLinkType key rollover
 	KeyChangeLinkType
+	// SignedDirectoryLinkType signed directory
+	SignedDirectoryLinkType
+	// OrderAuthorizationsLinkType list of authorizations of an order
+	OrderAuthorizationsLinkType
 )
 
 func (l LinkType) String() string {
@@ -139,6 +145,8 @@ func (l LinkType) String() string {
 		return "revoke-cert"
 	case KeyChangeLinkType:
 		return "key-change"
+	case SignedDirectoryLinkType:
+		return "directory.jws"
 	default:
 		return fmt.Sprintf("unexpected LinkType '%d'", int(l))
 	}
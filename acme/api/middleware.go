@@ -2,17 +2,27 @@ package api
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/smallstep/certificates/acme"
-	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
 	"github.com/smallstep/certificates/logging"
 	"github.com/smallstep/nosql"
 	"go.step.sm/crypto/jose"
@@ -62,9 +72,13 @@ func (h *Handler) baseURLFromRequest(next nextHTTP) nextHTTP {
 // addNonce is a middleware that adds a nonce to the response header.
 func (h *Handler) addNonce(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
-		nonce, err := h.db.CreateNonce(r.Context())
+		var nonce acme.Nonce
+		err := retryNonce(r.Context(), func() (err error) {
+			nonce, err = h.db.CreateNonce(r.Context())
+			return
+		})
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 		w.Header().Set("Replay-Nonce", string(nonce))
@@ -74,11 +88,39 @@ func (h *Handler) addNonce(next nextHTTP) nextHTTP {
 	}
 }
 
+// Maximum number of attempts, and initial backoff, of the nonce operations
+// that fail with a transient error.
+const (
+	nonceMaxAttempts  = 3
+	nonceRetryBackoff = 10 * time.Millisecond
+)
+
+// retryNonce calls fn until it succeeds, it fails with an error that is not
+// transient, as defined by apiv1.IsTransient, or the attempts are exhausted.
+// The wait between attempts is a random time up to a backoff that doubles
+// after each attempt, so the requests contending for the database do not retry
+// all at once.
+func retryNonce(ctx context.Context, fn func() error) error {
+	backoff := nonceRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= nonceMaxAttempts || !kmsapi.IsTransient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff))) + 1):
+		}
+		backoff *= 2
+	}
+}
+
 // addDirLink is a middleware that adds a 'Link' response reader with the
 // directory index url.
 func (h *Handler) addDirLink(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Link", link(h.linker.GetLink(r.Context(), DirectoryLinkType), "index"))
+		h.addIndexLink(r.Context(), w)
 		next(w, r)
 	}
 }
@@ -90,7 +132,7 @@ func (h *Handler) verifyContentType(next nextHTTP) nextHTTP {
 		var expected []string
 		p, err := provisionerFromContext(r.Context())
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 
@@ -110,22 +152,25 @@ func (h *Handler) verifyContentType(next nextHTTP) nextHTTP {
 				return
 			}
 		}
-		api.WriteError(w, acme.NewError(acme.ErrorMalformedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorMalformedType,
 			"expected content-type to be in %s, but got %s", expected, ct))
 	}
 }
 
 // parseJWS is a middleware that parses a request body into a JSONWebSignature struct.
+// It accepts the flattened JSON serialization required by RFC 8555, as well as
+// the general JSON and the compact serializations. The number of signatures is
+// checked by validateJWS.
 func (h *Handler) parseJWS(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			api.WriteError(w, acme.WrapErrorISE(err, "failed to read request body"))
+			h.writeError(w, r, acme.WrapErrorISE(err, "failed to read request body"))
 			return
 		}
 		jws, err := jose.ParseJWS(string(body))
 		if err != nil {
-			api.WriteError(w, acme.WrapError(acme.ErrorMalformedType, err, "failed to parse JWS from request body"))
+			h.writeError(w, r, acme.WrapError(acme.ErrorMalformedType, err, "failed to parse JWS from request body"))
 			return
 		}
 		ctx := context.WithValue(r.Context(), jwsContextKey, jws)
@@ -133,6 +178,11 @@ func (h *Handler) parseJWS(next nextHTTP) nextHTTP {
 	}
 }
 
+// supportedCritical contains the JWS header parameters that can be listed in
+// the crit header. ACME does not define any JWS extension, so any extension
+// marked as critical is rejected.
+var supportedCritical = map[string]bool{}
+
 // validateJWS checks the request body for to verify that it meets ACME
 // requirements for a JWS.
 //
@@ -153,15 +203,15 @@ func (h *Handler) validateJWS(next nextHTTP) nextHTTP {
 		ctx := r.Context()
 		jws, err := jwsFromContext(r.Context())
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 		if len(jws.Signatures) == 0 {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "request body does not contain a signature"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "request body does not contain a signature"))
 			return
 		}
 		if len(jws.Signatures) > 1 {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "request body contains more than one signature"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "request body contains more than one signature"))
 			return
 		}
 
@@ -172,65 +222,251 @@ func (h *Handler) validateJWS(next nextHTTP) nextHTTP {
 			len(uh.Algorithm) > 0 ||
 			len(uh.Nonce) > 0 ||
 			len(uh.ExtraHeaders) > 0 {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "unprotected header must not be used"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "unprotected header must not be used"))
 			return
 		}
 		hdr := sig.Protected
-		switch hdr.Algorithm {
-		case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
-			if hdr.JSONWebKey != nil {
-				switch k := hdr.JSONWebKey.Key.(type) {
-				case *rsa.PublicKey:
-					if k.Size() < keyutil.MinRSAKeyBytes {
-						api.WriteError(w, acme.NewError(acme.ErrorMalformedType,
-							"rsa keys must be at least %d bits (%d bytes) in size",
-							8*keyutil.MinRSAKeyBytes, keyutil.MinRSAKeyBytes))
-						return
-					}
-				default:
-					api.WriteError(w, acme.NewError(acme.ErrorMalformedType,
-						"jws key type and algorithm do not match"))
+		if crit, ok := hdr.ExtraHeaders["crit"]; ok {
+			names, ok := crit.([]interface{})
+			if !ok {
+				h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "jws crit header must be an array of strings"))
+				return
+			}
+			for _, v := range names {
+				name, ok := v.(string)
+				if !ok {
+					h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "jws crit header must be an array of strings"))
+					return
+				}
+				if !supportedCritical[name] {
+					h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "jws crit header contains unsupported extension %s", name))
 					return
 				}
 			}
-		case jose.ES256, jose.ES384, jose.ES512, jose.EdDSA:
-			// we good
-		default:
-			api.WriteError(w, acme.NewError(acme.ErrorBadSignatureAlgorithmType, "unsuitable algorithm: %s", hdr.Algorithm))
+		}
+		if err := validateJWSAlgorithm(hdr); err != nil {
+			h.writeError(w, r, err)
 			return
 		}
+		// The provisioner is always in the context of the ACME requests, see
+		// lookupProvisioner.
+		if prov, ok := ctx.Value(provisionerContextKey).(acme.Provisioner); ok {
+			if err := validateAllowedAlgorithm(prov, hdr.Algorithm); err != nil {
+				h.writeError(w, r, err)
+				return
+			}
+		}
 
 		// Check the validity/freshness of the Nonce.
-		if err := h.db.DeleteNonce(ctx, acme.Nonce(hdr.Nonce)); err != nil {
-			api.WriteError(w, err)
+		if err := retryNonce(ctx, func() error {
+			return h.db.DeleteNonce(ctx, acme.Nonce(hdr.Nonce))
+		}); err != nil {
+			h.writeError(w, r, err)
 			return
 		}
 
 		// Check that the JWS url matches the requested url.
 		jwsURL, ok := hdr.ExtraHeaders["url"].(string)
 		if !ok {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "jws missing url protected header"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "jws missing url protected header"))
 			return
 		}
-		reqURL := &url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path}
-		if jwsURL != reqURL.String() {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType,
+		reqURL := &url.URL{Scheme: "https", Host: r.Host, Path: h.pathPrefix + r.URL.Path, RawQuery: r.URL.RawQuery}
+		if !equalURLs(jwsURL, reqURL.String()) {
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType,
 				"url header in JWS (%s) does not match request url (%s)", jwsURL, reqURL))
 			return
 		}
 
 		if hdr.JSONWebKey != nil && len(hdr.KeyID) > 0 {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "jwk and kid are mutually exclusive"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "jwk and kid are mutually exclusive"))
 			return
 		}
 		if hdr.JSONWebKey == nil && hdr.KeyID == "" {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "either jwk or kid must be defined in jws protected header"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "either jwk or kid must be defined in jws protected header"))
 			return
 		}
 		next(w, r)
 	}
 }
 
+// validateJWSAlgorithm returns an error if the algorithm of the JWS is not
+// supported, or if it does not match the type and size of the jwk, if any.
+func validateJWSAlgorithm(hdr jose.Header) error {
+	switch hdr.Algorithm {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		if hdr.JSONWebKey != nil {
+			switch k := hdr.JSONWebKey.Key.(type) {
+			case *rsa.PublicKey:
+				if k.Size() < keyutil.MinRSAKeyBytes {
+					return acme.NewError(acme.ErrorMalformedType,
+						"rsa keys must be at least %d bits (%d bytes) in size",
+						8*keyutil.MinRSAKeyBytes, keyutil.MinRSAKeyBytes)
+				}
+			default:
+				return acme.NewError(acme.ErrorMalformedType,
+					"jws key type and algorithm do not match")
+			}
+		}
+	case jose.ES256, jose.ES384, jose.ES512:
+		if hdr.JSONWebKey != nil {
+			k, ok := hdr.JSONWebKey.Key.(*ecdsa.PublicKey)
+			if !ok || k.Curve.Params().Name != ecdsaAlgorithmCurves[hdr.Algorithm] {
+				return acme.NewError(acme.ErrorMalformedType,
+					"jws key type and algorithm do not match")
+			}
+		}
+	case jose.EdDSA:
+		// we good
+	default:
+		return acme.NewError(acme.ErrorBadSignatureAlgorithmType, "unsuitable algorithm: %s", hdr.Algorithm)
+	}
+	return nil
+}
+
+// ecdsaAlgorithmCurves maps the ECDSA signature algorithms to the curve of the
+// keys that can use them.
+var ecdsaAlgorithmCurves = map[string]string{
+	jose.ES256: "P-256",
+	jose.ES384: "P-384",
+	jose.ES512: "P-521",
+}
+
+// validateAllowedAlgorithm returns an error if the given JWS algorithm is not
+// allowed by the provisioner.
+func validateAllowedAlgorithm(prov acme.Provisioner, alg string) error {
+	allowed := prov.GetAllowedAlgorithms()
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, a := range allowed {
+		if a == alg {
+			return nil
+		}
+	}
+	return acme.NewError(acme.ErrorBadSignatureAlgorithmType,
+		"jws algorithm %s is not allowed; allowed algorithms are %s", alg, strings.Join(allowed, ", "))
+}
+
+// validateKeyCurve returns an error if the key is an ECDSA or Ed25519 key with
+// a curve that is not allowed by the provisioner.
+func validateKeyCurve(prov acme.Provisioner, jwk *jose.JSONWebKey) error {
+	allowed := prov.GetAllowedCurves()
+	if len(allowed) == 0 {
+		return nil
+	}
+	var crv string
+	switch k := jwk.Key.(type) {
+	case *ecdsa.PublicKey:
+		crv = k.Curve.Params().Name
+	case ed25519.PublicKey:
+		crv = "Ed25519"
+	default:
+		return nil
+	}
+	for _, c := range allowed {
+		if c == crv {
+			return nil
+		}
+	}
+	return acme.NewError(acme.ErrorBadSignatureAlgorithmType,
+		"jws key curve %s is not allowed; allowed curves are %s", crv, strings.Join(allowed, ", "))
+}
+
+// equalURLs reports whether the two given URLs are semantically equal. Both
+// URLs are canonicalized before comparing them, see canonicalURL.
+func equalURLs(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ca, ok := canonicalURL(a)
+	if !ok {
+		return false
+	}
+	cb, ok := canonicalURL(b)
+	if !ok {
+		return false
+	}
+	return ca == cb
+}
+
+// canonicalURL returns a canonical representation of the given URL. The
+// scheme and host are lowercased, default ports are removed, percent-encoded
+// unreserved characters are decoded and trailing slashes are removed from
+// the path. The raw query is kept as it is, so it must match exactly. The
+// second return value is false if the URL cannot be parsed or if it is not
+// absolute.
+func canonicalURL(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	switch port := u.Port(); {
+	case port == "":
+	case scheme == "https" && port == "443":
+	case scheme == "http" && port == "80":
+	default:
+		host += ":" + port
+	}
+	path := strings.TrimRight(decodeUnreserved(u.EscapedPath()), "/")
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return scheme + "://" + host + path, true
+}
+
+// decodeUnreserved decodes the percent-encoded octets of s that represent an
+// unreserved character as defined in RFC 3986, section 2.3. Other
+// percent-encodings are normalized to use uppercase hexadecimal digits.
+func decodeUnreserved(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		hi, ok1 := unhex(s[i+1])
+		lo, ok2 := unhex(s[i+2])
+		if !ok1 || !ok2 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		c := hi<<4 | lo
+		if isUnreserved(c) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return sb.String()
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func isUnreserved(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
 // extractJWK is a middleware that extracts the JWK from the JWS and saves it
 // in the context. Make sure to parse and validate the JWS before running this
 // middleware.
@@ -239,23 +475,32 @@ func (h *Handler) extractJWK(next nextHTTP) nextHTTP {
 		ctx := r.Context()
 		jws, err := jwsFromContext(r.Context())
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 		jwk := jws.Signatures[0].Protected.JSONWebKey
 		if jwk == nil {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "jwk expected in protected header"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "jwk expected in protected header"))
 			return
 		}
 		if !jwk.Valid() {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "invalid jwk in protected header"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "invalid jwk in protected header"))
+			return
+		}
+		prov, err := provisionerFromContext(ctx)
+		if err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+		if err := validateKeyCurve(prov, jwk); err != nil {
+			h.writeError(w, r, err)
 			return
 		}
 
 		// Overwrite KeyID with the JWK thumbprint.
 		jwk.KeyID, err = acme.KeyToID(jwk)
 		if err != nil {
-			api.WriteError(w, acme.WrapErrorISE(err, "error getting KeyID from JWK"))
+			h.writeError(w, r, acme.WrapErrorISE(err, "error getting KeyID from JWK"))
 			return
 		}
 
@@ -269,11 +514,11 @@ func (h *Handler) extractJWK(next nextHTTP) nextHTTP {
 			// For NewAccount requests ...
 			break
 		case err != nil:
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		default:
 			if !acc.IsValid() {
-				api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType, "account is not active"))
+				h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType, "account is not active"))
 				return
 			}
 			ctx = context.WithValue(ctx, accContextKey, acc)
@@ -283,7 +528,7 @@ func (h *Handler) extractJWK(next nextHTTP) nextHTTP {
 }
 
 // lookupProvisioner loads the provisioner associated with the request.
-// Responsds 404 if the provisioner does not exist.
+// Responds 404 with a malformed error if the provisioner does not exist.
 func (h *Handler) lookupProvisioner(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -291,24 +536,96 @@ func (h *Handler) lookupProvisioner(next nextHTTP) nextHTTP {
 		nameEscaped := chi.URLParam(r, "provisionerID")
 		name, err := url.PathUnescape(nameEscaped)
 		if err != nil {
-			api.WriteError(w, acme.WrapErrorISE(err, "error url unescaping provisioner name '%s'", nameEscaped))
+			h.writeError(w, r, acme.WrapErrorISE(err, "error url unescaping provisioner name '%s'", nameEscaped))
 			return
 		}
-		p, err := h.ca.LoadProvisionerByName(name)
+		acmeProv, err := h.loadACMEProvisioner(name)
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
-		acmeProv, ok := p.(*provisioner.ACME)
-		if !ok {
-			api.WriteError(w, acme.NewError(acme.ErrorAccountDoesNotExistType, "provisioner must be of type ACME"))
+		ctx = context.WithValue(ctx, provisionerContextKey, acme.Provisioner(acmeProv))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// lookupDefaultProvisioner loads the default provisioner, used in the paths
+// without a provisioner name, and stores it in the context.
+func (h *Handler) lookupDefaultProvisioner(next nextHTTP) nextHTTP {
+	return func(w http.ResponseWriter, r *http.Request) {
+		acmeProv, err := h.loadACMEProvisioner(h.defaultProvisioner)
+		if err != nil {
+			h.writeError(w, r, err)
 			return
 		}
-		ctx = context.WithValue(ctx, provisionerContextKey, acme.Provisioner(acmeProv))
+		ctx := context.WithValue(r.Context(), provisionerContextKey, acme.Provisioner(acmeProv))
 		next(w, r.WithContext(ctx))
 	}
 }
 
+// loadACMEProvisioner returns the enabled ACME provisioner with the given
+// name.
+func (h *Handler) loadACMEProvisioner(name string) (*provisioner.ACME, error) {
+	p, err := h.ca.LoadProvisionerByName(name)
+	switch {
+	case isNotFound(err):
+		return nil, h.unknownProvisionerError(name)
+	case err != nil:
+		return nil, acme.WrapErrorISE(err, "error loading provisioner '%s'", name)
+	}
+	acmeProv, ok := p.(*provisioner.ACME)
+	if !ok {
+		return nil, acme.NewError(acme.ErrorAccountDoesNotExistType, "provisioner must be of type ACME")
+	}
+	if !acmeProv.IsEnabled() {
+		return nil, acme.NewErrorWithStatus(acme.ErrorUnauthorizedType, http.StatusForbidden, "provisioner '%s' is disabled", name)
+	}
+	return acmeProv, nil
+}
+
+// isNotFound returns true if the error is acme.ErrNotFound, or an error with
+// the 404 Not Found status code, like the one returned by the authority when a
+// provisioner does not exist.
+func isNotFound(err error) bool {
+	if errors.Is(err, acme.ErrNotFound) {
+		return true
+	}
+	var sc errs.StatusCoder
+	return errors.As(err, &sc) && sc.StatusCode() == http.StatusNotFound
+}
+
+// unknownProvisionerError returns the error used when the provisioner in the
+// url does not exist. If the handler is configured to list the provisioners,
+// the names of the ACME provisioners are added to the detail.
+func (h *Handler) unknownProvisionerError(name string) *acme.Error {
+	ae := acme.NewErrorWithStatus(acme.ErrorMalformedType, http.StatusNotFound, "provisioner '%s' not found", name)
+	lister, ok := h.ca.(acme.ProvisionerLister)
+	if !h.listProvisioners || !ok {
+		return ae
+	}
+
+	var names []string
+	cursor := ""
+	for {
+		list, next, err := lister.GetProvisioners(cursor, provisioner.DefaultProvisionersMax)
+		if err != nil {
+			return ae
+		}
+		for _, p := range list {
+			if p.GetType() == provisioner.TypeACME {
+				names = append(names, p.GetName())
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(names)
+	ae.Detail += fmt.Sprintf("; valid ACME provisioners are: %s", strings.Join(names, ", "))
+	return ae
+}
+
 // lookupJWK loads the JWK associated with the acme account referenced by the
 // kid parameter of the signed payload.
 // Make sure to parse and validate the JWS before running this middleware.
@@ -317,14 +634,14 @@ func (h *Handler) lookupJWK(next nextHTTP) nextHTTP {
 		ctx := r.Context()
 		jws, err := jwsFromContext(ctx)
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 
 		kidPrefix := h.linker.GetLink(ctx, AccountLinkType, "")
 		kid := jws.Signatures[0].Protected.KeyID
 		if !strings.HasPrefix(kid, kidPrefix) {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType,
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType,
 				"kid does not have required prefix; expected %s, but got %s",
 				kidPrefix, kid))
 			return
@@ -334,14 +651,23 @@ func (h *Handler) lookupJWK(next nextHTTP) nextHTTP {
 		acc, err := h.db.GetAccount(ctx, accID)
 		switch {
 		case nosql.IsErrNotFound(err):
-			api.WriteError(w, acme.NewError(acme.ErrorAccountDoesNotExistType, "account with ID '%s' not found", accID))
+			h.writeError(w, r, acme.NewError(acme.ErrorAccountDoesNotExistType, "account with ID '%s' not found", accID))
 			return
 		case err != nil:
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		default:
 			if !acc.IsValid() {
-				api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType, "account is not active"))
+				h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType, "account is not active"))
+				return
+			}
+			prov, err := provisionerFromContext(ctx)
+			if err != nil {
+				h.writeError(w, r, err)
+				return
+			}
+			if err := validateKeyCurve(prov, acc.Key); err != nil {
+				h.writeError(w, r, err)
 				return
 			}
 			ctx = context.WithValue(ctx, accContextKey, acc)
@@ -359,21 +685,21 @@ func (h *Handler) verifyAndExtractJWSPayload(next nextHTTP) nextHTTP {
 		ctx := r.Context()
 		jws, err := jwsFromContext(ctx)
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 		jwk, err := jwkFromContext(ctx)
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 		if jwk.Algorithm != "" && jwk.Algorithm != jws.Signatures[0].Protected.Algorithm {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "verifier and signature algorithm do not match"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "verifier and signature algorithm do not match"))
 			return
 		}
 		payload, err := jws.Verify(jwk)
 		if err != nil {
-			api.WriteError(w, acme.WrapError(acme.ErrorMalformedType, err, "error verifying jws"))
+			h.writeError(w, r, acme.WrapError(acme.ErrorMalformedType, err, "error verifying jws"))
 			return
 		}
 		ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{
@@ -390,17 +716,63 @@ func (h *Handler) isPostAsGet(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
 		payload, err := payloadFromContext(r.Context())
 		if err != nil {
-			api.WriteError(w, err)
+			h.writeError(w, r, err)
 			return
 		}
 		if !payload.isPostAsGet {
-			api.WriteError(w, acme.NewError(acme.ErrorMalformedType, "expected POST-as-GET"))
+			h.writeError(w, r, acme.NewError(acme.ErrorMalformedType, "expected POST-as-GET"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isJSON asserts that the payload of a request is a JSON document, so a
+// malformed payload is rejected with a clear error instead of failing when it
+// is unmarshaled. POST-as-GET requests (empty JWS payload) are allowed.
+func (h *Handler) isJSON(next nextHTTP) nextHTTP {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, err := payloadFromContext(r.Context())
+		if err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+		if !payload.isPostAsGet && !json.Valid(payload.value) {
+			h.writeError(w, r, acme.NewDetailedError(acme.ErrorMalformedType, "jws payload is not a valid JSON document"))
 			return
 		}
 		next(w, r)
 	}
 }
 
+// defaultMaintenanceRetryAfter is the Retry-After sent to the clients while
+// the CA is in maintenance mode, if the maintenance does not define one.
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+// checkMaintenance is a middleware that rejects the requests with a 503
+// Service Unavailable while the CA is in maintenance mode. It's used in the
+// endpoints that create accounts, orders or certificates, the rest of the
+// endpoints keep working during the maintenance.
+func (h *Handler) checkMaintenance(next nextHTTP) nextHTTP {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mc, ok := h.ca.(acme.MaintenanceChecker)
+		if !ok {
+			next(w, r)
+			return
+		}
+		enabled, retryAfter := mc.GetMaintenance()
+		if !enabled {
+			next(w, r)
+			return
+		}
+		if retryAfter <= 0 {
+			retryAfter = defaultMaintenanceRetryAfter
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+		h.writeError(w, r, acme.NewErrorWithStatus(acme.ErrorServerInternalType, http.StatusServiceUnavailable, "the certificate authority is in maintenance mode"))
+	}
+}
+
 // ContextKey is the key type for storing and searching for ACME request
 // essentials in the context of a request.
 type ContextKey string
@@ -13,10 +13,16 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/authority/provisioner"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
 	"github.com/smallstep/nosql/database"
 	"go.step.sm/crypto/jose"
 )
@@ -169,6 +175,82 @@ func TestHandler_addNonce(t *testing.T) {
 	}
 }
 
+func TestHandler_addNonce_transientError(t *testing.T) {
+	u := "https://ca.smallstep.com/acme/new-nonce"
+	conflict := kmsapi.ErrTransient{Err: errors.New("write conflict")}
+	tests := []struct {
+		name       string
+		errs       []error
+		statusCode int
+		calls      int
+	}{
+		{"ok/conflict-once", []error{conflict}, 200, 2},
+		{"fail/conflict-exhausted", []error{conflict, conflict, conflict}, 500, nonceMaxAttempts},
+		{"fail/not-transient", []error{errors.New("force"), conflict}, 500, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			h := &Handler{db: &acme.MockDB{
+				MockCreateNonce: func(ctx context.Context) (acme.Nonce, error) {
+					calls++
+					if calls <= len(tt.errs) {
+						return "", tt.errs[calls-1]
+					}
+					return "bar", nil
+				},
+			}}
+			req := httptest.NewRequest("GET", u, nil)
+			w := httptest.NewRecorder()
+			h.addNonce(testNext)(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+			assert.Equals(t, calls, tt.calls)
+			if tt.statusCode == 200 {
+				assert.Equals(t, res.Header["Replay-Nonce"], []string{"bar"})
+			}
+		})
+	}
+}
+
+func TestHandler_validateJWS_transientNonceError(t *testing.T) {
+	u := "https://ca.smallstep.com/acme/account/1234"
+	jws := &jose.JSONWebSignature{
+		Signatures: []jose.Signature{
+			{
+				Protected: jose.Header{
+					Algorithm: jose.ES256,
+					KeyID:     "bar",
+					Nonce:     "nonce",
+					ExtraHeaders: map[jose.HeaderKey]interface{}{
+						"url": u,
+					},
+				},
+			},
+		},
+	}
+	var calls int
+	h := &Handler{db: &acme.MockDB{
+		MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+			assert.Equals(t, n, acme.Nonce("nonce"))
+			calls++
+			if calls == 1 {
+				return kmsapi.ErrTransient{Err: errors.New("write conflict")}
+			}
+			return nil
+		},
+	}}
+	req := httptest.NewRequest("GET", u, nil)
+	req = req.WithContext(context.WithValue(context.Background(), jwsContextKey, jws))
+	w := httptest.NewRecorder()
+	h.validateJWS(testNext)(w, req)
+	res := w.Result()
+
+	assert.Equals(t, res.StatusCode, 200)
+	assert.Equals(t, calls, 2)
+}
+
 func TestHandler_addDirLink(t *testing.T) {
 	prov := newProv()
 	provName := url.PathEscape(prov.GetName())
@@ -176,14 +258,16 @@ func TestHandler_addDirLink(t *testing.T) {
 	type test struct {
 		link       string
 		linker     Linker
+		next       func(h *Handler) nextHTTP
+		body       []byte
 		statusCode int
 		ctx        context.Context
 		err        *acme.Error
 	}
+	ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+	ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
 	var tests = map[string]func(t *testing.T) test{
 		"ok": func(t *testing.T) test {
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
-			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
 			return test{
 				linker:     NewLinker("dns", "acme"),
 				ctx:        ctx,
@@ -191,18 +275,51 @@ func TestHandler_addDirLink(t *testing.T) {
 				statusCode: 200,
 			}
 		},
+		"ok/write-json": func(t *testing.T) test {
+			return test{
+				linker: NewLinker("dns", "acme"),
+				next: func(h *Handler) nextHTTP {
+					return func(w http.ResponseWriter, r *http.Request) {
+						h.writeJSON(w, r, json.RawMessage(`{"foo":"bar"}`), http.StatusOK)
+					}
+				},
+				body:       []byte(`{"foo":"bar"}`),
+				ctx:        ctx,
+				link:       fmt.Sprintf("%s/acme/%s/directory", baseURL.String(), provName),
+				statusCode: 200,
+			}
+		},
+		"fail/error-response": func(t *testing.T) test {
+			return test{
+				linker: NewLinker("dns", "acme"),
+				next: func(h *Handler) nextHTTP {
+					return func(w http.ResponseWriter, r *http.Request) {
+						api.WriteError(w, r, acme.NewError(acme.ErrorMalformedType, "force"))
+					}
+				},
+				ctx:        ctx,
+				link:       fmt.Sprintf("%s/acme/%s/directory", baseURL.String(), provName),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorMalformedType, "force"),
+			}
+		},
 	}
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
 			h := &Handler{linker: tc.linker}
+			next, want := testNext, testBody
+			if tc.next != nil {
+				next, want = tc.next(h), tc.body
+			}
 			req := httptest.NewRequest("GET", "/foo", nil)
 			req = req.WithContext(tc.ctx)
 			w := httptest.NewRecorder()
-			h.addDirLink(testNext)(w, req)
+			h.addDirLink(next)(w, req)
 			res := w.Result()
 
 			assert.Equals(t, res.StatusCode, tc.statusCode)
+			assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<%s>;rel=\"index\"", tc.link)})
 
 			body, err := io.ReadAll(res.Body)
 			res.Body.Close()
@@ -218,8 +335,7 @@ func TestHandler_addDirLink(t *testing.T) {
 				assert.Equals(t, ae.Subproblems, tc.err.Subproblems)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
 			} else {
-				assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<%s>;rel=\"index\"", tc.link)})
-				assert.Equals(t, bytes.TrimSpace(body), testBody)
+				assert.Equals(t, bytes.TrimSpace(body), want)
 			}
 		})
 	}
@@ -708,6 +824,382 @@ func TestHandler_verifyAndExtractJWSPayload(t *testing.T) {
 	}
 }
 
+// mockProvisionerCA is a CA that implements the acme.ProvisionerLister
+// interface.
+type mockProvisionerCA struct {
+	acme.CertificateAuthority
+	loadProvisionerByName func(name string) (provisioner.Interface, error)
+	getProvisioners       func(cursor string, limit int) (provisioner.List, string, error)
+}
+
+func (m *mockProvisionerCA) LoadProvisionerByName(name string) (provisioner.Interface, error) {
+	return m.loadProvisionerByName(name)
+}
+
+func (m *mockProvisionerCA) GetProvisioners(cursor string, limit int) (provisioner.List, string, error) {
+	return m.getProvisioners(cursor, limit)
+}
+
+func TestHandler_lookupProvisioner(t *testing.T) {
+	prov := newProv()
+	ca := &mockProvisionerCA{
+		loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+			switch name {
+			case prov.GetName():
+				return prov.(*provisioner.ACME), nil
+			case "jwk":
+				return &provisioner.JWK{Type: "JWK", Name: "jwk"}, nil
+			case "disabled":
+				enabled := false
+				return &provisioner.ACME{Type: "ACME", Name: "disabled", Enabled: &enabled}, nil
+			case "admin":
+				return nil, admin.NewError(admin.ErrorNotFoundType, "provisioner %s not found", name)
+			case "error":
+				return nil, errors.New("force")
+			default:
+				return nil, errors.Wrapf(acme.ErrNotFound, "provisioner %s", name)
+			}
+		},
+		getProvisioners: func(cursor string, limit int) (provisioner.List, string, error) {
+			assert.Equals(t, limit, provisioner.DefaultProvisionersMax)
+			if cursor == "" {
+				return provisioner.List{
+					&provisioner.ACME{Type: "ACME", Name: "zeta"},
+					&provisioner.JWK{Type: "JWK", Name: "jwk"},
+				}, "next", nil
+			}
+			return provisioner.List{prov.(*provisioner.ACME)}, "", nil
+		},
+	}
+	notFound := func(detail string) *acme.Error {
+		ae := acme.NewError(acme.ErrorMalformedType, "")
+		ae.Status = http.StatusNotFound
+		ae.Detail = detail
+		return ae
+	}
+	type test struct {
+		name             string
+		ca               acme.CertificateAuthority
+		listProvisioners bool
+		err              *acme.Error
+		statusCode       int
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/unknown": func(t *testing.T) test {
+			return test{
+				name:       "foo",
+				ca:         ca,
+				statusCode: 404,
+				err:        notFound("provisioner 'foo' not found"),
+			}
+		},
+		"fail/unknown-list": func(t *testing.T) test {
+			return test{
+				name:             "foo",
+				ca:               ca,
+				listProvisioners: true,
+				statusCode:       404,
+				err:              notFound("provisioner 'foo' not found; valid ACME provisioners are: " + prov.GetName() + ", zeta"),
+			}
+		},
+		"fail/unknown-list-not-supported": func(t *testing.T) test {
+			return test{
+				name:             "foo",
+				ca:               struct{ acme.CertificateAuthority }{ca},
+				listProvisioners: true,
+				statusCode:       404,
+				err:              notFound("provisioner 'foo' not found"),
+			}
+		},
+		"fail/unknown-authority": func(t *testing.T) test {
+			return test{
+				name:       "admin",
+				ca:         ca,
+				statusCode: 404,
+				err:        notFound("provisioner 'admin' not found"),
+			}
+		},
+		"fail/load-error": func(t *testing.T) test {
+			return test{
+				name:       "error",
+				ca:         ca,
+				statusCode: 500,
+				err:        acme.NewErrorISE("error loading provisioner 'error': force"),
+			}
+		},
+		"fail/not-acme": func(t *testing.T) test {
+			return test{
+				name:       "jwk",
+				ca:         ca,
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorAccountDoesNotExistType, "provisioner must be of type ACME"),
+			}
+		},
+		"fail/disabled": func(t *testing.T) test {
+			ae := acme.NewError(acme.ErrorUnauthorizedType, "")
+			ae.Status = http.StatusForbidden
+			ae.Detail = "provisioner 'disabled' is disabled"
+			return test{
+				name:       "disabled",
+				ca:         ca,
+				statusCode: 403,
+				err:        ae,
+			}
+		},
+		"ok": func(t *testing.T) test {
+			return test{
+				name:       prov.GetName(),
+				ca:         ca,
+				statusCode: 200,
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			h := &Handler{ca: tc.ca, listProvisioners: tc.listProvisioners}
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("provisionerID", url.PathEscape(tc.name))
+			req := httptest.NewRequest("GET", "/foo/directory", nil)
+			req = req.WithContext(context.WithValue(context.Background(), chi.RouteCtxKey, chiCtx))
+			w := httptest.NewRecorder()
+			next := func(w http.ResponseWriter, r *http.Request) {
+				p, err := provisionerFromContext(r.Context())
+				assert.FatalError(t, err)
+				assert.Equals(t, p.GetName(), tc.name)
+				testNext(w, r)
+			}
+			h.lookupProvisioner(next)(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tc.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tc.err) {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+
+				assert.Equals(t, ae.Type, tc.err.Type)
+				assert.Equals(t, ae.Detail, tc.err.Detail)
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+			} else {
+				assert.Equals(t, bytes.TrimSpace(body), testBody)
+			}
+		})
+	}
+}
+
+func TestHandler_Route_unknownProvisioner(t *testing.T) {
+	r := chi.NewRouter()
+	h := &Handler{linker: NewLinker("dns", "acme"), ca: &mockProvisionerCA{
+		loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+			return nil, errors.Wrapf(acme.ErrNotFound, "provisioner %s", name)
+		},
+	}}
+	h.Route(r)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"directory", "GET", "/foo/directory", ""},
+		{"new-nonce", "HEAD", "/foo/new-nonce", ""},
+		{"new-account", "POST", "/foo/new-account", "not a jws"},
+		{"order", "POST", "/foo/order/ordID", "not a jws"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/jose+json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, http.StatusNotFound)
+			assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+			if tt.method != "HEAD" {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, acme.NewError(acme.ErrorMalformedType, "").Type)
+				assert.Equals(t, ae.Detail, "provisioner 'foo' not found")
+			}
+		})
+	}
+}
+
+func TestHandler_isJSON(t *testing.T) {
+	u := "https://ca.smallstep.com/acme/new-order"
+	malformed := func(detail string) *acme.Error {
+		ae := acme.NewError(acme.ErrorMalformedType, "")
+		ae.Detail = detail
+		return ae
+	}
+	type test struct {
+		ctx        context.Context
+		err        *acme.Error
+		statusCode int
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/no-payload": func(t *testing.T) test {
+			return test{
+				ctx:        context.Background(),
+				statusCode: 500,
+				err:        acme.NewErrorISE("payload expected in request context"),
+			}
+		},
+		"fail/not-json": func(t *testing.T) test {
+			return test{
+				ctx:        context.WithValue(context.Background(), payloadContextKey, &payloadInfo{value: []byte("identifiers=example.com")}),
+				statusCode: 400,
+				err:        malformed("jws payload is not a valid JSON document"),
+			}
+		},
+		"fail/truncated-json": func(t *testing.T) test {
+			return test{
+				ctx:        context.WithValue(context.Background(), payloadContextKey, &payloadInfo{value: []byte(`{"identifiers":[`)}),
+				statusCode: 400,
+				err:        malformed("jws payload is not a valid JSON document"),
+			}
+		},
+		"ok/post-as-get": func(t *testing.T) test {
+			return test{
+				ctx:        context.WithValue(context.Background(), payloadContextKey, &payloadInfo{isPostAsGet: true}),
+				statusCode: 200,
+			}
+		},
+		"ok/empty-json": func(t *testing.T) test {
+			return test{
+				ctx:        context.WithValue(context.Background(), payloadContextKey, &payloadInfo{value: []byte("{}"), isEmptyJSON: true}),
+				statusCode: 200,
+			}
+		},
+		"ok": func(t *testing.T) test {
+			return test{
+				ctx:        context.WithValue(context.Background(), payloadContextKey, &payloadInfo{value: []byte(`{"identifiers":[{"type":"dns","value":"example.com"}]}`)}),
+				statusCode: 200,
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			h := &Handler{}
+			req := httptest.NewRequest("POST", u, nil)
+			req = req.WithContext(tc.ctx)
+			w := httptest.NewRecorder()
+			h.isJSON(testNext)(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tc.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tc.err) {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+
+				assert.Equals(t, ae.Type, tc.err.Type)
+				assert.Equals(t, ae.Detail, tc.err.Detail)
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+			} else {
+				assert.Equals(t, bytes.TrimSpace(body), testBody)
+			}
+		})
+	}
+}
+
+func TestHandler_Route_notJSONPayload(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+	baseURL := "https://test.ca.smallstep.com"
+	prov := &provisioner.ACME{Type: "ACME", Name: "acme"}
+	assert.FatalError(t, prov.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+
+	r := chi.NewRouter()
+	h := &Handler{
+		linker: NewLinker("dns", "acme"),
+		db: &acme.MockDB{
+			MockCreateNonce: func(ctx context.Context) (acme.Nonce, error) {
+				return acme.Nonce("new-nonce"), nil
+			},
+			MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+				assert.Equals(t, n, acme.Nonce("the-nonce"))
+				return nil
+			},
+			MockGetAccount: func(ctx context.Context, id string) (*acme.Account, error) {
+				assert.Equals(t, id, "accID")
+				return &acme.Account{ID: id, Key: &pub, Status: acme.StatusValid}, nil
+			},
+			MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+				t.Error("CreateOrder should not be called")
+				return errors.New("force")
+			},
+		},
+		ca: &mockProvisionerCA{
+			loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+				assert.Equals(t, name, "acme")
+				return prov, nil
+			},
+		},
+	}
+	h.Route(r)
+
+	tests := []struct {
+		name    string
+		path    string
+		payload string
+	}{
+		{"new-order", "/acme/new-order", "identifiers=example.com"},
+		{"update-account", "/acme/account/accID", `{"contact":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			so := new(jose.SignerOptions)
+			// The routes are not mounted under a prefix, so "acme" is the
+			// provisioner name in the request path, while the account links
+			// include both the "acme" prefix and the provisioner name.
+			so.WithHeader("kid", baseURL+"/acme/acme/account/accID")
+			so.WithHeader("url", baseURL+tt.path)
+			so.WithHeader("nonce", "the-nonce")
+			signer, err := jose.NewSigner(jose.SigningKey{
+				Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+				Key:       jwk.Key,
+			}, so)
+			assert.FatalError(t, err)
+			jws, err := signer.Sign([]byte(tt.payload))
+			assert.FatalError(t, err)
+
+			req := httptest.NewRequest("POST", baseURL+tt.path, strings.NewReader(jws.FullSerialize()))
+			req.Header.Set("Content-Type", "application/jose+json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			assert.Equals(t, res.StatusCode, http.StatusBadRequest)
+			var ae acme.Error
+			assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+			assert.Equals(t, ae.Type, acme.NewError(acme.ErrorMalformedType, "").Type)
+			assert.Equals(t, ae.Detail, "jws payload is not a valid JSON document")
+		})
+	}
+}
+
 func TestHandler_lookupJWK(t *testing.T) {
 	prov := newProv()
 	provName := url.PathEscape(prov.GetName())
@@ -851,6 +1343,26 @@ func TestHandler_lookupJWK(t *testing.T) {
 				err:        acme.NewError(acme.ErrorUnauthorizedType, "account is not active"),
 			}
 		},
+		"fail/curve-not-allowed": func(t *testing.T) test {
+			pub := jwk.Public()
+			acc := &acme.Account{Status: "valid", Key: &pub}
+			restricted := &provisioner.ACME{Type: "ACME", Name: prov.GetName(), AllowedCurves: []string{"P-384"}}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, acme.Provisioner(restricted))
+			ctx = context.WithValue(ctx, jwsContextKey, parsedJWS)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			return test{
+				linker: NewLinker("dns", "acme"),
+				db: &acme.MockDB{
+					MockGetAccount: func(ctx context.Context, id string) (*acme.Account, error) {
+						assert.Equals(t, id, accID)
+						return acc, nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorBadSignatureAlgorithmType, "jws key curve P-256 is not allowed; allowed curves are P-384"),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			acc := &acme.Account{Status: "valid", Key: jwk}
 			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
@@ -910,10 +1422,41 @@ func TestHandler_lookupJWK(t *testing.T) {
 	}
 }
 
-func TestHandler_extractJWK(t *testing.T) {
-	prov := newProv()
-	provName := url.PathEscape(prov.GetName())
-	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+func Test_canonicalURL(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+		ok   bool
+	}{
+		{"ok", "https://ca.smallstep.com/acme/new-order", "https://ca.smallstep.com/acme/new-order", true},
+		{"ok/trailing-slash", "https://ca.smallstep.com/acme/new-order/", "https://ca.smallstep.com/acme/new-order", true},
+		{"ok/root", "https://ca.smallstep.com", "https://ca.smallstep.com/", true},
+		{"ok/https-default-port", "https://ca.smallstep.com:443/acme", "https://ca.smallstep.com/acme", true},
+		{"ok/http-default-port", "http://ca.smallstep.com:80/acme", "http://ca.smallstep.com/acme", true},
+		{"ok/other-port", "https://ca.smallstep.com:8443/acme", "https://ca.smallstep.com:8443/acme", true},
+		{"ok/ipv6", "https://[::1]:443/acme", "https://[::1]/acme", true},
+		{"ok/case", "HTTPS://CA.SmallStep.COM/acme", "https://ca.smallstep.com/acme", true},
+		{"ok/unreserved", "https://ca.smallstep.com/%61cme/%7Efoo", "https://ca.smallstep.com/acme/~foo", true},
+		{"ok/reserved", "https://ca.smallstep.com/acme/foo%2fbar", "https://ca.smallstep.com/acme/foo%2Fbar", true},
+		{"ok/query", "https://ca.smallstep.com/acme/foo/?b=%2f&a=1", "https://ca.smallstep.com/acme/foo?b=%2f&a=1", true},
+		{"ok/empty-query", "https://ca.smallstep.com/acme/foo?", "https://ca.smallstep.com/acme/foo", true},
+		{"fail/relative", "/acme/new-order", "", false},
+		{"fail/parse", "https://ca.smallstep.com/%zz", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := canonicalURL(tt.url)
+			assert.Equals(t, tt.want, got)
+			assert.Equals(t, tt.ok, ok)
+		})
+	}
+}
+
+func TestHandler_extractJWK(t *testing.T) {
+	prov := newProv()
+	provName := url.PathEscape(prov.GetName())
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
 	assert.FatalError(t, err)
 	kid, err := jwk.Thumbprint(crypto.SHA256)
 	assert.FatalError(t, err)
@@ -933,6 +1476,30 @@ func TestHandler_extractJWK(t *testing.T) {
 	assert.FatalError(t, err)
 	parsedJWS, err := jose.ParseJWS(raw)
 	assert.FatalError(t, err)
+	p521JWK, err := jose.GenerateJWK("EC", "P-521", "ES512", "sig", "", 0)
+	assert.FatalError(t, err)
+	p521Pub := p521JWK.Public()
+	so = new(jose.SignerOptions)
+	so.WithHeader("jwk", p521Pub)
+	signer, err = jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES512,
+		Key:       p521JWK.Key,
+	}, so)
+	assert.FatalError(t, err)
+	jws, err = signer.Sign([]byte("baz"))
+	assert.FatalError(t, err)
+	raw, err = jws.CompactSerialize()
+	assert.FatalError(t, err)
+	p521JWS, err := jose.ParseJWS(raw)
+	assert.FatalError(t, err)
+	restricted := &acme.MockProvisioner{
+		MgetName: func() string {
+			return prov.GetName()
+		},
+		MgetAllowedCurves: func() []string {
+			return []string{"P-256", "P-384"}
+		},
+	}
 	u := fmt.Sprintf("https://ca.smallstep.com/acme/%s/account/1234",
 		provName)
 	type test struct {
@@ -1050,6 +1617,50 @@ func TestHandler_extractJWK(t *testing.T) {
 				statusCode: 200,
 			}
 		},
+		"fail/curve-not-allowed": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), provisionerContextKey, restricted)
+			ctx = context.WithValue(ctx, jwsContextKey, p521JWS)
+			return test{
+				ctx:        ctx,
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorBadSignatureAlgorithmType, "jws key curve P-521 is not allowed; allowed curves are P-256, P-384"),
+			}
+		},
+		"ok/curve-allowed": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), provisionerContextKey, restricted)
+			ctx = context.WithValue(ctx, jwsContextKey, parsedJWS)
+			return test{
+				ctx: ctx,
+				db: &acme.MockDB{
+					MockGetAccountByKeyID: func(ctx context.Context, kid string) (*acme.Account, error) {
+						return nil, acme.ErrNotFound
+					},
+				},
+				next: func(w http.ResponseWriter, r *http.Request) {
+					w.Write(testBody)
+				},
+				statusCode: 200,
+			}
+		},
+		"ok/es512": func(t *testing.T) test {
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, jwsContextKey, p521JWS)
+			return test{
+				ctx: ctx,
+				db: &acme.MockDB{
+					MockGetAccountByKeyID: func(ctx context.Context, kid string) (*acme.Account, error) {
+						return nil, acme.ErrNotFound
+					},
+				},
+				next: func(w http.ResponseWriter, r *http.Request) {
+					_jwk, err := jwkFromContext(r.Context())
+					assert.FatalError(t, err)
+					assert.Equals(t, _jwk.Key, p521Pub.Key)
+					w.Write(testBody)
+				},
+				statusCode: 200,
+			}
+		},
 		"ok/no-account": func(t *testing.T) test {
 			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
 			ctx = context.WithValue(ctx, jwsContextKey, parsedJWS)
@@ -1242,6 +1853,49 @@ func TestHandler_validateJWS(t *testing.T) {
 				err:        acme.NewError(acme.ErrorMalformedType, "rsa keys must be at least 2048 bits (256 bytes) in size"),
 			}
 		},
+		"fail/crit-unsupported-extension": func(t *testing.T) test {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url":  u,
+								"crit": []interface{}{"foo"},
+								"foo":  "bar",
+							},
+						},
+					},
+				},
+			}
+			return test{
+				ctx:        context.WithValue(context.Background(), jwsContextKey, jws),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorMalformedType, "jws crit header contains unsupported extension foo"),
+			}
+		},
+		"fail/crit-not-an-array": func(t *testing.T) test {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url":  u,
+								"crit": "foo",
+							},
+						},
+					},
+				},
+			}
+			return test{
+				ctx:        context.WithValue(context.Background(), jwsContextKey, jws),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorMalformedType, "jws crit header must be an array of strings"),
+			}
+		},
 		"fail/UseNonce-error": func(t *testing.T) test {
 			jws := &jose.JSONWebSignature{
 				Signatures: []jose.Signature{
@@ -1300,6 +1954,112 @@ func TestHandler_validateJWS(t *testing.T) {
 				err:        acme.NewError(acme.ErrorMalformedType, "url header in JWS (foo) does not match request url (%s)", u),
 			}
 		},
+		"fail/url-different-path": func(t *testing.T) test {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": "https://ca.smallstep.com/acme/account/5678",
+							},
+						},
+					},
+				},
+			}
+			return test{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+				ctx:        context.WithValue(context.Background(), jwsContextKey, jws),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorMalformedType, "url header in JWS (https://ca.smallstep.com/acme/account/5678) does not match request url (%s)", u),
+			}
+		},
+		"ok/url-trailing-slash": func(t *testing.T) test {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": u + "/",
+							},
+						},
+					},
+				},
+			}
+			return test{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+				ctx: context.WithValue(context.Background(), jwsContextKey, jws),
+				next: func(w http.ResponseWriter, r *http.Request) {
+					w.Write(testBody)
+				},
+				statusCode: 200,
+			}
+		},
+		"ok/url-default-port": func(t *testing.T) test {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": "https://ca.smallstep.com:443/acme/account/1234",
+							},
+						},
+					},
+				},
+			}
+			return test{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+				ctx: context.WithValue(context.Background(), jwsContextKey, jws),
+				next: func(w http.ResponseWriter, r *http.Request) {
+					w.Write(testBody)
+				},
+				statusCode: 200,
+			}
+		},
+		"ok/url-case-and-encoding": func(t *testing.T) test {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": "HTTPS://CA.smallstep.com/acme/%61ccount/1234",
+							},
+						},
+					},
+				},
+			}
+			return test{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+				ctx: context.WithValue(context.Background(), jwsContextKey, jws),
+				next: func(w http.ResponseWriter, r *http.Request) {
+					w.Write(testBody)
+				},
+				statusCode: 200,
+			}
+		},
 		"fail/both-jwk-kid": func(t *testing.T) test {
 			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
 			assert.FatalError(t, err)
@@ -1380,6 +2140,34 @@ func TestHandler_validateJWS(t *testing.T) {
 				statusCode: 200,
 			}
 		},
+		"ok/crit-empty": func(t *testing.T) test {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url":  u,
+								"crit": []interface{}{},
+							},
+						},
+					},
+				},
+			}
+			return test{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+				ctx: context.WithValue(context.Background(), jwsContextKey, jws),
+				next: func(w http.ResponseWriter, r *http.Request) {
+					w.Write(testBody)
+				},
+				statusCode: 200,
+			}
+		},
 		"ok/jwk/ecdsa": func(t *testing.T) test {
 			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
 			assert.FatalError(t, err)
@@ -1410,6 +2198,59 @@ func TestHandler_validateJWS(t *testing.T) {
 				statusCode: 200,
 			}
 		},
+		"ok/jwk/es512": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-521", "ES512", "sig", "", 0)
+			assert.FatalError(t, err)
+			pub := jwk.Public()
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm:  jose.ES512,
+							JSONWebKey: &pub,
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": u,
+							},
+						},
+					},
+				},
+			}
+			return test{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+				ctx: context.WithValue(context.Background(), jwsContextKey, jws),
+				next: func(w http.ResponseWriter, r *http.Request) {
+					w.Write(testBody)
+				},
+				statusCode: 200,
+			}
+		},
+		"fail/ecdsa-curve-&-alg-mismatch": func(t *testing.T) test {
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+			pub := jwk.Public()
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm:  jose.ES512,
+							JSONWebKey: &pub,
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": u,
+							},
+						},
+					},
+				},
+			}
+			return test{
+				ctx:        context.WithValue(context.Background(), jwsContextKey, jws),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorMalformedType, "jws key type and algorithm do not match"),
+			}
+		},
 		"ok/jwk/rsa": func(t *testing.T) test {
 			jwk, err := jose.GenerateJWK("RSA", "", "", "sig", "", 2048)
 			assert.FatalError(t, err)
@@ -1472,3 +2313,508 @@ func TestHandler_validateJWS(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_validateJWS_allowedAlgorithms(t *testing.T) {
+	u := "https://ca.smallstep.com/acme/account/1234"
+	ecJWK, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	rsaJWK, err := jose.GenerateJWK("RSA", "", "", "sig", "", 2048)
+	assert.FatalError(t, err)
+	prov := &acme.MockProvisioner{
+		MgetAllowedAlgorithms: func() []string {
+			return []string{jose.ES256}
+		},
+	}
+
+	tests := []struct {
+		name       string
+		alg        string
+		jwk        *jose.JSONWebKey
+		statusCode int
+		err        *acme.Error
+	}{
+		{"ok", jose.ES256, ecJWK, 200, nil},
+		{"fail/not-allowed", jose.RS256, rsaJWK, 400,
+			acme.NewError(acme.ErrorBadSignatureAlgorithmType, "jws algorithm RS256 is not allowed; allowed algorithms are ES256")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := tt.jwk.Public()
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm:  tt.alg,
+							JSONWebKey: &pub,
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": u,
+							},
+						},
+					},
+				},
+			}
+			h := &Handler{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+			}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, jwsContextKey, jws)
+			req := httptest.NewRequest("GET", u, nil)
+			req = req.WithContext(ctx)
+			w := httptest.NewRecorder()
+			h.validateJWS(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(testBody)
+			})(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tt.err) {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, tt.err.Type)
+				assert.Equals(t, ae.Detail, tt.err.Detail)
+			} else {
+				assert.Equals(t, bytes.TrimSpace(body), testBody)
+			}
+		})
+	}
+}
+
+func TestHandler_parseJWS_serializations(t *testing.T) {
+	u := "https://ca.smallstep.com/acme/account/1234"
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	so := new(jose.SignerOptions)
+	so.EmbedJWK = true
+	so.WithHeader("url", u)
+	so.WithHeader("nonce", "nonce")
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+		Key:       jwk.Key,
+	}, so)
+	assert.FatalError(t, err)
+	payload := []byte(`{"foo":"bar"}`)
+	signed, err := signer.Sign(payload)
+	assert.FatalError(t, err)
+	compact, err := signed.CompactSerialize()
+	assert.FatalError(t, err)
+	flattened := signed.FullSerialize()
+
+	// The general serialization contains an array of signatures.
+	var flat map[string]string
+	assert.FatalError(t, json.Unmarshal([]byte(flattened), &flat))
+	general := func(n int) string {
+		sigs := make([]map[string]string, n)
+		for i := range sigs {
+			sigs[i] = map[string]string{"protected": flat["protected"], "signature": flat["signature"]}
+		}
+		b, err := json.Marshal(map[string]interface{}{"payload": flat["payload"], "signatures": sigs})
+		assert.FatalError(t, err)
+		return string(b)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+		err        *acme.Error
+	}{
+		{"ok/compact", compact, 200, nil},
+		{"ok/flattened", flattened, 200, nil},
+		{"ok/general", general(1), 200, nil},
+		{"fail/general-multiple-signatures", general(2), 400,
+			acme.NewError(acme.ErrorMalformedType, "request body contains more than one signature")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						assert.Equals(t, n, acme.Nonce("nonce"))
+						return nil
+					},
+				},
+			}
+			req := httptest.NewRequest("POST", u, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			h.parseJWS(h.validateJWS(func(w http.ResponseWriter, r *http.Request) {
+				jws, err := jwsFromContext(r.Context())
+				assert.FatalError(t, err)
+				if assert.Len(t, 1, jws.Signatures) {
+					assert.Equals(t, jws.Signatures[0].Protected.JSONWebKey.Key, jwk.Public().Key)
+				}
+				assert.Equals(t, jws.UnsafePayloadWithoutVerification(), payload)
+				w.Write(testBody)
+			}))(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tt.err) {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, tt.err.Type)
+				assert.Equals(t, ae.Detail, tt.err.Detail)
+			} else {
+				assert.Equals(t, bytes.TrimSpace(body), testBody)
+			}
+		})
+	}
+}
+
+func TestHandler_validateJWS_pathPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		statusCode int
+		err        *acme.Error
+	}{
+		{"ok", "https://ca.smallstep.com/ca/acme/account/1234", 200, nil},
+		{"fail/missing-prefix", "https://ca.smallstep.com/acme/account/1234", 400,
+			acme.NewError(acme.ErrorMalformedType, "url header in JWS (https://ca.smallstep.com/acme/account/1234) does not match request url (https://ca.smallstep.com/ca/acme/account/1234)")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": tt.url,
+							},
+						},
+					},
+				},
+			}
+			h := &Handler{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+				pathPrefix: "/ca",
+			}
+			// The proxy strips the prefix before forwarding the request.
+			req := httptest.NewRequest("GET", "https://ca.smallstep.com/acme/account/1234", nil)
+			req = req.WithContext(context.WithValue(context.Background(), jwsContextKey, jws))
+			w := httptest.NewRecorder()
+			h.validateJWS(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(testBody)
+			})(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tt.err) {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, tt.err.Type)
+				assert.Equals(t, ae.Detail, tt.err.Detail)
+			} else {
+				assert.Equals(t, bytes.TrimSpace(body), testBody)
+			}
+		})
+	}
+}
+
+func TestHandler_validateJWS_query(t *testing.T) {
+	tests := []struct {
+		name       string
+		reqURL     string
+		url        string
+		statusCode int
+		err        *acme.Error
+	}{
+		{"ok", "https://ca.smallstep.com/acme/account/1234?foo=bar", "https://ca.smallstep.com/acme/account/1234?foo=bar", 200, nil},
+		{"ok/no-query", "https://ca.smallstep.com/acme/account/1234", "https://ca.smallstep.com/acme/account/1234", 200, nil},
+		{"fail/missing-query", "https://ca.smallstep.com/acme/account/1234?foo=bar", "https://ca.smallstep.com/acme/account/1234", 400,
+			acme.NewError(acme.ErrorMalformedType, "url header in JWS (https://ca.smallstep.com/acme/account/1234) does not match request url (https://ca.smallstep.com/acme/account/1234?foo=bar)")},
+		{"fail/different-query", "https://ca.smallstep.com/acme/account/1234?foo=bar", "https://ca.smallstep.com/acme/account/1234?foo=baz", 400,
+			acme.NewError(acme.ErrorMalformedType, "url header in JWS (https://ca.smallstep.com/acme/account/1234?foo=baz) does not match request url (https://ca.smallstep.com/acme/account/1234?foo=bar)")},
+		{"fail/unexpected-query", "https://ca.smallstep.com/acme/account/1234", "https://ca.smallstep.com/acme/account/1234?foo=bar", 400,
+			acme.NewError(acme.ErrorMalformedType, "url header in JWS (https://ca.smallstep.com/acme/account/1234?foo=bar) does not match request url (https://ca.smallstep.com/acme/account/1234)")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": tt.url,
+							},
+						},
+					},
+				},
+			}
+			h := &Handler{
+				db: &acme.MockDB{
+					MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+						return nil
+					},
+				},
+			}
+			req := httptest.NewRequest("GET", tt.reqURL, nil)
+			req = req.WithContext(context.WithValue(context.Background(), jwsContextKey, jws))
+			w := httptest.NewRecorder()
+			h.validateJWS(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(testBody)
+			})(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tt.err) {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, tt.err.Type)
+				assert.Equals(t, ae.Detail, tt.err.Detail)
+			} else {
+				assert.Equals(t, bytes.TrimSpace(body), testBody)
+			}
+		})
+	}
+}
+
+// mockMaintenanceCA is a CA that implements the acme.MaintenanceChecker
+// interface.
+type mockMaintenanceCA struct {
+	acme.CertificateAuthority
+	enabled    bool
+	retryAfter time.Duration
+}
+
+func (m *mockMaintenanceCA) GetMaintenance() (bool, time.Duration) {
+	return m.enabled, m.retryAfter
+}
+
+func TestHandler_checkMaintenance(t *testing.T) {
+	tests := []struct {
+		name       string
+		ca         acme.CertificateAuthority
+		codes      map[acme.ProblemType]int
+		statusCode int
+		retryAfter string
+	}{
+		{"ok/not-supported", struct{ acme.CertificateAuthority }{}, nil, 200, ""},
+		{"ok/disabled", &mockMaintenanceCA{retryAfter: time.Minute}, nil, 200, ""},
+		{"fail/enabled", &mockMaintenanceCA{enabled: true, retryAfter: 90 * time.Second}, nil, 503, "90"},
+		{"fail/enabled-round-up", &mockMaintenanceCA{enabled: true, retryAfter: 1500 * time.Millisecond}, nil, 503, "2"},
+		{"fail/enabled-default", &mockMaintenanceCA{enabled: true}, nil, 503, "300"},
+		{"fail/enabled-status-code", &mockMaintenanceCA{enabled: true}, map[acme.ProblemType]int{acme.ErrorServerInternalType: 500}, 500, "300"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{ca: tt.ca, errorStatusCodes: tt.codes}
+			req := httptest.NewRequest("POST", "/acme/new-order", nil)
+			w := httptest.NewRecorder()
+			h.checkMaintenance(testNext)(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+			assert.Equals(t, res.Header.Get("Retry-After"), tt.retryAfter)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, acme.NewError(acme.ErrorServerInternalType, "").Type)
+				assert.Equals(t, ae.Detail, "the certificate authority is in maintenance mode")
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+			} else {
+				assert.Equals(t, bytes.TrimSpace(body), testBody)
+			}
+		})
+	}
+}
+
+func TestHandler_Route_maintenance(t *testing.T) {
+	ca := &mockMaintenanceCA{
+		CertificateAuthority: &mockProvisionerCA{
+			loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+				return newProv().(*provisioner.ACME), nil
+			},
+		},
+		enabled:    true,
+		retryAfter: time.Minute,
+	}
+	h := &Handler{
+		linker: NewLinker("dns", "acme"),
+		db: &acme.MockDB{
+			MockCreateNonce: func(ctx context.Context) (acme.Nonce, error) {
+				return acme.Nonce("the-nonce"), nil
+			},
+		},
+		ca: ca,
+	}
+	r := chi.NewRouter()
+	h.Route(r)
+
+	do := func(method, path string) *http.Response {
+		req := httptest.NewRequest(method, path, strings.NewReader("not a jws"))
+		req.Header.Set("Content-Type", "application/jose+json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// Issuance is blocked.
+	for _, path := range []string{"/acme/new-account", "/acme/new-order", "/acme/order/ordID/finalize"} {
+		res := do("POST", path)
+		assert.Equals(t, res.StatusCode, http.StatusServiceUnavailable)
+		assert.Equals(t, res.Header.Get("Retry-After"), "60")
+		assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+	}
+
+	// Reads keep working, requests to the rest of the endpoints reach the
+	// JWS validation.
+	res := do("GET", "/acme/directory")
+	assert.Equals(t, res.StatusCode, http.StatusOK)
+	res = do("HEAD", "/acme/new-nonce")
+	assert.Equals(t, res.StatusCode, http.StatusOK)
+	assert.Equals(t, res.Header.Get("Replay-Nonce"), "the-nonce")
+	for _, path := range []string{"/acme/order/ordID", "/acme/authz/authzID", "/acme/certificate/certID"} {
+		res := do("POST", path)
+		assert.Equals(t, res.StatusCode, http.StatusBadRequest)
+		assert.Equals(t, res.Header.Get("Retry-After"), "")
+	}
+
+	// The maintenance is reversible.
+	ca.enabled = false
+	res = do("POST", "/acme/new-order")
+	assert.Equals(t, res.StatusCode, http.StatusBadRequest)
+	assert.Equals(t, res.Header.Get("Retry-After"), "")
+}
+
+func TestHandler_Route_disabledProvisioner(t *testing.T) {
+	enabled := false
+	r := chi.NewRouter()
+	h := &Handler{linker: NewLinker("dns", "acme"), ca: &mockProvisionerCA{
+		loadProvisionerByName: func(name string) (provisioner.Interface, error) {
+			p := newProv().(*provisioner.ACME)
+			p.Enabled = &enabled
+			return p, nil
+		},
+	}}
+	h.Route(r)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{"directory", "GET", "/acme/directory"},
+		{"new-order", "POST", "/acme/new-order"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("not a jws"))
+			req.Header.Set("Content-Type", "application/jose+json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, http.StatusForbidden)
+			assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+
+			var ae acme.Error
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&ae))
+			assert.Equals(t, ae.Type, acme.NewError(acme.ErrorUnauthorizedType, "").Type)
+			assert.Equals(t, ae.Detail, "provisioner 'acme' is disabled")
+		})
+	}
+}
+
+func mustAccountKey(t testing.TB) (*jose.JSONWebKey, *jose.JSONWebKey) {
+	t.Helper()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := jwk.Public()
+	pub.KeyID, err = acme.KeyToID(&pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwk, &pub
+}
+
+func mustSignedJWS(t testing.TB, jwk *jose.JSONWebKey, payload []byte) *jose.JSONWebSignature {
+	t.Helper()
+	so := new(jose.SignerOptions)
+	so.WithHeader("alg", jose.SignatureAlgorithm(jwk.Algorithm))
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+		Key:       jwk.Key,
+	}, so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jose.ParseJWS(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestHandler_verifyAndExtractJWSPayload_rollover(t *testing.T) {
+	oldJWK, oldPub := mustAccountKey(t)
+	newJWK, newPub := mustAccountKey(t)
+	h := &Handler{}
+
+	verify := func(jws *jose.JSONWebSignature, acc *acme.Account) int {
+		ctx := context.WithValue(context.Background(), jwsContextKey, jws)
+		ctx = context.WithValue(ctx, jwkContextKey, acc.Key)
+		ctx = context.WithValue(ctx, accContextKey, acc)
+		req := httptest.NewRequest("GET", "https://ca.smallstep.com/acme/account/accID", nil)
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.verifyAndExtractJWSPayload(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})(w, req)
+		return w.Result().StatusCode
+	}
+
+	acc := &acme.Account{ID: "accID", Key: oldPub, Status: acme.StatusValid}
+	assert.Equals(t, verify(mustSignedJWS(t, oldJWK, []byte("{}")), acc), 200)
+
+	// After the rollover the old key is not accepted.
+	acc = &acme.Account{ID: "accID", Key: newPub, Status: acme.StatusValid}
+	assert.Equals(t, verify(mustSignedJWS(t, oldJWK, []byte("{}")), acc), 400)
+	assert.Equals(t, verify(mustSignedJWS(t, newJWK, []byte("{}")), acc), 200)
+}
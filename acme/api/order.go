@@ -2,17 +2,23 @@ package api
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/smallstep/certificates/acme"
-	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/logging"
+	"go.step.sm/crypto/pemutil"
 	"go.step.sm/crypto/randutil"
 )
 
@@ -23,30 +29,76 @@ type NewOrderRequest struct {
 	NotAfter    time.Time         `json:"notAfter,omitempty"`
 }
 
-// Validate validates a new-order request body.
-func (n *NewOrderRequest) Validate() error {
+// Validate validates a new-order request body. The identifiers of custom types
+// are validated by their authorizer in the given registry.
+func (n *NewOrderRequest) Validate(reg *acme.Registry) error {
 	if len(n.Identifiers) == 0 {
 		return acme.NewError(acme.ErrorMalformedType, "identifiers list cannot be empty")
 	}
 	for _, id := range n.Identifiers {
-		if !(id.Type == acme.DNS || id.Type == acme.IP) {
-			return acme.NewError(acme.ErrorMalformedType, "identifier type unsupported: %s", id.Type)
-		}
-		if id.Type == acme.IP && net.ParseIP(id.Value) == nil {
-			return acme.NewError(acme.ErrorMalformedType, "invalid IP address: %s", id.Value)
+		switch id.Type {
+		case acme.DNS:
+		case acme.IP:
+			if net.ParseIP(id.Value) == nil {
+				return acme.NewError(acme.ErrorMalformedType, "invalid IP address: %s", id.Value)
+			}
+		default:
+			a, ok := reg.IdentifierAuthorizer(id.Type)
+			if !ok {
+				return unsupportedIdentifierError("identifier %s has an unsupported type %s", id.Value, id.Type)
+			}
+			if err := a.ValidateIdentifier(id.Value); err != nil {
+				return acme.NewDetailedError(acme.ErrorMalformedType, "invalid %s identifier %s: %v", id.Type, id.Value, err)
+			}
 		}
 	}
 	return nil
 }
 
 // FinalizeRequest captures the body for a Finalize order request.
+//
+// ServerKeyGen can be used instead of the CSR to request the CA to generate
+// the key of the certificate. This is not part of the ACME protocol, and it
+// must be enabled in the provisioner.
 type FinalizeRequest struct {
-	CSR string `json:"csr"`
-	csr *x509.CertificateRequest
+	CSR          string               `json:"csr"`
+	ServerKeyGen *ServerKeyGenRequest `json:"serverKeyGen,omitempty"`
+	csr          *x509.CertificateRequest
+}
+
+// ServerKeyGenRequest defines the key that the CA will generate when an order
+// is finalized, and the password used to encrypt it in the response. KeyType,
+// Curve and Size default to an EC P-256 key.
+type ServerKeyGenRequest struct {
+	KeyType  string `json:"kty,omitempty"`
+	Curve    string `json:"crv,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	Password string `json:"password"`
+}
+
+// FinalizeResponse is the response to a Finalize order request using server
+// side key generation. It is the order with the generated key, as an encrypted
+// PKCS #8 PEM block. The key is not part of the response logs.
+type FinalizeResponse struct {
+	*acme.Order
+	PrivateKey string `json:"privateKey"`
 }
 
 // Validate validates a finalize request body.
 func (f *FinalizeRequest) Validate() error {
+	if f.ServerKeyGen != nil {
+		if f.CSR != "" {
+			return acme.NewError(acme.ErrorMalformedType, "csr and serverKeyGen cannot be used together")
+		}
+		if f.ServerKeyGen.Password == "" {
+			return acme.NewError(acme.ErrorMalformedType, "serverKeyGen password cannot be empty")
+		}
+		if f.ServerKeyGen.KeyType == "" {
+			f.ServerKeyGen.KeyType, f.ServerKeyGen.Curve = "EC", "P-256"
+		}
+		return nil
+	}
+
 	var err error
 	csrBytes, err := base64.RawURLEncoding.DecodeString(f.CSR)
 	if err != nil {
@@ -54,10 +106,12 @@ func (f *FinalizeRequest) Validate() error {
 	}
 	f.csr, err = x509.ParseCertificateRequest(csrBytes)
 	if err != nil {
-		return acme.WrapError(acme.ErrorMalformedType, err, "unable to parse csr")
+		return acme.WrapDetailedError(acme.ErrorMalformedType, err, "unable to parse csr")
 	}
+	// The self-signature proves the possession of the private key, it's
+	// verified before any other check of the CSR.
 	if err = f.csr.CheckSignature(); err != nil {
-		return acme.WrapError(acme.ErrorMalformedType, err, "csr failed signature check")
+		return acme.WrapDetailedError(acme.ErrorBadCSRType, err, "csr signature does not verify with its public key")
 	}
 	return nil
 }
@@ -70,31 +124,86 @@ func (h *Handler) NewOrder(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	prov, err := provisionerFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	payload, err := payloadFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	var nor NewOrderRequest
 	if err := json.Unmarshal(payload.value, &nor); err != nil {
-		api.WriteError(w, acme.WrapError(acme.ErrorMalformedType, err,
+		h.writeError(w, r, acme.WrapError(acme.ErrorMalformedType, err,
 			"failed to unmarshal new-order request payload"))
 		return
 	}
 
-	if err := nor.Validate(); err != nil {
-		api.WriteError(w, err)
+	if err := nor.Validate(h.registry); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if err := authorizeIdentifierTypes(prov, nor.Identifiers); err != nil {
+		h.writeError(w, r, err)
 		return
 	}
 
+	if err := h.authorizeWildcards(prov, nor.Identifiers); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if err := authorizeIdentifiers(prov, nor.Identifiers); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if err := checkMixedWildcards(w, prov, nor.Identifiers); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	// Trusted accounts are exempt from the per-account limits.
+	trusted := prov.IsTrustedAccount(acc.ID)
+	if trusted && (prov.GetMaxPendingAuthz() > 0 || prov.GetMaxOrdersPerAccount() > 0) {
+		logRateLimitExemption(w, acc, prov)
+	}
+
+	// The authorizations of the account are loaded once, to check the limit of
+	// pending authorizations and to find the ones that can be reused.
+	var azs []*acme.Authorization
+	pendingLimit := prov.GetMaxPendingAuthz()
+	if (pendingLimit > 0 && !trusted) || prov.IsWildcardAuthzReuseEnabled() || prov.GetAuthzReuseAge() > 0 {
+		if azs, err = h.db.GetAuthorizationsByAccountID(ctx, acc.ID); err != nil {
+			h.writeError(w, r, acme.WrapErrorISE(err, "error retrieving authorizations"))
+			return
+		}
+	}
+	// The limit is checked first with the loaded authorizations, so the orders
+	// beyond it are rejected before creating anything, and then enforced
+	// atomically by the database when each authorization is created.
+	if pendingLimit <= 0 || trusted {
+		pendingLimit = 0
+	} else {
+		pending := 0
+		for _, az := range azs {
+			if az.Status == acme.StatusPending {
+				pending++
+			}
+		}
+		if pending+len(nor.Identifiers) > pendingLimit {
+			h.writeError(w, r, acme.NewError(acme.ErrorRateLimitedType,
+				"account '%s' has too many pending authorizations; the maximum is %d", acc.ID, pendingLimit))
+			return
+		}
+	}
+
 	now := clock.Now()
 	// New order.
 	o := &acme.Order{
@@ -108,26 +217,63 @@ func (h *Handler) NewOrder(w http.ResponseWriter, r *http.Request) {
 		NotAfter:         nor.NotAfter,
 	}
 
+	if o.NotBefore.IsZero() {
+		o.NotBefore = now
+	}
+	if o.NotAfter.IsZero() {
+		o.NotAfter = o.NotBefore.Add(prov.DefaultTLSCertDuration())
+	}
+	if err := validateOrderValidity(prov, o); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	// The lifetime count of orders of the account is incremented before storing
+	// anything, so it includes the orders that fail after this point.
+	if limit := prov.GetMaxOrdersPerAccount(); limit > 0 && !trusted {
+		ok, err := h.db.IncrementOrderCount(ctx, acc.ID, limit)
+		if err != nil {
+			h.writeError(w, r, acme.WrapErrorISE(err, "error updating order count"))
+			return
+		}
+		if !ok {
+			h.writeError(w, r, acme.NewError(acme.ErrorRateLimitedType,
+				"account '%s' has reached the maximum number of orders; the maximum is %d", acc.ID, limit))
+			return
+		}
+	}
+
+	// The new authorizations are deleted if the order cannot be created.
+	var created []*acme.Authorization
+	validAzs, wildcardAzs := reusableAuthorizations(prov, azs, now)
 	for i, identifier := range o.Identifiers {
-		az := &acme.Authorization{
+		az := authorizationFor(validAzs, identifier)
+		if az == nil {
+			az = wildcardAuthorizationFor(wildcardAzs, identifier)
+		}
+		if az != nil {
+			// The order cannot outlive the authorizations it reuses.
+			if az.ExpiresAt.Before(o.ExpiresAt) {
+				o.ExpiresAt = az.ExpiresAt
+			}
+			o.AuthorizationIDs[i] = az.ID
+			continue
+		}
+		az = &acme.Authorization{
 			AccountID:  acc.ID,
 			Identifier: identifier,
 			ExpiresAt:  o.ExpiresAt,
 			Status:     acme.StatusPending,
 		}
-		if err := h.newAuthorization(ctx, az); err != nil {
-			api.WriteError(w, err)
+		if err := h.newAuthorization(ctx, prov, az, pendingLimit); err != nil {
+			h.deleteAuthorizations(ctx, append(created, az))
+			h.writeError(w, r, err)
 			return
 		}
+		created = append(created, az)
 		o.AuthorizationIDs[i] = az.ID
 	}
 
-	if o.NotBefore.IsZero() {
-		o.NotBefore = now
-	}
-	if o.NotAfter.IsZero() {
-		o.NotAfter = o.NotBefore.Add(prov.DefaultTLSCertDuration())
-	}
 	// If request NotBefore was empty then backdate the order.NotBefore (now)
 	// to avoid timing issues.
 	if nor.NotBefore.IsZero() {
@@ -135,17 +281,222 @@ func (h *Handler) NewOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.db.CreateOrder(ctx, o); err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error creating order"))
+		h.deleteAuthorizations(ctx, created)
+		h.writeError(w, r, acme.WrapErrorISE(err, "error creating order"))
 		return
 	}
 
 	h.linker.LinkOrder(ctx, o)
+	h.pageAuthorizations(ctx, w, o, prov)
 
 	w.Header().Set("Location", h.linker.GetLink(ctx, OrderLinkType, o.ID))
-	api.JSONStatus(w, o, http.StatusCreated)
+	h.writeJSON(w, r, o, http.StatusCreated)
+}
+
+// validateOrderValidity validates the validity window of a new order against
+// the certificate durations allowed by the provisioner. Depending on the
+// validity policy of the provisioner, windows that are too short or too long
+// are rejected or clamped to the closest allowed duration.
+func validateOrderValidity(prov acme.Provisioner, o *acme.Order) error {
+	if o.NotAfter.Before(o.NotBefore) {
+		return acme.NewError(acme.ErrorMalformedType, "notAfter (%s) cannot be before notBefore (%s)",
+			o.NotAfter.Format(time.RFC3339), o.NotBefore.Format(time.RFC3339))
+	}
+
+	d := o.NotAfter.Sub(o.NotBefore)
+	minDur, maxDur := prov.MinTLSCertDuration(), prov.MaxTLSCertDuration()
+	clamp := prov.GetValidityPolicy() == provisioner.ACMEValidityPolicyClamp
+	switch {
+	case d < minDur && clamp:
+		o.NotAfter = o.NotBefore.Add(minDur)
+	case d < minDur:
+		return acme.NewError(acme.ErrorMalformedType, "requested duration of %v is less than the authorized minimum certificate duration of %v", d, minDur)
+	case d > maxDur && clamp:
+		o.NotAfter = o.NotBefore.Add(maxDur)
+	case d > maxDur:
+		return acme.NewError(acme.ErrorMalformedType, "requested duration of %v is more than the authorized maximum certificate duration of %v", d, maxDur)
+	}
+	return nil
+}
+
+// authorizeWildcards checks that the provisioner is allowed to request the
+// wildcard identifiers of a new order, if the CA restricts them.
+func (h *Handler) authorizeWildcards(prov acme.Provisioner, identifiers []acme.Identifier) error {
+	wa, ok := h.ca.(acme.WildcardAuthorizer)
+	if !ok {
+		return nil
+	}
+	for _, id := range identifiers {
+		if id.Type != acme.DNS || !strings.HasPrefix(id.Value, "*.") {
+			continue
+		}
+		if err := wa.AuthorizeWildcard(prov.GetName(), strings.TrimPrefix(id.Value, "*.")); err != nil {
+			return acme.WrapError(acme.ErrorRejectedIdentifierType, err, "wildcard identifier %s rejected", id.Value)
+		}
+	}
+	return nil
+}
+
+// checkMixedWildcards applies the mixed wildcard policy of the provisioner to
+// the identifiers of a new order. With the warn policy the order is flagged in
+// the request log, and with the reject policy it fails with a malformed error.
+func checkMixedWildcards(w http.ResponseWriter, prov acme.Provisioner, identifiers []acme.Identifier) error {
+	policy := prov.GetMixedWildcardPolicy()
+	if policy == provisioner.ACMEMixedWildcardPolicyAllow {
+		return nil
+	}
+	name, wildcard, ok := mixedWildcardIdentifiers(identifiers)
+	if !ok {
+		return nil
+	}
+	if policy == provisioner.ACMEMixedWildcardPolicyReject {
+		return acme.NewError(acme.ErrorMalformedType,
+			"identifier %s cannot be requested in the same order as the wildcard identifier %s", name, wildcard)
+	}
+	logMixedWildcard(w, prov, name, wildcard)
+	return nil
+}
+
+// mixedWildcardIdentifiers returns the first dns identifier that is a
+// subdomain of the base domain of a wildcard identifier in the same order,
+// e.g. www.example.com and *.example.com, and that wildcard identifier.
+func mixedWildcardIdentifiers(identifiers []acme.Identifier) (name, wildcard string, ok bool) {
+	var bases []string
+	for _, id := range identifiers {
+		if id.Type == acme.DNS && strings.HasPrefix(id.Value, "*.") {
+			bases = append(bases, strings.ToLower(strings.TrimPrefix(id.Value, "*.")))
+		}
+	}
+	if len(bases) == 0 {
+		return "", "", false
+	}
+	for _, id := range identifiers {
+		if id.Type != acme.DNS || strings.HasPrefix(id.Value, "*.") {
+			continue
+		}
+		value := strings.ToLower(id.Value)
+		for _, base := range bases {
+			if strings.HasSuffix(value, "."+base) {
+				return id.Value, "*." + base, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// authorizeIdentifierTypes returns an error if the type of an identifier is
+// not enabled in the provisioner, all the supported types are enabled if the
+// provisioner does not restrict them.
+func authorizeIdentifierTypes(prov acme.Provisioner, identifiers []acme.Identifier) error {
+	types := prov.GetIdentifierTypes()
+	if len(types) == 0 {
+		return nil
+	}
+	for _, id := range identifiers {
+		enabled := false
+		for _, typ := range types {
+			if string(id.Type) == typ {
+				enabled = true
+				break
+			}
+		}
+		if !enabled {
+			return unsupportedIdentifierError("identifier %s has a type %s that is not enabled in the provisioner", id.Value, id.Type)
+		}
+	}
+	return nil
+}
+
+// unsupportedIdentifierError returns an unsupportedIdentifier error that
+// names the offending identifier in the detail.
+func unsupportedIdentifierError(msg string, args ...interface{}) *acme.Error {
+	return acme.NewDetailedError(acme.ErrorUnsupportedIdentifierType, msg, args...)
+}
+
+// authorizeIdentifiers checks that the identifiers of a new order are allowed
+// by the provisioner policy.
+func authorizeIdentifiers(prov acme.Provisioner, identifiers []acme.Identifier) error {
+	for _, id := range identifiers {
+		if err := prov.AuthorizeOrderIdentifier(string(id.Type), id.Value); err != nil {
+			return acme.WrapError(acme.ErrorRejectedIdentifierType, err, "identifier %s rejected", id.Value)
+		}
+	}
+	return nil
+}
+
+// reusableAuthorizations returns the authorizations of the account that the
+// provisioner allows reusing, they must be valid and not expired. The first
+// list has the ones validated within the authorization reuse age, and the
+// second one the wildcard authorizations, that are reused for the names under
+// the wildcard domains.
+func reusableAuthorizations(prov acme.Provisioner, azs []*acme.Authorization, now time.Time) (valid, wildcard []*acme.Authorization) {
+	maxAge := prov.GetAuthzReuseAge()
+	wildcardReuse := prov.IsWildcardAuthzReuseEnabled()
+	for _, az := range azs {
+		if az.Status != acme.StatusValid || !now.Before(az.ExpiresAt) {
+			continue
+		}
+		if wildcardReuse && az.Wildcard {
+			wildcard = append(wildcard, az)
+		}
+		if validatedAt, ok := az.ValidatedAt(); ok && maxAge > 0 && now.Sub(validatedAt) <= maxAge {
+			valid = append(valid, az)
+		}
+	}
+	return valid, wildcard
+}
+
+// authorizationFor returns the authorization for the same identifier, or nil
+// if there is none. A wildcard identifier is only satisfied by a wildcard
+// authorization of the same domain.
+func authorizationFor(azs []*acme.Authorization, id acme.Identifier) *acme.Authorization {
+	wildcard := strings.HasPrefix(id.Value, "*.")
+	value := strings.TrimPrefix(id.Value, "*.")
+	for _, az := range azs {
+		if az.Identifier.Type == id.Type && az.Wildcard == wildcard && strings.EqualFold(az.Identifier.Value, value) {
+			return az
+		}
+	}
+	return nil
+}
+
+// wildcardAuthorizationFor returns the wildcard authorization that covers the
+// given identifier, or nil if there is none. A wildcard authorization for
+// *.example.com covers the dns identifiers one label below it, like
+// a.example.com, but not example.com or a.b.example.com.
+func wildcardAuthorizationFor(azs []*acme.Authorization, id acme.Identifier) *acme.Authorization {
+	if id.Type != acme.DNS || strings.HasPrefix(id.Value, "*.") {
+		return nil
+	}
+	i := strings.IndexByte(id.Value, '.')
+	if i <= 0 {
+		return nil
+	}
+	for _, az := range azs {
+		if az.Identifier.Type == acme.DNS && strings.EqualFold(az.Identifier.Value, id.Value[i+1:]) {
+			return az
+		}
+	}
+	return nil
 }
 
-func (h *Handler) newAuthorization(ctx context.Context, az *acme.Authorization) error {
+// deleteAuthorizations deletes the authorizations, and their challenges,
+// created for an order that failed, so they don't count towards the pending
+// authorizations of the account. The errors are only logged, as the order has
+// already failed.
+func (h *Handler) deleteAuthorizations(ctx context.Context, azs []*acme.Authorization) {
+	if len(azs) == 0 {
+		return
+	}
+	if err := h.db.DeleteAuthorizations(ctx, azs); err != nil {
+		log.Printf("error deleting the authorizations of a failed order: %v", err)
+	}
+}
+
+// newAuthorization creates the challenges and the authorization. If maxPending
+// is greater than zero, the authorization is only created if the account has
+// fewer pending authorizations.
+func (h *Handler) newAuthorization(ctx context.Context, prov acme.Provisioner, az *acme.Authorization, maxPending int) error {
 	if strings.HasPrefix(az.Identifier.Value, "*.") {
 		az.Wildcard = true
 		az.Identifier = acme.Identifier{
@@ -154,7 +505,11 @@ func (h *Handler) newAuthorization(ctx context.Context, az *acme.Authorization)
 		}
 	}
 
-	chTypes := challengeTypes(az)
+	chTypes := challengeTypes(prov, az, h.registry)
+	if len(chTypes) == 0 {
+		return acme.NewError(acme.ErrorRejectedIdentifierType,
+			"no challenges are allowed for %s identifier %s", az.Identifier.Type, az.Identifier.Value)
+	}
 
 	var err error
 	az.Token, err = randutil.Alphanumeric(32)
@@ -175,9 +530,20 @@ func (h *Handler) newAuthorization(ctx context.Context, az *acme.Authorization)
 		}
 		az.Challenges[i] = ch
 	}
-	if err = h.db.CreateAuthorization(ctx, az); err != nil {
+	if maxPending <= 0 {
+		if err = h.db.CreateAuthorization(ctx, az); err != nil {
+			return acme.WrapErrorISE(err, "error creating authorization")
+		}
+		return nil
+	}
+	ok, err := h.db.CreatePendingAuthorization(ctx, az, maxPending)
+	if err != nil {
 		return acme.WrapErrorISE(err, "error creating authorization")
 	}
+	if !ok {
+		return acme.NewError(acme.ErrorRateLimitedType,
+			"account '%s' has too many pending authorizations; the maximum is %d", az.AccountID, maxPending)
+	}
 	return nil
 }
 
@@ -186,38 +552,116 @@ func (h *Handler) GetOrder(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	prov, err := provisionerFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	o, err := h.db.GetOrder(ctx, chi.URLParam(r, "ordID"))
 	if err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error retrieving order"))
+		h.writeError(w, r, acme.WrapErrorISE(err, "error retrieving order"))
 		return
 	}
 	if acc.ID != o.AccountID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
 			"account '%s' does not own order '%s'", acc.ID, o.ID))
 		return
 	}
 	if prov.GetID() != o.ProvisionerID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
 			"provisioner '%s' does not own order '%s'", prov.GetID(), o.ID))
 		return
 	}
 	if err = o.UpdateStatus(ctx, h.db); err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error updating order status"))
+		h.writeError(w, r, acme.WrapErrorISE(err, "error updating order status"))
 		return
 	}
 
 	h.linker.LinkOrder(ctx, o)
+	h.pageAuthorizations(ctx, w, o, prov)
 
 	w.Header().Set("Location", h.linker.GetLink(ctx, OrderLinkType, o.ID))
-	api.JSON(w, o)
+	setRetryAfter(w, o.Status, prov.GetOrderRetryAfter())
+	h.writeJSON(w, r, o, http.StatusOK)
+}
+
+// OrderAuthorizations is the response of the authorizations endpoint of an
+// order, a page of the links to the authorizations of the order.
+type OrderAuthorizations struct {
+	Authorizations []string `json:"authorizations"`
+}
+
+// GetOrderAuthorizations ACME api for retrieving the authorizations of an
+// order when they are not all included in the order. The cursor query
+// parameter is the index of the first authorization in the page, and a Link
+// header with rel="next" points to the next page if there is one. The cursor is
+// part of the url in the JWS, so validateJWS rejects a request for a page other
+// than the one the client signed.
+func (h *Handler) GetOrderAuthorizations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	acc, err := accountFromContext(ctx)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	prov, err := provisionerFromContext(ctx)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	o, err := h.db.GetOrder(ctx, chi.URLParam(r, "ordID"))
+	if err != nil {
+		h.writeError(w, r, acme.WrapErrorISE(err, "error retrieving order"))
+		return
+	}
+	if acc.ID != o.AccountID {
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
+			"account '%s' does not own order '%s'", acc.ID, o.ID))
+		return
+	}
+	if prov.GetID() != o.ProvisionerID {
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
+			"provisioner '%s' does not own order '%s'", prov.GetID(), o.ID))
+		return
+	}
+
+	var cursor int
+	if s := r.URL.Query().Get("cursor"); s != "" {
+		if cursor, err = strconv.Atoi(s); err != nil || cursor < 0 || cursor > len(o.AuthorizationIDs) {
+			h.writeError(w, r, acme.NewDetailedError(acme.ErrorMalformedType, "invalid authorizations cursor '%s'", s))
+			return
+		}
+	}
+
+	h.linker.LinkOrder(ctx, o)
+	urls := o.AuthorizationURLs[cursor:]
+	if size := prov.GetAuthorizationsPageSize(); size > 0 && len(urls) > size {
+		urls = urls[:size]
+		w.Header().Add("Link", link(h.authorizationsPageLink(ctx, o.ID, cursor+size), "next"))
+	}
+	w.Header().Add("Link", link(h.linker.GetLink(ctx, OrderLinkType, o.ID), "up"))
+	h.writeJSON(w, r, &OrderAuthorizations{Authorizations: urls}, http.StatusOK)
+}
+
+// pageAuthorizations keeps in the order the first page of the authorization
+// links, and adds a Link header with rel="next" pointing to the rest of them.
+// Orders that fit in a page are not modified.
+func (h *Handler) pageAuthorizations(ctx context.Context, w http.ResponseWriter, o *acme.Order, prov acme.Provisioner) {
+	size := prov.GetAuthorizationsPageSize()
+	if size <= 0 || len(o.AuthorizationURLs) <= size {
+		return
+	}
+	o.AuthorizationURLs = o.AuthorizationURLs[:size]
+	w.Header().Add("Link", link(h.authorizationsPageLink(ctx, o.ID, size), "next"))
+}
+
+// authorizationsPageLink returns the link to the page of the authorizations of
+// an order starting at the given cursor.
+func (h *Handler) authorizationsPageLink(ctx context.Context, ordID string, cursor int) string {
+	return h.linker.GetLink(ctx, OrderAuthorizationsLinkType, ordID) + "?cursor=" + strconv.Itoa(cursor)
 }
 
 // FinalizeOrder attemptst to finalize an order and create a certificate.
@@ -225,61 +669,212 @@ func (h *Handler) FinalizeOrder(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	acc, err := accountFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	prov, err := provisionerFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	payload, err := payloadFromContext(ctx)
 	if err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 	var fr FinalizeRequest
 	if err := json.Unmarshal(payload.value, &fr); err != nil {
-		api.WriteError(w, acme.WrapError(acme.ErrorMalformedType, err,
+		h.writeError(w, r, acme.WrapError(acme.ErrorMalformedType, err,
 			"failed to unmarshal finalize-order request payload"))
 		return
 	}
 	if err := fr.Validate(); err != nil {
-		api.WriteError(w, err)
+		h.writeError(w, r, err)
 		return
 	}
 
 	o, err := h.db.GetOrder(ctx, chi.URLParam(r, "ordID"))
 	if err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error retrieving order"))
+		h.writeError(w, r, acme.WrapErrorISE(err, "error retrieving order"))
 		return
 	}
 	if acc.ID != o.AccountID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
 			"account '%s' does not own order '%s'", acc.ID, o.ID))
 		return
 	}
 	if prov.GetID() != o.ProvisionerID {
-		api.WriteError(w, acme.NewError(acme.ErrorUnauthorizedType,
+		h.writeError(w, r, acme.NewError(acme.ErrorUnauthorizedType,
 			"provisioner '%s' does not own order '%s'", prov.GetID(), o.ID))
 		return
 	}
-	if err = o.Finalize(ctx, h.db, fr.csr, h.ca, prov); err != nil {
-		api.WriteError(w, acme.WrapErrorISE(err, "error finalizing order"))
+
+	var keyPEM []byte
+	if fr.ServerKeyGen != nil {
+		if fr.csr, keyPEM, err = h.serverKeyGen(ctx, prov, o, fr.ServerKeyGen); err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+		logServerKeyGen(w, acc, prov, o, fr.ServerKeyGen)
+	}
+
+	// The key of the CSR must be attested if the provisioner requires it.
+	if roots := prov.GetKeyAttestationRoots(); roots != nil {
+		ka, err := acme.VerifyKeyAttestation(fr.csr, roots)
+		if err != nil {
+			h.writeError(w, r, err)
+			return
+		}
+		logKeyAttestation(w, ka)
+	}
+
+	if err = o.Finalize(ctx, h.db, fr.csr, h.ca, prov, h.registry); err != nil {
+		h.writeError(w, r, acme.WrapErrorISE(err, "error finalizing order"))
 		return
 	}
 
 	h.linker.LinkOrder(ctx, o)
+	h.pageAuthorizations(ctx, w, o, prov)
 
 	w.Header().Set("Location", h.linker.GetLink(ctx, OrderLinkType, o.ID))
-	api.JSON(w, o)
+	setRetryAfter(w, o.Status, prov.GetOrderRetryAfter())
+	if keyPEM != nil {
+		h.writeJSON(w, r, &FinalizeResponse{Order: o, PrivateKey: string(keyPEM)}, http.StatusOK)
+		return
+	}
+	h.writeJSON(w, r, o, http.StatusOK)
+}
+
+// serverKeyGen generates a new key using the CA, and returns a CSR for the
+// identifiers of the order signed by the new key and the key encrypted with
+// the password in the request. The key only lives in memory and it's never
+// stored.
+func (h *Handler) serverKeyGen(ctx context.Context, prov acme.Provisioner, o *acme.Order, req *ServerKeyGenRequest) (*x509.CertificateRequest, []byte, error) {
+	if !prov.IsServerKeyGenerationEnabled() {
+		return nil, nil, acme.NewError(acme.ErrorUnauthorizedType,
+			"server-side key generation is not enabled for provisioner '%s'", prov.GetName())
+	}
+	// The key is only generated for an order ready to be finalized, a new key
+	// would not match the certificate already issued.
+	if err := o.UpdateStatus(ctx, h.db); err != nil {
+		return nil, nil, err
+	}
+	switch o.Status {
+	case acme.StatusReady:
+	case acme.StatusValid:
+		return nil, nil, acme.NewError(acme.ErrorOrderNotReadyType, "order %s has already been finalized", o.ID)
+	default:
+		return nil, nil, acme.NewError(acme.ErrorOrderNotReadyType, "order %s is not ready", o.ID)
+	}
+	kg, ok := h.ca.(acme.KeyGenerator)
+	if !ok {
+		return nil, nil, acme.NewError(acme.ErrorNotImplementedType,
+			"server-side key generation is not supported by the certificate authority")
+	}
+
+	signer, err := kg.GenerateKey(req.KeyType, req.Curve, req.Size)
+	if err != nil {
+		return nil, nil, acme.WrapError(acme.ErrorMalformedType, err, "error generating key")
+	}
+
+	template := new(x509.CertificateRequest)
+	for _, id := range o.Identifiers {
+		switch id.Type {
+		case acme.DNS:
+			template.DNSNames = append(template.DNSNames, id.Value)
+		case acme.IP:
+			template.IPAddresses = append(template.IPAddresses, net.ParseIP(id.Value))
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return nil, nil, acme.WrapErrorISE(err, "error creating certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, acme.WrapErrorISE(err, "error parsing certificate request")
+	}
+
+	block, err := pemutil.Serialize(signer, pemutil.WithPKCS8(true), pemutil.WithPassword([]byte(req.Password)))
+	if err != nil {
+		return nil, nil, acme.WrapErrorISE(err, "error encrypting key")
+	}
+	return csr, pem.EncodeToMemory(block), nil
+}
+
+func logServerKeyGen(w http.ResponseWriter, acc *acme.Account, prov acme.Provisioner, o *acme.Order, req *ServerKeyGenRequest) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		m := map[string]interface{}{
+			"account":      acc.ID,
+			"provisioner":  prov.GetName(),
+			"order":        o.ID,
+			"serverKeyGen": req.KeyType,
+		}
+		rl.WithFields(m)
+	}
+}
+
+// logRateLimitExemption flags in the request log that the per-account limits
+// were not applied to a trusted account.
+func logRateLimitExemption(w http.ResponseWriter, acc *acme.Account, prov acme.Provisioner) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		m := map[string]interface{}{
+			"account":         acc.ID,
+			"provisioner":     prov.GetName(),
+			"rateLimitExempt": true,
+		}
+		rl.WithFields(m)
+	}
+}
+
+// logMixedWildcard flags in the request log a new order that requests a
+// wildcard identifier and a subdomain of its base domain.
+func logMixedWildcard(w http.ResponseWriter, prov acme.Provisioner, name, wildcard string) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		m := map[string]interface{}{
+			"provisioner":   prov.GetName(),
+			"mixedWildcard": []string{wildcard, name},
+		}
+		rl.WithFields(m)
+	}
+}
+
+// logKeyAttestation adds the format of the key attestation and the attested
+// device to the request log.
+func logKeyAttestation(w http.ResponseWriter, ka *acme.KeyAttestation) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		m := map[string]interface{}{
+			"keyAttestation": ka.Format,
+		}
+		if ka.DeviceID != "" {
+			m["attestedDevice"] = ka.DeviceID
+		}
+		rl.WithFields(m)
+	}
 }
 
 // challengeTypes determines the types of challenges that should be used
-// for the ACME authorization request.
-func challengeTypes(az *acme.Authorization) []acme.ChallengeType {
+// for the ACME authorization request. The challenges configured in the
+// provisioner for the identifier type are used if present, otherwise the
+// default ones, or the ones of the IdentifierAuthorizer of a custom type in
+// the registry.
+func challengeTypes(prov acme.Provisioner, az *acme.Authorization, reg *acme.Registry) []acme.ChallengeType {
 	var chTypes []acme.ChallengeType
 
+	if challenges := prov.GetChallenges(string(az.Identifier.Type)); len(challenges) > 0 {
+		for _, typ := range challenges {
+			// HTTP and TLS challenges can only be used for identifiers without wildcards.
+			if az.Wildcard && acme.ChallengeType(typ) != acme.DNS01 {
+				continue
+			}
+			chTypes = append(chTypes, acme.ChallengeType(typ))
+		}
+		return chTypes
+	}
+
 	switch az.Identifier.Type {
 	case acme.IP:
 		chTypes = []acme.ChallengeType{acme.HTTP01, acme.TLSALPN01}
@@ -290,7 +885,11 @@ func challengeTypes(az *acme.Authorization) []acme.ChallengeType {
 			chTypes = append(chTypes, []acme.ChallengeType{acme.HTTP01, acme.TLSALPN01}...)
 		}
 	default:
-		chTypes = []acme.ChallengeType{}
+		if a, ok := reg.IdentifierAuthorizer(az.Identifier.Type); ok {
+			chTypes = a.ChallengeTypes()
+		} else {
+			chTypes = []acme.ChallengeType{}
+		}
 	}
 
 	return chTypes
@@ -3,14 +3,18 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,7 +22,11 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"go.step.sm/crypto/jose"
+	"go.step.sm/crypto/keyutil"
 	"go.step.sm/crypto/pemutil"
+	"go.step.sm/crypto/x509util"
 )
 
 func TestNewOrderRequest_Validate(t *testing.T) {
@@ -35,6 +43,7 @@ func TestNewOrderRequest_Validate(t *testing.T) {
 			}
 		},
 		"fail/bad-identifier": func(t *testing.T) test {
+			err := acme.NewDetailedError(acme.ErrorUnsupportedIdentifierType, "identifier bar.com has an unsupported type foo")
 			return test{
 				nor: &NewOrderRequest{
 					Identifiers: []acme.Identifier{
@@ -42,7 +51,7 @@ func TestNewOrderRequest_Validate(t *testing.T) {
 						{Type: "foo", Value: "bar.com"},
 					},
 				},
-				err: acme.NewError(acme.ErrorMalformedType, "identifier type unsupported: foo"),
+				err: err,
 			}
 		},
 		"fail/bad-ip": func(t *testing.T) test {
@@ -143,7 +152,7 @@ func TestNewOrderRequest_Validate(t *testing.T) {
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
-			if err := tc.nor.Validate(); err != nil {
+			if err := tc.nor.Validate(nil); err != nil {
 				if assert.NotNil(t, err) {
 					ae, ok := err.(*acme.Error)
 					assert.True(t, ok)
@@ -182,9 +191,19 @@ func TestFinalizeRequestValidate(t *testing.T) {
 	}
 	var tests = map[string]func(t *testing.T) test{
 		"fail/parse-csr-error": func(t *testing.T) test {
+			err := acme.NewDetailedError(acme.ErrorMalformedType, "unable to parse csr: asn1: syntax error: sequence truncated")
 			return test{
 				fr:  &FinalizeRequest{},
-				err: acme.NewError(acme.ErrorMalformedType, "unable to parse csr: asn1: syntax error: sequence truncated"),
+				err: err,
+			}
+		},
+		"fail/garbage-csr": func(t *testing.T) test {
+			err := acme.NewDetailedError(acme.ErrorMalformedType, "unable to parse csr: asn1: structure error")
+			return test{
+				fr: &FinalizeRequest{
+					CSR: base64.RawURLEncoding.EncodeToString([]byte("not a certificate request")),
+				},
+				err: err,
 			}
 		},
 		"fail/invalid-csr-signature": func(t *testing.T) test {
@@ -192,11 +211,40 @@ func TestFinalizeRequestValidate(t *testing.T) {
 			assert.FatalError(t, err)
 			c, ok := b.(*x509.CertificateRequest)
 			assert.Fatal(t, ok)
+			ae := acme.NewDetailedError(acme.ErrorBadCSRType, "csr signature does not verify with its public key: x509: ECDSA verification failure")
 			return test{
 				fr: &FinalizeRequest{
 					CSR: base64.RawURLEncoding.EncodeToString(c.Raw),
 				},
-				err: acme.NewError(acme.ErrorMalformedType, "csr failed signature check: x509: ECDSA verification failure"),
+				err: ae,
+			}
+		},
+		"fail/tampered-csr-signature": func(t *testing.T) test {
+			raw := append([]byte{}, csr.Raw...)
+			raw[len(raw)-1] ^= 0xff
+			ae := acme.NewDetailedError(acme.ErrorBadCSRType, "csr signature does not verify with its public key: ")
+			return test{
+				fr: &FinalizeRequest{
+					CSR: base64.RawURLEncoding.EncodeToString(raw),
+				},
+				err: ae,
+			}
+		},
+		"fail/csr-and-server-key-gen": func(t *testing.T) test {
+			return test{
+				fr: &FinalizeRequest{
+					CSR:          base64.RawURLEncoding.EncodeToString(csr.Raw),
+					ServerKeyGen: &ServerKeyGenRequest{Password: "password"},
+				},
+				err: acme.NewError(acme.ErrorMalformedType, "csr and serverKeyGen cannot be used together"),
+			}
+		},
+		"fail/server-key-gen-empty-password": func(t *testing.T) test {
+			return test{
+				fr: &FinalizeRequest{
+					ServerKeyGen: &ServerKeyGenRequest{KeyType: "EC", Curve: "P-256"},
+				},
+				err: acme.NewError(acme.ErrorMalformedType, "serverKeyGen password cannot be empty"),
 			}
 		},
 		"ok": func(t *testing.T) test {
@@ -206,6 +254,13 @@ func TestFinalizeRequestValidate(t *testing.T) {
 				},
 			}
 		},
+		"ok/server-key-gen": func(t *testing.T) test {
+			return test{
+				fr: &FinalizeRequest{
+					ServerKeyGen: &ServerKeyGenRequest{Password: "password"},
+				},
+			}
+		},
 	}
 	for name, run := range tests {
 		tc := run(t)
@@ -220,7 +275,13 @@ func TestFinalizeRequestValidate(t *testing.T) {
 				}
 			} else {
 				if assert.Nil(t, tc.err) {
-					assert.Equals(t, tc.fr.csr.Raw, csr.Raw)
+					if tc.fr.ServerKeyGen != nil {
+						assert.Nil(t, tc.fr.csr)
+						assert.Equals(t, tc.fr.ServerKeyGen.KeyType, "EC")
+						assert.Equals(t, tc.fr.ServerKeyGen.Curve, "P-256")
+					} else {
+						assert.Equals(t, tc.fr.csr.Raw, csr.Raw)
+					}
 				}
 			}
 		})
@@ -271,6 +332,8 @@ func TestHandler_GetOrder(t *testing.T) {
 		db         acme.DB
 		ctx        context.Context
 		statusCode int
+		order      *acme.Order
+		retryAfter []string
 		err        *acme.Error
 	}
 	var tests = map[string]func(t *testing.T) test{
@@ -417,6 +480,51 @@ func TestHandler_GetOrder(t *testing.T) {
 				statusCode: 200,
 			}
 		},
+		"ok/pending": func(t *testing.T) test {
+			p := newProv().(*provisioner.ACME)
+			p.OrderRetryAfter = &provisioner.Duration{Duration: 10 * time.Second}
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			pending := o
+			pending.Status = acme.StatusPending
+			pending.Error = nil
+			pending.ExpiresAt = now.Add(time.Hour)
+			pending.AuthorizationURLs = []string{
+				fmt.Sprintf("%s/acme/%s/authz/foo", baseURL.String(), escProvName),
+			}
+			return test{
+				db: &acme.MockDB{
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						return &acme.Order{
+							ID:               "orderID",
+							AccountID:        "accountID",
+							ProvisionerID:    fmt.Sprintf("acme/%s", prov.GetName()),
+							ExpiresAt:        pending.ExpiresAt,
+							Status:           acme.StatusPending,
+							AuthorizationIDs: []string{"foo"},
+							NotBefore:        nbf,
+							NotAfter:         naf,
+							Identifiers:      o.Identifiers,
+						}, nil
+					},
+					MockGetAuthorization: func(ctx context.Context, id string) (*acme.Authorization, error) {
+						assert.Equals(t, id, "foo")
+						return &acme.Authorization{
+							ID:        "foo",
+							Status:    acme.StatusPending,
+							ExpiresAt: pending.ExpiresAt,
+						}, nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 200,
+				order:      &pending,
+				retryAfter: []string{"10"},
+			}
+		},
 	}
 	for name, run := range tests {
 		tc := run(t)
@@ -444,11 +552,17 @@ func TestHandler_GetOrder(t *testing.T) {
 				assert.Equals(t, ae.Subproblems, tc.err.Subproblems)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
 			} else {
-				expB, err := json.Marshal(o)
+				expO := &o
+				if tc.order != nil {
+					expO = tc.order
+				}
+				expB, err := json.Marshal(expO)
 				assert.FatalError(t, err)
 
 				assert.Equals(t, bytes.TrimSpace(body), expB)
 				assert.Equals(t, res.Header["Location"], []string{u})
+				assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL.String(), escProvName)})
+				assert.Equals(t, res.Header["Retry-After"], tc.retryAfter)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/json"})
 			}
 		})
@@ -457,9 +571,10 @@ func TestHandler_GetOrder(t *testing.T) {
 
 func TestHandler_newAuthorization(t *testing.T) {
 	type test struct {
-		az  *acme.Authorization
-		db  acme.DB
-		err *acme.Error
+		az   *acme.Authorization
+		prov acme.Provisioner
+		db   acme.DB
+		err  *acme.Error
 	}
 	var tests = map[string]func(t *testing.T) test{
 		"fail/error-db.CreateChallenge": func(t *testing.T) test {
@@ -632,12 +747,74 @@ func TestHandler_newAuthorization(t *testing.T) {
 				az: az,
 			}
 		},
+		"fail/no-challenges": func(t *testing.T) test {
+			az := &acme.Authorization{
+				AccountID: "accID",
+				Identifier: acme.Identifier{
+					Type:  "dns",
+					Value: "*.zap.internal",
+				},
+			}
+			return test{
+				prov: &acme.MockProvisioner{
+					MgetChallenges: func(typ string) []string {
+						return []string{"http-01"}
+					},
+				},
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						assert.FatalError(t, errors.New("unexpected call to CreateChallenge"))
+						return nil
+					},
+				},
+				az:  az,
+				err: acme.NewError(acme.ErrorRejectedIdentifierType, "no challenges are allowed for dns identifier zap.internal"),
+			}
+		},
+		"ok/provisioner-challenges": func(t *testing.T) test {
+			az := &acme.Authorization{
+				AccountID: "accID",
+				Identifier: acme.Identifier{
+					Type:  "ip",
+					Value: "10.0.0.1",
+				},
+				Status:    acme.StatusPending,
+				ExpiresAt: clock.Now(),
+			}
+			var ch1 **acme.Challenge
+			return test{
+				prov: &acme.MockProvisioner{
+					MgetChallenges: func(typ string) []string {
+						assert.Equals(t, typ, "ip")
+						return []string{"http-01"}
+					},
+				},
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						ch.ID = "http"
+						assert.Equals(t, ch.Type, acme.HTTP01)
+						assert.Equals(t, ch.Value, "10.0.0.1")
+						ch1 = &ch
+						return nil
+					},
+					MockCreateAuthorization: func(ctx context.Context, _az *acme.Authorization) error {
+						assert.Equals(t, _az.Challenges, []*acme.Challenge{*ch1})
+						return nil
+					},
+				},
+				az: az,
+			}
+		},
 	}
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
 			tc := run(t)
 			h := &Handler{db: tc.db}
-			if err := h.newAuthorization(context.Background(), tc.az); err != nil {
+			prov := tc.prov
+			if prov == nil {
+				prov = newProv()
+			}
+			if err := h.newAuthorization(context.Background(), prov, tc.az, 0); err != nil {
 				if assert.NotNil(t, tc.err) {
 					switch k := err.(type) {
 					case *acme.Error:
@@ -658,6 +835,30 @@ func TestHandler_newAuthorization(t *testing.T) {
 	}
 }
 
+// mockWildcardCA is a CA that implements the acme.WildcardAuthorizer interface.
+type mockWildcardCA struct {
+	acme.CertificateAuthority
+	authorizeWildcard func(provisionerName, domain string) error
+}
+
+func (m *mockWildcardCA) AuthorizeWildcard(provisionerName, domain string) error {
+	return m.authorizeWildcard(provisionerName, domain)
+}
+
+type mockKeyGenCA struct {
+	acme.CertificateAuthority
+	sign        func(cr *x509.CertificateRequest, opts provisioner.SignOptions, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
+	generateKey func(kty, crv string, size int) (crypto.Signer, error)
+}
+
+func (m *mockKeyGenCA) Sign(cr *x509.CertificateRequest, opts provisioner.SignOptions, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+	return m.sign(cr, opts, signOpts...)
+}
+
+func (m *mockKeyGenCA) GenerateKey(kty, crv string, size int) (crypto.Signer, error) {
+	return m.generateKey(kty, crv, size)
+}
+
 func TestHandler_NewOrder(t *testing.T) {
 	// Request with chi context
 	prov := newProv()
@@ -668,6 +869,7 @@ func TestHandler_NewOrder(t *testing.T) {
 
 	type test struct {
 		db         acme.DB
+		ca         acme.CertificateAuthority
 		ctx        context.Context
 		nor        *NewOrderRequest
 		statusCode int
@@ -756,7 +958,7 @@ func TestHandler_NewOrder(t *testing.T) {
 				err:        acme.NewError(acme.ErrorMalformedType, "identifiers list cannot be empty"),
 			}
 		},
-		"fail/error-h.newAuthorization": func(t *testing.T) test {
+		"fail/error-db.GetAuthorizationsByAccountID": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
 			fr := &NewOrderRequest{
 				Identifiers: []acme.Identifier{
@@ -772,216 +974,317 @@ func TestHandler_NewOrder(t *testing.T) {
 				ctx:        ctx,
 				statusCode: 500,
 				db: &acme.MockDB{
-					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
-						assert.Equals(t, ch.AccountID, "accID")
-						assert.Equals(t, ch.Type, acme.DNS01)
-						assert.NotEquals(t, ch.Token, "")
-						assert.Equals(t, ch.Status, acme.StatusPending)
-						assert.Equals(t, ch.Value, "zap.internal")
-						return errors.New("force")
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						assert.Equals(t, accID, "accID")
+						return nil, errors.New("force")
 					},
 				},
-				err: acme.NewErrorISE("error creating challenge: force"),
+				err: acme.NewErrorISE("error retrieving authorizations: force"),
 			}
 		},
-		"fail/error-db.CreateOrder": func(t *testing.T) test {
+		"fail/too-many-pending-authorizations": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
 			fr := &NewOrderRequest{
 				Identifiers: []acme.Identifier{
 					{Type: "dns", Value: "zap.internal"},
+					{Type: "dns", Value: "zar.internal"},
 				},
 			}
 			b, err := json.Marshal(fr)
 			assert.FatalError(t, err)
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			p := &provisioner.ACME{Type: "ACME", Name: "limited", MaxPendingAuthz: 3}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
 			ctx = context.WithValue(ctx, accContextKey, acc)
 			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
-			var (
-				ch1, ch2, ch3 **acme.Challenge
-				az1ID         *string
-				count         = 0
-			)
 			return test{
 				ctx:        ctx,
-				statusCode: 500,
+				statusCode: 400,
 				db: &acme.MockDB{
-					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
-						switch count {
-						case 0:
-							ch.ID = "dns"
-							assert.Equals(t, ch.Type, acme.DNS01)
-							ch1 = &ch
-						case 1:
-							ch.ID = "http"
-							assert.Equals(t, ch.Type, acme.HTTP01)
-							ch2 = &ch
-						case 2:
-							ch.ID = "tls"
-							assert.Equals(t, ch.Type, acme.TLSALPN01)
-							ch3 = &ch
-						default:
-							assert.FatalError(t, errors.New("test logic error"))
-							return errors.New("force")
-						}
-						count++
-						assert.Equals(t, ch.AccountID, "accID")
-						assert.NotEquals(t, ch.Token, "")
-						assert.Equals(t, ch.Status, acme.StatusPending)
-						assert.Equals(t, ch.Value, "zap.internal")
-						return nil
-					},
-					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
-						az.ID = "az1ID"
-						az1ID = &az.ID
-						assert.Equals(t, az.AccountID, "accID")
-						assert.NotEquals(t, az.Token, "")
-						assert.Equals(t, az.Status, acme.StatusPending)
-						assert.Equals(t, az.Identifier, fr.Identifiers[0])
-						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
-						assert.Equals(t, az.Wildcard, false)
-						return nil
-					},
-					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
-						assert.Equals(t, o.AccountID, "accID")
-						assert.Equals(t, o.ProvisionerID, prov.GetID())
-						assert.Equals(t, o.Status, acme.StatusPending)
-						assert.Equals(t, o.Identifiers, fr.Identifiers)
-						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
-						return errors.New("force")
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						assert.Equals(t, accID, "accID")
+						// Only the pending authorizations count towards the limit.
+						return []*acme.Authorization{
+							{ID: "az1", Status: acme.StatusPending},
+							{ID: "az2", Status: acme.StatusPending},
+							{ID: "az3", Status: acme.StatusValid},
+						}, nil
 					},
 				},
-				err: acme.NewErrorISE("error creating order: force"),
+				err: acme.NewError(acme.ErrorRateLimitedType, "account 'accID' has too many pending authorizations; the maximum is 3"),
 			}
 		},
-		"ok/multiple-authz": func(t *testing.T) test {
+		"fail/create-pending-authorization-limit": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
-			nor := &NewOrderRequest{
+			fr := &NewOrderRequest{
 				Identifiers: []acme.Identifier{
 					{Type: "dns", Value: "zap.internal"},
-					{Type: "dns", Value: "*.zar.internal"},
+					{Type: "dns", Value: "zar.internal"},
 				},
 			}
-			b, err := json.Marshal(nor)
+			b, err := json.Marshal(fr)
 			assert.FatalError(t, err)
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			p := &provisioner.ACME{Type: "ACME", Name: "limited", MaxPendingAuthz: 3}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
 			ctx = context.WithValue(ctx, accContextKey, acc)
 			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
-			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
-			var (
-				ch1, ch2, ch3, ch4 **acme.Challenge
-				az1ID, az2ID       *string
-				chCount, azCount   = 0, 0
-			)
+			var count int
 			return test{
 				ctx:        ctx,
-				statusCode: 201,
-				nor:        nor,
+				statusCode: 400,
 				db: &acme.MockDB{
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						return []*acme.Authorization{{ID: "az0", Status: acme.StatusPending}}, nil
+					},
 					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
-						switch chCount {
-						case 0:
-							ch.ID = "dns"
-							assert.Equals(t, ch.Type, acme.DNS01)
-							assert.Equals(t, ch.Value, "zap.internal")
-							ch1 = &ch
-						case 1:
-							ch.ID = "http"
-							assert.Equals(t, ch.Type, acme.HTTP01)
-							assert.Equals(t, ch.Value, "zap.internal")
-							ch2 = &ch
-						case 2:
-							ch.ID = "tls"
-							assert.Equals(t, ch.Type, acme.TLSALPN01)
-							assert.Equals(t, ch.Value, "zap.internal")
-							ch3 = &ch
-						case 3:
-							ch.ID = "dns"
-							assert.Equals(t, ch.Type, acme.DNS01)
-							assert.Equals(t, ch.Value, "zar.internal")
-							ch4 = &ch
-						default:
-							assert.FatalError(t, errors.New("test logic error"))
-							return errors.New("force")
-						}
-						chCount++
-						assert.Equals(t, ch.AccountID, "accID")
-						assert.NotEquals(t, ch.Token, "")
-						assert.Equals(t, ch.Status, acme.StatusPending)
+						count++
+						ch.ID = fmt.Sprintf("ch%dID", count)
 						return nil
 					},
-					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
-						switch azCount {
-						case 0:
-							az.ID = "az1ID"
-							az1ID = &az.ID
-							assert.Equals(t, az.Identifier, nor.Identifiers[0])
-							assert.Equals(t, az.Wildcard, false)
-							assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
-						case 1:
-							az.ID = "az2ID"
-							az2ID = &az.ID
-							assert.Equals(t, az.Identifier, acme.Identifier{
-								Type:  acme.DNS,
-								Value: "zar.internal",
-							})
-							assert.Equals(t, az.Wildcard, true)
-							assert.Equals(t, az.Challenges, []*acme.Challenge{*ch4})
-						default:
-							assert.FatalError(t, errors.New("test logic error"))
-							return errors.New("force")
+					// Another order created a pending authorization after the
+					// limit was checked.
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						assert.Equals(t, max, 3)
+						if az.Identifier.Value == "zar.internal" {
+							return false, nil
 						}
-						azCount++
-						assert.Equals(t, az.AccountID, "accID")
-						assert.NotEquals(t, az.Token, "")
-						assert.Equals(t, az.Status, acme.StatusPending)
+						az.ID = "az1ID"
+						return true, nil
+					},
+					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+						t.Error("CreateAuthorization should not be called")
 						return nil
 					},
-					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
-						o.ID = "ordID"
-						assert.Equals(t, o.AccountID, "accID")
-						assert.Equals(t, o.ProvisionerID, prov.GetID())
-						assert.Equals(t, o.Status, acme.StatusPending)
-						assert.Equals(t, o.Identifiers, nor.Identifiers)
-						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID, *az2ID})
+					MockDeleteAuthorizations: func(ctx context.Context, azs []*acme.Authorization) error {
+						// The first authorization and the challenges of the
+						// second one are deleted.
+						if assert.Equals(t, len(azs), 2) {
+							assert.Equals(t, azs[0].ID, "az1ID")
+							assert.Equals(t, azs[1].ID, "")
+						}
 						return nil
 					},
 				},
-				vr: func(t *testing.T, o *acme.Order) {
-					now := clock.Now()
-					testBufferDur := 5 * time.Second
-					orderExpiry := now.Add(defaultOrderExpiry)
-					expNbf := now.Add(-defaultOrderBackdate)
-					expNaf := now.Add(prov.DefaultTLSCertDuration())
-
-					assert.Equals(t, o.ID, "ordID")
-					assert.Equals(t, o.Status, acme.StatusPending)
-					assert.Equals(t, o.Identifiers, nor.Identifiers)
-					assert.Equals(t, o.AuthorizationURLs, []string{
-						fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName),
-						fmt.Sprintf("%s/acme/%s/authz/az2ID", baseURL.String(), escProvName),
-					})
-					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
-					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
-					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
-					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
-					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
-					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
+				err: acme.NewError(acme.ErrorRateLimitedType, "account 'accID' has too many pending authorizations; the maximum is 3"),
+			}
+		},
+		"fail/increment-order-count-error": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			fr := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+			}
+			b, err := json.Marshal(fr)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{Type: "ACME", Name: "limited", MaxOrdersPerAccount: 3}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				statusCode: 500,
+				db: &acme.MockDB{
+					MockIncrementOrderCount: func(ctx context.Context, accID string, max int) (bool, error) {
+						return false, errors.New("force")
+					},
 				},
+				err: acme.NewErrorISE("error updating order count: force"),
 			}
 		},
-		"ok/default-naf-nbf": func(t *testing.T) test {
+		"fail/max-orders-per-account": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			fr := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+			}
+			b, err := json.Marshal(fr)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{Type: "ACME", Name: "limited", MaxOrdersPerAccount: 3}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				statusCode: 400,
+				db: &acme.MockDB{
+					MockIncrementOrderCount: func(ctx context.Context, accID string, max int) (bool, error) {
+						assert.Equals(t, accID, "accID")
+						assert.Equals(t, max, 3)
+						return false, nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						assert.FatalError(t, errors.New("unexpected authorization"))
+						return true, nil
+					},
+				},
+				err: acme.NewError(acme.ErrorRateLimitedType, "account 'accID' has reached the maximum number of orders; the maximum is 3"),
+			}
+		},
+		"fail/naf-before-nbf": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
+			nbf := clock.Now().Add(time.Hour)
+			naf := nbf.Add(-time.Minute)
 			nor := &NewOrderRequest{
 				Identifiers: []acme.Identifier{
 					{Type: "dns", Value: "zap.internal"},
 				},
+				NotBefore: nbf,
+				NotAfter:  naf,
 			}
 			b, err := json.Marshal(nor)
 			assert.FatalError(t, err)
 			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
 			ctx = context.WithValue(ctx, accContextKey, acc)
 			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
-			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			return test{
+				ctx:        ctx,
+				db:         &acme.MockDB{},
+				statusCode: 400,
+				err: acme.NewError(acme.ErrorMalformedType, "notAfter (%s) cannot be before notBefore (%s)",
+					naf.Format(time.RFC3339), nbf.Format(time.RFC3339)),
+			}
+		},
+		"fail/duration-too-short": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nbf := clock.Now()
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+				NotBefore: nbf,
+				NotAfter:  nbf.Add(time.Minute),
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				db:         &acme.MockDB{},
+				statusCode: 400,
+				err: acme.NewError(acme.ErrorMalformedType, "requested duration of %v is less than the authorized minimum certificate duration of %v",
+					time.Minute, 5*time.Minute),
+			}
+		},
+		"fail/duration-too-long": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nbf := clock.Now()
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+				NotBefore: nbf,
+				NotAfter:  nbf.Add(48 * time.Hour),
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				db:         &acme.MockDB{},
+				statusCode: 400,
+				err: acme.NewError(acme.ErrorMalformedType, "requested duration of %v is more than the authorized maximum certificate duration of %v",
+					48*time.Hour, 24*time.Hour),
+			}
+		},
+		"fail/error-h.newAuthorization": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			fr := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+			}
+			b, err := json.Marshal(fr)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				statusCode: 500,
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						assert.Equals(t, ch.AccountID, "accID")
+						assert.Equals(t, ch.Type, acme.DNS01)
+						assert.NotEquals(t, ch.Token, "")
+						assert.Equals(t, ch.Status, acme.StatusPending)
+						assert.Equals(t, ch.Value, "zap.internal")
+						return errors.New("force")
+					},
+				},
+				err: acme.NewErrorISE("error creating challenge: force"),
+			}
+		},
+		"fail/error-h.newAuthorization-delete": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			fr := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+					{Type: "dns", Value: "zar.internal"},
+				},
+			}
+			b, err := json.Marshal(fr)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			var count int
+			return test{
+				ctx:        ctx,
+				statusCode: 500,
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						count++
+						ch.ID = fmt.Sprintf("ch%d", count)
+						return nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						if az.Identifier.Value == "zar.internal" {
+							return false, errors.New("force")
+						}
+						az.ID = "az1ID"
+						return true, nil
+					},
+					MockDeleteAuthorizations: func(ctx context.Context, azs []*acme.Authorization) error {
+						// The first authorization and the challenges of the
+						// second one are deleted.
+						if assert.Equals(t, len(azs), 2) {
+							assert.Equals(t, azs[0].ID, "az1ID")
+							assert.Equals(t, azs[1].ID, "")
+							var chIDs []string
+							for _, az := range azs {
+								for _, ch := range az.Challenges {
+									chIDs = append(chIDs, ch.ID)
+								}
+							}
+							assert.Equals(t, chIDs, []string{"ch1", "ch2", "ch3", "ch4", "ch5", "ch6"})
+						}
+						return errors.New("force delete")
+					},
+				},
+				err: acme.NewErrorISE("error creating authorization: force"),
+			}
+		},
+		"fail/error-db.CreateOrder": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			fr := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+			}
+			b, err := json.Marshal(fr)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
 			var (
 				ch1, ch2, ch3 **acme.Challenge
 				az1ID         *string
@@ -989,8 +1292,7 @@ func TestHandler_NewOrder(t *testing.T) {
 			)
 			return test{
 				ctx:        ctx,
-				statusCode: 201,
-				nor:        nor,
+				statusCode: 500,
 				db: &acme.MockDB{
 					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
 						switch count {
@@ -1017,56 +1319,44 @@ func TestHandler_NewOrder(t *testing.T) {
 						assert.Equals(t, ch.Value, "zap.internal")
 						return nil
 					},
-					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
 						az.ID = "az1ID"
 						az1ID = &az.ID
 						assert.Equals(t, az.AccountID, "accID")
 						assert.NotEquals(t, az.Token, "")
 						assert.Equals(t, az.Status, acme.StatusPending)
-						assert.Equals(t, az.Identifier, nor.Identifiers[0])
+						assert.Equals(t, az.Identifier, fr.Identifiers[0])
 						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
 						assert.Equals(t, az.Wildcard, false)
-						return nil
+						return true, nil
 					},
 					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
-						o.ID = "ordID"
 						assert.Equals(t, o.AccountID, "accID")
 						assert.Equals(t, o.ProvisionerID, prov.GetID())
 						assert.Equals(t, o.Status, acme.StatusPending)
-						assert.Equals(t, o.Identifiers, nor.Identifiers)
+						assert.Equals(t, o.Identifiers, fr.Identifiers)
 						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
+						return errors.New("force")
+					},
+					MockDeleteAuthorizations: func(ctx context.Context, azs []*acme.Authorization) error {
+						// The authorization created for the order is deleted.
+						if assert.Equals(t, len(azs), 1) {
+							assert.Equals(t, azs[0].ID, "az1ID")
+							assert.Equals(t, azs[0].Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
+						}
 						return nil
 					},
 				},
-				vr: func(t *testing.T, o *acme.Order) {
-					now := clock.Now()
-					testBufferDur := 5 * time.Second
-					orderExpiry := now.Add(defaultOrderExpiry)
-					expNbf := now.Add(-defaultOrderBackdate)
-					expNaf := now.Add(prov.DefaultTLSCertDuration())
-
-					assert.Equals(t, o.ID, "ordID")
-					assert.Equals(t, o.Status, acme.StatusPending)
-					assert.Equals(t, o.Identifiers, nor.Identifiers)
-					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
-					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
-					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
-					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
-					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
-					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
-					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
-				},
+				err: acme.NewErrorISE("error creating order: force"),
 			}
 		},
-		"ok/nbf-no-naf": func(t *testing.T) test {
-			now := clock.Now()
-			expNbf := now.Add(10 * time.Minute)
+		"ok/multiple-authz": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accID"}
 			nor := &NewOrderRequest{
 				Identifiers: []acme.Identifier{
 					{Type: "dns", Value: "zap.internal"},
+					{Type: "dns", Value: "*.zar.internal"},
 				},
-				NotBefore: expNbf,
 			}
 			b, err := json.Marshal(nor)
 			assert.FatalError(t, err)
@@ -1075,9 +1365,9 @@ func TestHandler_NewOrder(t *testing.T) {
 			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
 			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
 			var (
-				ch1, ch2, ch3 **acme.Challenge
-				az1ID         *string
-				count         = 0
+				ch1, ch2, ch3, ch4 **acme.Challenge
+				az1ID, az2ID       *string
+				chCount, azCount   = 0, 0
 			)
 			return test{
 				ctx:        ctx,
@@ -1085,40 +1375,63 @@ func TestHandler_NewOrder(t *testing.T) {
 				nor:        nor,
 				db: &acme.MockDB{
 					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
-						switch count {
+						switch chCount {
 						case 0:
 							ch.ID = "dns"
 							assert.Equals(t, ch.Type, acme.DNS01)
+							assert.Equals(t, ch.Value, "zap.internal")
 							ch1 = &ch
 						case 1:
 							ch.ID = "http"
 							assert.Equals(t, ch.Type, acme.HTTP01)
+							assert.Equals(t, ch.Value, "zap.internal")
 							ch2 = &ch
 						case 2:
 							ch.ID = "tls"
 							assert.Equals(t, ch.Type, acme.TLSALPN01)
+							assert.Equals(t, ch.Value, "zap.internal")
 							ch3 = &ch
+						case 3:
+							ch.ID = "dns"
+							assert.Equals(t, ch.Type, acme.DNS01)
+							assert.Equals(t, ch.Value, "zar.internal")
+							ch4 = &ch
 						default:
 							assert.FatalError(t, errors.New("test logic error"))
 							return errors.New("force")
 						}
-						count++
+						chCount++
 						assert.Equals(t, ch.AccountID, "accID")
 						assert.NotEquals(t, ch.Token, "")
 						assert.Equals(t, ch.Status, acme.StatusPending)
-						assert.Equals(t, ch.Value, "zap.internal")
 						return nil
 					},
-					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
-						az.ID = "az1ID"
-						az1ID = &az.ID
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						switch azCount {
+						case 0:
+							az.ID = "az1ID"
+							az1ID = &az.ID
+							assert.Equals(t, az.Identifier, nor.Identifiers[0])
+							assert.Equals(t, az.Wildcard, false)
+							assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
+						case 1:
+							az.ID = "az2ID"
+							az2ID = &az.ID
+							assert.Equals(t, az.Identifier, acme.Identifier{
+								Type:  acme.DNS,
+								Value: "zar.internal",
+							})
+							assert.Equals(t, az.Wildcard, true)
+							assert.Equals(t, az.Challenges, []*acme.Challenge{*ch4})
+						default:
+							assert.FatalError(t, errors.New("test logic error"))
+							return false, errors.New("force")
+						}
+						azCount++
 						assert.Equals(t, az.AccountID, "accID")
 						assert.NotEquals(t, az.Token, "")
 						assert.Equals(t, az.Status, acme.StatusPending)
-						assert.Equals(t, az.Identifier, nor.Identifiers[0])
-						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
-						assert.Equals(t, az.Wildcard, false)
-						return nil
+						return true, nil
 					},
 					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
 						o.ID = "ordID"
@@ -1126,7 +1439,7 @@ func TestHandler_NewOrder(t *testing.T) {
 						assert.Equals(t, o.ProvisionerID, prov.GetID())
 						assert.Equals(t, o.Status, acme.StatusPending)
 						assert.Equals(t, o.Identifiers, nor.Identifiers)
-						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
+						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID, *az2ID})
 						return nil
 					},
 				},
@@ -1134,12 +1447,16 @@ func TestHandler_NewOrder(t *testing.T) {
 					now := clock.Now()
 					testBufferDur := 5 * time.Second
 					orderExpiry := now.Add(defaultOrderExpiry)
-					expNaf := expNbf.Add(prov.DefaultTLSCertDuration())
+					expNbf := now.Add(-defaultOrderBackdate)
+					expNaf := now.Add(prov.DefaultTLSCertDuration())
 
 					assert.Equals(t, o.ID, "ordID")
 					assert.Equals(t, o.Status, acme.StatusPending)
 					assert.Equals(t, o.Identifiers, nor.Identifiers)
-					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
+					assert.Equals(t, o.AuthorizationURLs, []string{
+						fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName),
+						fmt.Sprintf("%s/acme/%s/authz/az2ID", baseURL.String(), escProvName),
+					})
 					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
 					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
 					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
@@ -1149,184 +1466,1014 @@ func TestHandler_NewOrder(t *testing.T) {
 				},
 			}
 		},
-		"ok/naf-no-nbf": func(t *testing.T) test {
+		"ok/default-naf-nbf": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var (
+				ch1, ch2, ch3 **acme.Challenge
+				az1ID         *string
+				count         = 0
+			)
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						switch count {
+						case 0:
+							ch.ID = "dns"
+							assert.Equals(t, ch.Type, acme.DNS01)
+							ch1 = &ch
+						case 1:
+							ch.ID = "http"
+							assert.Equals(t, ch.Type, acme.HTTP01)
+							ch2 = &ch
+						case 2:
+							ch.ID = "tls"
+							assert.Equals(t, ch.Type, acme.TLSALPN01)
+							ch3 = &ch
+						default:
+							assert.FatalError(t, errors.New("test logic error"))
+							return errors.New("force")
+						}
+						count++
+						assert.Equals(t, ch.AccountID, "accID")
+						assert.NotEquals(t, ch.Token, "")
+						assert.Equals(t, ch.Status, acme.StatusPending)
+						assert.Equals(t, ch.Value, "zap.internal")
+						return nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						az.ID = "az1ID"
+						az1ID = &az.ID
+						assert.Equals(t, az.AccountID, "accID")
+						assert.NotEquals(t, az.Token, "")
+						assert.Equals(t, az.Status, acme.StatusPending)
+						assert.Equals(t, az.Identifier, nor.Identifiers[0])
+						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
+						assert.Equals(t, az.Wildcard, false)
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						assert.Equals(t, o.AccountID, "accID")
+						assert.Equals(t, o.ProvisionerID, prov.GetID())
+						assert.Equals(t, o.Status, acme.StatusPending)
+						assert.Equals(t, o.Identifiers, nor.Identifiers)
+						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					now := clock.Now()
+					testBufferDur := 5 * time.Second
+					orderExpiry := now.Add(defaultOrderExpiry)
+					expNbf := now.Add(-defaultOrderBackdate)
+					expNaf := now.Add(prov.DefaultTLSCertDuration())
+
+					assert.Equals(t, o.ID, "ordID")
+					assert.Equals(t, o.Status, acme.StatusPending)
+					assert.Equals(t, o.Identifiers, nor.Identifiers)
+					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
+					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
+					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
+					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
+					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
+					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
+					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
+				},
+			}
+		},
+		"ok/nbf-no-naf": func(t *testing.T) test {
+			now := clock.Now()
+			expNbf := now.Add(10 * time.Minute)
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+				NotBefore: expNbf,
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var (
+				ch1, ch2, ch3 **acme.Challenge
+				az1ID         *string
+				count         = 0
+			)
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						switch count {
+						case 0:
+							ch.ID = "dns"
+							assert.Equals(t, ch.Type, acme.DNS01)
+							ch1 = &ch
+						case 1:
+							ch.ID = "http"
+							assert.Equals(t, ch.Type, acme.HTTP01)
+							ch2 = &ch
+						case 2:
+							ch.ID = "tls"
+							assert.Equals(t, ch.Type, acme.TLSALPN01)
+							ch3 = &ch
+						default:
+							assert.FatalError(t, errors.New("test logic error"))
+							return errors.New("force")
+						}
+						count++
+						assert.Equals(t, ch.AccountID, "accID")
+						assert.NotEquals(t, ch.Token, "")
+						assert.Equals(t, ch.Status, acme.StatusPending)
+						assert.Equals(t, ch.Value, "zap.internal")
+						return nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						az.ID = "az1ID"
+						az1ID = &az.ID
+						assert.Equals(t, az.AccountID, "accID")
+						assert.NotEquals(t, az.Token, "")
+						assert.Equals(t, az.Status, acme.StatusPending)
+						assert.Equals(t, az.Identifier, nor.Identifiers[0])
+						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
+						assert.Equals(t, az.Wildcard, false)
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						assert.Equals(t, o.AccountID, "accID")
+						assert.Equals(t, o.ProvisionerID, prov.GetID())
+						assert.Equals(t, o.Status, acme.StatusPending)
+						assert.Equals(t, o.Identifiers, nor.Identifiers)
+						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					now := clock.Now()
+					testBufferDur := 5 * time.Second
+					orderExpiry := now.Add(defaultOrderExpiry)
+					expNaf := expNbf.Add(prov.DefaultTLSCertDuration())
+
+					assert.Equals(t, o.ID, "ordID")
+					assert.Equals(t, o.Status, acme.StatusPending)
+					assert.Equals(t, o.Identifiers, nor.Identifiers)
+					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
+					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
+					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
+					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
+					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
+					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
+					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
+				},
+			}
+		},
+		"ok/naf-no-nbf": func(t *testing.T) test {
+			now := clock.Now()
+			expNaf := now.Add(15 * time.Minute)
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+				NotAfter: expNaf,
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var (
+				ch1, ch2, ch3 **acme.Challenge
+				az1ID         *string
+				count         = 0
+			)
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						switch count {
+						case 0:
+							ch.ID = "dns"
+							assert.Equals(t, ch.Type, acme.DNS01)
+							ch1 = &ch
+						case 1:
+							ch.ID = "http"
+							assert.Equals(t, ch.Type, acme.HTTP01)
+							ch2 = &ch
+						case 2:
+							ch.ID = "tls"
+							assert.Equals(t, ch.Type, acme.TLSALPN01)
+							ch3 = &ch
+						default:
+							assert.FatalError(t, errors.New("test logic error"))
+							return errors.New("force")
+						}
+						count++
+						assert.Equals(t, ch.AccountID, "accID")
+						assert.NotEquals(t, ch.Token, "")
+						assert.Equals(t, ch.Status, acme.StatusPending)
+						assert.Equals(t, ch.Value, "zap.internal")
+						return nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						az.ID = "az1ID"
+						az1ID = &az.ID
+						assert.Equals(t, az.AccountID, "accID")
+						assert.NotEquals(t, az.Token, "")
+						assert.Equals(t, az.Status, acme.StatusPending)
+						assert.Equals(t, az.Identifier, nor.Identifiers[0])
+						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
+						assert.Equals(t, az.Wildcard, false)
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						assert.Equals(t, o.AccountID, "accID")
+						assert.Equals(t, o.ProvisionerID, prov.GetID())
+						assert.Equals(t, o.Status, acme.StatusPending)
+						assert.Equals(t, o.Identifiers, nor.Identifiers)
+						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					testBufferDur := 5 * time.Second
+					orderExpiry := now.Add(defaultOrderExpiry)
+					expNbf := now.Add(-defaultOrderBackdate)
+
+					assert.Equals(t, o.ID, "ordID")
+					assert.Equals(t, o.Status, acme.StatusPending)
+					assert.Equals(t, o.Identifiers, nor.Identifiers)
+					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
+					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
+					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
+					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
+					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
+					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
+					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
+				},
+			}
+		},
+		"ok/naf-nbf": func(t *testing.T) test {
+			now := clock.Now()
+			expNbf := now.Add(5 * time.Minute)
+			expNaf := now.Add(15 * time.Minute)
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+				NotBefore: expNbf,
+				NotAfter:  expNaf,
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var (
+				ch1, ch2, ch3 **acme.Challenge
+				az1ID         *string
+				count         = 0
+			)
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+						switch count {
+						case 0:
+							ch.ID = "dns"
+							assert.Equals(t, ch.Type, acme.DNS01)
+							ch1 = &ch
+						case 1:
+							ch.ID = "http"
+							assert.Equals(t, ch.Type, acme.HTTP01)
+							ch2 = &ch
+						case 2:
+							ch.ID = "tls"
+							assert.Equals(t, ch.Type, acme.TLSALPN01)
+							ch3 = &ch
+						default:
+							assert.FatalError(t, errors.New("test logic error"))
+							return errors.New("force")
+						}
+						count++
+						assert.Equals(t, ch.AccountID, "accID")
+						assert.NotEquals(t, ch.Token, "")
+						assert.Equals(t, ch.Status, acme.StatusPending)
+						assert.Equals(t, ch.Value, "zap.internal")
+						return nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						az.ID = "az1ID"
+						az1ID = &az.ID
+						assert.Equals(t, az.AccountID, "accID")
+						assert.NotEquals(t, az.Token, "")
+						assert.Equals(t, az.Status, acme.StatusPending)
+						assert.Equals(t, az.Identifier, nor.Identifiers[0])
+						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
+						assert.Equals(t, az.Wildcard, false)
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						assert.Equals(t, o.AccountID, "accID")
+						assert.Equals(t, o.ProvisionerID, prov.GetID())
+						assert.Equals(t, o.Status, acme.StatusPending)
+						assert.Equals(t, o.Identifiers, nor.Identifiers)
+						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					testBufferDur := 5 * time.Second
+					orderExpiry := now.Add(defaultOrderExpiry)
+
+					assert.Equals(t, o.ID, "ordID")
+					assert.Equals(t, o.Status, acme.StatusPending)
+					assert.Equals(t, o.Identifiers, nor.Identifiers)
+					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
+					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
+					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
+					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
+					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
+					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
+					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
+				},
+			}
+		},
+		"fail/wildcard-rejected": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+					{Type: "dns", Value: "*.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				db:         &acme.MockDB{},
+				statusCode: 400,
+				ca: &mockWildcardCA{
+					authorizeWildcard: func(provisionerName, domain string) error {
+						assert.Equals(t, provisionerName, prov.GetName())
+						assert.Equals(t, domain, "example.com")
+						return errors.New("force")
+					},
+				},
+				err: acme.NewError(acme.ErrorRejectedIdentifierType, "wildcard identifier *.example.com rejected: force"),
+			}
+		},
+		"fail/identifier-rejected-by-policy": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "build-42.ci.example.com"},
+					{Type: "dns", Value: "zap.internal"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{
+				Type:   "ACME",
+				Name:   "test@acme-<test>provisioner.com",
+				Policy: &provisioner.ACMEPolicy{DNSNameRegex: `^[a-z0-9-]+\.ci\.example\.com$`},
+			}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx:        ctx,
+				db:         &acme.MockDB{},
+				statusCode: 400,
+				err: acme.NewError(acme.ErrorRejectedIdentifierType,
+					"identifier zap.internal rejected: dns identifier zap.internal does not match the provisioner policy ^[a-z0-9-]+\\.ci\\.example\\.com$"),
+			}
+		},
+		"fail/unsupported-identifier-type": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			b := []byte(`{"identifiers":[{"type":"dns","value":"example.com"},{"type":"email","value":"jane@example.com"}]}`)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ae := acme.NewError(acme.ErrorUnsupportedIdentifierType, "")
+			ae.Detail = "identifier jane@example.com has an unsupported type email"
+			return test{
+				ctx: ctx,
+				db: &acme.MockDB{
+					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+						t.Error("CreateAuthorization should not be called")
+						return nil
+					},
+				},
+				statusCode: 400,
+				err:        ae,
+			}
+		},
+		"fail/disabled-identifier-type": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "example.com"},
+					{Type: "ip", Value: "192.168.42.42"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{
+				Type:            "ACME",
+				Name:            "test@acme-<test>provisioner.com",
+				IdentifierTypes: []string{"dns"},
+			}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ae := acme.NewError(acme.ErrorUnsupportedIdentifierType, "")
+			ae.Detail = "identifier 192.168.42.42 has a type ip that is not enabled in the provisioner"
+			return test{
+				ctx: ctx,
+				db: &acme.MockDB{
+					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+						t.Error("CreateAuthorization should not be called")
+						return nil
+					},
+				},
+				statusCode: 400,
+				err:        ae,
+			}
+		},
+		"fail/mixed-wildcard-rejected": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "example.com"},
+					{Type: "dns", Value: "*.example.com"},
+					{Type: "dns", Value: "www.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &acme.MockProvisioner{
+				MgetName: func() string { return prov.GetName() },
+				MgetMixedWildcardPolicy: func() string {
+					return provisioner.ACMEMixedWildcardPolicyReject
+				},
+			}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, acme.Provisioner(p))
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			return test{
+				ctx: ctx,
+				db: &acme.MockDB{
+					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+						t.Error("CreateAuthorization should not be called")
+						return nil
+					},
+				},
+				statusCode: 400,
+				err: acme.NewError(acme.ErrorMalformedType,
+					"identifier www.example.com cannot be requested in the same order as the wildcard identifier *.example.com"),
+			}
+		},
+		"ok/mixed-wildcard-allowed": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "example.com"},
+					{Type: "dns", Value: "*.example.com"},
+					{Type: "dns", Value: "www.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var azCount int
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						azCount++
+						az.ID = fmt.Sprintf("az%dID", azCount)
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					assert.Equals(t, azCount, 3)
+					assert.Equals(t, o.ID, "ordID")
+					assert.Equals(t, o.Identifiers, nor.Identifiers)
+				},
+			}
+		},
+		"ok/wildcard-allowed": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "*.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var called bool
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				ca: &mockWildcardCA{
+					authorizeWildcard: func(provisionerName, domain string) error {
+						assert.Equals(t, provisionerName, prov.GetName())
+						assert.Equals(t, domain, "example.com")
+						called = true
+						return nil
+					},
+				},
+				db: &acme.MockDB{
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						assert.True(t, az.Wildcard)
+						assert.Equals(t, az.Identifier.Value, "example.com")
+						az.ID = "az1ID"
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					assert.True(t, called)
+					assert.Equals(t, o.ID, "ordID")
+					assert.Equals(t, o.Identifiers, nor.Identifiers)
+				},
+			}
+		},
+		"ok/max-orders-per-account": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{Type: "ACME", Name: prov.GetName(), MaxOrdersPerAccount: 3}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var count int
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockIncrementOrderCount: func(ctx context.Context, accID string, max int) (bool, error) {
+						assert.Equals(t, accID, "accID")
+						assert.Equals(t, max, 3)
+						count++
+						return true, nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						az.ID = "az1ID"
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					assert.Equals(t, count, 1)
+					assert.Equals(t, o.ID, "ordID")
+				},
+			}
+		},
+		"ok/trusted-account": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "zap.internal"},
+					{Type: "dns", Value: "zar.internal"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{
+				Type:                "ACME",
+				Name:                prov.GetName(),
+				MaxPendingAuthz:     1,
+				MaxOrdersPerAccount: 1,
+				TrustedAccounts:     []string{"accID"},
+			}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			var count int
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						t.Error("GetAuthorizationsByAccountID should not be called")
+						return nil, nil
+					},
+					MockIncrementOrderCount: func(ctx context.Context, accID string, max int) (bool, error) {
+						t.Error("IncrementOrderCount should not be called")
+						return false, nil
+					},
+					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+						count++
+						az.ID = fmt.Sprintf("az%dID", count)
+						return nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					assert.Equals(t, count, 2)
+					assert.Equals(t, o.ID, "ordID")
+				},
+			}
+		},
+		"ok/reuse-wildcard-authz": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "a.example.com"},
+					{Type: "dns", Value: "a.b.example.com"},
+					{Type: "dns", Value: "example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{Type: "ACME", Name: prov.GetName(), ReuseWildcardAuthz: true}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			expiresAt := clock.Now().Add(time.Hour)
+			var count int
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						assert.Equals(t, accID, "accID")
+						return []*acme.Authorization{
+							{
+								ID:         "pendingID",
+								AccountID:  "accID",
+								Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+								Wildcard:   true,
+								Status:     acme.StatusPending,
+								ExpiresAt:  expiresAt,
+							},
+							{
+								ID:         "wildcardID",
+								AccountID:  "accID",
+								Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+								Wildcard:   true,
+								Status:     acme.StatusValid,
+								ExpiresAt:  expiresAt,
+							},
+						}, nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						count++
+						az.ID = fmt.Sprintf("az%dID", count)
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						assert.Equals(t, o.AuthorizationIDs, []string{"wildcardID", "az1ID", "az2ID"})
+						assert.True(t, o.ExpiresAt.Equal(expiresAt))
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					assert.Equals(t, count, 2)
+					assert.Equals(t, o.ID, "ordID")
+					assert.True(t, o.ExpiresAt.Equal(expiresAt))
+				},
+			}
+		},
+		"ok/reuse-wildcard-authz-disabled": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "a.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						// The wildcard authorization is not reused.
+						return []*acme.Authorization{{
+							ID:         "wildcardID",
+							AccountID:  "accID",
+							Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+							Wildcard:   true,
+							Status:     acme.StatusValid,
+							ExpiresAt:  clock.Now().Add(time.Hour),
+						}}, nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						az.ID = "az1ID"
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						assert.Equals(t, o.AuthorizationIDs, []string{"az1ID"})
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					assert.Equals(t, o.ID, "ordID")
+				},
+			}
+		},
+		"fail/reuse-wildcard-authz-db-error": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "a.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{Type: "ACME", Name: prov.GetName(), MaxPendingAuthz: -1, ReuseWildcardAuthz: true}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			return test{
+				ctx:        ctx,
+				statusCode: 500,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						return nil, errors.New("force")
+					},
+				},
+				err: acme.NewErrorISE("error retrieving authorizations: force"),
+			}
+		},
+		"ok/reuse-authz": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "a.example.com"},
+					{Type: "dns", Value: "b.example.com"},
+					{Type: "dns", Value: "c.example.com"},
+					{Type: "dns", Value: "*.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{Type: "ACME", Name: prov.GetName(), AuthzReuseAge: &provisioner.Duration{Duration: 24 * time.Hour}}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			now := clock.Now()
+			expiresAt := now.Add(time.Hour)
+			newAz := func(id string) *acme.Authorization {
+				validatedAt := now.Add(-time.Hour)
+				az := &acme.Authorization{
+					ID:         id,
+					AccountID:  "accID",
+					Identifier: acme.Identifier{Type: "dns", Value: "a.example.com"},
+					Status:     acme.StatusValid,
+					ExpiresAt:  expiresAt,
+				}
+				switch id {
+				case "oldID":
+					// Validated before the reuse age.
+					az.Identifier.Value = "b.example.com"
+					validatedAt = now.Add(-25 * time.Hour)
+				case "expiredID":
+					az.Identifier.Value = "c.example.com"
+					az.ExpiresAt = now.Add(-time.Minute)
+				case "pendingID":
+					az.Identifier.Value = "example.com"
+					az.Wildcard = true
+					az.Status = acme.StatusPending
+					az.Challenges = []*acme.Challenge{{Status: acme.StatusPending}}
+					return az
+				}
+				az.Challenges = []*acme.Challenge{{Status: acme.StatusValid, ValidatedAt: validatedAt.Format(time.RFC3339)}}
+				return az
+			}
+			var count int
+			return test{
+				ctx:        ctx,
+				statusCode: 201,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						assert.Equals(t, accID, "accID")
+						var azs []*acme.Authorization
+						for _, id := range []string{"validID", "oldID", "expiredID", "pendingID"} {
+							azs = append(azs, newAz(id))
+						}
+						return azs, nil
+					},
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+						count++
+						az.ID = fmt.Sprintf("az%dID", count)
+						return true, nil
+					},
+					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+						o.ID = "ordID"
+						assert.Equals(t, o.AuthorizationIDs, []string{"validID", "az1ID", "az2ID", "az3ID"})
+						assert.True(t, o.ExpiresAt.Equal(expiresAt))
+						return nil
+					},
+				},
+				vr: func(t *testing.T, o *acme.Order) {
+					assert.Equals(t, count, 3)
+					assert.Equals(t, o.ID, "ordID")
+				},
+			}
+		},
+		"fail/reuse-authz-db-error": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accID"}
+			nor := &NewOrderRequest{
+				Identifiers: []acme.Identifier{
+					{Type: "dns", Value: "a.example.com"},
+				},
+			}
+			b, err := json.Marshal(nor)
+			assert.FatalError(t, err)
+			p := &provisioner.ACME{Type: "ACME", Name: prov.GetName(), MaxPendingAuthz: -1, AuthzReuseAge: &provisioner.Duration{Duration: time.Hour}}
+			assert.FatalError(t, p.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+			ctx := context.WithValue(context.Background(), provisionerContextKey, p)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			return test{
+				ctx:        ctx,
+				statusCode: 500,
+				nor:        nor,
+				db: &acme.MockDB{
+					MockGetAuthorizationsByAccountID: func(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+						return nil, errors.New("force")
+					},
+				},
+				err: acme.NewErrorISE("error retrieving authorizations: force"),
+			}
+		},
+		"ok/clamped-naf": func(t *testing.T) test {
+			clampProv := &provisioner.ACME{
+				Type:           "ACME",
+				Name:           prov.GetName(),
+				ValidityPolicy: provisioner.ACMEValidityPolicyClamp,
+			}
+			assert.FatalError(t, clampProv.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+
 			now := clock.Now()
-			expNaf := now.Add(15 * time.Minute)
+			expNbf := now.Add(5 * time.Minute)
 			acc := &acme.Account{ID: "accID"}
 			nor := &NewOrderRequest{
 				Identifiers: []acme.Identifier{
 					{Type: "dns", Value: "zap.internal"},
 				},
-				NotAfter: expNaf,
+				NotBefore: expNbf,
+				NotAfter:  expNbf.Add(48 * time.Hour),
 			}
 			b, err := json.Marshal(nor)
 			assert.FatalError(t, err)
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, clampProv)
 			ctx = context.WithValue(ctx, accContextKey, acc)
 			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
 			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
-			var (
-				ch1, ch2, ch3 **acme.Challenge
-				az1ID         *string
-				count         = 0
-			)
 			return test{
 				ctx:        ctx,
 				statusCode: 201,
 				nor:        nor,
 				db: &acme.MockDB{
-					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
-						switch count {
-						case 0:
-							ch.ID = "dns"
-							assert.Equals(t, ch.Type, acme.DNS01)
-							ch1 = &ch
-						case 1:
-							ch.ID = "http"
-							assert.Equals(t, ch.Type, acme.HTTP01)
-							ch2 = &ch
-						case 2:
-							ch.ID = "tls"
-							assert.Equals(t, ch.Type, acme.TLSALPN01)
-							ch3 = &ch
-						default:
-							assert.FatalError(t, errors.New("test logic error"))
-							return errors.New("force")
-						}
-						count++
-						assert.Equals(t, ch.AccountID, "accID")
-						assert.NotEquals(t, ch.Token, "")
-						assert.Equals(t, ch.Status, acme.StatusPending)
-						assert.Equals(t, ch.Value, "zap.internal")
-						return nil
-					},
-					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
 						az.ID = "az1ID"
-						az1ID = &az.ID
-						assert.Equals(t, az.AccountID, "accID")
-						assert.NotEquals(t, az.Token, "")
-						assert.Equals(t, az.Status, acme.StatusPending)
-						assert.Equals(t, az.Identifier, nor.Identifiers[0])
-						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
-						assert.Equals(t, az.Wildcard, false)
-						return nil
+						return true, nil
 					},
 					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
 						o.ID = "ordID"
-						assert.Equals(t, o.AccountID, "accID")
-						assert.Equals(t, o.ProvisionerID, prov.GetID())
-						assert.Equals(t, o.Status, acme.StatusPending)
-						assert.Equals(t, o.Identifiers, nor.Identifiers)
-						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
+						assert.True(t, o.NotBefore.Equal(expNbf))
+						assert.True(t, o.NotAfter.Equal(expNbf.Add(24*time.Hour)))
 						return nil
 					},
 				},
 				vr: func(t *testing.T, o *acme.Order) {
-					testBufferDur := 5 * time.Second
-					orderExpiry := now.Add(defaultOrderExpiry)
-					expNbf := now.Add(-defaultOrderBackdate)
-
 					assert.Equals(t, o.ID, "ordID")
-					assert.Equals(t, o.Status, acme.StatusPending)
-					assert.Equals(t, o.Identifiers, nor.Identifiers)
-					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
-					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
-					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
-					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
-					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
-					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
-					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
+					assert.True(t, o.NotBefore.Equal(expNbf))
+					assert.True(t, o.NotAfter.Equal(expNbf.Add(24*time.Hour)))
 				},
 			}
 		},
-		"ok/naf-nbf": func(t *testing.T) test {
+		"ok/clamped-short-duration": func(t *testing.T) test {
+			clampProv := &provisioner.ACME{
+				Type:           "ACME",
+				Name:           prov.GetName(),
+				ValidityPolicy: provisioner.ACMEValidityPolicyClamp,
+			}
+			assert.FatalError(t, clampProv.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+
 			now := clock.Now()
 			expNbf := now.Add(5 * time.Minute)
-			expNaf := now.Add(15 * time.Minute)
 			acc := &acme.Account{ID: "accID"}
 			nor := &NewOrderRequest{
 				Identifiers: []acme.Identifier{
 					{Type: "dns", Value: "zap.internal"},
 				},
 				NotBefore: expNbf,
-				NotAfter:  expNaf,
+				NotAfter:  expNbf.Add(time.Minute),
 			}
 			b, err := json.Marshal(nor)
 			assert.FatalError(t, err)
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, clampProv)
 			ctx = context.WithValue(ctx, accContextKey, acc)
 			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
 			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
-			var (
-				ch1, ch2, ch3 **acme.Challenge
-				az1ID         *string
-				count         = 0
-			)
 			return test{
 				ctx:        ctx,
 				statusCode: 201,
 				nor:        nor,
 				db: &acme.MockDB{
-					MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
-						switch count {
-						case 0:
-							ch.ID = "dns"
-							assert.Equals(t, ch.Type, acme.DNS01)
-							ch1 = &ch
-						case 1:
-							ch.ID = "http"
-							assert.Equals(t, ch.Type, acme.HTTP01)
-							ch2 = &ch
-						case 2:
-							ch.ID = "tls"
-							assert.Equals(t, ch.Type, acme.TLSALPN01)
-							ch3 = &ch
-						default:
-							assert.FatalError(t, errors.New("test logic error"))
-							return errors.New("force")
-						}
-						count++
-						assert.Equals(t, ch.AccountID, "accID")
-						assert.NotEquals(t, ch.Token, "")
-						assert.Equals(t, ch.Status, acme.StatusPending)
-						assert.Equals(t, ch.Value, "zap.internal")
-						return nil
-					},
-					MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+					MockCreatePendingAuthorization: func(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
 						az.ID = "az1ID"
-						az1ID = &az.ID
-						assert.Equals(t, az.AccountID, "accID")
-						assert.NotEquals(t, az.Token, "")
-						assert.Equals(t, az.Status, acme.StatusPending)
-						assert.Equals(t, az.Identifier, nor.Identifiers[0])
-						assert.Equals(t, az.Challenges, []*acme.Challenge{*ch1, *ch2, *ch3})
-						assert.Equals(t, az.Wildcard, false)
-						return nil
+						return true, nil
 					},
 					MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
 						o.ID = "ordID"
-						assert.Equals(t, o.AccountID, "accID")
-						assert.Equals(t, o.ProvisionerID, prov.GetID())
-						assert.Equals(t, o.Status, acme.StatusPending)
-						assert.Equals(t, o.Identifiers, nor.Identifiers)
-						assert.Equals(t, o.AuthorizationIDs, []string{*az1ID})
 						return nil
 					},
 				},
 				vr: func(t *testing.T, o *acme.Order) {
-					testBufferDur := 5 * time.Second
-					orderExpiry := now.Add(defaultOrderExpiry)
-
 					assert.Equals(t, o.ID, "ordID")
-					assert.Equals(t, o.Status, acme.StatusPending)
-					assert.Equals(t, o.Identifiers, nor.Identifiers)
-					assert.Equals(t, o.AuthorizationURLs, []string{fmt.Sprintf("%s/acme/%s/authz/az1ID", baseURL.String(), escProvName)})
-					assert.True(t, o.NotBefore.Add(-testBufferDur).Before(expNbf))
-					assert.True(t, o.NotBefore.Add(testBufferDur).After(expNbf))
-					assert.True(t, o.NotAfter.Add(-testBufferDur).Before(expNaf))
-					assert.True(t, o.NotAfter.Add(testBufferDur).After(expNaf))
-					assert.True(t, o.ExpiresAt.Add(-testBufferDur).Before(orderExpiry))
-					assert.True(t, o.ExpiresAt.Add(testBufferDur).After(orderExpiry))
+					assert.True(t, o.NotBefore.Equal(expNbf))
+					assert.True(t, o.NotAfter.Equal(expNbf.Add(5*time.Minute)))
 				},
 			}
 		},
@@ -1334,7 +2481,7 @@ func TestHandler_NewOrder(t *testing.T) {
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
-			h := &Handler{linker: NewLinker("dns", "acme"), db: tc.db}
+			h := &Handler{linker: NewLinker("dns", "acme"), db: tc.db, ca: tc.ca}
 			req := httptest.NewRequest("GET", u, nil)
 			req = req.WithContext(tc.ctx)
 			w := httptest.NewRecorder()
@@ -1364,6 +2511,7 @@ func TestHandler_NewOrder(t *testing.T) {
 				}
 
 				assert.Equals(t, res.Header["Location"], []string{u})
+				assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL.String(), escProvName)})
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/json"})
 			}
 		})
@@ -1420,11 +2568,48 @@ func TestHandler_FinalizeOrder(t *testing.T) {
 	payloadBytes, err := json.Marshal(nor)
 	assert.FatalError(t, err)
 
+	keyGenPayload, err := json.Marshal(&FinalizeRequest{
+		ServerKeyGen: &ServerKeyGenRequest{Password: "password"},
+	})
+	assert.FatalError(t, err)
+	keyGenProv := &provisioner.ACME{
+		Type:                      "ACME",
+		Name:                      "test@acme-<test>provisioner.com",
+		EnableServerKeyGeneration: true,
+	}
+	assert.FatalError(t, keyGenProv.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+	attestationRoots, err := os.ReadFile("../../authority/testdata/certs/root_ca.crt")
+	assert.FatalError(t, err)
+	attestationProv := &provisioner.ACME{
+		Type:                  "ACME",
+		Name:                  "test@acme-<test>provisioner.com",
+		RequireKeyAttestation: true,
+		KeyAttestationRoots:   attestationRoots,
+	}
+	assert.FatalError(t, attestationProv.Init(provisioner.Config{Claims: globalProvisionerClaims}))
+	readyOrder := func(p acme.Provisioner) *acme.Order {
+		return &acme.Order{
+			ID:            "orderID",
+			AccountID:     "accountID",
+			ProvisionerID: p.GetID(),
+			ExpiresAt:     naf,
+			Status:        acme.StatusReady,
+			NotBefore:     nbf,
+			NotAfter:      naf,
+			Identifiers: []acme.Identifier{
+				{Type: "dns", Value: "example.com"},
+				{Type: "dns", Value: "*.smallstep.com"},
+			},
+		}
+	}
+
 	type test struct {
 		db         acme.DB
+		ca         acme.CertificateAuthority
 		ctx        context.Context
 		statusCode int
 		err        *acme.Error
+		vfn        func(t *testing.T, body []byte)
 	}
 	var tests = map[string]func(t *testing.T) test{
 		"fail/no-account": func(t *testing.T) test {
@@ -1495,6 +2680,7 @@ func TestHandler_FinalizeOrder(t *testing.T) {
 			}
 		},
 		"fail/malformed-payload-error": func(t *testing.T) test {
+			malformedCSR := acme.NewDetailedError(acme.ErrorMalformedType, "unable to parse csr: asn1: syntax error: sequence truncated")
 			acc := &acme.Account{ID: "accID"}
 			fr := &FinalizeRequest{}
 			b, err := json.Marshal(fr)
@@ -1505,82 +2691,253 @@ func TestHandler_FinalizeOrder(t *testing.T) {
 			return test{
 				ctx:        ctx,
 				statusCode: 400,
-				err:        acme.NewError(acme.ErrorMalformedType, "unable to parse csr: asn1: syntax error: sequence truncated"),
+				err:        malformedCSR,
+			}
+		},
+		"fail/tampered-csr-signature": func(t *testing.T) test {
+			raw := append([]byte{}, csr.Raw...)
+			raw[len(raw)-1] ^= 0xff
+			b, err := json.Marshal(&FinalizeRequest{
+				CSR: base64.RawURLEncoding.EncodeToString(raw),
+			})
+			assert.FatalError(t, err)
+			tampered, err := x509.ParseCertificateRequest(raw)
+			assert.FatalError(t, err)
+			ae := acme.NewDetailedError(acme.ErrorBadCSRType, "csr signature does not verify with its public key: %v", tampered.CheckSignature())
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						t.Error("db.GetOrder should not be called")
+						return nil, errors.New("force")
+					},
+				},
+				ctx:        ctx,
+				statusCode: 400,
+				err:        ae,
+			}
+		},
+		"fail/db.GetOrder-error": func(t *testing.T) test {
+
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockError: acme.NewErrorISE("force"),
+				},
+				ctx:        ctx,
+				statusCode: 500,
+				err:        acme.NewErrorISE("force"),
+			}
+		},
+		"fail/account-id-mismatch": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						return &acme.Order{AccountID: "foo"}, nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 401,
+				err:        acme.NewError(acme.ErrorUnauthorizedType, "account id mismatch"),
+			}
+		},
+		"fail/provisioner-id-mismatch": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						return &acme.Order{AccountID: "accountID", ProvisionerID: "bar"}, nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 401,
+				err:        acme.NewError(acme.ErrorUnauthorizedType, "provisioner id mismatch"),
+			}
+		},
+		"fail/order-finalize-error": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						return &acme.Order{
+							AccountID:     "accountID",
+							ProvisionerID: fmt.Sprintf("acme/%s", prov.GetName()),
+							ExpiresAt:     clock.Now().Add(-time.Hour),
+							Status:        acme.StatusReady,
+						}, nil
+					},
+					MockUpdateOrder: func(ctx context.Context, o *acme.Order) error {
+						return acme.NewErrorISE("force")
+					},
+				},
+				ctx:        ctx,
+				statusCode: 500,
+				err:        acme.NewErrorISE("force"),
+			}
+		},
+		"fail/server-key-gen-disabled": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: keyGenPayload})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						return readyOrder(prov), nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 401,
+				err:        acme.NewError(acme.ErrorUnauthorizedType, "server-side key generation is not enabled for provisioner"),
+			}
+		},
+		"fail/server-key-gen-already-finalized": func(t *testing.T) test {
+			acc := &acme.Account{ID: "accountID"}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, keyGenProv)
+			ctx = context.WithValue(ctx, accContextKey, acc)
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: keyGenPayload})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			return test{
+				db: &acme.MockDB{
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						o := readyOrder(keyGenProv)
+						o.Status = acme.StatusValid
+						return o, nil
+					},
+				},
+				ctx:        ctx,
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorOrderNotReadyType, "order orderID has already been finalized"),
 			}
 		},
-		"fail/db.GetOrder-error": func(t *testing.T) test {
-
+		"fail/server-key-gen-not-ready": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accountID"}
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, keyGenProv)
 			ctx = context.WithValue(ctx, accContextKey, acc)
-			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: keyGenPayload})
 			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
 			return test{
 				db: &acme.MockDB{
-					MockError: acme.NewErrorISE("force"),
+					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+						o := readyOrder(keyGenProv)
+						o.Status = acme.StatusInvalid
+						return o, nil
+					},
 				},
 				ctx:        ctx,
-				statusCode: 500,
-				err:        acme.NewErrorISE("force"),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorOrderNotReadyType, "order orderID is not ready"),
 			}
 		},
-		"fail/account-id-mismatch": func(t *testing.T) test {
+		"fail/server-key-gen-not-supported": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accountID"}
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, keyGenProv)
 			ctx = context.WithValue(ctx, accContextKey, acc)
-			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: keyGenPayload})
 			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
 			return test{
 				db: &acme.MockDB{
 					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
-						return &acme.Order{AccountID: "foo"}, nil
+						return readyOrder(keyGenProv), nil
 					},
 				},
 				ctx:        ctx,
-				statusCode: 401,
-				err:        acme.NewError(acme.ErrorUnauthorizedType, "account id mismatch"),
+				statusCode: 501,
+				err:        acme.NewError(acme.ErrorNotImplementedType, "server-side key generation is not supported by the certificate authority"),
 			}
 		},
-		"fail/provisioner-id-mismatch": func(t *testing.T) test {
+		"fail/key-attestation-required": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accountID"}
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, attestationProv)
 			ctx = context.WithValue(ctx, accContextKey, acc)
 			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
 			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
 			return test{
 				db: &acme.MockDB{
 					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
-						return &acme.Order{AccountID: "accountID", ProvisionerID: "bar"}, nil
+						return readyOrder(attestationProv), nil
 					},
 				},
 				ctx:        ctx,
-				statusCode: 401,
-				err:        acme.NewError(acme.ErrorUnauthorizedType, "provisioner id mismatch"),
+				statusCode: 400,
+				err:        acme.NewError(acme.ErrorBadCSRType, "CSR does not include a key attestation statement"),
 			}
 		},
-		"fail/order-finalize-error": func(t *testing.T) test {
+		"ok/server-key-gen": func(t *testing.T) test {
 			acc := &acme.Account{ID: "accountID"}
-			ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+			ctx := context.WithValue(context.Background(), provisionerContextKey, keyGenProv)
 			ctx = context.WithValue(ctx, accContextKey, acc)
-			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: payloadBytes})
+			ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: keyGenPayload})
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
 			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			var signedCSR *x509.CertificateRequest
 			return test{
 				db: &acme.MockDB{
 					MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
-						return &acme.Order{
-							AccountID:     "accountID",
-							ProvisionerID: fmt.Sprintf("acme/%s", prov.GetName()),
-							ExpiresAt:     clock.Now().Add(-time.Hour),
-							Status:        acme.StatusReady,
-						}, nil
+						return readyOrder(keyGenProv), nil
+					},
+					MockCreateCertificate: func(ctx context.Context, cert *acme.Certificate) error {
+						cert.ID = "certID"
+						return nil
 					},
 					MockUpdateOrder: func(ctx context.Context, o *acme.Order) error {
-						return acme.NewErrorISE("force")
+						assert.Equals(t, o.CertificateID, "certID")
+						assert.Equals(t, o.Status, acme.StatusValid)
+						return nil
+					},
+				},
+				ca: &mockKeyGenCA{
+					generateKey: func(kty, crv string, size int) (crypto.Signer, error) {
+						assert.Equals(t, kty, "EC")
+						assert.Equals(t, crv, "P-256")
+						assert.Equals(t, size, 0)
+						return keyutil.GenerateSigner(kty, crv, size)
+					},
+					sign: func(cr *x509.CertificateRequest, opts provisioner.SignOptions, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+						assert.Equals(t, cr.Subject.CommonName, "example.com")
+						assert.Equals(t, cr.DNSNames, []string{"*.smallstep.com", "example.com"})
+						signedCSR = cr
+						return []*x509.Certificate{{}, {}}, nil
 					},
 				},
 				ctx:        ctx,
-				statusCode: 500,
-				err:        acme.NewErrorISE("force"),
+				statusCode: 200,
+				vfn: func(t *testing.T, body []byte) {
+					var fr FinalizeResponse
+					assert.FatalError(t, json.Unmarshal(body, &fr))
+					assert.Equals(t, fr.ID, "orderID")
+					assert.Equals(t, fr.Status, acme.StatusValid)
+
+					key, err := pemutil.Parse([]byte(fr.PrivateKey), pemutil.WithPassword([]byte("password")))
+					assert.FatalError(t, err)
+					signer, ok := key.(crypto.Signer)
+					assert.Fatal(t, ok)
+					if assert.NotNil(t, signedCSR) {
+						assert.Equals(t, signer.Public(), signedCSR.PublicKey)
+					}
+				},
 			}
 		},
 		"ok": func(t *testing.T) test {
@@ -1624,7 +2981,7 @@ func TestHandler_FinalizeOrder(t *testing.T) {
 	for name, run := range tests {
 		tc := run(t)
 		t.Run(name, func(t *testing.T) {
-			h := &Handler{linker: NewLinker("dns", "acme"), db: tc.db}
+			h := &Handler{linker: NewLinker("dns", "acme"), db: tc.db, ca: tc.ca}
 			req := httptest.NewRequest("GET", u, nil)
 			req = req.WithContext(tc.ctx)
 			w := httptest.NewRecorder()
@@ -1646,6 +3003,8 @@ func TestHandler_FinalizeOrder(t *testing.T) {
 				assert.Equals(t, ae.Identifier, tc.err.Identifier)
 				assert.Equals(t, ae.Subproblems, tc.err.Subproblems)
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+			} else if tc.vfn != nil {
+				tc.vfn(t, body)
 			} else {
 				expB, err := json.Marshal(o)
 				assert.FatalError(t, err)
@@ -1655,15 +3014,94 @@ func TestHandler_FinalizeOrder(t *testing.T) {
 
 				assert.Equals(t, bytes.TrimSpace(body), expB)
 				assert.Equals(t, res.Header["Location"], []string{u})
+				assert.Equals(t, res.Header["Link"], []string{fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL.String(), escProvName)})
 				assert.Equals(t, res.Header["Content-Type"], []string{"application/json"})
 			}
 		})
 	}
 }
 
+func Test_wildcardAuthorizationFor(t *testing.T) {
+	wildcard := &acme.Authorization{
+		ID:         "wildcardID",
+		Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+		Wildcard:   true,
+		Status:     acme.StatusValid,
+	}
+	azs := []*acme.Authorization{wildcard}
+	tests := []struct {
+		name string
+		id   acme.Identifier
+		want *acme.Authorization
+	}{
+		{"ok", acme.Identifier{Type: "dns", Value: "a.example.com"}, wildcard},
+		{"ok/case", acme.Identifier{Type: "dns", Value: "A.Example.COM"}, wildcard},
+		{"fail/domain", acme.Identifier{Type: "dns", Value: "example.com"}, nil},
+		{"fail/two-labels", acme.Identifier{Type: "dns", Value: "a.b.example.com"}, nil},
+		{"fail/other-domain", acme.Identifier{Type: "dns", Value: "a.example.org"}, nil},
+		{"fail/suffix", acme.Identifier{Type: "dns", Value: "a.badexample.com"}, nil},
+		{"fail/wildcard", acme.Identifier{Type: "dns", Value: "*.example.com"}, nil},
+		{"fail/ip", acme.Identifier{Type: "ip", Value: "10.0.0.1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, wildcardAuthorizationFor(azs, tt.id), tt.want)
+		})
+	}
+}
+
+func Test_authorizationFor(t *testing.T) {
+	dns := &acme.Authorization{
+		ID:         "dnsID",
+		Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+		Status:     acme.StatusValid,
+	}
+	wildcard := &acme.Authorization{
+		ID:         "wildcardID",
+		Identifier: acme.Identifier{Type: "dns", Value: "example.org"},
+		Wildcard:   true,
+		Status:     acme.StatusValid,
+	}
+	ip := &acme.Authorization{
+		ID:         "ipID",
+		Identifier: acme.Identifier{Type: "ip", Value: "10.0.0.1"},
+		Status:     acme.StatusValid,
+	}
+	azs := []*acme.Authorization{dns, wildcard, ip}
+	tests := []struct {
+		name string
+		id   acme.Identifier
+		want *acme.Authorization
+	}{
+		{"ok/dns", acme.Identifier{Type: "dns", Value: "example.com"}, dns},
+		{"ok/case", acme.Identifier{Type: "dns", Value: "Example.COM"}, dns},
+		{"ok/wildcard", acme.Identifier{Type: "dns", Value: "*.example.org"}, wildcard},
+		{"ok/ip", acme.Identifier{Type: "ip", Value: "10.0.0.1"}, ip},
+		{"fail/subdomain", acme.Identifier{Type: "dns", Value: "a.example.com"}, nil},
+		{"fail/not-wildcard", acme.Identifier{Type: "dns", Value: "example.org"}, nil},
+		{"fail/wildcard", acme.Identifier{Type: "dns", Value: "*.example.com"}, nil},
+		{"fail/type", acme.Identifier{Type: "ip", Value: "example.com"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, authorizationFor(azs, tt.id), tt.want)
+		})
+	}
+}
+
 func TestHandler_challengeTypes(t *testing.T) {
+	challenges := map[string][]string{
+		"dns": {"dns-01", "http-01"},
+		"ip":  {"tls-alpn-01"},
+	}
+	configured := &acme.MockProvisioner{
+		MgetChallenges: func(typ string) []string {
+			return challenges[typ]
+		},
+	}
 	type args struct {
-		az *acme.Authorization
+		prov acme.Provisioner
+		az   *acme.Authorization
 	}
 	tests := []struct {
 		name string
@@ -1700,12 +3138,505 @@ func TestHandler_challengeTypes(t *testing.T) {
 			},
 			want: []acme.ChallengeType{acme.HTTP01, acme.TLSALPN01},
 		},
+		{
+			name: "ok/provisioner-dns",
+			args: args{
+				prov: configured,
+				az: &acme.Authorization{
+					Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+					Wildcard:   false,
+				},
+			},
+			want: []acme.ChallengeType{acme.DNS01, acme.HTTP01},
+		},
+		{
+			name: "ok/provisioner-wildcard",
+			args: args{
+				prov: configured,
+				az: &acme.Authorization{
+					Identifier: acme.Identifier{Type: "dns", Value: "*.example.com"},
+					Wildcard:   true,
+				},
+			},
+			want: []acme.ChallengeType{acme.DNS01},
+		},
+		{
+			name: "ok/provisioner-ip",
+			args: args{
+				prov: configured,
+				az: &acme.Authorization{
+					Identifier: acme.Identifier{Type: "ip", Value: "192.168.42.42"},
+					Wildcard:   false,
+				},
+			},
+			want: []acme.ChallengeType{acme.TLSALPN01},
+		},
+		{
+			name: "ok/provisioner-default",
+			args: args{
+				prov: &acme.MockProvisioner{
+					MgetChallenges: func(typ string) []string {
+						return map[string][]string{"dns": {"dns-01"}}[typ]
+					},
+				},
+				az: &acme.Authorization{
+					Identifier: acme.Identifier{Type: "ip", Value: "192.168.42.42"},
+					Wildcard:   false,
+				},
+			},
+			want: []acme.ChallengeType{acme.HTTP01, acme.TLSALPN01},
+		},
+		{
+			name: "ok/provisioner-wildcard-without-dns",
+			args: args{
+				prov: &acme.MockProvisioner{
+					MgetChallenges: func(typ string) []string {
+						return []string{"http-01", "tls-alpn-01"}
+					},
+				},
+				az: &acme.Authorization{
+					Identifier: acme.Identifier{Type: "dns", Value: "*.example.com"},
+					Wildcard:   true,
+				},
+			},
+			want: nil,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := challengeTypes(tt.args.az); !reflect.DeepEqual(got, tt.want) {
+			prov := tt.args.prov
+			if prov == nil {
+				prov = newProv()
+			}
+			if got := challengeTypes(prov, tt.args.az, nil); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Handler.challengeTypes() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestHandler_GetOrder_authorizationsPage(t *testing.T) {
+	p := newProv().(*provisioner.ACME)
+	p.AuthorizationsPageSize = 2
+	escProvName := url.PathEscape(p.GetName())
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("ordID", "orderID")
+	u := fmt.Sprintf("%s/acme/%s/order/orderID", baseURL, escProvName)
+	authzLink := func(id string) string {
+		return fmt.Sprintf("%s/acme/%s/authz/%s", baseURL, escProvName, id)
+	}
+
+	tests := []struct {
+		name    string
+		authzs  []string
+		expURLs []string
+		expLink []string
+	}{
+		{"inline", []string{"foo", "bar"}, []string{authzLink("foo"), authzLink("bar")}, []string{
+			fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL, escProvName),
+		}},
+		{"paginated", []string{"foo", "bar", "baz", "zap", "zip"}, []string{authzLink("foo"), authzLink("bar")}, []string{
+			fmt.Sprintf("<%s/acme/%s/order/orderID/authorizations?cursor=2>;rel=\"next\"", baseURL, escProvName),
+			fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL, escProvName),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), provisionerContextKey, acme.Provisioner(p))
+			ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "accountID"})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			h := &Handler{linker: NewLinker("dns", "acme"), db: &acme.MockDB{
+				MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+					return &acme.Order{
+						ID:               "orderID",
+						AccountID:        "accountID",
+						ProvisionerID:    p.GetID(),
+						ExpiresAt:        clock.Now().Add(time.Hour),
+						Status:           acme.StatusReady,
+						AuthorizationIDs: tt.authzs,
+					}, nil
+				},
+			}}
+			req := httptest.NewRequest("POST", u, nil)
+			req = req.WithContext(ctx)
+			w := httptest.NewRecorder()
+			h.GetOrder(w, req)
+			res := w.Result()
+			assert.Equals(t, res.StatusCode, 200)
+
+			var o acme.Order
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&o))
+			assert.Equals(t, o.AuthorizationURLs, tt.expURLs)
+			assert.Equals(t, res.Header["Link"], tt.expLink)
+		})
+	}
+}
+
+func TestHandler_GetOrderAuthorizations(t *testing.T) {
+	p := newProv().(*provisioner.ACME)
+	p.AuthorizationsPageSize = 2
+	escProvName := url.PathEscape(p.GetName())
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("ordID", "orderID")
+	authzLink := func(id string) string {
+		return fmt.Sprintf("%s/acme/%s/authz/%s", baseURL, escProvName, id)
+	}
+	pageLink := func(cursor int) string {
+		return fmt.Sprintf("<%s/acme/%s/order/orderID/authorizations?cursor=%d>;rel=\"next\"", baseURL, escProvName, cursor)
+	}
+	upLink := fmt.Sprintf("<%s/acme/%s/order/orderID>;rel=\"up\"", baseURL, escProvName)
+	indexLink := fmt.Sprintf("<%s/acme/%s/directory>;rel=\"index\"", baseURL, escProvName)
+
+	type test struct {
+		cursor     string
+		accountID  string
+		statusCode int
+		expURLs    []string
+		expLink    []string
+		err        *acme.Error
+	}
+	invalidCursor := func(cursor string) *acme.Error {
+		err := acme.NewDetailedError(acme.ErrorMalformedType, "invalid authorizations cursor '%s'", cursor)
+		return err
+	}
+	var tests = map[string]test{
+		"ok/first-page": {
+			statusCode: 200,
+			expURLs:    []string{authzLink("foo"), authzLink("bar")},
+			expLink:    []string{pageLink(2), upLink, indexLink},
+		},
+		"ok/middle-page": {
+			cursor:     "2",
+			statusCode: 200,
+			expURLs:    []string{authzLink("baz"), authzLink("zap")},
+			expLink:    []string{pageLink(4), upLink, indexLink},
+		},
+		"ok/last-page": {
+			cursor:     "4",
+			statusCode: 200,
+			expURLs:    []string{authzLink("zip")},
+			expLink:    []string{upLink, indexLink},
+		},
+		"ok/end": {
+			cursor:     "5",
+			statusCode: 200,
+			expURLs:    []string{},
+			expLink:    []string{upLink, indexLink},
+		},
+		"fail/cursor-not-a-number": {
+			cursor:     "foo",
+			statusCode: 400,
+			err:        invalidCursor("foo"),
+		},
+		"fail/cursor-negative": {
+			cursor:     "-1",
+			statusCode: 400,
+			err:        invalidCursor("-1"),
+		},
+		"fail/cursor-out-of-range": {
+			cursor:     "6",
+			statusCode: 400,
+			err:        invalidCursor("6"),
+		},
+		"fail/account-mismatch": {
+			accountID:  "otherID",
+			statusCode: 401,
+			err:        acme.NewError(acme.ErrorUnauthorizedType, "account 'otherID' does not own order 'orderID'"),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			accID := tc.accountID
+			if accID == "" {
+				accID = "accountID"
+			}
+			ctx := context.WithValue(context.Background(), provisionerContextKey, acme.Provisioner(p))
+			ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: accID})
+			ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+			ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+			h := &Handler{linker: NewLinker("dns", "acme"), db: &acme.MockDB{
+				MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+					assert.Equals(t, id, "orderID")
+					return &acme.Order{
+						ID:               "orderID",
+						AccountID:        "accountID",
+						ProvisionerID:    p.GetID(),
+						AuthorizationIDs: []string{"foo", "bar", "baz", "zap", "zip"},
+					}, nil
+				},
+			}}
+			u := fmt.Sprintf("%s/acme/%s/order/orderID/authorizations", baseURL, escProvName)
+			if tc.cursor != "" {
+				u += "?cursor=" + tc.cursor
+			}
+			req := httptest.NewRequest("POST", u, nil)
+			req = req.WithContext(ctx)
+			w := httptest.NewRecorder()
+			h.GetOrderAuthorizations(w, req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tc.statusCode)
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			assert.FatalError(t, err)
+
+			if res.StatusCode >= 400 && assert.NotNil(t, tc.err) {
+				var ae acme.Error
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &ae))
+				assert.Equals(t, ae.Type, tc.err.Type)
+				assert.Equals(t, ae.Detail, tc.err.Detail)
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/problem+json"})
+			} else {
+				var page OrderAuthorizations
+				assert.FatalError(t, json.Unmarshal(bytes.TrimSpace(body), &page))
+				assert.Equals(t, page.Authorizations, tc.expURLs)
+				assert.Equals(t, res.Header["Link"], tc.expLink)
+				assert.Equals(t, res.Header["Content-Type"], []string{"application/json"})
+			}
+		})
+	}
+}
+
+func TestHandler_GetOrderAuthorizations_signedCursor(t *testing.T) {
+	p := newProv().(*provisioner.ACME)
+	p.AuthorizationsPageSize = 2
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("ordID", "orderID")
+	h := &Handler{linker: NewLinker("dns", "acme"), db: &acme.MockDB{
+		MockDeleteNonce: func(ctx context.Context, n acme.Nonce) error {
+			return nil
+		},
+		MockGetOrder: func(ctx context.Context, id string) (*acme.Order, error) {
+			return &acme.Order{
+				ID:               "orderID",
+				AccountID:        "accountID",
+				ProvisionerID:    p.GetID(),
+				AuthorizationIDs: []string{"foo", "bar", "baz", "zap", "zip"},
+			}, nil
+		},
+	}}
+	ctx := context.WithValue(context.Background(), provisionerContextKey, acme.Provisioner(p))
+	ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "accountID"})
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+	ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+	next := h.authorizationsPageLink(ctx, "orderID", 2)
+
+	// The cursor is part of the url in the JWS, so a client cannot request a
+	// page other than the one it signed.
+	tests := []struct {
+		name       string
+		jwsURL     string
+		reqURL     string
+		statusCode int
+	}{
+		{"ok", next, next, 200},
+		{"fail/cursor-not-signed", strings.TrimSuffix(next, "?cursor=2"), next, 400},
+		{"fail/cursor-changed", next, strings.Replace(next, "cursor=2", "cursor=4", 1), 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jws := &jose.JSONWebSignature{
+				Signatures: []jose.Signature{
+					{
+						Protected: jose.Header{
+							Algorithm: jose.ES256,
+							KeyID:     "bar",
+							ExtraHeaders: map[jose.HeaderKey]interface{}{
+								"url": tt.jwsURL,
+							},
+						},
+					},
+				},
+			}
+			req := httptest.NewRequest("POST", tt.reqURL, nil)
+			req = req.WithContext(context.WithValue(ctx, jwsContextKey, jws))
+			w := httptest.NewRecorder()
+			h.validateJWS(h.GetOrderAuthorizations)(w, req)
+			res := w.Result()
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+		})
+	}
+}
+
+// corpAssetAuthorizer is an acme.IdentifierAuthorizer for corp-asset-id
+// identifiers, the assets are owned by the accounts in owners.
+type corpAssetAuthorizer struct {
+	owners map[string]string
+}
+
+func (a *corpAssetAuthorizer) ValidateIdentifier(value string) error {
+	if !strings.HasPrefix(value, "asset-") {
+		return errors.New("asset ids must start with asset-")
+	}
+	return nil
+}
+
+func (a *corpAssetAuthorizer) ChallengeTypes() []acme.ChallengeType {
+	return []acme.ChallengeType{"corp-asset-01"}
+}
+
+func (a *corpAssetAuthorizer) ValidateChallenge(ctx context.Context, ch *acme.Challenge, keyAuth string) error {
+	if a.owners[ch.Value] != ch.AccountID {
+		return acme.NewError(acme.ErrorUnauthorizedType, "asset %s is not owned by account %s", ch.Value, ch.AccountID)
+	}
+	return nil
+}
+
+func (a *corpAssetAuthorizer) SubjectAlternativeName(value string) (x509util.SubjectAlternativeName, error) {
+	return x509util.SubjectAlternativeName{Type: x509util.URIType, Value: "urn:corp-asset-id:" + value}, nil
+}
+
+func TestHandler_customIdentifier(t *testing.T) {
+	reg := acme.NewRegistry()
+	assert.FatalError(t, reg.RegisterIdentifierAuthorizer("corp-asset-id", &corpAssetAuthorizer{
+		owners: map[string]string{"asset-1234": "accID"},
+	}))
+
+	prov := newProv()
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	acc := &acme.Account{ID: "accID"}
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	pub := jwk.Public()
+
+	challenges := map[string]*acme.Challenge{}
+	h := &Handler{
+		linker: NewLinker("dns", "acme"),
+		db: &acme.MockDB{
+			MockCreateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+				ch.ID = fmt.Sprintf("ch%d", len(challenges))
+				challenges[ch.ID] = ch
+				return nil
+			},
+			MockCreateAuthorization: func(ctx context.Context, az *acme.Authorization) error {
+				az.ID = "azID"
+				return nil
+			},
+			MockCreateOrder: func(ctx context.Context, o *acme.Order) error {
+				o.ID = "ordID"
+				return nil
+			},
+			MockGetChallenge: func(ctx context.Context, chID, azID string) (*acme.Challenge, error) {
+				ch, ok := challenges[chID]
+				if !ok {
+					return nil, acme.ErrNotFound
+				}
+				copied := *ch
+				return &copied, nil
+			},
+			MockUpdateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+				challenges[ch.ID] = ch
+				return nil
+			},
+		},
+		registry:                 reg,
+		validateChallengeOptions: &acme.ValidateChallengeOptions{Registry: reg},
+	}
+
+	newOrder := func(value string) *http.Response {
+		b, err := json.Marshal(&NewOrderRequest{
+			Identifiers: []acme.Identifier{{Type: "corp-asset-id", Value: value}},
+		})
+		assert.FatalError(t, err)
+		ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+		ctx = context.WithValue(ctx, accContextKey, acc)
+		ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{value: b})
+		ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+		req := httptest.NewRequest("POST", "/acme/new-order", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.NewOrder(w, req)
+		return w.Result()
+	}
+	getChallenge := func(chID string) *acme.Challenge {
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("chID", chID)
+		chiCtx.URLParams.Add("authzID", "azID")
+		ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+		ctx = context.WithValue(ctx, accContextKey, acc)
+		ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{isEmptyJSON: true})
+		ctx = context.WithValue(ctx, jwkContextKey, &pub)
+		ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+		req := httptest.NewRequest("POST", "/acme/challenge/azID/"+chID, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.GetChallenge(w, req)
+		res := w.Result()
+		assert.Equals(t, res.StatusCode, 200)
+		var ch acme.Challenge
+		assert.FatalError(t, json.NewDecoder(res.Body).Decode(&ch))
+		return &ch
+	}
+
+	// The identifier is validated by the authorizer.
+	res := newOrder("1234")
+	assert.Equals(t, res.StatusCode, 400)
+	var ae acme.Error
+	assert.FatalError(t, json.NewDecoder(res.Body).Decode(&ae))
+	assert.Equals(t, ae.Type, acme.NewError(acme.ErrorMalformedType, "").Type)
+	assert.Equals(t, ae.Detail, "invalid corp-asset-id identifier 1234: asset ids must start with asset-")
+	assert.Equals(t, len(challenges), 0)
+
+	// The authorization offers the challenges of the authorizer.
+	res = newOrder("asset-1234")
+	assert.Equals(t, res.StatusCode, 201)
+	var o acme.Order
+	assert.FatalError(t, json.NewDecoder(res.Body).Decode(&o))
+	assert.Equals(t, o.Identifiers, []acme.Identifier{{Type: "corp-asset-id", Value: "asset-1234"}})
+	assert.Equals(t, len(challenges), 1)
+	ch := challenges["ch0"]
+	assert.Equals(t, ch.Type, acme.ChallengeType("corp-asset-01"))
+	assert.Equals(t, ch.Value, "asset-1234")
+	assert.Equals(t, ch.AccountID, "accID")
+
+	// The challenge is validated by the authorizer.
+	ch = getChallenge("ch0")
+	assert.Equals(t, ch.Status, acme.StatusValid)
+	assert.Equals(t, challenges["ch0"].Status, acme.StatusValid)
+
+	// A challenge rejected by the authorizer is invalid.
+	challenges["ch1"] = &acme.Challenge{ID: "ch1", AccountID: "accID", Type: "corp-asset-01", Value: "asset-5678", Token: "token", Status: acme.StatusPending}
+	ch = getChallenge("ch1")
+	assert.Equals(t, ch.Status, acme.StatusInvalid)
+	if assert.NotNil(t, ch.Error) {
+		assert.Equals(t, ch.Error.Type, acme.NewError(acme.ErrorUnauthorizedType, "").Type)
+	}
+}
+
+func Test_mixedWildcardIdentifiers(t *testing.T) {
+	dns := func(values ...string) []acme.Identifier {
+		ids := make([]acme.Identifier, len(values))
+		for i, v := range values {
+			ids[i] = acme.Identifier{Type: acme.DNS, Value: v}
+		}
+		return ids
+	}
+	tests := []struct {
+		name         string
+		identifiers  []acme.Identifier
+		wantName     string
+		wantWildcard string
+		wantOK       bool
+	}{
+		{"ok/no-wildcard", dns("example.com", "www.example.com"), "", "", false},
+		{"ok/base", dns("example.com", "*.example.com"), "", "", false},
+		{"ok/other-domain", dns("*.example.com", "www.example.org", "example.com.org"), "", "", false},
+		{"ok/wildcards", dns("*.example.com", "*.a.example.com"), "", "", false},
+		{"ok/ip", append(dns("*.example.com"), acme.Identifier{Type: acme.IP, Value: "10.0.0.1"}), "", "", false},
+		{"mixed", dns("example.com", "*.example.com", "www.example.com"), "www.example.com", "*.example.com", true},
+		{"mixed/deep", dns("a.b.example.com", "*.example.com"), "a.b.example.com", "*.example.com", true},
+		{"mixed/case", dns("*.Example.com", "WWW.example.COM"), "WWW.example.COM", "*.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, wildcard, ok := mixedWildcardIdentifiers(tt.identifiers)
+			assert.Equals(t, name, tt.wantName)
+			assert.Equals(t, wildcard, tt.wantWildcard)
+			assert.Equals(t, ok, tt.wantOK)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/logging"
+	"go.step.sm/crypto/jose"
+)
+
+const (
+	// deferredValidationWorkers is the number of goroutines that run the
+	// deferred validations.
+	deferredValidationWorkers = 16
+	// maxDeferredValidations is the maximum number of deferred validations
+	// waiting for a worker.
+	maxDeferredValidations = 1024
+)
+
+// validationLimiter limits the number of challenge validations running at the
+// same time, globally and for each provisioner. The validations beyond the
+// limits are deferred to a bounded queue, and a fixed pool of workers runs
+// them as soon as a slot is free. The workers stop, and the running
+// validations are canceled, when the context of the limiter is done.
+type validationLimiter struct {
+	ctx          context.Context
+	global       chan struct{}
+	mu           sync.Mutex
+	provisioners map[string]chan struct{}
+	deferred     map[string]bool
+	queue        chan func(context.Context)
+	startWorkers sync.Once
+}
+
+// newValidationLimiter returns a limiter that allows max concurrent
+// validations, a value lower or equal to 0 disables the global limit.
+func newValidationLimiter(ctx context.Context, max int) *validationLimiter {
+	l := &validationLimiter{
+		ctx:          ctx,
+		provisioners: make(map[string]chan struct{}),
+		deferred:     make(map[string]bool),
+		queue:        make(chan func(context.Context), maxDeferredValidations),
+	}
+	if max > 0 {
+		l.global = make(chan struct{}, max)
+	}
+	return l
+}
+
+// provisionerSlots returns the semaphore of the provisioner with the given
+// name, or nil if the provisioner does not have a limit. The semaphore is
+// replaced if the limit of the provisioner changes.
+func (l *validationLimiter) provisionerSlots(name string, max int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max <= 0 {
+		delete(l.provisioners, name)
+		return nil
+	}
+	slots, ok := l.provisioners[name]
+	if !ok || cap(slots) != max {
+		slots = make(chan struct{}, max)
+		l.provisioners[name] = slots
+	}
+	return slots
+}
+
+// tryAcquire reserves a validation slot without waiting. It returns the
+// function that releases the slot, and false if a limit has been reached.
+func (l *validationLimiter) tryAcquire(name string, max int) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	slots := l.provisionerSlots(name, max)
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		default:
+			release(slots)
+			return nil, false
+		}
+	}
+	return func() {
+		release(l.global)
+		release(slots)
+	}, true
+}
+
+// acquire waits for a validation slot and returns the function that releases
+// it. It returns false if the context is done before a slot is free.
+func (l *validationLimiter) acquire(ctx context.Context, name string, max int) (func(), bool) {
+	slots := l.provisionerSlots(name, max)
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		case <-ctx.Done():
+			release(slots)
+			return nil, false
+		}
+	}
+	return func() {
+		release(l.global)
+		release(slots)
+	}, true
+}
+
+// enqueue adds fn to the queue of deferred validations, starting the workers
+// the first time. It returns false if the queue is full or the limiter has
+// been stopped.
+func (l *validationLimiter) enqueue(fn func(context.Context)) bool {
+	if l.ctx.Err() != nil {
+		return false
+	}
+	l.startWorkers.Do(func() {
+		for i := 0; i < deferredValidationWorkers; i++ {
+			go l.work()
+		}
+	})
+	select {
+	case l.queue <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// work runs the deferred validations until the context of the limiter is
+// done.
+func (l *validationLimiter) work() {
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case fn := <-l.queue:
+			fn(l.ctx)
+		}
+	}
+}
+
+// isDeferred returns true if the validation of the challenge is deferred.
+func (l *validationLimiter) isDeferred(chID string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.deferred[chID]
+}
+
+// setDeferred marks the validation of the challenge as deferred, it returns
+// false if it already was.
+func (l *validationLimiter) setDeferred(chID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.deferred[chID] {
+		return false
+	}
+	l.deferred[chID] = true
+	return true
+}
+
+// done removes the deferred mark of the challenge.
+func (l *validationLimiter) done(chID string) {
+	l.mu.Lock()
+	delete(l.deferred, chID)
+	l.mu.Unlock()
+}
+
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// validateChallenge validates the challenge if there is a free validation
+// slot. Otherwise the validation is deferred to the background, and the
+// challenge is returned with the processing status. The status is not stored,
+// so the challenge remains pending until the deferred validation runs.
+func (h *Handler) validateChallenge(ctx context.Context, w http.ResponseWriter, ch *acme.Challenge, prov acme.Provisioner, jwk *jose.JSONWebKey, vo *acme.ValidateChallengeOptions) error {
+	if ch.Status != acme.StatusPending {
+		return nil
+	}
+	if h.validations.isDeferred(ch.ID) {
+		ch.Status = acme.StatusProcessing
+		return nil
+	}
+	release, ok := h.validations.tryAcquire(prov.GetName(), prov.GetMaxConcurrentValidations())
+	if !ok {
+		if err := h.deferValidation(ch, prov, jwk, vo); err != nil {
+			return err
+		}
+		logValidationDeferred(w, ch, prov)
+		ch.Status = acme.StatusProcessing
+		return nil
+	}
+	defer release()
+	return ch.Validate(ctx, h.db, jwk, vo)
+}
+
+// deferValidation queues the validation of a copy of the challenge, that runs
+// in the background as soon as there is a free validation slot. It returns a
+// rateLimited error if there are too many deferred validations.
+func (h *Handler) deferValidation(ch *acme.Challenge, prov acme.Provisioner, jwk *jose.JSONWebKey, vo *acme.ValidateChallengeOptions) error {
+	if !h.validations.setDeferred(ch.ID) {
+		return nil
+	}
+	name, max := prov.GetName(), prov.GetMaxConcurrentValidations()
+	deferred := *ch
+	deferred.History = append([]*acme.ChallengeAttempt(nil), ch.History...)
+	if !h.validations.enqueue(func(ctx context.Context) {
+		defer h.validations.done(deferred.ID)
+		release, ok := h.validations.acquire(ctx, name, max)
+		if !ok {
+			return
+		}
+		defer release()
+		if err := deferred.Validate(ctx, h.db, jwk, vo); err != nil {
+			log.Printf("error validating deferred challenge %s: %v", deferred.ID, err)
+		}
+	}) {
+		h.validations.done(ch.ID)
+		return acme.NewError(acme.ErrorRateLimitedType, "too many challenge validations in progress")
+	}
+	return nil
+}
+
+// logValidationDeferred flags in the request log that the validation of the
+// challenge was deferred because of the concurrent validations limits.
+func logValidationDeferred(w http.ResponseWriter, ch *acme.Challenge, prov acme.Provisioner) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		m := map[string]interface{}{
+			"challenge":          ch.ID,
+			"provisioner":        prov.GetName(),
+			"validationDeferred": true,
+		}
+		rl.WithFields(m)
+	}
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"go.step.sm/crypto/jose"
+)
+
+func Test_validationLimiter(t *testing.T) {
+	var l *validationLimiter
+	release, ok := l.tryAcquire("acme", 1)
+	assert.True(t, ok)
+	release()
+	assert.False(t, l.isDeferred("chID"))
+
+	// Global limit
+	l = newValidationLimiter(context.Background(), 2)
+	release1, ok := l.tryAcquire("acme", 0)
+	assert.True(t, ok)
+	release2, ok := l.tryAcquire("other", 0)
+	assert.True(t, ok)
+	_, ok = l.tryAcquire("acme", 0)
+	assert.False(t, ok)
+	release1()
+	release3, ok := l.tryAcquire("acme", 0)
+	assert.True(t, ok)
+	release2()
+	release3()
+
+	// Provisioner limit
+	l = newValidationLimiter(context.Background(), 0)
+	release1, ok = l.tryAcquire("acme", 1)
+	assert.True(t, ok)
+	_, ok = l.tryAcquire("acme", 1)
+	assert.False(t, ok)
+	release2, ok = l.tryAcquire("other", 1)
+	assert.True(t, ok)
+	release1()
+	release3, ok = l.tryAcquire("acme", 1)
+	assert.True(t, ok)
+	release2()
+	release3()
+
+	// A full provisioner does not take a global slot
+	l = newValidationLimiter(context.Background(), 1)
+	release1, ok = l.tryAcquire("acme", 1)
+	assert.True(t, ok)
+	_, ok = l.tryAcquire("acme", 1)
+	assert.False(t, ok)
+	assert.Equals(t, len(l.global), 1)
+	release1()
+	assert.Equals(t, len(l.global), 0)
+
+	// Deferred challenges
+	assert.True(t, l.setDeferred("chID"))
+	assert.False(t, l.setDeferred("chID"))
+	assert.True(t, l.isDeferred("chID"))
+	l.done("chID")
+	assert.False(t, l.isDeferred("chID"))
+
+	// Waiting for a slot ends when the context is canceled, and a stopped
+	// limiter does not queue validations.
+	ctx, cancel := context.WithCancel(context.Background())
+	l = newValidationLimiter(ctx, 1)
+	release1, ok = l.tryAcquire("acme", 0)
+	assert.True(t, ok)
+	cancel()
+	_, ok = l.acquire(ctx, "acme", 0)
+	assert.False(t, ok)
+	release1()
+	assert.Equals(t, len(l.global), 0)
+	assert.False(t, l.enqueue(func(context.Context) {}))
+}
+
+func TestHandler_GetChallenge_deferredValidation(t *testing.T) {
+	prov := newProv()
+	baseURL := &url.URL{Scheme: "https", Host: "test.ca.smallstep.com"}
+	_jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	pub := _jwk.Public()
+
+	var gets int32
+	started := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	updated := make(chan string, 10)
+	h := &Handler{
+		db: &acme.MockDB{
+			MockGetChallenge: func(ctx context.Context, chID, azID string) (*acme.Challenge, error) {
+				return &acme.Challenge{
+					ID:        chID,
+					Status:    acme.StatusPending,
+					Type:      acme.HTTP01,
+					AccountID: "accID",
+					Value:     "example.com",
+					Token:     "token",
+				}, nil
+			},
+			MockUpdateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+				assert.Equals(t, ch.Status, acme.StatusPending)
+				updated <- ch.ID
+				return nil
+			},
+		},
+		linker: NewLinker("dns", "acme"),
+		validateChallengeOptions: &acme.ValidateChallengeOptions{
+			HTTPGet: func(string) (*http.Response, error) {
+				atomic.AddInt32(&gets, 1)
+				started <- struct{}{}
+				<-unblock
+				return nil, errors.New("force")
+			},
+		},
+		validations: newValidationLimiter(context.Background(), 1),
+	}
+
+	getChallenge := func(chID string) *http.Response {
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("chID", chID)
+		chiCtx.URLParams.Add("authzID", "authzID")
+		ctx := context.WithValue(context.Background(), provisionerContextKey, prov)
+		ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "accID"})
+		ctx = context.WithValue(ctx, payloadContextKey, &payloadInfo{isEmptyJSON: true})
+		ctx = context.WithValue(ctx, jwkContextKey, &pub)
+		ctx = context.WithValue(ctx, baseURLContextKey, baseURL)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+		req := httptest.NewRequest("POST", "/foo", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.GetChallenge(w, req)
+		return w.Result()
+	}
+	status := func(res *http.Response) acme.Status {
+		var ch acme.Challenge
+		assert.FatalError(t, json.NewDecoder(res.Body).Decode(&ch))
+		return ch.Status
+	}
+	wait := func(c <-chan struct{}) {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the validation")
+		}
+	}
+
+	// The first validation takes the only slot.
+	var first *http.Response
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		first = getChallenge("ch1")
+	}()
+	wait(started)
+
+	// The next ones are deferred instead of being launched.
+	for i := 0; i < 3; i++ {
+		res := getChallenge(fmt.Sprintf("ch%d", i+2))
+		assert.Equals(t, res.StatusCode, 200)
+		assert.Equals(t, res.Header["Retry-After"], []string{"5"})
+		assert.Equals(t, status(res), acme.StatusProcessing)
+	}
+	// A deferred challenge is not deferred again.
+	res := getChallenge("ch2")
+	assert.Equals(t, res.StatusCode, 200)
+	assert.Equals(t, status(res), acme.StatusProcessing)
+	assert.Equals(t, atomic.LoadInt32(&gets), int32(1))
+	assert.True(t, h.validations.isDeferred("ch2"))
+
+	// Once the slot is free the deferred validations run one at a time.
+	close(unblock)
+	wait(done)
+	assert.Equals(t, first.StatusCode, 200)
+	assert.Equals(t, status(first), acme.StatusPending)
+	ids := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		select {
+		case id := <-updated:
+			ids[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the deferred validations")
+		}
+	}
+	assert.Equals(t, ids, map[string]bool{"ch1": true, "ch2": true, "ch3": true, "ch4": true})
+	assert.Equals(t, atomic.LoadInt32(&gets), int32(4))
+}
+
+func TestHandler_validateChallenge_provisionerLimit(t *testing.T) {
+	p := newProv().(*provisioner.ACME)
+	p.MaxConcurrentValidations = 1
+	h := &Handler{validations: newValidationLimiter(context.Background(), 0)}
+
+	release, ok := h.validations.tryAcquire(p.GetName(), p.GetMaxConcurrentValidations())
+	assert.True(t, ok)
+	defer release()
+
+	ch := &acme.Challenge{ID: "chID", Status: acme.StatusPending, Type: acme.HTTP01}
+	blocked := make(chan struct{})
+	h.db = &acme.MockDB{
+		MockUpdateChallenge: func(ctx context.Context, ch *acme.Challenge) error {
+			return nil
+		},
+	}
+	vo := &acme.ValidateChallengeOptions{
+		HTTPGet: func(string) (*http.Response, error) {
+			close(blocked)
+			return nil, errors.New("force")
+		},
+	}
+	assert.FatalError(t, h.validateChallenge(context.Background(), httptest.NewRecorder(), ch, p, nil, vo))
+	assert.Equals(t, ch.Status, acme.StatusProcessing)
+	assert.True(t, h.validations.isDeferred("chID"))
+	select {
+	case <-blocked:
+		t.Fatal("deferred validation launched beyond the provisioner limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandler_validateChallenge_queueFull(t *testing.T) {
+	p := newProv().(*provisioner.ACME)
+	h := &Handler{validations: newValidationLimiter(context.Background(), 1)}
+
+	release, ok := h.validations.tryAcquire(p.GetName(), 0)
+	assert.True(t, ok)
+	defer release()
+
+	// Fill the queue without starting the workers.
+	h.validations.startWorkers.Do(func() {})
+	for i := 0; i < maxDeferredValidations; i++ {
+		assert.True(t, h.validations.enqueue(func(context.Context) {}))
+	}
+
+	ch := &acme.Challenge{ID: "chID", Status: acme.StatusPending, Type: acme.HTTP01}
+	err := h.validateChallenge(context.Background(), httptest.NewRecorder(), ch, p, nil, &acme.ValidateChallengeOptions{})
+	if assert.NotNil(t, err) {
+		var ae *acme.Error
+		assert.True(t, errors.As(err, &ae))
+		typ, _ := ae.ProblemType()
+		assert.Equals(t, typ, acme.ErrorRateLimitedType)
+	}
+	assert.Equals(t, ch.Status, acme.StatusPending)
+	assert.False(t, h.validations.isDeferred("chID"))
+}
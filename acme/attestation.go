@@ -0,0 +1,166 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"strconv"
+	"strings"
+)
+
+// Formats of the key attestation statements.
+const (
+	// KeyAttestationTPM is a key attested by a TPM, the attestation
+	// certificate must be issued by an attestation CA and include the
+	// tcg-kp-AIKCertificate extended key usage.
+	KeyAttestationTPM = "tpm"
+	// KeyAttestationApple is a key attested by the Apple Managed Device
+	// Attestation, the attestation certificate must include the serial number
+	// of the device.
+	KeyAttestationApple = "apple"
+	// KeyAttestationYubiKey is a key attested by a YubiKey using the PIV
+	// attestation, the attestation certificate must include the serial number
+	// of the YubiKey.
+	KeyAttestationYubiKey = "yubikey"
+)
+
+var (
+	// oidKeyAttestation is the CSR extension with the key attestation
+	// statement.
+	oidKeyAttestation = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37476, 9000, 64, 3}
+	// oidYubicoSerialNumber is the serial number of the YubiKey in the PIV
+	// attestation certificates.
+	oidYubicoSerialNumber = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}
+	// oidAppleSerialNumber is the serial number of the device in the Apple
+	// attestation certificates.
+	oidAppleSerialNumber = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 9, 1}
+	// oidTCGKpAIKCertificate is the extended key usage of the certificates
+	// issued by a TPM attestation CA.
+	oidTCGKpAIKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 3}
+)
+
+// keyAttestationStatement is the value of the key attestation extension:
+//
+//	KeyAttestation ::= SEQUENCE {
+//	    format        UTF8String,
+//	    certificates  SEQUENCE OF Certificate }
+//
+// The first certificate is the attestation certificate of the key, followed
+// by the intermediates required to verify it against the attestation roots.
+type keyAttestationStatement struct {
+	Format       string `asn1:"utf8"`
+	Certificates []asn1.RawValue
+}
+
+// KeyAttestation is the result of the verification of a key attestation, the
+// format of the statement and the identity of the device that generated the
+// key, if it's known.
+type KeyAttestation struct {
+	Format   string
+	DeviceID string
+}
+
+// VerifyKeyAttestation verifies the key attestation statement included in a
+// CSR. The attestation certificate must chain up to one of the given roots,
+// its key must be the key of the CSR, and it must include the extensions of
+// the format of the statement. It returns a badCSR error if the statement is
+// missing or it cannot be verified.
+func VerifyKeyAttestation(csr *x509.CertificateRequest, roots *x509.CertPool) (*KeyAttestation, error) {
+	var value []byte
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oidKeyAttestation) {
+			value = ext.Value
+			break
+		}
+	}
+	if value == nil {
+		return nil, NewError(ErrorBadCSRType, "CSR does not include a key attestation statement")
+	}
+
+	var st keyAttestationStatement
+	if rest, err := asn1.Unmarshal(value, &st); err != nil || len(rest) > 0 {
+		return nil, NewError(ErrorBadCSRType, "CSR includes a malformed key attestation statement")
+	}
+	switch st.Format {
+	case KeyAttestationTPM, KeyAttestationApple, KeyAttestationYubiKey:
+	default:
+		return nil, NewError(ErrorBadCSRType, "unsupported key attestation format '%s'", st.Format)
+	}
+	if len(st.Certificates) == 0 {
+		return nil, NewError(ErrorBadCSRType, "key attestation statement does not include certificates")
+	}
+
+	certs := make([]*x509.Certificate, len(st.Certificates))
+	for i, rv := range st.Certificates {
+		cert, err := x509.ParseCertificate(rv.FullBytes)
+		if err != nil {
+			return nil, WrapError(ErrorBadCSRType, err, "error parsing key attestation certificate")
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   clock.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, WrapError(ErrorBadCSRType, err, "error verifying key attestation certificate")
+	}
+
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(csr.PublicKey) {
+		return nil, NewError(ErrorBadCSRType, "key attestation certificate does not match the CSR key")
+	}
+
+	deviceID, err := attestedDeviceID(st.Format, leaf)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyAttestation{
+		Format:   st.Format,
+		DeviceID: deviceID,
+	}, nil
+}
+
+// attestedDeviceID verifies that an attestation certificate has the
+// extensions of the given format, and returns the identity of the device in
+// it. The identity of a TPM is the subject of its attestation certificate.
+func attestedDeviceID(format string, cert *x509.Certificate) (string, error) {
+	switch format {
+	case KeyAttestationYubiKey:
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidYubicoSerialNumber) {
+				var serial int64
+				if rest, err := asn1.Unmarshal(ext.Value, &serial); err != nil || len(rest) > 0 {
+					return "", NewError(ErrorBadCSRType, "key attestation certificate includes a malformed YubiKey serial number")
+				}
+				return strconv.FormatInt(serial, 10), nil
+			}
+		}
+		return "", NewError(ErrorBadCSRType, "key attestation certificate does not include the YubiKey serial number")
+	case KeyAttestationApple:
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidAppleSerialNumber) {
+				if serial := strings.TrimSpace(string(ext.Value)); serial != "" {
+					return serial, nil
+				}
+			}
+		}
+		return "", NewError(ErrorBadCSRType, "key attestation certificate does not include the Apple device serial number")
+	default:
+		for _, oid := range cert.UnknownExtKeyUsage {
+			if oid.Equal(oidTCGKpAIKCertificate) {
+				if cert.Subject.SerialNumber != "" {
+					return cert.Subject.SerialNumber, nil
+				}
+				return cert.Subject.CommonName, nil
+			}
+		}
+		return "", NewError(ErrorBadCSRType, "key attestation certificate is not a TPM attestation certificate")
+	}
+}
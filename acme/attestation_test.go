@@ -0,0 +1,219 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+type attestationCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newAttestationCA(t *testing.T) *attestationCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Attestation Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	cert, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return &attestationCA{cert: cert, key: key}
+}
+
+func (ca *attestationCA) attest(t *testing.T, pub crypto.PublicKey, subject pkix.Name, exts ...pkix.Extension) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         subject,
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: exts,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	assert.FatalError(t, err)
+	cert, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return cert
+}
+
+func newAttestedCSR(t *testing.T, key crypto.Signer, format string, certs ...*x509.Certificate) *x509.CertificateRequest {
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "example.com"},
+		DNSNames: []string{"example.com"},
+	}
+	if format != "" {
+		st := keyAttestationStatement{Format: format}
+		for _, cert := range certs {
+			st.Certificates = append(st.Certificates, asn1.RawValue{FullBytes: cert.Raw})
+		}
+		value, err := asn1.Marshal(st)
+		assert.FatalError(t, err)
+		template.ExtraExtensions = []pkix.Extension{{Id: oidKeyAttestation, Value: value}}
+	}
+	b, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	assert.FatalError(t, err)
+	csr, err := x509.ParseCertificateRequest(b)
+	assert.FatalError(t, err)
+	return csr
+}
+
+func TestVerifyKeyAttestation(t *testing.T) {
+	ca := newAttestationCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+
+	serial, err := asn1.Marshal(12345678)
+	assert.FatalError(t, err)
+	yubikeyCert := ca.attest(t, key.Public(), pkix.Name{CommonName: "YubiKey PIV Attestation 9a"},
+		pkix.Extension{Id: oidYubicoSerialNumber, Value: serial})
+	appleCert := ca.attest(t, key.Public(), pkix.Name{CommonName: "device"},
+		pkix.Extension{Id: oidAppleSerialNumber, Value: []byte("C02XK0ABJGH5")})
+	aikUsage, err := asn1.Marshal([]asn1.ObjectIdentifier{oidTCGKpAIKCertificate})
+	assert.FatalError(t, err)
+	tpmCert := ca.attest(t, key.Public(), pkix.Name{CommonName: "tpm-host", SerialNumber: "EK-1234"},
+		pkix.Extension{Id: asn1.ObjectIdentifier{2, 5, 29, 37}, Value: aikUsage})
+	malformedSerial := ca.attest(t, key.Public(), pkix.Name{CommonName: "YubiKey PIV Attestation 9a"},
+		pkix.Extension{Id: oidYubicoSerialNumber, Value: []byte("foo")})
+	plainCert := ca.attest(t, key.Public(), pkix.Name{CommonName: "device"})
+
+	untrusted := newAttestationCA(t)
+	untrustedCert := untrusted.attest(t, key.Public(), pkix.Name{CommonName: "YubiKey PIV Attestation 9a"})
+	otherKeyCert := ca.attest(t, otherKey.Public(), pkix.Name{CommonName: "YubiKey PIV Attestation 9a"})
+
+	type test struct {
+		csr     *x509.CertificateRequest
+		want    *KeyAttestation
+		wantErr string
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/no-attestation": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, ""),
+				wantErr: "CSR does not include a key attestation statement",
+			}
+		},
+		"fail/malformed": func(t *testing.T) test {
+			csr := newAttestedCSR(t, key, "")
+			csr.Extensions = append(csr.Extensions, pkix.Extension{Id: oidKeyAttestation, Value: []byte("foo")})
+			return test{
+				csr:     csr,
+				wantErr: "CSR includes a malformed key attestation statement",
+			}
+		},
+		"fail/unsupported-format": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, "android-key", yubikeyCert),
+				wantErr: "unsupported key attestation format 'android-key'",
+			}
+		},
+		"fail/no-certificates": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationYubiKey),
+				wantErr: "key attestation statement does not include certificates",
+			}
+		},
+		"fail/untrusted": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationYubiKey, untrustedCert),
+				wantErr: "error verifying key attestation certificate",
+			}
+		},
+		"fail/untrusted-intermediate": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationYubiKey, untrustedCert, untrusted.cert),
+				wantErr: "error verifying key attestation certificate",
+			}
+		},
+		"fail/key-mismatch": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationYubiKey, otherKeyCert),
+				wantErr: "key attestation certificate does not match the CSR key",
+			}
+		},
+		"ok/yubikey": func(t *testing.T) test {
+			return test{
+				csr:  newAttestedCSR(t, key, KeyAttestationYubiKey, yubikeyCert),
+				want: &KeyAttestation{Format: KeyAttestationYubiKey, DeviceID: "12345678"},
+			}
+		},
+		"ok/apple": func(t *testing.T) test {
+			return test{
+				csr:  newAttestedCSR(t, key, KeyAttestationApple, appleCert),
+				want: &KeyAttestation{Format: KeyAttestationApple, DeviceID: "C02XK0ABJGH5"},
+			}
+		},
+		"ok/tpm": func(t *testing.T) test {
+			return test{
+				csr:  newAttestedCSR(t, key, KeyAttestationTPM, tpmCert),
+				want: &KeyAttestation{Format: KeyAttestationTPM, DeviceID: "EK-1234"},
+			}
+		},
+		"fail/yubikey-no-serial": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationYubiKey, tpmCert),
+				wantErr: "key attestation certificate does not include the YubiKey serial number",
+			}
+		},
+		"fail/yubikey-malformed-serial": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationYubiKey, malformedSerial),
+				wantErr: "key attestation certificate includes a malformed YubiKey serial number",
+			}
+		},
+		"fail/apple-no-serial": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationApple, yubikeyCert),
+				wantErr: "key attestation certificate does not include the Apple device serial number",
+			}
+		},
+		"fail/tpm-no-aik-usage": func(t *testing.T) test {
+			return test{
+				csr:     newAttestedCSR(t, key, KeyAttestationTPM, plainCert),
+				wantErr: "key attestation certificate is not a TPM attestation certificate",
+			}
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			ka, err := VerifyKeyAttestation(tc.csr, roots)
+			if tc.wantErr != "" {
+				if assert.NotNil(t, err) {
+					k, ok := err.(*Error)
+					if assert.True(t, ok) {
+						assert.Equals(t, k.Type, NewError(ErrorBadCSRType, "").Type)
+						assert.Equals(t, k.Status, 400)
+						assert.True(t, strings.HasPrefix(k.Err.Error(), tc.wantErr))
+					}
+				}
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, ka, tc.want)
+		})
+	}
+}
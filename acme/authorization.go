@@ -28,6 +28,23 @@ func (az *Authorization) ToLog() (interface{}, error) {
 	return string(b), nil
 }
 
+// ValidatedAt returns the time the authorization was validated, the validation
+// time of its valid challenge. It returns false if there's no valid challenge
+// or its validation time is not known.
+func (az *Authorization) ValidatedAt() (time.Time, bool) {
+	for _, ch := range az.Challenges {
+		if ch.Status != StatusValid {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ch.ValidatedAt)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
 // UpdateStatus updates the ACME Authorization Status if necessary.
 // Changes to the Authorization are saved using the database interface.
 func (az *Authorization) UpdateStatus(ctx context.Context, db DB) error {
@@ -38,6 +55,8 @@ func (az *Authorization) UpdateStatus(ctx context.Context, db DB) error {
 		return nil
 	case StatusValid:
 		return nil
+	case StatusDeactivated:
+		return nil
 	case StatusPending:
 		// check expiry
 		if now.After(az.ExpiresAt) {
@@ -67,3 +86,34 @@ func (az *Authorization) UpdateStatus(ctx context.Context, db DB) error {
 	}
 	return nil
 }
+
+// Deactivate deactivates a pending or valid ACME Authorization, the pending
+// challenges of the authorization are invalidated so they cannot be validated
+// anymore. Deactivating an already deactivated authorization is a no-op.
+// Changes to the Authorization and its challenges are saved using the
+// database interface.
+func (az *Authorization) Deactivate(ctx context.Context, db DB) error {
+	switch az.Status {
+	case StatusDeactivated:
+		return nil
+	case StatusPending, StatusValid:
+	default:
+		return NewError(ErrorMalformedType, "cannot deactivate authorization with status %s", az.Status)
+	}
+
+	for _, ch := range az.Challenges {
+		if ch.Status != StatusPending && ch.Status != StatusProcessing {
+			continue
+		}
+		ch.Status = StatusInvalid
+		if err := db.UpdateChallenge(ctx, ch); err != nil {
+			return WrapErrorISE(err, "error updating challenge")
+		}
+	}
+
+	az.Status = StatusDeactivated
+	if err := db.UpdateAuthorization(ctx, az); err != nil {
+		return WrapErrorISE(err, "error updating authorization")
+	}
+	return nil
+}
@@ -32,6 +32,14 @@ func TestAuthorization_UpdateStatus(t *testing.T) {
 				az: az,
 			}
 		},
+		"ok/already-deactivated": func(t *testing.T) test {
+			az := &Authorization{
+				Status: StatusDeactivated,
+			}
+			return test{
+				az: az,
+			}
+		},
 		"fail/error-unexpected-status": func(t *testing.T) test {
 			az := &Authorization{
 				Status: "foo",
@@ -148,3 +156,102 @@ func TestAuthorization_UpdateStatus(t *testing.T) {
 
 	}
 }
+
+func TestAuthorization_Deactivate(t *testing.T) {
+	type test struct {
+		az      *Authorization
+		db      DB
+		err     *Error
+		updated []string
+	}
+	newAuthz := func(status Status) *Authorization {
+		return &Authorization{
+			ID:     "azID",
+			Status: status,
+			Challenges: []*Challenge{
+				{ID: "ch1", Status: StatusPending},
+				{ID: "ch2", Status: StatusValid},
+				{ID: "ch3", Status: StatusProcessing},
+			},
+		}
+	}
+	tests := map[string]func(t *testing.T) test{
+		"ok/pending": func(t *testing.T) test {
+			return test{az: newAuthz(StatusPending), updated: []string{"ch1", "ch3"}}
+		},
+		"ok/valid": func(t *testing.T) test {
+			return test{az: newAuthz(StatusValid), updated: []string{"ch1", "ch3"}}
+		},
+		"ok/already-deactivated": func(t *testing.T) test {
+			return test{az: newAuthz(StatusDeactivated)}
+		},
+		"fail/invalid": func(t *testing.T) test {
+			return test{
+				az:  newAuthz(StatusInvalid),
+				err: NewError(ErrorMalformedType, "cannot deactivate authorization with status invalid"),
+			}
+		},
+		"fail/db.UpdateChallenge-error": func(t *testing.T) test {
+			return test{
+				az: newAuthz(StatusPending),
+				db: &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, ch *Challenge) error {
+						return errors.New("force")
+					},
+				},
+				err: NewErrorISE("error updating challenge: force"),
+			}
+		},
+		"fail/db.UpdateAuthorization-error": func(t *testing.T) test {
+			return test{
+				az: newAuthz(StatusPending),
+				db: &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, ch *Challenge) error {
+						return nil
+					},
+					MockUpdateAuthorization: func(ctx context.Context, az *Authorization) error {
+						return errors.New("force")
+					},
+				},
+				err: NewErrorISE("error updating authorization: force"),
+			}
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			var updated []string
+			if tc.db == nil {
+				tc.db = &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, ch *Challenge) error {
+						assert.Equals(t, ch.Status, StatusInvalid)
+						updated = append(updated, ch.ID)
+						return nil
+					},
+					MockUpdateAuthorization: func(ctx context.Context, az *Authorization) error {
+						assert.Equals(t, az.Status, StatusDeactivated)
+						return nil
+					},
+				}
+			}
+			if err := tc.az.Deactivate(context.Background(), tc.db); err != nil {
+				if assert.NotNil(t, tc.err) {
+					switch k := err.(type) {
+					case *Error:
+						assert.Equals(t, k.Type, tc.err.Type)
+						assert.Equals(t, k.Status, tc.err.Status)
+						assert.Equals(t, k.Err.Error(), tc.err.Err.Error())
+					default:
+						assert.FatalError(t, errors.New("unexpected error type"))
+					}
+				}
+				return
+			}
+			if assert.Nil(t, tc.err) {
+				assert.Equals(t, tc.az.Status, StatusDeactivated)
+				assert.Equals(t, updated, tc.updated)
+				assert.Equals(t, tc.az.Challenges[1].Status, StatusValid)
+			}
+		})
+	}
+}
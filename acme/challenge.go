@@ -3,7 +3,6 @@ package acme
 import (
 	"context"
 	"crypto"
-	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
 	"encoding/asn1"
@@ -32,17 +31,34 @@ const (
 )
 
 // Challenge represents an ACME response Challenge type.
+//
+// History is a non-standard extension with the last validation attempts, it
+// is only recorded if enabled in the provisioner.
 type Challenge struct {
-	ID              string        `json:"-"`
-	AccountID       string        `json:"-"`
-	AuthorizationID string        `json:"-"`
-	Value           string        `json:"-"`
-	Type            ChallengeType `json:"type"`
-	Status          Status        `json:"status"`
-	Token           string        `json:"token"`
-	ValidatedAt     string        `json:"validated,omitempty"`
-	URL             string        `json:"url"`
-	Error           *Error        `json:"error,omitempty"`
+	ID              string              `json:"-"`
+	AccountID       string              `json:"-"`
+	AuthorizationID string              `json:"-"`
+	Value           string              `json:"-"`
+	Type            ChallengeType       `json:"type"`
+	Status          Status              `json:"status"`
+	Token           string              `json:"token"`
+	ValidatedAt     string              `json:"validated,omitempty"`
+	URL             string              `json:"url"`
+	Error           *Error              `json:"error,omitempty"`
+	History         []*ChallengeAttempt `json:"x-history,omitempty"`
+	historySize     int
+	remoteAddr      string
+}
+
+// ChallengeAttempt is the result of an attempt to validate a challenge. Status
+// is the status of the challenge after the attempt, Error the reason of a
+// failed attempt, and RemoteAddr the address or the name contacted by the
+// validator.
+type ChallengeAttempt struct {
+	AttemptedAt time.Time `json:"attemptedAt"`
+	Status      Status    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	RemoteAddr  string    `json:"remoteAddr,omitempty"`
 }
 
 // ToLog enables response logging.
@@ -63,6 +79,9 @@ func (ch *Challenge) Validate(ctx context.Context, db DB, jwk *jose.JSONWebKey,
 	if ch.Status != StatusPending {
 		return nil
 	}
+	if vo != nil {
+		ch.historySize = vo.HistorySize
+	}
 	switch ch.Type {
 	case HTTP01:
 		return http01Validate(ctx, ch, db, jwk, vo)
@@ -71,14 +90,51 @@ func (ch *Challenge) Validate(ctx context.Context, db DB, jwk *jose.JSONWebKey,
 	case TLSALPN01:
 		return tlsalpn01Validate(ctx, ch, db, jwk, vo)
 	default:
-		return NewErrorISE("unexpected challenge type '%s'", ch.Type)
+		var reg *Registry
+		if vo != nil {
+			reg = vo.Registry
+		}
+		a, ok := reg.challengeAuthorizer(ch.Type)
+		if !ok {
+			return NewErrorISE("unexpected challenge type '%s'", ch.Type)
+		}
+		keyAuth, err := reg.KeyAuthorization(ch, jwk)
+		if err != nil {
+			return err
+		}
+		return customValidate(ctx, ch, db, a, keyAuth)
 	}
 }
 
 func http01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSONWebKey, vo *ValidateChallengeOptions) error {
-	u := &url.URL{Scheme: "http", Host: ch.Value, Path: fmt.Sprintf("/.well-known/acme-challenge/%s", ch.Token)}
+	host := ch.Value
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	u := &url.URL{Scheme: "http", Host: host, Path: fmt.Sprintf("/.well-known/acme-challenge/%s", ch.Token)}
+	ch.remoteAddr = u.Host
 
-	resp, err := vo.HTTPGet(u.String())
+	// RFC 8555 section 8.3 requires the validation to use port 80.
+	if port := u.Port(); port != "" && port != "80" {
+		return storeError(ctx, db, ch, true, NewError(ErrorConnectionType,
+			"http-01 validation must use port 80, but url %s uses port %s", u, port))
+	}
+
+	var resp *http.Response
+	var err error
+	if len(vo.HTTPHeaders) == 0 {
+		resp, err = vo.HTTPGet(u.String())
+	} else {
+		if vo.HTTPDo == nil {
+			return NewErrorISE("http-01 validation headers are configured but the http client does not support them")
+		}
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+			return WrapErrorISE(err, "error creating request for url %s", u)
+		}
+		req.Header = vo.HTTPHeaders.Clone()
+		resp, err = vo.HTTPDo(req)
+	}
 	if err != nil {
 		return storeError(ctx, db, ch, false, WrapError(ErrorConnectionType, err,
 			"error doing http GET for url %s", u))
@@ -96,7 +152,7 @@ func http01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSONWeb
 	}
 	keyAuth := strings.TrimSpace(string(body))
 
-	expected, err := KeyAuthorization(ch.Token, jwk)
+	expected, err := vo.Registry.KeyAuthorization(ch, jwk)
 	if err != nil {
 		return err
 	}
@@ -109,6 +165,7 @@ func http01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSONWeb
 	ch.Status = StatusValid
 	ch.Error = nil
 	ch.ValidatedAt = clock.Now().Format(time.RFC3339)
+	ch.recordAttempt(nil)
 
 	if err = db.UpdateChallenge(ctx, ch); err != nil {
 		return WrapErrorISE(err, "error updating challenge")
@@ -116,6 +173,100 @@ func http01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSONWeb
 	return nil
 }
 
+// DefaultHTTP01MaxRedirects is the default maximum number of redirects
+// followed in an http-01 validation.
+const DefaultHTTP01MaxRedirects = 10
+
+// HTTP01RedirectOptions configures the redirects followed in the http-01
+// validations. Disabled fails the validations that get a redirect.
+// MaxRedirects is the maximum number of redirects followed in a validation,
+// DefaultHTTP01MaxRedirects if it's not set. Schemes is the list of schemes
+// allowed in the redirects, http and https if it's not set, any other scheme
+// fails the validation.
+type HTTP01RedirectOptions struct {
+	Disabled     bool
+	MaxRedirects int
+	Schemes      []string
+}
+
+// allowsScheme returns true if a redirect to the given scheme can be followed.
+func (o HTTP01RedirectOptions) allowsScheme(scheme string) bool {
+	if len(o.Schemes) == 0 {
+		return scheme == "http" || scheme == "https"
+	}
+	for _, s := range o.Schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP01CheckRedirect returns the redirect policy of the http client used to
+// validate the http-01 challenges. Redirects are only followed to the allowed
+// schemes, and only to http on port 80 and https on port 443, a redirect to
+// any other scheme or port, or a redirect beyond the maximum, fails the
+// validation.
+func HTTP01CheckRedirect(o HTTP01RedirectOptions) func(*http.Request, []*http.Request) error {
+	maxRedirects := o.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = DefaultHTTP01MaxRedirects
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		if o.Disabled {
+			return fmt.Errorf("http-01 redirects are not allowed, got redirect to %s", req.URL)
+		}
+		// via contains the previous requests, the first one is not a
+		// redirect.
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if !o.allowsScheme(req.URL.Scheme) {
+			return fmt.Errorf("http-01 redirect to %s uses the unsupported scheme %s", req.URL, req.URL.Scheme)
+		}
+		port := req.URL.Port()
+		switch req.URL.Scheme {
+		case "http":
+			if port != "" && port != "80" {
+				return fmt.Errorf("http-01 redirect to %s uses the non-standard port %s", req.URL, port)
+			}
+		case "https":
+			if port != "" && port != "443" {
+				return fmt.Errorf("http-01 redirect to %s uses the non-standard port %s", req.URL, port)
+			}
+		default:
+			return fmt.Errorf("http-01 redirect to %s uses the unsupported scheme %s", req.URL, req.URL.Scheme)
+		}
+		return nil
+	}
+}
+
+// tlsVersionError is the error returned by the tls-alpn-01 validations if the
+// host negotiates a TLS version lower than the minimum version.
+type tlsVersionError struct {
+	Version uint16
+}
+
+func (e *tlsVersionError) Error() string {
+	return fmt.Sprintf("host negotiated TLS %s", tlsVersionName(e.Version))
+}
+
+// tlsVersionName returns the name of a TLS version, e.g. "1.2".
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
 func tlsAlert(err error) uint8 {
 	var opErr *net.OpError
 	if errors.As(err, &opErr) {
@@ -128,32 +279,56 @@ func tlsAlert(err error) uint8 {
 }
 
 func tlsalpn01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSONWebKey, vo *ValidateChallengeOptions) error {
+	// https://tools.ietf.org/html/rfc8737#section-4
+	// ACME servers that implement "acme-tls/1" MUST only negotiate TLS 1.2
+	// [RFC5246] or higher when connecting to clients for validation.
+	//
+	// TLSMinVersion can only raise the minimum version.
+	minVersion := vo.TLSMinVersion
+	if minVersion < tls.VersionTLS12 {
+		minVersion = tls.VersionTLS12
+	}
 	config := &tls.Config{
 		NextProtos: []string{"acme-tls/1"},
-		// https://tools.ietf.org/html/rfc8737#section-4
-		// ACME servers that implement "acme-tls/1" MUST only negotiate TLS 1.2
-		// [RFC5246] or higher when connecting to clients for validation.
-		MinVersion:         tls.VersionTLS12,
+		// Older versions are offered so the hosts that only support them fail
+		// with a tlsVersionError instead of a generic handshake error. The
+		// handshake is aborted as soon as the version is known, before the
+		// key exchange.
+		MinVersion: tls.VersionTLS10,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if cs.Version < minVersion {
+				return &tlsVersionError{Version: cs.Version}
+			}
+			return nil
+		},
 		ServerName:         serverName(ch),
 		InsecureSkipVerify: true, // we expect a self-signed challenge certificate
 	}
 
 	hostPort := net.JoinHostPort(ch.Value, "443")
+	ch.remoteAddr = hostPort
 
 	conn, err := vo.TLSDial("tcp", hostPort, config)
 	if err != nil {
+		switch {
 		// With Go 1.17+ tls.Dial fails if there's no overlap between configured
 		// client and server protocols. When this happens the connection is
 		// closed with the error no_application_protocol(120) as required by
 		// RFC7301. See https://golang.org/doc/go1.17#ALPN
-		if tlsAlert(err) == 120 {
+		case tlsAlert(err) == 120:
 			return storeError(ctx, db, ch, true, NewError(ErrorRejectedIdentifierType,
 				"cannot negotiate ALPN acme-tls/1 protocol for tls-alpn-01 challenge"))
+		case errors.As(err, new(*tlsVersionError)):
+			return storeError(ctx, db, ch, true, NewDetailedError(ErrorTLSType,
+				"cannot negotiate TLS %s or higher with %s for tls-alpn-01 challenge: %v", tlsVersionName(minVersion), hostPort, err))
 		}
 		return storeError(ctx, db, ch, false, WrapError(ErrorConnectionType, err,
 			"error doing TLS dial for %s", hostPort))
 	}
 	defer conn.Close()
+	if addr := conn.RemoteAddr(); addr != nil {
+		ch.remoteAddr = addr.String()
+	}
 
 	cs := conn.ConnectionState()
 	certs := cs.PeerCertificates
@@ -187,11 +362,11 @@ func tlsalpn01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSON
 	idPeAcmeIdentifierV1Obsolete := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 30, 1}
 	foundIDPeAcmeIdentifierV1Obsolete := false
 
-	keyAuth, err := KeyAuthorization(ch.Token, jwk)
+	keyAuth, err := vo.Registry.KeyAuthorization(ch, jwk)
 	if err != nil {
 		return err
 	}
-	hashedKeyAuth := sha256.Sum256([]byte(keyAuth))
+	hashedKeyAuth := vo.Registry.KeyAuthorizationDigest(ch.Type, keyAuth)
 
 	for _, ext := range leafCert.Extensions {
 		if idPeAcmeIdentifier.Equal(ext.Id) {
@@ -218,6 +393,7 @@ func tlsalpn01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSON
 			ch.Status = StatusValid
 			ch.Error = nil
 			ch.ValidatedAt = clock.Now().Format(time.RFC3339)
+			ch.recordAttempt(nil)
 
 			if err = db.UpdateChallenge(ctx, ch); err != nil {
 				return WrapErrorISE(err, "tlsalpn01ValidateChallenge - error updating challenge")
@@ -246,18 +422,21 @@ func dns01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSONWebK
 	// Instead perform txt lookup for _acme-challenge.example.com
 	domain := strings.TrimPrefix(ch.Value, "*.")
 
-	txtRecords, err := vo.LookupTxt("_acme-challenge." + domain)
+	ch.remoteAddr = "_acme-challenge." + domain
+	txtRecords, err := vo.LookupTxt(ch.remoteAddr)
 	if err != nil {
 		return storeError(ctx, db, ch, false, WrapError(ErrorDNSType, err,
 			"error looking up TXT records for domain %s", domain))
 	}
 
-	expectedKeyAuth, err := KeyAuthorization(ch.Token, jwk)
+	expectedKeyAuth, err := vo.Registry.KeyAuthorization(ch, jwk)
 	if err != nil {
 		return err
 	}
-	h := sha256.Sum256([]byte(expectedKeyAuth))
-	expected := base64.RawURLEncoding.EncodeToString(h[:])
+	h := vo.Registry.KeyAuthorizationDigest(ch.Type, expectedKeyAuth)
+	expected := base64.RawURLEncoding.EncodeToString(h)
+	// All the TXT records are checked, there might be other records for
+	// different orders or unrelated ones, and any of them can match.
 	var found bool
 	for _, r := range txtRecords {
 		if r == expected {
@@ -274,6 +453,7 @@ func dns01Validate(ctx context.Context, ch *Challenge, db DB, jwk *jose.JSONWebK
 	ch.Status = StatusValid
 	ch.Error = nil
 	ch.ValidatedAt = clock.Now().Format(time.RFC3339)
+	ch.recordAttempt(nil)
 
 	if err = db.UpdateChallenge(ctx, ch); err != nil {
 		return WrapErrorISE(err, "error updating challenge")
@@ -351,25 +531,78 @@ func KeyAuthorization(token string, jwk *jose.JSONWebKey) (string, error) {
 	return fmt.Sprintf("%s.%s", token, encPrint), nil
 }
 
+// KeyAuthorizer computes the key authorization of the challenges of a type.
+// The standard challenges always use KeyAuthorization, as defined in RFC 8555,
+// but non-standard challenge types can register their own computation using
+// Registry.RegisterKeyAuthorizer.
+type KeyAuthorizer interface {
+	KeyAuthorization(token string, jwk *jose.JSONWebKey) (string, error)
+}
+
+// KeyAuthorizerFunc is an adapter to use a function as a KeyAuthorizer.
+type KeyAuthorizerFunc func(token string, jwk *jose.JSONWebKey) (string, error)
+
+// KeyAuthorization implements the KeyAuthorizer interface.
+func (f KeyAuthorizerFunc) KeyAuthorization(token string, jwk *jose.JSONWebKey) (string, error) {
+	return f(token, jwk)
+}
+
 // storeError the given error to an ACME error and saves using the DB interface.
 func storeError(ctx context.Context, db DB, ch *Challenge, markInvalid bool, err *Error) error {
 	ch.Error = err
 	if markInvalid {
 		ch.Status = StatusInvalid
 	}
+	ch.recordAttempt(err)
 	if err := db.UpdateChallenge(ctx, ch); err != nil {
 		return WrapErrorISE(err, "failure saving error to acme challenge")
 	}
 	return nil
 }
 
+// recordAttempt appends the result of a validation attempt to the history of
+// the challenge, keeping only the last attempts. It does nothing if the history
+// is disabled.
+func (ch *Challenge) recordAttempt(err *Error) {
+	if ch.historySize <= 0 {
+		return
+	}
+	attempt := &ChallengeAttempt{
+		AttemptedAt: clock.Now(),
+		Status:      ch.Status,
+		RemoteAddr:  ch.remoteAddr,
+	}
+	if err != nil {
+		// The detail of the ACME error is generic, the cause has the reason.
+		attempt.Error = err.Cause().Error()
+	}
+	ch.History = append(ch.History, attempt)
+	if n := len(ch.History) - ch.historySize; n > 0 {
+		ch.History = append([]*ChallengeAttempt(nil), ch.History[n:]...)
+	}
+}
+
 type httpGetter func(string) (*http.Response, error)
+type httpDoer func(*http.Request) (*http.Response, error)
 type lookupTxt func(string) ([]string, error)
 type tlsDialer func(network, addr string, config *tls.Config) (*tls.Conn, error)
 
 // ValidateChallengeOptions are ACME challenge validator functions.
+// HistorySize is the maximum number of validation attempts kept in the
+// challenge history, 0 disables it. HTTPHeaders, if set, are added to the
+// http-01 validation requests, and those requests are sent using HTTPDo
+// instead of HTTPGet. TLSMinVersion is the minimum TLS version negotiated in
+// the tls-alpn-01 validations, it cannot be lower than the TLS 1.2 required by
+// RFC 8737.
 type ValidateChallengeOptions struct {
-	HTTPGet   httpGetter
-	LookupTxt lookupTxt
-	TLSDial   tlsDialer
+	HTTPGet       httpGetter
+	HTTPDo        httpDoer
+	LookupTxt     lookupTxt
+	TLSDial       tlsDialer
+	HistorySize   int
+	HTTPHeaders   http.Header
+	TLSMinVersion uint16
+	// Registry contains the custom identifier types and the key authorization
+	// of the non-standard challenges, it can be nil.
+	Registry *Registry
 }
@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -19,6 +20,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -225,6 +227,153 @@ func TestKeyAuthorization(t *testing.T) {
 	}
 }
 
+func TestRegistry_KeyAuthorization(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	assert.FatalError(t, err)
+
+	// A non-standard challenge using the hex encoding of the thumbprint.
+	custom := ChallengeType("x-internal-01")
+	reg := NewRegistry()
+	assert.FatalError(t, reg.RegisterKeyAuthorizer(custom, KeyAuthorizerFunc(func(token string, jwk *jose.JSONWebKey) (string, error) {
+		tp, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return "", err
+		}
+		return token + ":" + hex.EncodeToString(tp), nil
+	})))
+
+	for _, typ := range []ChallengeType{HTTP01, DNS01, TLSALPN01} {
+		assert.NotNil(t, reg.RegisterKeyAuthorizer(typ, KeyAuthorizerFunc(KeyAuthorization)))
+	}
+
+	tests := []struct {
+		typ ChallengeType
+		exp string
+	}{
+		{HTTP01, "1234." + base64.RawURLEncoding.EncodeToString(thumbprint)},
+		{DNS01, "1234." + base64.RawURLEncoding.EncodeToString(thumbprint)},
+		{TLSALPN01, "1234." + base64.RawURLEncoding.EncodeToString(thumbprint)},
+		{"x-unregistered-01", "1234." + base64.RawURLEncoding.EncodeToString(thumbprint)},
+		{custom, "1234:" + hex.EncodeToString(thumbprint)},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.typ), func(t *testing.T) {
+			ch := &Challenge{Type: tt.typ, Token: "1234"}
+			ka, err := reg.KeyAuthorization(ch, jwk)
+			assert.FatalError(t, err)
+			assert.Equals(t, ka, tt.exp)
+			// A nil registry always uses the standard key authorization.
+			ka, err = (*Registry)(nil).KeyAuthorization(ch, jwk)
+			assert.FatalError(t, err)
+			assert.Equals(t, ka, "1234."+base64.RawURLEncoding.EncodeToString(thumbprint))
+		})
+	}
+}
+
+func TestRegistry_KeyAuthorizationDigest(t *testing.T) {
+	custom := ChallengeType("x-digest-01")
+	reg := NewRegistry()
+	assert.FatalError(t, reg.RegisterKeyAuthorizationDigest(custom, crypto.SHA384))
+
+	for _, typ := range []ChallengeType{HTTP01, DNS01, TLSALPN01} {
+		err := reg.RegisterKeyAuthorizationDigest(typ, crypto.SHA384)
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), fmt.Sprintf("the key authorization digest of %s challenges cannot be changed", typ))
+		}
+	}
+	err := reg.RegisterKeyAuthorizationDigest("x-unknown-01", crypto.Hash(0))
+	if assert.NotNil(t, err) {
+		assert.Equals(t, err.Error(), "hash function unknown hash value 0 is not available")
+	}
+	_, ok := reg.keyAuthorizationDigests["x-unknown-01"]
+	assert.False(t, ok)
+
+	sum256 := sha256.Sum256([]byte("token.thumbprint"))
+	sum384 := sha512.Sum384([]byte("token.thumbprint"))
+	tests := []struct {
+		typ ChallengeType
+		exp []byte
+	}{
+		{HTTP01, sum256[:]},
+		{DNS01, sum256[:]},
+		{TLSALPN01, sum256[:]},
+		{"x-unregistered-01", sum256[:]},
+		{custom, sum384[:]},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.typ), func(t *testing.T) {
+			assert.Equals(t, reg.KeyAuthorizationDigest(tt.typ, "token.thumbprint"), tt.exp)
+			assert.Equals(t, (*Registry)(nil).KeyAuthorizationDigest(tt.typ, "token.thumbprint"), sum256[:])
+		})
+	}
+}
+
+func TestParseKeyAuthorizationDigests(t *testing.T) {
+	tests := []struct {
+		name    string
+		digests map[string]string
+		want    map[ChallengeType]crypto.Hash
+		wantErr string
+	}{
+		{"ok/nil", nil, nil, ""},
+		{"ok", map[string]string{"device-attest-01": "SHA-384", "x-internal-01": "SHA-512"}, map[ChallengeType]crypto.Hash{
+			"device-attest-01": crypto.SHA384,
+			"x-internal-01":    crypto.SHA512,
+		}, ""},
+		{"fail/hash", map[string]string{"device-attest-01": "sha384"}, nil, "unsupported hash function sha384 for challenge device-attest-01"},
+		{"fail/unavailable", map[string]string{"device-attest-01": "MD4"}, nil, "hash function MD4 is not available"},
+		{"fail/standard", map[string]string{"tls-alpn-01": "SHA-384"}, nil, "the key authorization digest of tls-alpn-01 challenges cannot be changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKeyAuthorizationDigests(tt.digests)
+			if tt.wantErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Equals(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, got, tt.want)
+		})
+	}
+}
+
+func TestChallenge_Validate_customDigest(t *testing.T) {
+	custom := ChallengeType("device-attest-01")
+	reg := NewRegistry()
+	assert.FatalError(t, reg.RegisterKeyAuthorizationDigest(custom, crypto.SHA384))
+
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	keyAuth, err := KeyAuthorization("token", jwk)
+	assert.FatalError(t, err)
+	// The device reports the SHA-384 digest of the key authorization.
+	proof := sha512.Sum384([]byte(keyAuth))
+
+	assert.FatalError(t, reg.RegisterIdentifierAuthorizer("device", &mockIdentifierAuthorizer{
+		challengeTypes: []ChallengeType{custom},
+		validate: func(ch *Challenge, keyAuth string) error {
+			if !bytes.Equal(reg.KeyAuthorizationDigest(ch.Type, keyAuth), proof[:]) {
+				return NewError(ErrorUnauthorizedType, "digest mismatch")
+			}
+			return nil
+		},
+	}))
+
+	ch := &Challenge{ID: "chID", Type: custom, Token: "token", Value: "device-1", Status: StatusPending}
+	db := &MockDB{
+		MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+			return nil
+		},
+	}
+	assert.FatalError(t, ch.Validate(context.Background(), db, jwk, &ValidateChallengeOptions{Registry: reg}))
+	assert.Equals(t, ch.Status, StatusValid)
+	assert.Nil(t, ch.Error)
+}
+
 func TestChallenge_Validate(t *testing.T) {
 	type test struct {
 		ch  *Challenge
@@ -521,6 +670,81 @@ func (errReader) Close() error {
 	return nil
 }
 
+func TestChallenge_Validate_history(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	expKeyAuth, err := KeyAuthorization("token", jwk)
+	assert.FatalError(t, err)
+
+	// The database keeps only the persisted fields of the challenge.
+	var stored *Challenge
+	db := &MockDB{
+		MockGetChallenge: func(ctx context.Context, id, azID string) (*Challenge, error) {
+			return &Challenge{
+				ID:          stored.ID,
+				Type:        stored.Type,
+				Status:      stored.Status,
+				Token:       stored.Token,
+				Value:       stored.Value,
+				ValidatedAt: stored.ValidatedAt,
+				Error:       stored.Error,
+				History:     stored.History,
+			}, nil
+		},
+		MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+			stored = updch
+			return nil
+		},
+	}
+	stored = &Challenge{ID: "chID", Type: HTTP01, Token: "token", Value: "zap.internal", Status: StatusPending}
+
+	validate := func(t *testing.T, historySize int, res *http.Response, err error) *Challenge {
+		ch, e := db.GetChallenge(context.Background(), "chID", "azID")
+		assert.FatalError(t, e)
+		assert.FatalError(t, ch.Validate(context.Background(), db, jwk, &ValidateChallengeOptions{
+			HTTPGet: func(url string) (*http.Response, error) {
+				return res, err
+			},
+			HistorySize: historySize,
+		}))
+		ch, e = db.GetChallenge(context.Background(), "chID", "azID")
+		assert.FatalError(t, e)
+		return ch
+	}
+
+	// Disabled by default.
+	ch := validate(t, 0, nil, errors.New("force"))
+	assert.Equals(t, ch.Status, StatusPending)
+	assert.Nil(t, ch.History)
+
+	// The failed attempts accumulate, up to the history size.
+	for i := 1; i <= 3; i++ {
+		ch = validate(t, 2, nil, errors.Errorf("force %d", i))
+		assert.Equals(t, ch.Status, StatusPending)
+		if i < 2 {
+			assert.Equals(t, len(ch.History), i)
+		} else {
+			assert.Equals(t, len(ch.History), 2)
+		}
+	}
+	for i, a := range ch.History {
+		assert.Equals(t, a.Status, StatusPending)
+		assert.Equals(t, a.RemoteAddr, "zap.internal")
+		assert.Equals(t, a.Error, fmt.Sprintf("error doing http GET for url http://zap.internal/.well-known/acme-challenge/token: force %d", i+2))
+		assert.False(t, a.AttemptedAt.IsZero())
+	}
+
+	// The successful attempt is the last one.
+	ch = validate(t, 2, &http.Response{
+		Body: io.NopCloser(bytes.NewBufferString(expKeyAuth)),
+	}, nil)
+	assert.Equals(t, ch.Status, StatusValid)
+	assert.Equals(t, len(ch.History), 2)
+	assert.Equals(t, ch.History[0].Status, StatusPending)
+	assert.Equals(t, ch.History[1].Status, StatusValid)
+	assert.Equals(t, ch.History[1].Error, "")
+}
+
 func TestHTTP01Validate(t *testing.T) {
 	type test struct {
 		vo  *ValidateChallengeOptions
@@ -906,6 +1130,344 @@ func TestHTTP01Validate(t *testing.T) {
 	}
 }
 
+func TestHTTP01Validate_headers(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	expKeyAuth, err := KeyAuthorization("token", jwk)
+	assert.FatalError(t, err)
+
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		assert.Equals(t, r.URL.Path, "/.well-known/acme-challenge/token")
+		if r.Header.Get("X-Validation-Secret") == "wrong" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, expKeyAuth)
+	}))
+	defer srv.Close()
+	// The validation connects to port 80 of the identifier, so the client
+	// dials the test server instead.
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			assert.Equals(t, addr, "zap.internal:80")
+			return net.Dial(network, srv.Listener.Addr().String())
+		},
+	}}
+
+	tests := []struct {
+		name       string
+		headers    http.Header
+		httpDo     httpDoer
+		wantStatus Status
+		wantErr    bool
+	}{
+		{"ok/default", nil, client.Do, StatusValid, false},
+		{"ok/headers", http.Header{"X-Validation-Secret": {"shared-secret"}}, client.Do, StatusValid, false},
+		{"ok/rejected", http.Header{"X-Validation-Secret": {"wrong"}}, client.Do, StatusPending, false},
+		{"fail/no-http-do", http.Header{"X-Validation-Secret": {"shared-secret"}}, nil, StatusPending, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			ch := &Challenge{ID: "chID", Type: HTTP01, Token: "token", Value: "zap.internal", Status: StatusPending}
+			db := &MockDB{
+				MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+					return nil
+				},
+			}
+			vo := &ValidateChallengeOptions{
+				HTTPGet:     client.Get,
+				HTTPDo:      tt.httpDo,
+				HTTPHeaders: tt.headers,
+			}
+			err := http01Validate(context.Background(), ch, db, jwk, vo)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				assert.Nil(t, got)
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, ch.Status, tt.wantStatus)
+			if assert.NotNil(t, got) {
+				if tt.headers == nil {
+					assert.Equals(t, got.Get("X-Validation-Secret"), "")
+				}
+				for k := range tt.headers {
+					assert.Equals(t, got.Get(k), tt.headers.Get(k))
+				}
+			}
+		})
+	}
+}
+
+func TestHTTP01Validate_port(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name       string
+		value      string
+		wantURL    string
+		wantStatus Status
+		wantErr    string
+	}{
+		{"ok/default", "zap.internal", "http://zap.internal/.well-known/acme-challenge/token", StatusPending, "force"},
+		{"ok/port-80", "zap.internal:80", "http://zap.internal:80/.well-known/acme-challenge/token", StatusPending, "force"},
+		{"ok/ipv6", "2001:db8::1", "http://[2001:db8::1]/.well-known/acme-challenge/token", StatusPending, "force"},
+		{"fail/port-8080", "zap.internal:8080", "", StatusInvalid, "http-01 validation must use port 80, but url http://zap.internal:8080/.well-known/acme-challenge/token uses port 8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotURL string
+			ch := &Challenge{ID: "chID", Type: HTTP01, Token: "token", Value: tt.value, Status: StatusPending}
+			db := &MockDB{
+				MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+					return nil
+				},
+			}
+			vo := &ValidateChallengeOptions{
+				HTTPGet: func(url string) (*http.Response, error) {
+					gotURL = url
+					return nil, errors.New("force")
+				},
+			}
+			assert.FatalError(t, http01Validate(context.Background(), ch, db, jwk, vo))
+			assert.Equals(t, gotURL, tt.wantURL)
+			assert.Equals(t, ch.Status, tt.wantStatus)
+			if assert.NotNil(t, ch.Error) {
+				assert.Equals(t, ch.Error.Type, NewError(ErrorConnectionType, "").Type)
+				assert.True(t, strings.HasSuffix(ch.Error.Err.Error(), tt.wantErr))
+			}
+		})
+	}
+}
+
+func TestHTTP01Validate_ipv6(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	expKeyAuth, err := KeyAuthorization("token", jwk)
+	assert.FatalError(t, err)
+
+	var gotHost string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		assert.Equals(t, r.URL.Path, "/.well-known/acme-challenge/token")
+		fmt.Fprint(w, expKeyAuth)
+	}))
+	defer srv.Close()
+	// The IPv6 literal must be bracketed in the url and the dial address.
+	var gotAddr string
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			gotAddr = addr
+			return net.Dial(network, srv.Listener.Addr().String())
+		},
+	}}
+
+	ch := &Challenge{ID: "chID", Type: HTTP01, Token: "token", Value: "2001:db8::1", Status: StatusPending}
+	db := &MockDB{
+		MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+			return nil
+		},
+	}
+	assert.FatalError(t, http01Validate(context.Background(), ch, db, jwk, &ValidateChallengeOptions{HTTPGet: client.Get}))
+	assert.Equals(t, ch.Status, StatusValid)
+	assert.Nil(t, ch.Error)
+	assert.Equals(t, gotAddr, "[2001:db8::1]:80")
+	assert.Equals(t, gotHost, "[2001:db8::1]")
+}
+
+func TestHTTP01CheckRedirect(t *testing.T) {
+	mustRequest := func(u string) *http.Request {
+		req, err := http.NewRequest("GET", u, nil)
+		assert.FatalError(t, err)
+		return req
+	}
+	via := []*http.Request{mustRequest("http://zap.internal/.well-known/acme-challenge/token")}
+	httpsOnly := HTTP01RedirectOptions{Schemes: []string{"https"}}
+	tests := []struct {
+		name string
+		opts HTTP01RedirectOptions
+		url  string
+		via  []*http.Request
+		err  string
+	}{
+		{"ok/http", HTTP01RedirectOptions{}, "http://other.internal/token", via, ""},
+		{"ok/http-80", HTTP01RedirectOptions{}, "http://other.internal:80/token", via, ""},
+		{"ok/https", HTTP01RedirectOptions{}, "https://other.internal/token", via, ""},
+		{"ok/https-443", HTTP01RedirectOptions{}, "https://other.internal:443/token", via, ""},
+		{"ok/https-only", httpsOnly, "https://other.internal/token", via, ""},
+		{"ok/at-limit", HTTP01RedirectOptions{}, "http://other.internal/token", make([]*http.Request, DefaultHTTP01MaxRedirects), ""},
+		{"ok/max-redirects-at-limit", HTTP01RedirectOptions{MaxRedirects: 2}, "http://other.internal/token", make([]*http.Request, 2), ""},
+		{"fail/disabled", HTTP01RedirectOptions{Disabled: true}, "http://other.internal/token", via, "http-01 redirects are not allowed, got redirect to http://other.internal/token"},
+		{"fail/http-port", HTTP01RedirectOptions{}, "http://other.internal:8080/token", via, "http-01 redirect to http://other.internal:8080/token uses the non-standard port 8080"},
+		{"fail/http-443", HTTP01RedirectOptions{}, "http://other.internal:443/token", via, "http-01 redirect to http://other.internal:443/token uses the non-standard port 443"},
+		{"fail/https-port", HTTP01RedirectOptions{}, "https://other.internal:8443/token", via, "http-01 redirect to https://other.internal:8443/token uses the non-standard port 8443"},
+		{"fail/scheme", HTTP01RedirectOptions{}, "ftp://other.internal/token", via, "http-01 redirect to ftp://other.internal/token uses the unsupported scheme ftp"},
+		{"fail/https-only", httpsOnly, "http://other.internal/token", via, "http-01 redirect to http://other.internal/token uses the unsupported scheme http"},
+		{"fail/too-many", HTTP01RedirectOptions{}, "http://other.internal/token", make([]*http.Request, DefaultHTTP01MaxRedirects+1), "stopped after 10 redirects"},
+		{"fail/max-redirects", HTTP01RedirectOptions{MaxRedirects: 2}, "http://other.internal/token", make([]*http.Request, 3), "stopped after 2 redirects"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := HTTP01CheckRedirect(tt.opts)(mustRequest(tt.url), tt.via)
+			if tt.err == "" {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Equals(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper implemented by a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func TestHTTP01Validate_redirect(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	keyAuth, err := KeyAuthorization("token", jwk)
+	assert.FatalError(t, err)
+
+	// The validated host redirects to location, the rest of the hosts
+	// respond with the key authorization.
+	var location string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "zap.internal" {
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": {location}},
+				Body:       io.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(keyAuth)),
+			Request:    req,
+		}, nil
+	})
+
+	tests := []struct {
+		name       string
+		location   string
+		follow     bool
+		wantStatus Status
+		wantErr    string
+	}{
+		{"ok/https", "https://redirect.internal/token", true, StatusValid, ""},
+		{"fail/weird-port", "http://redirect.internal:8080/token", true, StatusPending, "http-01 redirect to http://redirect.internal:8080/token uses the non-standard port 8080"},
+		{"fail/disabled", "https://redirect.internal/token", false, StatusPending, "http-01 redirects are not allowed, got redirect to https://redirect.internal/token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location = tt.location
+			client := &http.Client{
+				Transport:     transport,
+				CheckRedirect: HTTP01CheckRedirect(HTTP01RedirectOptions{Disabled: !tt.follow}),
+			}
+			ch := &Challenge{ID: "chID", Type: HTTP01, Token: "token", Value: "zap.internal", Status: StatusPending}
+			db := &MockDB{
+				MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+					return nil
+				},
+			}
+			vo := &ValidateChallengeOptions{HTTPGet: client.Get}
+			assert.FatalError(t, http01Validate(context.Background(), ch, db, jwk, vo))
+			assert.Equals(t, ch.Status, tt.wantStatus)
+			if tt.wantErr == "" {
+				assert.Nil(t, ch.Error)
+			} else if assert.NotNil(t, ch.Error) {
+				assert.Equals(t, ch.Error.Type, NewError(ErrorConnectionType, "").Type)
+				assert.True(t, strings.HasSuffix(ch.Error.Err.Error(), tt.wantErr))
+			}
+		})
+	}
+}
+
+func TestHTTP01Validate_redirectChain(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	keyAuth, err := KeyAuthorization("token", jwk)
+	assert.FatalError(t, err)
+
+	// The validated host starts a chain of chainLength redirects, the last one
+	// uses lastScheme if it's set.
+	var chainLength int
+	var lastScheme string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		hops, _ := strconv.Atoi(q.Get("hops"))
+		if req.URL.Host == "zap.internal" {
+			hops = chainLength
+		}
+		if hops > 0 {
+			scheme := "http"
+			if hops == 1 && lastScheme != "" {
+				scheme = lastScheme
+			}
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": {fmt.Sprintf("%s://redirect.internal/token?hops=%d", scheme, hops-1)}},
+				Body:       io.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(keyAuth)),
+			Request:    req,
+		}, nil
+	})
+
+	tests := []struct {
+		name       string
+		redirects  int
+		scheme     string
+		opts       HTTP01RedirectOptions
+		wantStatus Status
+		wantErr    string
+	}{
+		{"ok/at-limit", DefaultHTTP01MaxRedirects, "", HTTP01RedirectOptions{}, StatusValid, ""},
+		{"ok/max-redirects-at-limit", 3, "", HTTP01RedirectOptions{MaxRedirects: 3}, StatusValid, ""},
+		{"ok/scheme", 2, "https", HTTP01RedirectOptions{Schemes: []string{"http", "https"}}, StatusValid, ""},
+		{"fail/over-limit", DefaultHTTP01MaxRedirects + 1, "", HTTP01RedirectOptions{}, StatusPending, "stopped after 10 redirects"},
+		{"fail/max-redirects-over-limit", 4, "", HTTP01RedirectOptions{MaxRedirects: 3}, StatusPending, "stopped after 3 redirects"},
+		{"fail/scheme", 2, "https", HTTP01RedirectOptions{Schemes: []string{"http"}}, StatusPending, "http-01 redirect to https://redirect.internal/token?hops=0 uses the unsupported scheme https"},
+		{"fail/unsupported-scheme", 1, "file", HTTP01RedirectOptions{}, StatusPending, "http-01 redirect to file://redirect.internal/token?hops=0 uses the unsupported scheme file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chainLength, lastScheme = tt.redirects, tt.scheme
+			client := &http.Client{
+				Transport:     transport,
+				CheckRedirect: HTTP01CheckRedirect(tt.opts),
+			}
+			ch := &Challenge{ID: "chID", Type: HTTP01, Token: "token", Value: "zap.internal", Status: StatusPending}
+			db := &MockDB{
+				MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+					return nil
+				},
+			}
+			vo := &ValidateChallengeOptions{HTTPGet: client.Get}
+			assert.FatalError(t, http01Validate(context.Background(), ch, db, jwk, vo))
+			assert.Equals(t, ch.Status, tt.wantStatus)
+			if tt.wantErr == "" {
+				assert.Nil(t, ch.Error)
+			} else if assert.NotNil(t, ch.Error) {
+				assert.Equals(t, ch.Error.Type, NewError(ErrorConnectionType, "").Type)
+				assert.True(t, strings.HasSuffix(ch.Error.Err.Error(), tt.wantErr))
+			}
+		})
+	}
+}
+
 func TestDNS01Validate(t *testing.T) {
 	fulldomain := "*.zap.internal"
 	domain := strings.TrimPrefix(fulldomain, "*.")
@@ -1181,6 +1743,89 @@ func TestDNS01Validate(t *testing.T) {
 				jwk: jwk,
 			}
 		},
+		"ok/multiple-records": func(t *testing.T) test {
+			ch := &Challenge{
+				ID:     "chID",
+				Token:  "token",
+				Value:  fulldomain,
+				Status: StatusPending,
+			}
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+
+			expKeyAuth, err := KeyAuthorization(ch.Token, jwk)
+			assert.FatalError(t, err)
+			h := sha256.Sum256([]byte(expKeyAuth))
+			expected := base64.RawURLEncoding.EncodeToString(h[:])
+
+			return test{
+				ch: ch,
+				vo: &ValidateChallengeOptions{
+					LookupTxt: func(url string) ([]string, error) {
+						return []string{
+							"v=spf1 -all",
+							"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0",
+							expected,
+							"foo",
+						}, nil
+					},
+				},
+				db: &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+						assert.Equals(t, updch.ID, ch.ID)
+						assert.Equals(t, updch.Status, StatusValid)
+						assert.Equals(t, updch.Error, nil)
+						return nil
+					},
+				},
+				jwk: jwk,
+			}
+		},
+		"ok/quoted-value-mismatch": func(t *testing.T) test {
+			ch := &Challenge{
+				ID:     "chID",
+				Token:  "token",
+				Value:  fulldomain,
+				Status: StatusPending,
+			}
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+
+			expKeyAuth, err := KeyAuthorization(ch.Token, jwk)
+			assert.FatalError(t, err)
+			h := sha256.Sum256([]byte(expKeyAuth))
+			expected := base64.RawURLEncoding.EncodeToString(h[:])
+
+			// The resolver already joins the strings of a record, the value
+			// must match exactly.
+			records := []string{
+				`"` + expected + `"`,
+				`"` + expected[:20] + `" "` + expected[20:] + `"`,
+				" " + expected,
+			}
+			return test{
+				ch: ch,
+				vo: &ValidateChallengeOptions{
+					LookupTxt: func(url string) ([]string, error) {
+						return records, nil
+					},
+				},
+				db: &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+						assert.Equals(t, updch.ID, ch.ID)
+						assert.Equals(t, updch.Status, StatusPending)
+
+						err := NewError(ErrorRejectedIdentifierType, "keyAuthorization does not match; expected %s, but got %s", expKeyAuth, records)
+						assert.HasPrefix(t, updch.Error.Err.Error(), err.Err.Error())
+						assert.Equals(t, updch.Error.Type, err.Type)
+						return nil
+					},
+				},
+				jwk: jwk,
+			}
+		},
 	}
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -2206,6 +2851,118 @@ func TestTLSALPN01Validate(t *testing.T) {
 				jwk: jwk,
 			}
 		},
+		"ok/old-tls-version-error": func(t *testing.T) test {
+			ch := makeTLSCh()
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+
+			expKeyAuth, err := KeyAuthorization(ch.Token, jwk)
+			assert.FatalError(t, err)
+			expKeyAuthHash := sha256.Sum256([]byte(expKeyAuth))
+
+			cert, err := newTLSALPNValidationCert(expKeyAuthHash[:], false, true, ch.Value)
+			assert.FatalError(t, err)
+
+			srv, tlsDial := newTestTLSALPNServer(cert)
+			srv.TLS.MinVersion = tls.VersionTLS10
+			srv.TLS.MaxVersion = tls.VersionTLS11
+			srv.Start()
+
+			return test{
+				ch: ch,
+				vo: &ValidateChallengeOptions{
+					TLSDial: tlsDial,
+				},
+				db: &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+						assert.Equals(t, updch.Status, StatusInvalid)
+						if assert.NotNil(t, updch.Error) {
+							assert.Equals(t, updch.Error.Type, NewError(ErrorTLSType, "").Type)
+							assert.Equals(t, updch.Error.Detail, "cannot negotiate TLS 1.2 or higher with zap.internal:443 for tls-alpn-01 challenge: host negotiated TLS 1.1")
+						}
+						return nil
+					},
+				},
+				srv: srv,
+				jwk: jwk,
+			}
+		},
+		"ok/old-tls-version-min-version-error": func(t *testing.T) test {
+			ch := makeTLSCh()
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+
+			expKeyAuth, err := KeyAuthorization(ch.Token, jwk)
+			assert.FatalError(t, err)
+			expKeyAuthHash := sha256.Sum256([]byte(expKeyAuth))
+
+			cert, err := newTLSALPNValidationCert(expKeyAuthHash[:], false, true, ch.Value)
+			assert.FatalError(t, err)
+
+			srv, tlsDial := newTestTLSALPNServer(cert)
+			srv.TLS.MinVersion = tls.VersionTLS12
+			srv.TLS.MaxVersion = tls.VersionTLS12
+			srv.Start()
+
+			return test{
+				ch: ch,
+				vo: &ValidateChallengeOptions{
+					TLSDial:       tlsDial,
+					TLSMinVersion: tls.VersionTLS13,
+				},
+				db: &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+						assert.Equals(t, updch.Status, StatusInvalid)
+						if assert.NotNil(t, updch.Error) {
+							assert.Equals(t, updch.Error.Type, NewError(ErrorTLSType, "").Type)
+							assert.Equals(t, updch.Error.Detail, "cannot negotiate TLS 1.3 or higher with zap.internal:443 for tls-alpn-01 challenge: host negotiated TLS 1.2")
+						}
+						return nil
+					},
+				},
+				srv: srv,
+				jwk: jwk,
+			}
+		},
+		"ok/no-alpn-error": func(t *testing.T) test {
+			ch := makeTLSCh()
+
+			jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+			assert.FatalError(t, err)
+
+			expKeyAuth, err := KeyAuthorization(ch.Token, jwk)
+			assert.FatalError(t, err)
+			expKeyAuthHash := sha256.Sum256([]byte(expKeyAuth))
+
+			cert, err := newTLSALPNValidationCert(expKeyAuthHash[:], false, true, ch.Value)
+			assert.FatalError(t, err)
+
+			srv, tlsDial := newTestTLSALPNServer(cert)
+			srv.TLS.NextProtos = nil
+			srv.Start()
+
+			return test{
+				ch: ch,
+				vo: &ValidateChallengeOptions{
+					TLSDial: tlsDial,
+				},
+				db: &MockDB{
+					MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+						assert.Equals(t, updch.Status, StatusInvalid)
+
+						err := NewError(ErrorRejectedIdentifierType, "cannot negotiate ALPN acme-tls/1 protocol for tls-alpn-01 challenge")
+						assert.HasPrefix(t, updch.Error.Err.Error(), err.Err.Error())
+						assert.Equals(t, updch.Error.Type, err.Type)
+						assert.Equals(t, updch.Error.Detail, err.Detail)
+						return nil
+					},
+				},
+				srv: srv,
+				jwk: jwk,
+			}
+		},
 		"ok/ip": func(t *testing.T) test {
 			ch := makeTLSCh()
 			ch.Value = "127.0.0.1"
@@ -2272,6 +3029,34 @@ func TestTLSALPN01Validate(t *testing.T) {
 	}
 }
 
+func TestTLSALPN01Validate_ipv6(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	var gotAddr, gotServerName string
+	ch := &Challenge{ID: "chID", Type: TLSALPN01, Token: "token", Value: "2001:db8::1", Status: StatusPending}
+	db := &MockDB{
+		MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+			return nil
+		},
+	}
+	vo := &ValidateChallengeOptions{
+		TLSDial: func(network, addr string, config *tls.Config) (*tls.Conn, error) {
+			gotAddr = addr
+			gotServerName = config.ServerName
+			return nil, errors.New("force")
+		},
+	}
+	assert.FatalError(t, tlsalpn01Validate(context.Background(), ch, db, jwk, vo))
+	// The IPv6 literal is bracketed in the dial address and the SNI is the
+	// ip6.arpa name of the address as required by RFC 8738.
+	assert.Equals(t, gotAddr, "[2001:db8::1]:443")
+	assert.Equals(t, gotServerName, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")
+	if assert.NotNil(t, ch.Error) {
+		assert.HasPrefix(t, ch.Error.Err.Error(), "error doing TLS dial for [2001:db8::1]:443: force")
+	}
+}
+
 func Test_reverseAddr(t *testing.T) {
 	type args struct {
 		ip net.IP
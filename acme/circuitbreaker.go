@@ -0,0 +1,371 @@
+package acme
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Default values used by the circuit breaker if they are not configured.
+const (
+	DefaultCircuitBreakerThreshold = 5
+	DefaultCircuitBreakerCooldown  = 30 * time.Second
+)
+
+// CircuitBreakerOptions are the options used to configure the circuit breaker
+// of a DB. Threshold is the number of consecutive failures that open the
+// circuit, and Cooldown is the time the circuit stays open before a new
+// request is allowed to probe the DB. The default values are used if they are
+// not set.
+type CircuitBreakerOptions struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks the health of a DB. It opens after threshold
+// consecutive failures, rejecting all the requests. After the cooldown, it
+// becomes half-open and lets one request at a time probe the DB: if the probe
+// succeeds the circuit is closed again, and if it fails the circuit is opened
+// for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(opts CircuitBreakerOptions) *circuitBreaker {
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultCircuitBreakerThreshold
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = DefaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: opts.Threshold,
+		cooldown:  opts.Cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow returns true if a request can be sent to the DB.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		cb.probing = true
+		return true
+	case circuitHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// done records the result of a request allowed by the circuit breaker.
+func (cb *circuitBreaker) done(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The request was canceled by the client, the DB health is unknown.
+		if cb.state == circuitHalfOpen {
+			cb.probing = false
+		}
+	case isCircuitBreakerFailure(err):
+		// Failures of requests started before the circuit was opened do not
+		// extend the cooldown.
+		switch cb.state {
+		case circuitClosed:
+			cb.failures++
+			if cb.failures >= cb.threshold {
+				cb.open()
+			}
+		case circuitHalfOpen:
+			cb.open()
+		}
+	default:
+		cb.state = circuitClosed
+		cb.failures = 0
+		cb.probing = false
+	}
+}
+
+func (cb *circuitBreaker) open() {
+	cb.state = circuitOpen
+	cb.openedAt = cb.now()
+	cb.probing = false
+}
+
+// isCircuitBreakerFailure returns true if the error is a failure of the DB.
+// Not found errors, and the ACME errors caused by the request, are valid
+// responses of a healthy DB.
+func isCircuitBreakerFailure(err error) bool {
+	var ae *Error
+	switch {
+	case err == nil, errors.Is(err, ErrNotFound):
+		return false
+	case errors.As(err, &ae):
+		return ae.Status >= http.StatusInternalServerError
+	default:
+		return true
+	}
+}
+
+// circuitBreakerDB is a DB that fails fast, with a 503 serverInternal error,
+// while its circuit breaker is open.
+type circuitBreakerDB struct {
+	db DB
+	cb *circuitBreaker
+}
+
+// circuitBreakerFinalizerDB is a circuitBreakerDB of a DB that implements the
+// OrderFinalizer interface.
+type circuitBreakerFinalizerDB struct {
+	*circuitBreakerDB
+}
+
+// NewCircuitBreakerDB returns a DB that wraps the given one with a circuit
+// breaker. After a number of consecutive failures, the returned DB rejects all
+// the requests with a 503 serverInternal error, instead of sending them to a
+// degraded DB, until the DB recovers. The returned DB implements the
+// OrderFinalizer interface if the given DB does.
+func NewCircuitBreakerDB(db DB, opts CircuitBreakerOptions) DB {
+	cdb := &circuitBreakerDB{
+		db: db,
+		cb: newCircuitBreaker(opts),
+	}
+	if _, ok := db.(OrderFinalizer); ok {
+		return &circuitBreakerFinalizerDB{cdb}
+	}
+	return cdb
+}
+
+func errCircuitOpen() *Error {
+	return NewErrorWithStatus(ErrorServerInternalType, http.StatusServiceUnavailable, "the database is temporarily unavailable")
+}
+
+func (db *circuitBreakerDB) do(fn func() error) error {
+	if !db.cb.allow() {
+		return errCircuitOpen()
+	}
+	err := fn()
+	db.cb.done(err)
+	return err
+}
+
+// CreateAccount implements the DB interface.
+func (db *circuitBreakerDB) CreateAccount(ctx context.Context, acc *Account) error {
+	return db.do(func() error {
+		return db.db.CreateAccount(ctx, acc)
+	})
+}
+
+// GetAccount implements the DB interface.
+func (db *circuitBreakerDB) GetAccount(ctx context.Context, id string) (acc *Account, err error) {
+	err = db.do(func() (err error) {
+		acc, err = db.db.GetAccount(ctx, id)
+		return
+	})
+	return
+}
+
+// GetAccountByKeyID implements the DB interface.
+func (db *circuitBreakerDB) GetAccountByKeyID(ctx context.Context, kid string) (acc *Account, err error) {
+	err = db.do(func() (err error) {
+		acc, err = db.db.GetAccountByKeyID(ctx, kid)
+		return
+	})
+	return
+}
+
+// UpdateAccount implements the DB interface.
+func (db *circuitBreakerDB) UpdateAccount(ctx context.Context, acc *Account) error {
+	return db.do(func() error {
+		return db.db.UpdateAccount(ctx, acc)
+	})
+}
+
+// CreateNonce implements the DB interface.
+func (db *circuitBreakerDB) CreateNonce(ctx context.Context) (nonce Nonce, err error) {
+	err = db.do(func() (err error) {
+		nonce, err = db.db.CreateNonce(ctx)
+		return
+	})
+	return
+}
+
+// DeleteNonce implements the DB interface.
+func (db *circuitBreakerDB) DeleteNonce(ctx context.Context, nonce Nonce) error {
+	return db.do(func() error {
+		return db.db.DeleteNonce(ctx, nonce)
+	})
+}
+
+// CreateAuthorization implements the DB interface.
+func (db *circuitBreakerDB) CreateAuthorization(ctx context.Context, az *Authorization) error {
+	return db.do(func() error {
+		return db.db.CreateAuthorization(ctx, az)
+	})
+}
+
+// CreatePendingAuthorization implements the DB interface.
+func (db *circuitBreakerDB) CreatePendingAuthorization(ctx context.Context, az *Authorization, max int) (ok bool, err error) {
+	err = db.do(func() (err error) {
+		ok, err = db.db.CreatePendingAuthorization(ctx, az, max)
+		return
+	})
+	return
+}
+
+// GetAuthorization implements the DB interface.
+func (db *circuitBreakerDB) GetAuthorization(ctx context.Context, id string) (az *Authorization, err error) {
+	err = db.do(func() (err error) {
+		az, err = db.db.GetAuthorization(ctx, id)
+		return
+	})
+	return
+}
+
+// UpdateAuthorization implements the DB interface.
+func (db *circuitBreakerDB) UpdateAuthorization(ctx context.Context, az *Authorization) error {
+	return db.do(func() error {
+		return db.db.UpdateAuthorization(ctx, az)
+	})
+}
+
+// DeleteAuthorizations implements the DB interface.
+func (db *circuitBreakerDB) DeleteAuthorizations(ctx context.Context, azs []*Authorization) error {
+	return db.do(func() error {
+		return db.db.DeleteAuthorizations(ctx, azs)
+	})
+}
+
+// GetAuthorizationsByAccountID implements the DB interface.
+func (db *circuitBreakerDB) GetAuthorizationsByAccountID(ctx context.Context, accountID string) (azs []*Authorization, err error) {
+	err = db.do(func() (err error) {
+		azs, err = db.db.GetAuthorizationsByAccountID(ctx, accountID)
+		return
+	})
+	return
+}
+
+// CreateCertificate implements the DB interface.
+func (db *circuitBreakerDB) CreateCertificate(ctx context.Context, cert *Certificate) error {
+	return db.do(func() error {
+		return db.db.CreateCertificate(ctx, cert)
+	})
+}
+
+// GetCertificate implements the DB interface.
+func (db *circuitBreakerDB) GetCertificate(ctx context.Context, id string) (cert *Certificate, err error) {
+	err = db.do(func() (err error) {
+		cert, err = db.db.GetCertificate(ctx, id)
+		return
+	})
+	return
+}
+
+// CreateChallenge implements the DB interface.
+func (db *circuitBreakerDB) CreateChallenge(ctx context.Context, ch *Challenge) error {
+	return db.do(func() error {
+		return db.db.CreateChallenge(ctx, ch)
+	})
+}
+
+// GetChallenge implements the DB interface.
+func (db *circuitBreakerDB) GetChallenge(ctx context.Context, id, authzID string) (ch *Challenge, err error) {
+	err = db.do(func() (err error) {
+		ch, err = db.db.GetChallenge(ctx, id, authzID)
+		return
+	})
+	return
+}
+
+// UpdateChallenge implements the DB interface.
+func (db *circuitBreakerDB) UpdateChallenge(ctx context.Context, ch *Challenge) error {
+	return db.do(func() error {
+		return db.db.UpdateChallenge(ctx, ch)
+	})
+}
+
+// CreateOrder implements the DB interface.
+func (db *circuitBreakerDB) CreateOrder(ctx context.Context, o *Order) error {
+	return db.do(func() error {
+		return db.db.CreateOrder(ctx, o)
+	})
+}
+
+// GetOrder implements the DB interface.
+func (db *circuitBreakerDB) GetOrder(ctx context.Context, id string) (o *Order, err error) {
+	err = db.do(func() (err error) {
+		o, err = db.db.GetOrder(ctx, id)
+		return
+	})
+	return
+}
+
+// GetOrdersByAccountID implements the DB interface.
+func (db *circuitBreakerDB) GetOrdersByAccountID(ctx context.Context, accountID string) (ids []string, err error) {
+	err = db.do(func() (err error) {
+		ids, err = db.db.GetOrdersByAccountID(ctx, accountID)
+		return
+	})
+	return
+}
+
+// UpdateOrder implements the DB interface.
+func (db *circuitBreakerDB) UpdateOrder(ctx context.Context, o *Order) error {
+	return db.do(func() error {
+		return db.db.UpdateOrder(ctx, o)
+	})
+}
+
+// GetOrdersByIdentifiers implements the DB interface.
+func (db *circuitBreakerDB) GetOrdersByIdentifiers(ctx context.Context, accountID string, identifiers []Identifier) (ids []string, err error) {
+	err = db.do(func() (err error) {
+		ids, err = db.db.GetOrdersByIdentifiers(ctx, accountID, identifiers)
+		return
+	})
+	return
+}
+
+// IncrementOrderCount implements the DB interface.
+func (db *circuitBreakerDB) IncrementOrderCount(ctx context.Context, accountID string, max int) (ok bool, err error) {
+	err = db.do(func() (err error) {
+		ok, err = db.db.IncrementOrderCount(ctx, accountID, max)
+		return
+	})
+	return
+}
+
+// FinalizeOrder implements the OrderFinalizer interface.
+func (db *circuitBreakerFinalizerDB) FinalizeOrder(ctx context.Context, o *Order, cert *Certificate) error {
+	return db.do(func() error {
+		return db.db.(OrderFinalizer).FinalizeOrder(ctx, o, cert)
+	})
+}
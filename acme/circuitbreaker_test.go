@@ -0,0 +1,197 @@
+package acme
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+)
+
+type finalizerMockDB struct {
+	MockDB
+	finalizeOrder func(ctx context.Context, o *Order, cert *Certificate) error
+}
+
+func (m *finalizerMockDB) FinalizeOrder(ctx context.Context, o *Order, cert *Certificate) error {
+	return m.finalizeOrder(ctx, o, cert)
+}
+
+func TestNewCircuitBreakerDB(t *testing.T) {
+	db := NewCircuitBreakerDB(&MockDB{}, CircuitBreakerOptions{})
+	_, ok := db.(OrderFinalizer)
+	assert.False(t, ok)
+	cb := db.(*circuitBreakerDB).cb
+	assert.Equals(t, cb.threshold, DefaultCircuitBreakerThreshold)
+	assert.Equals(t, cb.cooldown, DefaultCircuitBreakerCooldown)
+
+	var called bool
+	db = NewCircuitBreakerDB(&finalizerMockDB{
+		finalizeOrder: func(ctx context.Context, o *Order, cert *Certificate) error {
+			called = true
+			return nil
+		},
+	}, CircuitBreakerOptions{Threshold: 3, Cooldown: time.Minute})
+	f, ok := db.(OrderFinalizer)
+	if assert.True(t, ok) {
+		assert.FatalError(t, f.FinalizeOrder(context.Background(), &Order{}, &Certificate{}))
+		assert.True(t, called)
+	}
+	cb = db.(*circuitBreakerFinalizerDB).cb
+	assert.Equals(t, cb.threshold, 3)
+	assert.Equals(t, cb.cooldown, time.Minute)
+}
+
+func Test_isCircuitBreakerFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"not found", ErrNotFound, false},
+		{"wrapped not found", errors.Wrap(ErrNotFound, "error loading account"), false},
+		{"acme client error", NewError(ErrorMalformedType, "order not found"), false},
+		{"acme server error", NewErrorISE("error loading order"), true},
+		{"db error", errors.New("connection refused"), true},
+		{"deadline exceeded", context.DeadlineExceeded, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, isCircuitBreakerFailure(tt.err), tt.want)
+		})
+	}
+}
+
+func TestCircuitBreakerDB(t *testing.T) {
+	ctx := context.Background()
+	var calls int
+	var dbErr error
+	mdb := &MockDB{
+		MockGetOrder: func(ctx context.Context, id string) (*Order, error) {
+			calls++
+			if dbErr != nil {
+				return nil, dbErr
+			}
+			return &Order{ID: id}, nil
+		},
+	}
+	db := NewCircuitBreakerDB(mdb, CircuitBreakerOptions{Threshold: 3, Cooldown: 10 * time.Second}).(*circuitBreakerDB)
+	now := time.Now()
+	db.cb.now = func() time.Time { return now }
+
+	// getOrder returns whether the DB was called and the error.
+	getOrder := func() (bool, error) {
+		n := calls
+		o, err := db.GetOrder(ctx, "oID")
+		if err == nil {
+			assert.Equals(t, o, &Order{ID: "oID"})
+		}
+		return calls > n, err
+	}
+	assertOpen := func(t *testing.T) {
+		t.Helper()
+		called, err := getOrder()
+		assert.False(t, called)
+		if assert.NotNil(t, err) {
+			var ae *Error
+			if assert.True(t, errors.As(err, &ae)) {
+				assert.Equals(t, ae.Type, NewErrorISE("").Type)
+				assert.Equals(t, ae.Status, http.StatusServiceUnavailable)
+			}
+		}
+	}
+
+	// Not found errors are not failures.
+	dbErr = ErrNotFound
+	for i := 0; i < 5; i++ {
+		called, err := getOrder()
+		assert.True(t, called)
+		assert.Equals(t, err, ErrNotFound)
+	}
+	assert.Equals(t, db.cb.state, circuitClosed)
+
+	// A success resets the consecutive failures.
+	dbErr = errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		called, _ := getOrder()
+		assert.True(t, called)
+	}
+	dbErr = nil
+	called, err := getOrder()
+	assert.FatalError(t, err)
+	assert.True(t, called)
+	assert.Equals(t, db.cb.failures, 0)
+
+	// Open after threshold consecutive failures.
+	dbErr = errors.New("connection refused")
+	for i := 0; i < 3; i++ {
+		called, err := getOrder()
+		assert.True(t, called)
+		assert.Equals(t, err, dbErr)
+	}
+	assert.Equals(t, db.cb.state, circuitOpen)
+	assertOpen(t)
+
+	// Still open before the cooldown.
+	now = now.Add(9 * time.Second)
+	assertOpen(t)
+
+	// Half-open after the cooldown, the failed probe opens it again.
+	now = now.Add(time.Second)
+	called, err = getOrder()
+	assert.True(t, called)
+	assert.Equals(t, err, dbErr)
+	assert.Equals(t, db.cb.state, circuitOpen)
+	assertOpen(t)
+
+	// Only one probe at a time is allowed while half-open, and a canceled
+	// probe lets the next request probe the DB.
+	now = now.Add(10 * time.Second)
+	mdb.MockGetOrder = func(ctx context.Context, id string) (*Order, error) {
+		calls++
+		assert.Equals(t, db.cb.state, circuitHalfOpen)
+		assertOpen(t)
+		return nil, context.Canceled
+	}
+	called, err = getOrder()
+	assert.True(t, called)
+	assert.Equals(t, err, context.Canceled)
+	assert.Equals(t, db.cb.state, circuitHalfOpen)
+	assert.False(t, db.cb.probing)
+
+	// A successful probe closes it.
+	mdb.MockGetOrder = func(ctx context.Context, id string) (*Order, error) {
+		calls++
+		return &Order{ID: id}, nil
+	}
+	called, err = getOrder()
+	assert.FatalError(t, err)
+	assert.True(t, called)
+	assert.Equals(t, db.cb.state, circuitClosed)
+	assert.Equals(t, db.cb.failures, 0)
+	called, err = getOrder()
+	assert.FatalError(t, err)
+	assert.True(t, called)
+}
+
+func TestCircuitBreakerDB_failuresWhileOpen(t *testing.T) {
+	cb := newCircuitBreaker(CircuitBreakerOptions{Threshold: 1, Cooldown: 10 * time.Second})
+	now := time.Now()
+	cb.now = func() time.Time { return now }
+
+	assert.True(t, cb.allow())
+	assert.True(t, cb.allow())
+	cb.done(errors.New("force"))
+	assert.Equals(t, cb.state, circuitOpen)
+
+	// A late failure of a request allowed before opening the circuit does
+	// not extend the cooldown.
+	now = now.Add(5 * time.Second)
+	cb.done(errors.New("force"))
+	now = now.Add(5 * time.Second)
+	assert.True(t, cb.allow())
+	assert.Equals(t, cb.state, circuitHalfOpen)
+}
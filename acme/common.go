@@ -2,7 +2,9 @@ package acme
 
 import (
 	"context"
+	"crypto"
 	"crypto/x509"
+	"net/http"
 	"time"
 
 	"github.com/smallstep/certificates/authority/provisioner"
@@ -14,6 +16,33 @@ type CertificateAuthority interface {
 	LoadProvisionerByName(string) (provisioner.Interface, error)
 }
 
+// ProvisionerLister is an optional interface implemented by a CA authority
+// that can list its provisioners. It is used to include the valid ACME
+// provisioners in the error returned for an unknown one.
+type ProvisionerLister interface {
+	GetProvisioners(cursor string, limit int) (provisioner.List, string, error)
+}
+
+// WildcardAuthorizer is an optional interface implemented by a CA authority
+// that restricts the provisioners that can request wildcard certificates for
+// a domain.
+type WildcardAuthorizer interface {
+	AuthorizeWildcard(provisionerName, domain string) error
+}
+
+// KeyGenerator is an optional interface implemented by a CA authority that
+// can generate the keys of the certificates on behalf of the ACME clients.
+type KeyGenerator interface {
+	GenerateKey(kty, crv string, size int) (crypto.Signer, error)
+}
+
+// MaintenanceChecker is an optional interface implemented by a CA authority
+// that can be put in maintenance mode. While in maintenance, the requests that
+// create accounts, orders or certificates are rejected.
+type MaintenanceChecker interface {
+	GetMaintenance() (bool, time.Duration)
+}
+
 // Clock that returns time in UTC rounded to seconds.
 type Clock struct{}
 
@@ -31,18 +60,78 @@ type Provisioner interface {
 	GetID() string
 	GetName() string
 	DefaultTLSCertDuration() time.Duration
+	MinTLSCertDuration() time.Duration
+	MaxTLSCertDuration() time.Duration
 	GetOptions() *provisioner.Options
+	GetMaxPendingAuthz() int
+	GetMaxOrdersPerAccount() int
+	GetValidityPolicy() string
+	GetMustStaple() string
+	GetCommonNamePolicy() string
+	GetMixedWildcardPolicy() string
+	GetChallengeRetryAfter() time.Duration
+	GetOrderRetryAfter() time.Duration
+	IsKeyRolloverDisabled() bool
+	AuthorizeOrderIdentifier(typ, value string) error
+	IsServerKeyGenerationEnabled() bool
+	GetChallengeHistorySize() int
+	GetAllowedCurves() []string
+	GetAllowedAlgorithms() []string
+	GetChallenges(typ string) []string
+	GetHTTP01Headers() http.Header
+	GetKeyAttestationRoots() *x509.CertPool
+	GetAccountIdentities() []string
+	GetIdentifierTypes() []string
+	IsTrustedAccount(accountID string) bool
+	GetMaxConcurrentValidations() int
+	GetAuthorizationsPageSize() int
+	GetMaxContacts() int
+	IsWildcardAuthzReuseEnabled() bool
+	GetAuthzReuseAge() time.Duration
+	GetCAAIdentities() []string
+	GetWebsite() string
+	GetDirectoryMeta() map[string]string
 }
 
 // MockProvisioner for testing
 type MockProvisioner struct {
-	Mret1                   interface{}
-	Merr                    error
-	MgetID                  func() string
-	MgetName                func() string
-	MauthorizeSign          func(ctx context.Context, ott string) ([]provisioner.SignOption, error)
-	MdefaultTLSCertDuration func() time.Duration
-	MgetOptions             func() *provisioner.Options
+	Mret1                         interface{}
+	Merr                          error
+	MgetID                        func() string
+	MgetName                      func() string
+	MauthorizeSign                func(ctx context.Context, ott string) ([]provisioner.SignOption, error)
+	MdefaultTLSCertDuration       func() time.Duration
+	MminTLSCertDuration           func() time.Duration
+	MmaxTLSCertDuration           func() time.Duration
+	MgetOptions                   func() *provisioner.Options
+	MgetMaxPendingAuthz           func() int
+	MgetMaxOrdersPerAccount       func() int
+	MgetValidityPolicy            func() string
+	MgetMustStaple                func() string
+	MgetCommonNamePolicy          func() string
+	MgetMixedWildcardPolicy       func() string
+	MgetChallengeRetryAfter       func() time.Duration
+	MgetOrderRetryAfter           func() time.Duration
+	MisKeyRolloverDisabled        func() bool
+	MauthorizeOrderIdentifier     func(typ, value string) error
+	MisServerKeyGenerationEnabled func() bool
+	MgetChallengeHistorySize      func() int
+	MgetAllowedCurves             func() []string
+	MgetAllowedAlgorithms         func() []string
+	MgetChallenges                func(typ string) []string
+	MgetHTTP01Headers             func() http.Header
+	MgetKeyAttestationRoots       func() *x509.CertPool
+	MgetAccountIdentities         func() []string
+	MgetIdentifierTypes           func() []string
+	MisTrustedAccount             func(accountID string) bool
+	MgetMaxConcurrentValidations  func() int
+	MgetAuthorizationsPageSize    func() int
+	MgetMaxContacts               func() int
+	MisWildcardAuthzReuseEnabled  func() bool
+	MgetAuthzReuseAge             func() time.Duration
+	MgetCAAIdentities             func() []string
+	MgetWebsite                   func() string
+	MgetDirectoryMeta             func() map[string]string
 }
 
 // GetName mock
@@ -69,6 +158,30 @@ func (m *MockProvisioner) DefaultTLSCertDuration() time.Duration {
 	return m.Mret1.(time.Duration)
 }
 
+// MinTLSCertDuration mock
+func (m *MockProvisioner) MinTLSCertDuration() time.Duration {
+	if m.MminTLSCertDuration != nil {
+		return m.MminTLSCertDuration()
+	}
+	d, ok := m.Mret1.(time.Duration)
+	if !ok {
+		return 0
+	}
+	return d
+}
+
+// MaxTLSCertDuration mock
+func (m *MockProvisioner) MaxTLSCertDuration() time.Duration {
+	if m.MmaxTLSCertDuration != nil {
+		return m.MmaxTLSCertDuration()
+	}
+	d, ok := m.Mret1.(time.Duration)
+	if !ok {
+		return 0
+	}
+	return d
+}
+
 // GetOptions mock
 func (m *MockProvisioner) GetOptions() *provisioner.Options {
 	if m.MgetOptions != nil {
@@ -84,3 +197,228 @@ func (m *MockProvisioner) GetID() string {
 	}
 	return m.Mret1.(string)
 }
+
+// GetMaxPendingAuthz mock
+func (m *MockProvisioner) GetMaxPendingAuthz() int {
+	if m.MgetMaxPendingAuthz != nil {
+		return m.MgetMaxPendingAuthz()
+	}
+	return 0
+}
+
+// GetMaxOrdersPerAccount mock
+func (m *MockProvisioner) GetMaxOrdersPerAccount() int {
+	if m.MgetMaxOrdersPerAccount != nil {
+		return m.MgetMaxOrdersPerAccount()
+	}
+	return 0
+}
+
+// GetValidityPolicy mock
+func (m *MockProvisioner) GetValidityPolicy() string {
+	if m.MgetValidityPolicy != nil {
+		return m.MgetValidityPolicy()
+	}
+	policy, _ := m.Mret1.(string)
+	return policy
+}
+
+// GetMustStaple mock
+func (m *MockProvisioner) GetMustStaple() string {
+	if m.MgetMustStaple != nil {
+		return m.MgetMustStaple()
+	}
+	return provisioner.ACMEMustStapleIgnore
+}
+
+// GetCommonNamePolicy mock
+func (m *MockProvisioner) GetCommonNamePolicy() string {
+	if m.MgetCommonNamePolicy != nil {
+		return m.MgetCommonNamePolicy()
+	}
+	return provisioner.ACMECommonNamePolicyAllow
+}
+
+// GetMixedWildcardPolicy mock
+func (m *MockProvisioner) GetMixedWildcardPolicy() string {
+	if m.MgetMixedWildcardPolicy != nil {
+		return m.MgetMixedWildcardPolicy()
+	}
+	return provisioner.ACMEMixedWildcardPolicyAllow
+}
+
+// GetChallengeRetryAfter mock
+func (m *MockProvisioner) GetChallengeRetryAfter() time.Duration {
+	if m.MgetChallengeRetryAfter != nil {
+		return m.MgetChallengeRetryAfter()
+	}
+	return 0
+}
+
+// GetOrderRetryAfter mock
+func (m *MockProvisioner) GetOrderRetryAfter() time.Duration {
+	if m.MgetOrderRetryAfter != nil {
+		return m.MgetOrderRetryAfter()
+	}
+	return 0
+}
+
+// IsKeyRolloverDisabled mock
+func (m *MockProvisioner) IsKeyRolloverDisabled() bool {
+	if m.MisKeyRolloverDisabled != nil {
+		return m.MisKeyRolloverDisabled()
+	}
+	return false
+}
+
+// AuthorizeOrderIdentifier mock
+func (m *MockProvisioner) AuthorizeOrderIdentifier(typ, value string) error {
+	if m.MauthorizeOrderIdentifier != nil {
+		return m.MauthorizeOrderIdentifier(typ, value)
+	}
+	return nil
+}
+
+// IsServerKeyGenerationEnabled mock
+func (m *MockProvisioner) IsServerKeyGenerationEnabled() bool {
+	if m.MisServerKeyGenerationEnabled != nil {
+		return m.MisServerKeyGenerationEnabled()
+	}
+	return false
+}
+
+// GetChallengeHistorySize mock
+func (m *MockProvisioner) GetChallengeHistorySize() int {
+	if m.MgetChallengeHistorySize != nil {
+		return m.MgetChallengeHistorySize()
+	}
+	return 0
+}
+
+// GetAllowedCurves mock
+func (m *MockProvisioner) GetAllowedCurves() []string {
+	if m.MgetAllowedCurves != nil {
+		return m.MgetAllowedCurves()
+	}
+	return nil
+}
+
+// GetAllowedAlgorithms mock
+func (m *MockProvisioner) GetAllowedAlgorithms() []string {
+	if m.MgetAllowedAlgorithms != nil {
+		return m.MgetAllowedAlgorithms()
+	}
+	return nil
+}
+
+// GetChallenges mock
+func (m *MockProvisioner) GetChallenges(typ string) []string {
+	if m.MgetChallenges != nil {
+		return m.MgetChallenges(typ)
+	}
+	return nil
+}
+
+// GetHTTP01Headers mock
+func (m *MockProvisioner) GetHTTP01Headers() http.Header {
+	if m.MgetHTTP01Headers != nil {
+		return m.MgetHTTP01Headers()
+	}
+	return nil
+}
+
+// GetKeyAttestationRoots mock
+func (m *MockProvisioner) GetKeyAttestationRoots() *x509.CertPool {
+	if m.MgetKeyAttestationRoots != nil {
+		return m.MgetKeyAttestationRoots()
+	}
+	return nil
+}
+
+// GetAccountIdentities mock
+func (m *MockProvisioner) GetAccountIdentities() []string {
+	if m.MgetAccountIdentities != nil {
+		return m.MgetAccountIdentities()
+	}
+	return nil
+}
+
+// GetIdentifierTypes mock
+func (m *MockProvisioner) GetIdentifierTypes() []string {
+	if m.MgetIdentifierTypes != nil {
+		return m.MgetIdentifierTypes()
+	}
+	return nil
+}
+
+// IsTrustedAccount mock
+func (m *MockProvisioner) IsTrustedAccount(accountID string) bool {
+	if m.MisTrustedAccount != nil {
+		return m.MisTrustedAccount(accountID)
+	}
+	return false
+}
+
+// GetMaxConcurrentValidations mock
+func (m *MockProvisioner) GetMaxConcurrentValidations() int {
+	if m.MgetMaxConcurrentValidations != nil {
+		return m.MgetMaxConcurrentValidations()
+	}
+	return 0
+}
+
+// GetAuthorizationsPageSize mock
+func (m *MockProvisioner) GetAuthorizationsPageSize() int {
+	if m.MgetAuthorizationsPageSize != nil {
+		return m.MgetAuthorizationsPageSize()
+	}
+	return 0
+}
+
+// GetMaxContacts mock
+func (m *MockProvisioner) GetMaxContacts() int {
+	if m.MgetMaxContacts != nil {
+		return m.MgetMaxContacts()
+	}
+	return 0
+}
+
+// IsWildcardAuthzReuseEnabled mock
+func (m *MockProvisioner) IsWildcardAuthzReuseEnabled() bool {
+	if m.MisWildcardAuthzReuseEnabled != nil {
+		return m.MisWildcardAuthzReuseEnabled()
+	}
+	return false
+}
+
+// GetAuthzReuseAge mock
+func (m *MockProvisioner) GetAuthzReuseAge() time.Duration {
+	if m.MgetAuthzReuseAge != nil {
+		return m.MgetAuthzReuseAge()
+	}
+	return 0
+}
+
+// GetCAAIdentities mock
+func (m *MockProvisioner) GetCAAIdentities() []string {
+	if m.MgetCAAIdentities != nil {
+		return m.MgetCAAIdentities()
+	}
+	return nil
+}
+
+// GetWebsite mock
+func (m *MockProvisioner) GetWebsite() string {
+	if m.MgetWebsite != nil {
+		return m.MgetWebsite()
+	}
+	return ""
+}
+
+// GetDirectoryMeta mock
+func (m *MockProvisioner) GetDirectoryMeta() map[string]string {
+	if m.MgetDirectoryMeta != nil {
+		return m.MgetDirectoryMeta()
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package acme
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,6 +15,13 @@ import (
 var ErrNotFound = errors.New("not found")
 
 // DB is the DB interface expected by the step-ca ACME API.
+//
+// The context passed to the methods is the context of the request,
+// implementations must honor its cancellation and deadline and abort the
+// operation, returning the context error, if it's done. The errors caused by a
+// temporary condition, like a write conflict with a concurrent transaction,
+// can be wrapped in an apiv1.ErrTransient, from the kms/apiv1 package, so the
+// operation is retried.
 type DB interface {
 	CreateAccount(ctx context.Context, acc *Account) error
 	GetAccount(ctx context.Context, id string) (*Account, error)
@@ -23,9 +32,24 @@ type DB interface {
 	DeleteNonce(ctx context.Context, nonce Nonce) error
 
 	CreateAuthorization(ctx context.Context, az *Authorization) error
+	// CreatePendingAuthorization creates the authorization if the account has
+	// fewer than max pending authorizations that have not expired, and returns
+	// false if it does not. The check and the creation are atomic, so
+	// concurrent orders cannot exceed the limit.
+	CreatePendingAuthorization(ctx context.Context, az *Authorization, max int) (bool, error)
 	GetAuthorization(ctx context.Context, id string) (*Authorization, error)
 	UpdateAuthorization(ctx context.Context, az *Authorization) error
 
+	// DeleteAuthorizations deletes the given authorizations with their
+	// challenges. It's used to remove the authorizations of an order that
+	// could not be created.
+	DeleteAuthorizations(ctx context.Context, azs []*Authorization) error
+
+	// GetAuthorizationsByAccountID returns the pending or valid authorizations
+	// of an account that have not expired. Their status is updated by
+	// UpdateStatus before they are filtered.
+	GetAuthorizationsByAccountID(ctx context.Context, accountID string) ([]*Authorization, error)
+
 	CreateCertificate(ctx context.Context, cert *Certificate) error
 	GetCertificate(ctx context.Context, id string) (*Certificate, error)
 
@@ -37,6 +61,44 @@ type DB interface {
 	GetOrder(ctx context.Context, id string) (*Order, error)
 	GetOrdersByAccountID(ctx context.Context, accountID string) ([]string, error)
 	UpdateOrder(ctx context.Context, o *Order) error
+
+	// GetOrdersByIdentifiers returns the IDs of all the orders of an account,
+	// in any state, with the same set of identifiers as the given ones.
+	GetOrdersByIdentifiers(ctx context.Context, accountID string, identifiers []Identifier) ([]string, error)
+
+	// IncrementOrderCount increments the number of orders created by an
+	// account if it's lower than max, and returns false if the account has
+	// already reached it. The count is never decreased, not even when the
+	// orders are deleted.
+	IncrementOrderCount(ctx context.Context, accountID string, max int) (bool, error)
+}
+
+// OrderFinalizer is an optional interface that can be implemented by a DB to
+// store the certificate of an order and mark the order as valid atomically.
+// If the DB does not implement it, the certificate will be created and the
+// order updated using two different operations.
+type OrderFinalizer interface {
+	FinalizeOrder(ctx context.Context, o *Order, cert *Certificate) error
+}
+
+// GarbageCollector is an optional interface that can be implemented by a DB
+// to delete the ACME objects that are no longer needed. Each method deletes at
+// most limit objects expired, or created in the case of nonces, before the
+// given time, and returns the number of deleted objects, so they can be
+// deleted in small batches. Authorizations are deleted with their challenges,
+// orders are only deleted if they were not finalized, and valid or deactivated
+// authorizations are never deleted, as the finalized orders reference them.
+type GarbageCollector interface {
+	DeleteExpiredOrders(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteExpiredAuthorizations(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteExpiredNonces(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+// RandomSourceSetter is an optional interface that can be implemented by a DB
+// to generate the nonces using the given source of randomness instead of
+// crypto/rand, e.g. a deterministic one in tests.
+type RandomSourceSetter interface {
+	SetRandomSource(r io.Reader)
 }
 
 // MockDB is an implementation of the DB interface that should only be used as
@@ -50,9 +112,14 @@ type MockDB struct {
 	MockCreateNonce func(ctx context.Context) (Nonce, error)
 	MockDeleteNonce func(ctx context.Context, nonce Nonce) error
 
-	MockCreateAuthorization func(ctx context.Context, az *Authorization) error
-	MockGetAuthorization    func(ctx context.Context, id string) (*Authorization, error)
-	MockUpdateAuthorization func(ctx context.Context, az *Authorization) error
+	MockCreateAuthorization        func(ctx context.Context, az *Authorization) error
+	MockCreatePendingAuthorization func(ctx context.Context, az *Authorization, max int) (bool, error)
+	MockGetAuthorization           func(ctx context.Context, id string) (*Authorization, error)
+	MockUpdateAuthorization        func(ctx context.Context, az *Authorization) error
+
+	MockDeleteAuthorizations func(ctx context.Context, azs []*Authorization) error
+
+	MockGetAuthorizationsByAccountID func(ctx context.Context, accountID string) ([]*Authorization, error)
 
 	MockCreateCertificate func(ctx context.Context, cert *Certificate) error
 	MockGetCertificate    func(ctx context.Context, id string) (*Certificate, error)
@@ -65,6 +132,9 @@ type MockDB struct {
 	MockGetOrder             func(ctx context.Context, id string) (*Order, error)
 	MockGetOrdersByAccountID func(ctx context.Context, accountID string) ([]string, error)
 	MockUpdateOrder          func(ctx context.Context, o *Order) error
+	MockIncrementOrderCount  func(ctx context.Context, accountID string, max int) (bool, error)
+
+	MockGetOrdersByIdentifiers func(ctx context.Context, accountID string, identifiers []Identifier) ([]string, error)
 
 	MockRet1  interface{}
 	MockError error
@@ -140,6 +210,16 @@ func (m *MockDB) CreateAuthorization(ctx context.Context, az *Authorization) err
 	return m.MockError
 }
 
+// CreatePendingAuthorization mock
+func (m *MockDB) CreatePendingAuthorization(ctx context.Context, az *Authorization, max int) (bool, error) {
+	if m.MockCreatePendingAuthorization != nil {
+		return m.MockCreatePendingAuthorization(ctx, az, max)
+	} else if m.MockError != nil {
+		return false, m.MockError
+	}
+	return true, nil
+}
+
 // GetAuthorization mock
 func (m *MockDB) GetAuthorization(ctx context.Context, id string) (*Authorization, error) {
 	if m.MockGetAuthorization != nil {
@@ -160,6 +240,25 @@ func (m *MockDB) UpdateAuthorization(ctx context.Context, az *Authorization) err
 	return m.MockError
 }
 
+// DeleteAuthorizations mock
+func (m *MockDB) DeleteAuthorizations(ctx context.Context, azs []*Authorization) error {
+	if m.MockDeleteAuthorizations != nil {
+		return m.MockDeleteAuthorizations(ctx, azs)
+	}
+	return m.MockError
+}
+
+// GetAuthorizationsByAccountID mock
+func (m *MockDB) GetAuthorizationsByAccountID(ctx context.Context, accID string) ([]*Authorization, error) {
+	if m.MockGetAuthorizationsByAccountID != nil {
+		return m.MockGetAuthorizationsByAccountID(ctx, accID)
+	} else if m.MockError != nil {
+		return nil, m.MockError
+	}
+	azs, _ := m.MockRet1.([]*Authorization)
+	return azs, m.MockError
+}
+
 // CreateCertificate mock
 func (m *MockDB) CreateCertificate(ctx context.Context, cert *Certificate) error {
 	if m.MockCreateCertificate != nil {
@@ -249,3 +348,23 @@ func (m *MockDB) GetOrdersByAccountID(ctx context.Context, accID string) ([]stri
 	}
 	return m.MockRet1.([]string), m.MockError
 }
+
+// GetOrdersByIdentifiers mock
+func (m *MockDB) GetOrdersByIdentifiers(ctx context.Context, accID string, identifiers []Identifier) ([]string, error) {
+	if m.MockGetOrdersByIdentifiers != nil {
+		return m.MockGetOrdersByIdentifiers(ctx, accID, identifiers)
+	} else if m.MockError != nil {
+		return nil, m.MockError
+	}
+	return m.MockRet1.([]string), m.MockError
+}
+
+// IncrementOrderCount mock
+func (m *MockDB) IncrementOrderCount(ctx context.Context, accID string, max int) (bool, error) {
+	if m.MockIncrementOrderCount != nil {
+		return m.MockIncrementOrderCount(ctx, accID, max)
+	} else if m.MockError != nil {
+		return false, m.MockError
+	}
+	return true, nil
+}
@@ -27,6 +27,9 @@ func (dba *dbAccount) clone() *dbAccount {
 }
 
 func (db *DB) getAccountIDByKeyID(ctx context.Context, kid string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	id, err := db.db.Get(accountByKeyIDTable, []byte(kid))
 	if err != nil {
 		if nosqlDB.IsErrNotFound(err) {
@@ -39,6 +42,9 @@ func (db *DB) getAccountIDByKeyID(ctx context.Context, kid string) (string, erro
 
 // getDBAccount retrieves and unmarshals dbAccount.
 func (db *DB) getDBAccount(ctx context.Context, id string) (*dbAccount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	data, err := db.db.Get(accountTable, []byte(id))
 	if err != nil {
 		if nosqlDB.IsErrNotFound(err) {
@@ -100,6 +106,10 @@ func (db *DB) CreateAccount(ctx context.Context, acc *acme.Account) error {
 	}
 	kidB := []byte(kid)
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Set the jwkID -> acme account ID index
 	_, swapped, err := db.db.CmpAndSwap(accountByKeyIDTable, kidB, nil, []byte(acc.ID))
 	switch {
@@ -122,6 +132,9 @@ func (db *DB) UpdateAccount(ctx context.Context, acc *acme.Account) error {
 	if err != nil {
 		return err
 	}
+	if !acme.IsValidAccountStatusTransition(old.Status, acc.Status) {
+		return acme.NewAccountStatusTransitionError(acc.ID, old.Status, acc.Status)
+	}
 
 	nu := old.clone()
 	nu.Contact = acc.Contact
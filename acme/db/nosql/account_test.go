@@ -570,6 +570,28 @@ func TestDB_UpdateAccount(t *testing.T) {
 				err: errors.New("error loading account accID: force"),
 			}
 		},
+		"fail/reactivate": func(t *testing.T) test {
+			return test{
+				acc: &acme.Account{
+					ID:      accID,
+					Status:  acme.StatusValid,
+					Contact: []string{"foo", "bar"},
+				},
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, accountTable)
+						assert.Equals(t, string(key), accID)
+
+						return b, nil
+					},
+					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+						t.Error("db.CmpAndSwap should not be called")
+						return nil, false, nil
+					},
+				},
+				err: errors.New("cannot change the status of account accID from deactivated to valid"),
+			}
+		},
 		"fail/already-deactivated": func(t *testing.T) test {
 			clone := dbacc.clone()
 			clone.Status = acme.StatusDeactivated
@@ -8,6 +8,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 )
 
 // dbAuthz is the base authz type that others build from.
@@ -24,6 +25,20 @@ type dbAuthz struct {
 	Error        *acme.Error     `json:"error"`
 }
 
+// authzExpiryIndex indexes the authorizations by the time they expire. Valid
+// and deactivated authorizations are never deleted.
+var authzExpiryIndex = &expiryIndex{
+	name:  "authzs",
+	table: authzTable,
+	indexTime: func(key, value []byte) (string, time.Time, bool, error) {
+		az := new(dbAuthz)
+		if err := json.Unmarshal(value, az); err != nil {
+			return "", time.Time{}, false, errors.Wrapf(err, "error unmarshaling authz %s into dbAuthz", key)
+		}
+		return az.ID, az.ExpiresAt, az.Status != acme.StatusValid && az.Status != acme.StatusDeactivated, nil
+	},
+}
+
 func (ba *dbAuthz) clone() *dbAuthz {
 	u := *ba
 	return &u
@@ -32,6 +47,9 @@ func (ba *dbAuthz) clone() *dbAuthz {
 // getDBAuthz retrieves and unmarshals a database representation of the
 // ACME Authorization type.
 func (db *DB) getDBAuthz(ctx context.Context, id string) (*dbAuthz, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	data, err := db.db.Get(authzTable, []byte(id))
 	if nosql.IsErrNotFound(err) {
 		return nil, acme.NewError(acme.ErrorMalformedType, "authz %s not found", id)
@@ -73,9 +91,9 @@ func (db *DB) GetAuthorization(ctx context.Context, id string) (*acme.Authorizat
 	}, nil
 }
 
-// CreateAuthorization creates an entry in the database for the Authorization.
-// Implements the acme.DB.CreateAuthorization interface.
-func (db *DB) CreateAuthorization(ctx context.Context, az *acme.Authorization) error {
+// saveNewAuthz generates the ID of a new authorization and stores it. It's not
+// added to the index of the account.
+func (db *DB) saveNewAuthz(ctx context.Context, az *acme.Authorization) error {
 	var err error
 	az.ID, err = randID()
 	if err != nil {
@@ -100,9 +118,79 @@ func (db *DB) CreateAuthorization(ctx context.Context, az *acme.Authorization) e
 		Wildcard:     az.Wildcard,
 	}
 
+	if err := db.indexExpiry(ctx, authzExpiryIndex, az.ID, az.ExpiresAt); err != nil {
+		return err
+	}
 	return db.save(ctx, az.ID, dbaz, nil, "authz", authzTable)
 }
 
+// CreateAuthorization creates an entry in the database for the Authorization.
+// Implements the acme.DB.CreateAuthorization interface.
+func (db *DB) CreateAuthorization(ctx context.Context, az *acme.Authorization) error {
+	if err := db.saveNewAuthz(ctx, az); err != nil {
+		return err
+	}
+
+	if err := db.addAuthzID(ctx, az.AccountID, az.ID); err != nil {
+		// Delete the authorization if the index update fails. Ignore error
+		// from delete -- we tried our best.
+		db.db.Del(authzTable, []byte(az.ID))
+		return err
+	}
+	return nil
+}
+
+// CreatePendingAuthorization creates an entry in the database for the
+// Authorization if the account has fewer than max pending authorizations that
+// have not expired, and returns false if it does not. The authorizations are
+// counted from the same version of the index of the account that is swapped to
+// add the new one, so a concurrent update makes it count them again.
+// Implements the acme.DB.CreatePendingAuthorization interface.
+func (db *DB) CreatePendingAuthorization(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+	if err := db.saveNewAuthz(ctx, az); err != nil {
+		return false, err
+	}
+
+	ok, err := db.addPendingAuthzID(ctx, az.AccountID, az.ID, max)
+	if err != nil || !ok {
+		// Delete the authorization if it's not added to the index. Ignore
+		// error from delete -- we tried our best.
+		db.db.Del(authzTable, []byte(az.ID))
+		az.ID = ""
+	}
+	return ok, err
+}
+
+// addPendingAuthzID appends a new authorization to the index of the account if
+// the authorizations in the index have fewer than max pending authorizations
+// that have not expired.
+func (db *DB) addPendingAuthzID(ctx context.Context, accID, azID string, max int) (bool, error) {
+	for {
+		azIDs, old, err := db.getAuthzIDs(ctx, accID)
+		if err != nil {
+			return false, err
+		}
+		var pending int
+		now := clock.Now()
+		for _, id := range azIDs {
+			dbaz, err := db.getDBAuthz(ctx, id)
+			if err != nil {
+				return false, err
+			}
+			if dbaz.Status == acme.StatusPending && now.Before(dbaz.ExpiresAt) {
+				pending++
+			}
+		}
+		if pending >= max {
+			return false, nil
+		}
+		// Retry if the index has been updated concurrently.
+		if swapped, err := db.swapAuthzIDs(accID, old, append(azIDs, azID)); err != nil || swapped {
+			return swapped, err
+		}
+	}
+}
+
 // UpdateAuthorization saves an updated ACME Authorization to the database.
 func (db *DB) UpdateAuthorization(ctx context.Context, az *acme.Authorization) error {
 	old, err := db.getDBAuthz(ctx, az.ID)
@@ -116,3 +204,193 @@ func (db *DB) UpdateAuthorization(ctx context.Context, az *acme.Authorization) e
 	nu.Error = az.Error
 	return db.save(ctx, old.ID, nu, old, "authz", authzTable)
 }
+
+// DeleteAuthorizations deletes the given authorizations with their challenges
+// in a single transaction. The authorizations are removed from the index of
+// their accounts first, so the index never points to a deleted authorization.
+func (db *DB) DeleteAuthorizations(ctx context.Context, azs []*acme.Authorization) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var ops []*database.TxEntry
+	azIDsByAccount := make(map[string][]string)
+	for _, az := range azs {
+		// The authorization might not have been created.
+		if az.ID != "" {
+			ops = append(ops, deleteOp(authzTable, []byte(az.ID)))
+			azIDsByAccount[az.AccountID] = append(azIDsByAccount[az.AccountID], az.ID)
+		}
+		for _, ch := range az.Challenges {
+			if ch != nil && ch.ID != "" {
+				ops = append(ops, deleteOp(challengeTable, []byte(ch.ID)))
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	for accID, azIDs := range azIDsByAccount {
+		if err := db.removeAuthzIDs(ctx, accID, azIDs); err != nil {
+			return err
+		}
+	}
+	if err := db.db.Update(&database.Tx{Operations: ops}); err != nil {
+		return errors.Wrap(err, "error deleting authzs")
+	}
+	return nil
+}
+
+// getAuthzIDs returns the index of the authorizations of the account and its
+// stored representation, nil if the index does not exist.
+func (db *DB) getAuthzIDs(ctx context.Context, accID string) ([]string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	b, err := db.db.Get(authzsByAccountIDTable, []byte(accID))
+	if nosql.IsErrNotFound(err) {
+		return []string{}, nil, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "error loading authzIDs for account %s", accID)
+	}
+	var azIDs []string
+	if err := json.Unmarshal(b, &azIDs); err != nil {
+		return nil, nil, errors.Wrapf(err, "error unmarshaling authzIDs for account %s", accID)
+	}
+	return azIDs, b, nil
+}
+
+// swapAuthzIDs replaces the index of the authorizations of the account if it
+// has not changed. It returns false if the index has been updated
+// concurrently.
+func (db *DB) swapAuthzIDs(accID string, old []byte, azIDs []string) (bool, error) {
+	// An empty index is stored as an empty list, the nosql drivers store a nil
+	// value as an empty one, which is not valid JSON.
+	nu, err := json.Marshal(azIDs)
+	if err != nil {
+		return false, errors.Wrapf(err, "error marshaling authzIDs for account %s", accID)
+	}
+	_, swapped, err := db.db.CmpAndSwap(authzsByAccountIDTable, []byte(accID), old, nu)
+	if err != nil {
+		return false, errors.Wrapf(err, "error saving authzIDs index for account %s", accID)
+	}
+	return swapped, nil
+}
+
+// addAuthzID appends a new authorization to the index of the account. The
+// index keeps the pending and valid authorizations until they expire, the ones
+// that are no longer needed are removed from the index when it's read, so
+// adding an authorization does not load the other ones.
+func (db *DB) addAuthzID(ctx context.Context, accID, azID string) error {
+	for {
+		azIDs, old, err := db.getAuthzIDs(ctx, accID)
+		if err != nil {
+			return err
+		}
+		// Retry if the index has been updated concurrently.
+		if swapped, err := db.swapAuthzIDs(accID, old, append(azIDs, azID)); err != nil || swapped {
+			return err
+		}
+	}
+}
+
+// removeAuthzIDs removes the given authorizations from the index of the
+// account.
+func (db *DB) removeAuthzIDs(ctx context.Context, accID string, rmAzIDs []string) error {
+	rm := make(map[string]bool, len(rmAzIDs))
+	for _, azID := range rmAzIDs {
+		rm[azID] = true
+	}
+	for {
+		azIDs, old, err := db.getAuthzIDs(ctx, accID)
+		if err != nil {
+			return err
+		}
+		keep := []string{}
+		for _, azID := range azIDs {
+			if !rm[azID] {
+				keep = append(keep, azID)
+			}
+		}
+		if len(keep) == len(azIDs) {
+			return nil
+		}
+		// Retry if the index has been updated concurrently.
+		if swapped, err := db.swapAuthzIDs(accID, old, keep); err != nil || swapped {
+			return err
+		}
+	}
+}
+
+// GetAuthorizationsByAccountID returns the pending and valid authorizations in
+// the index of the account that have not expired. The status of the
+// authorizations is updated by UpdateStatus first, and the ones that are no
+// longer pending or valid, or that have expired, are removed from the index.
+func (db *DB) GetAuthorizationsByAccountID(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+	azIDs, _, err := db.getAuthzIDs(ctx, accID)
+	if err != nil {
+		return nil, err
+	}
+
+	var rmAzIDs []string
+	azs := []*acme.Authorization{}
+	now := clock.Now()
+	for _, azID := range azIDs {
+		az, err := db.GetAuthorization(ctx, azID)
+		if err != nil {
+			return nil, acme.WrapErrorISE(err, "error loading authz %s for account %s", azID, accID)
+		}
+		if err = az.UpdateStatus(ctx, db); err != nil {
+			return nil, acme.WrapErrorISE(err, "error updating authz %s for account %s", azID, accID)
+		}
+		if (az.Status == acme.StatusPending || az.Status == acme.StatusValid) && now.Before(az.ExpiresAt) {
+			azs = append(azs, az)
+		} else {
+			rmAzIDs = append(rmAzIDs, azID)
+		}
+	}
+	if len(rmAzIDs) > 0 {
+		if err := db.removeAuthzIDs(ctx, accID, rmAzIDs); err != nil {
+			return nil, err
+		}
+	}
+	return azs, nil
+}
+
+// DeleteExpiredAuthorizations deletes up to limit authorizations, with their
+// challenges, that expired before the given time, and returns the number of
+// deleted authorizations. Valid and deactivated authorizations are kept, as
+// the finalized orders, which are never deleted, still reference them.
+// Implements the acme.GarbageCollector interface.
+func (db *DB) DeleteExpiredAuthorizations(ctx context.Context, before time.Time, limit int) (int, error) {
+	return db.deleteExpired(ctx, authzExpiryIndex, before, limit, func(ctx context.Context, entries []*database.Entry) ([]*database.TxEntry, int, error) {
+		var (
+			n   int
+			ops []*database.TxEntry
+		)
+		azIDsByAccount := make(map[string][]string)
+		for _, e := range entries {
+			az := new(dbAuthz)
+			if err := json.Unmarshal(e.Value, az); err != nil {
+				return nil, 0, errors.Wrapf(err, "error unmarshaling authz %s into dbAuthz", e.Key)
+			}
+			if az.Status == acme.StatusValid || az.Status == acme.StatusDeactivated {
+				continue
+			}
+			ops = append(ops, deleteOp(authzTable, e.Key))
+			for _, chID := range az.ChallengeIDs {
+				ops = append(ops, deleteOp(challengeTable, []byte(chID)))
+			}
+			azIDsByAccount[az.AccountID] = append(azIDsByAccount[az.AccountID], az.ID)
+			n++
+		}
+
+		// Remove the authorizations from the index of the accounts before
+		// deleting them, so the index never points to a deleted authorization.
+		for accID, azIDs := range azIDsByAccount {
+			if err := db.removeAuthzIDs(ctx, accID, azIDs); err != nil {
+				return nil, 0, err
+			}
+		}
+		return ops, n, nil
+	})
+}
@@ -354,7 +354,7 @@ func TestDB_CreateAuthorization(t *testing.T) {
 				Error:    acme.NewErrorISE("force"),
 			}
 			return test{
-				db: &db.MockNoSQLDB{
+				db: withExpiryIndex(&db.MockNoSQLDB{
 					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
 						assert.Equals(t, bucket, authzTable)
 						assert.Equals(t, string(key), az.ID)
@@ -378,11 +378,61 @@ func TestDB_CreateAuthorization(t *testing.T) {
 						assert.True(t, clock.Now().Add(time.Minute).After(dbaz.CreatedAt))
 						return nil, false, errors.New("force")
 					},
-				},
+				}),
 				az:  az,
 				err: errors.New("error saving acme authz: force"),
 			}
 		},
+		"fail/expiry-index-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, expiryIndexTable)
+						assert.Equals(t, string(key), "authzs")
+						return nil, errors.New("force")
+					},
+				},
+				az: &acme.Authorization{
+					AccountID: "accountID",
+					Status:    acme.StatusPending,
+					ExpiresAt: clock.Now().Add(5 * time.Minute),
+				},
+				err: errors.New("error loading authzs expiry index: force"),
+			}
+		},
+		"fail/index-error": func(t *testing.T) test {
+			az := &acme.Authorization{
+				ID:        azID,
+				AccountID: "accountID",
+				Identifier: acme.Identifier{
+					Type:  "dns",
+					Value: "test.ca.smallstep.com",
+				},
+				Status:    acme.StatusPending,
+				Token:     "token",
+				ExpiresAt: clock.Now().Add(5 * time.Minute),
+			}
+			return test{
+				db: withExpiryIndex(&db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, authzsByAccountIDTable)
+						assert.Equals(t, string(key), az.AccountID)
+						return nil, errors.New("force")
+					},
+					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+						assert.Equals(t, bucket, authzTable)
+						return nu, true, nil
+					},
+					MDel: func(bucket, key []byte) error {
+						assert.Equals(t, bucket, authzTable)
+						assert.Equals(t, string(key), az.ID)
+						return nil
+					},
+				}),
+				az:  az,
+				err: errors.New("error loading authzIDs for account accountID: force"),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			var (
 				id    string
@@ -407,8 +457,21 @@ func TestDB_CreateAuthorization(t *testing.T) {
 				}
 			)
 			return test{
-				db: &db.MockNoSQLDB{
+				db: withExpiryIndex(&db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, authzsByAccountIDTable)
+						assert.Equals(t, string(key), az.AccountID)
+						return nil, nosqldb.ErrNotFound
+					},
 					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+						if string(bucket) == string(authzsByAccountIDTable) {
+							assert.Equals(t, string(key), az.AccountID)
+							assert.Equals(t, old, nil)
+							b, err := json.Marshal([]string{*idPtr})
+							assert.FatalError(t, err)
+							assert.Equals(t, nu, b)
+							return nu, true, nil
+						}
 						*idPtr = string(key)
 						assert.Equals(t, bucket, authzTable)
 						assert.Equals(t, string(key), az.ID)
@@ -432,7 +495,7 @@ func TestDB_CreateAuthorization(t *testing.T) {
 						assert.True(t, clock.Now().Add(time.Minute).After(dbaz.CreatedAt))
 						return nu, true, nil
 					},
-				},
+				}),
 				az:  az,
 				_id: idPtr,
 			}
@@ -614,3 +677,722 @@ func TestDB_UpdateAuthorization(t *testing.T) {
 		})
 	}
 }
+
+func TestDB_DeleteAuthorizations(t *testing.T) {
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		data := map[string]map[string][]byte{
+			string(authzTable):             {},
+			string(challengeTable):         {},
+			string(authzsByAccountIDTable): {},
+		}
+		for _, az := range []*dbAuthz{
+			{ID: "az1", AccountID: "accID", Status: acme.StatusPending, ChallengeIDs: []string{"ch1", "ch2"}},
+			{ID: "az2", AccountID: "accID", Status: acme.StatusPending, ChallengeIDs: []string{"ch3"}},
+		} {
+			b, err := json.Marshal(az)
+			assert.FatalError(t, err)
+			data[string(authzTable)][az.ID] = b
+		}
+		for _, chID := range []string{"ch1", "ch2", "ch3", "ch4"} {
+			b, err := json.Marshal(&dbChallenge{ID: chID, AccountID: "accID", Status: acme.StatusPending})
+			assert.FatalError(t, err)
+			data[string(challengeTable)][chID] = b
+		}
+		b, err := json.Marshal([]string{"az1", "az2"})
+		assert.FatalError(t, err)
+		data[string(authzsByAccountIDTable)]["accID"] = b
+		return data
+	}
+	azs := []*acme.Authorization{
+		{ID: "az1", AccountID: "accID", Challenges: []*acme.Challenge{{ID: "ch1"}, {ID: "ch2"}}},
+		// An authorization that was not created, with a created challenge.
+		{AccountID: "accID", Challenges: []*acme.Challenge{{ID: "ch4"}, nil}},
+	}
+	type test struct {
+		db   nosql.DB
+		data map[string]map[string][]byte
+		azs  []*acme.Authorization
+		err  error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.Update-error": func(t *testing.T) test {
+			data := newData(t)
+			mdb := memoryNoSQLDB(data)
+			mdb.MUpdate = func(tx *nosqldb.Tx) error {
+				return errors.New("force")
+			}
+			return test{
+				db:   mdb,
+				data: data,
+				azs:  azs,
+				err:  errors.New("error deleting authzs: force"),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:   memoryNoSQLDB(data),
+				data: data,
+				azs:  azs,
+			}
+		},
+		"ok/empty": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			err := d.DeleteAuthorizations(context.Background(), tc.azs)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			if tc.data == nil {
+				return
+			}
+			var azIDs, chIDs, index []string
+			for _, e := range mustList(t, tc.db, authzTable) {
+				azIDs = append(azIDs, string(e.Key))
+			}
+			for _, e := range mustList(t, tc.db, challengeTable) {
+				chIDs = append(chIDs, string(e.Key))
+			}
+			assert.Equals(t, azIDs, []string{"az2"})
+			assert.Equals(t, chIDs, []string{"ch3"})
+			assert.FatalError(t, json.Unmarshal(tc.data[string(authzsByAccountIDTable)]["accID"], &index))
+			assert.Equals(t, index, []string{"az2"})
+		})
+	}
+}
+
+func TestDB_addAuthzID(t *testing.T) {
+	accID := "accID"
+	index := func(t *testing.T, azIDs ...string) []byte {
+		b, err := json.Marshal(azIDs)
+		assert.FatalError(t, err)
+		return b
+	}
+	type test struct {
+		db    nosql.DB
+		data  map[string]map[string][]byte
+		index []string
+		err   error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.Get-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, authzsByAccountIDTable)
+						assert.Equals(t, key, []byte(accID))
+						return nil, errors.New("force")
+					},
+				},
+				err: errors.Errorf("error loading authzIDs for account %s: force", accID),
+			}
+		},
+		"fail/unmarshal-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, authzsByAccountIDTable)
+						assert.Equals(t, key, []byte(accID))
+						return []byte("foo"), nil
+					},
+				},
+				err: errors.Errorf("error unmarshaling authzIDs for account %s", accID),
+			}
+		},
+		"fail/db.CmpAndSwap-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						return nil, nosqldb.ErrNotFound
+					},
+					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+						assert.Equals(t, bucket, authzsByAccountIDTable)
+						return nil, false, errors.New("force")
+					},
+				},
+				err: errors.Errorf("error saving authzIDs index for account %s: force", accID),
+			}
+		},
+		"ok/no-old": func(t *testing.T) test {
+			data := map[string]map[string][]byte{}
+			return test{
+				db:    memoryNoSQLDB(data),
+				data:  data,
+				index: []string{"foo"},
+			}
+		},
+		"ok/append": func(t *testing.T) test {
+			data := map[string]map[string][]byte{
+				string(authzsByAccountIDTable): {accID: index(t, "bar")},
+			}
+			return test{
+				db:    memoryNoSQLDB(data),
+				data:  data,
+				index: []string{"bar", "foo"},
+			}
+		},
+		"ok/retry": func(t *testing.T) test {
+			data := map[string]map[string][]byte{
+				string(authzsByAccountIDTable): {accID: index(t, "bar")},
+			}
+			mdb := memoryNoSQLDB(data)
+			cmpAndSwap := mdb.MCmpAndSwap
+			var retried bool
+			mdb.MCmpAndSwap = func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+				// Simulate an authorization added concurrently.
+				if !retried {
+					retried = true
+					data[string(bucket)][string(key)] = index(t, "bar", "baz")
+				}
+				return cmpAndSwap(bucket, key, old, nu)
+			}
+			return test{
+				db:    mdb,
+				data:  data,
+				index: []string{"bar", "baz", "foo"},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			if err := d.addAuthzID(context.Background(), accID, "foo"); err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			var azIDs []string
+			assert.FatalError(t, json.Unmarshal(tc.data[string(authzsByAccountIDTable)][accID], &azIDs))
+			assert.Equals(t, azIDs, tc.index)
+		})
+	}
+}
+
+func TestDB_CreatePendingAuthorization(t *testing.T) {
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		data := map[string]map[string][]byte{
+			string(authzTable):             {},
+			string(authzsByAccountIDTable): {},
+		}
+		now := clock.Now()
+		for _, az := range []*dbAuthz{
+			{ID: "az1", AccountID: "accID", Status: acme.StatusPending, ExpiresAt: now.Add(time.Hour)},
+			{ID: "az2", AccountID: "accID", Status: acme.StatusValid, ExpiresAt: now.Add(time.Hour)},
+			{ID: "az3", AccountID: "accID", Status: acme.StatusPending, ExpiresAt: now.Add(-time.Hour)},
+		} {
+			b, err := json.Marshal(az)
+			assert.FatalError(t, err)
+			data[string(authzTable)][az.ID] = b
+		}
+		b, err := json.Marshal([]string{"az1", "az2", "az3"})
+		assert.FatalError(t, err)
+		data[string(authzsByAccountIDTable)]["accID"] = b
+		return data
+	}
+	type test struct {
+		db    nosql.DB
+		data  map[string]map[string][]byte
+		max   int
+		ok    bool
+		index []string
+		err   error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.Get-error": func(t *testing.T) test {
+			data := newData(t)
+			mdb := memoryNoSQLDB(data)
+			mdb.MGet = func(bucket, key []byte) ([]byte, error) {
+				if string(bucket) == string(authzsByAccountIDTable) {
+					return nil, errors.New("force")
+				}
+				return data[string(bucket)][string(key)], nil
+			}
+			return test{
+				db:    withExpiryIndex(mdb),
+				data:  data,
+				max:   2,
+				index: []string{"az1", "az2", "az3"},
+				err:   errors.New("error loading authzIDs for account accID: force"),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:    withExpiryIndex(memoryNoSQLDB(data)),
+				data:  data,
+				max:   2,
+				ok:    true,
+				index: []string{"az1", "az2", "az3"},
+			}
+		},
+		"ok/limit": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:    withExpiryIndex(memoryNoSQLDB(data)),
+				data:  data,
+				max:   1,
+				index: []string{"az1", "az2", "az3"},
+			}
+		},
+		"ok/limit-after-retry": func(t *testing.T) test {
+			data := newData(t)
+			mdb := memoryNoSQLDB(data)
+			cmpAndSwap := mdb.MCmpAndSwap
+			var retried bool
+			mdb.MCmpAndSwap = func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+				// Simulate a pending authorization added concurrently.
+				if string(bucket) == string(authzsByAccountIDTable) && !retried {
+					retried = true
+					b, err := json.Marshal(&dbAuthz{ID: "az4", AccountID: "accID", Status: acme.StatusPending, ExpiresAt: clock.Now().Add(time.Hour)})
+					assert.FatalError(t, err)
+					data[string(authzTable)]["az4"] = b
+					b, err = json.Marshal([]string{"az1", "az2", "az3", "az4"})
+					assert.FatalError(t, err)
+					data[string(bucket)][string(key)] = b
+				}
+				return cmpAndSwap(bucket, key, old, nu)
+			}
+			return test{
+				db:    withExpiryIndex(mdb),
+				data:  data,
+				max:   2,
+				index: []string{"az1", "az2", "az3", "az4"},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			az := &acme.Authorization{
+				AccountID:  "accID",
+				Identifier: acme.Identifier{Type: "dns", Value: "test.ca.smallstep.com"},
+				Status:     acme.StatusPending,
+				ExpiresAt:  clock.Now().Add(time.Hour),
+			}
+			ok, err := d.CreatePendingAuthorization(context.Background(), az, tc.max)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+			} else {
+				assert.Nil(t, tc.err)
+			}
+			assert.Equals(t, ok, tc.ok)
+
+			var index []string
+			assert.FatalError(t, json.Unmarshal(tc.data[string(authzsByAccountIDTable)]["accID"], &index))
+			_, stored := tc.data[string(authzTable)][az.ID]
+			if tc.ok {
+				assert.Equals(t, index, append(tc.index, az.ID))
+				assert.True(t, stored)
+			} else {
+				// The authorization is deleted if it's not created.
+				assert.Equals(t, index, tc.index)
+				assert.Equals(t, az.ID, "")
+				assert.Equals(t, len(tc.data[string(authzTable)]), len(tc.index))
+			}
+		})
+	}
+}
+
+func TestDB_GetAuthorizationsByAccountID_updateStatus(t *testing.T) {
+	accID := "accID"
+	now := clock.Now()
+	newData := func(t *testing.T, azIDs ...string) map[string]map[string][]byte {
+		authzs := []*dbAuthz{
+			// foo has expired
+			{ID: "foo", AccountID: accID, Status: acme.StatusPending, ExpiresAt: now.Add(-5 * time.Minute), ChallengeIDs: []string{"chFoo"}},
+			// bar has been completed
+			{ID: "bar", AccountID: accID, Status: acme.StatusPending, ExpiresAt: now.Add(5 * time.Minute), ChallengeIDs: []string{"chBar"}},
+			// baz is still pending
+			{ID: "baz", AccountID: accID, Status: acme.StatusPending, ExpiresAt: now.Add(5 * time.Minute), ChallengeIDs: []string{"chBaz"}},
+		}
+		challenges := map[string]acme.Status{
+			"chFoo": acme.StatusPending,
+			"chBar": acme.StatusValid,
+			"chBaz": acme.StatusPending,
+		}
+		data := map[string]map[string][]byte{
+			string(authzTable):             {},
+			string(challengeTable):         {},
+			string(authzsByAccountIDTable): {},
+		}
+		for _, az := range authzs {
+			b, err := json.Marshal(az)
+			assert.FatalError(t, err)
+			data[string(authzTable)][az.ID] = b
+		}
+		for id, status := range challenges {
+			b, err := json.Marshal(&dbChallenge{ID: id, AccountID: accID, Status: status})
+			assert.FatalError(t, err)
+			data[string(challengeTable)][id] = b
+		}
+		if len(azIDs) > 0 {
+			b, err := json.Marshal(azIDs)
+			assert.FatalError(t, err)
+			data[string(authzsByAccountIDTable)][accID] = b
+		}
+		return data
+	}
+	type test struct {
+		db     nosql.DB
+		data   map[string]map[string][]byte
+		res    []string
+		index  []string
+		status map[string]acme.Status
+		err    error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.Get-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, authzsByAccountIDTable)
+						assert.Equals(t, key, []byte(accID))
+						return nil, errors.New("force")
+					},
+				},
+				err: errors.Errorf("error loading authzIDs for account %s: force", accID),
+			}
+		},
+		"fail/authz-not-found": func(t *testing.T) test {
+			return test{
+				db:  memoryNoSQLDB(newData(t, "baz", "zap")),
+				err: errors.Errorf("error loading authz zap for account %s", accID),
+			}
+		},
+		"ok/no-index": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:   memoryNoSQLDB(data),
+				data: data,
+				res:  []string{},
+			}
+		},
+		"ok/expired-are-removed": func(t *testing.T) test {
+			data := newData(t, "foo", "bar", "baz")
+			return test{
+				db:    memoryNoSQLDB(data),
+				data:  data,
+				res:   []string{"bar", "baz"},
+				index: []string{"bar", "baz"},
+				status: map[string]acme.Status{
+					"foo": acme.StatusInvalid,
+					"bar": acme.StatusValid,
+					"baz": acme.StatusPending,
+				},
+			}
+		},
+		"ok/none-pending": func(t *testing.T) test {
+			data := newData(t, "foo", "bar")
+			return test{
+				db:    memoryNoSQLDB(data),
+				data:  data,
+				res:   []string{"bar"},
+				index: []string{"bar"},
+			}
+		},
+		"ok/all-removed": func(t *testing.T) test {
+			data := newData(t, "foo")
+			return test{
+				db:    memoryNoSQLDB(data),
+				data:  data,
+				res:   []string{},
+				index: []string{},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			azs, err := d.GetAuthorizationsByAccountID(context.Background(), accID)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					if acmeErr, ok := err.(*acme.Error); ok {
+						err = acmeErr.Err
+					}
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			res := []string{}
+			for _, az := range azs {
+				res = append(res, az.ID)
+			}
+			assert.Equals(t, res, tc.res)
+
+			if b, ok := tc.data[string(authzsByAccountIDTable)][accID]; ok {
+				var index []string
+				assert.FatalError(t, json.Unmarshal(b, &index))
+				assert.Equals(t, index, tc.index)
+			} else {
+				assert.Nil(t, tc.index)
+			}
+			for id, status := range tc.status {
+				az := new(dbAuthz)
+				assert.FatalError(t, json.Unmarshal(tc.data[string(authzTable)][id], az))
+				assert.Equals(t, az.Status, status)
+			}
+		})
+	}
+}
+
+func TestDB_DeleteExpiredAuthorizations(t *testing.T) {
+	now := clock.Now().Truncate(time.Second)
+	before := now.Add(-time.Hour)
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		authzs := map[string]*dbAuthz{
+			"az1": {ID: "az1", AccountID: "acc1", Status: acme.StatusPending, ChallengeIDs: []string{"ch1", "ch2"}, ExpiresAt: now.Add(-2 * time.Hour)},
+			"az2": {ID: "az2", AccountID: "acc1", Status: acme.StatusPending, ChallengeIDs: []string{"ch3"}, ExpiresAt: now.Add(time.Hour)},
+			"az3": {ID: "az3", AccountID: "acc2", Status: acme.StatusValid, ChallengeIDs: []string{"ch4"}, ExpiresAt: now.Add(-3 * time.Hour)},
+			"az4": {ID: "az4", AccountID: "acc2", Status: acme.StatusPending, ChallengeIDs: []string{"ch5"}, ExpiresAt: now.Add(-30 * time.Minute)},
+			"az5": {ID: "az5", AccountID: "acc2", Status: acme.StatusDeactivated, ChallengeIDs: []string{"ch6"}, ExpiresAt: now.Add(-3 * time.Hour)},
+			"az6": {ID: "az6", AccountID: "acc2", Status: acme.StatusInvalid, ChallengeIDs: []string{"ch7"}, ExpiresAt: now.Add(-3 * time.Hour)},
+		}
+		data := map[string]map[string][]byte{
+			string(authzTable):             {},
+			string(challengeTable):         {},
+			string(authzsByAccountIDTable): {},
+		}
+		for id, az := range authzs {
+			b, err := json.Marshal(az)
+			assert.FatalError(t, err)
+			data[string(authzTable)][id] = b
+			for _, chID := range az.ChallengeIDs {
+				b, err := json.Marshal(&dbChallenge{ID: chID, AccountID: az.AccountID, Type: "http-01", Status: acme.StatusPending})
+				assert.FatalError(t, err)
+				data[string(challengeTable)][chID] = b
+			}
+		}
+		b, err := json.Marshal([]string{"az1", "az2"})
+		assert.FatalError(t, err)
+		data[string(authzsByAccountIDTable)]["acc1"] = b
+		return data
+	}
+	type test struct {
+		db         nosql.DB
+		data       map[string]map[string][]byte
+		limit      int
+		n          int
+		authzs     []string
+		challenges []string
+		index      []string
+		err        error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.List-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, expiryIndexTable)
+						return nil, nosqldb.ErrNotFound
+					},
+					MList: func(bucket []byte) ([]*nosqldb.Entry, error) {
+						assert.Equals(t, bucket, authzTable)
+						return nil, errors.New("force")
+					},
+				},
+				limit: 10,
+				err:   errors.New("error loading authzs: force"),
+			}
+		},
+		"fail/db.Update-error": func(t *testing.T) test {
+			data := newData(t)
+			mdb := memoryNoSQLDB(data)
+			mdb.MUpdate = func(tx *nosqldb.Tx) error {
+				return errors.New("force")
+			}
+			return test{
+				db:    mdb,
+				data:  data,
+				limit: 10,
+				err:   errors.New("error deleting expired authzs: force"),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:         memoryNoSQLDB(data),
+				data:       data,
+				limit:      10,
+				n:          2,
+				authzs:     []string{"az2", "az3", "az4", "az5"},
+				challenges: []string{"ch3", "ch4", "ch5", "ch6"},
+				index:      []string{"az2"},
+			}
+		},
+		"ok/limit": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:         memoryNoSQLDB(data),
+				data:       data,
+				limit:      1,
+				n:          1,
+				authzs:     []string{"az1", "az2", "az3", "az4", "az5"},
+				challenges: []string{"ch1", "ch2", "ch3", "ch4", "ch5", "ch6"},
+				index:      []string{"az1", "az2"},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			n, err := d.DeleteExpiredAuthorizations(context.Background(), before, tc.limit)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			assert.Equals(t, n, tc.n)
+
+			var authzs, challenges []string
+			for _, e := range mustList(t, tc.db, authzTable) {
+				authzs = append(authzs, string(e.Key))
+			}
+			for _, e := range mustList(t, tc.db, challengeTable) {
+				challenges = append(challenges, string(e.Key))
+			}
+			assert.Equals(t, authzs, tc.authzs)
+			assert.Equals(t, challenges, tc.challenges)
+
+			// The expired authorizations are removed from the index of the account.
+			var index []string
+			assert.FatalError(t, json.Unmarshal(tc.data[string(authzsByAccountIDTable)]["acc1"], &index))
+			assert.Equals(t, index, tc.index)
+		})
+	}
+}
+
+func TestDB_GetAuthorizationsByAccountID(t *testing.T) {
+	now := clock.Now()
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		azs := map[string]*dbAuthz{
+			"az1": {ID: "az1", AccountID: "acc1", Wildcard: true, Status: acme.StatusValid, ExpiresAt: now.Add(time.Hour)},
+			"az2": {ID: "az2", AccountID: "acc1", Status: acme.StatusPending, ExpiresAt: now.Add(time.Hour)},
+			"az3": {ID: "az3", AccountID: "acc1", Status: acme.StatusValid, ExpiresAt: now.Add(time.Hour)},
+			"az4": {ID: "az4", AccountID: "acc1", Status: acme.StatusValid, ExpiresAt: now.Add(-time.Hour)},
+			"az5": {ID: "az5", AccountID: "acc1", Status: acme.StatusInvalid, ExpiresAt: now.Add(time.Hour)},
+			"az6": {ID: "az6", AccountID: "acc2", Status: acme.StatusValid, ExpiresAt: now.Add(time.Hour)},
+		}
+		data := map[string]map[string][]byte{
+			string(authzTable):             {},
+			string(authzsByAccountIDTable): {},
+		}
+		for id, az := range azs {
+			b, err := json.Marshal(az)
+			assert.FatalError(t, err)
+			data[string(authzTable)][id] = b
+		}
+		for accID, azIDs := range map[string][]string{
+			"acc1": {"az1", "az2", "az3", "az4", "az5"},
+			"acc2": {"az6"},
+		} {
+			b, err := json.Marshal(azIDs)
+			assert.FatalError(t, err)
+			data[string(authzsByAccountIDTable)][accID] = b
+		}
+		return data
+	}
+	type test struct {
+		db    nosql.DB
+		data  map[string]map[string][]byte
+		accID string
+		azIDs []string
+		index []string
+		err   error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.Get-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, authzsByAccountIDTable)
+						return nil, errors.New("force")
+					},
+				},
+				accID: "acc1",
+				err:   errors.New("error loading authzIDs for account acc1: force"),
+			}
+		},
+		"fail/unmarshal-error": func(t *testing.T) test {
+			data := newData(t)
+			data[string(authzTable)]["az1"] = []byte("foo")
+			return test{
+				db:    memoryNoSQLDB(data),
+				accID: "acc1",
+				err:   errors.New("error loading authz az1 for account acc1"),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			data := newData(t)
+			// The authorizations are found using the index only.
+			mdb := memoryNoSQLDB(data)
+			mdb.MList = func(bucket []byte) ([]*nosqldb.Entry, error) {
+				return nil, errors.New("force")
+			}
+			return test{
+				db:    mdb,
+				data:  data,
+				accID: "acc1",
+				azIDs: []string{"az1", "az2", "az3"},
+				index: []string{"az1", "az2", "az3"},
+			}
+		},
+		"ok/no-index": func(t *testing.T) test {
+			return test{
+				db:    memoryNoSQLDB(newData(t)),
+				accID: "acc3",
+				azIDs: []string{},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			azs, err := d.GetAuthorizationsByAccountID(context.Background(), tc.accID)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					if acmeErr, ok := err.(*acme.Error); ok {
+						err = acmeErr.Err
+					}
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			azIDs := []string{}
+			for _, az := range azs {
+				azIDs = append(azIDs, az.ID)
+			}
+			assert.Equals(t, azIDs, tc.azIDs)
+
+			// The expired and invalid authorizations are removed from the index.
+			if tc.index != nil {
+				var index []string
+				assert.FatalError(t, json.Unmarshal(tc.data[string(authzsByAccountIDTable)][tc.accID], &index))
+				assert.Equals(t, index, tc.index)
+			}
+		})
+	}
+}
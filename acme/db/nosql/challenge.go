@@ -11,15 +11,16 @@ import (
 )
 
 type dbChallenge struct {
-	ID          string             `json:"id"`
-	AccountID   string             `json:"accountID"`
-	Type        acme.ChallengeType `json:"type"`
-	Status      acme.Status        `json:"status"`
-	Token       string             `json:"token"`
-	Value       string             `json:"value"`
-	ValidatedAt string             `json:"validatedAt"`
-	CreatedAt   time.Time          `json:"createdAt"`
-	Error       *acme.Error        `json:"error"`
+	ID          string                   `json:"id"`
+	AccountID   string                   `json:"accountID"`
+	Type        acme.ChallengeType       `json:"type"`
+	Status      acme.Status              `json:"status"`
+	Token       string                   `json:"token"`
+	Value       string                   `json:"value"`
+	ValidatedAt string                   `json:"validatedAt"`
+	CreatedAt   time.Time                `json:"createdAt"`
+	Error       *acme.Error              `json:"error"`
+	History     []*acme.ChallengeAttempt `json:"history,omitempty"`
 }
 
 func (dbc *dbChallenge) clone() *dbChallenge {
@@ -28,6 +29,9 @@ func (dbc *dbChallenge) clone() *dbChallenge {
 }
 
 func (db *DB) getDBChallenge(ctx context.Context, id string) (*dbChallenge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	data, err := db.db.Get(challengeTable, []byte(id))
 	if nosql.IsErrNotFound(err) {
 		return nil, acme.NewError(acme.ErrorMalformedType, "challenge %s not found", id)
@@ -81,6 +85,7 @@ func (db *DB) GetChallenge(ctx context.Context, id, authzID string) (*acme.Chall
 		Token:       dbch.Token,
 		Error:       dbch.Error,
 		ValidatedAt: dbch.ValidatedAt,
+		History:     dbch.History,
 	}
 	return ch, nil
 }
@@ -98,6 +103,7 @@ func (db *DB) UpdateChallenge(ctx context.Context, ch *acme.Challenge) error {
 	nu.Status = ch.Status
 	nu.Error = ch.Error
 	nu.ValidatedAt = ch.ValidatedAt
+	nu.History = ch.History
 
 	return db.save(ctx, old.ID, nu, old, "challenge", challengeTable)
 }
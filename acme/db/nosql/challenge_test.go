@@ -458,3 +458,45 @@ func TestDB_UpdateChallenge(t *testing.T) {
 		})
 	}
 }
+
+func TestDB_UpdateChallenge_history(t *testing.T) {
+	dbc := &dbChallenge{
+		ID:        "chID",
+		AccountID: "accountID",
+		Type:      "http-01",
+		Status:    acme.StatusPending,
+		Token:     "token",
+		Value:     "test.ca.smallstep.com",
+		CreatedAt: clock.Now(),
+	}
+	b, err := json.Marshal(dbc)
+	assert.FatalError(t, err)
+	d := DB{db: memoryNoSQLDB(map[string]map[string][]byte{
+		string(challengeTable): {"chID": b},
+	})}
+
+	now := clock.Now().Truncate(time.Second)
+	attempts := []*acme.ChallengeAttempt{
+		{AttemptedAt: now, Status: acme.StatusPending, Error: "connection refused", RemoteAddr: "test.ca.smallstep.com"},
+		{AttemptedAt: now.Add(time.Minute), Status: acme.StatusPending, Error: "connection reset", RemoteAddr: "test.ca.smallstep.com"},
+	}
+	ctx := context.Background()
+	for i := range attempts {
+		ch, err := d.GetChallenge(ctx, "chID", "azID")
+		assert.FatalError(t, err)
+		assert.Equals(t, len(ch.History), i)
+		ch.History = append(ch.History, attempts[i])
+		assert.FatalError(t, d.UpdateChallenge(ctx, ch))
+	}
+
+	ch, err := d.GetChallenge(ctx, "chID", "azID")
+	assert.FatalError(t, err)
+	if assert.Equals(t, len(ch.History), 2) {
+		for i, a := range ch.History {
+			assert.True(t, a.AttemptedAt.Equal(attempts[i].AttemptedAt))
+			assert.Equals(t, a.Status, attempts[i].Status)
+			assert.Equals(t, a.Error, attempts[i].Error)
+			assert.Equals(t, a.RemoteAddr, attempts[i].RemoteAddr)
+		}
+	}
+}
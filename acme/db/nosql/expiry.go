@@ -0,0 +1,342 @@
+package nosql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// The objects are indexed by the minute they can be deleted, and each minute
+// is split in shards so the concurrent writes rarely conflict and every entry
+// of the index stays small.
+const (
+	expiryBucketSize = time.Minute
+	expiryShards     = 16
+)
+
+// dbExpiryIndex is the sorted list of buckets that contain objects in the
+// expiry index of a table. Indexed is set once the objects stored before the
+// index existed have been added to it.
+type dbExpiryIndex struct {
+	Buckets []int64 `json:"buckets"`
+	Indexed bool    `json:"indexed"`
+}
+
+// expiryIndex indexes the objects of a table by the time they can be deleted,
+// so the GC does not need to load the whole table to find them. indexTime
+// returns the ID of a stored object and the time it can be deleted, or false
+// if the object must never be deleted.
+type expiryIndex struct {
+	name      string
+	table     []byte
+	indexTime func(key, value []byte) (string, time.Time, bool, error)
+}
+
+// deleteExpiredFunc returns the operations that delete the given expired
+// objects, skipping the ones that must be kept, and the number of objects
+// deleted.
+type deleteExpiredFunc func(ctx context.Context, entries []*database.Entry) ([]*database.TxEntry, int, error)
+
+func expiryBucket(t time.Time) int64 {
+	return t.Truncate(expiryBucketSize).Unix()
+}
+
+func expiryKey(name string, bucket int64, shard uint32) []byte {
+	return []byte(fmt.Sprintf("%s/%d/%d", name, bucket, shard))
+}
+
+func expiryShard(id string) uint32 {
+	return crc32.ChecksumIEEE([]byte(id)) % expiryShards
+}
+
+// getExpiryIndex returns the list of buckets of the index and its stored
+// representation, nil if the index does not exist.
+func (db *DB) getExpiryIndex(ctx context.Context, idx *expiryIndex) (*dbExpiryIndex, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	b, err := db.db.Get(expiryIndexTable, []byte(idx.name))
+	if nosql.IsErrNotFound(err) {
+		return new(dbExpiryIndex), nil, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "error loading %s expiry index", idx.name)
+	}
+	ei := new(dbExpiryIndex)
+	if err := json.Unmarshal(b, ei); err != nil {
+		return nil, nil, errors.Wrapf(err, "error unmarshaling %s expiry index", idx.name)
+	}
+	return ei, b, nil
+}
+
+// updateExpiryIndex changes the list of buckets of the index using fn, that
+// returns false if there is nothing to change. It's retried if the index is
+// updated concurrently.
+func (db *DB) updateExpiryIndex(ctx context.Context, idx *expiryIndex, fn func(ei *dbExpiryIndex) bool) error {
+	for {
+		ei, old, err := db.getExpiryIndex(ctx, idx)
+		if err != nil {
+			return err
+		}
+		if !fn(ei) {
+			return nil
+		}
+		nu, err := json.Marshal(ei)
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling %s expiry index", idx.name)
+		}
+		_, swapped, err := db.db.CmpAndSwap(expiryIndexTable, []byte(idx.name), old, nu)
+		if err != nil {
+			return errors.Wrapf(err, "error saving %s expiry index", idx.name)
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// getExpiryIDs returns the IDs stored in the given key of the index and its
+// stored representation, nil if the key does not exist.
+func (db *DB) getExpiryIDs(ctx context.Context, key []byte) ([]string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	b, err := db.db.Get(expiryIndexTable, key)
+	if nosql.IsErrNotFound(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "error loading expiry index %s", key)
+	}
+	var ids []string
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil, nil, errors.Wrapf(err, "error unmarshaling expiry index %s", key)
+	}
+	return ids, b, nil
+}
+
+// addExpiryBuckets adds the given buckets to the index.
+func (db *DB) addExpiryBuckets(ctx context.Context, idx *expiryIndex, buckets ...int64) error {
+	return db.updateExpiryIndex(ctx, idx, func(ei *dbExpiryIndex) bool {
+		n := len(ei.Buckets)
+		for _, bucket := range buckets {
+			i := sort.Search(len(ei.Buckets), func(i int) bool { return ei.Buckets[i] >= bucket })
+			if i == len(ei.Buckets) || ei.Buckets[i] != bucket {
+				ei.Buckets = append(ei.Buckets, 0)
+				copy(ei.Buckets[i+1:], ei.Buckets[i:])
+				ei.Buckets[i] = bucket
+			}
+		}
+		return len(ei.Buckets) != n
+	})
+}
+
+// addExpiryIDs adds the objects with the given IDs to a bucket of the index.
+// The bucket must have been added with addExpiryBuckets first, so the GC
+// never misses the objects of a bucket.
+func (db *DB) addExpiryIDs(ctx context.Context, idx *expiryIndex, bucket int64, ids ...string) error {
+	shards := make(map[uint32][]string)
+	for _, id := range ids {
+		shard := expiryShard(id)
+		shards[shard] = append(shards[shard], id)
+	}
+	for shard, ids := range shards {
+		key := expiryKey(idx.name, bucket, shard)
+		for {
+			cur, old, err := db.getExpiryIDs(ctx, key)
+			if err != nil {
+				return err
+			}
+			seen := make(map[string]bool, len(cur))
+			for _, id := range cur {
+				seen[id] = true
+			}
+			nu := cur
+			for _, id := range ids {
+				if !seen[id] {
+					seen[id] = true
+					nu = append(nu, id)
+				}
+			}
+			if len(nu) == len(cur) {
+				break
+			}
+			b, err := json.Marshal(nu)
+			if err != nil {
+				return errors.Wrapf(err, "error marshaling expiry index %s", key)
+			}
+			_, swapped, err := db.db.CmpAndSwap(expiryIndexTable, key, old, b)
+			if err != nil {
+				return errors.Wrapf(err, "error saving expiry index %s", key)
+			}
+			if swapped {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// indexExpiry adds a new object to the index. Objects are indexed before they
+// are stored, so an object is never stored without being indexed.
+func (db *DB) indexExpiry(ctx context.Context, idx *expiryIndex, id string, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	bucket := expiryBucket(t)
+	if err := db.addExpiryBuckets(ctx, idx, bucket); err != nil {
+		return err
+	}
+	return db.addExpiryIDs(ctx, idx, bucket, id)
+}
+
+// loadExpiryIndex returns the list of buckets of the index. The first time
+// it's called, the objects stored before the index existed are added to it,
+// which requires loading the whole table once.
+func (db *DB) loadExpiryIndex(ctx context.Context, idx *expiryIndex) (*dbExpiryIndex, error) {
+	ei, _, err := db.getExpiryIndex(ctx, idx)
+	if err != nil || ei.Indexed {
+		return ei, err
+	}
+
+	entries, err := db.db.List(idx.table)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading %s", idx.name)
+	}
+	idsByBucket := make(map[int64][]string)
+	for _, e := range entries {
+		id, t, ok, err := idx.indexTime(e.Key, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !t.IsZero() {
+			bucket := expiryBucket(t)
+			idsByBucket[bucket] = append(idsByBucket[bucket], id)
+		}
+	}
+	buckets := make([]int64, 0, len(idsByBucket))
+	for bucket := range idsByBucket {
+		buckets = append(buckets, bucket)
+	}
+	if err := db.addExpiryBuckets(ctx, idx, buckets...); err != nil {
+		return nil, err
+	}
+	for bucket, ids := range idsByBucket {
+		if err := db.addExpiryIDs(ctx, idx, bucket, ids...); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.updateExpiryIndex(ctx, idx, func(ei *dbExpiryIndex) bool {
+		ei.Indexed = true
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	ei, _, err = db.getExpiryIndex(ctx, idx)
+	return ei, err
+}
+
+// expiryIDsOp returns the operation that replaces the IDs stored in the given
+// key of the index, the key is deleted if there are no IDs left.
+func expiryIDsOp(key []byte, ids []string) (*database.TxEntry, error) {
+	if len(ids) == 0 {
+		return deleteOp(expiryIndexTable, key), nil
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error marshaling expiry index %s", key)
+	}
+	return &database.TxEntry{
+		Bucket: expiryIndexTable,
+		Key:    key,
+		Value:  b,
+		Cmd:    database.Set,
+	}, nil
+}
+
+// deleteExpired deletes up to limit objects of the index in the buckets that
+// ended before the given time, and returns the number of deleted objects. The
+// objects are deleted in chunks of at most limit objects, and each chunk is
+// removed from the index in the same transaction that deletes it.
+func (db *DB) deleteExpired(ctx context.Context, idx *expiryIndex, before time.Time, limit int, fn deleteExpiredFunc) (int, error) {
+	ei, err := db.loadExpiryIndex(ctx, idx)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		n    int
+		done []int64
+	)
+	for _, bucket := range ei.Buckets {
+		if n == limit || time.Unix(bucket, 0).Add(expiryBucketSize).After(before) {
+			break
+		}
+		empty := true
+		for shard := uint32(0); shard < expiryShards && empty; shard++ {
+			key := expiryKey(idx.name, bucket, shard)
+			ids, _, err := db.getExpiryIDs(ctx, key)
+			if err != nil {
+				return 0, err
+			}
+			for len(ids) > 0 && n < limit {
+				chunk := ids
+				if len(chunk) > limit-n {
+					chunk = chunk[:limit-n]
+				}
+				ids = ids[len(chunk):]
+
+				// Objects already deleted are just removed from the index.
+				var entries []*database.Entry
+				for _, id := range chunk {
+					b, err := db.db.Get(idx.table, []byte(id))
+					if nosql.IsErrNotFound(err) {
+						continue
+					} else if err != nil {
+						return 0, errors.Wrapf(err, "error loading %s %s", idx.name, id)
+					}
+					entries = append(entries, &database.Entry{Bucket: idx.table, Key: []byte(id), Value: b})
+				}
+				ops, deleted, err := fn(ctx, entries)
+				if err != nil {
+					return 0, err
+				}
+				op, err := expiryIDsOp(key, ids)
+				if err != nil {
+					return 0, err
+				}
+				if err := db.db.Update(&database.Tx{Operations: append(ops, op)}); err != nil {
+					return 0, errors.Wrapf(err, "error deleting expired %s", idx.name)
+				}
+				n += deleted
+			}
+			empty = len(ids) == 0
+		}
+		if !empty {
+			break
+		}
+		done = append(done, bucket)
+	}
+
+	if len(done) > 0 {
+		if err := db.updateExpiryIndex(ctx, idx, func(ei *dbExpiryIndex) bool {
+			var buckets []int64
+			for _, bucket := range ei.Buckets {
+				if i := sort.Search(len(done), func(i int) bool { return done[i] >= bucket }); i == len(done) || done[i] != bucket {
+					buckets = append(buckets, bucket)
+				}
+			}
+			changed := len(buckets) != len(ei.Buckets)
+			ei.Buckets = buckets
+			return changed
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
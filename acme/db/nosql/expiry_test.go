@@ -0,0 +1,180 @@
+package nosql
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// expiryIDs returns all the IDs stored in a bucket of the index.
+func expiryIDs(t *testing.T, data map[string]map[string][]byte, name string, bucket int64) []string {
+	t.Helper()
+	var ids []string
+	for shard := uint32(0); shard < expiryShards; shard++ {
+		if b, ok := data[string(expiryIndexTable)][string(expiryKey(name, bucket, shard))]; ok {
+			var shardIDs []string
+			assert.FatalError(t, json.Unmarshal(b, &shardIDs))
+			ids = append(ids, shardIDs...)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDB_indexExpiry(t *testing.T) {
+	now := clock.Now().Truncate(time.Minute)
+	data := map[string]map[string][]byte{}
+	d := DB{db: memoryNoSQLDB(data)}
+	ctx := context.Background()
+
+	assert.FatalError(t, d.indexExpiry(ctx, nonceExpiryIndex, "n1", now.Add(time.Minute)))
+	assert.FatalError(t, d.indexExpiry(ctx, nonceExpiryIndex, "n2", now.Add(30*time.Second)))
+	assert.FatalError(t, d.indexExpiry(ctx, nonceExpiryIndex, "n3", now))
+	assert.FatalError(t, d.indexExpiry(ctx, nonceExpiryIndex, "n3", now))
+	assert.FatalError(t, d.indexExpiry(ctx, nonceExpiryIndex, "n4", time.Time{}))
+
+	ei := new(dbExpiryIndex)
+	assert.FatalError(t, json.Unmarshal(data[string(expiryIndexTable)]["nonces"], ei))
+	assert.Equals(t, ei.Buckets, []int64{now.Unix(), now.Add(time.Minute).Unix()})
+	assert.False(t, ei.Indexed)
+	assert.Equals(t, expiryIDs(t, data, "nonces", now.Unix()), []string{"n2", "n3"})
+	assert.Equals(t, expiryIDs(t, data, "nonces", now.Add(time.Minute).Unix()), []string{"n1"})
+}
+
+func TestDB_deleteExpired(t *testing.T) {
+	now := clock.Now().Truncate(time.Minute)
+	before := now.Add(-time.Hour)
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		nonces := map[string]time.Time{
+			"n1": now.Add(-3 * time.Hour),
+			"n2": now.Add(-150 * time.Minute),
+			"n3": now.Add(-2 * time.Hour),
+			"n4": now,
+		}
+		data := map[string]map[string][]byte{string(nonceTable): {}}
+		for id, createdAt := range nonces {
+			b, err := json.Marshal(&dbNonce{ID: id, CreatedAt: createdAt})
+			assert.FatalError(t, err)
+			data[string(nonceTable)][id] = b
+		}
+		return data
+	}
+	deleteAll := func(ctx context.Context, entries []*database.Entry) ([]*database.TxEntry, int, error) {
+		ops := make([]*database.TxEntry, len(entries))
+		for i, e := range entries {
+			ops[i] = deleteOp(nonceTable, e.Key)
+		}
+		return ops, len(ops), nil
+	}
+	type test struct {
+		db        nosql.DB
+		data      map[string]map[string][]byte
+		limit     int
+		n         int
+		remaining []string
+		buckets   []int64
+		indexed   []string
+		err       error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.Get-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, expiryIndexTable)
+						assert.Equals(t, string(key), "nonces")
+						return nil, errors.New("force")
+					},
+				},
+				limit: 10,
+				err:   errors.New("error loading nonces expiry index: force"),
+			}
+		},
+		"ok/bootstrap": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:        memoryNoSQLDB(data),
+				data:      data,
+				limit:     10,
+				n:         3,
+				remaining: []string{"n4"},
+				buckets:   []int64{now.Unix()},
+				indexed:   []string{"n4"},
+			}
+		},
+		"ok/limit": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:        memoryNoSQLDB(data),
+				data:      data,
+				limit:     1,
+				n:         1,
+				remaining: []string{"n2", "n3", "n4"},
+				buckets:   []int64{now.Add(-150 * time.Minute).Unix(), now.Add(-2 * time.Hour).Unix(), now.Unix()},
+				indexed:   []string{"n2", "n3", "n4"},
+			}
+		},
+		"ok/indexed": func(t *testing.T) test {
+			data := newData(t)
+			mdb := memoryNoSQLDB(data)
+			d := DB{db: mdb}
+			assert.FatalError(t, d.indexExpiry(context.Background(), nonceExpiryIndex, "n3", now.Add(-2*time.Hour)))
+			assert.FatalError(t, d.updateExpiryIndex(context.Background(), nonceExpiryIndex, func(ei *dbExpiryIndex) bool {
+				ei.Indexed = true
+				return true
+			}))
+			// The objects are found using the index only.
+			mdb.MList = func(bucket []byte) ([]*database.Entry, error) {
+				return nil, errors.New("force")
+			}
+			return test{
+				db:        mdb,
+				data:      data,
+				limit:     10,
+				n:         1,
+				remaining: []string{"n1", "n2", "n4"},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			n, err := d.deleteExpired(context.Background(), nonceExpiryIndex, before, tc.limit, deleteAll)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			assert.Equals(t, n, tc.n)
+
+			var remaining []string
+			for _, e := range mustList(t, memoryNoSQLDB(tc.data), nonceTable) {
+				remaining = append(remaining, string(e.Key))
+			}
+			assert.Equals(t, remaining, tc.remaining)
+
+			// The buckets that have been emptied are removed from the index.
+			ei := new(dbExpiryIndex)
+			assert.FatalError(t, json.Unmarshal(tc.data[string(expiryIndexTable)]["nonces"], ei))
+			assert.True(t, ei.Indexed)
+			assert.Equals(t, ei.Buckets, tc.buckets)
+			var ids []string
+			for _, bucket := range ei.Buckets {
+				ids = append(ids, expiryIDs(t, tc.data, "nonces", bucket)...)
+			}
+			sort.Strings(ids)
+			assert.Equals(t, ids, tc.indexed)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package nosql
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,10 +19,23 @@ type dbNonce struct {
 	DeletedAt time.Time
 }
 
+// nonceExpiryIndex indexes the nonces by the time they are created.
+var nonceExpiryIndex = &expiryIndex{
+	name:  "nonces",
+	table: nonceTable,
+	indexTime: func(key, value []byte) (string, time.Time, bool, error) {
+		n := new(dbNonce)
+		if err := json.Unmarshal(value, n); err != nil {
+			return "", time.Time{}, false, errors.Wrapf(err, "error unmarshaling nonce %s into dbNonce", key)
+		}
+		return n.ID, n.CreatedAt, true, nil
+	},
+}
+
 // CreateNonce creates, stores, and returns an ACME replay-nonce.
 // Implements the acme.DB interface.
 func (db *DB) CreateNonce(ctx context.Context) (acme.Nonce, error) {
-	_id, err := randID()
+	_id, err := db.nonceID()
 	if err != nil {
 		return "", err
 	}
@@ -31,8 +45,11 @@ func (db *DB) CreateNonce(ctx context.Context) (acme.Nonce, error) {
 		ID:        id,
 		CreatedAt: clock.Now(),
 	}
+	if err := db.indexExpiry(ctx, nonceExpiryIndex, id, n.CreatedAt); err != nil {
+		return "", wrapTransient(err)
+	}
 	if err := db.save(ctx, id, n, nil, "nonce", nonceTable); err != nil {
-		return "", err
+		return "", wrapTransient(err)
 	}
 	return acme.Nonce(id), nil
 }
@@ -40,6 +57,9 @@ func (db *DB) CreateNonce(ctx context.Context) (acme.Nonce, error) {
 // DeleteNonce verifies that the nonce is valid (by checking if it exists),
 // and if so, consumes the nonce resource by deleting it from the database.
 func (db *DB) DeleteNonce(ctx context.Context, nonce acme.Nonce) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	err := db.db.Update(&database.Tx{
 		Operations: []*database.TxEntry{
 			{
@@ -59,8 +79,21 @@ func (db *DB) DeleteNonce(ctx context.Context, nonce acme.Nonce) error {
 	case nosql.IsErrNotFound(err):
 		return acme.NewError(acme.ErrorBadNonceType, "nonce %s not found", string(nonce))
 	case err != nil:
-		return errors.Wrapf(err, "error deleting nonce %s", string(nonce))
+		return wrapTransient(errors.Wrapf(err, "error deleting nonce %s", string(nonce)))
 	default:
 		return nil
 	}
 }
+
+// DeleteExpiredNonces deletes up to limit nonces created before the given
+// time, and returns the number of deleted nonces. Implements the
+// acme.GarbageCollector interface.
+func (db *DB) DeleteExpiredNonces(ctx context.Context, before time.Time, limit int) (int, error) {
+	return db.deleteExpired(ctx, nonceExpiryIndex, before, limit, func(ctx context.Context, entries []*database.Entry) ([]*database.TxEntry, int, error) {
+		ops := make([]*database.TxEntry, len(entries))
+		for i, e := range entries {
+			ops[i] = deleteOp(nonceTable, e.Key)
+		}
+		return ops, len(ops), nil
+	})
+}
@@ -1,8 +1,10 @@
 package nosql
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	mathrand "math/rand"
 	"testing"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/db"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
 	"github.com/smallstep/nosql"
 	"github.com/smallstep/nosql/database"
 )
@@ -23,7 +26,7 @@ func TestDB_CreateNonce(t *testing.T) {
 	var tests = map[string]func(t *testing.T) test{
 		"fail/cmpAndSwap-error": func(t *testing.T) test {
 			return test{
-				db: &db.MockNoSQLDB{
+				db: withExpiryIndex(&db.MockNoSQLDB{
 					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
 						assert.Equals(t, bucket, nonceTable)
 						assert.Equals(t, old, nil)
@@ -35,10 +38,22 @@ func TestDB_CreateNonce(t *testing.T) {
 						assert.True(t, clock.Now().Add(time.Minute).After(dbn.CreatedAt))
 						return nil, false, errors.New("force")
 					},
-				},
+				}),
 				err: errors.New("error saving acme nonce: force"),
 			}
 		},
+		"fail/expiry-index-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, expiryIndexTable)
+						assert.Equals(t, string(key), "nonces")
+						return nil, errors.New("force")
+					},
+				},
+				err: errors.New("error loading nonces expiry index: force"),
+			}
+		},
 		"ok": func(t *testing.T) test {
 			var (
 				id    string
@@ -46,7 +61,7 @@ func TestDB_CreateNonce(t *testing.T) {
 			)
 
 			return test{
-				db: &db.MockNoSQLDB{
+				db: withExpiryIndex(&db.MockNoSQLDB{
 					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
 						*idPtr = string(key)
 						assert.Equals(t, bucket, nonceTable)
@@ -59,7 +74,7 @@ func TestDB_CreateNonce(t *testing.T) {
 						assert.True(t, clock.Now().Add(time.Minute).After(dbn.CreatedAt))
 						return nil, true, nil
 					},
-				},
+				}),
 				_id: idPtr,
 			}
 		},
@@ -81,6 +96,35 @@ func TestDB_CreateNonce(t *testing.T) {
 	}
 }
 
+func TestDB_CreateNonce_randomSource(t *testing.T) {
+	newDB := func() *DB {
+		d := &DB{db: withExpiryIndex(&db.MockNoSQLDB{
+			MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+				return nil, true, nil
+			},
+		})}
+		d.SetRandomSource(mathrand.New(mathrand.NewSource(1)))
+		return d
+	}
+
+	// The same seed generates the same nonces.
+	d1, d2 := newDB(), newDB()
+	for i := 0; i < 3; i++ {
+		n1, err := d1.CreateNonce(context.Background())
+		assert.FatalError(t, err)
+		n2, err := d2.CreateNonce(context.Background())
+		assert.FatalError(t, err)
+		assert.Equals(t, n1, n2)
+	}
+
+	d := &DB{db: &db.MockNoSQLDB{}}
+	d.SetRandomSource(bytes.NewReader(nil))
+	_, err := d.CreateNonce(context.Background())
+	if assert.NotNil(t, err) {
+		assert.HasPrefix(t, err.Error(), "error generating random ID")
+	}
+}
+
 func TestDB_DeleteNonce(t *testing.T) {
 
 	nonceID := "nonceID"
@@ -166,3 +210,119 @@ func TestDB_DeleteNonce(t *testing.T) {
 		})
 	}
 }
+
+func TestDB_DeleteNonce_transient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"badger-conflict", errors.Wrap(errors.New(errBadgerConflict), "failed to commit badger transaction"), true},
+		{"other", errors.New("force"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := DB{db: &db.MockNoSQLDB{
+				MUpdate: func(tx *database.Tx) error {
+					return tt.err
+				},
+			}}
+			err := d.DeleteNonce(context.Background(), acme.Nonce("nonceID"))
+			if assert.NotNil(t, err) {
+				assert.Equals(t, kmsapi.IsTransient(err), tt.want)
+				assert.HasPrefix(t, err.Error(), "error deleting nonce nonceID: ")
+			}
+		})
+	}
+}
+
+func TestDB_DeleteExpiredNonces(t *testing.T) {
+	now := clock.Now().Truncate(time.Second)
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		nonces := map[string]time.Time{
+			"n1": now.Add(-3 * time.Hour),
+			"n2": now.Add(-2 * time.Hour),
+			"n3": now,
+		}
+		data := map[string]map[string][]byte{string(nonceTable): {}}
+		for id, createdAt := range nonces {
+			b, err := json.Marshal(&dbNonce{ID: id, CreatedAt: createdAt})
+			assert.FatalError(t, err)
+			data[string(nonceTable)][id] = b
+		}
+		return data
+	}
+	type test struct {
+		db        nosql.DB
+		limit     int
+		n         int
+		remaining []string
+		err       error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.List-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, expiryIndexTable)
+						return nil, database.ErrNotFound
+					},
+					MList: func(bucket []byte) ([]*database.Entry, error) {
+						assert.Equals(t, bucket, nonceTable)
+						return nil, errors.New("force")
+					},
+				},
+				limit: 10,
+				err:   errors.New("error loading nonces: force"),
+			}
+		},
+		"fail/db.Update-error": func(t *testing.T) test {
+			mdb := memoryNoSQLDB(newData(t))
+			mdb.MUpdate = func(tx *database.Tx) error {
+				return errors.New("force")
+			}
+			return test{
+				db:    mdb,
+				limit: 10,
+				err:   errors.New("error deleting expired nonces: force"),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			return test{
+				db:        memoryNoSQLDB(newData(t)),
+				limit:     10,
+				n:         2,
+				remaining: []string{"n3"},
+			}
+		},
+		"ok/limit": func(t *testing.T) test {
+			return test{
+				db:        memoryNoSQLDB(newData(t)),
+				limit:     1,
+				n:         1,
+				remaining: []string{"n2", "n3"},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			n, err := d.DeleteExpiredNonces(context.Background(), now.Add(-time.Hour), tc.limit)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			assert.Equals(t, n, tc.n)
+
+			var remaining []string
+			for _, e := range mustList(t, tc.db, nonceTable) {
+				remaining = append(remaining, string(e.Key))
+			}
+			assert.Equals(t, remaining, tc.remaining)
+		})
+	}
+}
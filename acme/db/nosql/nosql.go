@@ -2,41 +2,59 @@ package nosql
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"time"
 
 	"github.com/pkg/errors"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
 	nosqlDB "github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 	"go.step.sm/crypto/randutil"
 )
 
 var (
-	accountTable           = []byte("acme_accounts")
-	accountByKeyIDTable    = []byte("acme_keyID_accountID_index")
-	authzTable             = []byte("acme_authzs")
-	challengeTable         = []byte("acme_challenges")
-	nonceTable             = []byte("nonces")
-	orderTable             = []byte("acme_orders")
-	ordersByAccountIDTable = []byte("acme_account_orders_index")
-	certTable              = []byte("acme_certs")
+	accountTable               = []byte("acme_accounts")
+	accountByKeyIDTable        = []byte("acme_keyID_accountID_index")
+	authzTable                 = []byte("acme_authzs")
+	challengeTable             = []byte("acme_challenges")
+	nonceTable                 = []byte("nonces")
+	orderTable                 = []byte("acme_orders")
+	ordersByAccountIDTable     = []byte("acme_account_orders_index")
+	authzsByAccountIDTable     = []byte("acme_account_authzs_index")
+	certTable                  = []byte("acme_certs")
+	orderCountByAccountIDTable = []byte("acme_account_order_counts")
+	expiryIndexTable           = []byte("acme_expiry_index")
+	ordersByIdentifiersTable   = []byte("acme_identifiers_orders_index")
 )
 
 // DB is a struct that implements the AcmeDB interface.
 type DB struct {
-	db nosqlDB.DB
+	db           nosqlDB.DB
+	randomSource io.Reader
+}
+
+// SetRandomSource sets the source of randomness used to generate the nonces,
+// crypto/rand is used by default. It implements the acme.RandomSourceSetter
+// interface.
+func (db *DB) SetRandomSource(r io.Reader) {
+	db.randomSource = r
 }
 
 // New configures and returns a new ACME DB backend implemented using a nosql DB.
 func New(db nosqlDB.DB) (*DB, error) {
 	tables := [][]byte{accountTable, accountByKeyIDTable, authzTable,
-		challengeTable, nonceTable, orderTable, ordersByAccountIDTable, certTable}
+		challengeTable, nonceTable, orderTable, ordersByAccountIDTable,
+		authzsByAccountIDTable, certTable, orderCountByAccountIDTable,
+		expiryIndexTable, ordersByIdentifiersTable}
 	for _, b := range tables {
 		if err := db.CreateTable(b); err != nil {
 			return nil, errors.Wrapf(err, "error creating table %s",
 				string(b))
 		}
 	}
-	return &DB{db}, nil
+	return &DB{db: db}, nil
 }
 
 // save writes the new data to the database, overwriting the old data if it
@@ -64,6 +82,12 @@ func (db *DB) save(ctx context.Context, id string, nu, old interface{}, typ stri
 		}
 	}
 
+	// The nosql drivers do not support contexts, so we can only abort the
+	// operation if the context is done before writing.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	_, swapped, err := db.db.CmpAndSwap(table, []byte(id), oldB, newB)
 	switch {
 	case err != nil:
@@ -75,6 +99,15 @@ func (db *DB) save(ctx context.Context, id string, nu, old interface{}, typ stri
 	}
 }
 
+// deleteOp returns the operation used to delete a key in a transaction.
+func deleteOp(table, key []byte) *database.TxEntry {
+	return &database.TxEntry{
+		Bucket: table,
+		Key:    key,
+		Cmd:    database.Delete,
+	}
+}
+
 var idLen = 32
 
 func randID() (val string, err error) {
@@ -85,6 +118,19 @@ func randID() (val string, err error) {
 	return val, nil
 }
 
+// nonceID returns a random id for a nonce, read from the random source of the
+// DB if it's set.
+func (db *DB) nonceID() (string, error) {
+	if db.randomSource == nil {
+		return randID()
+	}
+	b := make([]byte, idLen/2)
+	if _, err := io.ReadFull(db.randomSource, b); err != nil {
+		return "", errors.Wrap(err, "error generating random ID")
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // Clock that returns time in UTC rounded to seconds.
 type Clock struct{}
 
@@ -94,3 +140,20 @@ func (c *Clock) Now() time.Time {
 }
 
 var clock = new(Clock)
+
+// errBadgerConflict is the message of the ErrConflict of both badger versions.
+// The error is matched by its message so the badger packages are not linked in
+// the builds without them.
+const errBadgerConflict = "Transaction Conflict. Please retry"
+
+// wrapTransient marks the transaction conflicts of the badger databases,
+// caused by concurrent transactions, as apiv1.ErrTransient so they can be
+// retried.
+func wrapTransient(err error) error {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if e.Error() == errBadgerConflict {
+			return kmsapi.ErrTransient{Err: err}
+		}
+	}
+	return err
+}
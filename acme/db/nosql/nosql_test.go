@@ -1,13 +1,19 @@
 package nosql
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"sort"
 	"testing"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+	"go.step.sm/crypto/jose"
 )
 
 func TestNew(t *testing.T) {
@@ -137,3 +143,204 @@ func TestDB_save(t *testing.T) {
 		})
 	}
 }
+
+func TestDB_canceledContext(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+
+	// Any call to the underlying database fails the test, the operations
+	// must return before reaching it.
+	fail := func(name string) {
+		t.Errorf("unexpected call to %s with a canceled context", name)
+	}
+	d := &DB{db: &db.MockNoSQLDB{
+		MGet: func(bucket, key []byte) ([]byte, error) {
+			fail("Get")
+			return nil, errors.New("force")
+		},
+		MDel: func(bucket, key []byte) error {
+			fail("Del")
+			return errors.New("force")
+		},
+		MUpdate: func(tx *database.Tx) error {
+			fail("Update")
+			return errors.New("force")
+		},
+		MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+			fail("CmpAndSwap")
+			return nil, false, errors.New("force")
+		},
+	}}
+
+	tests := map[string]func(ctx context.Context) error{
+		"CreateAccount": func(ctx context.Context) error {
+			return d.CreateAccount(ctx, &acme.Account{Key: jwk, Status: acme.StatusValid})
+		},
+		"GetAccount": func(ctx context.Context) error {
+			_, err := d.GetAccount(ctx, "accID")
+			return err
+		},
+		"GetAccountByKeyID": func(ctx context.Context) error {
+			_, err := d.GetAccountByKeyID(ctx, "kid")
+			return err
+		},
+		"UpdateAccount": func(ctx context.Context) error {
+			return d.UpdateAccount(ctx, &acme.Account{ID: "accID"})
+		},
+		"CreateNonce": func(ctx context.Context) error {
+			_, err := d.CreateNonce(ctx)
+			return err
+		},
+		"DeleteNonce": func(ctx context.Context) error {
+			return d.DeleteNonce(ctx, acme.Nonce("nonce"))
+		},
+		"CreateAuthorization": func(ctx context.Context) error {
+			return d.CreateAuthorization(ctx, &acme.Authorization{AccountID: "accID"})
+		},
+		"GetAuthorization": func(ctx context.Context) error {
+			_, err := d.GetAuthorization(ctx, "azID")
+			return err
+		},
+		"DeleteAuthorizations": func(ctx context.Context) error {
+			return d.DeleteAuthorizations(ctx, []*acme.Authorization{{ID: "azID", AccountID: "accID"}})
+		},
+		"GetAuthorizationsByAccountID": func(ctx context.Context) error {
+			_, err := d.GetAuthorizationsByAccountID(ctx, "accID")
+			return err
+		},
+		"CreateChallenge": func(ctx context.Context) error {
+			return d.CreateChallenge(ctx, &acme.Challenge{AccountID: "accID"})
+		},
+		"GetChallenge": func(ctx context.Context) error {
+			_, err := d.GetChallenge(ctx, "chID", "azID")
+			return err
+		},
+		"UpdateChallenge": func(ctx context.Context) error {
+			return d.UpdateChallenge(ctx, &acme.Challenge{ID: "chID"})
+		},
+		"CreateOrder": func(ctx context.Context) error {
+			return d.CreateOrder(ctx, &acme.Order{AccountID: "accID"})
+		},
+		"GetOrder": func(ctx context.Context) error {
+			_, err := d.GetOrder(ctx, "ordID")
+			return err
+		},
+		"GetOrdersByAccountID": func(ctx context.Context) error {
+			_, err := d.GetOrdersByAccountID(ctx, "accID")
+			return err
+		},
+		"UpdateOrder": func(ctx context.Context) error {
+			return d.UpdateOrder(ctx, &acme.Order{ID: "ordID"})
+		},
+		"CreateCertificate": func(ctx context.Context) error {
+			return d.CreateCertificate(ctx, &acme.Certificate{Leaf: &x509.Certificate{}})
+		},
+		"GetCertificate": func(ctx context.Context) error {
+			_, err := d.GetCertificate(ctx, "certID")
+			return err
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := run(ctx)
+			assert.True(t, errors.Is(err, context.Canceled))
+		})
+	}
+}
+
+// memoryNoSQLDB returns a mocked nosql.DB that keeps the data in memory, in
+// the given map of tables and keys.
+func memoryNoSQLDB(data map[string]map[string][]byte) *db.MockNoSQLDB {
+	return &db.MockNoSQLDB{
+		MGet: func(bucket, key []byte) ([]byte, error) {
+			if b, ok := data[string(bucket)][string(key)]; ok {
+				return b, nil
+			}
+			return nil, database.ErrNotFound
+		},
+		MList: func(bucket []byte) ([]*database.Entry, error) {
+			keys := make([]string, 0, len(data[string(bucket)]))
+			for k := range data[string(bucket)] {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			entries := make([]*database.Entry, len(keys))
+			for i, k := range keys {
+				entries[i] = &database.Entry{
+					Bucket: bucket,
+					Key:    []byte(k),
+					Value:  data[string(bucket)][k],
+				}
+			}
+			return entries, nil
+		},
+		MDel: func(bucket, key []byte) error {
+			delete(data[string(bucket)], string(key))
+			return nil
+		},
+		MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+			cur, ok := data[string(bucket)][string(key)]
+			if ok != (old != nil) || !bytes.Equal(cur, old) {
+				return cur, false, nil
+			}
+			if data[string(bucket)] == nil {
+				data[string(bucket)] = map[string][]byte{}
+			}
+			if nu == nil {
+				delete(data[string(bucket)], string(key))
+			} else {
+				data[string(bucket)][string(key)] = nu
+			}
+			return nu, true, nil
+		},
+		MUpdate: func(tx *database.Tx) error {
+			for _, op := range tx.Operations {
+				switch op.Cmd {
+				case database.Set:
+					if data[string(op.Bucket)] == nil {
+						data[string(op.Bucket)] = map[string][]byte{}
+					}
+					data[string(op.Bucket)][string(op.Key)] = op.Value
+				case database.Delete:
+					delete(data[string(op.Bucket)], string(op.Key))
+				default:
+					return errors.Errorf("unexpected command %v", op.Cmd)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// withExpiryIndex returns the given mock with the expiry index and the orders
+// by identifiers index kept in memory, so the tests of the other tables can
+// ignore them.
+func withExpiryIndex(m *db.MockNoSQLDB) *db.MockNoSQLDB {
+	mdb := *m
+	index := memoryNoSQLDB(map[string]map[string][]byte{})
+	isIndex := func(bucket []byte) bool {
+		return string(bucket) == string(expiryIndexTable) || string(bucket) == string(ordersByIdentifiersTable)
+	}
+	mdb.MGet = func(bucket, key []byte) ([]byte, error) {
+		if isIndex(bucket) {
+			return index.Get(bucket, key)
+		}
+		return m.Get(bucket, key)
+	}
+	mdb.MCmpAndSwap = func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+		if isIndex(bucket) {
+			return index.CmpAndSwap(bucket, key, old, nu)
+		}
+		return m.CmpAndSwap(bucket, key, old, nu)
+	}
+	return &mdb
+}
+
+func mustList(t *testing.T, d nosql.DB, bucket []byte) []*database.Entry {
+	t.Helper()
+	entries, err := d.List(bucket)
+	assert.FatalError(t, err)
+	return entries
+}
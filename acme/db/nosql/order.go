@@ -2,13 +2,18 @@ package nosql
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 )
 
 // Mutex for locking ordersByAccount index operations.
@@ -29,6 +34,20 @@ type dbOrder struct {
 	Error            *acme.Error       `json:"error,omitempty"`
 }
 
+// orderExpiryIndex indexes the orders by the time they expire. Finalized
+// orders are never deleted.
+var orderExpiryIndex = &expiryIndex{
+	name:  "orders",
+	table: orderTable,
+	indexTime: func(key, value []byte) (string, time.Time, bool, error) {
+		o := new(dbOrder)
+		if err := json.Unmarshal(value, o); err != nil {
+			return "", time.Time{}, false, errors.Wrapf(err, "error unmarshaling order %s into dbOrder", key)
+		}
+		return o.ID, o.ExpiresAt, o.Status != acme.StatusValid, nil
+	},
+}
+
 func (a *dbOrder) clone() *dbOrder {
 	b := *a
 	return &b
@@ -36,6 +55,9 @@ func (a *dbOrder) clone() *dbOrder {
 
 // getDBOrder retrieves and unmarshals an ACME Order type from the database.
 func (db *DB) getDBOrder(ctx context.Context, id string) (*dbOrder, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	b, err := db.db.Get(orderTable, []byte(id))
 	if nosql.IsErrNotFound(err) {
 		return nil, acme.NewError(acme.ErrorMalformedType, "order %s not found", id)
@@ -94,12 +116,26 @@ func (db *DB) CreateOrder(ctx context.Context, o *acme.Order) error {
 		NotAfter:         o.NotAfter,
 		AuthorizationIDs: o.AuthorizationIDs,
 	}
+	if err := db.indexExpiry(ctx, orderExpiryIndex, o.ID, o.ExpiresAt); err != nil {
+		return err
+	}
+	key, err := identifiersKey(o.AccountID, o.Identifiers)
+	if err != nil {
+		return err
+	}
+	if err := db.addOrderIDsByIdentifiers(ctx, key, o.ID); err != nil {
+		return err
+	}
 	if err := db.save(ctx, o.ID, dbo, nil, "order", orderTable); err != nil {
+		// Ignore error from removing the index -- we tried our best.
+		db.removeOrderIDsByIdentifiers(ctx, key, o.ID)
 		return err
 	}
 
 	_, err = db.updateAddOrderIDs(ctx, o.AccountID, o.ID)
 	if err != nil {
+		// The order has been deleted by updateAddOrderIDs.
+		db.removeOrderIDsByIdentifiers(ctx, key, o.ID)
 		return err
 	}
 	return nil
@@ -124,6 +160,10 @@ func (db *DB) updateAddOrderIDs(ctx context.Context, accID string, addOids ...st
 	ordersByAccountMux.Lock()
 	defer ordersByAccountMux.Unlock()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	var oldOids []string
 	b, err := db.db.Get(ordersByAccountIDTable, []byte(accID))
 	if err != nil {
@@ -185,3 +225,267 @@ func (db *DB) updateAddOrderIDs(ctx context.Context, accID string, addOids ...st
 func (db *DB) GetOrdersByAccountID(ctx context.Context, accID string) ([]string, error) {
 	return db.updateAddOrderIDs(ctx, accID)
 }
+
+// GetOrdersByIdentifiers returns the IDs of all the orders of an account with
+// the same set of identifiers as the given ones, in the order they were
+// created. The orders are looked up in the orders by identifiers index.
+func (db *DB) GetOrdersByIdentifiers(ctx context.Context, accID string, identifiers []acme.Identifier) ([]string, error) {
+	if err := db.loadOrdersByIdentifiersIndex(ctx); err != nil {
+		return nil, err
+	}
+	key, err := identifiersKey(accID, identifiers)
+	if err != nil {
+		return nil, err
+	}
+	oids, _, err := db.getOrderIDsByIdentifiers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return oids, nil
+}
+
+// ordersByIdentifiersIndexedKey is the key of the orders by identifiers index
+// that is set once the orders stored before the index existed have been added
+// to it. The other keys of the index always contain a slash.
+var ordersByIdentifiersIndexedKey = []byte("indexed")
+
+// identifiersKey returns the key of the orders by identifiers index for the
+// given account and set of identifiers. The identifiers are sorted and the
+// duplicates removed, so two sets with the same identifiers have the same key.
+func identifiersKey(accID string, identifiers []acme.Identifier) ([]byte, error) {
+	seen := make(map[acme.Identifier]bool, len(identifiers))
+	ids := make([]acme.Identifier, 0, len(identifiers))
+	for _, id := range identifiers {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Type != ids[j].Type {
+			return ids[i].Type < ids[j].Type
+		}
+		return ids[i].Value < ids[j].Value
+	})
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling order identifiers")
+	}
+	sum := sha256.Sum256(b)
+	return []byte(accID + "/" + hex.EncodeToString(sum[:])), nil
+}
+
+// getOrderIDsByIdentifiers returns the IDs stored in the given key of the
+// orders by identifiers index and its stored representation, nil if the key
+// does not exist.
+func (db *DB) getOrderIDsByIdentifiers(ctx context.Context, key []byte) ([]string, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	b, err := db.db.Get(ordersByIdentifiersTable, key)
+	if nosql.IsErrNotFound(err) {
+		return []string{}, nil, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "error loading orders by identifiers index %s", key)
+	}
+	var oids []string
+	if err := json.Unmarshal(b, &oids); err != nil {
+		return nil, nil, errors.Wrapf(err, "error unmarshaling orders by identifiers index %s", key)
+	}
+	return oids, b, nil
+}
+
+// updateOrderIDsByIdentifiers changes the IDs stored in the given key of the
+// orders by identifiers index using fn, that returns false if there is nothing
+// to change. It's retried if the key is updated concurrently.
+func (db *DB) updateOrderIDsByIdentifiers(ctx context.Context, key []byte, fn func(oids []string) ([]string, bool)) error {
+	for {
+		oids, old, err := db.getOrderIDsByIdentifiers(ctx, key)
+		if err != nil {
+			return err
+		}
+		oids, ok := fn(oids)
+		if !ok {
+			return nil
+		}
+		// An empty list is stored as an empty list, the nosql drivers store a
+		// nil value as an empty one, which is not valid JSON.
+		nu, err := json.Marshal(oids)
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling orders by identifiers index %s", key)
+		}
+		_, swapped, err := db.db.CmpAndSwap(ordersByIdentifiersTable, key, old, nu)
+		if err != nil {
+			return errors.Wrapf(err, "error saving orders by identifiers index %s", key)
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// addOrderIDsByIdentifiers adds the orders with the given IDs to a key of the
+// orders by identifiers index. Orders are indexed before they are stored, so
+// an order is never stored without being indexed.
+func (db *DB) addOrderIDsByIdentifiers(ctx context.Context, key []byte, addOids ...string) error {
+	return db.updateOrderIDsByIdentifiers(ctx, key, func(oids []string) ([]string, bool) {
+		seen := make(map[string]bool, len(oids))
+		for _, oid := range oids {
+			seen[oid] = true
+		}
+		n := len(oids)
+		for _, oid := range addOids {
+			if !seen[oid] {
+				seen[oid] = true
+				oids = append(oids, oid)
+			}
+		}
+		return oids, len(oids) != n
+	})
+}
+
+// removeOrderIDsByIdentifiers removes the orders with the given IDs from a key
+// of the orders by identifiers index.
+func (db *DB) removeOrderIDsByIdentifiers(ctx context.Context, key []byte, rmOids ...string) error {
+	rm := make(map[string]bool, len(rmOids))
+	for _, oid := range rmOids {
+		rm[oid] = true
+	}
+	return db.updateOrderIDsByIdentifiers(ctx, key, func(oids []string) ([]string, bool) {
+		keep := []string{}
+		for _, oid := range oids {
+			if !rm[oid] {
+				keep = append(keep, oid)
+			}
+		}
+		return keep, len(keep) != len(oids)
+	})
+}
+
+// loadOrdersByIdentifiersIndex adds the orders stored before the orders by
+// identifiers index existed to it. The first time it's called the whole table
+// of orders is loaded once, after that it only checks that it's done.
+func (db *DB) loadOrdersByIdentifiersIndex(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := db.db.Get(ordersByIdentifiersTable, ordersByIdentifiersIndexedKey)
+	if err == nil {
+		return nil
+	} else if !nosql.IsErrNotFound(err) {
+		return errors.Wrap(err, "error loading orders by identifiers index")
+	}
+
+	entries, err := db.db.List(orderTable)
+	if err != nil {
+		return errors.Wrap(err, "error loading orders")
+	}
+	var keys []string
+	oidsByKey := make(map[string][]string)
+	for _, e := range entries {
+		o := new(dbOrder)
+		if err := json.Unmarshal(e.Value, o); err != nil {
+			return errors.Wrapf(err, "error unmarshaling order %s into dbOrder", e.Key)
+		}
+		key, err := identifiersKey(o.AccountID, o.Identifiers)
+		if err != nil {
+			return err
+		}
+		if _, ok := oidsByKey[string(key)]; !ok {
+			keys = append(keys, string(key))
+		}
+		oidsByKey[string(key)] = append(oidsByKey[string(key)], o.ID)
+	}
+	for _, key := range keys {
+		if err := db.addOrderIDsByIdentifiers(ctx, []byte(key), oidsByKey[key]...); err != nil {
+			return err
+		}
+	}
+	// Another instance might have finished first.
+	if _, _, err := db.db.CmpAndSwap(ordersByIdentifiersTable, ordersByIdentifiersIndexedKey, nil, []byte("true")); err != nil {
+		return errors.Wrap(err, "error saving orders by identifiers index")
+	}
+	return nil
+}
+
+// IncrementOrderCount increments the number of orders created by the account
+// if it's lower than max, and returns false if it's not. The count is stored
+// in its own table, so it's kept when the orders are deleted.
+func (db *DB) IncrementOrderCount(ctx context.Context, accID string, max int) (bool, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		var count int
+		old, err := db.db.Get(orderCountByAccountIDTable, []byte(accID))
+		switch {
+		case nosql.IsErrNotFound(err):
+			old = nil
+		case err != nil:
+			return false, errors.Wrapf(err, "error loading order count for account %s", accID)
+		default:
+			if count, err = strconv.Atoi(string(old)); err != nil {
+				return false, errors.Wrapf(err, "error parsing order count for account %s", accID)
+			}
+		}
+		if count >= max {
+			return false, nil
+		}
+		// Retry if the count has been updated by a concurrent order.
+		_, swapped, err := db.db.CmpAndSwap(orderCountByAccountIDTable, []byte(accID), old, []byte(strconv.Itoa(count+1)))
+		switch {
+		case err != nil:
+			return false, errors.Wrapf(err, "error saving order count for account %s", accID)
+		case swapped:
+			return true, nil
+		}
+	}
+}
+
+// DeleteExpiredOrders deletes up to limit orders that expired before the given
+// time without being finalized, and returns the number of deleted orders.
+// Implements the acme.GarbageCollector interface.
+func (db *DB) DeleteExpiredOrders(ctx context.Context, before time.Time, limit int) (int, error) {
+	return db.deleteExpired(ctx, orderExpiryIndex, before, limit, func(ctx context.Context, entries []*database.Entry) ([]*database.TxEntry, int, error) {
+		var (
+			ops  []*database.TxEntry
+			keys []string
+		)
+		accIDs := make(map[string]bool)
+		oidsByKey := make(map[string][]string)
+		for _, e := range entries {
+			o := new(dbOrder)
+			if err := json.Unmarshal(e.Value, o); err != nil {
+				return nil, 0, errors.Wrapf(err, "error unmarshaling order %s into dbOrder", e.Key)
+			}
+			if o.Status == acme.StatusValid {
+				continue
+			}
+			ops = append(ops, deleteOp(orderTable, e.Key))
+			accIDs[o.AccountID] = true
+			key, err := identifiersKey(o.AccountID, o.Identifiers)
+			if err != nil {
+				return nil, 0, err
+			}
+			if _, ok := oidsByKey[string(key)]; !ok {
+				keys = append(keys, string(key))
+			}
+			oidsByKey[string(key)] = append(oidsByKey[string(key)], o.ID)
+		}
+
+		for _, key := range keys {
+			if err := db.removeOrderIDsByIdentifiers(ctx, []byte(key), oidsByKey[key]...); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		// Expired orders are no longer pending, so updating the index of the
+		// accounts removes them from it.
+		for accID := range accIDs {
+			if _, err := db.updateAddOrderIDs(ctx, accID); err != nil {
+				return nil, 0, err
+			}
+		}
+		return ops, len(ops), nil
+	})
+}
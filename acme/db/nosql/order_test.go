@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -406,7 +407,7 @@ func TestDB_CreateOrder(t *testing.T) {
 				AuthorizationIDs: []string{"foo", "bar"},
 			}
 			return test{
-				db: &db.MockNoSQLDB{
+				db: withExpiryIndex(&db.MockNoSQLDB{
 					MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
 						assert.Equals(t, string(bucket), string(orderTable))
 						assert.Equals(t, string(key), o.ID)
@@ -429,11 +430,24 @@ func TestDB_CreateOrder(t *testing.T) {
 						assert.Equals(t, dbo.Error, nil)
 						return nil, false, errors.New("force")
 					},
-				},
+				}),
 				o:   o,
 				err: errors.New("error saving acme order: force"),
 			}
 		},
+		"fail/expiry-index-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, expiryIndexTable)
+						assert.Equals(t, string(key), "orders")
+						return nil, errors.New("force")
+					},
+				},
+				o:   &acme.Order{AccountID: "accID", Status: acme.StatusPending, ExpiresAt: now},
+				err: errors.New("error loading orders expiry index: force"),
+			}
+		},
 		"fail/orderIDsByOrderUpdate-error": func(t *testing.T) test {
 			o := &acme.Order{
 				AccountID:     "accID",
@@ -450,7 +464,7 @@ func TestDB_CreateOrder(t *testing.T) {
 				AuthorizationIDs: []string{"foo", "bar"},
 			}
 			return test{
-				db: &db.MockNoSQLDB{
+				db: withExpiryIndex(&db.MockNoSQLDB{
 					MGet: func(bucket, key []byte) ([]byte, error) {
 						assert.Equals(t, string(bucket), string(ordersByAccountIDTable))
 						assert.Equals(t, string(key), o.AccountID)
@@ -478,7 +492,7 @@ func TestDB_CreateOrder(t *testing.T) {
 						assert.Equals(t, dbo.Error, nil)
 						return nu, true, nil
 					},
-				},
+				}),
 				o:   o,
 				err: errors.New("error loading orderIDs for account accID: force"),
 			}
@@ -503,7 +517,7 @@ func TestDB_CreateOrder(t *testing.T) {
 				AuthorizationIDs: []string{"foo", "bar"},
 			}
 			return test{
-				db: &db.MockNoSQLDB{
+				db: withExpiryIndex(&db.MockNoSQLDB{
 					MGet: func(bucket, key []byte) ([]byte, error) {
 						assert.Equals(t, string(bucket), string(ordersByAccountIDTable))
 						assert.Equals(t, string(key), o.AccountID)
@@ -544,7 +558,7 @@ func TestDB_CreateOrder(t *testing.T) {
 							return nil, false, errors.New("force")
 						}
 					},
-				},
+				}),
 				o:   o,
 				_id: idptr,
 			}
@@ -1023,3 +1037,398 @@ func TestDB_updateAddOrderIDs(t *testing.T) {
 		})
 	}
 }
+
+func TestDB_DeleteExpiredOrders(t *testing.T) {
+	now := clock.Now().Truncate(time.Second)
+	before := now.Add(-time.Hour)
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		orders := map[string]*dbOrder{
+			"o1": {ID: "o1", AccountID: "acc1", Status: acme.StatusPending, ExpiresAt: now.Add(-2 * time.Hour)},
+			"o2": {ID: "o2", AccountID: "acc1", Status: acme.StatusPending, ExpiresAt: now.Add(time.Hour)},
+			"o3": {ID: "o3", AccountID: "acc2", Status: acme.StatusInvalid, ExpiresAt: now.Add(-3 * time.Hour)},
+			"o4": {ID: "o4", AccountID: "acc2", Status: acme.StatusValid, ExpiresAt: now.Add(-2 * time.Hour)},
+			"o5": {ID: "o5", AccountID: "acc2", Status: acme.StatusPending, ExpiresAt: now.Add(-30 * time.Minute)},
+			"o6": {ID: "o6", AccountID: "acc2", Status: acme.StatusPending},
+		}
+		data := map[string]map[string][]byte{
+			string(orderTable):             {},
+			string(ordersByAccountIDTable): {},
+		}
+		for id, o := range orders {
+			b, err := json.Marshal(o)
+			assert.FatalError(t, err)
+			data[string(orderTable)][id] = b
+		}
+		b, err := json.Marshal([]string{"o1"})
+		assert.FatalError(t, err)
+		data[string(ordersByAccountIDTable)]["acc1"] = b
+		key, err := identifiersKey("acc1", nil)
+		assert.FatalError(t, err)
+		data[string(ordersByIdentifiersTable)] = map[string][]byte{
+			string(key): []byte(`["o1","o2"]`),
+		}
+		return data
+	}
+	type test struct {
+		db                  nosql.DB
+		data                map[string]map[string][]byte
+		limit               int
+		n                   int
+		remaining           []string
+		index               []string
+		ordersByIdentifiers []string
+		err                 error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.List-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, expiryIndexTable)
+						return nil, database.ErrNotFound
+					},
+					MList: func(bucket []byte) ([]*database.Entry, error) {
+						assert.Equals(t, bucket, orderTable)
+						return nil, errors.New("force")
+					},
+				},
+				limit: 10,
+				err:   errors.New("error loading orders: force"),
+			}
+		},
+		"fail/db.Update-error": func(t *testing.T) test {
+			data := newData(t)
+			mdb := memoryNoSQLDB(data)
+			mdb.MUpdate = func(tx *database.Tx) error {
+				return errors.New("force")
+			}
+			return test{
+				db:    mdb,
+				data:  data,
+				limit: 10,
+				err:   errors.New("error deleting expired orders: force"),
+			}
+		},
+		"ok": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:                  memoryNoSQLDB(data),
+				data:                data,
+				limit:               10,
+				n:                   2,
+				remaining:           []string{"o2", "o4", "o5", "o6"},
+				ordersByIdentifiers: []string{"o2"},
+			}
+		},
+		"ok/limit": func(t *testing.T) test {
+			data := newData(t)
+			return test{
+				db:                  memoryNoSQLDB(data),
+				data:                data,
+				limit:               1,
+				n:                   1,
+				remaining:           []string{"o1", "o2", "o4", "o5", "o6"},
+				index:               []string{"o1"},
+				ordersByIdentifiers: []string{"o1", "o2"},
+			}
+		},
+		"ok/none": func(t *testing.T) test {
+			data := newData(t)
+			delete(data[string(orderTable)], "o1")
+			delete(data[string(orderTable)], "o3")
+			return test{
+				db:                  memoryNoSQLDB(data),
+				data:                data,
+				limit:               10,
+				remaining:           []string{"o2", "o4", "o5", "o6"},
+				index:               []string{"o1"},
+				ordersByIdentifiers: []string{"o1", "o2"},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			n, err := d.DeleteExpiredOrders(context.Background(), before, tc.limit)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			assert.Equals(t, n, tc.n)
+			var remaining []string
+			for _, e := range mustList(t, tc.db, orderTable) {
+				remaining = append(remaining, string(e.Key))
+			}
+			assert.Equals(t, remaining, tc.remaining)
+
+			// The expired orders are removed from the index of the account.
+			var index []string
+			if b, ok := tc.data[string(ordersByAccountIDTable)]["acc1"]; ok {
+				assert.FatalError(t, json.Unmarshal(b, &index))
+			}
+			assert.Equals(t, index, tc.index)
+
+			// And from the orders by identifiers index.
+			key, err := identifiersKey("acc1", nil)
+			assert.FatalError(t, err)
+			var oids []string
+			assert.FatalError(t, json.Unmarshal(tc.data[string(ordersByIdentifiersTable)][string(key)], &oids))
+			assert.Equals(t, oids, tc.ordersByIdentifiers)
+		})
+	}
+}
+
+func TestDB_GetOrdersByIdentifiers(t *testing.T) {
+	foo := acme.Identifier{Type: "dns", Value: "foo.internal"}
+	bar := acme.Identifier{Type: "dns", Value: "bar.internal"}
+	newData := func(t *testing.T) map[string]map[string][]byte {
+		orders := map[string]*dbOrder{
+			"o1": {ID: "o1", AccountID: "acc1", Status: acme.StatusPending, Identifiers: []acme.Identifier{foo, bar}},
+			"o2": {ID: "o2", AccountID: "acc1", Status: acme.StatusValid, Identifiers: []acme.Identifier{bar, foo}},
+			"o3": {ID: "o3", AccountID: "acc1", Status: acme.StatusPending, Identifiers: []acme.Identifier{foo}},
+			"o4": {ID: "o4", AccountID: "acc2", Status: acme.StatusPending, Identifiers: []acme.Identifier{foo, bar}},
+		}
+		data := map[string]map[string][]byte{
+			string(orderTable): {},
+		}
+		for id, o := range orders {
+			b, err := json.Marshal(o)
+			assert.FatalError(t, err)
+			data[string(orderTable)][id] = b
+		}
+		return data
+	}
+	type test struct {
+		db          nosql.DB
+		accID       string
+		identifiers []acme.Identifier
+		oids        []string
+		err         error
+	}
+	var tests = map[string]func(t *testing.T) test{
+		"fail/db.Get-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						assert.Equals(t, bucket, ordersByIdentifiersTable)
+						assert.Equals(t, key, ordersByIdentifiersIndexedKey)
+						return nil, errors.New("force")
+					},
+				},
+				accID:       "acc1",
+				identifiers: []acme.Identifier{foo},
+				err:         errors.New("error loading orders by identifiers index: force"),
+			}
+		},
+		"fail/db.List-error": func(t *testing.T) test {
+			return test{
+				db: &db.MockNoSQLDB{
+					MGet: func(bucket, key []byte) ([]byte, error) {
+						return nil, database.ErrNotFound
+					},
+					MList: func(bucket []byte) ([]*database.Entry, error) {
+						assert.Equals(t, bucket, orderTable)
+						return nil, errors.New("force")
+					},
+				},
+				accID:       "acc1",
+				identifiers: []acme.Identifier{foo},
+				err:         errors.New("error loading orders: force"),
+			}
+		},
+		"fail/unmarshal-error": func(t *testing.T) test {
+			data := newData(t)
+			data[string(orderTable)]["o1"] = []byte("foo")
+			return test{
+				db:          memoryNoSQLDB(data),
+				accID:       "acc1",
+				identifiers: []acme.Identifier{foo},
+				err:         errors.New("error unmarshaling order o1 into dbOrder"),
+			}
+		},
+		"ok/match": func(t *testing.T) test {
+			return test{
+				db:          memoryNoSQLDB(newData(t)),
+				accID:       "acc1",
+				identifiers: []acme.Identifier{foo, bar},
+				oids:        []string{"o1", "o2"},
+			}
+		},
+		"ok/match-one": func(t *testing.T) test {
+			return test{
+				db:          memoryNoSQLDB(newData(t)),
+				accID:       "acc1",
+				identifiers: []acme.Identifier{foo},
+				oids:        []string{"o3"},
+			}
+		},
+		"ok/no-match": func(t *testing.T) test {
+			return test{
+				db:          memoryNoSQLDB(newData(t)),
+				accID:       "acc1",
+				identifiers: []acme.Identifier{bar},
+				oids:        []string{},
+			}
+		},
+		"ok/other-account": func(t *testing.T) test {
+			return test{
+				db:          memoryNoSQLDB(newData(t)),
+				accID:       "acc3",
+				identifiers: []acme.Identifier{foo, bar},
+				oids:        []string{},
+			}
+		},
+		"ok/indexed": func(t *testing.T) test {
+			// The orders are not loaded once the index is complete.
+			data := newData(t)
+			key, err := identifiersKey("acc1", []acme.Identifier{bar, foo})
+			assert.FatalError(t, err)
+			data[string(ordersByIdentifiersTable)] = map[string][]byte{
+				string(ordersByIdentifiersIndexedKey): []byte("true"),
+				string(key):                           []byte(`["o2"]`),
+			}
+			mdb := memoryNoSQLDB(data)
+			mdb.MList = func(bucket []byte) ([]*database.Entry, error) {
+				return nil, errors.New("force")
+			}
+			return test{
+				db:          mdb,
+				accID:       "acc1",
+				identifiers: []acme.Identifier{foo, bar, foo},
+				oids:        []string{"o2"},
+			}
+		},
+	}
+	for name, run := range tests {
+		tc := run(t)
+		t.Run(name, func(t *testing.T) {
+			d := DB{db: tc.db}
+			oids, err := d.GetOrdersByIdentifiers(context.Background(), tc.accID, tc.identifiers)
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+				return
+			}
+			assert.Nil(t, tc.err)
+			assert.Equals(t, oids, tc.oids)
+
+			// The orders stored before the index existed are only loaded once.
+			_, err = tc.db.Get(ordersByIdentifiersTable, ordersByIdentifiersIndexedKey)
+			assert.FatalError(t, err)
+		})
+	}
+}
+
+func TestDB_GetOrdersByIdentifiers_createOrder(t *testing.T) {
+	foo := acme.Identifier{Type: "dns", Value: "foo.internal"}
+	bar := acme.Identifier{Type: "dns", Value: "bar.internal"}
+	data := map[string]map[string][]byte{}
+	d := DB{db: memoryNoSQLDB(data)}
+	ctx := context.Background()
+
+	var oids []string
+	for _, o := range []*acme.Order{
+		{AccountID: "acc1", Status: acme.StatusPending, Identifiers: []acme.Identifier{foo, bar}},
+		{AccountID: "acc1", Status: acme.StatusPending, Identifiers: []acme.Identifier{foo}},
+		{AccountID: "acc2", Status: acme.StatusPending, Identifiers: []acme.Identifier{foo, bar}},
+		{AccountID: "acc1", Status: acme.StatusPending, Identifiers: []acme.Identifier{bar, foo, bar}},
+	} {
+		assert.FatalError(t, d.CreateOrder(ctx, o))
+		oids = append(oids, o.ID)
+	}
+
+	got, err := d.GetOrdersByIdentifiers(ctx, "acc1", []acme.Identifier{bar, foo})
+	assert.FatalError(t, err)
+	assert.Equals(t, got, []string{oids[0], oids[3]})
+
+	got, err = d.GetOrdersByIdentifiers(ctx, "acc2", []acme.Identifier{foo, bar})
+	assert.FatalError(t, err)
+	assert.Equals(t, got, []string{oids[2]})
+}
+
+func TestDB_IncrementOrderCount(t *testing.T) {
+	ctx := context.Background()
+	t.Run("ok", func(t *testing.T) {
+		data := map[string]map[string][]byte{}
+		d := DB{db: memoryNoSQLDB(data)}
+		for i := 1; i <= 3; i++ {
+			ok, err := d.IncrementOrderCount(ctx, "accID", 3)
+			assert.FatalError(t, err)
+			assert.True(t, ok)
+			assert.Equals(t, string(data[string(orderCountByAccountIDTable)]["accID"]), strconv.Itoa(i))
+		}
+		// The count is not incremented once the maximum is reached.
+		ok, err := d.IncrementOrderCount(ctx, "accID", 3)
+		assert.FatalError(t, err)
+		assert.False(t, ok)
+		assert.Equals(t, string(data[string(orderCountByAccountIDTable)]["accID"]), "3")
+
+		// Other accounts have their own count.
+		ok, err = d.IncrementOrderCount(ctx, "otherID", 3)
+		assert.FatalError(t, err)
+		assert.True(t, ok)
+		assert.Equals(t, string(data[string(orderCountByAccountIDTable)]["otherID"]), "1")
+	})
+	t.Run("ok/concurrent-update", func(t *testing.T) {
+		data := map[string]map[string][]byte{
+			string(orderCountByAccountIDTable): {"accID": []byte("1")},
+		}
+		mdb := memoryNoSQLDB(data)
+		cmpAndSwap := mdb.MCmpAndSwap
+		var swaps int
+		mdb.MCmpAndSwap = func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+			// Another order increments the count after the first read.
+			if swaps++; swaps == 1 {
+				data[string(bucket)][string(key)] = []byte("2")
+			}
+			return cmpAndSwap(bucket, key, old, nu)
+		}
+		d := DB{db: mdb}
+		ok, err := d.IncrementOrderCount(ctx, "accID", 3)
+		assert.FatalError(t, err)
+		assert.True(t, ok)
+		assert.Equals(t, swaps, 2)
+		assert.Equals(t, string(data[string(orderCountByAccountIDTable)]["accID"]), "3")
+	})
+	t.Run("fail/db.Get-error", func(t *testing.T) {
+		d := DB{db: &db.MockNoSQLDB{
+			MGet: func(bucket, key []byte) ([]byte, error) {
+				assert.Equals(t, bucket, orderCountByAccountIDTable)
+				assert.Equals(t, string(key), "accID")
+				return nil, errors.New("force")
+			},
+		}}
+		_, err := d.IncrementOrderCount(ctx, "accID", 3)
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "error loading order count for account accID: force")
+		}
+	})
+	t.Run("fail/db.CmpAndSwap-error", func(t *testing.T) {
+		d := DB{db: &db.MockNoSQLDB{
+			MGet: func(bucket, key []byte) ([]byte, error) {
+				return nil, database.ErrNotFound
+			},
+			MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+				assert.Nil(t, old)
+				assert.Equals(t, nu, []byte("1"))
+				return nil, false, errors.New("force")
+			},
+		}}
+		_, err := d.IncrementOrderCount(ctx, "accID", 3)
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "error saving order count for account accID: force")
+		}
+	})
+	t.Run("fail/context-canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		d := DB{db: memoryNoSQLDB(map[string]map[string][]byte{})}
+		_, err := d.IncrementOrderCount(ctx, "accID", 3)
+		assert.Equals(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,118 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+	"go.step.sm/crypto/jose"
+)
+
+const selectAccount = `SELECT id, key, contact, status FROM acme_accounts`
+
+// scanAccount reads an ACME account from the given row.
+func scanAccount(row *sql.Row, id string) (*acme.Account, error) {
+	var (
+		acc          acme.Account
+		key, contact []byte
+	)
+	if err := row.Scan(&acc.ID, &key, &contact, &acc.Status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, acme.ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "error loading account %s", id)
+	}
+	acc.Key = new(jose.JSONWebKey)
+	if err := json.Unmarshal(key, acc.Key); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling key for account %s", id)
+	}
+	if err := json.Unmarshal(contact, &acc.Contact); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling contact for account %s", id)
+	}
+	return &acc, nil
+}
+
+// GetAccount retrieves an ACME account by ID.
+func (db *DB) GetAccount(ctx context.Context, id string) (*acme.Account, error) {
+	row := db.db.QueryRowContext(ctx, selectAccount+` WHERE id = $1`, id)
+	return scanAccount(row, id)
+}
+
+// GetAccountByKeyID retrieves an ACME account by the ID of its key.
+func (db *DB) GetAccountByKeyID(ctx context.Context, kid string) (*acme.Account, error) {
+	row := db.db.QueryRowContext(ctx, selectAccount+` WHERE key_id = $1`, kid)
+	return scanAccount(row, kid)
+}
+
+// CreateAccount stores a new ACME account and sets its ID.
+func (db *DB) CreateAccount(ctx context.Context, acc *acme.Account) error {
+	var err error
+	acc.ID, err = randID()
+	if err != nil {
+		return err
+	}
+
+	kid, err := acme.KeyToID(acc.Key)
+	if err != nil {
+		return err
+	}
+	key, err := json.Marshal(acc.Key)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling account key")
+	}
+	contact := acc.Contact
+	if contact == nil {
+		contact = []string{}
+	}
+	contactB, err := json.Marshal(contact)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling account contact")
+	}
+
+	_, err = db.db.ExecContext(ctx, `INSERT INTO acme_accounts (id, key_id, key, contact, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		acc.ID, kid, string(key), string(contactB), acc.Status, clock.Now())
+	switch {
+	case isUniqueViolation(err):
+		return errors.Errorf("account with key-id %s already exists", kid)
+	case err != nil:
+		return errors.Wrap(err, "error saving acme account")
+	default:
+		return nil
+	}
+}
+
+// UpdateAccount updates the contact and status of an ACME account. The
+// deactivation time is set the first time the account is deactivated. The
+// status of deactivated and revoked accounts cannot be changed.
+func (db *DB) UpdateAccount(ctx context.Context, acc *acme.Account) error {
+	contact := acc.Contact
+	if contact == nil {
+		contact = []string{}
+	}
+	contactB, err := json.Marshal(contact)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling account contact")
+	}
+
+	res, err := db.db.ExecContext(ctx, `UPDATE acme_accounts SET contact = $2, status = $3,
+		deactivated_at = CASE WHEN $3 = $4 AND status <> $4 THEN $5 ELSE deactivated_at END
+		WHERE id = $1 AND (status = $3 OR (status = $6 AND $3 IN ($4, $7)))`,
+		acc.ID, string(contactB), acc.Status, acme.StatusDeactivated, clock.Now(), acme.StatusValid, acme.StatusRevoked)
+	if err != nil {
+		return errors.Wrapf(err, "error saving acme account %s", acc.ID)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrapf(err, "error saving acme account %s", acc.ID)
+	} else if n == 0 {
+		// The account does not exist, or its status is final.
+		old, err := db.GetAccount(ctx, acc.ID)
+		if err != nil {
+			return err
+		}
+		return acme.NewAccountStatusTransitionError(acc.ID, old.Status, acc.Status)
+	}
+	return nil
+}
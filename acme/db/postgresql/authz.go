@@ -0,0 +1,227 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+)
+
+// GetAuthorization retrieves an ACME authorization and its challenges from
+// the database. Implements acme.DB GetAuthorization interface.
+func (db *DB) GetAuthorization(ctx context.Context, id string) (*acme.Authorization, error) {
+	var (
+		az             acme.Authorization
+		chIDsB, errorB []byte
+	)
+	err := db.db.QueryRowContext(ctx, `SELECT id, account_id, identifier_type, identifier_value,
+		status, token, challenge_ids, wildcard, error, expires_at
+		FROM acme_authzs WHERE id = $1`, id).
+		Scan(&az.ID, &az.AccountID, &az.Identifier.Type, &az.Identifier.Value,
+			&az.Status, &az.Token, &chIDsB, &az.Wildcard, &errorB, &az.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, acme.NewError(acme.ErrorMalformedType, "authz %s not found", id)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error loading authz %s", id)
+	}
+	az.ExpiresAt = az.ExpiresAt.UTC()
+	if az.Error, err = unmarshalError(errorB); err != nil {
+		return nil, errors.Wrapf(err, "error loading authz %s", id)
+	}
+
+	var chIDs []string
+	if err := json.Unmarshal(chIDsB, &chIDs); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling challenge ids for authz %s", id)
+	}
+	az.Challenges = make([]*acme.Challenge, len(chIDs))
+	for i, chID := range chIDs {
+		az.Challenges[i], err = db.GetChallenge(ctx, chID, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &az, nil
+}
+
+// CreateAuthorization creates an entry in the database for the Authorization.
+// Implements the acme.DB.CreateAuthorization interface.
+func (db *DB) CreateAuthorization(ctx context.Context, az *acme.Authorization) error {
+	return createAuthorization(ctx, db.db, az)
+}
+
+// CreatePendingAuthorization creates an entry in the database for the
+// Authorization if the account has fewer than max pending authorizations that
+// have not expired, and returns false if it does not. The row of the account
+// is locked while the authorizations are counted, so the concurrent orders of
+// the account are serialized. Implements the
+// acme.DB.CreatePendingAuthorization interface.
+func (db *DB) CreatePendingAuthorization(ctx context.Context, az *acme.Authorization, max int) (bool, error) {
+	var ok bool
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT id FROM acme_accounts WHERE id = $1 FOR UPDATE`, az.AccountID); err != nil {
+			return errors.Wrapf(err, "error locking account %s", az.AccountID)
+		}
+		var pending int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM acme_authzs WHERE account_id = $1
+			AND status = $2 AND expires_at > $3`, az.AccountID, acme.StatusPending, clock.Now()).Scan(&pending); err != nil {
+			return errors.Wrapf(err, "error counting pending authzs for account %s", az.AccountID)
+		}
+		if pending >= max {
+			return nil
+		}
+		if err := createAuthorization(ctx, tx, az); err != nil {
+			return err
+		}
+		ok = true
+		return nil
+	})
+	if err != nil || !ok {
+		az.ID = ""
+		return false, err
+	}
+	return true, nil
+}
+
+// createAuthorization stores a new authorization and sets its ID.
+func createAuthorization(ctx context.Context, e execer, az *acme.Authorization) error {
+	var err error
+	az.ID, err = randID()
+	if err != nil {
+		return err
+	}
+
+	chIDs := make([]string, len(az.Challenges))
+	for i, ch := range az.Challenges {
+		chIDs[i] = ch.ID
+	}
+	chIDsB, err := json.Marshal(chIDs)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling challenge ids")
+	}
+
+	if _, err := e.ExecContext(ctx, `INSERT INTO acme_authzs (id, account_id, identifier_type, identifier_value,
+		status, token, challenge_ids, wildcard, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		az.ID, az.AccountID, az.Identifier.Type, az.Identifier.Value,
+		az.Status, az.Token, string(chIDsB), az.Wildcard, clock.Now(), az.ExpiresAt); err != nil {
+		return errors.Wrap(err, "error saving acme authz")
+	}
+	return nil
+}
+
+// UpdateAuthorization saves an updated ACME Authorization to the database.
+func (db *DB) UpdateAuthorization(ctx context.Context, az *acme.Authorization) error {
+	azErr, err := marshalError(az.Error)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.db.ExecContext(ctx, `UPDATE acme_authzs SET status = $2, error = $3 WHERE id = $1`,
+		az.ID, az.Status, azErr)
+	if err != nil {
+		return errors.Wrapf(err, "error saving acme authz %s", az.ID)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrapf(err, "error saving acme authz %s", az.ID)
+	} else if n == 0 {
+		return acme.NewError(acme.ErrorMalformedType, "authz %s not found", az.ID)
+	}
+	return nil
+}
+
+// DeleteAuthorizations deletes the given authorizations with their challenges
+// in a single transaction.
+func (db *DB) DeleteAuthorizations(ctx context.Context, azs []*acme.Authorization) error {
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		for _, az := range azs {
+			// The authorization might not have been created.
+			if az.ID != "" {
+				if _, err := tx.ExecContext(ctx, `DELETE FROM acme_authzs WHERE id = $1`, az.ID); err != nil {
+					return errors.Wrapf(err, "error deleting acme authz %s", az.ID)
+				}
+			}
+			for _, ch := range az.Challenges {
+				if ch == nil || ch.ID == "" {
+					continue
+				}
+				if _, err := tx.ExecContext(ctx, `DELETE FROM acme_challenges WHERE id = $1`, ch.ID); err != nil {
+					return errors.Wrapf(err, "error deleting acme challenge %s", ch.ID)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetAuthorizationsByAccountID returns the pending or valid authorizations of
+// an account that have not expired. The status of the authorizations is
+// updated by UpdateStatus first, and the ones that are no longer pending or
+// valid are excluded from the list.
+func (db *DB) GetAuthorizationsByAccountID(ctx context.Context, accID string) ([]*acme.Authorization, error) {
+	ids, err := db.queryIDs(ctx, `SELECT id FROM acme_authzs WHERE account_id = $1
+		AND status IN ($2, $3) AND expires_at > $4 ORDER BY created_at, id`,
+		accID, acme.StatusPending, acme.StatusValid, clock.Now())
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading authzIDs for account %s", accID)
+	}
+
+	azs := []*acme.Authorization{}
+	now := clock.Now()
+	for _, azID := range ids {
+		az, err := db.GetAuthorization(ctx, azID)
+		if err != nil {
+			return nil, acme.WrapErrorISE(err, "error loading authz %s for account %s", azID, accID)
+		}
+		if err = az.UpdateStatus(ctx, db); err != nil {
+			return nil, acme.WrapErrorISE(err, "error updating authz %s for account %s", azID, accID)
+		}
+		if (az.Status == acme.StatusPending || az.Status == acme.StatusValid) && now.Before(az.ExpiresAt) {
+			azs = append(azs, az)
+		}
+	}
+	return azs, nil
+}
+
+// DeleteExpiredAuthorizations deletes up to limit authorizations, with their
+// challenges, that expired before the given time, and returns the number of
+// deleted authorizations. Valid and deactivated authorizations are kept, as
+// the finalized orders, which are never deleted, still reference them.
+// Implements the acme.GarbageCollector interface.
+func (db *DB) DeleteExpiredAuthorizations(ctx context.Context, before time.Time, limit int) (int, error) {
+	var n int
+	if err := db.db.QueryRowContext(ctx, `WITH authzs AS (
+			DELETE FROM acme_authzs WHERE id IN (
+				SELECT id FROM acme_authzs WHERE expires_at < $1 AND status NOT IN ($3, $4) LIMIT $2)
+			RETURNING challenge_ids
+		), challenges AS (
+			DELETE FROM acme_challenges WHERE id IN (
+				SELECT jsonb_array_elements_text(challenge_ids) FROM authzs)
+		)
+		SELECT COUNT(*) FROM authzs`, before, limit, acme.StatusValid, acme.StatusDeactivated).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "error deleting expired authzs")
+	}
+	return n, nil
+}
+
+// queryIDs runs the given query and returns the list of IDs in the first
+// column of the result.
+func (db *DB) queryIDs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
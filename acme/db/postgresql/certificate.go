@@ -0,0 +1,98 @@
+package postgresql
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+)
+
+// CreateCertificate creates and stores an ACME certificate type.
+func (db *DB) CreateCertificate(ctx context.Context, cert *acme.Certificate) error {
+	var err error
+	cert.ID, err = randID()
+	if err != nil {
+		return err
+	}
+	return createCertificate(ctx, db.db, cert)
+}
+
+// createCertificate stores an ACME certificate with an already set ID.
+func createCertificate(ctx context.Context, e execer, cert *acme.Certificate) error {
+	leaf := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Leaf.Raw,
+	})
+	intermediates := []byte{}
+	for _, crt := range cert.Intermediates {
+		intermediates = append(intermediates, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: crt.Raw,
+		})...)
+	}
+
+	if _, err := e.ExecContext(ctx, `INSERT INTO acme_certs (id, account_id, order_id, leaf, intermediates, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		cert.ID, cert.AccountID, cert.OrderID, leaf, intermediates, clock.Now()); err != nil {
+		return errors.Wrap(err, "error saving acme certificate")
+	}
+	return nil
+}
+
+// GetCertificate retrieves and unmarshals an ACME certificate type from the
+// datastore.
+func (db *DB) GetCertificate(ctx context.Context, id string) (*acme.Certificate, error) {
+	var (
+		cert                acme.Certificate
+		leaf, intermediates []byte
+	)
+	err := db.db.QueryRowContext(ctx, `SELECT id, account_id, order_id, leaf, intermediates
+		FROM acme_certs WHERE id = $1`, id).
+		Scan(&cert.ID, &cert.AccountID, &cert.OrderID, &leaf, &intermediates)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, acme.NewError(acme.ErrorMalformedType, "certificate %s not found", id)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error loading certificate %s", id)
+	}
+
+	certs, err := parseBundle(append(leaf, intermediates...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing certificate chain for ACME certificate with ID %s", id)
+	}
+	if len(certs) == 0 {
+		return nil, errors.Errorf("error parsing certificate chain for ACME certificate with ID %s: chain is empty", id)
+	}
+	cert.Leaf = certs[0]
+	cert.Intermediates = certs[1:]
+	return &cert, nil
+}
+
+func parseBundle(b []byte) ([]*x509.Certificate, error) {
+	var (
+		err    error
+		block  *pem.Block
+		bundle []*x509.Certificate
+	)
+	for len(b) > 0 {
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, errors.New("error decoding PEM: data contains block that is not a certificate")
+		}
+		var crt *x509.Certificate
+		crt, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing x509 certificate")
+		}
+		bundle = append(bundle, crt)
+	}
+	if len(b) > 0 {
+		return nil, errors.New("error decoding PEM: unexpected data")
+	}
+	return bundle, nil
+}
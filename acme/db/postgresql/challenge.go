@@ -0,0 +1,83 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+)
+
+// CreateChallenge creates a new ACME challenge data structure in the database.
+// Implements acme.DB.CreateChallenge interface.
+func (db *DB) CreateChallenge(ctx context.Context, ch *acme.Challenge) error {
+	var err error
+	ch.ID, err = randID()
+	if err != nil {
+		return errors.Wrap(err, "error generating random id for ACME challenge")
+	}
+
+	if _, err := db.db.ExecContext(ctx, `INSERT INTO acme_challenges (id, account_id, type, status, token, value, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		ch.ID, ch.AccountID, ch.Type, acme.StatusPending, ch.Token, ch.Value, clock.Now()); err != nil {
+		return errors.Wrap(err, "error saving acme challenge")
+	}
+	return nil
+}
+
+// GetChallenge retrieves an ACME challenge from the database.
+// Implements the acme.DB GetChallenge interface.
+func (db *DB) GetChallenge(ctx context.Context, id, authzID string) (*acme.Challenge, error) {
+	var (
+		ch       acme.Challenge
+		errorB   []byte
+		historyB []byte
+	)
+	err := db.db.QueryRowContext(ctx, `SELECT id, account_id, type, status, token, value, validated_at, error, history
+		FROM acme_challenges WHERE id = $1`, id).
+		Scan(&ch.ID, &ch.AccountID, &ch.Type, &ch.Status, &ch.Token, &ch.Value, &ch.ValidatedAt, &errorB, &historyB)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, acme.NewError(acme.ErrorMalformedType, "challenge %s not found", id)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error loading acme challenge %s", id)
+	}
+	if ch.Error, err = unmarshalError(errorB); err != nil {
+		return nil, errors.Wrapf(err, "error loading acme challenge %s", id)
+	}
+	if len(historyB) > 0 {
+		if err := json.Unmarshal(historyB, &ch.History); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshaling history of acme challenge %s", id)
+		}
+	}
+	return &ch, nil
+}
+
+// UpdateChallenge updates an ACME challenge type in the database.
+func (db *DB) UpdateChallenge(ctx context.Context, ch *acme.Challenge) error {
+	chErr, err := marshalError(ch.Error)
+	if err != nil {
+		return err
+	}
+	var history interface{}
+	if len(ch.History) > 0 {
+		b, err := json.Marshal(ch.History)
+		if err != nil {
+			return errors.Wrapf(err, "error marshaling history of acme challenge %s", ch.ID)
+		}
+		history = string(b)
+	}
+
+	// These should be the only values changing in an Update request.
+	res, err := db.db.ExecContext(ctx, `UPDATE acme_challenges SET status = $2, error = $3, validated_at = $4, history = $5
+		WHERE id = $1`, ch.ID, ch.Status, chErr, ch.ValidatedAt, history)
+	if err != nil {
+		return errors.Wrapf(err, "error saving acme challenge %s", ch.ID)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrapf(err, "error saving acme challenge %s", ch.ID)
+	} else if n == 0 {
+		return acme.NewError(acme.ErrorMalformedType, "challenge %s not found", ch.ID)
+	}
+	return nil
+}
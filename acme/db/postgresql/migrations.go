@@ -0,0 +1,139 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// migrationsLockID is the key of the advisory lock used to avoid concurrent
+// migrations when multiple instances share the same database.
+const migrationsLockID = 0x61636d65 // "acme"
+
+// migrations is the list of schema migrations. Each migration is applied only
+// once and in order, its version is its position in the list starting at 1.
+// New migrations must be appended and existing ones must never be modified.
+var migrations = [][]string{
+	// 1: initial schema.
+	{
+		`CREATE TABLE acme_accounts (
+			id TEXT PRIMARY KEY,
+			key_id TEXT NOT NULL,
+			key JSONB NOT NULL,
+			contact JSONB NOT NULL,
+			status TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			deactivated_at TIMESTAMPTZ
+		)`,
+		`CREATE UNIQUE INDEX acme_accounts_key_id_idx ON acme_accounts (key_id)`,
+		`CREATE TABLE acme_nonces (
+			id TEXT PRIMARY KEY,
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE acme_challenges (
+			id TEXT PRIMARY KEY,
+			account_id TEXT NOT NULL REFERENCES acme_accounts (id),
+			type TEXT NOT NULL,
+			status TEXT NOT NULL,
+			token TEXT NOT NULL,
+			value TEXT NOT NULL,
+			validated_at TEXT NOT NULL DEFAULT '',
+			error JSONB,
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE acme_authzs (
+			id TEXT PRIMARY KEY,
+			account_id TEXT NOT NULL REFERENCES acme_accounts (id),
+			identifier_type TEXT NOT NULL,
+			identifier_value TEXT NOT NULL,
+			status TEXT NOT NULL,
+			token TEXT NOT NULL,
+			challenge_ids JSONB NOT NULL,
+			wildcard BOOLEAN NOT NULL,
+			error JSONB,
+			created_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX acme_authzs_account_id_status_idx ON acme_authzs (account_id, status)`,
+		`CREATE TABLE acme_orders (
+			id TEXT PRIMARY KEY,
+			account_id TEXT NOT NULL REFERENCES acme_accounts (id),
+			provisioner_id TEXT NOT NULL,
+			identifiers JSONB NOT NULL,
+			authorization_ids JSONB NOT NULL,
+			status TEXT NOT NULL,
+			not_before TIMESTAMPTZ NOT NULL,
+			not_after TIMESTAMPTZ NOT NULL,
+			certificate_id TEXT NOT NULL DEFAULT '',
+			error JSONB,
+			created_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX acme_orders_account_id_status_idx ON acme_orders (account_id, status)`,
+		`CREATE TABLE acme_certs (
+			id TEXT PRIMARY KEY,
+			account_id TEXT NOT NULL REFERENCES acme_accounts (id),
+			order_id TEXT NOT NULL REFERENCES acme_orders (id),
+			leaf BYTEA NOT NULL,
+			intermediates BYTEA NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX acme_certs_order_id_idx ON acme_certs (order_id)`,
+	},
+	// 2: indexes used to delete the expired objects.
+	{
+		`CREATE INDEX acme_nonces_created_at_idx ON acme_nonces (created_at)`,
+		`CREATE INDEX acme_authzs_expires_at_idx ON acme_authzs (expires_at)`,
+		`CREATE INDEX acme_orders_expires_at_idx ON acme_orders (expires_at)`,
+	},
+	// 3: history of the challenge validation attempts.
+	{
+		`ALTER TABLE acme_challenges ADD COLUMN history JSONB`,
+	},
+	// 4: number of orders created by each account.
+	{
+		`ALTER TABLE acme_accounts ADD COLUMN order_count INTEGER NOT NULL DEFAULT 0`,
+	},
+}
+
+// migrate applies the pending schema migrations in a single transaction.
+func migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting migrations transaction")
+	}
+	defer tx.Rollback()
+
+	// The lock is released when the transaction ends.
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationsLockID); err != nil {
+		return errors.Wrap(err, "error acquiring migrations lock")
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS acme_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return errors.Wrap(err, "error creating migrations table")
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM acme_schema_migrations`).Scan(&version); err != nil {
+		return errors.Wrap(err, "error loading schema version")
+	}
+	if version > len(migrations) {
+		return errors.Errorf("database schema version %d is newer than the supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		for _, stmt := range migrations[i] {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return errors.Wrapf(err, "error applying schema migration %d", i+1)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO acme_schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return errors.Wrapf(err, "error saving schema migration %d", i+1)
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "error committing schema migrations")
+}
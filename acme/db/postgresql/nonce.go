@@ -0,0 +1,57 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/base64"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+)
+
+// CreateNonce creates, stores, and returns an ACME replay-nonce.
+// Implements the acme.DB interface.
+func (db *DB) CreateNonce(ctx context.Context) (acme.Nonce, error) {
+	_id, err := db.nonceID()
+	if err != nil {
+		return "", err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString([]byte(_id))
+	if _, err := db.db.ExecContext(ctx, `INSERT INTO acme_nonces (id, created_at) VALUES ($1, $2)`,
+		id, clock.Now()); err != nil {
+		return "", wrapTransient(errors.Wrap(err, "error saving acme nonce"))
+	}
+	return acme.Nonce(id), nil
+}
+
+// DeleteNonce verifies that the nonce is valid (by checking if it exists),
+// and if so, consumes the nonce resource by deleting it from the database.
+func (db *DB) DeleteNonce(ctx context.Context, nonce acme.Nonce) error {
+	res, err := db.db.ExecContext(ctx, `DELETE FROM acme_nonces WHERE id = $1`, string(nonce))
+	if err != nil {
+		return wrapTransient(errors.Wrapf(err, "error deleting nonce %s", string(nonce)))
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrapf(err, "error deleting nonce %s", string(nonce))
+	} else if n == 0 {
+		return acme.NewError(acme.ErrorBadNonceType, "nonce %s not found", string(nonce))
+	}
+	return nil
+}
+
+// DeleteExpiredNonces deletes up to limit nonces created before the given
+// time, and returns the number of deleted nonces. Implements the
+// acme.GarbageCollector interface.
+func (db *DB) DeleteExpiredNonces(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := db.db.ExecContext(ctx, `DELETE FROM acme_nonces WHERE id IN (
+		SELECT id FROM acme_nonces WHERE created_at < $1 LIMIT $2)`, before, limit)
+	if err != nil {
+		return 0, errors.Wrap(err, "error deleting expired nonces")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "error deleting expired nonces")
+	}
+	return int(n), nil
+}
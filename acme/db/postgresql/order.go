@@ -0,0 +1,213 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+)
+
+// GetOrder retrieves an ACME Order from the database.
+func (db *DB) GetOrder(ctx context.Context, id string) (*acme.Order, error) {
+	var (
+		o                            acme.Order
+		identifiersB, azIDsB, errorB []byte
+	)
+	err := db.db.QueryRowContext(ctx, `SELECT id, account_id, provisioner_id, identifiers, authorization_ids,
+		status, not_before, not_after, certificate_id, error, expires_at
+		FROM acme_orders WHERE id = $1`, id).
+		Scan(&o.ID, &o.AccountID, &o.ProvisionerID, &identifiersB, &azIDsB,
+			&o.Status, &o.NotBefore, &o.NotAfter, &o.CertificateID, &errorB, &o.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, acme.NewError(acme.ErrorMalformedType, "order %s not found", id)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error loading order %s", id)
+	}
+	o.NotBefore = o.NotBefore.UTC()
+	o.NotAfter = o.NotAfter.UTC()
+	o.ExpiresAt = o.ExpiresAt.UTC()
+	if err := json.Unmarshal(identifiersB, &o.Identifiers); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling identifiers for order %s", id)
+	}
+	if err := json.Unmarshal(azIDsB, &o.AuthorizationIDs); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling authorization ids for order %s", id)
+	}
+	if o.Error, err = unmarshalError(errorB); err != nil {
+		return nil, errors.Wrapf(err, "error loading order %s", id)
+	}
+	return &o, nil
+}
+
+// CreateOrder creates ACME Order resources and saves them to the DB.
+func (db *DB) CreateOrder(ctx context.Context, o *acme.Order) error {
+	var err error
+	o.ID, err = randID()
+	if err != nil {
+		return err
+	}
+
+	identifiersB, err := json.Marshal(o.Identifiers)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling order identifiers")
+	}
+	azIDsB, err := json.Marshal(o.AuthorizationIDs)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling order authorization ids")
+	}
+
+	if _, err := db.db.ExecContext(ctx, `INSERT INTO acme_orders (id, account_id, provisioner_id, identifiers,
+		authorization_ids, status, not_before, not_after, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		o.ID, o.AccountID, o.ProvisionerID, string(identifiersB), string(azIDsB),
+		o.Status, o.NotBefore, o.NotAfter, clock.Now(), o.ExpiresAt); err != nil {
+		return errors.Wrap(err, "error saving acme order")
+	}
+	return nil
+}
+
+// UpdateOrder saves an updated ACME Order to the database.
+func (db *DB) UpdateOrder(ctx context.Context, o *acme.Order) error {
+	return updateOrder(ctx, db.db, o, "")
+}
+
+// execer is the interface implemented by sql.DB and sql.Tx used to run
+// statements inside or outside a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// updateOrder updates the status, error and certificate of an order. If
+// oldStatus is not empty, the order is only updated if its stored status
+// matches it.
+func updateOrder(ctx context.Context, e execer, o *acme.Order, oldStatus acme.Status) error {
+	oErr, err := marshalError(o.Error)
+	if err != nil {
+		return err
+	}
+
+	res, err := e.ExecContext(ctx, `UPDATE acme_orders SET status = $2, error = $3, certificate_id = $4
+		WHERE id = $1 AND ($5 = '' OR status = $5)`,
+		o.ID, o.Status, oErr, o.CertificateID, oldStatus)
+	if err != nil {
+		return errors.Wrapf(err, "error saving acme order %s", o.ID)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrapf(err, "error saving acme order %s", o.ID)
+	} else if n == 0 {
+		if oldStatus != "" {
+			return errors.Errorf("error saving acme order %s; changed since last read", o.ID)
+		}
+		return acme.NewError(acme.ErrorMalformedType, "order %s not found", o.ID)
+	}
+	return nil
+}
+
+// GetOrdersByAccountID returns the IDs of the pending orders of an account.
+// Orders that are no longer pending are updated and excluded from the list.
+//
+// According to RFC 8555:
+// The server SHOULD include pending orders and SHOULD NOT include orders
+// that are invalid in the array of URLs.
+func (db *DB) GetOrdersByAccountID(ctx context.Context, accID string) ([]string, error) {
+	ids, err := db.queryIDs(ctx, `SELECT id FROM acme_orders WHERE account_id = $1 AND status = $2
+		ORDER BY created_at, id`, accID, acme.StatusPending)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading orderIDs for account %s", accID)
+	}
+
+	pendOids := []string{}
+	for _, oid := range ids {
+		o, err := db.GetOrder(ctx, oid)
+		if err != nil {
+			return nil, acme.WrapErrorISE(err, "error loading order %s for account %s", oid, accID)
+		}
+		if err = o.UpdateStatus(ctx, db); err != nil {
+			return nil, acme.WrapErrorISE(err, "error updating order %s for account %s", oid, accID)
+		}
+		if o.Status == acme.StatusPending {
+			pendOids = append(pendOids, oid)
+		}
+	}
+	return pendOids, nil
+}
+
+// GetOrdersByIdentifiers returns the IDs of all the orders of an account with
+// the same set of identifiers as the given ones.
+func (db *DB) GetOrdersByIdentifiers(ctx context.Context, accID string, identifiers []acme.Identifier) ([]string, error) {
+	identifiersB, err := json.Marshal(identifiers)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling order identifiers")
+	}
+	// Two identifier arrays contain each other if they have the same elements,
+	// regardless of their order and duplicates.
+	ids, err := db.queryIDs(ctx, `SELECT id FROM acme_orders WHERE account_id = $1
+		AND identifiers @> $2::jsonb AND identifiers <@ $2::jsonb ORDER BY created_at, id`,
+		accID, string(identifiersB))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading orderIDs for account %s", accID)
+	}
+	return ids, nil
+}
+
+// IncrementOrderCount increments the number of orders created by the account
+// if it's lower than max, and returns false if it's not. The count is a column
+// of the account, so it's kept when the orders are deleted.
+func (db *DB) IncrementOrderCount(ctx context.Context, accID string, max int) (bool, error) {
+	res, err := db.db.ExecContext(ctx, `UPDATE acme_accounts SET order_count = order_count + 1
+		WHERE id = $1 AND order_count < $2`, accID, max)
+	if err != nil {
+		return false, errors.Wrapf(err, "error saving order count for account %s", accID)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "error saving order count for account %s", accID)
+	}
+	return n > 0, nil
+}
+
+// FinalizeOrder stores the certificate and marks the order as valid in a
+// single transaction. The order is only updated if it has not changed since
+// it was read. Implements the acme.OrderFinalizer interface.
+func (db *DB) FinalizeOrder(ctx context.Context, o *acme.Order, cert *acme.Certificate) error {
+	certID, err := randID()
+	if err != nil {
+		return err
+	}
+
+	nu := *o
+	nu.CertificateID = certID
+	nu.Status = acme.StatusValid
+	if err := db.withTx(ctx, func(tx *sql.Tx) error {
+		cert.ID = certID
+		if err := createCertificate(ctx, tx, cert); err != nil {
+			return err
+		}
+		return updateOrder(ctx, tx, &nu, o.Status)
+	}); err != nil {
+		return err
+	}
+
+	*o = nu
+	return nil
+}
+
+// DeleteExpiredOrders deletes up to limit orders that expired before the given
+// time without being finalized, and returns the number of deleted orders.
+// Implements the acme.GarbageCollector interface.
+func (db *DB) DeleteExpiredOrders(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := db.db.ExecContext(ctx, `DELETE FROM acme_orders WHERE id IN (
+		SELECT o.id FROM acme_orders o WHERE o.expires_at < $1 AND o.status <> $2
+		AND NOT EXISTS (SELECT 1 FROM acme_certs c WHERE c.order_id = o.id)
+		LIMIT $3)`, before, acme.StatusValid, limit)
+	if err != nil {
+		return 0, errors.Wrap(err, "error deleting expired orders")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "error deleting expired orders")
+	}
+	return int(n), nil
+}
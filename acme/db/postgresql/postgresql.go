@@ -0,0 +1,199 @@
+// Package postgresql implements the acme.DB interface using a PostgreSQL
+// database.
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
+	"go.step.sm/crypto/randutil"
+)
+
+// Type is the database type used in the configuration to select the
+// PostgreSQL implementation of the ACME database.
+const Type = "postgresql"
+
+// Default values for the connection pool.
+const (
+	DefaultMaxOpenConns    = 20
+	DefaultMaxIdleConns    = 5
+	DefaultConnMaxLifetime = 30 * time.Minute
+)
+
+// Options are the options used to open a PostgreSQL database.
+type Options struct {
+	// Database overwrites the database name in the data source.
+	Database string
+	// MaxOpenConns is the maximum number of open connections in the pool.
+	MaxOpenConns int
+	// MaxIdleConns is the maximum number of idle connections in the pool.
+	MaxIdleConns int
+	// ConnMaxLifetime is the maximum amount of time a connection may be
+	// reused.
+	ConnMaxLifetime time.Duration
+}
+
+// DB is a struct that implements the acme.DB interface using a PostgreSQL
+// database.
+type DB struct {
+	db           *sql.DB
+	randomSource io.Reader
+}
+
+// SetRandomSource sets the source of randomness used to generate the nonces,
+// crypto/rand is used by default. It implements the acme.RandomSourceSetter
+// interface.
+func (db *DB) SetRandomSource(r io.Reader) {
+	db.randomSource = r
+}
+
+// Open creates a pool of connections to the PostgreSQL database in the given
+// data source, and returns a DB after applying the schema migrations.
+func Open(ctx context.Context, dataSource string, opts Options) (*DB, error) {
+	cfg, err := pgx.ParseConfig(dataSource)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing postgresql data source")
+	}
+	if opts.Database != "" {
+		cfg.Database = opts.Database
+	}
+	if opts.MaxOpenConns <= 0 {
+		opts.MaxOpenConns = DefaultMaxOpenConns
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if opts.ConnMaxLifetime <= 0 {
+		opts.ConnMaxLifetime = DefaultConnMaxLifetime
+	}
+
+	db := stdlib.OpenDB(*cfg)
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error connecting to postgresql")
+	}
+
+	pg, err := New(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return pg, nil
+}
+
+// New returns a DB using the given pool of connections, the schema migrations
+// are applied before returning.
+func New(ctx context.Context, db *sql.DB) (*DB, error) {
+	if err := migrate(ctx, db); err != nil {
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+// Close closes the pool of connections.
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// withTx runs the given function in a transaction. The transaction is
+// committed if the function succeeds, and rolled back otherwise.
+func (db *DB) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting transaction")
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
+
+// isUniqueViolation returns true if the error is caused by a unique
+// constraint.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// wrapTransient marks the serialization failures and deadlocks, caused by
+// concurrent transactions, as apiv1.ErrTransient so they can be retried.
+func wrapTransient(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01") {
+		return kmsapi.ErrTransient{Err: err}
+	}
+	return err
+}
+
+// marshalError returns the JSON representation of the given ACME error, or
+// nil if the error is nil, so it's stored as NULL.
+func marshalError(e *acme.Error) (interface{}, error) {
+	if e == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling acme error")
+	}
+	return string(b), nil
+}
+
+// unmarshalError parses the JSON representation of an ACME error, a nil or
+// empty value returns a nil error.
+func unmarshalError(b []byte) (*acme.Error, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	e := new(acme.Error)
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling acme error")
+	}
+	return e, nil
+}
+
+var idLen = 32
+
+func randID() (val string, err error) {
+	val, err = randutil.Alphanumeric(idLen)
+	if err != nil {
+		return "", errors.Wrap(err, "error generating random alphanumeric ID")
+	}
+	return val, nil
+}
+
+// nonceID returns a random id for a nonce, read from the random source of the
+// DB if it's set.
+func (db *DB) nonceID() (string, error) {
+	if db.randomSource == nil {
+		return randID()
+	}
+	b := make([]byte, idLen/2)
+	if _, err := io.ReadFull(db.randomSource, b); err != nil {
+		return "", errors.Wrap(err, "error generating random ID")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Clock that returns time in UTC rounded to seconds.
+type Clock struct{}
+
+// Now returns the UTC time rounded to seconds.
+func (c *Clock) Now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+var clock = new(Clock)
@@ -0,0 +1,313 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultDNSCacheMaxSize is the default maximum number of hosts in a
+	// DNSCache.
+	DefaultDNSCacheMaxSize = 1000
+	// DefaultDNSCacheMinTTL is the default minimum time a host is cached. It's
+	// also used when the TTL of the records is not known, e.g. if the host is
+	// in the hosts file.
+	DefaultDNSCacheMinTTL = 5 * time.Second
+	// DefaultDNSCacheMaxTTL is the default maximum time a host is cached.
+	DefaultDNSCacheMaxTTL = 5 * time.Minute
+	// MaxDNSCacheTTL is the maximum time a host can be cached. It's well below
+	// the lifetime of the authorizations, so a cached address is never used
+	// to validate an authorization created long after the lookup.
+	MaxDNSCacheTTL = time.Hour
+)
+
+// dnsCacheEntry is a host in the cache.
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// DNSCache is a bounded cache of the IP addresses of the hosts dialed while
+// validating the http-01 and tls-alpn-01 challenges. The addresses are cached
+// for the TTL of the DNS records, clamped between a minimum and a maximum
+// TTL. Failed lookups are not cached.
+type DNSCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+	maxSize int
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	dialer  *net.Dialer
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+	now     func() time.Time
+}
+
+// NewDNSCache creates a new DNSCache with the given maximum number of hosts
+// and TTL clamps. Zero values use the defaults, and maxTTL is capped to
+// MaxDNSCacheTTL. The dialer is used to connect to the addresses.
+func NewDNSCache(maxSize int, minTTL, maxTTL time.Duration, dialer *net.Dialer) *DNSCache {
+	if maxSize <= 0 {
+		maxSize = DefaultDNSCacheMaxSize
+	}
+	if minTTL <= 0 {
+		minTTL = DefaultDNSCacheMinTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = DefaultDNSCacheMaxTTL
+	}
+	if maxTTL > MaxDNSCacheTTL {
+		maxTTL = MaxDNSCacheTTL
+	}
+	if minTTL > maxTTL {
+		minTTL = maxTTL
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: 30 * time.Second}
+	}
+	return &DNSCache{
+		entries: make(map[string]*dnsCacheEntry),
+		maxSize: maxSize,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		dialer:  dialer,
+		lookup:  newTTLResolver(dialer).LookupIPAddr,
+		now:     time.Now,
+	}
+}
+
+// LookupIPAddr returns the IP addresses of the host, from the cache if they
+// have not expired.
+func (c *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	now := c.now()
+
+	c.mu.Lock()
+	if e, ok := c.entries[host]; ok {
+		if now.Before(e.expires) {
+			c.mu.Unlock()
+			return e.addrs, nil
+		}
+		delete(c.entries, host)
+	}
+	c.mu.Unlock()
+
+	addrs, ttl, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The TTL counts from the time of the lookup.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxSize {
+		c.evict(now)
+	}
+	c.entries[host] = &dnsCacheEntry{
+		addrs:   addrs,
+		expires: now.Add(c.clampTTL(ttl)),
+	}
+	return addrs, nil
+}
+
+// clampTTL returns the TTL between the minimum and maximum TTL, an unknown
+// TTL uses the minimum one.
+func (c *DNSCache) clampTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl < c.minTTL:
+		return c.minTTL
+	case ttl > c.maxTTL:
+		return c.maxTTL
+	default:
+		return ttl
+	}
+}
+
+// evict removes the expired entries, and if the cache is still full, the
+// entry that expires first. It must be called with the lock held.
+func (c *DNSCache) evict(now time.Time) {
+	var next string
+	var nextExpires time.Time
+	for host, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, host)
+			continue
+		}
+		if next == "" || e.expires.Before(nextExpires) {
+			next, nextExpires = host, e.expires
+		}
+	}
+	if len(c.entries) >= c.maxSize {
+		delete(c.entries, next)
+	}
+}
+
+// DialContext connects to the address on the named network resolving the
+// host with the cache. The addresses of the host are tried in order until one
+// of them succeeds.
+func (c *DNSCache) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := c.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		switch {
+		case strings.HasSuffix(network, "4") && addr.IP.To4() == nil:
+			continue
+		case strings.HasSuffix(network, "6") && addr.IP.To4() != nil:
+			continue
+		}
+		conn, err := c.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return nil, firstErr
+}
+
+// TLSDial connects to the address on the named network using TLS, resolving
+// the host with the cache. The config must include the ServerName.
+func (c *DNSCache) TLSDial(network, addr string, config *tls.Config) (*tls.Conn, error) {
+	ctx := context.Background()
+	if c.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dialer.Timeout)
+		defer cancel()
+	}
+	rawConn, err := c.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		rawConn.SetDeadline(deadline)
+	}
+	conn := tls.Client(rawConn, config)
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	rawConn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// ttlRecorderKey is the context key used to pass a ttlRecorder to the dial
+// function of the ttlResolver.
+type ttlRecorderKey struct{}
+
+// ttlRecorder keeps the lowest TTL of the address records in the DNS
+// responses of a lookup.
+type ttlRecorder struct {
+	mu    sync.Mutex
+	ttl   uint32
+	found bool
+}
+
+// record parses a DNS response and records the TTL of its A, AAAA and CNAME
+// answers.
+func (r *ttlRecorder) record(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		switch h.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+			r.mu.Lock()
+			if !r.found || h.TTL < r.ttl {
+				r.ttl, r.found = h.TTL, true
+			}
+			r.mu.Unlock()
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// duration returns the recorded TTL, or 0 if no TTL was recorded.
+func (r *ttlRecorder) duration() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Duration(r.ttl) * time.Second
+}
+
+// ttlUDPConn is a UDP connection to a DNS server that records the TTLs of the
+// responses.
+type ttlUDPConn struct {
+	*net.UDPConn
+	recorder *ttlRecorder
+}
+
+func (c *ttlUDPConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil {
+		c.recorder.record(b[:n])
+	}
+	return n, err
+}
+
+// ttlResolver is a resolver that returns the TTL of the address records with
+// the addresses. The Go resolver does not expose the TTLs, so they are read
+// from the UDP responses of the DNS servers. The TTL is unknown, and 0 is
+// returned, if the host is in the hosts file, or the responses are received
+// using TCP.
+type ttlResolver struct {
+	resolver *net.Resolver
+}
+
+func newTTLResolver(dialer *net.Dialer) *ttlResolver {
+	return &ttlResolver{
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+				recorder, ok := ctx.Value(ttlRecorderKey{}).(*ttlRecorder)
+				if udpConn, isUDP := conn.(*net.UDPConn); ok && isUDP {
+					return &ttlUDPConn{UDPConn: udpConn, recorder: recorder}, nil
+				}
+				return conn, nil
+			},
+		},
+	}
+}
+
+// LookupIPAddr returns the IP addresses of the host, and the lowest TTL of the
+// records in the responses.
+func (r *ttlResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	recorder := new(ttlRecorder)
+	addrs, err := r.resolver.LookupIPAddr(context.WithValue(ctx, ttlRecorderKey{}, recorder), host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return addrs, recorder.duration(), nil
+}
@@ -0,0 +1,253 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newTestDNSCache returns a DNSCache using a fake resolver that returns
+// 127.0.0.1 with the given TTL, and a clock that can be moved.
+func newTestDNSCache(maxSize int, minTTL, maxTTL, ttl time.Duration) (*DNSCache, *int32, *time.Time) {
+	var lookups int32
+	now := time.Now()
+	c := NewDNSCache(maxSize, minTTL, maxTTL, nil)
+	c.lookup = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+		atomic.AddInt32(&lookups, 1)
+		if host == "fail.test" {
+			return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, ttl, nil
+	}
+	c.now = func() time.Time {
+		return now
+	}
+	return c, &lookups, &now
+}
+
+func TestNewDNSCache(t *testing.T) {
+	tests := []struct {
+		name                   string
+		maxSize                int
+		minTTL, maxTTL         time.Duration
+		wantSize               int
+		wantMinTTL, wantMaxTTL time.Duration
+	}{
+		{"defaults", 0, 0, 0, DefaultDNSCacheMaxSize, DefaultDNSCacheMinTTL, DefaultDNSCacheMaxTTL},
+		{"ok", 10, time.Second, time.Minute, 10, time.Second, time.Minute},
+		{"max-ttl", 10, time.Second, 24 * time.Hour, 10, time.Second, MaxDNSCacheTTL},
+		{"min-ttl", 10, time.Hour, time.Minute, 10, time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDNSCache(tt.maxSize, tt.minTTL, tt.maxTTL, nil)
+			assert.Equals(t, c.maxSize, tt.wantSize)
+			assert.Equals(t, c.minTTL, tt.wantMinTTL)
+			assert.Equals(t, c.maxTTL, tt.wantMaxTTL)
+		})
+	}
+}
+
+func TestDNSCache_LookupIPAddr(t *testing.T) {
+	ctx := context.Background()
+	c, lookups, now := newTestDNSCache(10, time.Second, time.Minute, 30*time.Second)
+
+	addrs, err := c.LookupIPAddr(ctx, "example.test")
+	assert.FatalError(t, err)
+	assert.Equals(t, addrs, []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}})
+	assert.Equals(t, *lookups, int32(1))
+
+	// Cached, the host is case insensitive.
+	*now = now.Add(29 * time.Second)
+	_, err = c.LookupIPAddr(ctx, "EXAMPLE.test.")
+	assert.FatalError(t, err)
+	assert.Equals(t, *lookups, int32(1))
+
+	// Stale entries are not used past the TTL.
+	*now = now.Add(time.Second)
+	_, err = c.LookupIPAddr(ctx, "example.test")
+	assert.FatalError(t, err)
+	assert.Equals(t, *lookups, int32(2))
+
+	// Failed lookups are not cached.
+	_, err = c.LookupIPAddr(ctx, "fail.test")
+	assert.NotNil(t, err)
+	_, err = c.LookupIPAddr(ctx, "fail.test")
+	assert.NotNil(t, err)
+	assert.Equals(t, *lookups, int32(4))
+}
+
+func TestDNSCache_LookupIPAddr_ttlClamps(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		wantTTL time.Duration
+	}{
+		{"unknown", 0, 5 * time.Second},
+		{"low", time.Second, 5 * time.Second},
+		{"ok", 10 * time.Second, 10 * time.Second},
+		{"high", time.Hour, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, lookups, now := newTestDNSCache(10, 5*time.Second, time.Minute, tt.ttl)
+			start := *now
+			_, err := c.LookupIPAddr(context.Background(), "example.test")
+			assert.FatalError(t, err)
+
+			*now = start.Add(tt.wantTTL - time.Millisecond)
+			_, err = c.LookupIPAddr(context.Background(), "example.test")
+			assert.FatalError(t, err)
+			assert.Equals(t, *lookups, int32(1))
+
+			*now = start.Add(tt.wantTTL)
+			_, err = c.LookupIPAddr(context.Background(), "example.test")
+			assert.FatalError(t, err)
+			assert.Equals(t, *lookups, int32(2))
+		})
+	}
+}
+
+func TestDNSCache_LookupIPAddr_maxSize(t *testing.T) {
+	ctx := context.Background()
+	c, lookups, now := newTestDNSCache(2, time.Second, time.Minute, 30*time.Second)
+
+	_, err := c.LookupIPAddr(ctx, "a.test")
+	assert.FatalError(t, err)
+	*now = now.Add(time.Second)
+	_, err = c.LookupIPAddr(ctx, "b.test")
+	assert.FatalError(t, err)
+	*now = now.Add(time.Second)
+	_, err = c.LookupIPAddr(ctx, "c.test")
+	assert.FatalError(t, err)
+	assert.Equals(t, len(c.entries), 2)
+	assert.Equals(t, *lookups, int32(3))
+
+	// a.test expires first, so it's the one evicted.
+	_, err = c.LookupIPAddr(ctx, "c.test")
+	assert.FatalError(t, err)
+	_, err = c.LookupIPAddr(ctx, "b.test")
+	assert.FatalError(t, err)
+	assert.Equals(t, *lookups, int32(3))
+	_, err = c.LookupIPAddr(ctx, "a.test")
+	assert.FatalError(t, err)
+	assert.Equals(t, *lookups, int32(4))
+	assert.Equals(t, len(c.entries), 2)
+}
+
+func TestDNSCache_DialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	assert.FatalError(t, err)
+
+	ctx := context.Background()
+	c, lookups, _ := newTestDNSCache(10, time.Second, time.Minute, 30*time.Second)
+	for i := 0; i < 3; i++ {
+		conn, err := c.DialContext(ctx, "tcp", net.JoinHostPort("example.test", port))
+		assert.FatalError(t, err)
+		assert.Equals(t, conn.RemoteAddr().String(), ln.Addr().String())
+		conn.Close()
+	}
+	assert.Equals(t, *lookups, int32(1))
+
+	// IP addresses are not resolved.
+	conn, err := c.DialContext(ctx, "tcp", ln.Addr().String())
+	assert.FatalError(t, err)
+	conn.Close()
+	assert.Equals(t, *lookups, int32(1))
+
+	// No IPv6 addresses.
+	_, err = c.DialContext(ctx, "tcp6", net.JoinHostPort("example.test", port))
+	var dnsErr *net.DNSError
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.Equals(t, dnsErr.Err, "no suitable address found")
+	}
+
+	_, err = c.DialContext(ctx, "tcp", net.JoinHostPort("fail.test", port))
+	assert.NotNil(t, err)
+}
+
+func Test_ttlRecorder_record(t *testing.T) {
+	name := dnsmessage.MustNewName("example.test.")
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	assert.FatalError(t, b.StartQuestions())
+	assert.FatalError(t, b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	assert.FatalError(t, b.StartAnswers())
+	assert.FatalError(t, b.CNAMEResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 300},
+		dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("www.example.test.")}))
+	assert.FatalError(t, b.AResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("www.example.test."), Class: dnsmessage.ClassINET, TTL: 60},
+		dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}))
+	msg, err := b.Finish()
+	assert.FatalError(t, err)
+
+	r := new(ttlRecorder)
+	assert.Equals(t, r.duration(), time.Duration(0))
+	r.record([]byte("not a dns message"))
+	assert.Equals(t, r.duration(), time.Duration(0))
+	r.record(msg)
+	assert.Equals(t, r.duration(), time.Minute)
+}
+
+// BenchmarkDNSCache_DialContext compares the number of lookups done dialing
+// the same hosts with and without the cache.
+func BenchmarkDNSCache_DialContext(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	hosts := []string{"a.test", "b.test", "c.test", "d.test"}
+
+	run := func(b *testing.B, maxSize int, ttl time.Duration) {
+		var lookups int32
+		c := NewDNSCache(maxSize, ttl, ttl, nil)
+		c.lookup = func(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+			atomic.AddInt32(&lookups, 1)
+			return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, ttl, nil
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			conn, err := c.DialContext(context.Background(), "tcp", net.JoinHostPort(hosts[i%len(hosts)], port))
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.Close()
+		}
+		b.ReportMetric(float64(lookups)/float64(b.N), "lookups/op")
+	}
+
+	b.Run("cache", func(b *testing.B) {
+		run(b, DefaultDNSCacheMaxSize, time.Minute)
+	})
+	b.Run("no-cache", func(b *testing.B) {
+		// With a TTL of one nanosecond every entry is expired when used.
+		run(b, DefaultDNSCacheMaxSize, time.Nanosecond)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/errs"
@@ -264,12 +265,51 @@ var (
 	}
 )
 
+// ParseProblemType returns the ProblemType with the given name, e.g.
+// "unauthorized", and false if it is not a known ACME problem type.
+func ParseProblemType(name string) (ProblemType, bool) {
+	for pt := ErrorAccountDoesNotExistType; pt <= ErrorNotImplementedType; pt++ {
+		if pt.String() == name {
+			return pt, true
+		}
+	}
+	return 0, false
+}
+
+// ParseErrorStatusCodes parses and validates a map of ACME problem type names
+// and the HTTP status codes that will be used for them, e.g. {"unauthorized":
+// 403}. The status codes must be 4xx or 5xx codes.
+func ParseErrorStatusCodes(m map[string]int) (map[ProblemType]int, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	codes := make(map[ProblemType]int, len(m))
+	for _, name := range names {
+		pt, ok := ParseProblemType(name)
+		if !ok {
+			return nil, errors.Errorf("unsupported ACME problem type %s", name)
+		}
+		if code := m[name]; code < 400 || code > 599 {
+			return nil, errors.Errorf("status code %d of ACME problem type %s is not a 4xx or 5xx code", code, name)
+		}
+		codes[pt] = m[name]
+	}
+	return codes, nil
+}
+
 // Error represents an ACME
 type Error struct {
 	Type        string        `json:"type"`
 	Detail      string        `json:"detail"`
 	Subproblems []interface{} `json:"subproblems,omitempty"`
 	Identifier  interface{}   `json:"identifier,omitempty"`
+	RequestID   string        `json:"requestId,omitempty"`
 	Err         error         `json:"-"`
 	Status      int           `json:"-"`
 }
@@ -299,6 +339,35 @@ func newError(pt ProblemType, err error) *Error {
 	}
 }
 
+// NewDetailedError creates a new Error type whose detail is the given message
+// instead of the generic description of the problem type. The message is sent
+// to the client, so it must not contain internal details.
+func NewDetailedError(pt ProblemType, msg string, args ...interface{}) *Error {
+	e := NewError(pt, msg, args...)
+	e.Detail = e.Err.Error()
+	return e
+}
+
+// WrapDetailedError wraps the error like WrapError, and uses the resulting
+// message as the detail of the Error, like NewDetailedError.
+func WrapDetailedError(typ ProblemType, err error, msg string, args ...interface{}) *Error {
+	e := WrapError(typ, err, msg, args...)
+	if e != nil {
+		e.Detail = e.Err.Error()
+	}
+	return e
+}
+
+// NewErrorWithStatus creates a new Error type like NewDetailedError, with the
+// given HTTP status code instead of the default one of the problem type. The
+// status codes configured for the problem type still replace it, see
+// WithStatusCodes.
+func NewErrorWithStatus(pt ProblemType, status int, msg string, args ...interface{}) *Error {
+	e := NewDetailedError(pt, msg, args...)
+	e.Status = status
+	return e
+}
+
 // NewErrorISE creates a new ErrorServerInternalType Error.
 func NewErrorISE(msg string, args ...interface{}) *Error {
 	return NewError(ErrorServerInternalType, msg, args...)
@@ -331,6 +400,36 @@ func (e *Error) StatusCode() int {
 	return e.Status
 }
 
+// ProblemType returns the ProblemType of the error, and false if its type is
+// not a known ACME problem type.
+func (e *Error) ProblemType() (ProblemType, bool) {
+	for pt, meta := range errorMap {
+		if meta.typ == e.Type {
+			return pt, true
+		}
+	}
+	return 0, false
+}
+
+// WithStatusCodes returns a copy of the error with the HTTP status code that
+// codes has for its problem type, e.g. the status codes parsed with
+// ParseErrorStatusCodes. If there is none, the error is returned unchanged.
+func (e *Error) WithStatusCodes(codes map[ProblemType]int) *Error {
+	if len(codes) == 0 {
+		return e
+	}
+	pt, ok := e.ProblemType()
+	if !ok {
+		return e
+	}
+	if code, ok := codes[pt]; ok && code != e.Status {
+		ae := *e
+		ae.Status = code
+		return &ae
+	}
+	return e
+}
+
 // Error allows AError to implement the error interface.
 func (e *Error) Error() string {
 	return e.Detail
@@ -354,7 +453,7 @@ func (e *Error) ToLog() (interface{}, error) {
 }
 
 // WriteError writes to w a JSON representation of the given error.
-func WriteError(w http.ResponseWriter, err *Error) {
+func WriteError(w http.ResponseWriter, r *http.Request, err *Error) {
 	w.Header().Set("Content-Type", "application/problem+json")
 	w.WriteHeader(err.StatusCode())
 
@@ -372,6 +471,14 @@ func WriteError(w http.ResponseWriter, err *Error) {
 		}
 	}
 
+	// Add the request id as an extension field of the problem document, so it
+	// can be correlated with the logs.
+	if id, ok := logging.GetRequestID(r.Context()); ok {
+		e := *err
+		e.RequestID = id
+		err = &e
+	}
+
 	if err := json.NewEncoder(w).Encode(err); err != nil {
 		log.Println(err)
 	}
@@ -0,0 +1,96 @@
+package acme
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/logging"
+)
+
+func TestWriteError_requestID(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		ae := NewError(ErrorMalformedType, "bad request")
+		r := httptest.NewRequest("GET", "/acme/new-order", nil)
+		r = r.WithContext(logging.WithRequestID(r.Context(), "reqID"))
+		w := httptest.NewRecorder()
+		WriteError(w, r, ae)
+
+		res := w.Result()
+		assert.Equals(t, res.StatusCode, 400)
+		assert.Equals(t, res.Header.Get("Content-Type"), "application/problem+json")
+		var body map[string]interface{}
+		assert.FatalError(t, json.NewDecoder(res.Body).Decode(&body))
+		assert.Equals(t, body["type"], "urn:ietf:params:acme:error:malformed")
+		assert.Equals(t, body["requestId"], "reqID")
+		// The error is not modified.
+		assert.Equals(t, ae.RequestID, "")
+	})
+
+	t.Run("ok/no-request-id", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/acme/new-order", nil)
+		w := httptest.NewRecorder()
+		WriteError(w, r, NewError(ErrorMalformedType, "bad request"))
+
+		var body map[string]interface{}
+		assert.FatalError(t, json.NewDecoder(w.Result().Body).Decode(&body))
+		_, ok := body["requestId"]
+		assert.False(t, ok)
+	})
+}
+
+func TestParseErrorStatusCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		codes   map[string]int
+		want    map[ProblemType]int
+		wantErr string
+	}{
+		{"ok/nil", nil, nil, ""},
+		{"ok", map[string]int{"unauthorized": 401, "rateLimited": 503}, map[ProblemType]int{
+			ErrorUnauthorizedType: 401,
+			ErrorRateLimitedType:  503,
+		}, ""},
+		{"fail/type", map[string]int{"unauthorized": 401, "foo": 400}, nil, "unsupported ACME problem type foo"},
+		{"fail/code", map[string]int{"malformed": 302}, nil, "status code 302 of ACME problem type malformed is not a 4xx or 5xx code"},
+		{"fail/code-range", map[string]int{"serverInternal": 600}, nil, "status code 600 of ACME problem type serverInternal is not a 4xx or 5xx code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseErrorStatusCodes(tt.codes)
+			if tt.wantErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Equals(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, got, tt.want)
+		})
+	}
+}
+
+func TestError_WithStatusCodes(t *testing.T) {
+	codes := map[ProblemType]int{ErrorUnauthorizedType: 403, ErrorMalformedType: 422}
+
+	// Defaults of RFC 8555
+	assert.Equals(t, NewError(ErrorUnauthorizedType, "unauthorized").Status, 401)
+	assert.Equals(t, NewError(ErrorUnauthorizedType, "unauthorized").WithStatusCodes(nil).Status, 401)
+
+	ae := NewError(ErrorUnauthorizedType, "unauthorized")
+	assert.Equals(t, ae.WithStatusCodes(codes).Status, 403)
+	// The error is not modified.
+	assert.Equals(t, ae.Status, 401)
+	assert.Equals(t, WrapError(ErrorUnauthorizedType, errors.New("force"), "unauthorized").WithStatusCodes(codes).Status, 403)
+	assert.Equals(t, NewErrorISE("internal").WithStatusCodes(codes).Status, 500)
+
+	// The status codes replace the ones given to the constructor.
+	assert.Equals(t, NewErrorWithStatus(ErrorMalformedType, 404, "not found").Status, 404)
+	assert.Equals(t, NewErrorWithStatus(ErrorMalformedType, 404, "not found").WithStatusCodes(codes).Status, 422)
+
+	// Unknown types are not modified.
+	ae = &Error{Type: "urn:example:error", Status: 400}
+	assert.Equals(t, ae.WithStatusCodes(codes), ae)
+}
@@ -0,0 +1,193 @@
+package acme
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Default values used by the GC if they are not configured.
+const (
+	DefaultGCInterval  = time.Hour
+	DefaultGCRetention = 24 * time.Hour
+	DefaultGCBatchSize = 100
+)
+
+// Default values used by the nonce sweeper if they are not configured.
+const (
+	DefaultNonceSweepInterval = 5 * time.Minute
+	DefaultNonceMaxAge        = time.Hour
+)
+
+// GCOptions are the options used to configure a GC. Interval is the time
+// between passes, Retention is the time that expired objects are kept before
+// they are deleted, and BatchSize is the maximum number of objects deleted in
+// one operation. The default values are used if Interval or BatchSize are not
+// set.
+type GCOptions struct {
+	Interval  time.Duration
+	Retention time.Duration
+	BatchSize int
+}
+
+// NonceSweeperOptions are the options used to configure a nonce sweeper.
+// Interval is the time between sweeps, MaxAge is the time an unused nonce is
+// kept, and BatchSize is the maximum number of nonces deleted in one
+// operation. The default values are used if they are not set.
+type NonceSweeperOptions struct {
+	Interval  time.Duration
+	MaxAge    time.Duration
+	BatchSize int
+}
+
+// deleteFunc deletes up to limit objects expired before the given time.
+type deleteFunc func(ctx context.Context, before time.Time, limit int) (int, error)
+
+// GC periodically deletes the expired ACME objects from a DB that implements
+// the GarbageCollector interface.
+type GC struct {
+	deleters  []deleteFunc
+	interval  time.Duration
+	retention time.Duration
+	batchSize int
+	mu        sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewGC creates a new GC for the given DB. It returns false if the DB does not
+// implement the GarbageCollector interface.
+func NewGC(db DB, opts GCOptions) (*GC, bool) {
+	gcdb, ok := db.(GarbageCollector)
+	if !ok {
+		return nil, false
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultGCInterval
+	}
+	if opts.Retention < 0 {
+		opts.Retention = 0
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultGCBatchSize
+	}
+	return &GC{
+		// Orders are deleted first, as they reference the authorizations.
+		deleters: []deleteFunc{
+			gcdb.DeleteExpiredOrders,
+			gcdb.DeleteExpiredAuthorizations,
+			gcdb.DeleteExpiredNonces,
+		},
+		interval:  opts.Interval,
+		retention: opts.Retention,
+		batchSize: opts.BatchSize,
+	}, true
+}
+
+// NewNonceSweeper creates a GC that only deletes the nonces, so they can be
+// deleted more often than the rest of the objects. A nonce is only deleted if
+// it was created more than MaxAge ago, so the nonces created during a sweep
+// are never deleted. It returns false if the DB does not implement the
+// GarbageCollector interface.
+func NewNonceSweeper(db DB, opts NonceSweeperOptions) (*GC, bool) {
+	gcdb, ok := db.(GarbageCollector)
+	if !ok {
+		return nil, false
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultNonceSweepInterval
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = DefaultNonceMaxAge
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultGCBatchSize
+	}
+	return &GC{
+		deleters:  []deleteFunc{gcdb.DeleteExpiredNonces},
+		interval:  opts.Interval,
+		retention: opts.MaxAge,
+		batchSize: opts.BatchSize,
+	}, true
+}
+
+// Run starts the GC in the background. A pass is done every interval until
+// Stop is called.
+func (gc *GC) Run() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.stop != nil {
+		return
+	}
+	gc.stop, gc.done = make(chan struct{}), make(chan struct{})
+	go gc.loop(gc.stop, gc.done)
+}
+
+// Stop stops the GC and waits for the current pass, if any, to finish.
+func (gc *GC) Stop() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.stop == nil {
+		return
+	}
+	close(gc.stop)
+	<-gc.done
+	gc.stop, gc.done = nil, nil
+}
+
+func (gc *GC) loop(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			gc.collect(stop)
+		}
+	}
+}
+
+// collect does a GC pass that is canceled if the GC is stopped.
+func (gc *GC) collect(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	n, err := gc.Collect(ctx)
+	if err != nil {
+		log.Printf("error deleting expired ACME objects: %v", err)
+	}
+	if n > 0 {
+		log.Printf("deleted %d expired ACME objects", n)
+	}
+}
+
+// Collect does a GC pass, deleting in batches all the orders, authorizations
+// with their challenges and nonces expired before the retention period. A
+// nonce sweeper only deletes the nonces. It returns the number of deleted
+// objects.
+func (gc *GC) Collect(ctx context.Context) (int, error) {
+	before := clock.Now().Add(-gc.retention)
+	var total int
+	for _, fn := range gc.deleters {
+		for {
+			n, err := fn(ctx, before, gc.batchSize)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			if n < gc.batchSize {
+				break
+			}
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,258 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+type mockGCDB struct {
+	MockDB
+	deleteExpiredOrders         func(ctx context.Context, before time.Time, limit int) (int, error)
+	deleteExpiredAuthorizations func(ctx context.Context, before time.Time, limit int) (int, error)
+	deleteExpiredNonces         func(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+func (m *mockGCDB) DeleteExpiredOrders(ctx context.Context, before time.Time, limit int) (int, error) {
+	return m.deleteExpiredOrders(ctx, before, limit)
+}
+
+func (m *mockGCDB) DeleteExpiredAuthorizations(ctx context.Context, before time.Time, limit int) (int, error) {
+	return m.deleteExpiredAuthorizations(ctx, before, limit)
+}
+
+func (m *mockGCDB) DeleteExpiredNonces(ctx context.Context, before time.Time, limit int) (int, error) {
+	return m.deleteExpiredNonces(ctx, before, limit)
+}
+
+// batches returns a delete function that deletes n objects in batches.
+func batches(t *testing.T, n int, calls *[]string, name string, retention time.Duration) func(ctx context.Context, before time.Time, limit int) (int, error) {
+	return func(ctx context.Context, before time.Time, limit int) (int, error) {
+		expected := clock.Now().Add(-retention)
+		assert.True(t, before.After(expected.Add(-time.Minute)))
+		assert.True(t, before.Before(expected.Add(time.Minute)))
+		*calls = append(*calls, name)
+		if n < limit {
+			limit = n
+		}
+		n -= limit
+		return limit, nil
+	}
+}
+
+func TestNewGC(t *testing.T) {
+	gc, ok := NewGC(&MockDB{}, GCOptions{})
+	assert.False(t, ok)
+	assert.Nil(t, gc)
+
+	gc, ok = NewGC(&mockGCDB{}, GCOptions{Retention: -time.Hour})
+	assert.True(t, ok)
+	assert.Equals(t, gc.interval, DefaultGCInterval)
+	assert.Equals(t, gc.retention, time.Duration(0))
+	assert.Equals(t, gc.batchSize, DefaultGCBatchSize)
+
+	gc, ok = NewGC(&mockGCDB{}, GCOptions{Interval: time.Minute, Retention: time.Hour, BatchSize: 10})
+	assert.True(t, ok)
+	assert.Equals(t, gc.interval, time.Minute)
+	assert.Equals(t, gc.retention, time.Hour)
+	assert.Equals(t, gc.batchSize, 10)
+}
+
+func TestGC_Collect(t *testing.T) {
+	type test struct {
+		db    *mockGCDB
+		calls []string
+		want  int
+		err   error
+	}
+	var calls []string
+	var tests = map[string]func(t *testing.T) test{
+		"ok/batches": func(t *testing.T) test {
+			calls = nil
+			return test{
+				db: &mockGCDB{
+					deleteExpiredOrders:         batches(t, 25, &calls, "orders", time.Hour),
+					deleteExpiredAuthorizations: batches(t, 10, &calls, "authzs", time.Hour),
+					deleteExpiredNonces:         batches(t, 0, &calls, "nonces", time.Hour),
+				},
+				calls: []string{"orders", "orders", "orders", "authzs", "authzs", "nonces"},
+				want:  35,
+			}
+		},
+		"fail/authzs-error": func(t *testing.T) test {
+			calls = nil
+			return test{
+				db: &mockGCDB{
+					deleteExpiredOrders: batches(t, 5, &calls, "orders", time.Hour),
+					deleteExpiredAuthorizations: func(ctx context.Context, before time.Time, limit int) (int, error) {
+						calls = append(calls, "authzs")
+						return 0, errors.New("force")
+					},
+				},
+				calls: []string{"orders", "authzs"},
+				want:  5,
+				err:   errors.New("force"),
+			}
+		},
+	}
+	for name, run := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc := run(t)
+			gc, ok := NewGC(tc.db, GCOptions{Retention: time.Hour, BatchSize: 10})
+			assert.Fatal(t, ok)
+			got, err := gc.Collect(context.Background())
+			if tc.err != nil {
+				if assert.NotNil(t, err) {
+					assert.Equals(t, err.Error(), tc.err.Error())
+				}
+			} else {
+				assert.FatalError(t, err)
+			}
+			assert.Equals(t, got, tc.want)
+			assert.Equals(t, calls, tc.calls)
+		})
+	}
+}
+
+func TestGC_RunStop(t *testing.T) {
+	passes := make(chan struct{}, 10)
+	db := &mockGCDB{
+		deleteExpiredOrders: func(ctx context.Context, before time.Time, limit int) (int, error) {
+			passes <- struct{}{}
+			return 0, nil
+		},
+		deleteExpiredAuthorizations: func(ctx context.Context, before time.Time, limit int) (int, error) {
+			return 0, nil
+		},
+		deleteExpiredNonces: func(ctx context.Context, before time.Time, limit int) (int, error) {
+			return 0, nil
+		},
+	}
+	gc, ok := NewGC(db, GCOptions{Interval: 10 * time.Millisecond})
+	assert.Fatal(t, ok)
+
+	// Stop before Run is a no-op.
+	gc.Stop()
+
+	gc.Run()
+	gc.Run()
+	select {
+	case <-passes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GC pass not executed")
+	}
+	gc.Stop()
+	gc.Stop()
+
+	// Drain and check that no more passes are executed.
+	for len(passes) > 0 {
+		<-passes
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equals(t, len(passes), 0)
+}
+
+// memNonceDB is a GarbageCollector that keeps the creation time of the nonces
+// in memory. Only DeleteExpiredNonces can be used.
+type memNonceDB struct {
+	mockGCDB
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func (m *memNonceDB) create(id string, createdAt time.Time) {
+	m.mu.Lock()
+	m.nonces[id] = createdAt
+	m.mu.Unlock()
+}
+
+func (m *memNonceDB) exists(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.nonces[id]
+	return ok
+}
+
+func (m *memNonceDB) DeleteExpiredNonces(ctx context.Context, before time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int
+	for id, createdAt := range m.nonces {
+		if n == limit {
+			break
+		}
+		if createdAt.Before(before) {
+			delete(m.nonces, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestNewNonceSweeper(t *testing.T) {
+	gc, ok := NewNonceSweeper(&MockDB{}, NonceSweeperOptions{})
+	assert.False(t, ok)
+	assert.Nil(t, gc)
+
+	gc, ok = NewNonceSweeper(&mockGCDB{}, NonceSweeperOptions{MaxAge: -time.Hour})
+	assert.True(t, ok)
+	assert.Equals(t, gc.interval, DefaultNonceSweepInterval)
+	assert.Equals(t, gc.retention, DefaultNonceMaxAge)
+	assert.Equals(t, gc.batchSize, DefaultGCBatchSize)
+	assert.Equals(t, len(gc.deleters), 1)
+
+	gc, ok = NewNonceSweeper(&mockGCDB{}, NonceSweeperOptions{Interval: time.Minute, MaxAge: 10 * time.Minute, BatchSize: 10})
+	assert.True(t, ok)
+	assert.Equals(t, gc.interval, time.Minute)
+	assert.Equals(t, gc.retention, 10*time.Minute)
+	assert.Equals(t, gc.batchSize, 10)
+}
+
+func TestNonceSweeper_Collect(t *testing.T) {
+	now := clock.Now()
+	db := &memNonceDB{nonces: make(map[string]time.Time)}
+	for i := 0; i < 50; i++ {
+		db.create(fmt.Sprintf("expired-%d", i), now.Add(-2*time.Hour))
+		db.create(fmt.Sprintf("valid-%d", i), now.Add(-30*time.Minute))
+	}
+
+	// The orders and authorizations deleters of the mockGCDB are not set, so
+	// the sweep would panic if it tried to delete them.
+	gc, ok := NewNonceSweeper(db, NonceSweeperOptions{MaxAge: time.Hour, BatchSize: 1})
+	assert.Fatal(t, ok)
+
+	// Create nonces while the sweep is running.
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 10; j++ {
+				db.create(fmt.Sprintf("new-%d-%d", i, j), clock.Now())
+			}
+		}(i)
+	}
+	close(start)
+	n, err := gc.Collect(context.Background())
+	wg.Wait()
+	assert.FatalError(t, err)
+	assert.Equals(t, n, 50)
+
+	for i := 0; i < 50; i++ {
+		assert.False(t, db.exists(fmt.Sprintf("expired-%d", i)))
+		assert.True(t, db.exists(fmt.Sprintf("valid-%d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			assert.True(t, db.exists(fmt.Sprintf("new-%d-%d", i, j)))
+		}
+	}
+	assert.Equals(t, len(db.nonces), 150)
+}
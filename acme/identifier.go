@@ -0,0 +1,69 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.step.sm/crypto/x509util"
+)
+
+// IdentifierAuthorizer authorizes the identifiers of a custom type. The dns
+// and ip identifiers are always handled by the ACME server, an
+// IdentifierAuthorizer registered with Registry.RegisterIdentifierAuthorizer
+// adds a new identifier type, with its own challenges, to the new-order and
+// challenge endpoints.
+type IdentifierAuthorizer interface {
+	// ValidateIdentifier returns an error if the value is not a valid
+	// identifier of the type. It's called for every identifier of the type in
+	// a new order.
+	ValidateIdentifier(value string) error
+	// ChallengeTypes returns the types of the challenges offered for the
+	// identifiers of the type. They cannot be standard challenge types.
+	ChallengeTypes() []ChallengeType
+	// ValidateChallenge validates a challenge of one of the types returned by
+	// ChallengeTypes, keyAuthorization is the key authorization of the
+	// challenge for the account key. It returns nil if the challenge is valid.
+	// If it returns an *Error the challenge is marked as invalid, other errors
+	// are stored in the challenge but it remains pending so the client can
+	// retry it.
+	ValidateChallenge(ctx context.Context, ch *Challenge, keyAuthorization string) error
+	// SubjectAlternativeName returns the subject alternative name that binds
+	// the identifier to the certificate issued for the order, e.g. a uri. The
+	// identifiers of the type are not part of the CSR, so without it the
+	// certificate would not contain the authorized identity.
+	SubjectAlternativeName(value string) (x509util.SubjectAlternativeName, error)
+}
+
+func hasChallengeType(a IdentifierAuthorizer, typ ChallengeType) bool {
+	for _, t := range a.ChallengeTypes() {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// customValidate validates a challenge of a custom identifier type using its
+// IdentifierAuthorizer.
+func customValidate(ctx context.Context, ch *Challenge, db DB, a IdentifierAuthorizer, keyAuth string) error {
+	if err := a.ValidateChallenge(ctx, ch, keyAuth); err != nil {
+		var ae *Error
+		if errors.As(err, &ae) {
+			return storeError(ctx, db, ch, true, ae)
+		}
+		return storeError(ctx, db, ch, false, WrapError(ErrorConnectionType, err,
+			"error validating %s challenge for %s", ch.Type, ch.Value))
+	}
+
+	// Update and store the challenge.
+	ch.Status = StatusValid
+	ch.Error = nil
+	ch.ValidatedAt = clock.Now().Format(time.RFC3339)
+	ch.recordAttempt(nil)
+
+	if err := db.UpdateChallenge(ctx, ch); err != nil {
+		return WrapErrorISE(err, "error updating challenge")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"go.step.sm/crypto/jose"
+	"go.step.sm/crypto/x509util"
+)
+
+// mockIdentifierAuthorizer is an IdentifierAuthorizer that validates the
+// challenges using validate.
+type mockIdentifierAuthorizer struct {
+	challengeTypes []ChallengeType
+	validate       func(ch *Challenge, keyAuth string) error
+	san            func(value string) (x509util.SubjectAlternativeName, error)
+}
+
+func (m *mockIdentifierAuthorizer) ValidateIdentifier(value string) error {
+	if value == "" {
+		return errors.New("value cannot be empty")
+	}
+	return nil
+}
+
+func (m *mockIdentifierAuthorizer) ChallengeTypes() []ChallengeType {
+	return m.challengeTypes
+}
+
+func (m *mockIdentifierAuthorizer) ValidateChallenge(ctx context.Context, ch *Challenge, keyAuth string) error {
+	return m.validate(ch, keyAuth)
+}
+
+func (m *mockIdentifierAuthorizer) SubjectAlternativeName(value string) (x509util.SubjectAlternativeName, error) {
+	if m.san != nil {
+		return m.san(value)
+	}
+	return x509util.SubjectAlternativeName{Type: x509util.URIType, Value: "urn:asset:" + value}, nil
+}
+
+func TestRegistry_RegisterIdentifierAuthorizer(t *testing.T) {
+	reg := NewRegistry()
+	foo := &mockIdentifierAuthorizer{challengeTypes: []ChallengeType{"foo-01"}}
+	tests := []struct {
+		name string
+		typ  IdentifierType
+		a    IdentifierAuthorizer
+		err  string
+	}{
+		{"ok", "foo", foo, ""},
+		{"ok/other", "bar", &mockIdentifierAuthorizer{challengeTypes: []ChallengeType{"bar-01", "bar-02"}}, ""},
+		{"fail/registered", "foo", foo, "the authorizer of foo identifiers is already registered"},
+		{"fail/dns", DNS, foo, "the authorizer of dns identifiers cannot be changed"},
+		{"fail/ip", IP, foo, "the authorizer of ip identifiers cannot be changed"},
+		{"fail/standard-challenge", "zar", &mockIdentifierAuthorizer{challengeTypes: []ChallengeType{HTTP01}}, "zar identifiers cannot use the standard challenge http-01"},
+		{"fail/used-challenge", "zar", &mockIdentifierAuthorizer{challengeTypes: []ChallengeType{"zar-01", "foo-01"}}, "challenge foo-01 is already used by foo identifiers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := reg.RegisterIdentifierAuthorizer(tt.typ, tt.a)
+			if tt.err != "" {
+				if assert.NotNil(t, err) {
+					assert.Equals(t, err.Error(), tt.err)
+				}
+				if tt.typ != "foo" {
+					_, ok := reg.IdentifierAuthorizer(tt.typ)
+					assert.False(t, ok)
+				}
+				return
+			}
+			assert.FatalError(t, err)
+			a, ok := reg.IdentifierAuthorizer(tt.typ)
+			assert.True(t, ok)
+			assert.Equals(t, a, tt.a)
+		})
+	}
+
+	a, ok := reg.challengeAuthorizer("bar-02")
+	assert.True(t, ok)
+	assert.Equals(t, a.ChallengeTypes(), []ChallengeType{"bar-01", "bar-02"})
+	_, ok = reg.challengeAuthorizer(HTTP01)
+	assert.False(t, ok)
+
+	// The registries are independent and a nil registry is empty.
+	_, ok = NewRegistry().IdentifierAuthorizer("foo")
+	assert.False(t, ok)
+	_, ok = (*Registry)(nil).challengeAuthorizer("bar-02")
+	assert.False(t, ok)
+}
+
+func TestChallenge_Validate_customIdentifier(t *testing.T) {
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	assert.FatalError(t, err)
+	expKeyAuth, err := KeyAuthorization("token", jwk)
+	assert.FatalError(t, err)
+
+	var validateErr error
+	reg := NewRegistry()
+	assert.FatalError(t, reg.RegisterIdentifierAuthorizer("asset", &mockIdentifierAuthorizer{
+		challengeTypes: []ChallengeType{"asset-01"},
+		validate: func(ch *Challenge, keyAuth string) error {
+			assert.Equals(t, ch.Value, "asset-1234")
+			assert.Equals(t, keyAuth, expKeyAuth)
+			return validateErr
+		},
+	}))
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus Status
+		wantErr    *Error
+	}{
+		{"ok", nil, StatusValid, nil},
+		{"ok/rejected", NewError(ErrorUnauthorizedType, "asset is not owned by the account"), StatusInvalid,
+			NewError(ErrorUnauthorizedType, "asset is not owned by the account")},
+		{"ok/error", errors.New("force"), StatusPending,
+			NewError(ErrorConnectionType, "error validating asset-01 challenge for asset-1234: force")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validateErr = tt.err
+			var updated bool
+			ch := &Challenge{ID: "chID", Type: "asset-01", Token: "token", Value: "asset-1234", Status: StatusPending}
+			db := &MockDB{
+				MockUpdateChallenge: func(ctx context.Context, updch *Challenge) error {
+					updated = true
+					assert.Equals(t, updch.Status, tt.wantStatus)
+					return nil
+				},
+			}
+			assert.FatalError(t, ch.Validate(context.Background(), db, jwk, &ValidateChallengeOptions{Registry: reg}))
+			assert.True(t, updated)
+			assert.Equals(t, ch.Status, tt.wantStatus)
+			if tt.wantErr == nil {
+				assert.Nil(t, ch.Error)
+				assert.NotEquals(t, ch.ValidatedAt, "")
+			} else if assert.NotNil(t, ch.Error) {
+				assert.Equals(t, ch.Error.Type, tt.wantErr.Type)
+				assert.Equals(t, ch.Error.Err.Error(), tt.wantErr.Err.Error())
+			}
+		})
+	}
+
+	// Unknown challenge types are still rejected.
+	ch := &Challenge{ID: "chID", Type: "unknown-01", Status: StatusPending}
+	err = ch.Validate(context.Background(), &MockDB{}, jwk, &ValidateChallengeOptions{Registry: reg})
+	var ae *Error
+	if assert.True(t, errors.As(err, &ae)) {
+		assert.Equals(t, ae.Err.Error(), "unexpected challenge type 'unknown-01'")
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"net"
+	"net/http"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
 	"go.step.sm/crypto/x509util"
 )
 
@@ -27,6 +29,30 @@ type Identifier struct {
 	Value string         `json:"value"`
 }
 
+// SameIdentifiers returns true if a and b contain the same identifiers,
+// regardless of their order and duplicates.
+func SameIdentifiers(a, b []Identifier) bool {
+	contains := func(ids []Identifier, id Identifier) bool {
+		for _, v := range ids {
+			if v == id {
+				return true
+			}
+		}
+		return false
+	}
+	for _, id := range a {
+		if !contains(b, id) {
+			return false
+		}
+	}
+	for _, id := range b {
+		if !contains(a, id) {
+			return false
+		}
+	}
+	return true
+}
+
 // Order contains order metadata for the ACME protocol order type.
 type Order struct {
 	ID                string       `json:"id"`
@@ -64,6 +90,9 @@ func (o *Order) UpdateStatus(ctx context.Context, db DB) error {
 		return nil
 	case StatusValid:
 		return nil
+	case StatusProcessing:
+		// The order is being finalized.
+		return nil
 	case StatusReady:
 		// Check expiry
 		if now.After(o.ExpiresAt) {
@@ -81,9 +110,10 @@ func (o *Order) UpdateStatus(ctx context.Context, db DB) error {
 		}
 
 		var count = map[Status]int{
-			StatusValid:   0,
-			StatusInvalid: 0,
-			StatusPending: 0,
+			StatusValid:       0,
+			StatusInvalid:     0,
+			StatusPending:     0,
+			StatusDeactivated: 0,
 		}
 		for _, azID := range o.AuthorizationIDs {
 			az, err := db.GetAuthorization(ctx, azID)
@@ -97,7 +127,7 @@ func (o *Order) UpdateStatus(ctx context.Context, db DB) error {
 			count[st]++
 		}
 		switch {
-		case count[StatusInvalid] > 0:
+		case count[StatusInvalid] > 0 || count[StatusDeactivated] > 0:
 			o.Status = StatusInvalid
 
 		// No change in the order status, so just return the order as is -
@@ -121,8 +151,9 @@ func (o *Order) UpdateStatus(ctx context.Context, db DB) error {
 }
 
 // Finalize signs a certificate if the necessary conditions for Order completion
-// have been met.
-func (o *Order) Finalize(ctx context.Context, db DB, csr *x509.CertificateRequest, auth CertificateAuthority, p Provisioner) error {
+// have been met. The registry provides the authorizers of the custom
+// identifier types of the order, it can be nil.
+func (o *Order) Finalize(ctx context.Context, db DB, csr *x509.CertificateRequest, auth CertificateAuthority, p Provisioner, reg *Registry) error {
 	if err := o.UpdateStatus(ctx, db); err != nil {
 		return err
 	}
@@ -140,17 +171,33 @@ func (o *Order) Finalize(ctx context.Context, db DB, csr *x509.CertificateReques
 		return NewErrorISE("unexpected status %s for order %s", o.Status, o.ID)
 	}
 
+	// The common name is checked against the SANs requested in the CSR before
+	// canonicalizing it, as canonicalize adds the common name to them.
+	if cn := csr.Subject.CommonName; cn != "" && !commonNameInSANs(csr) {
+		switch p.GetCommonNamePolicy() {
+		case provisioner.ACMECommonNamePolicyReject:
+			return NewDetailedError(ErrorBadCSRType, "CSR common name %s is not one of the subject alternative names", cn)
+		case provisioner.ACMECommonNamePolicyStrip:
+			csr.Subject.CommonName = ""
+		}
+	}
+
 	// canonicalize the CSR to allow for comparison
 	csr = canonicalize(csr)
 
 	// retrieve the requested SANs for the Order
-	sans, err := o.sans(csr)
+	sans, err := o.sans(csr, reg)
 	if err != nil {
 		return err
 	}
 
+	if _, ok := provisioner.MustStapleExtension(csr); ok && p.GetMustStaple() == provisioner.ACMEMustStapleForbid {
+		return NewDetailedError(ErrorBadCSRType, "CSR requires OCSP must-staple, but provisioner %s does not allow it", p.GetName())
+	}
+
 	// Get authorizations from the ACME provisioner.
 	ctx = provisioner.NewContextWithMethod(ctx, provisioner.SignMethod)
+	ctx = provisioner.NewContextWithACMEAccountID(ctx, o.AccountID)
 	signOps, err := p.AuthorizeSign(ctx, "")
 	if err != nil {
 		return WrapErrorISE(err, "error retrieving authorization options from ACME provisioner")
@@ -165,15 +212,35 @@ func (o *Order) Finalize(ctx context.Context, db DB, csr *x509.CertificateReques
 	if err != nil {
 		return WrapErrorISE(err, "error creating template options from ACME provisioner")
 	}
-	signOps = append(signOps, templateOptions)
+	signOps = append(signOps, templateOptions, provisioner.ACMEOrderOption{
+		AccountID: o.AccountID,
+		OrderID:   o.ID,
+	})
+
+	// The validity window of the order was validated when it was created, but
+	// the claims of the provisioner might have changed since then. With the
+	// clamp policy the window is never extended beyond the current maximum.
+	notAfter := o.NotAfter
+	if p.GetValidityPolicy() == provisioner.ACMEValidityPolicyClamp && !o.NotBefore.IsZero() {
+		if max := o.NotBefore.Add(p.MaxTLSCertDuration()); notAfter.After(max) {
+			notAfter = max
+		}
+	}
 
 	// Sign a new certificate.
 	certChain, err := auth.Sign(csr, provisioner.SignOptions{
 		NotBefore: provisioner.NewTimeDuration(o.NotBefore),
-		NotAfter:  provisioner.NewTimeDuration(o.NotAfter),
+		NotAfter:  provisioner.NewTimeDuration(notAfter),
 	}, signOps...)
 	if err != nil {
-		return WrapErrorISE(err, "error signing certificate for order %s", o.ID)
+		ae := WrapErrorISE(err, "error signing certificate for order %s", o.ID)
+		// Keep the 503 of a temporarily unavailable KMS, so the client can
+		// retry the finalize request.
+		if sc, ok := err.(errs.StatusCoder); ok && sc.StatusCode() == http.StatusServiceUnavailable {
+			ae.Status = http.StatusServiceUnavailable
+			ae.Detail = "the certificate authority is temporarily unable to sign certificates"
+		}
+		return ae
 	}
 
 	cert := &Certificate{
@@ -182,6 +249,15 @@ func (o *Order) Finalize(ctx context.Context, db DB, csr *x509.CertificateReques
 		Leaf:          certChain[0],
 		Intermediates: certChain[1:],
 	}
+	// Store the certificate and update the order atomically if the database
+	// supports it.
+	if f, ok := db.(OrderFinalizer); ok {
+		if err := f.FinalizeOrder(ctx, o, cert); err != nil {
+			return WrapErrorISE(err, "error finalizing order %s", o.ID)
+		}
+		return nil
+	}
+
 	if err := db.CreateCertificate(ctx, cert); err != nil {
 		return WrapErrorISE(err, "error creating certificate for order %s", o.ID)
 	}
@@ -194,7 +270,7 @@ func (o *Order) Finalize(ctx context.Context, db DB, csr *x509.CertificateReques
 	return nil
 }
 
-func (o *Order) sans(csr *x509.CertificateRequest) ([]x509util.SubjectAlternativeName, error) {
+func (o *Order) sans(csr *x509.CertificateRequest, reg *Registry) ([]x509util.SubjectAlternativeName, error) {
 
 	var sans []x509util.SubjectAlternativeName
 
@@ -202,6 +278,7 @@ func (o *Order) sans(csr *x509.CertificateRequest) ([]x509util.SubjectAlternativ
 	orderNames := make([]string, numberOfIdentifierType(DNS, o.Identifiers))
 	orderIPs := make([]net.IP, numberOfIdentifierType(IP, o.Identifiers))
 	indexDNS, indexIP := 0, 0
+	var customSANs []x509util.SubjectAlternativeName
 	for _, n := range o.Identifiers {
 		switch n.Type {
 		case DNS:
@@ -211,7 +288,24 @@ func (o *Order) sans(csr *x509.CertificateRequest) ([]x509util.SubjectAlternativ
 			orderIPs[indexIP] = net.ParseIP(n.Value) // NOTE: this assumes are all valid IPs at this time; or will result in nil entries
 			indexIP++
 		default:
-			return sans, NewErrorISE("unsupported identifier type in order: %s", n.Type)
+			// The identifiers of custom types are authorized by their
+			// IdentifierAuthorizer, they are not part of the CSR, but the
+			// authorizer provides the SAN that binds them to the certificate.
+			a, ok := reg.IdentifierAuthorizer(n.Type)
+			if !ok {
+				return sans, NewErrorISE("unsupported identifier type in order: %s", n.Type)
+			}
+			san, err := a.SubjectAlternativeName(n.Value)
+			if err != nil {
+				return sans, WrapErrorISE(err, "error getting the subject alternative name of %s identifier %s", n.Type, n.Value)
+			}
+			switch {
+			case san.Value == "":
+				return sans, NewErrorISE("empty subject alternative name for %s identifier %s", n.Type, n.Value)
+			case san.Type != x509util.DNSType && san.Type != x509util.EmailType && san.Type != x509util.IPType && san.Type != x509util.URIType:
+				return sans, NewErrorISE("unsupported subject alternative name type %q for %s identifier %s", san.Type, n.Type, n.Value)
+			}
+			customSANs = append(customSANs, san)
 		}
 	}
 	orderNames = uniqueSortedLowerNames(orderNames)
@@ -260,7 +354,26 @@ func (o *Order) sans(csr *x509.CertificateRequest) ([]x509util.SubjectAlternativ
 		index++
 	}
 
-	return sans, nil
+	return append(sans, customSANs...), nil
+}
+
+// commonNameInSANs returns true if the common name of the CSR is one of its
+// DNS names, ignoring the case, or IP addresses.
+func commonNameInSANs(csr *x509.CertificateRequest) bool {
+	cn := csr.Subject.CommonName
+	for _, name := range csr.DNSNames {
+		if strings.EqualFold(name, cn) {
+			return true
+		}
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		for _, sanIP := range csr.IPAddresses {
+			if ip.Equal(sanIP) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // numberOfIdentifierType returns the number of Identifiers that
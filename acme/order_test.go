@@ -2,17 +2,26 @@ package acme
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
+	"fmt"
+	"math/big"
 	"net"
+	"net/http"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
 	"go.step.sm/crypto/x509util"
 )
 
@@ -161,6 +170,46 @@ func TestOrder_UpdateStatus(t *testing.T) {
 				},
 			}
 		},
+		"ok/deactivated": func(t *testing.T) test {
+			now := clock.Now()
+			o := &Order{
+				ID:               "oID",
+				AccountID:        "accID",
+				Status:           StatusPending,
+				ExpiresAt:        now.Add(5 * time.Minute),
+				AuthorizationIDs: []string{"a", "b"},
+			}
+			az1 := &Authorization{
+				ID:     "a",
+				Status: StatusPending,
+			}
+			az2 := &Authorization{
+				ID:     "b",
+				Status: StatusDeactivated,
+			}
+
+			return test{
+				o: o,
+				db: &MockDB{
+					MockUpdateOrder: func(ctx context.Context, updo *Order) error {
+						assert.Equals(t, updo.ID, o.ID)
+						assert.Equals(t, updo.Status, StatusInvalid)
+						return nil
+					},
+					MockGetAuthorization: func(ctx context.Context, id string) (*Authorization, error) {
+						switch id {
+						case az1.ID:
+							return az1, nil
+						case az2.ID:
+							return az2, nil
+						default:
+							assert.FatalError(t, errors.Errorf("unexpected authz key %s", id))
+							return nil, errors.New("force")
+						}
+					},
+				},
+			}
+		},
 		"ok/still-pending": func(t *testing.T) test {
 			now := clock.Now()
 			o := &Order{
@@ -286,6 +335,15 @@ func (m *mockSignAuth) LoadProvisionerByName(name string) (provisioner.Interface
 	return m.ret1.(provisioner.Interface), m.err
 }
 
+type mockFinalizerDB struct {
+	MockDB
+	finalizeOrder func(ctx context.Context, o *Order, cert *Certificate) error
+}
+
+func (m *mockFinalizerDB) FinalizeOrder(ctx context.Context, o *Order, cert *Certificate) error {
+	return m.finalizeOrder(ctx, o, cert)
+}
+
 func TestOrder_Finalize(t *testing.T) {
 	type test struct {
 		o    *Order
@@ -479,6 +537,86 @@ func TestOrder_Finalize(t *testing.T) {
 				err: NewErrorISE("error signing certificate for order oID: force"),
 			}
 		},
+		"fail/must-staple-forbidden": func(t *testing.T) test {
+			now := clock.Now()
+			o := &Order{
+				ID:               "oID",
+				AccountID:        "accID",
+				Status:           StatusReady,
+				ExpiresAt:        now.Add(5 * time.Minute),
+				AuthorizationIDs: []string{"a"},
+				Identifiers: []Identifier{
+					{Type: "dns", Value: "foo.internal"},
+				},
+			}
+			csr := &x509.CertificateRequest{
+				Subject: pkix.Name{
+					CommonName: "foo.internal",
+				},
+				Extensions: []pkix.Extension{
+					{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}, Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05}},
+				},
+			}
+			err := NewDetailedError(ErrorBadCSRType, "CSR requires OCSP must-staple, but provisioner acme does not allow it")
+
+			return test{
+				o:   o,
+				csr: csr,
+				prov: &MockProvisioner{
+					MgetName: func() string {
+						return "acme"
+					},
+					MgetMustStaple: func() string {
+						return provisioner.ACMEMustStapleForbid
+					},
+					MauthorizeSign: func(ctx context.Context, token string) ([]provisioner.SignOption, error) {
+						t.Error("AuthorizeSign should not be called")
+						return nil, nil
+					},
+				},
+				err: err,
+			}
+		},
+		"fail/error-auth.Sign-unavailable": func(t *testing.T) test {
+			now := clock.Now()
+			o := &Order{
+				ID:               "oID",
+				AccountID:        "accID",
+				Status:           StatusReady,
+				ExpiresAt:        now.Add(5 * time.Minute),
+				AuthorizationIDs: []string{"a"},
+				Identifiers: []Identifier{
+					{Type: "dns", Value: "foo.internal"},
+				},
+			}
+			csr := &x509.CertificateRequest{
+				Subject: pkix.Name{
+					CommonName: "foo.internal",
+				},
+			}
+			err := NewErrorISE("error signing certificate for order oID: authority.Sign; error creating certificate: rate exceeded")
+			err.Status = http.StatusServiceUnavailable
+			err.Detail = "the certificate authority is temporarily unable to sign certificates"
+
+			return test{
+				o:   o,
+				csr: csr,
+				prov: &MockProvisioner{
+					MauthorizeSign: func(ctx context.Context, token string) ([]provisioner.SignOption, error) {
+						return nil, nil
+					},
+					MgetOptions: func() *provisioner.Options {
+						return nil
+					},
+				},
+				ca: &mockSignAuth{
+					sign: func(_csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+						return nil, errs.Wrap(http.StatusServiceUnavailable, errors.New("rate exceeded"), "authority.Sign; error creating certificate")
+					},
+				},
+				err: err,
+			}
+		},
 		"fail/error-db.CreateCertificate": func(t *testing.T) test {
 			now := clock.Now()
 			o := &Order{
@@ -662,6 +800,131 @@ func TestOrder_Finalize(t *testing.T) {
 				},
 			}
 		},
+		"fail/error-db.FinalizeOrder": func(t *testing.T) test {
+			now := clock.Now()
+			o := &Order{
+				ID:               "oID",
+				AccountID:        "accID",
+				Status:           StatusReady,
+				ExpiresAt:        now.Add(5 * time.Minute),
+				AuthorizationIDs: []string{"a", "b"},
+				Identifiers: []Identifier{
+					{Type: "dns", Value: "foo.internal"},
+					{Type: "dns", Value: "bar.internal"},
+				},
+			}
+			csr := &x509.CertificateRequest{
+				Subject: pkix.Name{
+					CommonName: "foo.internal",
+				},
+				DNSNames: []string{"bar.internal"},
+			}
+
+			foo := &x509.Certificate{Subject: pkix.Name{CommonName: "foo"}}
+			bar := &x509.Certificate{Subject: pkix.Name{CommonName: "bar"}}
+			baz := &x509.Certificate{Subject: pkix.Name{CommonName: "baz"}}
+
+			return test{
+				o:   o,
+				csr: csr,
+				prov: &MockProvisioner{
+					MauthorizeSign: func(ctx context.Context, token string) ([]provisioner.SignOption, error) {
+						assert.Equals(t, token, "")
+						return nil, nil
+					},
+					MgetOptions: func() *provisioner.Options {
+						return nil
+					},
+				},
+				ca: &mockSignAuth{
+					sign: func(_csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+						assert.Equals(t, _csr, csr)
+						return []*x509.Certificate{foo, bar, baz}, nil
+					},
+				},
+				db: &mockFinalizerDB{
+					MockDB: MockDB{
+						MockCreateCertificate: func(ctx context.Context, cert *Certificate) error {
+							assert.FatalError(t, errors.New("unexpected call to CreateCertificate"))
+							return nil
+						},
+					},
+					finalizeOrder: func(ctx context.Context, updo *Order, cert *Certificate) error {
+						assert.Equals(t, updo, o)
+						assert.Equals(t, cert.AccountID, o.AccountID)
+						assert.Equals(t, cert.OrderID, o.ID)
+						assert.Equals(t, cert.Leaf, foo)
+						assert.Equals(t, cert.Intermediates, []*x509.Certificate{bar, baz})
+						return errors.New("force")
+					},
+				},
+				err: NewErrorISE("error finalizing order oID: force"),
+			}
+		},
+		"ok/new-cert-finalizer": func(t *testing.T) test {
+			now := clock.Now()
+			o := &Order{
+				ID:               "oID",
+				AccountID:        "accID",
+				Status:           StatusReady,
+				ExpiresAt:        now.Add(5 * time.Minute),
+				AuthorizationIDs: []string{"a", "b"},
+				Identifiers: []Identifier{
+					{Type: "dns", Value: "foo.internal"},
+					{Type: "dns", Value: "bar.internal"},
+				},
+			}
+			csr := &x509.CertificateRequest{
+				Subject: pkix.Name{
+					CommonName: "foo.internal",
+				},
+				DNSNames: []string{"bar.internal"},
+			}
+
+			foo := &x509.Certificate{Subject: pkix.Name{CommonName: "foo"}}
+			bar := &x509.Certificate{Subject: pkix.Name{CommonName: "bar"}}
+			baz := &x509.Certificate{Subject: pkix.Name{CommonName: "baz"}}
+
+			return test{
+				o:   o,
+				csr: csr,
+				prov: &MockProvisioner{
+					MauthorizeSign: func(ctx context.Context, token string) ([]provisioner.SignOption, error) {
+						assert.Equals(t, token, "")
+						return nil, nil
+					},
+					MgetOptions: func() *provisioner.Options {
+						return nil
+					},
+				},
+				ca: &mockSignAuth{
+					sign: func(_csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+						assert.Equals(t, _csr, csr)
+						return []*x509.Certificate{foo, bar, baz}, nil
+					},
+				},
+				db: &mockFinalizerDB{
+					MockDB: MockDB{
+						MockUpdateOrder: func(ctx context.Context, updo *Order) error {
+							assert.FatalError(t, errors.New("unexpected call to UpdateOrder"))
+							return nil
+						},
+					},
+					finalizeOrder: func(ctx context.Context, updo *Order, cert *Certificate) error {
+						assert.Equals(t, updo.ID, o.ID)
+						assert.Equals(t, updo.Status, StatusReady)
+						assert.Equals(t, cert.AccountID, o.AccountID)
+						assert.Equals(t, cert.OrderID, o.ID)
+						assert.Equals(t, cert.Leaf, foo)
+						assert.Equals(t, cert.Intermediates, []*x509.Certificate{bar, baz})
+						cert.ID = "certID"
+						updo.CertificateID = "certID"
+						updo.Status = StatusValid
+						return nil
+					},
+				},
+			}
+		},
 		"ok/new-cert-ip": func(t *testing.T) test {
 			now := clock.Now()
 			o := &Order{
@@ -762,6 +1025,10 @@ func TestOrder_Finalize(t *testing.T) {
 				ca: &mockSignAuth{
 					sign: func(_csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
 						assert.Equals(t, _csr, csr)
+						assert.Equals(t, extraOpts[len(extraOpts)-1], provisioner.ACMEOrderOption{
+							AccountID: o.AccountID,
+							OrderID:   o.ID,
+						})
 						return []*x509.Certificate{foo, bar, baz}, nil
 					},
 				},
@@ -791,7 +1058,7 @@ func TestOrder_Finalize(t *testing.T) {
 	for name, run := range tests {
 		t.Run(name, func(t *testing.T) {
 			tc := run(t)
-			if err := tc.o.Finalize(context.Background(), tc.db, tc.csr, tc.ca, tc.prov); err != nil {
+			if err := tc.o.Finalize(context.Background(), tc.db, tc.csr, tc.ca, tc.prov, nil); err != nil {
 				if assert.NotNil(t, tc.err) {
 					switch k := err.(type) {
 					case *Error:
@@ -1375,7 +1642,7 @@ func TestOrder_sans(t *testing.T) {
 				Identifiers: tt.fields.Identifiers,
 			}
 			canonicalizedCSR := canonicalize(tt.csr)
-			got, err := o.sans(canonicalizedCSR)
+			got, err := o.sans(canonicalizedCSR, nil)
 			if tt.err != nil {
 				if err == nil {
 					t.Errorf("Order.sans() = %v, want error; got none", got)
@@ -1399,3 +1666,359 @@ func TestOrder_sans(t *testing.T) {
 		})
 	}
 }
+
+func TestOrder_sans_customIdentifier(t *testing.T) {
+	var (
+		san    x509util.SubjectAlternativeName
+		sanErr error
+	)
+	reg := NewRegistry()
+	assert.FatalError(t, reg.RegisterIdentifierAuthorizer("asset", &mockIdentifierAuthorizer{
+		challengeTypes: []ChallengeType{"asset-01"},
+		san: func(value string) (x509util.SubjectAlternativeName, error) {
+			assert.Equals(t, value, "asset-1234")
+			return san, sanErr
+		},
+	}))
+
+	tests := []struct {
+		name   string
+		san    x509util.SubjectAlternativeName
+		sanErr error
+		want   []x509util.SubjectAlternativeName
+		err    string
+	}{
+		{"ok", x509util.SubjectAlternativeName{Type: x509util.URIType, Value: "urn:asset:asset-1234"}, nil,
+			[]x509util.SubjectAlternativeName{{Type: "dns", Value: "example.com"}, {Type: "uri", Value: "urn:asset:asset-1234"}}, ""},
+		{"fail/error", x509util.SubjectAlternativeName{}, errors.New("force"), nil,
+			"error getting the subject alternative name of asset identifier asset-1234: force"},
+		{"fail/empty", x509util.SubjectAlternativeName{Type: x509util.URIType}, nil, nil,
+			"empty subject alternative name for asset identifier asset-1234"},
+		{"fail/type", x509util.SubjectAlternativeName{Type: "auto", Value: "asset-1234"}, nil, nil,
+			`unsupported subject alternative name type "auto" for asset identifier asset-1234`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			san, sanErr = tt.san, tt.sanErr
+			o := &Order{
+				Identifiers: []Identifier{{Type: "asset", Value: "asset-1234"}, {Type: "dns", Value: "example.com"}},
+			}
+			got, err := o.sans(canonicalize(&x509.CertificateRequest{DNSNames: []string{"example.com"}}), reg)
+			if tt.err != "" {
+				var ae *Error
+				if assert.True(t, errors.As(err, &ae)) {
+					assert.Equals(t, ae.Type, NewErrorISE("").Type)
+					assert.Equals(t, ae.Err.Error(), tt.err)
+				}
+				return
+			}
+			assert.FatalError(t, err)
+			assert.Equals(t, got, tt.want)
+		})
+	}
+}
+
+func TestOrder_Finalize_manyIdentifiers(t *testing.T) {
+	const n = 50
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+
+	// The identifiers and the names in the CSR use different, unsorted,
+	// orders.
+	want := make([]string, n)
+	identifiers := make([]Identifier, n)
+	authzIDs := make([]string, n)
+	csrNames := make([]string, n)
+	for i := 0; i < n; i++ {
+		want[i] = fmt.Sprintf("host-%02d.internal", i)
+		identifiers[i] = Identifier{Type: DNS, Value: fmt.Sprintf("host-%02d.internal", (i*7)%n)}
+		authzIDs[i] = fmt.Sprintf("az-%02d", i)
+		csrNames[i] = fmt.Sprintf("HOST-%02d.internal", (i*13)%n)
+	}
+
+	o := &Order{
+		ID:               "oID",
+		AccountID:        "accID",
+		Status:           StatusReady,
+		ExpiresAt:        clock.Now().Add(5 * time.Minute),
+		AuthorizationIDs: authzIDs,
+		Identifiers:      identifiers,
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "host-07.internal"},
+		DNSNames: csrNames,
+	}, key)
+	assert.FatalError(t, err)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	assert.FatalError(t, err)
+
+	var signCalls int
+	var leaf *x509.Certificate
+	prov := &MockProvisioner{
+		MauthorizeSign: func(ctx context.Context, token string) ([]provisioner.SignOption, error) {
+			return nil, nil
+		},
+		MgetOptions: func() *provisioner.Options {
+			return nil
+		},
+	}
+	ca := &mockSignAuth{
+		sign: func(_csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+			signCalls++
+			// Create the certificate using the template options, like the
+			// authority does.
+			var certOptions []x509util.Option
+			for _, op := range extraOpts {
+				if co, ok := op.(provisioner.CertificateOptions); ok {
+					certOptions = append(certOptions, co.Options(signOpts)...)
+				}
+			}
+			c, err := x509util.NewCertificate(_csr, certOptions...)
+			assert.FatalError(t, err)
+			template := c.GetCertificate()
+			template.SerialNumber = big.NewInt(1)
+			template.NotBefore = time.Now()
+			template.NotAfter = time.Now().Add(time.Hour)
+			der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+			assert.FatalError(t, err)
+			leaf, err = x509.ParseCertificate(der)
+			assert.FatalError(t, err)
+			return []*x509.Certificate{leaf}, nil
+		},
+	}
+	var certs []*Certificate
+	db := &MockDB{
+		MockGetAuthorization: func(ctx context.Context, id string) (*Authorization, error) {
+			t.Errorf("unexpected authorization lookup %s for a ready order", id)
+			return nil, errors.New("force")
+		},
+		MockCreateCertificate: func(ctx context.Context, cert *Certificate) error {
+			cert.ID = "certID"
+			certs = append(certs, cert)
+			return nil
+		},
+		MockUpdateOrder: func(ctx context.Context, updo *Order) error {
+			assert.Equals(t, updo.CertificateID, "certID")
+			assert.Equals(t, updo.Status, StatusValid)
+			return nil
+		},
+	}
+
+	assert.FatalError(t, o.Finalize(context.Background(), db, csr, ca, prov, nil))
+	assert.Equals(t, signCalls, 1)
+	if assert.Len(t, 1, certs) {
+		assert.Equals(t, certs[0].Leaf, leaf)
+	}
+	assert.Equals(t, leaf.DNSNames, want)
+	assert.True(t, sort.StringsAreSorted(leaf.DNSNames))
+}
+
+func TestOrder_Finalize_validity(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"foo.internal"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.FatalError(t, err)
+
+	now := clock.Now()
+	tests := []struct {
+		name         string
+		policy       string
+		maxDuration  time.Duration
+		notAfter     time.Time
+		wantNotAfter time.Time
+	}{
+		{"ok/shortened", provisioner.ACMEValidityPolicyReject, 24 * time.Hour, now.Add(time.Hour), now.Add(time.Hour)},
+		{"ok/shortened-clamp", provisioner.ACMEValidityPolicyClamp, 24 * time.Hour, now.Add(time.Hour), now.Add(time.Hour)},
+		{"ok/clamped", provisioner.ACMEValidityPolicyClamp, time.Hour, now.Add(24 * time.Hour), now.Add(time.Hour)},
+		{"ok/not-clamped-reject", provisioner.ACMEValidityPolicyReject, time.Hour, now.Add(24 * time.Hour), now.Add(24 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Order{
+				ID:               "oID",
+				AccountID:        "accID",
+				Status:           StatusReady,
+				ExpiresAt:        now.Add(5 * time.Minute),
+				AuthorizationIDs: []string{"a"},
+				Identifiers:      []Identifier{{Type: DNS, Value: "foo.internal"}},
+				NotBefore:        now,
+				NotAfter:         tt.notAfter,
+			}
+			csr := &x509.CertificateRequest{DNSNames: []string{"foo.internal"}}
+			prov := &MockProvisioner{
+				MauthorizeSign: func(ctx context.Context, token string) ([]provisioner.SignOption, error) {
+					return nil, nil
+				},
+				MgetOptions: func() *provisioner.Options {
+					return nil
+				},
+				MgetValidityPolicy: func() string {
+					return tt.policy
+				},
+				MmaxTLSCertDuration: func() time.Duration {
+					return tt.maxDuration
+				},
+			}
+			ca := &mockSignAuth{
+				sign: func(_csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+					assert.True(t, signOpts.NotBefore.Time().Equal(now))
+					assert.True(t, signOpts.NotAfter.Time().Equal(tt.wantNotAfter))
+					return []*x509.Certificate{leaf}, nil
+				},
+			}
+			db := &MockDB{
+				MockCreateCertificate: func(ctx context.Context, cert *Certificate) error {
+					cert.ID = "certID"
+					return nil
+				},
+				MockUpdateOrder: func(ctx context.Context, updo *Order) error {
+					return nil
+				},
+			}
+			assert.FatalError(t, o.Finalize(context.Background(), db, csr, ca, prov, nil))
+			assert.True(t, o.NotAfter.Equal(tt.notAfter))
+		})
+	}
+}
+
+func TestSameIdentifiers(t *testing.T) {
+	foo := Identifier{Type: DNS, Value: "foo.internal"}
+	bar := Identifier{Type: DNS, Value: "bar.internal"}
+	ip := Identifier{Type: IP, Value: "10.0.0.1"}
+	tests := []struct {
+		name string
+		a    []Identifier
+		b    []Identifier
+		want bool
+	}{
+		{"ok/empty", nil, []Identifier{}, true},
+		{"ok/same", []Identifier{foo, ip}, []Identifier{foo, ip}, true},
+		{"ok/different-order", []Identifier{foo, bar, ip}, []Identifier{ip, foo, bar}, true},
+		{"ok/duplicates", []Identifier{foo, foo, bar}, []Identifier{bar, foo}, true},
+		{"fail/subset", []Identifier{foo}, []Identifier{foo, bar}, false},
+		{"fail/superset", []Identifier{foo, bar}, []Identifier{foo}, false},
+		{"fail/different-type", []Identifier{{Type: DNS, Value: "10.0.0.1"}}, []Identifier{ip}, false},
+		{"fail/empty", []Identifier{foo}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SameIdentifiers(tt.a, tt.b); got != tt.want {
+				t.Errorf("SameIdentifiers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrder_Finalize_commonName(t *testing.T) {
+	now := clock.Now()
+	foo := &x509.Certificate{Subject: pkix.Name{CommonName: "foo"}}
+	rejected := NewDetailedError(ErrorBadCSRType, "CSR common name foo.internal is not one of the subject alternative names")
+
+	tests := []struct {
+		name        string
+		policy      string
+		identifiers []string
+		csr         *x509.CertificateRequest
+		wantCN      string
+		wantNames   []string
+		err         *Error
+	}{
+		{"ok/cn-in-sans", provisioner.ACMECommonNamePolicyReject, []string{"foo.internal", "bar.internal"},
+			&x509.CertificateRequest{Subject: pkix.Name{CommonName: "Foo.internal"}, DNSNames: []string{"foo.internal", "bar.internal"}},
+			"Foo.internal", []string{"bar.internal", "foo.internal"}, nil},
+		{"ok/cn-not-in-sans-allow", provisioner.ACMECommonNamePolicyAllow, []string{"foo.internal", "bar.internal"},
+			&x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo.internal"}, DNSNames: []string{"bar.internal"}},
+			"foo.internal", []string{"bar.internal", "foo.internal"}, nil},
+		{"ok/cn-not-in-sans-strip", provisioner.ACMECommonNamePolicyStrip, []string{"bar.internal"},
+			&x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo.internal"}, DNSNames: []string{"bar.internal"}},
+			"", []string{"bar.internal"}, nil},
+		{"fail/cn-not-in-sans-reject", provisioner.ACMECommonNamePolicyReject, []string{"foo.internal", "bar.internal"},
+			&x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo.internal"}, DNSNames: []string{"bar.internal"}},
+			"", nil, rejected},
+		{"fail/cn-not-in-sans-strip-identifier", provisioner.ACMECommonNamePolicyStrip, []string{"foo.internal", "bar.internal"},
+			&x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo.internal"}, DNSNames: []string{"bar.internal"}},
+			"", nil, NewError(ErrorBadCSRType, "CSR names do not match identifiers exactly: CSR names = [bar.internal], Order names = [bar.internal foo.internal]")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Order{
+				ID:               "oID",
+				AccountID:        "accID",
+				Status:           StatusReady,
+				ExpiresAt:        now.Add(5 * time.Minute),
+				AuthorizationIDs: []string{"a"},
+			}
+			for _, v := range tt.identifiers {
+				o.Identifiers = append(o.Identifiers, Identifier{Type: DNS, Value: v})
+			}
+			prov := &MockProvisioner{
+				MauthorizeSign: func(ctx context.Context, token string) ([]provisioner.SignOption, error) {
+					return nil, nil
+				},
+				MgetOptions: func() *provisioner.Options {
+					return nil
+				},
+				MgetCommonNamePolicy: func() string {
+					return tt.policy
+				},
+			}
+			ca := &mockSignAuth{
+				sign: func(_csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+					assert.Equals(t, _csr.Subject.CommonName, tt.wantCN)
+					assert.Equals(t, _csr.DNSNames, tt.wantNames)
+					return []*x509.Certificate{foo}, nil
+				},
+			}
+			db := &MockDB{
+				MockCreateCertificate: func(ctx context.Context, cert *Certificate) error {
+					cert.ID = "certID"
+					return nil
+				},
+				MockUpdateOrder: func(ctx context.Context, updo *Order) error {
+					return nil
+				},
+			}
+			err := o.Finalize(context.Background(), db, tt.csr, ca, prov, nil)
+			if tt.err == nil {
+				assert.FatalError(t, err)
+				assert.Equals(t, o.Status, StatusValid)
+				return
+			}
+			switch k := err.(type) {
+			case *Error:
+				assert.Equals(t, k.Type, tt.err.Type)
+				assert.Equals(t, k.Detail, tt.err.Detail)
+				assert.Equals(t, k.Err.Error(), tt.err.Err.Error())
+			default:
+				assert.FatalError(t, errors.New("unexpected error type"))
+			}
+		})
+	}
+}
+
+func Test_commonNameInSANs(t *testing.T) {
+	tests := []struct {
+		name string
+		csr  *x509.CertificateRequest
+		want bool
+	}{
+		{"ok/dns", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "FOO.internal"}, DNSNames: []string{"foo.internal"}}, true},
+		{"ok/ip", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "10.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, true},
+		{"fail/dns", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo.internal"}, DNSNames: []string{"bar.internal"}}, false},
+		{"fail/ip-as-dns", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo.internal"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, false},
+		{"fail/no-sans", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "foo.internal"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, commonNameInSANs(tt.csr), tt.want)
+		})
+	}
+}
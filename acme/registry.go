@@ -0,0 +1,212 @@
+package acme
+
+import (
+	"crypto"
+	_ "crypto/sha256" // register crypto.SHA256
+	_ "crypto/sha512" // register crypto.SHA384 and crypto.SHA512
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.step.sm/crypto/jose"
+)
+
+// Registry contains the extensions of an ACME server: the authorizers of the
+// custom identifier types, and the key authorization and its digest of the
+// non-standard challenge types. The ACME handler owns one registry, so
+// different servers in the same process can have different extensions. A nil
+// Registry is valid and only supports the standard identifiers and challenges.
+type Registry struct {
+	mu                      sync.RWMutex
+	identifierAuthorizers   map[IdentifierType]IdentifierAuthorizer
+	keyAuthorizers          map[ChallengeType]KeyAuthorizer
+	keyAuthorizationDigests map[ChallengeType]crypto.Hash
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		identifierAuthorizers:   make(map[IdentifierType]IdentifierAuthorizer),
+		keyAuthorizers:          make(map[ChallengeType]KeyAuthorizer),
+		keyAuthorizationDigests: make(map[ChallengeType]crypto.Hash),
+	}
+}
+
+// Clone returns a copy of the registry, a nil registry returns an empty one.
+// It's used to add extensions to a registry without modifying the original.
+func (r *Registry) Clone() *Registry {
+	c := NewRegistry()
+	if r == nil {
+		return c
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for k, v := range r.identifierAuthorizers {
+		c.identifierAuthorizers[k] = v
+	}
+	for k, v := range r.keyAuthorizers {
+		c.keyAuthorizers[k] = v
+	}
+	for k, v := range r.keyAuthorizationDigests {
+		c.keyAuthorizationDigests[k] = v
+	}
+	return c
+}
+
+// RegisterIdentifierAuthorizer sets the IdentifierAuthorizer of the
+// identifiers of the given type. It returns an error if the type is dns or ip
+// or it's already registered, or if the authorizer offers a standard challenge
+// type or one already offered by another identifier type.
+func (r *Registry) RegisterIdentifierAuthorizer(typ IdentifierType, a IdentifierAuthorizer) error {
+	switch typ {
+	case DNS, IP:
+		return fmt.Errorf("the authorizer of %s identifiers cannot be changed", typ)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.identifierAuthorizers[typ]; ok {
+		return fmt.Errorf("the authorizer of %s identifiers is already registered", typ)
+	}
+	for _, chType := range a.ChallengeTypes() {
+		switch chType {
+		case HTTP01, DNS01, TLSALPN01:
+			return fmt.Errorf("%s identifiers cannot use the standard challenge %s", typ, chType)
+		}
+		for t, other := range r.identifierAuthorizers {
+			if hasChallengeType(other, chType) {
+				return fmt.Errorf("challenge %s is already used by %s identifiers", chType, t)
+			}
+		}
+	}
+	r.identifierAuthorizers[typ] = a
+	return nil
+}
+
+// IdentifierAuthorizer returns the IdentifierAuthorizer registered for the
+// given identifier type.
+func (r *Registry) IdentifierAuthorizer(typ IdentifierType) (IdentifierAuthorizer, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.identifierAuthorizers[typ]
+	return a, ok
+}
+
+// challengeAuthorizer returns the IdentifierAuthorizer that offers the given
+// challenge type.
+func (r *Registry) challengeAuthorizer(typ ChallengeType) (IdentifierAuthorizer, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, a := range r.identifierAuthorizers {
+		if hasChallengeType(a, typ) {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// RegisterKeyAuthorizer sets the KeyAuthorizer used by the challenges of the
+// given type. It returns an error if the type is one of the standard
+// challenges, their key authorization cannot be changed.
+func (r *Registry) RegisterKeyAuthorizer(typ ChallengeType, ka KeyAuthorizer) error {
+	switch typ {
+	case HTTP01, DNS01, TLSALPN01:
+		return fmt.Errorf("the key authorization of %s challenges cannot be changed", typ)
+	}
+	r.mu.Lock()
+	r.keyAuthorizers[typ] = ka
+	r.mu.Unlock()
+	return nil
+}
+
+// KeyAuthorization returns the key authorization of the challenge for the
+// given account key, using the KeyAuthorizer registered for the challenge type
+// if there is one.
+func (r *Registry) KeyAuthorization(ch *Challenge, jwk *jose.JSONWebKey) (string, error) {
+	if r != nil {
+		r.mu.RLock()
+		ka, ok := r.keyAuthorizers[ch.Type]
+		r.mu.RUnlock()
+		if ok {
+			return ka.KeyAuthorization(ch.Token, jwk)
+		}
+	}
+	return KeyAuthorization(ch.Token, jwk)
+}
+
+// RegisterKeyAuthorizationDigest sets the hash function used to digest the key
+// authorization of the challenges of the given type. It returns an error if the
+// type is one of the standard challenges, they always use SHA-256, or if the
+// hash function is not linked into the binary.
+func (r *Registry) RegisterKeyAuthorizationDigest(typ ChallengeType, h crypto.Hash) error {
+	switch typ {
+	case HTTP01, DNS01, TLSALPN01:
+		return fmt.Errorf("the key authorization digest of %s challenges cannot be changed", typ)
+	}
+	if !h.Available() {
+		return fmt.Errorf("hash function %v is not available", h)
+	}
+	r.mu.Lock()
+	r.keyAuthorizationDigests[typ] = h
+	r.mu.Unlock()
+	return nil
+}
+
+// KeyAuthorizationDigest returns the digest of the given key authorization
+// using the hash function registered for the challenge type, or SHA-256 if
+// there is none.
+func (r *Registry) KeyAuthorizationDigest(typ ChallengeType, keyAuth string) []byte {
+	h := crypto.SHA256
+	if r != nil {
+		r.mu.RLock()
+		if v, ok := r.keyAuthorizationDigests[typ]; ok {
+			h = v
+		}
+		r.mu.RUnlock()
+	}
+	hh := h.New()
+	hh.Write([]byte(keyAuth))
+	return hh.Sum(nil)
+}
+
+// ParseKeyAuthorizationDigests parses and validates a map of non-standard
+// challenge types and the names of the hash functions used to digest their key
+// authorization, e.g. {"device-attest-01": "SHA-384"}. The names are the ones
+// returned by crypto.Hash.String.
+func ParseKeyAuthorizationDigests(m map[string]string) (map[ChallengeType]crypto.Hash, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	types := make([]string, 0, len(m))
+	for typ := range m {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	reg := NewRegistry()
+	for _, typ := range types {
+		h, ok := parseHash(m[typ])
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function %s for challenge %s", m[typ], typ)
+		}
+		if err := reg.RegisterKeyAuthorizationDigest(ChallengeType(typ), h); err != nil {
+			return nil, err
+		}
+	}
+	return reg.keyAuthorizationDigests, nil
+}
+
+// parseHash returns the hash function with the given name.
+func parseHash(name string) (crypto.Hash, bool) {
+	for h := crypto.MD4; h <= crypto.BLAKE2b_512; h++ {
+		if h.String() == name {
+			return h, true
+		}
+	}
+	return 0, false
+}
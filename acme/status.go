@@ -12,9 +12,14 @@ var (
 	StatusPending = Status("pending")
 	// StatusDeactivated -- deactivated; e.g. for an Account that is not longer valid.
 	StatusDeactivated = Status("deactivated")
+	// StatusRevoked -- revoked; e.g. for an Account that has been disabled by
+	// the server.
+	StatusRevoked = Status("revoked")
 	// StatusReady -- ready; e.g. for an Order that is ready to be finalized.
 	StatusReady = Status("ready")
+	// StatusProcessing -- processing; e.g. for an Order that is being
+	// finalized or a Challenge that is being validated.
+	StatusProcessing = Status("processing")
 	//statusExpired     = "expired"
 	//statusActive      = "active"
-	//statusProcessing  = "processing"
 )
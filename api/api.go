@@ -33,6 +33,7 @@ type Authority interface {
 	// context specifies the Authorize[Sign|Revoke|etc.] method.
 	Authorize(ctx context.Context, ott string) ([]provisioner.SignOption, error)
 	AuthorizeSign(ott string) ([]provisioner.SignOption, error)
+	AuthorizeClientCertificate(ctx context.Context, chain []*x509.Certificate) ([]provisioner.SignOption, error)
 	GetTLSOptions() *config.TLSOptions
 	Root(shasum string) (*x509.Certificate, error)
 	Sign(cr *x509.CertificateRequest, opts provisioner.SignOptions, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
@@ -45,6 +46,8 @@ type Authority interface {
 	GetEncryptedKey(kid string) (string, error)
 	GetRoots() (federation []*x509.Certificate, err error)
 	GetFederation() ([]*x509.Certificate, error)
+	GetX509Signers() ([]*x509.Certificate, error)
+	GetCertificateChain(serial string) ([]*x509.Certificate, bool, error)
 	Version() authority.Version
 }
 
@@ -250,7 +253,9 @@ func (h *caHandler) Route(r Router) {
 	r.MethodFunc("GET", "/version", h.Version)
 	r.MethodFunc("GET", "/health", h.Health)
 	r.MethodFunc("GET", "/root/{sha}", h.Root)
+	r.MethodFunc("GET", "/certificate/{serial}", h.Certificate)
 	r.MethodFunc("POST", "/sign", h.Sign)
+	r.MethodFunc("POST", "/sign/batch", h.SignBatch)
 	r.MethodFunc("POST", "/renew", h.Renew)
 	r.MethodFunc("POST", "/rekey", h.Rekey)
 	r.MethodFunc("POST", "/revoke", h.Revoke)
@@ -258,6 +263,7 @@ func (h *caHandler) Route(r Router) {
 	r.MethodFunc("GET", "/provisioners/{kid}/encrypted-key", h.ProvisionerKey)
 	r.MethodFunc("GET", "/roots", h.Roots)
 	r.MethodFunc("GET", "/federation", h.Federation)
+	r.MethodFunc("GET", "/jwks", h.JWKS)
 	// SSH CA
 	r.MethodFunc("POST", "/ssh/sign", h.SSHSign)
 	r.MethodFunc("POST", "/ssh/renew", h.SSHRenew)
@@ -299,13 +305,42 @@ func (h *caHandler) Root(w http.ResponseWriter, r *http.Request) {
 	// Load root certificate with the
 	cert, err := h.Authority.Root(sum)
 	if err != nil {
-		WriteError(w, errs.Wrapf(http.StatusNotFound, err, "%s was not found", r.RequestURI))
+		WriteError(w, r, errs.Wrapf(http.StatusNotFound, err, "%s was not found", r.RequestURI))
 		return
 	}
 
 	JSON(w, &RootResponse{RootPEM: Certificate{cert}})
 }
 
+// CertificateStatusHeader is the header used by the Certificate endpoint to
+// report if the certificate is "valid" or "revoked".
+const CertificateStatusHeader = "X-Certificate-Status"
+
+// Certificate is an HTTP handler that returns the PEM of the certificate with
+// the serial number in the URL, followed by the certificate of its issuer. The
+// serial number is in decimal, as it is stored in the database.
+func (h *caHandler) Certificate(w http.ResponseWriter, r *http.Request) {
+	serial := chi.URLParam(r, "serial")
+	chain, revoked, err := h.Authority.GetCertificateChain(serial)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	status := "valid"
+	if revoked {
+		status = "revoked"
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Header().Set(CertificateStatusHeader, status)
+	for _, crt := range chain {
+		if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}); err != nil {
+			LogError(w, err)
+			return
+		}
+	}
+}
+
 func certChainToPEM(certChain []*x509.Certificate) []Certificate {
 	certChainPEM := make([]Certificate, 0, len(certChain))
 	for _, c := range certChain {
@@ -318,13 +353,13 @@ func certChainToPEM(certChain []*x509.Certificate) []Certificate {
 func (h *caHandler) Provisioners(w http.ResponseWriter, r *http.Request) {
 	cursor, limit, err := ParseCursor(r)
 	if err != nil {
-		WriteError(w, err)
+		WriteError(w, r, err)
 		return
 	}
 
 	p, next, err := h.Authority.GetProvisioners(cursor, limit)
 	if err != nil {
-		WriteError(w, errs.InternalServerErr(err))
+		WriteError(w, r, errs.InternalServerErr(err))
 		return
 	}
 	JSON(w, &ProvisionersResponse{
@@ -338,7 +373,7 @@ func (h *caHandler) ProvisionerKey(w http.ResponseWriter, r *http.Request) {
 	kid := chi.URLParam(r, "kid")
 	key, err := h.Authority.GetEncryptedKey(kid)
 	if err != nil {
-		WriteError(w, errs.NotFoundErr(err))
+		WriteError(w, r, errs.NotFoundErr(err))
 		return
 	}
 	JSON(w, &ProvisionerKeyResponse{key})
@@ -348,7 +383,7 @@ func (h *caHandler) ProvisionerKey(w http.ResponseWriter, r *http.Request) {
 func (h *caHandler) Roots(w http.ResponseWriter, r *http.Request) {
 	roots, err := h.Authority.GetRoots()
 	if err != nil {
-		WriteError(w, errs.ForbiddenErr(err))
+		WriteError(w, r, errs.ForbiddenErr(err))
 		return
 	}
 
@@ -366,7 +401,7 @@ func (h *caHandler) Roots(w http.ResponseWriter, r *http.Request) {
 func (h *caHandler) Federation(w http.ResponseWriter, r *http.Request) {
 	federated, err := h.Authority.GetFederation()
 	if err != nil {
-		WriteError(w, errs.ForbiddenErr(err))
+		WriteError(w, r, errs.ForbiddenErr(err))
 		return
 	}
 
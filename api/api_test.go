@@ -555,6 +555,7 @@ type mockAuthority struct {
 	ret1, ret2                   interface{}
 	err                          error
 	authorizeSign                func(ott string) ([]provisioner.SignOption, error)
+	authorizeClientCertificate   func(ctx context.Context, chain []*x509.Certificate) ([]provisioner.SignOption, error)
 	getTLSOptions                func() *authority.TLSOptions
 	root                         func(shasum string) (*x509.Certificate, error)
 	sign                         func(cr *x509.CertificateRequest, opts provisioner.SignOptions, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error)
@@ -567,6 +568,8 @@ type mockAuthority struct {
 	getEncryptedKey              func(kid string) (string, error)
 	getRoots                     func() ([]*x509.Certificate, error)
 	getFederation                func() ([]*x509.Certificate, error)
+	getX509Signers               func() ([]*x509.Certificate, error)
+	getCertificateChain          func(serial string) ([]*x509.Certificate, bool, error)
 	signSSH                      func(ctx context.Context, key ssh.PublicKey, opts provisioner.SignSSHOptions, signOpts ...provisioner.SignOption) (*ssh.Certificate, error)
 	signSSHAddUser               func(ctx context.Context, key ssh.PublicKey, cert *ssh.Certificate) (*ssh.Certificate, error)
 	renewSSH                     func(ctx context.Context, cert *ssh.Certificate) (*ssh.Certificate, error)
@@ -592,6 +595,13 @@ func (m *mockAuthority) AuthorizeSign(ott string) ([]provisioner.SignOption, err
 	return m.ret1.([]provisioner.SignOption), m.err
 }
 
+func (m *mockAuthority) AuthorizeClientCertificate(ctx context.Context, chain []*x509.Certificate) ([]provisioner.SignOption, error) {
+	if m.authorizeClientCertificate != nil {
+		return m.authorizeClientCertificate(ctx, chain)
+	}
+	return m.ret1.([]provisioner.SignOption), m.err
+}
+
 func (m *mockAuthority) GetTLSOptions() *authority.TLSOptions {
 	if m.getTLSOptions != nil {
 		return m.getTLSOptions()
@@ -676,6 +686,20 @@ func (m *mockAuthority) GetFederation() ([]*x509.Certificate, error) {
 	return m.ret1.([]*x509.Certificate), m.err
 }
 
+func (m *mockAuthority) GetX509Signers() ([]*x509.Certificate, error) {
+	if m.getX509Signers != nil {
+		return m.getX509Signers()
+	}
+	return m.ret1.([]*x509.Certificate), m.err
+}
+
+func (m *mockAuthority) GetCertificateChain(serial string) ([]*x509.Certificate, bool, error) {
+	if m.getCertificateChain != nil {
+		return m.getCertificateChain(serial)
+	}
+	return m.ret1.([]*x509.Certificate), m.ret2.(bool), m.err
+}
+
 func (m *mockAuthority) SignSSH(ctx context.Context, key ssh.PublicKey, opts provisioner.SignSSHOptions, signOpts ...provisioner.SignOption) (*ssh.Certificate, error) {
 	if m.signSSH != nil {
 		return m.signSSH(ctx, key, opts, signOpts...)
@@ -843,6 +867,67 @@ func Test_caHandler_Root(t *testing.T) {
 	}
 }
 
+func Test_caHandler_Certificate(t *testing.T) {
+	cert := parseCertificate(certPEM)
+	root := parseCertificate(rootPEM)
+	getCertificateChain := func(serial string) ([]*x509.Certificate, bool, error) {
+		switch serial {
+		case "1234":
+			return []*x509.Certificate{cert, root}, false, nil
+		case "5678":
+			return []*x509.Certificate{cert}, true, nil
+		default:
+			return nil, false, errs.NotFound("certificate %s not found", serial)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		serial     string
+		statusCode int
+		status     string
+		body       string
+	}{
+		{"ok", "1234", 200, "valid", certPEM + "\n" + rootPEM + "\n"},
+		{"ok revoked", "5678", 200, "revoked", certPEM + "\n"},
+		{"fail unknown", "9999", 404, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("serial", tt.serial)
+			req := httptest.NewRequest("GET", "http://example.com/certificate/"+tt.serial, nil)
+			req = req.WithContext(context.WithValue(context.Background(), chi.RouteCtxKey, chiCtx))
+
+			h := New(&mockAuthority{getCertificateChain: getCertificateChain}).(*caHandler)
+			w := httptest.NewRecorder()
+			h.Certificate(w, req)
+			res := w.Result()
+
+			if res.StatusCode != tt.statusCode {
+				t.Errorf("caHandler.Certificate StatusCode = %d, wants %d", res.StatusCode, tt.statusCode)
+			}
+			if got := res.Header.Get(CertificateStatusHeader); got != tt.status {
+				t.Errorf("caHandler.Certificate %s = %s, wants %s", CertificateStatusHeader, got, tt.status)
+			}
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Errorf("caHandler.Certificate unexpected error = %v", err)
+			}
+			if tt.statusCode == 200 {
+				if got := res.Header.Get("Content-Type"); got != "application/pem-certificate-chain" {
+					t.Errorf("caHandler.Certificate Content-Type = %s, wants application/pem-certificate-chain", got)
+				}
+				if string(body) != tt.body {
+					t.Errorf("caHandler.Certificate Body = %s, wants %s", body, tt.body)
+				}
+			}
+		})
+	}
+}
+
 func Test_caHandler_Sign(t *testing.T) {
 	csr := parseCertificateRequest(csrPEM)
 	valid, err := json.Marshal(SignRequest{
@@ -916,6 +1001,113 @@ func Test_caHandler_Sign(t *testing.T) {
 	}
 }
 
+func Test_caHandler_SignBatch(t *testing.T) {
+	csr := parseCertificateRequest(csrPEM)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "forbidden.smallstep.com"},
+	}, key)
+	assert.FatalError(t, err)
+	forbidden, err := x509.ParseCertificateRequest(der)
+	assert.FatalError(t, err)
+
+	entry := func(cr *x509.CertificateRequest) string {
+		b, err := json.Marshal(BatchSignEntry{CsrPEM: CertificateRequest{cr}})
+		assert.FatalError(t, err)
+		return string(b)
+	}
+	batch := strings.Join([]string{
+		entry(csr), entry(forbidden), "{", "", `{"csr":""}`, entry(csr),
+	}, "\n")
+	tooMany := strings.Repeat(entry(csr)+"\n", MaxBatchSignEntries+1)
+	tooLarge := `{"csr":"` + strings.Repeat("A", MaxBatchSignEntrySize) + `"}`
+	batchTooLarge := strings.Repeat("\n", MaxBatchSignSize) + entry(csr)
+
+	type result struct {
+		index  int
+		status int
+	}
+	tests := []struct {
+		name       string
+		ott        string
+		input      string
+		autherr    error
+		statusCode int
+		expected   []result
+	}{
+		{"ok", "foobarzar", entry(csr), nil, http.StatusCreated, []result{{0, 0}}},
+		{"ok mixed", "foobarzar", batch, nil, http.StatusCreated, []result{
+			{0, 0}, {1, http.StatusForbidden}, {2, http.StatusBadRequest}, {3, http.StatusBadRequest}, {4, 0},
+		}},
+		{"missing ott", "", batch, nil, http.StatusBadRequest, nil},
+		{"empty batch", "foobarzar", "\n\n", nil, http.StatusBadRequest, nil},
+		{"too many entries", "foobarzar", tooMany, nil, http.StatusRequestEntityTooLarge, nil},
+		{"entry too large", "foobarzar", tooLarge, nil, http.StatusRequestEntityTooLarge, nil},
+		{"batch too large", "foobarzar", batchTooLarge, nil, http.StatusRequestEntityTooLarge, nil},
+		{"authorize error", "foobarzar", batch, fmt.Errorf("an error"), http.StatusUnauthorized, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&mockAuthority{
+				authorizeSign: func(ott string) ([]provisioner.SignOption, error) {
+					assert.Equals(t, tt.ott, ott)
+					return nil, tt.autherr
+				},
+				sign: func(cr *x509.CertificateRequest, opts provisioner.SignOptions, signOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
+					if cr.Subject.CommonName != "test.smallstep.com" {
+						return nil, errors.Errorf("common name %s is not allowed", cr.Subject.CommonName)
+					}
+					return []*x509.Certificate{parseCertificate(certPEM), parseCertificate(rootPEM)}, nil
+				},
+			}).(*caHandler)
+			req := httptest.NewRequest("POST", "http://example.com/sign/batch", strings.NewReader(tt.input))
+			if tt.ott != "" {
+				req.Header.Set("Authorization", tt.ott)
+			}
+			w := httptest.NewRecorder()
+			h.SignBatch(logging.NewResponseLogger(w), req)
+			res := w.Result()
+
+			if res.StatusCode != tt.statusCode {
+				t.Errorf("caHandler.SignBatch StatusCode = %d, wants %d", res.StatusCode, tt.statusCode)
+			}
+
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Errorf("caHandler.SignBatch unexpected error = %v", err)
+			}
+			if tt.statusCode >= http.StatusBadRequest {
+				return
+			}
+
+			assert.Equals(t, []string{"application/x-ndjson"}, res.Header["Content-Type"])
+			lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+			if assert.Equals(t, len(tt.expected), len(lines)) {
+				for i, line := range lines {
+					var r BatchSignResponse
+					assert.FatalError(t, json.Unmarshal([]byte(line), &r))
+					assert.Equals(t, tt.expected[i].index, r.Index)
+					if tt.expected[i].status == 0 {
+						assert.Nil(t, r.Error)
+						if assert.NotNil(t, r.SignResponse) {
+							assert.Equals(t, parseCertificate(certPEM), r.ServerPEM.Certificate)
+							assert.Equals(t, 2, len(r.CertChainPEM))
+						}
+					} else {
+						assert.Nil(t, r.SignResponse)
+						if assert.NotNil(t, r.Error) {
+							assert.Equals(t, tt.expected[i].status, r.Error.Status)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
 func Test_caHandler_Renew(t *testing.T) {
 	cs := &tls.ConnectionState{
 		PeerCertificates: []*x509.Certificate{parseCertificate(certPEM)},
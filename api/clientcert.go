@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+type clientCertificateChainKey struct{}
+
+// NewClientCertificateHandler returns a handler that only exposes to the next
+// handler the client certificates issued by the given roots.
+//
+// When MTLS provisioners are configured, the TLS server also accepts client
+// certificates issued by other PKIs. Those certificates are removed from the
+// TLS connection state of the request and stored in the request context, so
+// the endpoints that authenticate the client certificate of the connection,
+// like renew, rekey or revoke, only see certificates issued by the CA, and
+// only the sign endpoint can use the others.
+func NewClientCertificateHandler(next http.Handler, roots []*x509.Certificate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && !isIssuedByRoots(r.TLS.VerifiedChains, roots) {
+			cs := *r.TLS
+			chain := cs.PeerCertificates
+			cs.PeerCertificates = nil
+			cs.VerifiedChains = nil
+			r = r.WithContext(context.WithValue(r.Context(), clientCertificateChainKey{}, chain))
+			r.TLS = &cs
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCertificateChainFromContext returns the client certificate chain of
+// other PKI, the leaf first, stored in the context by the
+// ClientCertificateHandler.
+func clientCertificateChainFromContext(ctx context.Context) ([]*x509.Certificate, bool) {
+	chain, ok := ctx.Value(clientCertificateChainKey{}).([]*x509.Certificate)
+	return chain, ok && len(chain) > 0
+}
+
+// isIssuedByRoots returns true if one of the verified chains ends in one of the
+// given roots.
+func isIssuedByRoots(verifiedChains [][]*x509.Certificate, roots []*x509.Certificate) bool {
+	for _, chain := range verifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		last := chain[len(chain)-1]
+		for _, root := range roots {
+			if last.Equal(root) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/logging"
+)
+
+func mustForeignCertificate(t *testing.T) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "workload"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return crt
+}
+
+func TestNewClientCertificateHandler(t *testing.T) {
+	root := parseCertificate(rootPEM)
+	leaf := parseCertificate(certPEM)
+	foreign := mustForeignCertificate(t)
+
+	tests := []struct {
+		name      string
+		tls       *tls.ConnectionState
+		wantPeers []*x509.Certificate
+		wantChain []*x509.Certificate
+	}{
+		{"no tls", nil, nil, nil},
+		{"no client certificate", &tls.ConnectionState{}, nil, nil},
+		{"issued by the CA", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf},
+			VerifiedChains:   [][]*x509.Certificate{{leaf, root}},
+		}, []*x509.Certificate{leaf}, nil},
+		{"other PKI", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{foreign},
+			VerifiedChains:   [][]*x509.Certificate{{foreign}},
+		}, nil, []*x509.Certificate{foreign}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				var peers []*x509.Certificate
+				if r.TLS != nil {
+					peers = r.TLS.PeerCertificates
+					if peers == nil {
+						assert.Len(t, 0, r.TLS.VerifiedChains)
+					}
+				}
+				assert.Equals(t, peers, tt.wantPeers)
+				chain, ok := clientCertificateChainFromContext(r.Context())
+				assert.Equals(t, ok, tt.wantChain != nil)
+				assert.Equals(t, chain, tt.wantChain)
+			})
+			req := httptest.NewRequest("POST", "http://example.com/sign", nil)
+			req.TLS = tt.tls
+			NewClientCertificateHandler(next, []*x509.Certificate{root}).ServeHTTP(httptest.NewRecorder(), req)
+			assert.True(t, called)
+			// The connection state of the original request is not modified.
+			if tt.tls != nil {
+				assert.Equals(t, req.TLS, tt.tls)
+			}
+		})
+	}
+}
+
+func Test_caHandler_Sign_clientCertificate(t *testing.T) {
+	csr := parseCertificateRequest(csrPEM)
+	foreign := mustForeignCertificate(t)
+	withToken, err := json.Marshal(SignRequest{CsrPEM: CertificateRequest{csr}, OTT: "foobarzar"})
+	assert.FatalError(t, err)
+	withoutToken, err := json.Marshal(SignRequest{CsrPEM: CertificateRequest{csr}})
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name       string
+		input      string
+		chain      []*x509.Certificate
+		autherr    error
+		wantMTLS   bool
+		statusCode int
+	}{
+		{"ok", string(withoutToken), []*x509.Certificate{foreign}, nil, true, http.StatusCreated},
+		{"ok/token", string(withToken), []*x509.Certificate{foreign}, nil, false, http.StatusCreated},
+		{"fail/unauthorized", string(withoutToken), []*x509.Certificate{foreign}, fmt.Errorf("an error"), true, http.StatusUnauthorized},
+		{"fail/no-client-certificate", string(withoutToken), nil, nil, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var usedMTLS, usedToken bool
+			h := New(&mockAuthority{
+				ret1: parseCertificate(certPEM), ret2: parseCertificate(rootPEM),
+				authorizeSign: func(ott string) ([]provisioner.SignOption, error) {
+					usedToken = true
+					return nil, nil
+				},
+				authorizeClientCertificate: func(ctx context.Context, chain []*x509.Certificate) ([]provisioner.SignOption, error) {
+					usedMTLS = true
+					assert.Equals(t, chain, tt.chain)
+					return nil, tt.autherr
+				},
+				getTLSOptions: func() *authority.TLSOptions {
+					return nil
+				},
+			}).(*caHandler)
+			req := httptest.NewRequest("POST", "http://example.com/sign", strings.NewReader(tt.input))
+			if tt.chain != nil {
+				req.TLS = &tls.ConnectionState{
+					PeerCertificates: tt.chain,
+					VerifiedChains:   [][]*x509.Certificate{tt.chain},
+				}
+			}
+			w := httptest.NewRecorder()
+			handler := NewClientCertificateHandler(http.HandlerFunc(h.Sign), []*x509.Certificate{parseCertificate(rootPEM)})
+			handler.ServeHTTP(logging.NewResponseLogger(w), req)
+			res := w.Result()
+
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+			assert.Equals(t, usedMTLS, tt.wantMTLS)
+			if tt.statusCode != http.StatusBadRequest {
+				assert.Equals(t, usedToken, !tt.wantMTLS)
+			}
+		})
+	}
+}
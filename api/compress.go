@@ -0,0 +1,170 @@
+package api
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressionMinSize is the default minimum size in bytes that a
+// response must have to be compressed.
+const DefaultCompressionMinSize = 1024
+
+// NewCompressionHandler returns an http.Handler that compresses with gzip the
+// successful responses of the given handler if the client accepts it and the
+// response is at least minSize bytes long. Error responses and small responses
+// are always sent uncompressed. All the responses include the header
+// "Vary: Accept-Encoding", so caches don't serve a compressed response to a
+// client that doesn't accept it, or the other way around.
+func NewCompressionHandler(next http.Handler, minSize int) http.Handler {
+	if minSize <= 0 {
+		minSize = DefaultCompressionMinSize
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(strings.Join(r.Header.Values("Accept-Encoding"), ",")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			minSize:        minSize,
+			status:         http.StatusOK,
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip returns true if the given Accept-Encoding header value allows a
+// gzip encoded response. An explicit gzip value takes precedence over "*".
+func acceptsGzip(acceptEncoding string) bool {
+	var gzipQ, anyQ *float64
+	for _, enc := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(enc, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "gzip" {
+			gzipQ = &q
+		} else {
+			anyQ = &q
+		}
+	}
+	switch {
+	case gzipQ != nil:
+		return *gzipQ > 0
+	case anyQ != nil:
+		return *anyQ > 0
+	default:
+		return false
+	}
+}
+
+// compressResponseWriter is an http.ResponseWriter that buffers the response
+// until it knows if it has to be compressed or not. The headers and the status
+// code are written once the buffer reaches the minimum size or when the
+// writer is closed.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	minSize     int
+	status      int
+	buf         []byte
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader records the status code, it will be written with the first
+// chunk of the response.
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+	}
+}
+
+// Write buffers the given bytes until the minimum size is reached, after that
+// it writes them directly to the gzip writer or the underlying writer.
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(b)
+	case w.wroteHeader:
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes any buffered data and flushes the gzip writer and the
+// underlying writer, so streamed responses are sent as they are written. A
+// response flushed before reaching the minimum size is not compressed.
+func (w *compressResponseWriter) Flush() {
+	if !w.wroteHeader {
+		if err := w.flushBuffer(); err != nil {
+			return
+		}
+	}
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes any buffered data and closes the gzip writer if the response
+// was compressed.
+func (w *compressResponseWriter) Close() error {
+	if !w.wroteHeader {
+		if err := w.flushBuffer(); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+// flushBuffer writes the headers and the buffered data, enabling the
+// compression if the response is large enough, it's successful, and it's not
+// already encoded.
+func (w *compressResponseWriter) flushBuffer() error {
+	h := w.Header()
+	if len(w.buf) >= w.minSize && w.status >= 200 && w.status < 300 && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func TestNewCompressionHandler(t *testing.T) {
+	largeCRL := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	smallError := []byte(`{"type":"urn:ietf:params:acme:error:malformed","detail":"bad request"}`)
+	largeError := bytes.Repeat([]byte(" "), 4096)
+
+	type test struct {
+		handler        http.HandlerFunc
+		acceptEncoding string
+		minSize        int
+		statusCode     int
+		compressed     bool
+		body           []byte
+		header         http.Header
+	}
+	tests := map[string]test{
+		"ok/large-crl": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/pkix-crl")
+				w.Header().Set("Replay-Nonce", "nonce")
+				w.Write(largeCRL[:1000])
+				w.Write(largeCRL[1000:])
+			},
+			acceptEncoding: "gzip, deflate",
+			statusCode:     http.StatusOK,
+			compressed:     true,
+			body:           largeCRL,
+			header: http.Header{
+				"Content-Type":     {"application/pkix-crl"},
+				"Content-Encoding": {"gzip"},
+				"Replay-Nonce":     {"nonce"},
+				"Vary":             {"Accept-Encoding"},
+			},
+		},
+		"ok/small-error": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.Header().Set("Replay-Nonce", "nonce")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(smallError)
+			},
+			acceptEncoding: "gzip",
+			statusCode:     http.StatusBadRequest,
+			body:           smallError,
+			header: http.Header{
+				"Content-Type": {"application/problem+json"},
+				"Replay-Nonce": {"nonce"},
+				"Vary":         {"Accept-Encoding"},
+			},
+		},
+		"ok/large-error": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(largeError)
+			},
+			acceptEncoding: "gzip",
+			statusCode:     http.StatusInternalServerError,
+			body:           largeError,
+			header: http.Header{
+				"Content-Type": {"application/problem+json"},
+				"Vary":         {"Accept-Encoding"},
+			},
+		},
+		"ok/small-response": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/pkix-crl")
+				w.Write(largeCRL[:100])
+			},
+			acceptEncoding: "gzip",
+			statusCode:     http.StatusOK,
+			body:           largeCRL[:100],
+			header: http.Header{
+				"Content-Type": {"application/pkix-crl"},
+				"Vary":         {"Accept-Encoding"},
+			},
+		},
+		"ok/custom-min-size": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/pkix-crl")
+				w.Write(largeCRL[:100])
+			},
+			acceptEncoding: "gzip",
+			minSize:        100,
+			statusCode:     http.StatusOK,
+			compressed:     true,
+			body:           largeCRL[:100],
+			header: http.Header{
+				"Content-Type":     {"application/pkix-crl"},
+				"Content-Encoding": {"gzip"},
+				"Vary":             {"Accept-Encoding"},
+			},
+		},
+		"ok/gzip-not-accepted": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/pkix-crl")
+				w.Write(largeCRL)
+			},
+			acceptEncoding: "gzip;q=0, identity",
+			statusCode:     http.StatusOK,
+			body:           largeCRL,
+			header: http.Header{
+				"Content-Type": {"application/pkix-crl"},
+				"Vary":         {"Accept-Encoding"},
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/crl", nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			NewCompressionHandler(tc.handler, tc.minSize).ServeHTTP(w, req)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equals(t, res.StatusCode, tc.statusCode)
+			assert.Equals(t, res.Header, tc.header)
+
+			var r io.Reader = res.Body
+			if tc.compressed {
+				gz, err := gzip.NewReader(res.Body)
+				assert.FatalError(t, err)
+				r = gz
+			}
+			body, err := io.ReadAll(r)
+			assert.FatalError(t, err)
+			assert.Equals(t, body, tc.body)
+		})
+	}
+}
+
+func TestNewCompressionHandler_flush(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 128)
+	small := []byte("0123456789abcdef")
+
+	t.Run("compressed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler := func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write(large)
+			rw.(http.Flusher).Flush()
+
+			// The flushed data can be decompressed before the response ends.
+			assert.True(t, w.Flushed)
+			gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+			assert.FatalError(t, err)
+			b := make([]byte, len(large))
+			_, err = io.ReadFull(gz, b)
+			assert.FatalError(t, err)
+			assert.Equals(t, b, large)
+
+			rw.Write(small)
+		}
+		req := httptest.NewRequest("GET", "/stream", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		NewCompressionHandler(http.HandlerFunc(handler), 1024).ServeHTTP(w, req)
+
+		assert.Equals(t, w.Header().Get("Content-Encoding"), "gzip")
+		gz, err := gzip.NewReader(w.Body)
+		assert.FatalError(t, err)
+		body, err := io.ReadAll(gz)
+		assert.FatalError(t, err)
+		assert.Equals(t, body, append(append([]byte{}, large...), small...))
+	})
+
+	t.Run("small", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler := func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write(small)
+			rw.(http.Flusher).Flush()
+
+			// A response flushed before reaching the minimum size is not
+			// compressed.
+			assert.True(t, w.Flushed)
+			assert.Equals(t, w.Body.Bytes(), small)
+
+			rw.Write(large)
+		}
+		req := httptest.NewRequest("GET", "/stream", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		NewCompressionHandler(http.HandlerFunc(handler), 1024).ServeHTTP(w, req)
+
+		assert.Equals(t, w.Header().Get("Content-Encoding"), "")
+		assert.Equals(t, w.Header().Values("Vary"), []string{"Accept-Encoding"})
+		assert.Equals(t, w.Body.Bytes(), append(append([]byte{}, small...), large...))
+	})
+}
+
+func Test_acceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                    false,
+		"identity":            false,
+		"deflate, br":         false,
+		"gzip":                true,
+		"GZIP":                true,
+		"deflate, gzip;q=1.0": true,
+		"gzip;q=0.5":          true,
+		"gzip;q=0":            false,
+		"*":                   true,
+		"*;q=0":               false,
+		"gzip;q=0, *":         false,
+		"*, gzip;q=0":         false,
+		"*;q=0, gzip":         true,
+		"deflate, *":          true,
+	}
+	for acceptEncoding, want := range tests {
+		t.Run(acceptEncoding, func(t *testing.T) {
+			assert.Equals(t, acceptsGzip(acceptEncoding), want)
+		})
+	}
+}
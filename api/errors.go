@@ -14,14 +14,16 @@ import (
 	"github.com/smallstep/certificates/scep"
 )
 
-// WriteError writes to w a JSON representation of the given error.
-func WriteError(w http.ResponseWriter, err error) {
+// WriteError writes to w a JSON representation of the given error. The id of
+// the request is added to the errors of the CA, ACME and admin APIs, so they
+// can be correlated with the logs.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
 	switch k := err.(type) {
 	case *acme.Error:
-		acme.WriteError(w, k)
+		acme.WriteError(w, r, k)
 		return
 	case *admin.Error:
-		admin.WriteError(w, k)
+		admin.WriteError(w, r, k)
 		return
 	case *scep.Error:
 		w.Header().Set("Content-Type", "text/plain")
@@ -58,6 +60,14 @@ func WriteError(w http.ResponseWriter, err error) {
 		}
 	}
 
+	if e, ok := err.(*errs.Error); ok {
+		if id, ok := logging.GetRequestID(r.Context()); ok {
+			ee := *e
+			ee.RequestID = id
+			err = &ee
+		}
+	}
+
 	if err := json.NewEncoder(w).Encode(err); err != nil {
 		LogError(w, err)
 	}
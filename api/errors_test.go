@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/logging"
+)
+
+func TestWriteError_requestID(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		statusCode int
+	}{
+		{"errs", errs.BadRequest("bad request"), 400},
+		{"acme", acme.NewError(acme.ErrorMalformedType, "bad request"), 400},
+		{"admin", admin.NewError(admin.ErrorBadRequestType, "bad request"), 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/sign", nil)
+			r = r.WithContext(logging.WithRequestID(r.Context(), "reqID"))
+			w := httptest.NewRecorder()
+			WriteError(w, r, tt.err)
+
+			res := w.Result()
+			assert.Equals(t, res.StatusCode, tt.statusCode)
+			var body map[string]interface{}
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&body))
+			assert.Equals(t, body["requestId"], "reqID")
+		})
+	}
+
+	t.Run("ok/no-request-id", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		WriteError(w, httptest.NewRequest("GET", "/sign", nil), errs.BadRequest("bad request"))
+
+		var body map[string]interface{}
+		assert.FatalError(t, json.NewDecoder(w.Result().Body).Decode(&body))
+		_, ok := body["requestId"]
+		assert.False(t, ok)
+	})
+}
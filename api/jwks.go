@@ -0,0 +1,60 @@
+package api
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/smallstep/certificates/errs"
+	"go.step.sm/crypto/jose"
+)
+
+// JWKS returns the public keys of the active X.509 signers of the CA as a JSON
+// Web Key Set. The key id of each key is the hex-encoded subject key
+// identifier of its certificate, and the certificate is included in the x5c
+// parameter.
+func (h *caHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	signers, err := h.Authority.GetX509Signers()
+	if err != nil {
+		WriteError(w, r, errs.InternalServerErr(err))
+		return
+	}
+
+	keys := make([]jose.JSONWebKey, len(signers))
+	for i, crt := range signers {
+		kid, err := subjectKeyID(crt)
+		if err != nil {
+			WriteError(w, r, errs.InternalServerErr(err))
+			return
+		}
+		keys[i] = jose.JSONWebKey{
+			Key:          crt.PublicKey,
+			KeyID:        kid,
+			Use:          "sig",
+			Certificates: []*x509.Certificate{crt},
+		}
+	}
+
+	JSON(w, &jose.JSONWebKeySet{Keys: keys})
+}
+
+// subjectKeyID returns the hex-encoded subject key identifier of the
+// certificate. If the certificate does not have one, it is computed using the
+// method 1 of RFC 5280, section 4.2.1.2.
+func subjectKeyID(crt *x509.Certificate) (string, error) {
+	if len(crt.SubjectKeyId) > 0 {
+		return hex.EncodeToString(crt.SubjectKeyId), nil
+	}
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(crt.RawSubjectPublicKeyInfo, &info); err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(info.PublicKey.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
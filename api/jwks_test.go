@@ -0,0 +1,113 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"go.step.sm/crypto/jose"
+)
+
+func newSignerCertificate(t *testing.T, signer crypto.Signer, ski []byte) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          ski,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return crt
+}
+
+func Test_caHandler_JWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.FatalError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.FatalError(t, err)
+
+	ecCert := newSignerCertificate(t, ecKey, []byte{1, 2, 3, 4})
+	rsaCert := newSignerCertificate(t, rsaKey, []byte{5, 6, 7, 8})
+	// Go 1.15+ adds a subject key identifier to CA certificates, remove it
+	// to test the computed one.
+	edCert := newSignerCertificate(t, edKey, nil)
+	edCert.SubjectKeyId = nil
+	edSum := sha1.Sum(edKey.Public().(ed25519.PublicKey))
+
+	type key struct {
+		kid     string
+		keyType reflect.Type
+	}
+	tests := []struct {
+		name       string
+		signers    []*x509.Certificate
+		err        error
+		statusCode int
+		want       []key
+	}{
+		{"ok", []*x509.Certificate{ecCert, rsaCert, edCert}, nil, http.StatusOK, []key{
+			{"01020304", reflect.TypeOf(&ecdsa.PublicKey{})},
+			{"05060708", reflect.TypeOf(&rsa.PublicKey{})},
+			{hex.EncodeToString(edSum[:]), reflect.TypeOf(ed25519.PublicKey{})},
+		}},
+		{"ok/rotated", []*x509.Certificate{rsaCert}, nil, http.StatusOK, []key{
+			{"05060708", reflect.TypeOf(&rsa.PublicKey{})},
+		}},
+		{"ok/empty", nil, nil, http.StatusOK, []key{}},
+		{"fail", nil, fmt.Errorf("an error"), http.StatusInternalServerError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&mockAuthority{ret1: tt.signers, err: tt.err}).(*caHandler)
+			req := httptest.NewRequest("GET", "http://example.com/jwks", nil)
+			w := httptest.NewRecorder()
+			h.JWKS(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.statusCode {
+				t.Errorf("caHandler.JWKS StatusCode = %d, wants %d", res.StatusCode, tt.statusCode)
+			}
+			if tt.statusCode >= http.StatusBadRequest {
+				return
+			}
+
+			var jwks jose.JSONWebKeySet
+			assert.FatalError(t, json.NewDecoder(res.Body).Decode(&jwks))
+			got := []key{}
+			for i, k := range jwks.Keys {
+				assert.Equals(t, k.Use, "sig")
+				if assert.Len(t, 1, k.Certificates) {
+					assert.Equals(t, k.Certificates[0].Raw, tt.signers[i].Raw)
+				}
+				got = append(got, key{k.KeyID, reflect.TypeOf(k.Key)})
+			}
+			assert.Equals(t, got, tt.want)
+		})
+	}
+}
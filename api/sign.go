@@ -22,16 +22,24 @@ type SignRequest struct {
 // Validate checks the fields of the SignRequest and returns nil if they are ok
 // or an error if something is wrong.
 func (s *SignRequest) Validate() error {
+	if err := s.validateCSR(); err != nil {
+		return err
+	}
+	if s.OTT == "" {
+		return errs.BadRequest("missing ott")
+	}
+
+	return nil
+}
+
+// validateCSR checks the certificate request of the SignRequest.
+func (s *SignRequest) validateCSR() error {
 	if s.CsrPEM.CertificateRequest == nil {
 		return errs.BadRequest("missing csr")
 	}
 	if err := s.CsrPEM.CertificateRequest.CheckSignature(); err != nil {
 		return errs.BadRequestErr(err, "invalid csr")
 	}
-	if s.OTT == "" {
-		return errs.BadRequest("missing ott")
-	}
-
 	return nil
 }
 
@@ -47,17 +55,30 @@ type SignResponse struct {
 // Sign is an HTTP handler that reads a certificate request and an
 // one-time-token (ott) from the body and creates a new certificate with the
 // information in the certificate request.
+//
+// If the request does not contain a token, but it's made using a client
+// certificate issued by other PKI, the request is authorized by the MTLS
+// provisioners using the client certificate.
 func (h *caHandler) Sign(w http.ResponseWriter, r *http.Request) {
 	var body SignRequest
 	if err := ReadJSON(r.Body, &body); err != nil {
-		WriteError(w, errs.BadRequestErr(err, "error reading request body"))
+		WriteError(w, r, errs.BadRequestErr(err, "error reading request body"))
 		return
 	}
 
-	logOtt(w, body.OTT)
-	if err := body.Validate(); err != nil {
-		WriteError(w, err)
-		return
+	chain, useClientCertificate := clientCertificateChainFromContext(r.Context())
+	useClientCertificate = useClientCertificate && body.OTT == ""
+	if useClientCertificate {
+		if err := body.validateCSR(); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+	} else {
+		logOtt(w, body.OTT)
+		if err := body.Validate(); err != nil {
+			WriteError(w, r, err)
+			return
+		}
 	}
 
 	opts := provisioner.SignOptions{
@@ -66,15 +87,21 @@ func (h *caHandler) Sign(w http.ResponseWriter, r *http.Request) {
 		TemplateData: body.TemplateData,
 	}
 
-	signOpts, err := h.Authority.AuthorizeSign(body.OTT)
+	var signOpts []provisioner.SignOption
+	var err error
+	if useClientCertificate {
+		signOpts, err = h.Authority.AuthorizeClientCertificate(r.Context(), chain)
+	} else {
+		signOpts, err = h.Authority.AuthorizeSign(body.OTT)
+	}
 	if err != nil {
-		WriteError(w, errs.UnauthorizedErr(err))
+		WriteError(w, r, errs.UnauthorizedErr(err))
 		return
 	}
 
 	certChain, err := h.Authority.Sign(body.CsrPEM.CertificateRequest, opts, signOpts...)
 	if err != nil {
-		WriteError(w, errs.ForbiddenErr(err))
+		WriteError(w, r, errs.ForbiddenErr(err))
 		return
 	}
 	certChainPEM := certChainToPEM(certChain)
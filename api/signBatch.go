@@ -0,0 +1,213 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/logging"
+)
+
+const (
+	// MaxBatchSignEntries is the maximum number of certificate requests
+	// accepted in a single batch.
+	MaxBatchSignEntries = 1000
+	// MaxBatchSignEntrySize is the maximum size in bytes of a single entry,
+	// one line, in a batch.
+	MaxBatchSignEntrySize = 64 * 1024
+	// MaxBatchSignSize is the maximum size in bytes of a batch. The whole
+	// batch is read before signing the first entry, so this limits the memory
+	// used by a request.
+	MaxBatchSignSize = 2 * 1024 * 1024
+)
+
+// BatchSignEntry is each one of the lines of a batch sign request. It has the
+// same fields than a SignRequest except for the token, that is shared by all
+// the entries and sent in the Authorization header.
+type BatchSignEntry struct {
+	CsrPEM       CertificateRequest `json:"csr"`
+	NotAfter     TimeDuration       `json:"notAfter,omitempty"`
+	NotBefore    TimeDuration       `json:"notBefore,omitempty"`
+	TemplateData json.RawMessage    `json:"templateData,omitempty"`
+}
+
+// Validate checks the fields of the BatchSignEntry and returns nil if they are
+// ok or an error if something is wrong.
+func (s *BatchSignEntry) Validate() error {
+	if s.CsrPEM.CertificateRequest == nil {
+		return errs.BadRequest("missing csr")
+	}
+	if err := s.CsrPEM.CertificateRequest.CheckSignature(); err != nil {
+		return errs.BadRequestErr(err, "invalid csr")
+	}
+	return nil
+}
+
+// BatchSignResponse is each one of the lines of a batch sign response. Index
+// is the position, starting at 0, of the entry in the request. Only one of the
+// certificate fields or the error is set.
+type BatchSignResponse struct {
+	Index int `json:"index"`
+	*SignResponse
+	Error *errs.Error `json:"error,omitempty"`
+}
+
+// batchSignItem is an entry of the batch or the error found decoding it.
+type batchSignItem struct {
+	entry *BatchSignEntry
+	err   error
+}
+
+// readBatchSignEntries reads the newline delimited JSON entries in r. Errors
+// decoding or validating an entry are kept with the entry so they can be
+// reported independently. Only a batch exceeding the limits, or a body that
+// cannot be read, is an error for the whole request.
+func readBatchSignEntries(r *http.Request) ([]batchSignItem, error) {
+	var items []batchSignItem
+	body := &io.LimitedReader{R: r.Body, N: MaxBatchSignSize + 1}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 4096), MaxBatchSignEntrySize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == MaxBatchSignEntries {
+			return nil, errs.New(http.StatusRequestEntityTooLarge,
+				"batch exceeds the maximum number of entries (%d)", MaxBatchSignEntries)
+		}
+		entry := new(BatchSignEntry)
+		if err := json.Unmarshal(line, entry); err != nil {
+			items = append(items, batchSignItem{err: errs.BadRequestErr(err, "error decoding json")})
+			continue
+		}
+		items = append(items, batchSignItem{entry: entry, err: entry.Validate()})
+	}
+	if body.N <= 0 {
+		return nil, errs.New(http.StatusRequestEntityTooLarge,
+			"batch exceeds the maximum size (%d bytes)", MaxBatchSignSize)
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, errs.New(http.StatusRequestEntityTooLarge,
+				"batch entry exceeds the maximum size (%d bytes)", MaxBatchSignEntrySize)
+		}
+		return nil, errs.BadRequestErr(err, "error reading request body")
+	}
+	if len(items) == 0 {
+		return nil, errs.BadRequest("missing batch entries")
+	}
+	return items, nil
+}
+
+// SignBatch is an HTTP handler that reads a stream of certificate requests in
+// newline delimited JSON, and signs all of them using the one-time-token (ott)
+// in the Authorization header. The same sign options, and therefore the same
+// provisioner policies and templates, are applied to each one of the entries.
+//
+// The response is also newline delimited JSON, with one line per entry written
+// and flushed as soon as the certificate is signed. An entry that cannot be
+// signed is reported with its error and the rest of the batch continues. The
+// entries are processed one at a time, so a client reading the response slowly
+// throttles the signing.
+func (h *caHandler) SignBatch(w http.ResponseWriter, r *http.Request) {
+	ott := r.Header.Get("Authorization")
+	logOtt(w, ott)
+	if ott == "" {
+		WriteError(w, r, errs.BadRequest("missing ott"))
+		return
+	}
+
+	// The whole body is read before writing the response, HTTP/1.x does not
+	// allow reading the request after the response has been started. The
+	// size of the body is limited by MaxBatchSignSize.
+	items, err := readBatchSignEntries(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	signOpts, err := h.Authority.AuthorizeSign(ott)
+	if err != nil {
+		WriteError(w, r, errs.UnauthorizedErr(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusCreated)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	var signed, failed int
+	for i, item := range items {
+		// Stop if the client is gone.
+		if r.Context().Err() != nil {
+			break
+		}
+		res := h.signBatchEntry(item, signOpts)
+		res.Index = i
+		if res.Error != nil {
+			failed++
+		} else {
+			signed++
+		}
+		if err := enc.Encode(res); err != nil {
+			LogError(w, err)
+			break
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	logBatchSign(w, len(items), signed, failed)
+}
+
+func (h *caHandler) signBatchEntry(item batchSignItem, signOpts []provisioner.SignOption) *BatchSignResponse {
+	if item.err != nil {
+		return &BatchSignResponse{Error: toBatchSignError(item.err)}
+	}
+
+	opts := provisioner.SignOptions{
+		NotBefore:    item.entry.NotBefore,
+		NotAfter:     item.entry.NotAfter,
+		TemplateData: item.entry.TemplateData,
+	}
+	certChain, err := h.Authority.Sign(item.entry.CsrPEM.CertificateRequest, opts, signOpts...)
+	if err != nil {
+		return &BatchSignResponse{Error: toBatchSignError(errs.ForbiddenErr(err))}
+	}
+	certChainPEM := certChainToPEM(certChain)
+	var caPEM Certificate
+	if len(certChainPEM) > 1 {
+		caPEM = certChainPEM[1]
+	}
+	return &BatchSignResponse{
+		SignResponse: &SignResponse{
+			ServerPEM:    certChainPEM[0],
+			CaPEM:        caPEM,
+			CertChainPEM: certChainPEM,
+		},
+	}
+}
+
+func toBatchSignError(err error) *errs.Error {
+	if e, ok := err.(*errs.Error); ok {
+		return e
+	}
+	return errs.InternalServerErr(err).(*errs.Error)
+}
+
+func logBatchSign(w http.ResponseWriter, total, signed, failed int) {
+	if rl, ok := w.(logging.ResponseLogger); ok {
+		rl.WithFields(map[string]interface{}{
+			"batch-entries": total,
+			"batch-signed":  signed,
+			"batch-failed":  failed,
+		})
+	}
+}
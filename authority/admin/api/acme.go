@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/admin"
+)
+
+// GetAccountOrdersResponse for returning the orders of an ACME account.
+type GetAccountOrdersResponse struct {
+	Orders []*acme.Order `json:"orders"`
+}
+
+// GetAccountOrders returns the orders of an ACME account, in any state, with
+// the same set of identifiers as the ones in the identifier query params. It
+// helps to debug why a client keeps creating new orders instead of reusing the
+// existing ones. The identifiers are IPs if they can be parsed as one, and dns
+// names otherwise.
+func (h *Handler) GetAccountOrders(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	accID := chi.URLParam(r, "id")
+
+	if h.acmeDB == nil {
+		api.WriteError(w, r, admin.NewError(admin.ErrorNotImplementedType,
+			"acme database not configured"))
+		return
+	}
+
+	values := r.URL.Query()["identifier"]
+	if len(values) == 0 {
+		api.WriteError(w, r, admin.NewError(admin.ErrorBadRequestType,
+			"identifier query param cannot be empty"))
+		return
+	}
+	identifiers := make([]acme.Identifier, len(values))
+	for i, v := range values {
+		if v == "" {
+			api.WriteError(w, r, admin.NewError(admin.ErrorBadRequestType,
+				"identifier query param cannot be empty"))
+			return
+		}
+		identifiers[i] = acme.Identifier{Type: acme.DNS, Value: v}
+		if net.ParseIP(v) != nil {
+			identifiers[i].Type = acme.IP
+		}
+	}
+
+	if _, err := h.acmeDB.GetAccount(ctx, accID); err != nil {
+		if errors.Is(err, acme.ErrNotFound) {
+			api.WriteError(w, r, admin.NewError(admin.ErrorNotFoundType,
+				"acme account %s not found", accID))
+			return
+		}
+		api.WriteError(w, r, admin.WrapErrorISE(err, "error loading acme account %s", accID))
+		return
+	}
+
+	oids, err := h.acmeDB.GetOrdersByIdentifiers(ctx, accID, identifiers)
+	if err != nil {
+		api.WriteError(w, r, admin.WrapErrorISE(err, "error loading orders for acme account %s", accID))
+		return
+	}
+	orders := make([]*acme.Order, 0, len(oids))
+	for _, oid := range oids {
+		o, err := h.acmeDB.GetOrder(ctx, oid)
+		if err != nil {
+			api.WriteError(w, r, admin.WrapErrorISE(err, "error loading order %s", oid))
+			return
+		}
+		orders = append(orders, o)
+	}
+	api.JSON(w, &GetAccountOrdersResponse{
+		Orders: orders,
+	})
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/admin"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ndjsonContentType is the content type used to stream certificates as
+// newline delimited JSON.
+const ndjsonContentType = "application/x-ndjson"
+
+// GetCertificatesResponse for returning a list of certificates.
+type GetCertificatesResponse struct {
+	Certificates []*authority.CertificateInfo `json:"certificates"`
+	NextCursor   string                       `json:"nextCursor"`
+}
+
+// RevokeByKeyRequest is the body of a request to revoke all the certificates
+// with a public key.
+type RevokeByKeyRequest struct {
+	Fingerprint string `json:"fingerprint"`
+	ReasonCode  int    `json:"reasonCode"`
+	Reason      string `json:"reason"`
+}
+
+// Validate validates a revoke by key request body.
+func (r *RevokeByKeyRequest) Validate() error {
+	if b, err := hex.DecodeString(r.Fingerprint); err != nil || len(b) != sha256.Size {
+		return admin.NewError(admin.ErrorBadRequestType, "fingerprint must be a hex encoded SHA-256 hash")
+	}
+	if r.ReasonCode < ocsp.Unspecified || r.ReasonCode > ocsp.AACompromise {
+		return admin.NewError(admin.ErrorBadRequestType, "reasonCode out of bounds")
+	}
+	return nil
+}
+
+// RevokeByKeyResponse is the response to a revoke by key request, with the
+// serial numbers of the revoked certificates.
+type RevokeByKeyResponse struct {
+	Revoked []string `json:"revoked"`
+}
+
+// RevokeCertificatesByKey revokes all the certificates with the public key
+// with the requested SHA-256 fingerprint, e.g. after a key compromise.
+func (h *Handler) RevokeCertificatesByKey(w http.ResponseWriter, r *http.Request) {
+	var body RevokeByKeyRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, r, admin.WrapError(admin.ErrorBadRequestType, err, "error reading request body"))
+		return
+	}
+
+	if err := body.Validate(); err != nil {
+		api.WriteError(w, r, err)
+		return
+	}
+
+	revoked, err := h.auth.RevokeByKeyFingerprint(r.Context(), body.Fingerprint, body.ReasonCode, body.Reason)
+	if err != nil {
+		api.WriteError(w, r, err)
+		return
+	}
+	api.JSON(w, &RevokeByKeyResponse{Revoked: revoked})
+}
+
+// GetCertificate returns the issuance metadata of the certificate with the
+// requested serial number, or an error.
+func (h *Handler) GetCertificate(w http.ResponseWriter, r *http.Request) {
+	serial := chi.URLParam(r, "serial")
+
+	info, err := h.auth.GetCertificateInfo(serial)
+	if err != nil {
+		api.WriteError(w, r, err)
+		return
+	}
+	api.JSON(w, info)
+}
+
+// GetCertificates returns a segment of the certificates that have not
+// expired. If the client accepts application/x-ndjson, the certificates are
+// streamed one per line as they are read from the database, followed by a
+// line with the next cursor if there are more certificates.
+func (h *Handler) GetCertificates(w http.ResponseWriter, r *http.Request) {
+	cursor, limit, err := api.ParseCursor(r)
+	if err != nil {
+		api.WriteError(w, r, admin.WrapError(admin.ErrorBadRequestType, err,
+			"error parsing cursor and limit from query params"))
+		return
+	}
+
+	if acceptsNDJSON(r) {
+		h.streamCertificates(w, r, cursor, limit)
+		return
+	}
+
+	certs := []*authority.CertificateInfo{}
+	nextCursor, err := h.auth.ListCertificates(cursor, limit, func(info *authority.CertificateInfo) error {
+		certs = append(certs, info)
+		return nil
+	})
+	if err != nil {
+		api.WriteError(w, r, err)
+		return
+	}
+	api.JSON(w, &GetCertificatesResponse{
+		Certificates: certs,
+		NextCursor:   nextCursor,
+	})
+}
+
+// streamCertificates writes the certificates as newline delimited JSON. Once
+// the first certificate is written the status code cannot change, so errors
+// after that point will just end the response.
+func (h *Handler) streamCertificates(w http.ResponseWriter, r *http.Request, cursor string, limit int) {
+	var started bool
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	nextCursor, err := h.auth.ListCertificates(cursor, limit, func(info *authority.CertificateInfo) error {
+		if !started {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if err := enc.Encode(info); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err != nil && !started:
+		api.WriteError(w, r, err)
+		return
+	case err != nil:
+		api.LogError(w, err)
+		return
+	case !started:
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+	if nextCursor != "" {
+		enc.Encode(map[string]string{"nextCursor": nextCursor})
+	}
+}
+
+// acceptsNDJSON returns true if the request accepts newline delimited JSON.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/admin"
@@ -8,13 +9,16 @@ import (
 
 // Handler is the ACME API request handler.
 type Handler struct {
-	db   admin.DB
-	auth *authority.Authority
+	db     admin.DB
+	auth   *authority.Authority
+	acmeDB acme.DB
 }
 
-// NewHandler returns a new Authority Config Handler.
-func NewHandler(auth *authority.Authority) api.RouterHandler {
-	h := &Handler{db: auth.GetAdminDatabase(), auth: auth}
+// NewHandler returns a new Authority Config Handler. The ACME database is used
+// to look up the orders of the ACME accounts, it can be nil if ACME is not
+// configured.
+func NewHandler(auth *authority.Authority, acmeDB acme.DB) api.RouterHandler {
+	h := &Handler{db: auth.GetAdminDatabase(), auth: auth, acmeDB: acmeDB}
 
 	return h
 }
@@ -38,4 +42,16 @@ func (h *Handler) Route(r api.Router) {
 	r.MethodFunc("POST", "/admins", authnz(h.CreateAdmin))
 	r.MethodFunc("PATCH", "/admins/{id}", authnz(h.UpdateAdmin))
 	r.MethodFunc("DELETE", "/admins/{id}", authnz(h.DeleteAdmin))
+
+	// Certificates
+	r.MethodFunc("GET", "/certificates", authnz(h.GetCertificates))
+	r.MethodFunc("GET", "/certificates/{serial}", authnz(h.GetCertificate))
+	r.MethodFunc("POST", "/certificates/revoke-by-key", authnz(h.RevokeCertificatesByKey))
+
+	// ACME accounts
+	r.MethodFunc("GET", "/accounts/{id}/orders", authnz(h.GetAccountOrders))
+
+	// Maintenance mode
+	r.MethodFunc("GET", "/maintenance", authnz(h.GetMaintenance))
+	r.MethodFunc("PUT", "/maintenance", authnz(h.SetMaintenance))
 }
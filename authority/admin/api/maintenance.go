@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/authority/admin"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// MaintenanceRequest represents the body for a SetMaintenance request.
+type MaintenanceRequest struct {
+	Enabled    bool                  `json:"enabled"`
+	RetryAfter *provisioner.Duration `json:"retryAfter,omitempty"`
+}
+
+// Validate validates a maintenance request body.
+func (mr *MaintenanceRequest) Validate() error {
+	if mr.RetryAfter.Value() < 0 {
+		return admin.NewError(admin.ErrorBadRequestType, "retryAfter cannot be negative")
+	}
+	return nil
+}
+
+// MaintenanceResponse is the resource with the state of the maintenance mode.
+type MaintenanceResponse struct {
+	Enabled    bool                  `json:"enabled"`
+	RetryAfter *provisioner.Duration `json:"retryAfter,omitempty"`
+}
+
+// GetMaintenance returns the state of the maintenance mode of the CA.
+func (h *Handler) GetMaintenance(w http.ResponseWriter, r *http.Request) {
+	api.JSON(w, h.maintenanceResponse())
+}
+
+// SetMaintenance enables or disables the maintenance mode of the CA. While in
+// maintenance, the ACME requests that create accounts, orders or certificates
+// are rejected with a 503, and the rest of the requests keep working. The
+// maintenance mode is kept in memory, a restart of the CA disables it.
+func (h *Handler) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var body MaintenanceRequest
+	if err := api.ReadJSON(r.Body, &body); err != nil {
+		api.WriteError(w, r, admin.WrapError(admin.ErrorBadRequestType, err, "error reading request body"))
+		return
+	}
+
+	if err := body.Validate(); err != nil {
+		api.WriteError(w, r, err)
+		return
+	}
+
+	h.auth.SetMaintenance(body.Enabled, body.RetryAfter.Value())
+	api.JSON(w, h.maintenanceResponse())
+}
+
+func (h *Handler) maintenanceResponse() *MaintenanceResponse {
+	enabled, retryAfter := h.auth.GetMaintenance()
+	res := &MaintenanceResponse{Enabled: enabled}
+	if retryAfter > 0 {
+		res.RetryAfter = &provisioner.Duration{Duration: retryAfter}
+	}
+	return res
+}
@@ -106,11 +106,12 @@ var (
 
 // Error represents an Admin
 type Error struct {
-	Type    string `json:"type"`
-	Detail  string `json:"detail"`
-	Message string `json:"message"`
-	Err     error  `json:"-"`
-	Status  int    `json:"-"`
+	Type      string `json:"type"`
+	Detail    string `json:"detail"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+	Err       error  `json:"-"`
+	Status    int    `json:"-"`
 }
 
 // IsType returns true if the error type matches the input type.
@@ -198,7 +199,7 @@ func (e *Error) ToLog() (interface{}, error) {
 }
 
 // WriteError writes to w a JSON representation of the given error.
-func WriteError(w http.ResponseWriter, err *Error) {
+func WriteError(w http.ResponseWriter, r *http.Request, err *Error) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.StatusCode())
 
@@ -217,6 +218,14 @@ func WriteError(w http.ResponseWriter, err *Error) {
 		}
 	}
 
+	// Add the request id to the response, so it can be correlated with the
+	// logs.
+	if id, ok := logging.GetRequestID(r.Context()); ok {
+		e := *err
+		e.RequestID = id
+		err = &e
+	}
+
 	if err := json.NewEncoder(w).Encode(err); err != nil {
 		log.Println(err)
 	}
@@ -3,9 +3,13 @@ package authority
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"io"
 	"log"
 	"strings"
 	"sync"
@@ -20,6 +24,8 @@ import (
 	"github.com/smallstep/certificates/cas"
 	casapi "github.com/smallstep/certificates/cas/apiv1"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/hooks"
 	"github.com/smallstep/certificates/kms"
 	kmsapi "github.com/smallstep/certificates/kms/apiv1"
 	"github.com/smallstep/certificates/kms/sshagentkms"
@@ -46,10 +52,23 @@ type Authority struct {
 	password           []byte
 	issuerPassword     []byte
 	x509CAService      cas.CertificateAuthorityService
+	x509Issuers        map[string]cas.CertificateAuthorityService
+	x509IssuerCerts    map[string]*x509.Certificate
+	x509KeyIssuers     map[string]cas.CertificateAuthorityService
+	x509KeyIssuerCerts map[string]*x509.Certificate
+	intermediateX509   *x509.Certificate
 	rootX509Certs      []*x509.Certificate
 	rootX509CertPool   *x509.CertPool
 	federatedX509Certs []*x509.Certificate
 	certificates       *sync.Map
+	issuanceHooks      []issuanceHook
+	asyncHooks         []hooks.IssuanceHook
+	issuanceQueue      *hooks.Queue
+	randomSource       io.Reader
+
+	// ACME signed directory
+	acmeDirectorySigner crypto.Signer
+	acmeDirectoryChain  []*x509.Certificate
 
 	// SCEP CA
 	scepService *scep.Service
@@ -75,6 +94,11 @@ type Authority struct {
 	getIdentityFunc  provisioner.GetIdentityFunc
 
 	adminMutex sync.RWMutex
+
+	// Maintenance mode
+	maintenanceMutex      sync.RWMutex
+	maintenance           bool
+	maintenanceRetryAfter time.Duration
 }
 
 // New creates and initiates a new Authority type.
@@ -171,16 +195,35 @@ func (a *Authority) reloadAdminResources(ctx context.Context) error {
 		return admin.WrapErrorISE(err, "error generating provisioner config")
 	}
 
-	// Create provisioner collection.
+	// Create provisioner collection and the issuers configured in them.
 	provClxn := provisioner.NewCollection(provisionerConfig.Audiences)
+	x509Issuers := make(map[string]cas.CertificateAuthorityService)
+	x509IssuerCerts := make(map[string]*x509.Certificate)
+	// All the provisioners are initialized before failing, so the errors in
+	// all of them are reported together.
+	var merr errs.MultiError
 	for _, p := range provList {
 		if err := p.Init(*provisionerConfig); err != nil {
-			return err
+			merr.Append(errors.Wrapf(err, "error initializing provisioner %s", p.GetName()))
+			continue
 		}
 		if err := provClxn.Store(p); err != nil {
-			return err
+			merr.Append(err)
+			continue
+		}
+		if acmeProv, ok := p.(*provisioner.ACME); ok && acmeProv.Issuer != nil {
+			srv, crt, err := a.newX509Issuer(acmeProv.Issuer.Certificate, acmeProv.Issuer.Key)
+			if err != nil {
+				merr.Append(errors.Wrapf(err, "error initializing issuer for provisioner %s", p.GetName()))
+				continue
+			}
+			x509Issuers[p.GetID()] = srv
+			x509IssuerCerts[p.GetID()] = crt
 		}
 	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return err
+	}
 	// Create admin collection.
 	adminClxn := administrator.NewCollection(provClxn)
 	for _, adm := range adminList {
@@ -196,11 +239,68 @@ func (a *Authority) reloadAdminResources(ctx context.Context) error {
 
 	a.config.AuthorityConfig.Provisioners = provList
 	a.provisioners = provClxn
+	a.x509Issuers = x509Issuers
+	a.x509IssuerCerts = x509IssuerCerts
 	a.config.AuthorityConfig.Admins = adminList
 	a.admins = adminClxn
 	return nil
 }
 
+// loadX509Signer reads the certificate chain in crt, verifies it against the
+// roots of the authority, and creates the signer for the key, that must match
+// the public key of the certificate.
+func (a *Authority) loadX509Signer(crt, key string) ([]*x509.Certificate, crypto.Signer, error) {
+	chain, err := pemutil.ReadCertificateBundle(crt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.validateIssuerChain(crt, chain); err != nil {
+		return nil, nil, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         a.rootX509CertPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, nil, errors.Wrapf(err, "error verifying %s", crt)
+	}
+	signer, err := a.keyManager.CreateSigner(&kmsapi.CreateSignerRequest{
+		SigningKey: key,
+		Password:   []byte(a.password),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if pub, ok := chain[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(signer.Public()) {
+		return nil, nil, errors.Errorf("key %s does not match the public key in %s", key, crt)
+	}
+	return chain, signer, nil
+}
+
+// newX509Issuer creates a new X.509 CA service using the given intermediate
+// certificate bundle and key, and returns it with the intermediate
+// certificate. The intermediate must chain to one of the roots of the
+// authority.
+func (a *Authority) newX509Issuer(crt, key string) (cas.CertificateAuthorityService, *x509.Certificate, error) {
+	chain, signer, err := a.loadX509Signer(crt, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv, err := cas.New(context.Background(), casapi.Options{
+		Type:             casapi.SoftCAS,
+		CertificateChain: chain,
+		Signer:           signer,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return srv, chain[0], nil
+}
+
 // init performs validation and initializes the fields of an Authority struct.
 func (a *Authority) init() error {
 	// Check if handler has already been validated/initialized.
@@ -268,6 +368,10 @@ func (a *Authority) init() error {
 			if err != nil {
 				return err
 			}
+			if err := a.validateIssuerChain(a.config.IntermediateCert, options.CertificateChain); err != nil {
+				return err
+			}
+			a.intermediateX509 = options.CertificateChain[0]
 			options.Signer, err = a.keyManager.CreateSigner(&kmsapi.CreateSignerRequest{
 				SigningKey: a.config.IntermediateKey,
 				Password:   []byte(a.password),
@@ -275,6 +379,9 @@ func (a *Authority) init() error {
 			if err != nil {
 				return err
 			}
+			if a.config.KMS != nil && a.config.KMS.Retry != nil {
+				options.Signer = kms.NewRetrySigner(options.Signer, a.config.KMS.Retry)
+			}
 		}
 
 		a.x509CAService, err = cas.New(context.Background(), options)
@@ -532,6 +639,38 @@ func (a *Authority) init() error {
 		return err
 	}
 
+	// Create the issuance hooks.
+	for _, o := range a.config.IssuanceHooks {
+		h, err := hooks.New(o)
+		if err != nil {
+			return err
+		}
+		if o.Async {
+			a.asyncHooks = append(a.asyncHooks, h)
+			continue
+		}
+		a.issuanceHooks = append(a.issuanceHooks, issuanceHook{
+			hook:        h,
+			failOnError: o.FailOnError,
+		})
+	}
+	if len(a.asyncHooks) > 0 {
+		a.issuanceQueue = hooks.NewQueue(a.config.IssuanceQueue, a.asyncHooks...)
+		a.issuanceHooks = append(a.issuanceHooks, issuanceHook{
+			hook: a.issuanceQueue,
+		})
+	}
+
+	// Create the issuers selected by the key type of the requests.
+	if err := a.initX509KeyIssuers(); err != nil {
+		return err
+	}
+
+	// Create the signer of the ACME directory.
+	if err := a.initACMEDirectorySigner(); err != nil {
+		return err
+	}
+
 	// Configure templates, currently only ssh templates are supported.
 	if a.sshCAHostCertSignKey != nil || a.sshCAUserCertSignKey != nil {
 		a.templates = a.config.Templates
@@ -553,6 +692,135 @@ func (a *Authority) init() error {
 	return nil
 }
 
+// initX509KeyIssuers creates the issuers configured for the different key
+// types. All the issuers are loaded before failing, so the errors in all of
+// them are reported together.
+func (a *Authority) initX509KeyIssuers() error {
+	if len(a.config.Issuers) == 0 {
+		return nil
+	}
+	issuers := make(map[string]cas.CertificateAuthorityService)
+	issuerCerts := make(map[string]*x509.Certificate)
+	var merr errs.MultiError
+	for _, o := range a.config.Issuers {
+		srv, crt, err := a.newX509Issuer(o.Certificate, o.Key)
+		if err != nil {
+			merr.Append(errors.Wrapf(err, "error initializing issuer %s", o.Certificate))
+			continue
+		}
+		kty := o.KeyType
+		if kty == "" {
+			kty = keyType(crt.PublicKey)
+		}
+		if _, ok := issuers[kty]; ok {
+			merr.Append(errors.Errorf("error initializing issuer %s: there is already an issuer for %s keys", o.Certificate, kty))
+			continue
+		}
+		issuers[kty] = srv
+		issuerCerts[kty] = crt
+	}
+	if err := merr.ErrorOrNil(); err != nil {
+		return err
+	}
+	a.x509KeyIssuers = issuers
+	a.x509KeyIssuerCerts = issuerCerts
+	return nil
+}
+
+// x509CAServiceFor returns the X.509 CA service that signs the certificates
+// with the given public key, the issuer configured for its key type, or the
+// default one.
+func (a *Authority) x509CAServiceFor(pub crypto.PublicKey) cas.CertificateAuthorityService {
+	if srv, ok := a.x509KeyIssuers[keyType(pub)]; ok {
+		return srv
+	}
+	return a.x509CAService
+}
+
+// x509ProvisionerIssuer returns the X.509 CA service configured in the
+// provisioner with the given id and its certificate. The issuers are replaced
+// when the provisioners are reloaded, so they are read holding the admin lock.
+func (a *Authority) x509ProvisionerIssuer(provisionerID string) (cas.CertificateAuthorityService, *x509.Certificate, bool) {
+	a.adminMutex.RLock()
+	defer a.adminMutex.RUnlock()
+	srv, ok := a.x509Issuers[provisionerID]
+	return srv, a.x509IssuerCerts[provisionerID], ok
+}
+
+// x509IssuerCertFor returns the certificate of the issuer returned by
+// x509CAServiceFor, or nil if the default issuer is managed by an external CAS.
+func (a *Authority) x509IssuerCertFor(pub crypto.PublicKey) *x509.Certificate {
+	if crt, ok := a.x509KeyIssuerCerts[keyType(pub)]; ok {
+		return crt
+	}
+	return a.intermediateX509
+}
+
+// keyType returns the JWK key type of the given public key, "EC", "RSA" or
+// "OKP", or an empty string if the key is not supported.
+func keyType(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return "EC"
+	case *rsa.PublicKey:
+		return "RSA"
+	case ed25519.PublicKey:
+		return "OKP"
+	default:
+		return ""
+	}
+}
+
+// initACMEDirectorySigner loads the key used to sign the ACME directory if the
+// signed directory is enabled. The intermediate certificate and key are used
+// if different ones are not configured.
+func (a *Authority) initACMEDirectorySigner() (err error) {
+	if a.config.ACME == nil || a.config.ACME.SignedDirectory == nil || !a.config.ACME.SignedDirectory.Enabled {
+		return nil
+	}
+	crt, key := a.config.ACME.SignedDirectory.Certificate, a.config.ACME.SignedDirectory.Key
+	if crt == "" {
+		crt, key = a.config.IntermediateCert, a.config.IntermediateKey
+	}
+	if crt == "" || key == "" {
+		return errors.New("acme signedDirectory requires a crt and key if the authority does not have an intermediate key")
+	}
+	a.acmeDirectoryChain, a.acmeDirectorySigner, err = a.loadX509Signer(crt, key)
+	return errors.Wrap(err, "error loading acme signedDirectory key")
+}
+
+// GetACMEDirectorySigner returns the signer and the certificate chain used to
+// sign the ACME directory. The signer is nil if the signed directory is not
+// enabled.
+func (a *Authority) GetACMEDirectorySigner() (crypto.Signer, []*x509.Certificate) {
+	return a.acmeDirectorySigner, a.acmeDirectoryChain
+}
+
+// SetMaintenance enables or disables the maintenance mode of the authority.
+// While in maintenance, the ACME requests that create accounts, orders or
+// certificates are rejected, and the clients are asked to retry after the
+// given duration.
+func (a *Authority) SetMaintenance(enabled bool, retryAfter time.Duration) {
+	a.maintenanceMutex.Lock()
+	defer a.maintenanceMutex.Unlock()
+	a.maintenance = enabled
+	a.maintenanceRetryAfter = retryAfter
+}
+
+// GetMaintenance returns whether the authority is in maintenance mode, and
+// the duration after which the clients should retry their requests.
+func (a *Authority) GetMaintenance() (bool, time.Duration) {
+	a.maintenanceMutex.RLock()
+	defer a.maintenanceMutex.RUnlock()
+	return a.maintenance, a.maintenanceRetryAfter
+}
+
+// GetRandomSource returns the source of randomness set with WithRandomSource,
+// or nil if the default crypto/rand is used.
+func (a *Authority) GetRandomSource() io.Reader {
+	return a.randomSource
+}
+
 // GetDatabase returns the authority database. If the configuration does not
 // define a database, GetDatabase will return a db.SimpleDB instance.
 func (a *Authority) GetDatabase() db.AuthDB {
@@ -572,6 +840,9 @@ func (a *Authority) IsAdminAPIEnabled() bool {
 
 // Shutdown safely shuts down any clients, databases, etc. held by the Authority.
 func (a *Authority) Shutdown() error {
+	if a.issuanceQueue != nil {
+		a.issuanceQueue.Close()
+	}
 	if err := a.keyManager.Close(); err != nil {
 		log.Printf("error closing the key manager: %v", err)
 	}
@@ -580,6 +851,9 @@ func (a *Authority) Shutdown() error {
 
 // CloseForReload closes internal services, to allow a safe reload.
 func (a *Authority) CloseForReload() {
+	if a.issuanceQueue != nil {
+		a.issuanceQueue.Close()
+	}
 	if err := a.keyManager.Close(); err != nil {
 		log.Printf("error closing the key manager: %v", err)
 	}
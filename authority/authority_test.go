@@ -15,6 +15,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/config"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"go.step.sm/crypto/jose"
@@ -471,3 +472,70 @@ func TestAuthority_GetSCEPService(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthority_GetACMEDirectorySigner(t *testing.T) {
+	withSignedDirectory := func(o *config.SignedDirectoryOptions) Option {
+		return func(a *Authority) error {
+			a.config.ACME = &config.ACMEOptions{SignedDirectory: o}
+			return nil
+		}
+	}
+
+	t.Run("ok/disabled", func(t *testing.T) {
+		a := testAuthority(t, withSignedDirectory(&config.SignedDirectoryOptions{Enabled: false}))
+		signer, chain := a.GetACMEDirectorySigner()
+		assert.Nil(t, signer)
+		assert.Nil(t, chain)
+	})
+
+	t.Run("ok/intermediate", func(t *testing.T) {
+		intermediate, err := pemutil.ReadCertificate("testdata/certs/intermediate_ca.crt")
+		assert.FatalError(t, err)
+		a := testAuthority(t, withSignedDirectory(&config.SignedDirectoryOptions{Enabled: true}))
+		signer, chain := a.GetACMEDirectorySigner()
+		if assert.NotNil(t, signer) && assert.Len(t, 1, chain) {
+			assert.Equals(t, chain[0], intermediate)
+			assert.Equals(t, signer.Public(), intermediate.PublicKey)
+		}
+	})
+
+	t.Run("fail/key", func(t *testing.T) {
+		a := testAuthority(t)
+		a.config.ACME = &config.ACMEOptions{SignedDirectory: &config.SignedDirectoryOptions{
+			Enabled:     true,
+			Certificate: "testdata/certs/intermediate_ca.crt",
+			Key:         "testdata/secrets/foo.key",
+		}}
+		err := a.initACMEDirectorySigner()
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "error loading acme signedDirectory key")
+		}
+	})
+
+	t.Run("fail/no-intermediate", func(t *testing.T) {
+		a := testAuthority(t)
+		a.config.IntermediateKey = ""
+		a.config.ACME = &config.ACMEOptions{SignedDirectory: &config.SignedDirectoryOptions{Enabled: true}}
+		err := a.initACMEDirectorySigner()
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "acme signedDirectory requires a crt and key if the authority does not have an intermediate key")
+		}
+	})
+}
+
+func TestAuthority_SetMaintenance(t *testing.T) {
+	a := testAuthority(t)
+	enabled, retryAfter := a.GetMaintenance()
+	assert.False(t, enabled)
+	assert.Equals(t, retryAfter, time.Duration(0))
+
+	a.SetMaintenance(true, 5*time.Minute)
+	enabled, retryAfter = a.GetMaintenance()
+	assert.True(t, enabled)
+	assert.Equals(t, retryAfter, 5*time.Minute)
+
+	a.SetMaintenance(false, 0)
+	enabled, retryAfter = a.GetMaintenance()
+	assert.False(t, enabled)
+	assert.Equals(t, retryAfter, time.Duration(0))
+}
@@ -255,6 +255,66 @@ func (a *Authority) AuthorizeSign(token string) ([]provisioner.SignOption, error
 	return a.Authorize(ctx, token)
 }
 
+// AuthorizeClientCertificate authorizes a signature request using the client
+// certificate chain of the TLS connection, the leaf first. The chain is
+// verified by the MTLS provisioners, and the sign options of the first one
+// that accepts it are returned.
+func (a *Authority) AuthorizeClientCertificate(ctx context.Context, chain []*x509.Certificate) ([]provisioner.SignOption, error) {
+	if len(chain) == 0 {
+		return nil, errs.Unauthorized("authority.AuthorizeClientCertificate: missing client certificate")
+	}
+	opts := []interface{}{errs.WithKeyVal("serialNumber", chain[0].SerialNumber.String())}
+	for _, p := range a.mtlsProvisioners() {
+		if signOpts, err := p.AuthorizeClientCertificate(ctx, chain); err == nil {
+			return signOpts, nil
+		}
+	}
+	return nil, errs.Unauthorized("authority.AuthorizeClientCertificate: client certificate is not accepted by any provisioner", opts...)
+}
+
+// GetClientCertificateRoots returns the roots of the MTLS provisioners. The
+// TLS server accepts client certificates issued by them, in addition to the
+// ones issued by the CA.
+func (a *Authority) GetClientCertificateRoots() []*x509.Certificate {
+	var roots []*x509.Certificate
+	for _, p := range a.mtlsProvisioners() {
+		roots = append(roots, p.GetRootCertificates()...)
+	}
+	return roots
+}
+
+// mtlsProvisioners returns the MTLS provisioners in the collection.
+func (a *Authority) mtlsProvisioners() []*provisioner.MTLS {
+	var (
+		list   provisioner.List
+		cursor string
+		provs  []*provisioner.MTLS
+	)
+	for {
+		list, cursor = a.provisioners.Find(cursor, provisioner.DefaultProvisionersMax)
+		for _, p := range list {
+			if mp, ok := p.(*provisioner.MTLS); ok {
+				provs = append(provs, mp)
+			}
+		}
+		if cursor == "" {
+			return provs
+		}
+	}
+}
+
+// AuthorizeWildcard returns an error if the wildcard policy of the authority
+// protects the given base domain, and the provisioner with the given name is
+// not one of the allowed to issue wildcard certificates for it.
+func (a *Authority) AuthorizeWildcard(provisionerName, domain string) error {
+	d := a.config.AuthorityConfig.WildcardPolicy.Lookup(domain)
+	if d == nil || d.IsAllowed(provisionerName) {
+		return nil
+	}
+	return errs.Forbidden("authority.AuthorizeWildcard: provisioner '%s' is not allowed to issue wildcard certificates for the protected domain %s",
+		provisionerName, d.Domain)
+}
+
 // authorizeRevoke locates the provisioner used to generate the authenticating
 // token and then performs the token validation flow.
 func (a *Authority) authorizeRevoke(ctx context.Context, token string) error {
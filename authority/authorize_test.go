@@ -3,10 +3,15 @@ package authority
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net/http"
 	"strconv"
 	"testing"
@@ -14,6 +19,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/config"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
@@ -1290,3 +1296,149 @@ func TestAuthority_authorizeSSHRekey(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthority_AuthorizeWildcard(t *testing.T) {
+	a := testAuthority(t)
+	a.config.AuthorityConfig.WildcardPolicy = &config.WildcardPolicy{
+		ProtectedDomains: []*config.ProtectedDomain{
+			{Domain: "example.com", AllowedProvisioners: []string{"acme-internal"}},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		provisionerName string
+		domain          string
+		err             error
+	}{
+		{"ok/allowed", "acme-internal", "example.com", nil},
+		{"ok/allowed-subdomain", "acme-internal", "foo.example.com", nil},
+		{"ok/not-protected", "acme-lax", "example.org", nil},
+		{"fail/protected", "acme-lax", "example.com",
+			errors.New("authority.AuthorizeWildcard: provisioner 'acme-lax' is not allowed to issue wildcard certificates for the protected domain example.com")},
+		{"fail/protected-subdomain", "acme-lax", "foo.example.com",
+			errors.New("authority.AuthorizeWildcard: provisioner 'acme-lax' is not allowed to issue wildcard certificates for the protected domain example.com")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.AuthorizeWildcard(tt.provisionerName, tt.domain)
+			if tt.err != nil {
+				if assert.NotNil(t, err) {
+					assert.Equals(t, err.Error(), tt.err.Error())
+					sc, ok := err.(errs.StatusCoder)
+					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+					assert.Equals(t, sc.StatusCode(), http.StatusForbidden)
+				}
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthority_AuthorizeClientCertificate(t *testing.T) {
+	// newCert creates a certificate valid for an hour signed by the parent, or
+	// self-signed if the parent is nil.
+	newCert := func(template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.FatalError(t, err)
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+		template.NotBefore = time.Now().Add(-time.Minute)
+		template.NotAfter = time.Now().Add(time.Hour)
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		b, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		assert.FatalError(t, err)
+		crt, err := x509.ParseCertificate(b)
+		assert.FatalError(t, err)
+		return crt, key
+	}
+	newChain := func(name string) (*x509.Certificate, []*x509.Certificate) {
+		root, rootKey := newCert(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: name + " Root CA"},
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, nil, nil)
+		intermediate, intermediateKey := newCert(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: name + " Intermediate CA"},
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, root, rootKey)
+		leaf, _ := newCert(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "workload"},
+			DNSNames:    []string{"workload.internal"},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, intermediate, intermediateKey)
+		return root, []*x509.Certificate{leaf, intermediate}
+	}
+	root, chain := newChain("Trusted")
+	_, otherChain := newChain("Untrusted")
+	leaf := chain[0]
+
+	a := testAuthority(t)
+	assert.Len(t, 0, a.GetClientCertificateRoots())
+
+	p := &provisioner.MTLS{
+		Name:  "mtls",
+		Type:  "MTLS",
+		Roots: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}),
+	}
+	pc, err := a.generateProvisionerConfig(context.Background())
+	assert.FatalError(t, err)
+	assert.FatalError(t, p.Init(*pc))
+	assert.FatalError(t, a.provisioners.Store(p))
+	assert.Equals(t, a.GetClientCertificateRoots(), []*x509.Certificate{root})
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate
+		csr   *x509.CertificateRequest
+		err   error
+	}{
+		{"ok", chain, getCSR(t, priv, func(csr *x509.CertificateRequest) {
+			csr.Subject.CommonName = "workload"
+			csr.DNSNames = []string{"workload.internal"}
+		}), nil},
+		{"fail/empty", nil, nil,
+			errors.New("authority.AuthorizeClientCertificate: missing client certificate")},
+		{"fail/untrusted", otherChain, nil,
+			errors.New("authority.AuthorizeClientCertificate: client certificate is not accepted by any provisioner")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signOpts, err := a.AuthorizeClientCertificate(context.Background(), tt.chain)
+			if tt.err != nil {
+				if assert.NotNil(t, err) {
+					assert.Equals(t, err.Error(), tt.err.Error())
+					sc, ok := err.(errs.StatusCoder)
+					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+					assert.Equals(t, sc.StatusCode(), http.StatusUnauthorized)
+				}
+				return
+			}
+			assert.FatalError(t, err)
+
+			certChain, err := a.Sign(tt.csr, provisioner.SignOptions{}, signOpts...)
+			assert.FatalError(t, err)
+			assert.Equals(t, certChain[0].Subject.CommonName, "workload")
+			assert.Equals(t, certChain[0].DNSNames, []string{"workload.internal"})
+			assert.False(t, certChain[0].NotAfter.After(leaf.NotAfter))
+
+			// The new certificate is constrained to the names of the client
+			// certificate.
+			csr := getCSR(t, priv, func(csr *x509.CertificateRequest) {
+				csr.Subject.CommonName = "workload"
+				csr.DNSNames = []string{"workload.internal", "other.internal"}
+			})
+			_, err = a.Sign(csr, provisioner.SignOptions{}, signOpts...)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package authority
+
+import (
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+)
+
+// validateChain checks that each certificate in the chain is signed by the
+// next one.
+func validateChain(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return errors.Wrapf(err, "certificate %d in the chain, %q, is not signed by certificate %d, %q",
+				i, chain[i].Subject, i+1, chain[i+1].Subject)
+		}
+	}
+	return nil
+}
+
+// maxChainDepth returns the maximum number of certificates in a chain, 0 if
+// there's no limit.
+func (a *Authority) maxChainDepth() int {
+	if a.config == nil || a.config.AuthorityConfig == nil {
+		return 0
+	}
+	return a.config.AuthorityConfig.MaxChainDepth
+}
+
+// validateIssuerChain validates the certificate bundle of an issuer on
+// startup. The issued certificates are prepended to the bundle, so it must be
+// shorter than the maximum depth.
+func (a *Authority) validateIssuerChain(name string, chain []*x509.Certificate) error {
+	if max := a.maxChainDepth(); max > 0 && len(chain) >= max {
+		return errors.Errorf("%s has %d certificates, the chains of the issued certificates would exceed the maximum depth of %d",
+			name, len(chain), max)
+	}
+	if err := validateChain(chain); err != nil {
+		return errors.Wrapf(err, "error validating %s", name)
+	}
+	return nil
+}
+
+// validateCertificateChain validates the chain of an issued certificate, with
+// the leaf as the first certificate, before returning it.
+func (a *Authority) validateCertificateChain(fullchain []*x509.Certificate) error {
+	if max := a.maxChainDepth(); max > 0 && len(fullchain) > max {
+		return errors.Errorf("certificate chain has %d certificates, it exceeds the maximum depth of %d",
+			len(fullchain), max)
+	}
+	return validateChain(fullchain)
+}
@@ -0,0 +1,91 @@
+package authority
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/config"
+)
+
+func TestAuthority_validateCertificateChain(t *testing.T) {
+	root, rootSigner := generateRootCertificate(t)
+	intermediate, intSigner := generateIntermidiateCertificate(t, root, rootSigner)
+	leaf := generateCertificate(t, "test.smallstep.com", []string{"test.smallstep.com"}, withSigner(intermediate, intSigner))
+
+	// An intermediate with the same subject than the valid one but a different
+	// key.
+	otherIntermediate, _ := generateIntermidiateCertificate(t, root, rootSigner)
+
+	withDepth := func(depth int) *Authority {
+		return &Authority{config: &config.Config{
+			AuthorityConfig: &config.AuthConfig{MaxChainDepth: depth},
+		}}
+	}
+
+	tests := []struct {
+		name  string
+		auth  *Authority
+		chain []*x509.Certificate
+		err   error
+	}{
+		{"ok/two-links", withDepth(0), []*x509.Certificate{leaf, intermediate}, nil},
+		{"ok/with-root", withDepth(0), []*x509.Certificate{leaf, intermediate, root}, nil},
+		{"ok/max-depth", withDepth(2), []*x509.Certificate{leaf, intermediate}, nil},
+		{"ok/leaf-only", withDepth(1), []*x509.Certificate{leaf}, nil},
+		{"ok/no-config", &Authority{}, []*x509.Certificate{leaf, intermediate}, nil},
+		{"fail/broken-link", withDepth(0), []*x509.Certificate{leaf, otherIntermediate},
+			errors.New(`certificate 0 in the chain, "CN=test.smallstep.com", is not signed by certificate 1, "CN=TestIntermediateCA"`)},
+		{"fail/wrong-order", withDepth(0), []*x509.Certificate{intermediate, leaf},
+			errors.New(`certificate 0 in the chain, "CN=TestIntermediateCA", is not signed by certificate 1, "CN=test.smallstep.com"`)},
+		{"fail/max-depth", withDepth(2), []*x509.Certificate{leaf, intermediate, root},
+			errors.New("certificate chain has 3 certificates, it exceeds the maximum depth of 2")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.auth.validateCertificateChain(tt.chain)
+			if tt.err == nil {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.HasPrefix(t, err.Error(), tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestAuthority_validateIssuerChain(t *testing.T) {
+	root, rootSigner := generateRootCertificate(t)
+	intermediate, _ := generateIntermidiateCertificate(t, root, rootSigner)
+	otherRoot, _ := generateRootCertificate(t)
+
+	withDepth := func(depth int) *Authority {
+		return &Authority{config: &config.Config{
+			AuthorityConfig: &config.AuthConfig{MaxChainDepth: depth},
+		}}
+	}
+
+	tests := []struct {
+		name  string
+		auth  *Authority
+		chain []*x509.Certificate
+		err   error
+	}{
+		{"ok", withDepth(0), []*x509.Certificate{intermediate, root}, nil},
+		{"ok/max-depth", withDepth(3), []*x509.Certificate{intermediate, root}, nil},
+		{"fail/max-depth", withDepth(2), []*x509.Certificate{intermediate, root},
+			errors.New("intermediate.crt has 2 certificates, the chains of the issued certificates would exceed the maximum depth of 2")},
+		{"fail/broken-link", withDepth(0), []*x509.Certificate{intermediate, otherRoot},
+			errors.New(`error validating intermediate.crt: certificate 0 in the chain, "CN=TestIntermediateCA", is not signed by certificate 1, "CN=TestRootCA"`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.auth.validateIssuerChain("intermediate.crt", tt.chain)
+			if tt.err == nil {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.HasPrefix(t, err.Error(), tt.err.Error())
+			}
+		})
+	}
+}
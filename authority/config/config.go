@@ -4,13 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/acme"
 	"github.com/smallstep/certificates/authority/provisioner"
 	cas "github.com/smallstep/certificates/cas/apiv1"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/hooks"
 	kms "github.com/smallstep/certificates/kms/apiv1"
 	"github.com/smallstep/certificates/templates"
 	"go.step.sm/linkedca"
@@ -52,6 +57,7 @@ type Config struct {
 	FederatedRoots   []string             `json:"federatedRoots"`
 	IntermediateCert string               `json:"crt"`
 	IntermediateKey  string               `json:"key"`
+	Issuers          []*X509IssuerOptions `json:"issuers,omitempty"`
 	Address          string               `json:"address"`
 	InsecureAddress  string               `json:"insecureAddress"`
 	DNSNames         []string             `json:"dnsNames"`
@@ -62,10 +68,347 @@ type Config struct {
 	Monitoring       json.RawMessage      `json:"monitoring,omitempty"`
 	AuthorityConfig  *AuthConfig          `json:"authority,omitempty"`
 	TLS              *TLSOptions          `json:"tls,omitempty"`
+	Compression      *CompressionOptions  `json:"compression,omitempty"`
+	ACME             *ACMEOptions         `json:"acme,omitempty"`
+	ACMECleanup      *ACMECleanupOptions  `json:"acmeCleanup,omitempty"`
+	IssuanceHooks    []*hooks.Options     `json:"issuanceHooks,omitempty"`
+	IssuanceQueue    *hooks.QueueOptions  `json:"issuanceQueue,omitempty"`
 	Password         string               `json:"password,omitempty"`
 	Templates        *templates.Templates `json:"templates,omitempty"`
 }
 
+// CompressionOptions contains the options used to compress the HTTP responses
+// of the CA. Only responses equal or larger than MinSize bytes are compressed,
+// if MinSize is not set a default value of 1024 bytes is used.
+type CompressionOptions struct {
+	Enabled bool `json:"enabled"`
+	MinSize int  `json:"minSize,omitempty"`
+}
+
+// Validate validates the compression options.
+func (c *CompressionOptions) Validate() error {
+	if c != nil && c.MinSize < 0 {
+		return errors.New("compression minSize cannot be negative")
+	}
+	return nil
+}
+
+// ACMEOptions contains the options of the ACME server. ListProvisioners adds
+// the names of the ACME provisioners to the error returned when a request uses
+// an unknown provisioner, it should only be enabled in debugging environments.
+// PathPrefix is the external path prefix added to the ACME links when the CA
+// runs behind a gateway that removes it, e.g. "/ca". SignedDirectory serves,
+// alongside the plain directory, the directory in a JWS signed by the CA.
+// Validation configures the clients used to validate the challenges, and
+// CircuitBreaker the circuit breaker of the ACME database. StrictAccept
+// rejects with a 406 the directory requests with an Accept header that does
+// not allow application/json, by default the directory is always served.
+// ErrorStatusCodes overrides the HTTP status codes of the ACME errors by
+// problem type, e.g. {"unauthorized": 403}, the rest of them use the status
+// codes of RFC 8555. GlobalDirectory serves the directory and the nonces of a
+// default provisioner without the provisioner in the path.
+// KeyAuthorizationDigests sets the hash function used to digest the key
+// authorization of non-standard challenge types, e.g.
+// {"device-attest-01": "SHA-384"}, the rest of them use SHA-256.
+type ACMEOptions struct {
+	ListProvisioners        bool                    `json:"listProvisioners,omitempty"`
+	PathPrefix              string                  `json:"pathPrefix,omitempty"`
+	SignedDirectory         *SignedDirectoryOptions `json:"signedDirectory,omitempty"`
+	Validation              *ACMEValidationOptions  `json:"validation,omitempty"`
+	CircuitBreaker          *CircuitBreakerOptions  `json:"circuitBreaker,omitempty"`
+	StrictAccept            bool                    `json:"strictAccept,omitempty"`
+	ErrorStatusCodes        map[string]int          `json:"errorStatusCodes,omitempty"`
+	GlobalDirectory         *GlobalDirectoryOptions `json:"globalDirectory,omitempty"`
+	KeyAuthorizationDigests map[string]string       `json:"keyAuthorizationDigests,omitempty"`
+}
+
+// Validate validates the ACME options, a nil value is valid.
+func (o *ACMEOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	var merr errs.MultiError
+	merr.Append(validatePathPrefix(o.PathPrefix))
+	merr.Append(o.SignedDirectory.Validate())
+	merr.Append(o.GlobalDirectory.Validate())
+	merr.Append(o.Validation.Validate())
+	merr.Append(o.CircuitBreaker.Validate())
+	if _, err := acme.ParseErrorStatusCodes(o.ErrorStatusCodes); err != nil {
+		merr.Append(errors.Wrap(err, "acme errorStatusCodes"))
+	}
+	if _, err := acme.ParseKeyAuthorizationDigests(o.KeyAuthorizationDigests); err != nil {
+		merr.Append(errors.Wrap(err, "acme keyAuthorizationDigests"))
+	}
+	return merr.ErrorOrNil()
+}
+
+// validatePathPrefix checks that the ACME path prefix is empty or an absolute
+// path without a trailing slash, e.g. "/ca" or "/pki/ca".
+func validatePathPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return errors.Errorf("acme pathPrefix %q must start with a slash and cannot end with one", prefix)
+	}
+	for _, segment := range strings.Split(prefix[1:], "/") {
+		switch {
+		case segment == "", segment == ".", segment == "..":
+			return errors.Errorf("acme pathPrefix %q cannot contain empty, . or .. segments", prefix)
+		case url.PathEscape(segment) != segment:
+			return errors.Errorf("acme pathPrefix %q cannot contain characters that must be escaped", prefix)
+		}
+	}
+	return nil
+}
+
+// ACMEValidationOptions contains the options of the clients used to validate
+// the ACME challenges. MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout
+// configure the pool of connections used by the http-01 validations, if they
+// are not set the defaults of the ACME server are used. DNSCache enables a
+// cache of the addresses of the hosts dialed by the http-01 and tls-alpn-01
+// validations. TLSALPN01MinVersion is the minimum TLS version negotiated in
+// the tls-alpn-01 validations, it cannot be lower than TLS 1.2, the default.
+// MaxConcurrentValidations limits the number of challenges validated at the
+// same time, the validations beyond the limit are deferred. It's unlimited if
+// it's not set. HTTP01DisableRedirects fails the http-01 validations that get
+// a redirect, by default the redirects to the standard http and https ports
+// are followed. HTTP01MaxRedirects is the maximum number of redirects followed,
+// 10 if it's not set, and HTTP01RedirectSchemes restricts the schemes of the
+// redirects to http or https.
+type ACMEValidationOptions struct {
+	MaxIdleConns             int                   `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost      int                   `json:"maxIdleConnsPerHost,omitempty"`
+	IdleConnTimeout          *provisioner.Duration `json:"idleConnTimeout,omitempty"`
+	DNSCache                 *DNSCacheOptions      `json:"dnsCache,omitempty"`
+	TLSALPN01MinVersion      TLSVersion            `json:"tlsALPN01MinVersion,omitempty"`
+	MaxConcurrentValidations int                   `json:"maxConcurrentValidations,omitempty"`
+	HTTP01DisableRedirects   bool                  `json:"http01DisableRedirects,omitempty"`
+	HTTP01MaxRedirects       int                   `json:"http01MaxRedirects,omitempty"`
+	HTTP01RedirectSchemes    []string              `json:"http01RedirectSchemes,omitempty"`
+}
+
+// Validate validates the ACME validation options, a nil value is valid.
+func (o *ACMEValidationOptions) Validate() error {
+	switch {
+	case o == nil:
+		return nil
+	case o.MaxIdleConns < 0:
+		return errors.New("acme validation maxIdleConns cannot be negative")
+	case o.MaxIdleConnsPerHost < 0:
+		return errors.New("acme validation maxIdleConnsPerHost cannot be negative")
+	case o.IdleConnTimeout != nil && o.IdleConnTimeout.Duration < 0:
+		return errors.New("acme validation idleConnTimeout cannot be negative")
+	case o.MaxConcurrentValidations < 0:
+		return errors.New("acme validation maxConcurrentValidations cannot be negative")
+	case o.HTTP01MaxRedirects < 0:
+		return errors.New("acme validation http01MaxRedirects cannot be negative")
+	case !validHTTP01RedirectSchemes(o.HTTP01RedirectSchemes):
+		return errors.Errorf("acme validation http01RedirectSchemes %q can only contain http and https", o.HTTP01RedirectSchemes)
+	case o.TLSALPN01MinVersion != 0 && o.TLSALPN01MinVersion.Validate() != nil:
+		return errors.Errorf("acme validation tlsALPN01MinVersion %v is not a valid tls version", float64(o.TLSALPN01MinVersion))
+	case o.TLSALPN01MinVersion != 0 && o.TLSALPN01MinVersion < 1.2:
+		return errors.Errorf("acme validation tlsALPN01MinVersion %v cannot be lower than 1.2", float64(o.TLSALPN01MinVersion))
+	default:
+		return o.DNSCache.Validate()
+	}
+}
+
+// validHTTP01RedirectSchemes returns true if the given schemes are only http
+// or https.
+func validHTTP01RedirectSchemes(schemes []string) bool {
+	for _, s := range schemes {
+		if s != "http" && s != "https" {
+			return false
+		}
+	}
+	return true
+}
+
+// DNSCacheOptions contains the options of the cache of the addresses of the
+// hosts dialed to validate the ACME challenges. The addresses are cached for
+// the TTL of the DNS records, clamped between MinTTL and MaxTTL, and at most
+// MaxSize hosts are kept. If they are not set the defaults of the ACME server
+// are used.
+type DNSCacheOptions struct {
+	Enabled bool                  `json:"enabled"`
+	MaxSize int                   `json:"maxSize,omitempty"`
+	MinTTL  *provisioner.Duration `json:"minTTL,omitempty"`
+	MaxTTL  *provisioner.Duration `json:"maxTTL,omitempty"`
+}
+
+// Validate validates the DNS cache options, a nil value is valid.
+func (o *DNSCacheOptions) Validate() error {
+	switch {
+	case o == nil:
+		return nil
+	case o.MaxSize < 0:
+		return errors.New("acme validation dnsCache maxSize cannot be negative")
+	case o.MinTTL != nil && o.MinTTL.Duration < 0:
+		return errors.New("acme validation dnsCache minTTL cannot be negative")
+	case o.MaxTTL != nil && o.MaxTTL.Duration < 0:
+		return errors.New("acme validation dnsCache maxTTL cannot be negative")
+	case o.MinTTL != nil && o.MaxTTL != nil && o.MinTTL.Duration > o.MaxTTL.Duration:
+		return errors.New("acme validation dnsCache minTTL cannot be greater than maxTTL")
+	default:
+		return nil
+	}
+}
+
+// CircuitBreakerOptions contains the options of the circuit breaker of the
+// ACME database. When enabled, after Threshold consecutive failures of the
+// database the ACME requests fail fast with a 503 error for the Cooldown
+// period, and then one request at a time probes the database until one
+// succeeds. If they are not set the defaults of the ACME server are used.
+type CircuitBreakerOptions struct {
+	Enabled   bool                  `json:"enabled"`
+	Threshold int                   `json:"threshold,omitempty"`
+	Cooldown  *provisioner.Duration `json:"cooldown,omitempty"`
+}
+
+// Validate validates the circuit breaker options, a nil value is valid.
+func (o *CircuitBreakerOptions) Validate() error {
+	switch {
+	case o == nil:
+		return nil
+	case o.Threshold < 0:
+		return errors.New("acme circuitBreaker threshold cannot be negative")
+	case o.Cooldown != nil && o.Cooldown.Duration < 0:
+		return errors.New("acme circuitBreaker cooldown cannot be negative")
+	default:
+		return nil
+	}
+}
+
+// SignedDirectoryOptions contains the options used to serve the ACME
+// directory in a JWS. The JWS is signed by default with the intermediate key,
+// and includes the intermediate certificate chain in the x5c header. A
+// different certificate chain and key can be set using Certificate and Key,
+// the certificate must chain up to one of the configured roots.
+type SignedDirectoryOptions struct {
+	Enabled     bool   `json:"enabled"`
+	Certificate string `json:"crt,omitempty"`
+	Key         string `json:"key,omitempty"`
+}
+
+// Validate validates the signed directory options, a nil value is valid.
+func (o *SignedDirectoryOptions) Validate() error {
+	switch {
+	case o == nil:
+		return nil
+	case o.Certificate != "" && o.Key == "":
+		return errors.New("acme signedDirectory key cannot be empty if crt is set")
+	case o.Certificate == "" && o.Key != "":
+		return errors.New("acme signedDirectory crt cannot be empty if key is set")
+	default:
+		return nil
+	}
+}
+
+// GlobalDirectoryOptions contains the options used to serve the ACME directory
+// and the nonces of the default Provisioner at /acme/directory and
+// /acme/new-nonce, for clients that expect a single directory URL. The paths
+// with the provisioner name are always served.
+type GlobalDirectoryOptions struct {
+	Enabled     bool   `json:"enabled"`
+	Provisioner string `json:"provisioner,omitempty"`
+}
+
+// Validate validates the global directory options, a nil value is valid.
+func (o *GlobalDirectoryOptions) Validate() error {
+	if o != nil && o.Enabled && o.Provisioner == "" {
+		return errors.New("acme globalDirectory provisioner cannot be empty if it's enabled")
+	}
+	return nil
+}
+
+// X509IssuerOptions contains an additional intermediate certificate and key
+// used to sign the X.509 certificates requested with a key of a given type,
+// e.g. to sign the RSA requests with an RSA intermediate and the EC requests
+// with an EC one. KeyType is one of "EC", "RSA" or "OKP", if it's not set the
+// type of the intermediate key is used. The requests with a key type without
+// an issuer are signed by the default intermediate.
+type X509IssuerOptions struct {
+	KeyType     string `json:"keyType,omitempty"`
+	Certificate string `json:"crt"`
+	Key         string `json:"key"`
+}
+
+// Validate validates the issuer options.
+func (o *X509IssuerOptions) Validate() error {
+	switch {
+	case o == nil:
+		return errors.New("issuers cannot contain null values")
+	case o.Certificate == "":
+		return errors.New("issuer crt cannot be empty")
+	case o.Key == "":
+		return errors.Errorf("issuer %s key cannot be empty", o.Certificate)
+	}
+	switch o.KeyType {
+	case "", "EC", "RSA", "OKP":
+		return nil
+	default:
+		return errors.Errorf("issuer %s keyType %s is not valid; valid values are EC, RSA or OKP", o.Certificate, o.KeyType)
+	}
+}
+
+// ACMECleanupOptions contains the options used to periodically delete the
+// expired ACME orders, authorizations, challenges and nonces. If Enabled, the
+// cleanup runs every Interval, one hour if not set, and deletes the objects
+// that expired more than Retention ago, 24 hours if not set, in batches of at
+// most BatchSize objects. Nonces configures a sweeper that deletes the unused
+// nonces more often, it runs even if the cleanup is not enabled.
+type ACMECleanupOptions struct {
+	Enabled   bool                     `json:"enabled"`
+	Interval  *provisioner.Duration    `json:"interval,omitempty"`
+	Retention *provisioner.Duration    `json:"retention,omitempty"`
+	BatchSize int                      `json:"batchSize,omitempty"`
+	Nonces    *ACMENonceCleanupOptions `json:"nonces,omitempty"`
+}
+
+// ACMENonceCleanupOptions contains the options of the sweeper of the unused
+// ACME nonces. If Enabled, the sweeper runs every Interval, five minutes if not
+// set, and deletes the nonces created more than MaxAge ago, one hour if not
+// set, in batches of at most BatchSize nonces.
+type ACMENonceCleanupOptions struct {
+	Enabled   bool                  `json:"enabled"`
+	Interval  *provisioner.Duration `json:"interval,omitempty"`
+	MaxAge    *provisioner.Duration `json:"maxAge,omitempty"`
+	BatchSize int                   `json:"batchSize,omitempty"`
+}
+
+// Validate validates the ACME nonce cleanup options.
+func (c *ACMENonceCleanupOptions) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case c.Interval != nil && c.Interval.Duration <= 0:
+		return errors.New("acmeCleanup nonces interval must be greater than 0")
+	case c.MaxAge != nil && c.MaxAge.Duration <= 0:
+		return errors.New("acmeCleanup nonces maxAge must be greater than 0")
+	case c.BatchSize < 0:
+		return errors.New("acmeCleanup nonces batchSize cannot be negative")
+	default:
+		return nil
+	}
+}
+
+// Validate validates the ACME cleanup options.
+func (c *ACMECleanupOptions) Validate() error {
+	switch {
+	case c == nil:
+		return nil
+	case c.Interval != nil && c.Interval.Duration <= 0:
+		return errors.New("acmeCleanup interval must be greater than 0")
+	case c.Retention != nil && c.Retention.Duration < 0:
+		return errors.New("acmeCleanup retention cannot be negative")
+	case c.BatchSize < 0:
+		return errors.New("acmeCleanup batchSize cannot be negative")
+	default:
+		return c.Nonces.Validate()
+	}
+}
+
 // ASN1DN contains ASN1.DN attributes that are used in Subject and Issuer
 // x509 Certificate blocks.
 type ASN1DN struct {
@@ -93,6 +436,73 @@ type AuthConfig struct {
 	DisableIssuedAtCheck bool                  `json:"disableIssuedAtCheck,omitempty"`
 	Backdate             *provisioner.Duration `json:"backdate,omitempty"`
 	EnableAdmin          bool                  `json:"enableAdmin,omitempty"`
+	WildcardPolicy       *WildcardPolicy       `json:"wildcardPolicy,omitempty"`
+	MaxChainDepth        int                   `json:"maxChainDepth,omitempty"`
+	StrictSANs           bool                  `json:"strictSANs,omitempty"`
+}
+
+// WildcardPolicy restricts the provisioners that can issue wildcard
+// certificates for a list of protected base domains.
+type WildcardPolicy struct {
+	ProtectedDomains []*ProtectedDomain `json:"protectedDomains"`
+}
+
+// ProtectedDomain is a base domain for which wildcard certificates, for the
+// domain or any of its subdomains, can only be issued by the provisioners in
+// AllowedProvisioners.
+type ProtectedDomain struct {
+	Domain              string   `json:"domain"`
+	AllowedProvisioners []string `json:"allowedProvisioners,omitempty"`
+}
+
+// Validate validates the wildcard policy.
+func (w *WildcardPolicy) Validate() error {
+	if w == nil {
+		return nil
+	}
+	for _, d := range w.ProtectedDomains {
+		switch {
+		case d == nil || d.Domain == "":
+			return errors.New("wildcardPolicy protectedDomains cannot contain an empty domain")
+		case strings.Contains(d.Domain, "*"):
+			return errors.Errorf("wildcardPolicy protected domain %s cannot contain a wildcard", d.Domain)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the most specific protected domain that matches the given
+// domain, or nil if the domain is not protected.
+func (w *WildcardPolicy) Lookup(domain string) *ProtectedDomain {
+	if w == nil {
+		return nil
+	}
+	var (
+		match    *ProtectedDomain
+		matchLen int
+	)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range w.ProtectedDomains {
+		base := strings.ToLower(strings.TrimSuffix(d.Domain, "."))
+		if domain != base && !strings.HasSuffix(domain, "."+base) {
+			continue
+		}
+		if match == nil || len(base) > matchLen {
+			match, matchLen = d, len(base)
+		}
+	}
+	return match
+}
+
+// IsAllowed returns true if the provisioner with the given name can issue
+// wildcard certificates for the protected domain.
+func (d *ProtectedDomain) IsAllowed(provisionerName string) bool {
+	for _, name := range d.AllowedProvisioners {
+		if name == provisionerName {
+			return true
+		}
+	}
+	return false
 }
 
 // init initializes the required fields in the AuthConfig if they are not
@@ -120,6 +530,8 @@ func (c *AuthConfig) Validate(audiences provisioner.Audiences) error {
 	// Initialize required fields.
 	c.init()
 
+	var merr errs.MultiError
+
 	// Check that only one K8sSA is enabled
 	var k8sCount int
 	for _, p := range c.Provisioners {
@@ -128,14 +540,20 @@ func (c *AuthConfig) Validate(audiences provisioner.Audiences) error {
 		}
 	}
 	if k8sCount > 1 {
-		return errors.New("cannot have more than one kubernetes service account provisioner")
+		merr.Append(errors.New("cannot have more than one kubernetes service account provisioner"))
 	}
 
 	if c.Backdate.Duration < 0 {
-		return errors.New("authority.backdate cannot be less than 0")
+		merr.Append(errors.New("authority.backdate cannot be less than 0"))
 	}
 
-	return nil
+	if c.MaxChainDepth < 0 {
+		merr.Append(errors.New("authority.maxChainDepth cannot be less than 0"))
+	}
+
+	merr.Append(c.WildcardPolicy.Validate())
+
+	return merr.ErrorOrNil()
 }
 
 // LoadConfiguration parses the given filename in JSON format and returns the
@@ -185,34 +603,33 @@ func (c *Config) Save(filename string) error {
 	return errors.Wrapf(enc.Encode(c), "error writing %s", filename)
 }
 
-// Validate validates the configuration.
+// Validate validates the configuration. All the errors found are reported
+// together in an errs.MultiError, so a misconfiguration can be fixed in a
+// single pass.
 func (c *Config) Validate() error {
-	switch {
-	case c.Address == "":
-		return errors.New("address cannot be empty")
-	case len(c.DNSNames) == 0:
-		return errors.New("dnsNames cannot be empty")
-	case c.AuthorityConfig == nil:
-		return errors.New("authority cannot be nil")
+	var merr errs.MultiError
+
+	if c.Address == "" {
+		merr.Append(errors.New("address cannot be empty"))
+	} else if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		// Validate address (a port is required)
+		merr.Append(errors.Errorf("invalid address %s", c.Address))
+	}
+	if len(c.DNSNames) == 0 {
+		merr.Append(errors.New("dnsNames cannot be empty"))
 	}
 
-	// Options holds the RA/CAS configuration.
-	ra := c.AuthorityConfig.Options
 	// The default RA/CAS requires root, crt and key.
-	if ra.Is(cas.SoftCAS) {
-		switch {
-		case c.Root.HasEmpties():
-			return errors.New("root cannot be empty")
-		case c.IntermediateCert == "":
-			return errors.New("crt cannot be empty")
-		case c.IntermediateKey == "":
-			return errors.New("key cannot be empty")
+	if c.AuthorityConfig == nil || c.AuthorityConfig.Options.Is(cas.SoftCAS) {
+		if c.Root.HasEmpties() {
+			merr.Append(errors.New("root cannot be empty"))
+		}
+		if c.IntermediateCert == "" {
+			merr.Append(errors.New("crt cannot be empty"))
+		}
+		if c.IntermediateKey == "" {
+			merr.Append(errors.New("key cannot be empty"))
 		}
-	}
-
-	// Validate address (a port is required)
-	if _, _, err := net.SplitHostPort(c.Address); err != nil {
-		return errors.Errorf("invalid address %s", c.Address)
 	}
 
 	if c.TLS == nil {
@@ -228,32 +645,59 @@ func (c *Config) Validate() error {
 			c.TLS.MinVersion = DefaultTLSOptions.MinVersion
 		}
 		if c.TLS.MinVersion > c.TLS.MaxVersion {
-			return errors.New("tls minVersion cannot exceed tls maxVersion")
+			merr.Append(errors.New("tls minVersion cannot exceed tls maxVersion"))
 		}
 		c.TLS.Renegotiation = c.TLS.Renegotiation || DefaultTLSOptions.Renegotiation
 	}
 
-	// Validate KMS options, nil is ok.
-	if err := c.KMS.Validate(); err != nil {
-		return err
+	// Validate the issuers, only one can be configured for each key type.
+	keyTypes := make(map[string]bool)
+	for _, o := range c.Issuers {
+		if err := o.Validate(); err != nil {
+			merr.Append(err)
+			continue
+		}
+		if o.KeyType != "" {
+			if keyTypes[o.KeyType] {
+				merr.Append(errors.Errorf("issuers cannot contain more than one %s issuer", o.KeyType))
+			}
+			keyTypes[o.KeyType] = true
+		}
 	}
 
-	// Validate RA/CAS options, nil is ok.
-	if err := ra.Validate(); err != nil {
-		return err
+	// Validate compression options, nil is ok.
+	merr.Append(c.Compression.Validate())
+
+	// Validate ACME options, nil is ok.
+	merr.Append(c.ACME.Validate())
+
+	// Validate ACME cleanup options, nil is ok.
+	merr.Append(c.ACMECleanup.Validate())
+
+	// Validate issuance hooks.
+	for _, h := range c.IssuanceHooks {
+		merr.Append(h.Validate())
 	}
+	merr.Append(c.IssuanceQueue.Validate())
+
+	// Validate KMS options, nil is ok.
+	merr.Append(c.KMS.Validate())
 
 	// Validate ssh: nil is ok
-	if err := c.SSH.Validate(); err != nil {
-		return err
-	}
+	merr.Append(c.SSH.Validate())
 
 	// Validate templates: nil is ok
-	if err := c.Templates.Validate(); err != nil {
-		return err
+	merr.Append(c.Templates.Validate())
+
+	if c.AuthorityConfig == nil {
+		merr.Append(errors.New("authority cannot be nil"))
+	} else {
+		// Validate RA/CAS options, nil is ok.
+		merr.Append(c.AuthorityConfig.Options.Validate())
+		merr.Append(c.AuthorityConfig.Validate(c.GetAudiences()))
 	}
 
-	return c.AuthorityConfig.Validate(c.GetAudiences())
+	return merr.ErrorOrNil()
 }
 
 // GetAudiences returns the legacy and possible urls without the ports that will
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
@@ -117,6 +118,21 @@ func TestConfigValidate(t *testing.T) {
 				err: errors.New("dnsNames cannot be empty"),
 			}
 		},
+		"negative-compression-minSize": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"../testdata/secrets/root_ca.crt"},
+					IntermediateCert: "../testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "../testdata/secrets/intermediate_ca_key",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					AuthorityConfig:  ac,
+					Compression:      &CompressionOptions{Enabled: true, MinSize: -1},
+				},
+				err: errors.New("compression minSize cannot be negative"),
+			}
+		},
 		"empty-TLS": func(t *testing.T) ConfigValidateTest {
 			return ConfigValidateTest{
 				config: &Config{
@@ -197,6 +213,73 @@ func TestConfigValidate(t *testing.T) {
 				err: errors.New("tls minVersion cannot exceed tls maxVersion"),
 			}
 		},
+		"ok-issuers": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"../testdata/secrets/root_ca.crt"},
+					IntermediateCert: "../testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "../testdata/secrets/intermediate_ca_key",
+					Issuers: []*X509IssuerOptions{
+						{Certificate: "rsa_intermediate_ca.crt", Key: "rsa_intermediate_ca_key"},
+						{KeyType: "OKP", Certificate: "okp_intermediate_ca.crt", Key: "okp_intermediate_ca_key"},
+					},
+					DNSNames:        []string{"test.smallstep.com"},
+					Password:        "pass",
+					AuthorityConfig: ac,
+				},
+				tls: DefaultTLSOptions,
+			}
+		},
+		"fail-issuers": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1:443",
+					Root:             []string{"../testdata/secrets/root_ca.crt"},
+					IntermediateCert: "../testdata/secrets/intermediate_ca.crt",
+					IntermediateKey:  "../testdata/secrets/intermediate_ca_key",
+					Issuers: []*X509IssuerOptions{
+						nil,
+						{KeyType: "RSA", Key: "rsa_intermediate_ca_key"},
+						{KeyType: "RSA", Certificate: "rsa_intermediate_ca.crt"},
+						{KeyType: "DSA", Certificate: "dsa_intermediate_ca.crt", Key: "dsa_intermediate_ca_key"},
+						{KeyType: "EC", Certificate: "ec_intermediate_ca.crt", Key: "ec_intermediate_ca_key"},
+						{KeyType: "EC", Certificate: "ec2_intermediate_ca.crt", Key: "ec2_intermediate_ca_key"},
+					},
+					DNSNames:        []string{"test.smallstep.com"},
+					Password:        "pass",
+					AuthorityConfig: ac,
+				},
+				err: errors.New("5 errors occurred:\n" +
+					"\t* issuers cannot contain null values\n" +
+					"\t* issuer crt cannot be empty\n" +
+					"\t* issuer rsa_intermediate_ca.crt key cannot be empty\n" +
+					"\t* issuer dsa_intermediate_ca.crt keyType DSA is not valid; valid values are EC, RSA or OKP\n" +
+					"\t* issuers cannot contain more than one EC issuer"),
+			}
+		},
+		"multiple-errors": func(t *testing.T) ConfigValidateTest {
+			return ConfigValidateTest{
+				config: &Config{
+					Address:          "127.0.0.1",
+					Root:             []string{"../testdata/secrets/root_ca.crt"},
+					IntermediateCert: "../testdata/secrets/intermediate_ca.crt",
+					DNSNames:         []string{"test.smallstep.com"},
+					Password:         "pass",
+					Compression:      &CompressionOptions{MinSize: -1},
+					ACME:             &ACMEOptions{PathPrefix: "ca/"},
+					AuthorityConfig: &AuthConfig{
+						Backdate: &provisioner.Duration{Duration: -time.Minute},
+					},
+				},
+				err: errors.New("5 errors occurred:\n" +
+					"\t* invalid address 127.0.0.1\n" +
+					"\t* key cannot be empty\n" +
+					"\t* compression minSize cannot be negative\n" +
+					"\t* acme pathPrefix \"ca/\" must start with a slash and cannot end with one\n" +
+					"\t* authority.backdate cannot be less than 0"),
+			}
+		},
 	}
 
 	for name, get := range tests {
@@ -271,6 +354,44 @@ func TestAuthConfigValidate(t *testing.T) {
 				asn1dn: ASN1DN{},
 			}
 		},
+		"fail-wildcard-policy-empty-domain": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					WildcardPolicy: &WildcardPolicy{
+						ProtectedDomains: []*ProtectedDomain{{Domain: ""}},
+					},
+				},
+				err: errors.New("wildcardPolicy protectedDomains cannot contain an empty domain"),
+			}
+		},
+		"fail-wildcard-policy-wildcard-domain": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					WildcardPolicy: &WildcardPolicy{
+						ProtectedDomains: []*ProtectedDomain{{Domain: "*.example.com"}},
+					},
+				},
+				err: errors.New("wildcardPolicy protected domain *.example.com cannot contain a wildcard"),
+			}
+		},
+		"fail-negative-max-chain-depth": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac:  &AuthConfig{MaxChainDepth: -1},
+				err: errors.New("authority.maxChainDepth cannot be less than 0"),
+			}
+		},
+		"ok-wildcard-policy": func(t *testing.T) AuthConfigValidateTest {
+			return AuthConfigValidateTest{
+				ac: &AuthConfig{
+					WildcardPolicy: &WildcardPolicy{
+						ProtectedDomains: []*ProtectedDomain{
+							{Domain: "example.com", AllowedProvisioners: []string{"acme"}},
+						},
+					},
+				},
+				asn1dn: ASN1DN{},
+			}
+		},
 		"ok-custom-asn1dn": func(t *testing.T) AuthConfigValidateTest {
 			return AuthConfigValidateTest{
 				ac: &AuthConfig{
@@ -298,3 +419,179 @@ func TestAuthConfigValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestWildcardPolicy_Lookup(t *testing.T) {
+	example := &ProtectedDomain{Domain: "example.com", AllowedProvisioners: []string{"acme"}}
+	teamA := &ProtectedDomain{Domain: "team-a.example.com", AllowedProvisioners: []string{"team-a"}}
+	policy := &WildcardPolicy{
+		ProtectedDomains: []*ProtectedDomain{example, teamA},
+	}
+
+	tests := []struct {
+		name   string
+		policy *WildcardPolicy
+		domain string
+		want   *ProtectedDomain
+	}{
+		{"ok/nil-policy", nil, "example.com", nil},
+		{"ok/base-domain", policy, "example.com", example},
+		{"ok/subdomain", policy, "foo.example.com", example},
+		{"ok/case-insensitive", policy, "Foo.Example.COM.", example},
+		{"ok/most-specific", policy, "foo.team-a.example.com", teamA},
+		{"ok/not-protected", policy, "example.org", nil},
+		{"ok/suffix-not-subdomain", policy, "badexample.com", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.policy.Lookup(tt.domain), tt.want)
+		})
+	}
+}
+
+func TestProtectedDomain_IsAllowed(t *testing.T) {
+	d := &ProtectedDomain{Domain: "example.com", AllowedProvisioners: []string{"acme", "acme-internal"}}
+	assert.True(t, d.IsAllowed("acme"))
+	assert.True(t, d.IsAllowed("acme-internal"))
+	assert.False(t, d.IsAllowed("acme-lax"))
+	assert.False(t, (&ProtectedDomain{Domain: "example.com"}).IsAllowed("acme"))
+}
+
+func TestACMECleanupOptions_Validate(t *testing.T) {
+	duration := func(d time.Duration) *provisioner.Duration {
+		return &provisioner.Duration{Duration: d}
+	}
+	tests := []struct {
+		name string
+		opts *ACMECleanupOptions
+		err  error
+	}{
+		{"ok/nil", nil, nil},
+		{"ok/empty", &ACMECleanupOptions{}, nil},
+		{"ok/enabled", &ACMECleanupOptions{Enabled: true}, nil},
+		{"ok", &ACMECleanupOptions{Enabled: true, Interval: duration(time.Hour), Retention: duration(0), BatchSize: 10}, nil},
+		{"fail/interval", &ACMECleanupOptions{Interval: duration(0)}, errors.New("acmeCleanup interval must be greater than 0")},
+		{"fail/retention", &ACMECleanupOptions{Retention: duration(-time.Hour)}, errors.New("acmeCleanup retention cannot be negative")},
+		{"fail/batchSize", &ACMECleanupOptions{BatchSize: -1}, errors.New("acmeCleanup batchSize cannot be negative")},
+		{"ok/nonces", &ACMECleanupOptions{Nonces: &ACMENonceCleanupOptions{
+			Enabled: true, Interval: duration(time.Minute), MaxAge: duration(time.Hour), BatchSize: 10,
+		}}, nil},
+		{"ok/nonces-only", &ACMECleanupOptions{Nonces: &ACMENonceCleanupOptions{Enabled: true}}, nil},
+		{"fail/nonces-interval", &ACMECleanupOptions{Nonces: &ACMENonceCleanupOptions{Interval: duration(0)}},
+			errors.New("acmeCleanup nonces interval must be greater than 0")},
+		{"fail/nonces-maxAge", &ACMECleanupOptions{Nonces: &ACMENonceCleanupOptions{MaxAge: duration(-time.Minute)}},
+			errors.New("acmeCleanup nonces maxAge must be greater than 0")},
+		{"fail/nonces-batchSize", &ACMECleanupOptions{Nonces: &ACMENonceCleanupOptions{BatchSize: -1}},
+			errors.New("acmeCleanup nonces batchSize cannot be negative")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.err == nil {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Equals(t, err.Error(), tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestACMEOptions_Validate(t *testing.T) {
+	duration := func(d time.Duration) *provisioner.Duration {
+		return &provisioner.Duration{Duration: d}
+	}
+	tests := []struct {
+		name string
+		opts *ACMEOptions
+		err  error
+	}{
+		{"ok/nil", nil, nil},
+		{"ok/empty", &ACMEOptions{}, nil},
+		{"ok/pathPrefix", &ACMEOptions{PathPrefix: "/ca"}, nil},
+		{"ok/pathPrefix-segments", &ACMEOptions{PathPrefix: "/pki/ca-1"}, nil},
+		{"fail/pathPrefix-relative", &ACMEOptions{PathPrefix: "ca"},
+			errors.New(`acme pathPrefix "ca" must start with a slash and cannot end with one`)},
+		{"fail/pathPrefix-trailing-slash", &ACMEOptions{PathPrefix: "/ca/"},
+			errors.New(`acme pathPrefix "/ca/" must start with a slash and cannot end with one`)},
+		{"fail/pathPrefix-root", &ACMEOptions{PathPrefix: "/"},
+			errors.New(`acme pathPrefix "/" must start with a slash and cannot end with one`)},
+		{"fail/pathPrefix-empty-segment", &ACMEOptions{PathPrefix: "/pki//ca"},
+			errors.New(`acme pathPrefix "/pki//ca" cannot contain empty, . or .. segments`)},
+		{"fail/pathPrefix-dot-segment", &ACMEOptions{PathPrefix: "/pki/../ca"},
+			errors.New(`acme pathPrefix "/pki/../ca" cannot contain empty, . or .. segments`)},
+		{"fail/pathPrefix-escaped", &ACMEOptions{PathPrefix: "/ca?x=1"},
+			errors.New(`acme pathPrefix "/ca?x=1" cannot contain characters that must be escaped`)},
+		{"ok/signedDirectory", &ACMEOptions{SignedDirectory: &SignedDirectoryOptions{Enabled: true}}, nil},
+		{"ok/signedDirectory-key", &ACMEOptions{SignedDirectory: &SignedDirectoryOptions{
+			Enabled: true, Certificate: "directory.crt", Key: "directory.key",
+		}}, nil},
+		{"fail/signedDirectory-key", &ACMEOptions{SignedDirectory: &SignedDirectoryOptions{
+			Enabled: true, Certificate: "directory.crt",
+		}}, errors.New("acme signedDirectory key cannot be empty if crt is set")},
+		{"fail/signedDirectory-crt", &ACMEOptions{SignedDirectory: &SignedDirectoryOptions{
+			Enabled: true, Key: "directory.key",
+		}}, errors.New("acme signedDirectory crt cannot be empty if key is set")},
+		{"ok/globalDirectory", &ACMEOptions{GlobalDirectory: &GlobalDirectoryOptions{Enabled: true, Provisioner: "acme"}}, nil},
+		{"ok/globalDirectory-disabled", &ACMEOptions{GlobalDirectory: &GlobalDirectoryOptions{Enabled: false}}, nil},
+		{"fail/globalDirectory-provisioner", &ACMEOptions{GlobalDirectory: &GlobalDirectoryOptions{Enabled: true}},
+			errors.New("acme globalDirectory provisioner cannot be empty if it's enabled")},
+		{"ok/validation", &ACMEOptions{Validation: &ACMEValidationOptions{
+			MaxIdleConns: 1000, MaxIdleConnsPerHost: 4, IdleConnTimeout: duration(time.Minute),
+			DNSCache: &DNSCacheOptions{Enabled: true, MaxSize: 10000, MinTTL: duration(time.Second), MaxTTL: duration(time.Minute)},
+		}}, nil},
+		{"fail/validation-maxIdleConns", &ACMEOptions{Validation: &ACMEValidationOptions{MaxIdleConns: -1}},
+			errors.New("acme validation maxIdleConns cannot be negative")},
+		{"fail/validation-maxIdleConnsPerHost", &ACMEOptions{Validation: &ACMEValidationOptions{MaxIdleConnsPerHost: -1}},
+			errors.New("acme validation maxIdleConnsPerHost cannot be negative")},
+		{"fail/validation-idleConnTimeout", &ACMEOptions{Validation: &ACMEValidationOptions{IdleConnTimeout: duration(-time.Second)}},
+			errors.New("acme validation idleConnTimeout cannot be negative")},
+		{"ok/validation-maxConcurrentValidations", &ACMEOptions{Validation: &ACMEValidationOptions{MaxConcurrentValidations: 100}}, nil},
+		{"fail/validation-maxConcurrentValidations", &ACMEOptions{Validation: &ACMEValidationOptions{MaxConcurrentValidations: -1}},
+			errors.New("acme validation maxConcurrentValidations cannot be negative")},
+		{"ok/validation-http01Redirects", &ACMEOptions{Validation: &ACMEValidationOptions{HTTP01MaxRedirects: 5, HTTP01RedirectSchemes: []string{"https"}}}, nil},
+		{"fail/validation-http01MaxRedirects", &ACMEOptions{Validation: &ACMEValidationOptions{HTTP01MaxRedirects: -1}},
+			errors.New("acme validation http01MaxRedirects cannot be negative")},
+		{"fail/validation-http01RedirectSchemes", &ACMEOptions{Validation: &ACMEValidationOptions{HTTP01RedirectSchemes: []string{"https", "ftp"}}},
+			errors.New(`acme validation http01RedirectSchemes ["https" "ftp"] can only contain http and https`)},
+		{"ok/validation-tlsALPN01", &ACMEOptions{Validation: &ACMEValidationOptions{TLSALPN01MinVersion: 1.3}}, nil},
+		{"fail/validation-tlsALPN01MinVersion-lower", &ACMEOptions{Validation: &ACMEValidationOptions{TLSALPN01MinVersion: 1.1}},
+			errors.New("acme validation tlsALPN01MinVersion 1.1 cannot be lower than 1.2")},
+		{"fail/validation-tlsALPN01MinVersion", &ACMEOptions{Validation: &ACMEValidationOptions{TLSALPN01MinVersion: 1.4}},
+			errors.New("acme validation tlsALPN01MinVersion 1.4 is not a valid tls version")},
+		{"fail/dnsCache-maxSize", &ACMEOptions{Validation: &ACMEValidationOptions{DNSCache: &DNSCacheOptions{MaxSize: -1}}},
+			errors.New("acme validation dnsCache maxSize cannot be negative")},
+		{"fail/dnsCache-minTTL", &ACMEOptions{Validation: &ACMEValidationOptions{DNSCache: &DNSCacheOptions{MinTTL: duration(-time.Second)}}},
+			errors.New("acme validation dnsCache minTTL cannot be negative")},
+		{"fail/dnsCache-maxTTL", &ACMEOptions{Validation: &ACMEValidationOptions{DNSCache: &DNSCacheOptions{MaxTTL: duration(-time.Second)}}},
+			errors.New("acme validation dnsCache maxTTL cannot be negative")},
+		{"fail/dnsCache-ttls", &ACMEOptions{Validation: &ACMEValidationOptions{DNSCache: &DNSCacheOptions{
+			MinTTL: duration(time.Minute), MaxTTL: duration(time.Second),
+		}}}, errors.New("acme validation dnsCache minTTL cannot be greater than maxTTL")},
+		{"ok/circuitBreaker", &ACMEOptions{CircuitBreaker: &CircuitBreakerOptions{
+			Enabled: true, Threshold: 10, Cooldown: duration(time.Minute),
+		}}, nil},
+		{"fail/circuitBreaker-threshold", &ACMEOptions{CircuitBreaker: &CircuitBreakerOptions{Threshold: -1}},
+			errors.New("acme circuitBreaker threshold cannot be negative")},
+		{"fail/circuitBreaker-cooldown", &ACMEOptions{CircuitBreaker: &CircuitBreakerOptions{Cooldown: duration(-time.Second)}},
+			errors.New("acme circuitBreaker cooldown cannot be negative")},
+		{"ok/errorStatusCodes", &ACMEOptions{ErrorStatusCodes: map[string]int{"unauthorized": 403, "rateLimited": 503}}, nil},
+		{"fail/errorStatusCodes-type", &ACMEOptions{ErrorStatusCodes: map[string]int{"unauthorized": 403, "foo": 400}},
+			errors.New("acme errorStatusCodes: unsupported ACME problem type foo")},
+		{"fail/errorStatusCodes-code", &ACMEOptions{ErrorStatusCodes: map[string]int{"unauthorized": 200}},
+			errors.New("acme errorStatusCodes: status code 200 of ACME problem type unauthorized is not a 4xx or 5xx code")},
+		{"ok/keyAuthorizationDigests", &ACMEOptions{KeyAuthorizationDigests: map[string]string{"device-attest-01": "SHA-384"}}, nil},
+		{"fail/keyAuthorizationDigests-hash", &ACMEOptions{KeyAuthorizationDigests: map[string]string{"device-attest-01": "SHA-999"}},
+			errors.New("acme keyAuthorizationDigests: unsupported hash function SHA-999 for challenge device-attest-01")},
+		{"fail/keyAuthorizationDigests-standard", &ACMEOptions{KeyAuthorizationDigests: map[string]string{"dns-01": "SHA-384"}},
+			errors.New("acme keyAuthorizationDigests: the key authorization digest of dns-01 challenges cannot be changed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.err == nil {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Equals(t, err.Error(), tt.err.Error())
+			}
+		})
+	}
+}
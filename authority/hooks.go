@@ -0,0 +1,57 @@
+package authority
+
+import (
+	"context"
+	"crypto/x509"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/hooks"
+)
+
+// issuanceHooksTimeout is the time that all the synchronous issuance hooks of
+// a certificate can take together. Once it's exceeded, the context of the
+// hooks is canceled, so the retries of the hooks cannot delay the response to
+// the client indefinitely.
+var issuanceHooksTimeout = 10 * time.Second
+
+// issuanceHook is an issuance hook and whether its failures must be returned.
+type issuanceHook struct {
+	hook        hooks.IssuanceHook
+	failOnError bool
+}
+
+// runIssuanceHooks calls the issuance hooks with the details of the issued
+// certificate. The failures of the hooks are logged, and the first one of a
+// hook with failOnError is returned after all the hooks have been called. The
+// hooks share a context that expires after issuanceHooksTimeout.
+func (a *Authority) runIssuanceHooks(typ string, crt *x509.Certificate, data *db.CertificateData) error {
+	if len(a.issuanceHooks) == 0 {
+		return nil
+	}
+
+	e := hooks.NewIssuanceEvent(typ, crt)
+	if p, err := a.LoadProvisionerByCertificate(crt); err == nil {
+		e.Provisioner = p.GetName()
+	}
+	if data != nil {
+		e.ACMEAccountID = data.AccountID
+		e.ACMEOrderID = data.OrderID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), issuanceHooksTimeout)
+	defer cancel()
+
+	var firstErr error
+	for _, h := range a.issuanceHooks {
+		if err := h.hook.Issued(ctx, e); err != nil {
+			log.Printf("error running issuance hook for certificate %s: %v", e.SerialNumber, err)
+			if h.failOnError && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return errors.Wrap(firstErr, "error running issuance hook")
+}
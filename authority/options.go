@@ -5,6 +5,7 @@ import (
 	"crypto"
 	"crypto/x509"
 	"encoding/pem"
+	"io"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/admin"
@@ -13,6 +14,7 @@ import (
 	"github.com/smallstep/certificates/cas"
 	casapi "github.com/smallstep/certificates/cas/apiv1"
 	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/certificates/hooks"
 	"github.com/smallstep/certificates/kms"
 	"golang.org/x/crypto/ssh"
 )
@@ -141,6 +143,41 @@ func WithX509Signer(crt *x509.Certificate, s crypto.Signer) Option {
 			return err
 		}
 		a.x509CAService = srv
+		a.intermediateX509 = crt
+		return nil
+	}
+}
+
+// WithIssuanceHook adds a hook that will be called after a certificate has
+// been issued. If failOnError is true, a hook failure will be returned instead
+// of the certificate.
+func WithIssuanceHook(h hooks.IssuanceHook, failOnError bool) Option {
+	return func(a *Authority) error {
+		a.issuanceHooks = append(a.issuanceHooks, issuanceHook{
+			hook:        h,
+			failOnError: failOnError,
+		})
+		return nil
+	}
+}
+
+// WithAsyncIssuanceHook adds a hook that will be called in the background, with
+// the issuance queue, after a certificate has been issued.
+func WithAsyncIssuanceHook(h hooks.IssuanceHook) Option {
+	return func(a *Authority) error {
+		a.asyncHooks = append(a.asyncHooks, h)
+		return nil
+	}
+}
+
+// WithRandomSource defines the source of randomness used to generate the serial
+// numbers of the X.509 certificates and the ACME nonces. It's meant to be used
+// in tests that need deterministic values, by default the serial numbers are
+// generated by the CAS and the nonces using crypto/rand. The source must be
+// safe for concurrent use.
+func WithRandomSource(r io.Reader) Option {
+	return func(a *Authority) error {
+		a.randomSource = r
 		return nil
 	}
 }
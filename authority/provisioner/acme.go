@@ -3,23 +3,329 @@ package provisioner
 import (
 	"context"
 	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/errs"
+	"golang.org/x/net/http/httpguts"
 )
 
+// DefaultACMEMaxPendingAuthz is the default maximum number of pending
+// authorizations that an ACME account can have.
+const DefaultACMEMaxPendingAuthz = 1000
+
+// Default polling intervals suggested to ACME clients using the Retry-After
+// header while a challenge is being validated or an order is being processed.
+const (
+	DefaultACMEChallengeRetryAfter = 5 * time.Second
+	DefaultACMEOrderRetryAfter     = 3 * time.Second
+)
+
+// Validity policies used by the ACME provisioner when a new order requests a
+// validity window that is outside the configured certificate durations.
+const (
+	// ACMEValidityPolicyReject rejects the order. This is the default policy.
+	ACMEValidityPolicyReject = "reject"
+	// ACMEValidityPolicyClamp adjusts the notAfter of the order to the closest
+	// allowed duration.
+	ACMEValidityPolicyClamp = "clamp"
+)
+
+// Must-staple policies used by the ACME provisioner when a certificate request
+// asks for the OCSP must-staple TLS feature.
+const (
+	// ACMEMustStapleIgnore issues the certificate without the TLS feature
+	// extension. This is the default policy.
+	ACMEMustStapleIgnore = "ignore"
+	// ACMEMustStapleAllow copies the TLS feature extension of the request to
+	// the certificate.
+	ACMEMustStapleAllow = "allow"
+	// ACMEMustStapleForbid rejects the certificate request.
+	ACMEMustStapleForbid = "forbid"
+)
+
+// Common name policies used by the ACME provisioner when the common name of a
+// certificate request is not one of its subject alternative names.
+const (
+	// ACMECommonNamePolicyAllow accepts the common name if it is one of the
+	// order identifiers, as RFC 8555 requires. This is the default policy.
+	ACMECommonNamePolicyAllow = "allow"
+	// ACMECommonNamePolicyReject rejects the certificate request.
+	ACMECommonNamePolicyReject = "reject"
+	// ACMECommonNamePolicyStrip removes the common name from the certificate
+	// request, the certificate is issued for the subject alternative names.
+	ACMECommonNamePolicyStrip = "strip"
+)
+
+// Mixed wildcard policies used by the ACME provisioner when a new order
+// requests a wildcard identifier and subdomains of its base domain, e.g.
+// *.example.com and www.example.com.
+const (
+	// ACMEMixedWildcardPolicyAllow accepts the order. This is the default
+	// policy.
+	ACMEMixedWildcardPolicyAllow = "allow"
+	// ACMEMixedWildcardPolicyWarn accepts the order and flags it in the
+	// request log.
+	ACMEMixedWildcardPolicyWarn = "warn"
+	// ACMEMixedWildcardPolicyReject rejects the order.
+	ACMEMixedWildcardPolicyReject = "reject"
+)
+
+// acmeAllowedCurves are the key curves that can be used in the AllowedCurves
+// of an ACME provisioner.
+var acmeAllowedCurves = map[string]bool{
+	"P-256":   true,
+	"P-384":   true,
+	"P-521":   true,
+	"Ed25519": true,
+}
+
+// acmeAllowedAlgorithms are the JWS algorithms that can be used in the
+// AllowedAlgorithms of an ACME provisioner.
+var acmeAllowedAlgorithms = map[string]bool{
+	"RS256": true,
+	"RS384": true,
+	"RS512": true,
+	"PS256": true,
+	"PS384": true,
+	"PS512": true,
+	"ES256": true,
+	"ES384": true,
+	"ES512": true,
+	"EdDSA": true,
+}
+
+// acmeAllowedChallenges are the challenges that can be configured for each
+// identifier type in the Challenges of an ACME provisioner.
+var acmeAllowedChallenges = map[string]map[string]bool{
+	"dns": {"http-01": true, "dns-01": true, "tls-alpn-01": true},
+	"ip":  {"http-01": true, "tls-alpn-01": true},
+}
+
+// acmeReservedHTTP01Headers are the headers that cannot be configured in the
+// HTTP01Headers of an ACME provisioner, they are set by the http client or
+// they would change the host being validated.
+var acmeReservedHTTP01Headers = map[string]bool{
+	"Host":              true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Te":                true,
+	"Trailer":           true,
+	"Upgrade":           true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+}
+
+// ACMEIssuer is the intermediate certificate and key used to sign the
+// certificates issued by an ACME provisioner. The key can be a file or a KMS
+// URI, and it will be decrypted using the authority password.
+type ACMEIssuer struct {
+	Certificate string `json:"crt"`
+	Key         string `json:"key"`
+}
+
+// ACMEPolicy restricts the identifiers that can be requested in new orders.
+// DNSNameRegex applies to the dns identifiers, including the wildcard ones,
+// and IPRegex to the ip identifiers. An empty expression allows all the values
+// of that type.
+type ACMEPolicy struct {
+	DNSNameRegex string `json:"dnsNameRegex,omitempty"`
+	IPRegex      string `json:"ipRegex,omitempty"`
+	dnsNameRegex *regexp.Regexp
+	ipRegex      *regexp.Regexp
+}
+
+func (p *ACMEPolicy) init() (err error) {
+	if p.DNSNameRegex != "" {
+		if p.dnsNameRegex, err = regexp.Compile(p.DNSNameRegex); err != nil {
+			return errors.Wrap(err, "error parsing provisioner policy dnsNameRegex")
+		}
+	}
+	if p.IPRegex != "" {
+		if p.ipRegex, err = regexp.Compile(p.IPRegex); err != nil {
+			return errors.Wrap(err, "error parsing provisioner policy ipRegex")
+		}
+	}
+	return nil
+}
+
 // ACME is the acme provisioner type, an entity that can authorize the ACME
 // provisioning flow.
+//
+// If Issuer is set, the certificates will be signed by the given intermediate
+// instead of the one configured in the authority.
+//
+// MaxPendingAuthz limits the number of pending authorizations that an account
+// can have, if it's not set DefaultACMEMaxPendingAuthz will be used, and a
+// negative value will disable the limit.
+//
+// MaxOrdersPerAccount limits the total number of orders that an account can
+// create during its lifetime, unlike MaxPendingAuthz the orders count even if
+// they are no longer pending. It's unlimited by default.
+//
+// ValidityPolicy defines what to do with new orders requesting a validity
+// window outside the certificate duration claims, it can be "reject" (the
+// default) or "clamp".
+//
+// MustStaple defines what to do with the certificate requests that ask for
+// the OCSP must-staple TLS feature (RFC 7633), it can be "ignore" (the
+// default), "allow" to include the extension in the certificate, or "forbid"
+// to reject the request.
+//
+// CommonNamePolicy defines what to do with the certificate requests with a
+// common name that is not one of their subject alternative names, it can be
+// "allow" (the default) if it is one of the order identifiers, "reject", or
+// "strip" to issue the certificate without it.
+//
+// MixedWildcardPolicy defines what to do with the new orders that request a
+// wildcard identifier and subdomains of its base domain, e.g. *.example.com
+// and www.example.com, it can be "allow" (the default), "warn" to flag them in
+// the request log, or "reject". The base domain itself, e.g. example.com, can
+// always be requested with the wildcard.
+//
+// ChallengeRetryAfter and OrderRetryAfter are the polling intervals suggested
+// to the clients while a challenge or an order is not in a final state, if
+// they are not set DefaultACMEChallengeRetryAfter and
+// DefaultACMEOrderRetryAfter will be used.
+//
+// EnableServerKeyGeneration allows the clients to request the CA to generate
+// the key of the certificate when an order is finalized. This is not part of
+// the ACME protocol, and the key is returned encrypted in the response.
+//
+// Policy, if set, restricts the identifiers that can be requested in new
+// orders using regular expressions.
+//
+// ChallengeHistorySize is the number of validation attempts stored with each
+// challenge, and returned in the non-standard x-history field. It is disabled
+// by default.
+//
+// AllowedCurves, if set, restricts the curves of the ECDSA and Ed25519 keys
+// used to sign the ACME requests, e.g. ["P-256", "P-384"]. RSA keys are not
+// affected.
+//
+// AllowedAlgorithms, if set, restricts the JWS algorithms used to sign the
+// ACME requests, e.g. ["ES256", "ES384"].
+//
+// Challenges, if set, defines the challenges offered for each identifier
+// type, e.g. {"dns": ["dns-01", "http-01"], "ip": ["http-01"]}. The identifier
+// types not in the map use the default challenges. Wildcard dns identifiers
+// only use dns-01.
+//
+// HTTP01Headers, if set, are the headers added to the http-01 validation
+// requests, e.g. a shared secret expected by an authenticating proxy in front
+// of the validated hosts. Note that the validation requests use plain http and
+// they are sent to any host an ACME client can order a certificate for, so
+// the values must not be considered secret unless the identifiers are
+// restricted with a Policy.
+//
+// RequireKeyAttestation rejects the finalize requests whose CSR does not
+// include a key attestation statement, proving that the key was generated in
+// a TPM, an Apple device or a YubiKey. The attestation certificates must chain
+// up to the PEM encoded KeyAttestationRoots, and include the extensions of the
+// attestation format. It cannot be used with EnableServerKeyGeneration.
+//
+// TrustedAccounts are the ids of the accounts exempt from MaxPendingAuthz and
+// MaxOrdersPerAccount, e.g. the accounts of internal clients that need higher
+// limits. The requests that skip a limit are flagged in the request logs.
+//
+// IdentifierTypes, if set, restricts the identifier types that can be
+// requested in new orders, e.g. ["dns"] to disable the ip identifiers.
+//
+// AccountIdentities, if set, only allows the registration of new accounts to
+// the clients that present a client certificate, issued by the CA, with one of
+// the given values in the common name or in the SANs. The existing accounts
+// are not affected.
+//
+// MaxConcurrentValidations limits the number of challenges of the provisioner
+// validated at the same time, the validations beyond the limit are deferred.
+// It's unlimited by default.
+//
+// AuthorizationsPageSize, if set, is the maximum number of authorization links
+// included in an order, the rest of them are returned in pages of the same
+// size by the authorizations endpoint of the order.
+//
+// MaxContacts, if set, is the maximum number of contacts of an account, the
+// duplicated contacts are not counted. It's unlimited by default.
+//
+// ReuseWildcardAuthz allows a valid wildcard authorization of an account, e.g.
+// for *.example.com, to satisfy the identifiers of new orders for the names
+// directly under it, e.g. a.example.com, while it has not expired. It's
+// disabled by default.
+//
+// AuthzReuseAge, if set, allows a valid authorization of an account to satisfy
+// the same identifier in new orders of the account, without new challenges,
+// while it has not expired and it was validated less than AuthzReuseAge ago.
+// It's 0 by default, the authorizations are not reused.
+//
+// CAAIdentities and Website, if set, are advertised in the meta object of the
+// ACME directory. CAAIdentities are the hostnames the CA recognizes in the
+// issuer domain of the CAA records, and Website is the URL of a page with
+// more information about the CA.
+//
+// DirectoryMeta, if set, are extra fields added to the meta object of the
+// ACME directory, e.g. {"myorg:profileURL": "https://example.com/profile"} for
+// a custom client. The keys must be namespaced with a prefix followed by a
+// colon, so they never clash with the fields of RFC 8555.
+//
+// IncludeAccountID adds the id of the ACME account that requested a
+// certificate to the provisioner extension of the certificate, as the
+// AccountID key-value pair. It's omitted by default.
+//
+// Enabled, if set to false, rejects all the requests to the ACME endpoints of
+// the provisioner with a 403, e.g. to stop a provisioner during an incident
+// without removing it. The provisioner is enabled by default. The linkedca
+// representation of the ACME provisioners does not have this field, so it
+// cannot be set in the provisioners stored in the admin database, and it's
+// lost when a provisioner is converted to linkedca, e.g. by an export.
 type ACME struct {
 	*base
-	ID      string   `json:"-"`
-	Type    string   `json:"type"`
-	Name    string   `json:"name"`
-	ForceCN bool     `json:"forceCN,omitempty"`
-	Claims  *Claims  `json:"claims,omitempty"`
-	Options *Options `json:"options,omitempty"`
-	claimer *Claimer
+	ID                        string              `json:"-"`
+	Type                      string              `json:"type"`
+	Name                      string              `json:"name"`
+	ForceCN                   bool                `json:"forceCN,omitempty"`
+	MaxPendingAuthz           int                 `json:"maxPendingAuthz,omitempty"`
+	MaxOrdersPerAccount       int                 `json:"maxOrdersPerAccount,omitempty"`
+	ValidityPolicy            string              `json:"validityPolicy,omitempty"`
+	MustStaple                string              `json:"mustStaple,omitempty"`
+	CommonNamePolicy          string              `json:"commonNamePolicy,omitempty"`
+	MixedWildcardPolicy       string              `json:"mixedWildcardPolicy,omitempty"`
+	ChallengeRetryAfter       *Duration           `json:"challengeRetryAfter,omitempty"`
+	OrderRetryAfter           *Duration           `json:"orderRetryAfter,omitempty"`
+	DisableKeyRollover        bool                `json:"disableKeyRollover,omitempty"`
+	EnableServerKeyGeneration bool                `json:"enableServerKeyGeneration,omitempty"`
+	Policy                    *ACMEPolicy         `json:"policy,omitempty"`
+	ChallengeHistorySize      int                 `json:"challengeHistorySize,omitempty"`
+	AllowedCurves             []string            `json:"allowedCurves,omitempty"`
+	AllowedAlgorithms         []string            `json:"allowedAlgorithms,omitempty"`
+	Challenges                map[string][]string `json:"challenges,omitempty"`
+	HTTP01Headers             map[string]string   `json:"http01Headers,omitempty"`
+	RequireKeyAttestation     bool                `json:"requireKeyAttestation,omitempty"`
+	KeyAttestationRoots       []byte              `json:"keyAttestationRoots,omitempty"`
+	AccountIdentities         []string            `json:"accountIdentities,omitempty"`
+	IdentifierTypes           []string            `json:"identifierTypes,omitempty"`
+	TrustedAccounts           []string            `json:"trustedAccounts,omitempty"`
+	MaxConcurrentValidations  int                 `json:"maxConcurrentValidations,omitempty"`
+	AuthorizationsPageSize    int                 `json:"authorizationsPageSize,omitempty"`
+	MaxContacts               int                 `json:"maxContacts,omitempty"`
+	ReuseWildcardAuthz        bool                `json:"reuseWildcardAuthz,omitempty"`
+	AuthzReuseAge             *Duration           `json:"authzReuseAge,omitempty"`
+	CAAIdentities             []string            `json:"caaIdentities,omitempty"`
+	Website                   string              `json:"website,omitempty"`
+	DirectoryMeta             map[string]string   `json:"directoryMeta,omitempty"`
+	IncludeAccountID          bool                `json:"includeAccountID,omitempty"`
+	Enabled                   *bool               `json:"enabled,omitempty"`
+	Issuer                    *ACMEIssuer         `json:"issuer,omitempty"`
+	Claims                    *Claims             `json:"claims,omitempty"`
+	Options                   *Options            `json:"options,omitempty"`
+	claimer                   *Claimer
+	keyAttestationRoots       *x509.CertPool
 }
 
 // GetID returns the provisioner unique identifier.
@@ -61,13 +367,261 @@ func (p *ACME) GetOptions() *Options {
 	return p.Options
 }
 
+// GetMaxPendingAuthz returns the maximum number of pending authorizations that
+// an account can have. A value of 0 indicates that there's no limit.
+func (p *ACME) GetMaxPendingAuthz() int {
+	switch {
+	case p.MaxPendingAuthz < 0:
+		return 0
+	case p.MaxPendingAuthz == 0:
+		return DefaultACMEMaxPendingAuthz
+	default:
+		return p.MaxPendingAuthz
+	}
+}
+
+// GetMaxOrdersPerAccount returns the maximum number of orders that an account
+// can create. A value of 0 indicates that there's no limit.
+func (p *ACME) GetMaxOrdersPerAccount() int {
+	return p.MaxOrdersPerAccount
+}
+
+// GetValidityPolicy returns the policy used when a new order requests a
+// validity window outside the certificate duration claims.
+func (p *ACME) GetValidityPolicy() string {
+	if p.ValidityPolicy == "" {
+		return ACMEValidityPolicyReject
+	}
+	return p.ValidityPolicy
+}
+
+// GetMustStaple returns the policy used when a certificate request asks for
+// the OCSP must-staple TLS feature.
+func (p *ACME) GetMustStaple() string {
+	if p.MustStaple == "" {
+		return ACMEMustStapleIgnore
+	}
+	return p.MustStaple
+}
+
+// GetCommonNamePolicy returns the policy used when the common name of a
+// certificate request is not one of its subject alternative names.
+func (p *ACME) GetCommonNamePolicy() string {
+	if p.CommonNamePolicy == "" {
+		return ACMECommonNamePolicyAllow
+	}
+	return p.CommonNamePolicy
+}
+
+// GetMixedWildcardPolicy returns the policy used when a new order requests a
+// wildcard identifier and subdomains of its base domain.
+func (p *ACME) GetMixedWildcardPolicy() string {
+	if p.MixedWildcardPolicy == "" {
+		return ACMEMixedWildcardPolicyAllow
+	}
+	return p.MixedWildcardPolicy
+}
+
+// GetChallengeRetryAfter returns the polling interval suggested to the clients
+// while a challenge is being validated.
+func (p *ACME) GetChallengeRetryAfter() time.Duration {
+	if p.ChallengeRetryAfter == nil {
+		return DefaultACMEChallengeRetryAfter
+	}
+	return p.ChallengeRetryAfter.Duration
+}
+
+// GetOrderRetryAfter returns the polling interval suggested to the clients
+// while an order is being processed.
+func (p *ACME) GetOrderRetryAfter() time.Duration {
+	if p.OrderRetryAfter == nil {
+		return DefaultACMEOrderRetryAfter
+	}
+	return p.OrderRetryAfter.Duration
+}
+
+// IsEnabled returns false if the provisioner has been explicitly disabled.
+func (p *ACME) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// IsKeyRolloverDisabled returns true if the key of the accounts cannot be
+// changed after they are created.
+func (p *ACME) IsKeyRolloverDisabled() bool {
+	return p.DisableKeyRollover
+}
+
+// IsServerKeyGenerationEnabled returns true if the clients can request the CA
+// to generate the key of the certificates.
+func (p *ACME) IsServerKeyGenerationEnabled() bool {
+	return p.EnableServerKeyGeneration
+}
+
+// GetChallengeHistorySize returns the maximum number of validation attempts
+// stored with each challenge, 0 if the history is disabled.
+func (p *ACME) GetChallengeHistorySize() int {
+	return p.ChallengeHistorySize
+}
+
+// GetAllowedCurves returns the curves allowed in the ECDSA and Ed25519 keys
+// used to sign the ACME requests, an empty list allows all of them.
+func (p *ACME) GetAllowedCurves() []string {
+	return p.AllowedCurves
+}
+
+// GetAllowedAlgorithms returns the JWS algorithms allowed in the ACME
+// requests, an empty list allows all of them.
+func (p *ACME) GetAllowedAlgorithms() []string {
+	return p.AllowedAlgorithms
+}
+
+// GetChallenges returns the challenges configured for the given identifier
+// type, "dns" or "ip", or nil if the default challenges must be used.
+func (p *ACME) GetChallenges(typ string) []string {
+	return p.Challenges[typ]
+}
+
+// GetHTTP01Headers returns the headers added to the http-01 validation
+// requests, nil if no headers are configured.
+func (p *ACME) GetHTTP01Headers() http.Header {
+	if len(p.HTTP01Headers) == 0 {
+		return nil
+	}
+	h := make(http.Header, len(p.HTTP01Headers))
+	for k, v := range p.HTTP01Headers {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// GetKeyAttestationRoots returns the roots used to verify the key attestation
+// of the finalize CSRs, nil if the key attestation is not required.
+func (p *ACME) GetKeyAttestationRoots() *x509.CertPool {
+	return p.keyAttestationRoots
+}
+
+// GetAccountIdentities returns the identities of the client certificates
+// allowed to register new accounts, an empty list allows all the clients.
+func (p *ACME) GetAccountIdentities() []string {
+	return p.AccountIdentities
+}
+
+// GetIdentifierTypes returns the identifier types that can be requested in
+// new orders, an empty list allows all the supported types.
+func (p *ACME) GetIdentifierTypes() []string {
+	return p.IdentifierTypes
+}
+
+// IsTrustedAccount returns true if the account with the given id is exempt
+// from the per-account limits of the provisioner.
+func (p *ACME) IsTrustedAccount(accountID string) bool {
+	for _, id := range p.TrustedAccounts {
+		if id == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMaxConcurrentValidations returns the maximum number of challenges of the
+// provisioner validated at the same time, 0 if it's unlimited.
+func (p *ACME) GetMaxConcurrentValidations() int {
+	return p.MaxConcurrentValidations
+}
+
+// GetAuthorizationsPageSize returns the maximum number of authorization links
+// included in an order, 0 if all of them are included.
+func (p *ACME) GetAuthorizationsPageSize() int {
+	return p.AuthorizationsPageSize
+}
+
+// GetMaxContacts returns the maximum number of contacts of an account, 0 if
+// it's unlimited.
+func (p *ACME) GetMaxContacts() int {
+	return p.MaxContacts
+}
+
+// IsWildcardAuthzReuseEnabled returns true if the valid wildcard authorizations
+// can satisfy the identifiers of new orders for the names under them.
+func (p *ACME) IsWildcardAuthzReuseEnabled() bool {
+	return p.ReuseWildcardAuthz
+}
+
+// GetAuthzReuseAge returns the maximum time since the validation of an
+// authorization for it to be reused by new orders, 0 if the authorizations are
+// not reused.
+func (p *ACME) GetAuthzReuseAge() time.Duration {
+	if p.AuthzReuseAge == nil {
+		return 0
+	}
+	return p.AuthzReuseAge.Duration
+}
+
+// GetCAAIdentities returns the hostnames advertised in the caaIdentities field
+// of the directory meta object.
+func (p *ACME) GetCAAIdentities() []string {
+	return p.CAAIdentities
+}
+
+// GetWebsite returns the URL advertised in the website field of the directory
+// meta object.
+func (p *ACME) GetWebsite() string {
+	return p.Website
+}
+
+// GetDirectoryMeta returns the extra fields added to the directory meta
+// object.
+func (p *ACME) GetDirectoryMeta() map[string]string {
+	return p.DirectoryMeta
+}
+
+// AuthorizeOrderIdentifier returns an error if an identifier of the given
+// type, "dns" or "ip", and value is not allowed by the provisioner policy.
+func (p *ACME) AuthorizeOrderIdentifier(typ, value string) error {
+	if p.Policy == nil {
+		return nil
+	}
+	var re *regexp.Regexp
+	switch typ {
+	case "dns":
+		re = p.Policy.dnsNameRegex
+	case "ip":
+		re = p.Policy.ipRegex
+	}
+	if re != nil && !re.MatchString(value) {
+		return errors.Errorf("%s identifier %s does not match the provisioner policy %s", typ, value, re)
+	}
+	return nil
+}
+
 // DefaultTLSCertDuration returns the default TLS cert duration enforced by
-// the provisioner.
+// the provisioner. If tlsCertDurationJitter is set, the duration is randomly
+// shortened or extended on every call; the ACME orders always request a
+// notAfter, so the jitter must be applied when the order is created and not by
+// the sign options.
 func (p *ACME) DefaultTLSCertDuration() time.Duration {
-	return p.claimer.DefaultTLSCertDuration()
+	d := p.claimer.DefaultTLSCertDuration()
+	if jitter := p.claimer.TLSCertDurationJitter(); jitter > 0 {
+		return jitterDuration(d, jitter, p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration())
+	}
+	return d
+}
+
+// MinTLSCertDuration returns the minimum TLS cert duration enforced by the
+// provisioner.
+func (p *ACME) MinTLSCertDuration() time.Duration {
+	return p.claimer.MinTLSCertDuration()
+}
+
+// MaxTLSCertDuration returns the maximum TLS cert duration enforced by the
+// provisioner.
+func (p *ACME) MaxTLSCertDuration() time.Duration {
+	return p.claimer.MaxTLSCertDuration()
 }
 
-// Init initializes and validates the fields of a JWK type.
+// Init initializes and validates the fields of a JWK type. Once the type and
+// name are validated, all the errors found in the configuration are returned
+// together in an errs.MultiError.
 func (p *ACME) Init(config Config) (err error) {
 	switch {
 	case p.Type == "":
@@ -76,27 +630,232 @@ func (p *ACME) Init(config Config) (err error) {
 		return errors.New("provisioner name cannot be empty")
 	}
 
+	var merr errs.MultiError
+	if p.Issuer != nil && p.Issuer.Certificate == "" {
+		merr.Append(errors.New("provisioner issuer crt cannot be empty"))
+	}
+	if p.Issuer != nil && p.Issuer.Key == "" {
+		merr.Append(errors.New("provisioner issuer key cannot be empty"))
+	}
+	if p.ChallengeRetryAfter != nil && p.ChallengeRetryAfter.Duration < 0 {
+		merr.Append(errors.New("provisioner challengeRetryAfter cannot be negative"))
+	}
+	if p.OrderRetryAfter != nil && p.OrderRetryAfter.Duration < 0 {
+		merr.Append(errors.New("provisioner orderRetryAfter cannot be negative"))
+	}
+	if p.AuthzReuseAge != nil && p.AuthzReuseAge.Duration < 0 {
+		merr.Append(errors.New("provisioner authzReuseAge cannot be negative"))
+	}
+	if p.ChallengeHistorySize < 0 {
+		merr.Append(errors.New("provisioner challengeHistorySize cannot be negative"))
+	}
+	if p.MaxOrdersPerAccount < 0 {
+		merr.Append(errors.New("provisioner maxOrdersPerAccount cannot be negative"))
+	}
+	if p.MaxConcurrentValidations < 0 {
+		merr.Append(errors.New("provisioner maxConcurrentValidations cannot be negative"))
+	}
+	if p.AuthorizationsPageSize < 0 {
+		merr.Append(errors.New("provisioner authorizationsPageSize cannot be negative"))
+	}
+	if p.MaxContacts < 0 {
+		merr.Append(errors.New("provisioner maxContacts cannot be negative"))
+	}
+	for _, id := range p.CAAIdentities {
+		if id == "" || strings.ContainsAny(id, " /:@*") {
+			merr.Append(errors.Errorf("invalid hostname %q in provisioner caaIdentities", id))
+		}
+	}
+	if p.Website != "" {
+		if u, err := url.Parse(p.Website); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			merr.Append(errors.Errorf("invalid provisioner website %q, it must be an absolute http or https URL", p.Website))
+		}
+	}
+	keys := make([]string, 0, len(p.DirectoryMeta))
+	for key := range p.DirectoryMeta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if i := strings.Index(key, ":"); i <= 0 || i == len(key)-1 || strings.ContainsAny(key, " \t\r\n") {
+			merr.Append(errors.Errorf("invalid key %q in provisioner directoryMeta, it must be namespaced, e.g. myorg:profileURL", key))
+		}
+	}
+
+	switch p.ValidityPolicy {
+	case "", ACMEValidityPolicyReject, ACMEValidityPolicyClamp:
+	default:
+		merr.Append(errors.Errorf("unsupported validity policy %s", p.ValidityPolicy))
+	}
+
+	switch p.MustStaple {
+	case "", ACMEMustStapleIgnore, ACMEMustStapleAllow, ACMEMustStapleForbid:
+	default:
+		merr.Append(errors.Errorf("unsupported mustStaple policy %s", p.MustStaple))
+	}
+
+	switch p.CommonNamePolicy {
+	case "", ACMECommonNamePolicyAllow, ACMECommonNamePolicyReject, ACMECommonNamePolicyStrip:
+	default:
+		merr.Append(errors.Errorf("unsupported commonNamePolicy %s", p.CommonNamePolicy))
+	}
+
+	switch p.MixedWildcardPolicy {
+	case "", ACMEMixedWildcardPolicyAllow, ACMEMixedWildcardPolicyWarn, ACMEMixedWildcardPolicyReject:
+	default:
+		merr.Append(errors.Errorf("unsupported mixedWildcardPolicy %s", p.MixedWildcardPolicy))
+	}
+
+	if err := p.Options.GetX509Options().Validate(); err != nil {
+		merr.Append(err)
+	}
+
+	if p.Policy != nil {
+		merr.Append(p.Policy.init())
+	}
+
+	for _, crv := range p.AllowedCurves {
+		if !acmeAllowedCurves[crv] {
+			merr.Append(errors.Errorf("unsupported curve %s in provisioner allowedCurves", crv))
+		}
+	}
+
+	for _, alg := range p.AllowedAlgorithms {
+		if !acmeAllowedAlgorithms[alg] {
+			merr.Append(errors.Errorf("unsupported algorithm %s in provisioner allowedAlgorithms", alg))
+		}
+	}
+
+	for typ, challenges := range p.Challenges {
+		merr.Append(validateACMEChallenges(typ, challenges))
+	}
+
+	for _, typ := range p.IdentifierTypes {
+		if _, ok := acmeAllowedChallenges[typ]; !ok {
+			merr.Append(errors.Errorf("unsupported identifier type %s in provisioner identifierTypes", typ))
+		}
+	}
+
+	// The headers are sent in plain text to the hosts being validated, see
+	// the HTTP01Headers documentation.
+	for name, value := range p.HTTP01Headers {
+		switch {
+		case !httpguts.ValidHeaderFieldName(name):
+			merr.Append(errors.Errorf("invalid header name %q in provisioner http01Headers", name))
+		case acmeReservedHTTP01Headers[http.CanonicalHeaderKey(name)]:
+			merr.Append(errors.Errorf("header %s cannot be set in provisioner http01Headers", name))
+		case !httpguts.ValidHeaderFieldValue(value):
+			merr.Append(errors.Errorf("invalid value for header %s in provisioner http01Headers", name))
+		}
+	}
+
+	switch {
+	case p.RequireKeyAttestation && p.EnableServerKeyGeneration:
+		merr.Append(errors.New("provisioner requireKeyAttestation cannot be used with enableServerKeyGeneration"))
+	case p.RequireKeyAttestation && len(p.KeyAttestationRoots) == 0:
+		merr.Append(errors.New("provisioner keyAttestationRoots cannot be empty if requireKeyAttestation is set"))
+	case !p.RequireKeyAttestation && len(p.KeyAttestationRoots) > 0:
+		merr.Append(errors.New("provisioner keyAttestationRoots requires requireKeyAttestation"))
+	case p.RequireKeyAttestation:
+		merr.Append(p.initKeyAttestationRoots())
+	}
+
 	// Update claims with global ones
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
-		return err
+		merr.Append(err)
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// validateACMEChallenges checks the challenges configured for the given
+// identifier type.
+func validateACMEChallenges(typ string, challenges []string) error {
+	allowed, ok := acmeAllowedChallenges[typ]
+	if !ok {
+		return errors.Errorf("unsupported identifier type %s in provisioner challenges", typ)
+	}
+	if len(challenges) == 0 {
+		return errors.Errorf("provisioner challenges for %s identifiers cannot be empty", typ)
+	}
+	var merr errs.MultiError
+	seen := make(map[string]bool, len(challenges))
+	for _, ch := range challenges {
+		if !allowed[ch] {
+			merr.Append(errors.Errorf("unsupported challenge %s for %s identifiers in provisioner challenges", ch, typ))
+		} else if seen[ch] {
+			merr.Append(errors.Errorf("duplicated challenge %s for %s identifiers in provisioner challenges", ch, typ))
+		}
+		seen[ch] = true
+	}
+	return merr.ErrorOrNil()
+}
+
+// initKeyAttestationRoots parses the PEM encoded KeyAttestationRoots.
+func (p *ACME) initKeyAttestationRoots() error {
+	p.keyAttestationRoots = x509.NewCertPool()
+	rest := p.KeyAttestationRoots
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "error parsing provisioner keyAttestationRoots")
+		}
+		p.keyAttestationRoots.AddCert(cert)
 	}
+	if len(p.keyAttestationRoots.Subjects()) == 0 {
+		return errors.Errorf("no x509 certificates found in keyAttestationRoots for provisioner '%s'", p.GetName())
+	}
+	return nil
+}
+
+// acmeAccountIDKey is the key used to store the ACME account id in the
+// context.
+type acmeAccountIDKey struct{}
+
+// NewContextWithACMEAccountID returns a copy of ctx with the id of the ACME
+// account that requests a certificate.
+func NewContextWithACMEAccountID(ctx context.Context, accountID string) context.Context {
+	return context.WithValue(ctx, acmeAccountIDKey{}, accountID)
+}
 
-	return err
+// ACMEAccountIDFromContext returns the ACME account id stored in ctx.
+func ACMEAccountIDFromContext(ctx context.Context) (string, bool) {
+	accountID, ok := ctx.Value(acmeAccountIDKey{}).(string)
+	return accountID, ok && accountID != ""
 }
 
 // AuthorizeSign does not do any validation, because all validation is handled
 // in the ACME protocol. This method returns a list of modifiers / constraints
 // on the resulting certificate.
 func (p *ACME) AuthorizeSign(ctx context.Context, token string) ([]SignOption, error) {
-	return []SignOption{
+	var keyValuePairs []string
+	if accountID, ok := ACMEAccountIDFromContext(ctx); ok && p.IncludeAccountID {
+		keyValuePairs = []string{"AccountID", accountID}
+	}
+	opts := []SignOption{
 		// modifiers / withOptions
-		newProvisionerExtensionOption(TypeACME, p.Name, ""),
+		newProvisionerExtensionOption(TypeACME, p.Name, "", keyValuePairs...),
 		newForceCNOption(p.ForceCN),
-		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
+		newDefaultDurationOption(p.claimer),
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	}, nil
+	}
+	switch p.GetMustStaple() {
+	case ACMEMustStapleAllow:
+		v := &mustStapleValidator{}
+		opts = append(opts, v, mustStapleModifier{v})
+	case ACMEMustStapleForbid:
+		opts = append(opts, &mustStapleValidator{forbid: true})
+	}
+	if p.Issuer != nil {
+		opts = append(opts, IssuerOption{ProvisionerID: p.GetID()})
+	}
+	return withX509Options(p.Options, opts)
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
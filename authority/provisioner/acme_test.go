@@ -3,13 +3,19 @@ package provisioner
 import (
 	"context"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	mathrand "math/rand"
 	"net/http"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
 	"github.com/smallstep/certificates/errs"
+	"go.step.sm/crypto/keyutil"
 )
 
 func TestACME_Getters(t *testing.T) {
@@ -32,6 +38,280 @@ func TestACME_Getters(t *testing.T) {
 	}
 }
 
+func TestACME_GetMaxPendingAuthz(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxPendingAuthz int
+		want            int
+	}{
+		{"default", 0, DefaultACMEMaxPendingAuthz},
+		{"configured", 10, 10},
+		{"disabled", -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ACME{MaxPendingAuthz: tt.maxPendingAuthz}
+			if got := p.GetMaxPendingAuthz(); got != tt.want {
+				t.Errorf("ACME.GetMaxPendingAuthz() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACME_GetValidityPolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		validityPolicy string
+		want           string
+	}{
+		{"default", "", ACMEValidityPolicyReject},
+		{"reject", ACMEValidityPolicyReject, ACMEValidityPolicyReject},
+		{"clamp", ACMEValidityPolicyClamp, ACMEValidityPolicyClamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ACME{ValidityPolicy: tt.validityPolicy}
+			if got := p.GetValidityPolicy(); got != tt.want {
+				t.Errorf("ACME.GetValidityPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACME_GetMustStaple(t *testing.T) {
+	tests := []struct {
+		name       string
+		mustStaple string
+		want       string
+	}{
+		{"default", "", ACMEMustStapleIgnore},
+		{"ignore", ACMEMustStapleIgnore, ACMEMustStapleIgnore},
+		{"allow", ACMEMustStapleAllow, ACMEMustStapleAllow},
+		{"forbid", ACMEMustStapleForbid, ACMEMustStapleForbid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ACME{MustStaple: tt.mustStaple}
+			if got := p.GetMustStaple(); got != tt.want {
+				t.Errorf("ACME.GetMustStaple() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACME_GetRetryAfter(t *testing.T) {
+	tests := []struct {
+		name                string
+		challengeRetryAfter *Duration
+		orderRetryAfter     *Duration
+		wantChallenge       time.Duration
+		wantOrder           time.Duration
+	}{
+		{"default", nil, nil, DefaultACMEChallengeRetryAfter, DefaultACMEOrderRetryAfter},
+		{"configured", &Duration{10 * time.Second}, &Duration{time.Second}, 10 * time.Second, time.Second},
+		{"disabled", &Duration{0}, &Duration{0}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ACME{ChallengeRetryAfter: tt.challengeRetryAfter, OrderRetryAfter: tt.orderRetryAfter}
+			if got := p.GetChallengeRetryAfter(); got != tt.wantChallenge {
+				t.Errorf("ACME.GetChallengeRetryAfter() = %v, want %v", got, tt.wantChallenge)
+			}
+			if got := p.GetOrderRetryAfter(); got != tt.wantOrder {
+				t.Errorf("ACME.GetOrderRetryAfter() = %v, want %v", got, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestACME_IsKeyRolloverDisabled(t *testing.T) {
+	p := &ACME{}
+	if p.IsKeyRolloverDisabled() {
+		t.Errorf("ACME.IsKeyRolloverDisabled() = true, want false")
+	}
+	p.DisableKeyRollover = true
+	if !p.IsKeyRolloverDisabled() {
+		t.Errorf("ACME.IsKeyRolloverDisabled() = false, want true")
+	}
+}
+
+func TestACME_AuthorizeSign_accountIDExtension(t *testing.T) {
+	p, err := generateACME()
+	assert.FatalError(t, err)
+	p.IncludeAccountID = true
+	ctx := NewContextWithACMEAccountID(context.Background(), "accID")
+	opts, err := p.AuthorizeSign(ctx, "")
+	assert.FatalError(t, err)
+
+	cert := new(x509.Certificate)
+	for _, o := range opts {
+		if m, ok := o.(CertificateModifier); ok {
+			assert.FatalError(t, m.Modify(cert, SignOptions{}))
+		}
+	}
+	if assert.Len(t, 1, cert.ExtraExtensions) {
+		ext := cert.ExtraExtensions[0]
+		assert.Equals(t, ext.Id, stepOIDProvisioner)
+		assert.False(t, ext.Critical)
+		var v stepProvisionerASN1
+		_, err := asn1.Unmarshal(ext.Value, &v)
+		assert.FatalError(t, err)
+		assert.Equals(t, v, stepProvisionerASN1{
+			Type:          int(TypeACME),
+			Name:          []byte(p.GetName()),
+			CredentialID:  []byte{},
+			KeyValuePairs: []string{"AccountID", "accID"},
+		})
+	}
+}
+
+func TestACME_AuthorizeSign_mustStaple(t *testing.T) {
+	pub, _, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	mustStaple := pkix.Extension{Id: oidTLSFeature, Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05}}
+	csr := &x509.CertificateRequest{PublicKey: pub, Extensions: []pkix.Extension{mustStaple}}
+
+	// sign applies the options in the same order as the authority.
+	sign := func(p *ACME, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+		opts, err := p.AuthorizeSign(context.Background(), "")
+		assert.FatalError(t, err)
+		cert := new(x509.Certificate)
+		var modifiers []CertificateModifier
+		for _, o := range opts {
+			switch k := o.(type) {
+			case CertificateRequestValidator:
+				if err := k.Valid(csr); err != nil {
+					return nil, err
+				}
+			case CertificateModifier:
+				modifiers = append(modifiers, k)
+			}
+		}
+		for _, m := range modifiers {
+			assert.FatalError(t, m.Modify(cert, SignOptions{}))
+		}
+		return cert, nil
+	}
+	hasMustStaple := func(cert *x509.Certificate) bool {
+		for _, ext := range cert.ExtraExtensions {
+			if ext.Id.Equal(oidTLSFeature) {
+				assert.Equals(t, ext, mustStaple)
+				return true
+			}
+		}
+		return false
+	}
+
+	p, err := generateACME()
+	assert.FatalError(t, err)
+
+	// The extension is dropped by default.
+	cert, err := sign(p, csr)
+	assert.FatalError(t, err)
+	assert.False(t, hasMustStaple(cert))
+
+	p.MustStaple = ACMEMustStapleAllow
+	cert, err = sign(p, csr)
+	assert.FatalError(t, err)
+	assert.True(t, hasMustStaple(cert))
+	cert, err = sign(p, &x509.CertificateRequest{PublicKey: pub})
+	assert.FatalError(t, err)
+	assert.False(t, hasMustStaple(cert))
+
+	p.MustStaple = ACMEMustStapleForbid
+	_, err = sign(p, csr)
+	if assert.NotNil(t, err) {
+		sc, ok := err.(errs.StatusCoder)
+		assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+		assert.Equals(t, sc.StatusCode(), http.StatusForbidden)
+		assert.Equals(t, err.Error(), "certificate request cannot require OCSP must-staple")
+	}
+	cert, err = sign(p, &x509.CertificateRequest{PublicKey: pub})
+	assert.FatalError(t, err)
+	assert.False(t, hasMustStaple(cert))
+}
+
+func TestACME_IsEnabled(t *testing.T) {
+	enabled, disabled := true, false
+	p := &ACME{}
+	assert.True(t, p.IsEnabled())
+	p.Enabled = &enabled
+	assert.True(t, p.IsEnabled())
+	p.Enabled = &disabled
+	assert.False(t, p.IsEnabled())
+}
+
+func TestACME_DefaultTLSCertDuration(t *testing.T) {
+	tmp := durationJitterInt63n
+	t.Cleanup(func() {
+		durationJitterInt63n = tmp
+	})
+	durationJitterInt63n = mathrand.New(mathrand.NewSource(1)).Int63n
+
+	claimer, err := NewClaimer(nil, globalProvisionerClaims)
+	assert.FatalError(t, err)
+	p := &ACME{claimer: claimer}
+	assert.Equals(t, p.DefaultTLSCertDuration(), 24*time.Hour)
+
+	// The order notAfter is computed with the jitter, never above the max
+	// duration.
+	jitter := 10
+	p.claimer, err = NewClaimer(&Claims{TLSDurJitter: &jitter}, globalProvisionerClaims)
+	assert.FatalError(t, err)
+	var jittered bool
+	for i := 0; i < 100; i++ {
+		d := p.DefaultTLSCertDuration()
+		assert.True(t, d >= 24*time.Hour-144*time.Minute, fmt.Sprintf("duration %s is too short", d))
+		assert.True(t, d <= 24*time.Hour, fmt.Sprintf("duration %s is too long", d))
+		if d != 24*time.Hour {
+			jittered = true
+		}
+	}
+	assert.True(t, jittered)
+}
+
+func TestACME_GetMaxOrdersPerAccount(t *testing.T) {
+	p := &ACME{}
+	assert.Equals(t, p.GetMaxOrdersPerAccount(), 0)
+	p.MaxOrdersPerAccount = 100
+	assert.Equals(t, p.GetMaxOrdersPerAccount(), 100)
+}
+
+func TestACME_GetMaxConcurrentValidations(t *testing.T) {
+	p := &ACME{}
+	assert.Equals(t, p.GetMaxConcurrentValidations(), 0)
+	p.MaxConcurrentValidations = 10
+	assert.Equals(t, p.GetMaxConcurrentValidations(), 10)
+}
+
+func TestACME_GetAuthorizationsPageSize(t *testing.T) {
+	p := &ACME{}
+	assert.Equals(t, p.GetAuthorizationsPageSize(), 0)
+	p.AuthorizationsPageSize = 50
+	assert.Equals(t, p.GetAuthorizationsPageSize(), 50)
+}
+
+func TestACME_GetHTTP01Headers(t *testing.T) {
+	p := &ACME{}
+	assert.Nil(t, p.GetHTTP01Headers())
+	p.HTTP01Headers = map[string]string{"x-validation-secret": "foo"}
+	assert.Equals(t, p.GetHTTP01Headers(), http.Header{"X-Validation-Secret": {"foo"}})
+}
+
+func TestACME_GetKeyAttestationRoots(t *testing.T) {
+	roots, err := os.ReadFile("./testdata/certs/root_ca.crt")
+	assert.FatalError(t, err)
+	p := &ACME{Name: "foo", Type: "bar"}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims, Audiences: testAudiences}))
+	assert.Nil(t, p.GetKeyAttestationRoots())
+
+	p = &ACME{Name: "foo", Type: "bar", RequireKeyAttestation: true, KeyAttestationRoots: roots}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims, Audiences: testAudiences}))
+	if assert.NotNil(t, p.GetKeyAttestationRoots()) {
+		assert.Len(t, 1, p.GetKeyAttestationRoots().Subjects())
+	}
+}
+
 func TestACME_Init(t *testing.T) {
 	type ProvisionerValidateTest struct {
 		p   *ACME
@@ -64,11 +344,287 @@ func TestACME_Init(t *testing.T) {
 				err: errors.New("claims: MinTLSCertDuration must be greater than 0"),
 			}
 		},
+		"fail-bad-validity-policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", ValidityPolicy: "ignore"},
+				err: errors.New("unsupported validity policy ignore"),
+			}
+		},
+		"fail-bad-must-staple": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", MustStaple: "require"},
+				err: errors.New("unsupported mustStaple policy require"),
+			}
+		},
+		"fail-negative-challenge-retry-after": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", ChallengeRetryAfter: &Duration{-time.Second}},
+				err: errors.New("provisioner challengeRetryAfter cannot be negative"),
+			}
+		},
+		"fail-negative-order-retry-after": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", OrderRetryAfter: &Duration{-time.Second}},
+				err: errors.New("provisioner orderRetryAfter cannot be negative"),
+			}
+		},
+		"fail-negative-authz-reuse-age": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", AuthzReuseAge: &Duration{-time.Second}},
+				err: errors.New("provisioner authzReuseAge cannot be negative"),
+			}
+		},
+		"fail-negative-challenge-history-size": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", ChallengeHistorySize: -1},
+				err: errors.New("provisioner challengeHistorySize cannot be negative"),
+			}
+		},
+		"fail-unsupported-allowed-curve": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", AllowedCurves: []string{"P-256", "P-224"}},
+				err: errors.New("unsupported curve P-224 in provisioner allowedCurves"),
+			}
+		},
+		"fail-unsupported-allowed-algorithm": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", AllowedAlgorithms: []string{"ES256", "HS256"}},
+				err: errors.New("unsupported algorithm HS256 in provisioner allowedAlgorithms"),
+			}
+		},
+		"fail-unsupported-challenges-identifier-type": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Challenges: map[string][]string{"email": {"http-01"}}},
+				err: errors.New("unsupported identifier type email in provisioner challenges"),
+			}
+		},
+		"fail-unsupported-identifier-type": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", IdentifierTypes: []string{"dns", "email"}},
+				err: errors.New("unsupported identifier type email in provisioner identifierTypes"),
+			}
+		},
+		"fail-empty-challenges": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Challenges: map[string][]string{"dns": {}}},
+				err: errors.New("provisioner challenges for dns identifiers cannot be empty"),
+			}
+		},
+		"fail-unsupported-challenge": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Challenges: map[string][]string{"ip": {"http-01", "dns-01"}}},
+				err: errors.New("unsupported challenge dns-01 for ip identifiers in provisioner challenges"),
+			}
+		},
+		"fail-duplicated-challenge": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Challenges: map[string][]string{"dns": {"dns-01", "dns-01"}}},
+				err: errors.New("duplicated challenge dns-01 for dns identifiers in provisioner challenges"),
+			}
+		},
+		"fail-invalid-http01-header-name": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", HTTP01Headers: map[string]string{"X Secret": "foo"}},
+				err: errors.New(`invalid header name "X Secret" in provisioner http01Headers`),
+			}
+		},
+		"fail-reserved-http01-header": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", HTTP01Headers: map[string]string{"host": "internal.example.com"}},
+				err: errors.New("header host cannot be set in provisioner http01Headers"),
+			}
+		},
+		"fail-invalid-http01-header-value": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", HTTP01Headers: map[string]string{"X-Secret": "foo\r\nX-Other: bar"}},
+				err: errors.New("invalid value for header X-Secret in provisioner http01Headers"),
+			}
+		},
+		"fail-negative-max-orders-per-account": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", MaxOrdersPerAccount: -1},
+				err: errors.New("provisioner maxOrdersPerAccount cannot be negative"),
+			}
+		},
+		"fail-negative-max-concurrent-validations": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", MaxConcurrentValidations: -1},
+				err: errors.New("provisioner maxConcurrentValidations cannot be negative"),
+			}
+		},
+		"fail-negative-authorizations-page-size": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", AuthorizationsPageSize: -1},
+				err: errors.New("provisioner authorizationsPageSize cannot be negative"),
+			}
+		},
+		"fail-negative-max-contacts": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", MaxContacts: -1},
+				err: errors.New("provisioner maxContacts cannot be negative"),
+			}
+		},
+		"fail-common-name-policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", CommonNamePolicy: "ignore"},
+				err: errors.New("unsupported commonNamePolicy ignore"),
+			}
+		},
+		"fail-mixed-wildcard-policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", MixedWildcardPolicy: "deny"},
+				err: errors.New("unsupported mixedWildcardPolicy deny"),
+			}
+		},
+		"fail-directory-meta": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", DirectoryMeta: map[string]string{
+					"myorg:profileURL": "https://example.com/profile",
+					"profileURL":       "https://example.com/profile",
+				}},
+				err: errors.New(`invalid key "profileURL" in provisioner directoryMeta, it must be namespaced, e.g. myorg:profileURL`),
+			}
+		},
+		"fail-directory-meta-empty-name": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", DirectoryMeta: map[string]string{"myorg:": "foo"}},
+				err: errors.New(`invalid key "myorg:" in provisioner directoryMeta, it must be namespaced, e.g. myorg:profileURL`),
+			}
+		},
+		"fail-caa-identities": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", CAAIdentities: []string{"ca.example.com", "https://ca.example.com"}},
+				err: errors.New(`invalid hostname "https://ca.example.com" in provisioner caaIdentities`),
+			}
+		},
+		"fail-website": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Website: "ca.example.com"},
+				err: errors.New(`invalid provisioner website "ca.example.com", it must be an absolute http or https URL`),
+			}
+		},
+		"fail-key-attestation-server-key-generation": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", RequireKeyAttestation: true, EnableServerKeyGeneration: true},
+				err: errors.New("provisioner requireKeyAttestation cannot be used with enableServerKeyGeneration"),
+			}
+		},
+		"fail-key-attestation-empty-roots": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", RequireKeyAttestation: true},
+				err: errors.New("provisioner keyAttestationRoots cannot be empty if requireKeyAttestation is set"),
+			}
+		},
+		"fail-key-attestation-not-required": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", KeyAttestationRoots: []byte("foo")},
+				err: errors.New("provisioner keyAttestationRoots requires requireKeyAttestation"),
+			}
+		},
+		"fail-key-attestation-no-roots": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", RequireKeyAttestation: true, KeyAttestationRoots: []byte("foo")},
+				err: errors.New("no x509 certificates found in keyAttestationRoots for provisioner 'foo'"),
+			}
+		},
+		"fail-bad-policy-dns-name-regex": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Policy: &ACMEPolicy{DNSNameRegex: "["}},
+				err: errors.New("error parsing provisioner policy dnsNameRegex: error parsing regexp: missing closing ]: `[`"),
+			}
+		},
+		"fail-bad-policy-ip-regex": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p:   &ACME{Name: "foo", Type: "bar", Policy: &ACMEPolicy{IPRegex: "(10"}},
+				err: errors.New("error parsing provisioner policy ipRegex: error parsing regexp: missing closing ): `(10`"),
+			}
+		},
+		"fail-multiple-errors": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar",
+					OrderRetryAfter: &Duration{-time.Second},
+					ValidityPolicy:  "ignore",
+					Policy:          &ACMEPolicy{DNSNameRegex: "["},
+					Challenges:      map[string][]string{"ip": {"dns-01"}},
+				},
+				err: errors.New("4 errors occurred:\n" +
+					"\t* provisioner orderRetryAfter cannot be negative\n" +
+					"\t* unsupported validity policy ignore\n" +
+					"\t* error parsing provisioner policy dnsNameRegex: error parsing regexp: missing closing ]: `[`\n" +
+					"\t* unsupported challenge dns-01 for ip identifiers in provisioner challenges"),
+			}
+		},
 		"ok": func(t *testing.T) ProvisionerValidateTest {
 			return ProvisionerValidateTest{
 				p: &ACME{Name: "foo", Type: "bar"},
 			}
 		},
+		"ok/policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", Policy: &ACMEPolicy{
+					DNSNameRegex: `^[a-z0-9-]+\.ci\.example\.com$`,
+					IPRegex:      `^10\.`,
+				}},
+			}
+		},
+		"ok/clamp-validity-policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", ValidityPolicy: ACMEValidityPolicyClamp},
+			}
+		},
+		"ok/allowed-curves": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", AllowedCurves: []string{"P-256", "P-384", "Ed25519"}},
+			}
+		},
+		"ok/allowed-algorithms": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", AllowedAlgorithms: []string{"ES256", "ES384", "RS256", "PS384"}},
+			}
+		},
+		"ok/challenges": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", Challenges: map[string][]string{
+					"dns": {"dns-01", "http-01"},
+					"ip":  {"http-01", "tls-alpn-01"},
+				}},
+			}
+		},
+		"ok/key-attestation": func(t *testing.T) ProvisionerValidateTest {
+			roots, err := os.ReadFile("./testdata/certs/root_ca.crt")
+			assert.FatalError(t, err)
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", RequireKeyAttestation: true, KeyAttestationRoots: roots},
+			}
+		},
+		"ok/http01-headers": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", HTTP01Headers: map[string]string{
+					"X-Validation-Secret": "foo",
+					"Authorization":       "Basic Zm9vOmJhcg==",
+				}},
+			}
+		},
+		"ok/common-name-policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", CommonNamePolicy: ACMECommonNamePolicyStrip},
+			}
+		},
+		"ok/mixed-wildcard-policy": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", MixedWildcardPolicy: ACMEMixedWildcardPolicyReject},
+			}
+		},
+		"ok/directory-meta": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", CAAIdentities: []string{"ca.example.com"}, Website: "https://ca.example.com/docs"},
+			}
+		},
+		"ok/directory-meta-extra": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &ACME{Name: "foo", Type: "bar", DirectoryMeta: map[string]string{"myorg:profileURL": "https://example.com/profile"}},
+			}
+		},
 	}
 
 	config := Config{
@@ -90,6 +646,39 @@ func TestACME_Init(t *testing.T) {
 	}
 }
 
+func TestACME_AuthorizeOrderIdentifier(t *testing.T) {
+	policy := &ACMEPolicy{
+		DNSNameRegex: `^[a-z0-9-]+\.ci\.example\.com$`,
+		IPRegex:      `^10\.`,
+	}
+	p := &ACME{Name: "foo", Type: "bar", Policy: policy}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims, Audiences: testAudiences}))
+
+	tests := []struct {
+		name    string
+		p       *ACME
+		typ     string
+		value   string
+		wantErr bool
+	}{
+		{"ok/no-policy", &ACME{}, "dns", "foo.example.com", false},
+		{"ok/dns", p, "dns", "build-42.ci.example.com", false},
+		{"ok/ip", p, "ip", "10.0.0.1", false},
+		{"ok/other-type", p, "foo", "bar", false},
+		{"fail/dns", p, "dns", "foo.example.com", true},
+		{"fail/dns-subdomain", p, "dns", "a.b.ci.example.com", true},
+		{"fail/dns-wildcard", p, "dns", "*.ci.example.com", true},
+		{"fail/ip", p, "ip", "192.168.0.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.AuthorizeOrderIdentifier(tt.typ, tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("ACME.AuthorizeOrderIdentifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestACME_AuthorizeRenew(t *testing.T) {
 	type test struct {
 		p    *ACME
@@ -141,10 +730,12 @@ func TestACME_AuthorizeRenew(t *testing.T) {
 
 func TestACME_AuthorizeSign(t *testing.T) {
 	type test struct {
-		p     *ACME
-		token string
-		code  int
-		err   error
+		p             *ACME
+		ctx           context.Context
+		token         string
+		keyValuePairs []string
+		code          int
+		err           error
 	}
 	tests := map[string]func(*testing.T) test{
 		"ok": func(t *testing.T) test {
@@ -152,14 +743,42 @@ func TestACME_AuthorizeSign(t *testing.T) {
 			assert.FatalError(t, err)
 			return test{
 				p:     p,
+				ctx:   context.Background(),
 				token: "foo",
 			}
 		},
+		"ok/account-id-disabled": func(t *testing.T) test {
+			p, err := generateACME()
+			assert.FatalError(t, err)
+			return test{
+				p:   p,
+				ctx: NewContextWithACMEAccountID(context.Background(), "accID"),
+			}
+		},
+		"ok/account-id": func(t *testing.T) test {
+			p, err := generateACME()
+			assert.FatalError(t, err)
+			p.IncludeAccountID = true
+			return test{
+				p:             p,
+				ctx:           NewContextWithACMEAccountID(context.Background(), "accID"),
+				keyValuePairs: []string{"AccountID", "accID"},
+			}
+		},
+		"ok/account-id-not-in-context": func(t *testing.T) test {
+			p, err := generateACME()
+			assert.FatalError(t, err)
+			p.IncludeAccountID = true
+			return test{
+				p:   p,
+				ctx: context.Background(),
+			}
+		},
 	}
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			tc := tt(t)
-			if opts, err := tc.p.AuthorizeSign(context.Background(), tc.token); err != nil {
+			if opts, err := tc.p.AuthorizeSign(tc.ctx, tc.token); err != nil {
 				if assert.NotNil(t, tc.err) {
 					sc, ok := err.(errs.StatusCoder)
 					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
@@ -175,7 +794,7 @@ func TestACME_AuthorizeSign(t *testing.T) {
 							assert.Equals(t, v.Type, int(TypeACME))
 							assert.Equals(t, v.Name, tc.p.GetName())
 							assert.Equals(t, v.CredentialID, "")
-							assert.Len(t, 0, v.KeyValuePairs)
+							assert.Equals(t, v.KeyValuePairs, tc.keyValuePairs)
 						case *forceCNOption:
 							assert.Equals(t, v.ForceCN, tc.p.ForceCN)
 						case profileDefaultDuration:
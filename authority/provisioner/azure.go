@@ -204,6 +204,10 @@ func (p *Azure) Init(config Config) (err error) {
 	// Initialize config
 	p.assertConfig()
 
+	if err := p.Options.GetX509Options().Validate(); err != nil {
+		return err
+	}
+
 	// Update claims with global ones
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
 		return err
@@ -320,15 +324,15 @@ func (p *Azure) AuthorizeSign(ctx context.Context, token string) ([]SignOption,
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "aws.AuthorizeSign")
 	}
 
-	return append(so,
+	return withX509Options(p.Options, append(so,
 		templateOptions,
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeAzure, p.Name, p.TenantID),
-		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
+		newDefaultDurationOption(p.claimer),
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	), nil
+	))
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
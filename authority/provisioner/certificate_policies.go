@@ -0,0 +1,168 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	oidExtensionCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidPolicyQualifierCPS           = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1}
+	oidPolicyQualifierUserNotice    = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 2}
+)
+
+// maxExplicitTextLength is the maximum length of the explicit text of a user
+// notice, as defined in RFC 5280.
+const maxExplicitTextLength = 200
+
+// CertificatePolicy is a policy added to the certificate policies extension of
+// the certificates issued by a provisioner. The ID is the policy OID in dotted
+// notation, e.g. "1.3.6.1.4.1.99999.1.1", CPS are the URIs of the
+// certification practice statements, and UserNotice is the text displayed to
+// the relying parties.
+type CertificatePolicy struct {
+	ID         string   `json:"id"`
+	CPS        []string `json:"cps,omitempty"`
+	UserNotice string   `json:"userNotice,omitempty"`
+}
+
+// CertificatePolicies is the list of policies added to the certificate
+// policies extension, in the configured order. The extension replaces any
+// policy set in the certificate template.
+type CertificatePolicies []CertificatePolicy
+
+// Validate checks the syntax of the certificate policies.
+func (p CertificatePolicies) Validate() error {
+	seen := make(map[string]bool, len(p))
+	for _, policy := range p {
+		if _, err := parseOID(policy.ID); err != nil {
+			return errors.Wrapf(err, "invalid certificatePolicies id %q", policy.ID)
+		}
+		if seen[policy.ID] {
+			return errors.Errorf("duplicated certificatePolicies id %s", policy.ID)
+		}
+		seen[policy.ID] = true
+		for _, cps := range policy.CPS {
+			u, err := url.Parse(cps)
+			if err != nil || !u.IsAbs() || u.Host == "" || !isIA5String(cps) {
+				return errors.Errorf("invalid certificatePolicies cps %q for policy %s", cps, policy.ID)
+			}
+		}
+		if n := utf8.RuneCountInString(policy.UserNotice); n > maxExplicitTextLength {
+			return errors.Errorf("certificatePolicies userNotice for policy %s cannot be longer than %d characters", policy.ID, maxExplicitTextLength)
+		}
+	}
+	return nil
+}
+
+// policyInformation is the ASN.1 structure of a PolicyInformation, defined in
+// RFC 5280, section 4.2.1.4.
+type policyInformation struct {
+	PolicyIdentifier asn1.ObjectIdentifier
+	PolicyQualifiers []policyQualifierInfo `asn1:"optional,omitempty"`
+}
+
+type policyQualifierInfo struct {
+	PolicyQualifierID asn1.ObjectIdentifier
+	Qualifier         asn1.RawValue
+}
+
+type userNotice struct {
+	ExplicitText string `asn1:"utf8"`
+}
+
+// Extension returns the certificate policies extension.
+func (p CertificatePolicies) Extension() (pkix.Extension, error) {
+	policies := make([]policyInformation, len(p))
+	for i, policy := range p {
+		oid, err := parseOID(policy.ID)
+		if err != nil {
+			return pkix.Extension{}, errors.Wrapf(err, "invalid certificatePolicies id %q", policy.ID)
+		}
+		policies[i].PolicyIdentifier = oid
+		for _, cps := range policy.CPS {
+			b, err := asn1.MarshalWithParams(cps, "ia5")
+			if err != nil {
+				return pkix.Extension{}, errors.Wrapf(err, "error marshaling certificatePolicies cps %q", cps)
+			}
+			policies[i].PolicyQualifiers = append(policies[i].PolicyQualifiers, policyQualifierInfo{
+				PolicyQualifierID: oidPolicyQualifierCPS,
+				Qualifier:         asn1.RawValue{FullBytes: b},
+			})
+		}
+		if policy.UserNotice != "" {
+			b, err := asn1.Marshal(userNotice{ExplicitText: policy.UserNotice})
+			if err != nil {
+				return pkix.Extension{}, errors.Wrap(err, "error marshaling certificatePolicies userNotice")
+			}
+			policies[i].PolicyQualifiers = append(policies[i].PolicyQualifiers, policyQualifierInfo{
+				PolicyQualifierID: oidPolicyQualifierUserNotice,
+				Qualifier:         asn1.RawValue{FullBytes: b},
+			})
+		}
+	}
+	b, err := asn1.Marshal(policies)
+	if err != nil {
+		return pkix.Extension{}, errors.Wrap(err, "error marshaling certificatePolicies")
+	}
+	return pkix.Extension{Id: oidExtensionCertificatePolicies, Value: b}, nil
+}
+
+// certificatePoliciesEnforcer replaces the certificate policies of the
+// certificate with the configured ones.
+type certificatePoliciesEnforcer CertificatePolicies
+
+func (e certificatePoliciesEnforcer) Enforce(cert *x509.Certificate) error {
+	ext, err := CertificatePolicies(e).Extension()
+	if err != nil {
+		return err
+	}
+	extensions := make([]pkix.Extension, 0, len(cert.ExtraExtensions)+1)
+	for _, x := range cert.ExtraExtensions {
+		if !x.Id.Equal(oidExtensionCertificatePolicies) {
+			extensions = append(extensions, x)
+		}
+	}
+	cert.PolicyIdentifiers = nil
+	cert.ExtraExtensions = append(extensions, ext)
+	return nil
+}
+
+// parseOID parses an object identifier in dotted notation.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, errors.New("object identifiers must have at least two components")
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part != strconv.Itoa(n) {
+			return nil, errors.Errorf("invalid component %q", part)
+		}
+		oid[i] = n
+	}
+	switch {
+	case oid[0] > 2:
+		return nil, errors.New("the first component must be 0, 1 or 2")
+	case oid[0] < 2 && oid[1] > 39:
+		return nil, errors.New("the second component must be less than 40")
+	}
+	return oid, nil
+}
+
+func isIA5String(s string) bool {
+	for _, r := range s {
+		if r > 127 {
+			return false
+		}
+	}
+	return true
+}
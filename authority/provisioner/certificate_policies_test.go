@@ -0,0 +1,140 @@
+package provisioner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func TestCertificatePolicies_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies CertificatePolicies
+		wantErr  string
+	}{
+		{"ok/nil", nil, ""},
+		{"ok", CertificatePolicies{
+			{ID: "1.3.6.1.4.1.99999.1.1", CPS: []string{"https://example.com/cps"}, UserNotice: "Our policy"},
+			{ID: "2.23.140.1.2.1"},
+		}, ""},
+		{"fail/empty-id", CertificatePolicies{{}}, `invalid certificatePolicies id "": object identifiers must have at least two components`},
+		{"fail/one-component", CertificatePolicies{{ID: "1"}}, `invalid certificatePolicies id "1": object identifiers must have at least two components`},
+		{"fail/invalid-component", CertificatePolicies{{ID: "1.3.a"}}, `invalid certificatePolicies id "1.3.a": invalid component "a"`},
+		{"fail/empty-component", CertificatePolicies{{ID: "1..3"}}, `invalid certificatePolicies id "1..3": invalid component ""`},
+		{"fail/leading-zero", CertificatePolicies{{ID: "1.03"}}, `invalid certificatePolicies id "1.03": invalid component "03"`},
+		{"fail/negative-component", CertificatePolicies{{ID: "1.3.-1"}}, `invalid certificatePolicies id "1.3.-1": invalid component "-1"`},
+		{"fail/first-component", CertificatePolicies{{ID: "3.1"}}, `invalid certificatePolicies id "3.1": the first component must be 0, 1 or 2`},
+		{"fail/second-component", CertificatePolicies{{ID: "1.40"}}, `invalid certificatePolicies id "1.40": the second component must be less than 40`},
+		{"fail/duplicated", CertificatePolicies{{ID: "2.5.29.32.0"}, {ID: "2.5.29.32.0"}}, "duplicated certificatePolicies id 2.5.29.32.0"},
+		{"fail/relative-cps", CertificatePolicies{{ID: "2.5.29.32.0", CPS: []string{"/cps"}}},
+			`invalid certificatePolicies cps "/cps" for policy 2.5.29.32.0`},
+		{"fail/non-ascii-cps", CertificatePolicies{{ID: "2.5.29.32.0", CPS: []string{"https://example.com/política"}}},
+			`invalid certificatePolicies cps "https://example.com/política" for policy 2.5.29.32.0`},
+		{"fail/user-notice-too-long", CertificatePolicies{{ID: "2.5.29.32.0", UserNotice: strings.Repeat("a", 201)}},
+			"certificatePolicies userNotice for policy 2.5.29.32.0 cannot be longer than 200 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policies.Validate()
+			if tt.wantErr == "" {
+				assert.FatalError(t, err)
+			} else if assert.NotNil(t, err) {
+				assert.Equals(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestX509Options_Validate_certificatePolicies(t *testing.T) {
+	assert.FatalError(t, (&X509Options{CertificatePolicies: CertificatePolicies{{ID: "2.5.29.32.0"}}}).Validate())
+	assert.NotNil(t, (&X509Options{CertificatePolicies: CertificatePolicies{{ID: "foo"}}}).Validate())
+}
+
+func Test_certificatePoliciesEnforcer_Enforce(t *testing.T) {
+	policies := CertificatePolicies{
+		{ID: "1.3.6.1.4.1.99999.1.1", CPS: []string{"https://example.com/cps", "http://example.com/cps"}, UserNotice: "Issued under our policy"},
+		{ID: "2.23.140.1.2.1"},
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:      big.NewInt(1),
+		Subject:           pkix.Name{CommonName: "test"},
+		NotBefore:         time.Now(),
+		NotAfter:          time.Now().Add(time.Hour),
+		PolicyIdentifiers: []asn1.ObjectIdentifier{{1, 2, 3}},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidExtensionCertificatePolicies, Value: []byte{0x30, 0x00}},
+			{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte{0x05, 0x00}},
+		},
+	}
+	assert.FatalError(t, certificatePoliciesEnforcer(policies).Enforce(template))
+	b, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	cert, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+
+	// The policies in the template are replaced, and the other extensions
+	// are kept.
+	var values [][]byte
+	var other bool
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidExtensionCertificatePolicies):
+			values = append(values, ext.Value)
+		case ext.Id.Equal(asn1.ObjectIdentifier{1, 2, 3, 4}):
+			other = true
+		}
+	}
+	assert.True(t, other)
+	assert.Len(t, 1, values)
+	assert.Equals(t, cert.PolicyIdentifiers, []asn1.ObjectIdentifier{
+		{1, 3, 6, 1, 4, 1, 99999, 1, 1}, {2, 23, 140, 1, 2, 1},
+	})
+
+	// certificatePolicies ::= SEQUENCE SIZE (1..MAX) OF PolicyInformation
+	var infos []struct {
+		PolicyIdentifier asn1.ObjectIdentifier
+		PolicyQualifiers []struct {
+			PolicyQualifierID asn1.ObjectIdentifier
+			Qualifier         asn1.RawValue
+		} `asn1:"optional"`
+	}
+	rest, err := asn1.Unmarshal(values[0], &infos)
+	assert.FatalError(t, err)
+	assert.Len(t, 0, rest)
+	assert.Len(t, 2, infos)
+
+	q := infos[0].PolicyQualifiers
+	assert.Len(t, 3, q)
+	for i, want := range []string{"https://example.com/cps", "http://example.com/cps"} {
+		// CPSuri ::= IA5String
+		assert.Equals(t, q[i].PolicyQualifierID, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 1})
+		assert.Equals(t, q[i].Qualifier.Class, asn1.ClassUniversal)
+		assert.Equals(t, q[i].Qualifier.Tag, asn1.TagIA5String)
+		assert.Equals(t, string(q[i].Qualifier.Bytes), want)
+	}
+	// UserNotice ::= SEQUENCE { explicitText DisplayText OPTIONAL }
+	assert.Equals(t, q[2].PolicyQualifierID, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 2, 2})
+	assert.Equals(t, q[2].Qualifier.Tag, asn1.TagSequence)
+	var explicitText asn1.RawValue
+	rest, err = asn1.Unmarshal(q[2].Qualifier.Bytes, &explicitText)
+	assert.FatalError(t, err)
+	assert.Len(t, 0, rest)
+	assert.Equals(t, explicitText.Tag, asn1.TagUTF8String)
+	assert.Equals(t, string(explicitText.Bytes), "Issued under our policy")
+
+	// Policies without qualifiers omit the sequence.
+	assert.Len(t, 0, infos[1].PolicyQualifiers)
+	assert.Equals(t, infos[1].PolicyIdentifier, asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1})
+}
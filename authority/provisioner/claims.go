@@ -14,6 +14,7 @@ type Claims struct {
 	MaxTLSDur      *Duration `json:"maxTLSCertDuration,omitempty"`
 	DefaultTLSDur  *Duration `json:"defaultTLSCertDuration,omitempty"`
 	DisableRenewal *bool     `json:"disableRenewal,omitempty"`
+	TLSDurJitter   *int      `json:"tlsCertDurationJitter,omitempty"`
 	// SSH CA properties
 	MinUserSSHDur     *Duration `json:"minUserSSHCertDuration,omitempty"`
 	MaxUserSSHDur     *Duration `json:"maxUserSSHCertDuration,omitempty"`
@@ -41,11 +42,13 @@ func NewClaimer(claims *Claims, global Claims) (*Claimer, error) {
 func (c *Claimer) Claims() Claims {
 	disableRenewal := c.IsDisableRenewal()
 	enableSSHCA := c.IsSSHCAEnabled()
+	jitter := c.TLSCertDurationJitter()
 	return Claims{
 		MinTLSDur:         &Duration{c.MinTLSCertDuration()},
 		MaxTLSDur:         &Duration{c.MaxTLSCertDuration()},
 		DefaultTLSDur:     &Duration{c.DefaultTLSCertDuration()},
 		DisableRenewal:    &disableRenewal,
+		TLSDurJitter:      &jitter,
 		MinUserSSHDur:     &Duration{c.MinUserSSHCertDuration()},
 		MaxUserSSHDur:     &Duration{c.MaxUserSSHCertDuration()},
 		DefaultUserSSHDur: &Duration{c.DefaultUserSSHCertDuration()},
@@ -92,6 +95,20 @@ func (c *Claimer) MaxTLSCertDuration() time.Duration {
 	return c.claims.MaxTLSDur.Duration
 }
 
+// TLSCertDurationJitter returns the percentage of the default TLS cert
+// duration used to randomly shorten or extend it, 0 if it's disabled. If the
+// jitter is not set within the provisioner, then the global value from the
+// authority configuration will be used.
+func (c *Claimer) TLSCertDurationJitter() int {
+	if c.claims == nil || c.claims.TLSDurJitter == nil {
+		if c.global.TLSDurJitter == nil {
+			return 0
+		}
+		return *c.global.TLSDurJitter
+	}
+	return *c.claims.TLSDurJitter
+}
+
 // IsDisableRenewal returns if the renewal flow is disabled for the
 // provisioner. If the property is not set within the provisioner, then the
 // global value from the authority configuration will be used.
@@ -202,9 +219,10 @@ func (c *Claimer) IsSSHCAEnabled() bool {
 // Validate validates and modifies the Claims with default values.
 func (c *Claimer) Validate() error {
 	var (
-		min = c.MinTLSCertDuration()
-		max = c.MaxTLSCertDuration()
-		def = c.DefaultTLSCertDuration()
+		min    = c.MinTLSCertDuration()
+		max    = c.MaxTLSCertDuration()
+		def    = c.DefaultTLSCertDuration()
+		jitter = c.TLSCertDurationJitter()
 	)
 	switch {
 	case min <= 0:
@@ -220,6 +238,8 @@ func (c *Claimer) Validate() error {
 		return errors.Errorf("claims: DefaultCertDuration cannot be less than MinCertDuration: DefaultCertDuration - %v, MinCertDuration - %v", def, min)
 	case max < def:
 		return errors.Errorf("claims: MaxCertDuration cannot be less than DefaultCertDuration: MaxCertDuration - %v, DefaultCertDuration - %v", max, def)
+	case jitter < 0 || jitter > MaxTLSCertDurationJitter:
+		return errors.Errorf("claims: TLSCertDurationJitter must be between 0 and %d", MaxTLSCertDurationJitter)
 	default:
 		return nil
 	}
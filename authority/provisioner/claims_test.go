@@ -49,3 +49,30 @@ func TestClaimer_DefaultSSHCertDuration(t *testing.T) {
 		})
 	}
 }
+
+func TestClaimer_TLSCertDurationJitter(t *testing.T) {
+	ten, sixty, negative := 10, 60, -1
+	tests := []struct {
+		name    string
+		claims  *Claims
+		want    int
+		wantErr bool
+	}{
+		{"disabled", nil, 0, false},
+		{"ok", &Claims{TLSDurJitter: &ten}, 10, false},
+		{"fail negative", &Claims{TLSDurJitter: &negative}, -1, true},
+		{"fail too large", &Claims{TLSDurJitter: &sixty}, 60, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewClaimer(tt.claims, globalProvisionerClaims)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewClaimer() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := c.TLSCertDurationJitter(); got != tt.want {
+				t.Errorf("Claimer.TLSCertDurationJitter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
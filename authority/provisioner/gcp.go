@@ -206,6 +206,10 @@ func (p *GCP) Init(config Config) error {
 	}
 	// Initialize config
 	p.assertConfig()
+	if err := p.Options.GetX509Options().Validate(); err != nil {
+		return err
+	}
+
 	// Update claims with global ones
 	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
 		return err
@@ -265,15 +269,15 @@ func (p *GCP) AuthorizeSign(ctx context.Context, token string) ([]SignOption, er
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "gcp.AuthorizeSign")
 	}
 
-	return append(so,
+	return withX509Options(p.Options, append(so,
 		templateOptions,
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeGCP, p.Name, claims.Subject, "InstanceID", ce.InstanceID, "InstanceName", ce.InstanceName),
-		profileDefaultDuration(p.claimer.DefaultTLSCertDuration()),
+		newDefaultDurationOption(p.claimer),
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
-	), nil
+	))
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
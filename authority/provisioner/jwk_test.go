@@ -80,6 +80,22 @@ func TestJWK_Init(t *testing.T) {
 				err: errors.New("claims: MinTLSCertDuration must be greater than 0"),
 			}
 		},
+		"fail-name-constraints": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{}, Options: &Options{
+					X509: &X509Options{NameConstraints: &NameConstraints{PermittedDNSDomains: []string{"example.com"}}},
+				}},
+				err: errors.New("nameConstraints require allowCA"),
+			}
+		},
+		"fail-certificate-policies": func(t *testing.T) ProvisionerValidateTest {
+			return ProvisionerValidateTest{
+				p: &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{}, Options: &Options{
+					X509: &X509Options{CertificatePolicies: CertificatePolicies{{ID: "1"}}},
+				}},
+				err: errors.New(`invalid certificatePolicies id "1": object identifiers must have at least two components`),
+			}
+		},
 		"ok": func(t *testing.T) ProvisionerValidateTest {
 			return ProvisionerValidateTest{
 				p: &JWK{Name: "foo", Type: "bar", Key: &jose.JSONWebKey{}, audiences: testAudiences},
@@ -0,0 +1,187 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/errs"
+	"go.step.sm/crypto/x509util"
+)
+
+// MTLS is the provisioner that authenticates sign requests using the client
+// certificate of the TLS connection. The client certificate must chain up to
+// one of the roots configured in the provisioner, usually the roots of a
+// different PKI, and the new certificate is constrained to the subject and
+// SANs of the client certificate.
+type MTLS struct {
+	*base
+	ID       string   `json:"-"`
+	Type     string   `json:"type"`
+	Name     string   `json:"name"`
+	Roots    []byte   `json:"roots"`
+	Claims   *Claims  `json:"claims,omitempty"`
+	Options  *Options `json:"options,omitempty"`
+	claimer  *Claimer
+	roots    []*x509.Certificate
+	rootPool *x509.CertPool
+}
+
+// GetID returns the provisioner unique identifier. The name should uniquely
+// identify any MTLS provisioner.
+func (p *MTLS) GetID() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.GetIDForToken()
+}
+
+// GetIDForToken returns an identifier that will be used to load the
+// provisioner.
+func (p *MTLS) GetIDForToken() string {
+	return "mtls/" + p.Name
+}
+
+// GetTokenID returns an error, the MTLS provisioner does not use tokens.
+func (p *MTLS) GetTokenID(ott string) (string, error) {
+	return "", errors.New("mtls provisioner does not implement GetTokenID")
+}
+
+// GetName returns the name of the provisioner.
+func (p *MTLS) GetName() string {
+	return p.Name
+}
+
+// GetType returns the type of provisioner.
+func (p *MTLS) GetType() Type {
+	return TypeMTLS
+}
+
+// GetEncryptedKey returns the base provisioner encrypted key if it's defined.
+func (p *MTLS) GetEncryptedKey() (string, string, bool) {
+	return "", "", false
+}
+
+// GetOptions returns the configured provisioner options.
+func (p *MTLS) GetOptions() *Options {
+	return p.Options
+}
+
+// GetRootCertificates returns the roots used to verify the client
+// certificates.
+func (p *MTLS) GetRootCertificates() []*x509.Certificate {
+	return p.roots
+}
+
+// Init initializes and validates the fields of a MTLS type.
+func (p *MTLS) Init(config Config) (err error) {
+	switch {
+	case p.Type == "":
+		return errors.New("provisioner type cannot be empty")
+	case p.Name == "":
+		return errors.New("provisioner name cannot be empty")
+	case len(p.Roots) == 0:
+		return errors.New("provisioner root(s) cannot be empty")
+	}
+
+	p.roots = nil
+	p.rootPool = x509.NewCertPool()
+
+	var (
+		block *pem.Block
+		rest  = p.Roots
+	)
+	for rest != nil {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrap(err, "error parsing x509 certificate from PEM block")
+		}
+		p.roots = append(p.roots, cert)
+		p.rootPool.AddCert(cert)
+	}
+
+	// Verify that at least one root was found.
+	if len(p.roots) == 0 {
+		return errors.Errorf("no x509 certificates found in roots attribute for provisioner '%s'", p.GetName())
+	}
+
+	if err := p.Options.GetX509Options().Validate(); err != nil {
+		return err
+	}
+
+	// Update claims with global ones
+	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AuthorizeClientCertificate verifies the client certificate chain of a TLS
+// connection, the leaf first, and returns the list of SignOption for a sign
+// request. The new certificate is constrained to the common name and SANs of
+// the client certificate, and it cannot outlive it.
+func (p *MTLS) AuthorizeClientCertificate(ctx context.Context, chain []*x509.Certificate) ([]SignOption, error) {
+	if len(chain) == 0 {
+		return nil, errs.Unauthorized("mtls.AuthorizeClientCertificate; missing client certificate")
+	}
+
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, crt := range chain[1:] {
+		intermediates.AddCert(crt)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         p.rootPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, errs.Wrap(http.StatusUnauthorized, err,
+			"mtls.AuthorizeClientCertificate; error verifying client certificate chain")
+	}
+
+	sans := make([]string, 0, len(leaf.DNSNames)+len(leaf.IPAddresses)+len(leaf.EmailAddresses)+len(leaf.URIs))
+	sans = append(sans, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, leaf.EmailAddresses...)
+	for _, u := range leaf.URIs {
+		sans = append(sans, u.String())
+	}
+	if leaf.Subject.CommonName == "" && len(sans) == 0 {
+		return nil, errs.Unauthorized("mtls.AuthorizeClientCertificate; client certificate does not contain a subject or SANs")
+	}
+
+	// Certificate templates
+	data := x509util.CreateTemplateData(leaf.Subject.CommonName, sans)
+	templateOptions, err := TemplateOptions(p.Options, data)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "mtls.AuthorizeClientCertificate")
+	}
+
+	return withX509Options(p.Options, []SignOption{
+		templateOptions,
+		// modifiers / withOptions
+		newProvisionerExtensionOption(TypeMTLS, p.Name, ""),
+		profileLimitDuration{p.claimer.DefaultTLSCertDuration(), leaf.NotBefore, leaf.NotAfter},
+		// validators
+		commonNameValidator(leaf.Subject.CommonName),
+		defaultSANsValidator(sans),
+		defaultPublicKeyValidator{},
+		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
+	})
+}
+
+// AuthorizeRenew returns an error if the renewal is disabled.
+func (p *MTLS) AuthorizeRenew(ctx context.Context, cert *x509.Certificate) error {
+	if p.claimer.IsDisableRenewal() {
+		return errs.Unauthorized("mtls.AuthorizeRenew; renew is disabled for mtls provisioner '%s'", p.GetName())
+	}
+	return nil
+}
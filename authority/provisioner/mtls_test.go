@@ -0,0 +1,259 @@
+package provisioner
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/errs"
+)
+
+// mtlsTestCert creates a certificate using the given template, signed by the
+// parent and its key, or self-signed if the parent is nil.
+func mtlsTestCert(t *testing.T, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	assert.FatalError(t, err)
+	template.SerialNumber = serial
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Minute)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return crt, key
+}
+
+// mtlsTestCA creates a root and an intermediate certificate.
+func mtlsTestCA(t *testing.T, name string) (root, intermediate *x509.Certificate, intermediateKey crypto.Signer) {
+	t.Helper()
+	root, rootKey := mtlsTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name + " Root CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}, nil, nil)
+	intermediate, intermediateKey = mtlsTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name + " Intermediate CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}, root, rootKey)
+	return
+}
+
+func mtlsTestClientCert(t *testing.T, intermediate *x509.Certificate, intermediateKey crypto.Signer, ext ...x509.ExtKeyUsage) *x509.Certificate {
+	t.Helper()
+	if ext == nil {
+		ext = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	crt, _ := mtlsTestCert(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "workload"},
+		DNSNames:       []string{"workload.internal"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		EmailAddresses: []string{"workload@internal"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "internal", Path: "/workload"}},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    ext,
+	}, intermediate, intermediateKey)
+	return crt
+}
+
+func generateMTLS(t *testing.T, roots ...*x509.Certificate) *MTLS {
+	t.Helper()
+	var b []byte
+	for _, crt := range roots {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})...)
+	}
+	p := &MTLS{
+		Name:  "mtls",
+		Type:  "MTLS",
+		Roots: b,
+	}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims, Audiences: testAudiences}))
+	return p
+}
+
+func TestMTLS_Getters(t *testing.T) {
+	root, _, _ := mtlsTestCA(t, "Test")
+	p := generateMTLS(t, root)
+	if got := p.GetID(); got != "mtls/mtls" {
+		t.Errorf("MTLS.GetID() = %v, want %v", got, "mtls/mtls")
+	}
+	if got := p.GetName(); got != "mtls" {
+		t.Errorf("MTLS.GetName() = %v, want %v", got, "mtls")
+	}
+	if got := p.GetType(); got != TypeMTLS {
+		t.Errorf("MTLS.GetType() = %v, want %v", got, TypeMTLS)
+	}
+	kid, key, ok := p.GetEncryptedKey()
+	if kid != "" || key != "" || ok == true {
+		t.Errorf("MTLS.GetEncryptedKey() = (%v, %v, %v), want (%v, %v, %v)",
+			kid, key, ok, "", "", false)
+	}
+	if _, err := p.GetTokenID("token"); err == nil {
+		t.Error("MTLS.GetTokenID() error = nil, want error")
+	}
+	assert.Equals(t, p.GetRootCertificates(), []*x509.Certificate{root})
+}
+
+func TestMTLS_Init(t *testing.T) {
+	root, _, _ := mtlsTestCA(t, "Test")
+	other, _, _ := mtlsTestCA(t, "Other")
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw})...)
+	config := Config{Claims: globalProvisionerClaims, Audiences: testAudiences}
+
+	tests := []struct {
+		name      string
+		p         *MTLS
+		wantRoots []*x509.Certificate
+		err       error
+	}{
+		{"fail/empty", &MTLS{}, nil, errors.New("provisioner type cannot be empty")},
+		{"fail/empty-name", &MTLS{Type: "MTLS"}, nil, errors.New("provisioner name cannot be empty")},
+		{"fail/empty-roots", &MTLS{Type: "MTLS", Name: "foo"}, nil, errors.New("provisioner root(s) cannot be empty")},
+		{"fail/no-valid-root-certs", &MTLS{Type: "MTLS", Name: "foo", Roots: []byte("foo")}, nil,
+			errors.New("no x509 certificates found in roots attribute for provisioner 'foo'")},
+		{"fail/invalid-duration", &MTLS{Type: "MTLS", Name: "foo", Roots: bundle,
+			Claims: &Claims{DefaultTLSDur: &Duration{0}}}, nil,
+			errors.New("claims: MinTLSCertDuration must be greater than 0")},
+		{"ok", &MTLS{Type: "MTLS", Name: "foo", Roots: bundle}, []*x509.Certificate{root, other}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.p.Init(config)
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					assert.Equals(t, err.Error(), tt.err.Error())
+				}
+				return
+			}
+			if assert.Nil(t, tt.err) {
+				assert.Equals(t, tt.p.GetRootCertificates(), tt.wantRoots)
+				assert.Equals(t, len(tt.p.rootPool.Subjects()), len(tt.wantRoots))
+			}
+		})
+	}
+}
+
+func TestMTLS_AuthorizeClientCertificate(t *testing.T) {
+	root, intermediate, intermediateKey := mtlsTestCA(t, "Trusted")
+	_, untrustedIntermediate, untrustedKey := mtlsTestCA(t, "Untrusted")
+	p := generateMTLS(t, root)
+
+	leaf := mtlsTestClientCert(t, intermediate, intermediateKey)
+	serverLeaf := mtlsTestClientCert(t, intermediate, intermediateKey, x509.ExtKeyUsageServerAuth)
+	untrustedLeaf := mtlsTestClientCert(t, untrustedIntermediate, untrustedKey)
+	noNames, _ := mtlsTestCert(t, &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, intermediate, intermediateKey)
+
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate
+		code  int
+		err   error
+	}{
+		{"ok", []*x509.Certificate{leaf, intermediate}, 0, nil},
+		{"fail/empty", nil, http.StatusUnauthorized,
+			errors.New("mtls.AuthorizeClientCertificate; missing client certificate")},
+		{"fail/untrusted", []*x509.Certificate{untrustedLeaf, untrustedIntermediate}, http.StatusUnauthorized,
+			errors.New("mtls.AuthorizeClientCertificate; error verifying client certificate chain")},
+		{"fail/missing-intermediate", []*x509.Certificate{leaf}, http.StatusUnauthorized,
+			errors.New("mtls.AuthorizeClientCertificate; error verifying client certificate chain")},
+		{"fail/not-client-auth", []*x509.Certificate{serverLeaf, intermediate}, http.StatusUnauthorized,
+			errors.New("mtls.AuthorizeClientCertificate; error verifying client certificate chain")},
+		{"fail/no-names", []*x509.Certificate{noNames, intermediate}, http.StatusUnauthorized,
+			errors.New("mtls.AuthorizeClientCertificate; client certificate does not contain a subject or SANs")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := p.AuthorizeClientCertificate(context.Background(), tt.chain)
+			if err != nil {
+				if assert.NotNil(t, tt.err) {
+					sc, ok := err.(errs.StatusCoder)
+					assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+					assert.Equals(t, sc.StatusCode(), tt.code)
+					assert.HasPrefix(t, err.Error(), tt.err.Error())
+				}
+				return
+			}
+			if assert.Nil(t, tt.err) && assert.NotNil(t, opts) {
+				assert.Equals(t, len(opts), 7)
+				for _, o := range opts {
+					switch v := o.(type) {
+					case certificateOptionsFunc:
+					case *provisionerExtensionOption:
+						assert.Equals(t, v.Type, int(TypeMTLS))
+						assert.Equals(t, v.Name, p.GetName())
+						assert.Equals(t, v.CredentialID, "")
+						assert.Len(t, 0, v.KeyValuePairs)
+					case profileLimitDuration:
+						assert.Equals(t, v.def, p.claimer.DefaultTLSCertDuration())
+						assert.Equals(t, v.notBefore, leaf.NotBefore)
+						assert.Equals(t, v.notAfter, leaf.NotAfter)
+					case commonNameValidator:
+						assert.Equals(t, string(v), "workload")
+					case defaultPublicKeyValidator:
+					case defaultSANsValidator:
+						assert.Equals(t, []string(v), []string{
+							"workload.internal", "10.0.0.1", "workload@internal", "spiffe://internal/workload",
+						})
+					case *validityValidator:
+						assert.Equals(t, v.min, p.claimer.MinTLSCertDuration())
+						assert.Equals(t, v.max, p.claimer.MaxTLSCertDuration())
+					default:
+						assert.FatalError(t, errors.Errorf("unexpected sign option of type %T", v))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMTLS_AuthorizeRenew(t *testing.T) {
+	root, _, _ := mtlsTestCA(t, "Test")
+	p1 := generateMTLS(t, root)
+	p2 := generateMTLS(t, root)
+
+	// disable renewal
+	disable := true
+	p2.Claims = &Claims{DisableRenewal: &disable}
+	var err error
+	p2.claimer, err = NewClaimer(p2.Claims, globalProvisionerClaims)
+	assert.FatalError(t, err)
+
+	assert.FatalError(t, p1.AuthorizeRenew(context.Background(), nil))
+	err = p2.AuthorizeRenew(context.Background(), nil)
+	if assert.NotNil(t, err) {
+		sc, ok := err.(errs.StatusCoder)
+		assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+		assert.Equals(t, sc.StatusCode(), http.StatusUnauthorized)
+	}
+}
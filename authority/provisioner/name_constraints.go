@@ -0,0 +1,121 @@
+package provisioner
+
+import (
+	"crypto/x509"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NameConstraints are the name constraints added to the CA certificates issued
+// by a provisioner. The DNS domains and the email domains can start with a dot
+// to match only the subdomains, the IP ranges use the CIDR notation, and the
+// email addresses can be a mailbox, a domain or a subdomain, e.g.
+// "jane@example.com", "example.com" or ".example.com".
+//
+// As RFC 5280 requires, the extension is always marked as critical.
+type NameConstraints struct {
+	PermittedDNSDomains     []string `json:"permittedDNSDomains,omitempty"`
+	ExcludedDNSDomains      []string `json:"excludedDNSDomains,omitempty"`
+	PermittedIPRanges       []string `json:"permittedIPRanges,omitempty"`
+	ExcludedIPRanges        []string `json:"excludedIPRanges,omitempty"`
+	PermittedEmailAddresses []string `json:"permittedEmailAddresses,omitempty"`
+	ExcludedEmailAddresses  []string `json:"excludedEmailAddresses,omitempty"`
+}
+
+// Validate checks the syntax of the name constraints.
+func (c *NameConstraints) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.PermittedDNSDomains) == 0 && len(c.ExcludedDNSDomains) == 0 &&
+		len(c.PermittedIPRanges) == 0 && len(c.ExcludedIPRanges) == 0 &&
+		len(c.PermittedEmailAddresses) == 0 && len(c.ExcludedEmailAddresses) == 0 {
+		return errors.New("nameConstraints cannot be empty")
+	}
+	for _, d := range append(append([]string{}, c.PermittedDNSDomains...), c.ExcludedDNSDomains...) {
+		if err := validateConstraintDomain(d); err != nil {
+			return errors.Wrapf(err, "invalid nameConstraints DNS domain %q", d)
+		}
+	}
+	if _, err := parseIPRanges(c.PermittedIPRanges); err != nil {
+		return err
+	}
+	if _, err := parseIPRanges(c.ExcludedIPRanges); err != nil {
+		return err
+	}
+	for _, e := range append(append([]string{}, c.PermittedEmailAddresses...), c.ExcludedEmailAddresses...) {
+		domain := e
+		if i := strings.LastIndex(e, "@"); i >= 0 {
+			if i == 0 {
+				return errors.Errorf("invalid nameConstraints email address %q: local part cannot be empty", e)
+			}
+			domain = e[i+1:]
+		}
+		if err := validateConstraintDomain(domain); err != nil {
+			return errors.Wrapf(err, "invalid nameConstraints email address %q", e)
+		}
+	}
+	return nil
+}
+
+// Apply sets the name constraints in the given certificate.
+func (c *NameConstraints) Apply(cert *x509.Certificate) error {
+	if c == nil {
+		return nil
+	}
+	permittedIPRanges, err := parseIPRanges(c.PermittedIPRanges)
+	if err != nil {
+		return err
+	}
+	excludedIPRanges, err := parseIPRanges(c.ExcludedIPRanges)
+	if err != nil {
+		return err
+	}
+	cert.PermittedDNSDomainsCritical = true
+	cert.PermittedDNSDomains = c.PermittedDNSDomains
+	cert.ExcludedDNSDomains = c.ExcludedDNSDomains
+	cert.PermittedIPRanges = permittedIPRanges
+	cert.ExcludedIPRanges = excludedIPRanges
+	cert.PermittedEmailAddresses = c.PermittedEmailAddresses
+	cert.ExcludedEmailAddresses = c.ExcludedEmailAddresses
+	return nil
+}
+
+// validateConstraintDomain checks that d is a valid domain, optionally
+// starting with a dot.
+func validateConstraintDomain(d string) error {
+	name := strings.TrimPrefix(d, ".")
+	if name == "" {
+		return errors.New("domain cannot be empty")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return errors.New("domain labels must have between 1 and 63 characters")
+		}
+		for _, r := range label {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			default:
+				return errors.Errorf("domain cannot contain the character %q", r)
+			}
+		}
+	}
+	return nil
+}
+
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range ranges {
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid nameConstraints IP range %q", s)
+		}
+		if !ip.Equal(ipNet.IP) {
+			return nil, errors.Errorf("invalid nameConstraints IP range %q: host bits must be 0, use %s", s, ipNet)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
@@ -10,6 +10,13 @@ import (
 // noop provisioners is a provisioner that accepts anything.
 type noop struct{}
 
+// IsNoop returns true if the given provisioner is the noop provisioner, the
+// one loaded for the certificates without the provisioner extension.
+func IsNoop(p Interface) bool {
+	_, ok := p.(*noop)
+	return ok
+}
+
 func (p *noop) GetID() string {
 	return "noop"
 }
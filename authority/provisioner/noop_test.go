@@ -27,3 +27,9 @@ func Test_noop(t *testing.T) {
 	assert.Equals(t, []SignOption{}, sigOptions)
 	assert.Equals(t, nil, err)
 }
+
+func TestIsNoop(t *testing.T) {
+	assert.True(t, IsNoop(&noop{}))
+	assert.False(t, IsNoop(&JWK{}))
+	assert.False(t, IsNoop(nil))
+}
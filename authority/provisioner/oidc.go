@@ -18,6 +18,10 @@ import (
 	"go.step.sm/crypto/x509util"
 )
 
+// GitHubActionsIssuer is the issuer of the OIDC tokens available to GitHub
+// Actions workflows.
+const GitHubActionsIssuer = "https://token.actions.githubusercontent.com"
+
 // openIDConfiguration contains the necessary properties in the
 // `/.well-known/openid-configuration` document.
 type openIDConfiguration struct {
@@ -47,6 +51,9 @@ type openIDPayload struct {
 	Hd              string   `json:"hd"`
 	Nonce           string   `json:"nonce"`
 	Groups          []string `json:"groups"`
+	Repository      string   `json:"repository"`
+	Ref             string   `json:"ref"`
+	Workflow        string   `json:"workflow"`
 }
 
 func (o *openIDPayload) IsAdmin(admins []string) bool {
@@ -72,24 +79,93 @@ func (o *openIDPayload) IsAdmin(admins []string) bool {
 	return false
 }
 
+// GitHubActions contains the identity constraints applied to the tokens issued
+// by GitHub Actions. Each value can be an exact value or a glob pattern using
+// the syntax of path.Match, e.g. "octo-org/*" or "refs/heads/release-*". An
+// empty list allows any value of the claim.
+type GitHubActions struct {
+	Repositories []string `json:"repositories,omitempty"`
+	Refs         []string `json:"refs,omitempty"`
+	Workflows    []string `json:"workflows,omitempty"`
+}
+
+// Validate validates the glob patterns of the GitHub Actions constraints.
+func (g *GitHubActions) Validate() error {
+	for _, patterns := range [][]string{g.Repositories, g.Refs, g.Workflows} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "error parsing githubActions pattern %s", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// match returns an error if the repository, ref or workflow claims in the
+// given payload do not match the configured constraints.
+func (g *GitHubActions) match(p *openIDPayload) error {
+	switch {
+	case !matchAnyPattern(g.Repositories, p.Repository):
+		return errors.New("repository is not allowed")
+	case !matchAnyPattern(g.Refs, p.Ref):
+		return errors.New("ref is not allowed")
+	case !matchAnyPattern(g.Workflows, p.Workflow):
+		return errors.New("workflow is not allowed")
+	default:
+		return nil
+	}
+}
+
+// templateData returns the GitHub Actions claims that will be available in
+// the certificate templates under the GitHub key.
+func (g *GitHubActions) templateData(p *openIDPayload) map[string]string {
+	return map[string]string{
+		"Repository": p.Repository,
+		"Ref":        p.Ref,
+		"Workflow":   p.Workflow,
+	}
+}
+
+// matchAnyPattern returns true if the list of patterns is empty or if the
+// value matches one of them.
+func matchAnyPattern(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == value {
+			return true
+		}
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
 // OIDC represents an OAuth 2.0 OpenID Connect provider.
 //
 // ClientSecret is mandatory, but it can be an empty string.
+//
+// If GitHubActions is set, the provisioner will validate the tokens issued to
+// GitHub Actions workflows, and the ConfigurationEndpoint will default to the
+// one of the GitHub Actions issuer.
 type OIDC struct {
 	*base
-	ID                    string   `json:"-"`
-	Type                  string   `json:"type"`
-	Name                  string   `json:"name"`
-	ClientID              string   `json:"clientID"`
-	ClientSecret          string   `json:"clientSecret"`
-	ConfigurationEndpoint string   `json:"configurationEndpoint"`
-	TenantID              string   `json:"tenantID,omitempty"`
-	Admins                []string `json:"admins,omitempty"`
-	Domains               []string `json:"domains,omitempty"`
-	Groups                []string `json:"groups,omitempty"`
-	ListenAddress         string   `json:"listenAddress,omitempty"`
-	Claims                *Claims  `json:"claims,omitempty"`
-	Options               *Options `json:"options,omitempty"`
+	ID                    string         `json:"-"`
+	Type                  string         `json:"type"`
+	Name                  string         `json:"name"`
+	ClientID              string         `json:"clientID"`
+	ClientSecret          string         `json:"clientSecret"`
+	ConfigurationEndpoint string         `json:"configurationEndpoint"`
+	TenantID              string         `json:"tenantID,omitempty"`
+	Admins                []string       `json:"admins,omitempty"`
+	Domains               []string       `json:"domains,omitempty"`
+	Groups                []string       `json:"groups,omitempty"`
+	ListenAddress         string         `json:"listenAddress,omitempty"`
+	GitHubActions         *GitHubActions `json:"githubActions,omitempty"`
+	Claims                *Claims        `json:"claims,omitempty"`
+	Options               *Options       `json:"options,omitempty"`
 	configuration         openIDConfiguration
 	keyStore              *keyStore
 	claimer               *Claimer
@@ -154,6 +230,10 @@ func (o *OIDC) GetEncryptedKey() (kid, key string, ok bool) {
 
 // Init validates and initializes the OIDC provider.
 func (o *OIDC) Init(config Config) (err error) {
+	if o.GitHubActions != nil && o.ConfigurationEndpoint == "" {
+		o.ConfigurationEndpoint = GitHubActionsIssuer + "/.well-known/openid-configuration"
+	}
+
 	switch {
 	case o.Type == "":
 		return errors.New("type cannot be empty")
@@ -172,6 +252,17 @@ func (o *OIDC) Init(config Config) (err error) {
 		}
 	}
 
+	// Validate GitHub Actions constraints if given
+	if o.GitHubActions != nil {
+		if err := o.GitHubActions.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := o.Options.GetX509Options().Validate(); err != nil {
+		return err
+	}
+
 	// Update claims with global ones
 	if o.claimer, err = NewClaimer(o.Claims, config.Claims); err != nil {
 		return err
@@ -258,6 +349,13 @@ func (o *OIDC) ValidatePayload(p openIDPayload) error {
 		}
 	}
 
+	// Filter by GitHub Actions claims
+	if o.GitHubActions != nil {
+		if err := o.GitHubActions.match(&p); err != nil {
+			return errs.Wrap(http.StatusUnauthorized, err, "validatePayload: failed to validate oidc token payload")
+		}
+	}
+
 	return nil
 }
 
@@ -342,6 +440,9 @@ func (o *OIDC) AuthorizeSign(ctx context.Context, token string) ([]SignOption, e
 	if v, err := unsafeParseSigned(token); err == nil {
 		data.SetToken(v)
 	}
+	if o.GitHubActions != nil {
+		data.Set("GitHub", o.GitHubActions.templateData(claims))
+	}
 
 	// Use the default template unless no-templates are configured and email is
 	// an admin, in that case we will use the CR template.
@@ -355,15 +456,15 @@ func (o *OIDC) AuthorizeSign(ctx context.Context, token string) ([]SignOption, e
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "oidc.AuthorizeSign")
 	}
 
-	return []SignOption{
+	return withX509Options(o.Options, []SignOption{
 		templateOptions,
 		// modifiers / withOptions
 		newProvisionerExtensionOption(TypeOIDC, o.Name, o.ClientID),
-		profileDefaultDuration(o.claimer.DefaultTLSCertDuration()),
+		newDefaultDurationOption(o.claimer),
 		// validators
 		defaultPublicKeyValidator{},
 		newValidityValidator(o.claimer.MinTLSCertDuration(), o.claimer.MaxTLSCertDuration()),
-	}, nil
+	})
 }
 
 // AuthorizeRenew returns an error if the renewal is disabled.
@@ -404,6 +505,9 @@ func (o *OIDC) AuthorizeSSHSign(ctx context.Context, token string) ([]SignOption
 	if v, err := unsafeParseSigned(token); err == nil {
 		data.SetToken(v)
 	}
+	if o.GitHubActions != nil {
+		data.Set("GitHub", o.GitHubActions.templateData(claims))
+	}
 	// Add custom extensions added in the identity function.
 	for k, v := range iden.Permissions.Extensions {
 		data.AddExtension(k, v)
@@ -348,6 +348,103 @@ func TestOIDC_AuthorizeSign(t *testing.T) {
 	}
 }
 
+func TestOIDC_GitHubActions(t *testing.T) {
+	srv := generateJWKServer(1)
+	defer srv.Close()
+
+	var keys jose.JSONWebKeySet
+	assert.FatalError(t, getAndDecode(srv.URL+"/private", &keys))
+
+	p1, err := generateOIDC()
+	assert.FatalError(t, err)
+	p1.GitHubActions = &GitHubActions{
+		Repositories: []string{"smallstep/certificates", "smallstep/cli-*"},
+		Refs:         []string{"refs/heads/master", "refs/tags/v*"},
+	}
+	p2, err := generateOIDC()
+	assert.FatalError(t, err)
+	p2.GitHubActions = &GitHubActions{
+		Workflows: []string{"release"},
+	}
+
+	config := Config{Claims: globalProvisionerClaims}
+	p1.ConfigurationEndpoint = srv.URL + "/.well-known/openid-configuration"
+	p2.ConfigurationEndpoint = srv.URL + "/.well-known/openid-configuration"
+	assert.FatalError(t, p1.Init(config))
+	assert.FatalError(t, p2.Init(config))
+
+	now := time.Now()
+	okRepo, err := generateGitHubActionsToken("the-issuer", p1.ClientID, "smallstep/certificates", "refs/heads/master", "ci", now, &keys.Keys[0])
+	assert.FatalError(t, err)
+	okGlob, err := generateGitHubActionsToken("the-issuer", p1.ClientID, "smallstep/cli-utils", "refs/tags/v0.18.0", "ci", now, &keys.Keys[0])
+	assert.FatalError(t, err)
+	okWorkflow, err := generateGitHubActionsToken("the-issuer", p2.ClientID, "smallstep/certificates", "refs/heads/foo", "release", now, &keys.Keys[0])
+	assert.FatalError(t, err)
+	failRepo, err := generateGitHubActionsToken("the-issuer", p1.ClientID, "evil/certificates", "refs/heads/master", "ci", now, &keys.Keys[0])
+	assert.FatalError(t, err)
+	failGlob, err := generateGitHubActionsToken("the-issuer", p1.ClientID, "smallstep/cli/foo", "refs/heads/master", "ci", now, &keys.Keys[0])
+	assert.FatalError(t, err)
+	failRef, err := generateGitHubActionsToken("the-issuer", p1.ClientID, "smallstep/certificates", "refs/heads/feature", "ci", now, &keys.Keys[0])
+	assert.FatalError(t, err)
+	failWorkflow, err := generateGitHubActionsToken("the-issuer", p2.ClientID, "smallstep/certificates", "refs/heads/master", "ci", now, &keys.Keys[0])
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name    string
+		prov    *OIDC
+		token   string
+		err     string
+		wantErr bool
+	}{
+		{"ok repository", p1, okRepo, "", false},
+		{"ok glob", p1, okGlob, "", false},
+		{"ok workflow", p2, okWorkflow, "", false},
+		{"fail repository", p1, failRepo, "repository is not allowed", true},
+		{"fail glob", p1, failGlob, "repository is not allowed", true},
+		{"fail ref", p1, failRef, "ref is not allowed", true},
+		{"fail workflow", p2, failWorkflow, "workflow is not allowed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.prov.AuthorizeSign(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("OIDC.AuthorizeSign() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, sc.StatusCode(), http.StatusUnauthorized)
+				assert.HasSuffix(t, err.Error(), tt.err)
+				assert.Nil(t, got)
+			} else {
+				assert.Len(t, 5, got)
+			}
+		})
+	}
+}
+
+func TestGitHubActions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		g       *GitHubActions
+		wantErr bool
+	}{
+		{"ok", &GitHubActions{Repositories: []string{"smallstep/*"}, Refs: []string{"refs/heads/master"}}, false},
+		{"ok empty", &GitHubActions{}, false},
+		{"fail repositories", &GitHubActions{Repositories: []string{"smallstep/["}}, true},
+		{"fail refs", &GitHubActions{Refs: []string{"refs/heads/\\"}}, true},
+		{"fail workflows", &GitHubActions{Workflows: []string{"[a-"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.g.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("GitHubActions.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestOIDC_AuthorizeRevoke(t *testing.T) {
 	srv := generateJWKServer(2)
 	defer srv.Close()
@@ -1,6 +1,7 @@
 package provisioner
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"strings"
 
@@ -56,6 +57,46 @@ type X509Options struct {
 	// TemplateData is a JSON object with variables that can be used in custom
 	// templates.
 	TemplateData json.RawMessage `json:"templateData,omitempty"`
+
+	// SignatureAlgorithm is the algorithm used to sign the certificates, e.g.
+	// "ECDSA-SHA384". It must be compatible with the key of the issuer, if it
+	// is not set the default algorithm for the issuer key will be used.
+	SignatureAlgorithm string `json:"signatureAlgorithm,omitempty"`
+
+	// AllowCA allows the provisioner to issue CA certificates, with the basic
+	// constraints extension and CA:true, using a custom template. It is
+	// disabled by default, a CA certificate can sign any other certificate.
+	AllowCA bool `json:"allowCA,omitempty"`
+
+	// NameConstraints are added to the CA certificates issued by the
+	// provisioner. They require AllowCA.
+	NameConstraints *NameConstraints `json:"nameConstraints,omitempty"`
+
+	// CertificatePolicies are added to the certificate policies extension of
+	// the certificates issued by the provisioner.
+	CertificatePolicies CertificatePolicies `json:"certificatePolicies,omitempty"`
+}
+
+// Validate validates the X.509 options.
+func (o *X509Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if _, err := o.GetSignatureAlgorithm(); err != nil {
+		return err
+	}
+	if o.NameConstraints != nil {
+		if !o.AllowCA {
+			return errors.New("nameConstraints require allowCA")
+		}
+		if err := o.NameConstraints.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := o.CertificatePolicies.Validate(); err != nil {
+		return err
+	}
+	return nil
 }
 
 // HasTemplate returns true if a template is defined in the provisioner options.
@@ -63,6 +104,37 @@ func (o *X509Options) HasTemplate() bool {
 	return o != nil && (o.Template != "" || o.TemplateFile != "")
 }
 
+// signatureAlgorithms are the signature algorithms that can be configured in
+// the X.509 options.
+var signatureAlgorithms = []x509.SignatureAlgorithm{
+	x509.SHA256WithRSA,
+	x509.SHA384WithRSA,
+	x509.SHA512WithRSA,
+	x509.SHA256WithRSAPSS,
+	x509.SHA384WithRSAPSS,
+	x509.SHA512WithRSAPSS,
+	x509.ECDSAWithSHA256,
+	x509.ECDSAWithSHA384,
+	x509.ECDSAWithSHA512,
+	x509.PureEd25519,
+}
+
+// GetSignatureAlgorithm returns the signature algorithm defined in the X.509
+// options, or x509.UnknownSignatureAlgorithm if it's not set. The algorithm
+// uses the names in the crypto/x509 package, e.g. "SHA256-RSA" or
+// "ECDSA-SHA384".
+func (o *X509Options) GetSignatureAlgorithm() (x509.SignatureAlgorithm, error) {
+	if o == nil || o.SignatureAlgorithm == "" {
+		return x509.UnknownSignatureAlgorithm, nil
+	}
+	for _, alg := range signatureAlgorithms {
+		if strings.EqualFold(o.SignatureAlgorithm, alg.String()) {
+			return alg, nil
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, errors.Errorf("unsupported signature algorithm %s", o.SignatureAlgorithm)
+}
+
 // TemplateOptions generates a CertificateOptions with the template and data
 // defined in the ProvisionerOptions, the provisioner generated data, and the
 // user data provided in the request. If no template has been provided,
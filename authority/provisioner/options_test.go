@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
 
 	"go.step.sm/crypto/pemutil"
@@ -98,6 +99,96 @@ func TestProvisionerX509Options_HasTemplate(t *testing.T) {
 	}
 }
 
+func TestProvisionerX509Options_GetSignatureAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *X509Options
+		want    x509.SignatureAlgorithm
+		wantErr bool
+	}{
+		{"nil", nil, x509.UnknownSignatureAlgorithm, false},
+		{"empty", &X509Options{}, x509.UnknownSignatureAlgorithm, false},
+		{"SHA256-RSA", &X509Options{SignatureAlgorithm: "SHA256-RSA"}, x509.SHA256WithRSA, false},
+		{"SHA384-RSAPSS", &X509Options{SignatureAlgorithm: "SHA384-RSAPSS"}, x509.SHA384WithRSAPSS, false},
+		{"ECDSA-SHA384", &X509Options{SignatureAlgorithm: "ECDSA-SHA384"}, x509.ECDSAWithSHA384, false},
+		{"ecdsa-sha512", &X509Options{SignatureAlgorithm: "ecdsa-sha512"}, x509.ECDSAWithSHA512, false},
+		{"Ed25519", &X509Options{SignatureAlgorithm: "Ed25519"}, x509.PureEd25519, false},
+		{"fail SHA1-RSA", &X509Options{SignatureAlgorithm: "SHA1-RSA"}, x509.UnknownSignatureAlgorithm, true},
+		{"fail unknown", &X509Options{SignatureAlgorithm: "foo"}, x509.UnknownSignatureAlgorithm, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.options.GetSignatureAlgorithm()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("X509Options.GetSignatureAlgorithm() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("X509Options.GetSignatureAlgorithm() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisionerX509Options_Validate(t *testing.T) {
+	nc := &NameConstraints{PermittedDNSDomains: []string{"example.com"}}
+	tests := []struct {
+		name    string
+		options *X509Options
+		wantErr bool
+	}{
+		{"nil", nil, false},
+		{"empty", &X509Options{}, false},
+		{"allowCA", &X509Options{AllowCA: true}, false},
+		{"nameConstraints", &X509Options{AllowCA: true, NameConstraints: nc}, false},
+		{"fail signatureAlgorithm", &X509Options{SignatureAlgorithm: "SHA1-RSA"}, true},
+		{"fail nameConstraints without allowCA", &X509Options{NameConstraints: nc}, true},
+		{"fail empty nameConstraints", &X509Options{AllowCA: true, NameConstraints: &NameConstraints{}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("X509Options.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNameConstraints_Validate(t *testing.T) {
+	tests := []struct {
+		name        string
+		constraints *NameConstraints
+		wantErr     bool
+	}{
+		{"nil", nil, false},
+		{"ok", &NameConstraints{
+			PermittedDNSDomains:     []string{"example.com", ".example.org", "_srv.example.net"},
+			ExcludedDNSDomains:      []string{"secret.example.com"},
+			PermittedIPRanges:       []string{"10.0.0.0/8", "2001:db8::/32"},
+			ExcludedIPRanges:        []string{"10.10.0.0/16"},
+			PermittedEmailAddresses: []string{"jane@example.com", "example.org", ".example.net"},
+			ExcludedEmailAddresses:  []string{"root@example.com"},
+		}, false},
+		{"fail empty", &NameConstraints{}, true},
+		{"fail DNS empty", &NameConstraints{PermittedDNSDomains: []string{""}}, true},
+		{"fail DNS dot", &NameConstraints{PermittedDNSDomains: []string{"."}}, true},
+		{"fail DNS wildcard", &NameConstraints{PermittedDNSDomains: []string{"*.example.com"}}, true},
+		{"fail DNS empty label", &NameConstraints{ExcludedDNSDomains: []string{"example..com"}}, true},
+		{"fail DNS long label", &NameConstraints{ExcludedDNSDomains: []string{strings.Repeat("a", 64) + ".com"}}, true},
+		{"fail IP not CIDR", &NameConstraints{PermittedIPRanges: []string{"10.0.0.1"}}, true},
+		{"fail IP host bits", &NameConstraints{ExcludedIPRanges: []string{"10.0.0.1/8"}}, true},
+		{"fail email no local part", &NameConstraints{PermittedEmailAddresses: []string{"@example.com"}}, true},
+		{"fail email bad domain", &NameConstraints{ExcludedEmailAddresses: []string{"jane@exa mple.com"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.constraints.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("NameConstraints.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestTemplateOptions(t *testing.T) {
 	csr := parseCertificateRequest(t, "testdata/certs/ecdsa.csr")
 	data := x509util.TemplateData{
@@ -156,6 +156,10 @@ const (
 	TypeSSHPOP Type = 9
 	// TypeSCEP is used to indicate the SCEP provisioners
 	TypeSCEP Type = 10
+	// TypeMTLS is used to indicate the MTLS provisioners.
+	TypeMTLS Type = 11
+	// TypeVault is used to indicate the Vault provisioners.
+	TypeVault Type = 12
 )
 
 // String returns the string representation of the type.
@@ -181,6 +185,10 @@ func (t Type) String() string {
 		return "SSHPOP"
 	case TypeSCEP:
 		return "SCEP"
+	case TypeMTLS:
+		return "MTLS"
+	case TypeVault:
+		return "Vault"
 	default:
 		return ""
 	}
@@ -251,6 +259,10 @@ func (l *List) UnmarshalJSON(data []byte) error {
 			p = &SSHPOP{}
 		case "scep":
 			p = &SCEP{}
+		case "mtls":
+			p = &MTLS{}
+		case "vault":
+			p = &Vault{}
 		default:
 			// Skip unsupported provisioners. A client using this method may be
 			// compiled with a version of smallstep/certificates that does not
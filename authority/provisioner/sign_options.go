@@ -8,6 +8,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/json"
+	mathrand "math/rand"
 	"net"
 	"net/url"
 	"reflect"
@@ -34,6 +35,26 @@ type SignOptions struct {
 // Sign method.
 type SignOption interface{}
 
+// IssuerOption is a SignOption that indicates that the certificate must be
+// signed by the issuer configured in the provisioner with the given id instead
+// of the default one.
+type IssuerOption struct {
+	ProvisionerID string
+}
+
+// CAOption is a SignOption that allows the issuance of CA certificates. The
+// name constraints, if set, are added to the CA certificates.
+type CAOption struct {
+	NameConstraints *NameConstraints
+}
+
+// ACMEOrderOption is a SignOption used by the ACME protocol to record the
+// account and order that requested a certificate.
+type ACMEOrderOption struct {
+	AccountID string
+	OrderID   string
+}
+
 // CertificateValidator is an interface used to validate a given X.509 certificate.
 type CertificateValidator interface {
 	Valid(cert *x509.Certificate, opts SignOptions) error
@@ -317,6 +338,70 @@ func (v profileDefaultDuration) Modify(cert *x509.Certificate, so SignOptions) e
 	return nil
 }
 
+// MaxTLSCertDurationJitter is the maximum percentage of the default TLS cert
+// duration that can be used as jitter.
+const MaxTLSCertDurationJitter = 50
+
+// durationJitterInt63n returns a random number in [0, n), it is used to spread
+// the expiration of the certificates and tests can replace it with a seeded
+// source. The jitter does not need a cryptographically secure source.
+var durationJitterInt63n = mathrand.Int63n // nolint:gosec
+
+// profileDurationJitter is a modifier that sets the default certificate
+// duration and randomly shortens or extends it by up to the given percentage,
+// so the certificates issued at the same time do not expire, and get renewed,
+// at the same time. The requested validity windows are not modified, and the
+// duration is kept between the min and max durations.
+type profileDurationJitter struct {
+	def      profileDefaultDuration
+	percent  int
+	min, max time.Duration
+}
+
+func (v *profileDurationJitter) Modify(cert *x509.Certificate, so SignOptions) error {
+	if err := v.def.Modify(cert, so); err != nil {
+		return err
+	}
+	if !so.NotAfter.IsZero() {
+		return nil
+	}
+	d := jitterDuration(cert.NotAfter.Sub(cert.NotBefore), v.percent, v.min, v.max)
+	cert.NotAfter = cert.NotBefore.Add(d)
+	return nil
+}
+
+// jitterDuration randomly shortens or extends the duration d by up to the given
+// percentage, keeping it between min and max.
+func jitterDuration(d time.Duration, percent int, min, max time.Duration) time.Duration {
+	delta := int64(d / 100 * time.Duration(percent))
+	if delta <= 0 {
+		return d
+	}
+	d += time.Duration(durationJitterInt63n(2*delta+1) - delta)
+	switch {
+	case d > max:
+		d = max
+	case d < min:
+		d = min
+	}
+	return d
+}
+
+// newDefaultDurationOption returns the modifier that sets the default TLS cert
+// duration of the claimer, with a jitter if TLSCertDurationJitter is set.
+func newDefaultDurationOption(c *Claimer) SignOption {
+	def := profileDefaultDuration(c.DefaultTLSCertDuration())
+	if jitter := c.TLSCertDurationJitter(); jitter > 0 {
+		return &profileDurationJitter{
+			def:     def,
+			percent: jitter,
+			min:     c.MinTLSCertDuration(),
+			max:     c.MaxTLSCertDuration(),
+		}
+	}
+	return def
+}
+
 // profileLimitDuration is an x509 profile option that modifies an x509 validity
 // period according to an imposed expiration time.
 type profileLimitDuration struct {
@@ -400,6 +485,75 @@ func (v *validityValidator) Valid(cert *x509.Certificate, o SignOptions) error {
 	return nil
 }
 
+// oidTLSFeature is the id-pe-tlsfeature extension defined in RFC 7633.
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// tlsFeatureStatusRequest is the status_request TLS feature, the one used to
+// require OCSP stapling.
+const tlsFeatureStatusRequest = 5
+
+// MustStapleExtension returns the TLS feature extension of the certificate
+// request if it requires the status_request feature, also known as OCSP
+// must-staple.
+func MustStapleExtension(csr *x509.CertificateRequest) (pkix.Extension, bool) {
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if rest, err := asn1.Unmarshal(ext.Value, &features); err != nil || len(rest) > 0 {
+			continue
+		}
+		for _, f := range features {
+			if f == tlsFeatureStatusRequest {
+				return ext, true
+			}
+		}
+	}
+	return pkix.Extension{}, false
+}
+
+// mustStapleValidator looks for the OCSP must-staple extension in the
+// certificate request. It rejects the request if the extension is forbidden,
+// otherwise it keeps it for the mustStapleModifier.
+type mustStapleValidator struct {
+	forbid bool
+	ext    *pkix.Extension
+}
+
+// Valid implements the CertificateRequestValidator interface.
+func (v *mustStapleValidator) Valid(csr *x509.CertificateRequest) error {
+	ext, ok := MustStapleExtension(csr)
+	if !ok {
+		return nil
+	}
+	if v.forbid {
+		return errs.Forbidden("certificate request cannot require OCSP must-staple")
+	}
+	v.ext = &ext
+	return nil
+}
+
+// mustStapleModifier adds the OCSP must-staple extension found by the
+// validator to the certificate.
+type mustStapleModifier struct {
+	validator *mustStapleValidator
+}
+
+// Modify implements the CertificateModifier interface.
+func (m mustStapleModifier) Modify(cert *x509.Certificate, _ SignOptions) error {
+	if m.validator.ext == nil {
+		return nil
+	}
+	for _, ext := range cert.ExtraExtensions {
+		if ext.Id.Equal(oidTLSFeature) {
+			return nil
+		}
+	}
+	cert.ExtraExtensions = append(cert.ExtraExtensions, *m.validator.ext)
+	return nil
+}
+
 var (
 	stepOIDRoot        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37476, 9000, 64}
 	stepOIDProvisioner = append(asn1.ObjectIdentifier(nil), append(stepOIDRoot, 1)...)
@@ -437,6 +591,37 @@ func (o *forceCNOption) Modify(cert *x509.Certificate, _ SignOptions) error {
 	return nil
 }
 
+// signatureAlgorithmEnforcer sets the algorithm used to sign the
+// certificate.
+type signatureAlgorithmEnforcer x509.SignatureAlgorithm
+
+func (s signatureAlgorithmEnforcer) Enforce(cert *x509.Certificate) error {
+	cert.SignatureAlgorithm = x509.SignatureAlgorithm(s)
+	return nil
+}
+
+// withX509Options appends to the given sign options a
+// signatureAlgorithmEnforcer if the X.509 options define a signature
+// algorithm, a certificatePoliciesEnforcer if they define certificate
+// policies, and a CAOption if they allow the issuance of CA certificates.
+func withX509Options(o *Options, so []SignOption) ([]SignOption, error) {
+	opts := o.GetX509Options()
+	alg, err := opts.GetSignatureAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	if alg != x509.UnknownSignatureAlgorithm {
+		so = append(so, signatureAlgorithmEnforcer(alg))
+	}
+	if opts != nil && len(opts.CertificatePolicies) > 0 {
+		so = append(so, certificatePoliciesEnforcer(opts.CertificatePolicies))
+	}
+	if opts != nil && opts.AllowCA {
+		so = append(so, CAOption{NameConstraints: opts.NameConstraints})
+	}
+	return so, nil
+}
+
 type provisionerExtensionOption struct {
 	Type          int
 	Name          string
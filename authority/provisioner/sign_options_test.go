@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"fmt"
+	mathrand "math/rand"
 	"net"
 	"net/url"
 	"strings"
@@ -624,6 +625,76 @@ func Test_profileDefaultDuration_Option(t *testing.T) {
 	}
 }
 
+func Test_profileDurationJitter_Option(t *testing.T) {
+	tmp := durationJitterInt63n
+	t.Cleanup(func() {
+		durationJitterInt63n = tmp
+	})
+	durationJitterInt63n = mathrand.New(mathrand.NewSource(1)).Int63n
+
+	nb := time.Now().Add(5 * time.Minute).UTC()
+	pdj := &profileDurationJitter{
+		def:     profileDefaultDuration(24 * time.Hour),
+		percent: 10,
+		min:     5 * time.Minute,
+		max:     25 * time.Hour,
+	}
+
+	// The duration is between the default duration +/- 10%, and never above
+	// the max duration.
+	var jittered bool
+	for i := 0; i < 100; i++ {
+		cert := new(x509.Certificate)
+		assert.FatalError(t, pdj.Modify(cert, SignOptions{NotBefore: NewTimeDuration(nb)}))
+		assert.Equals(t, cert.NotBefore, nb)
+		d := cert.NotAfter.Sub(cert.NotBefore)
+		assert.True(t, d >= 24*time.Hour-144*time.Minute, fmt.Sprintf("duration %s is too short", d))
+		assert.True(t, d <= 25*time.Hour, fmt.Sprintf("duration %s is too long", d))
+		if d != 24*time.Hour {
+			jittered = true
+		}
+	}
+	assert.True(t, jittered)
+
+	// A requested notAfter is not modified.
+	na := nb.Add(time.Hour)
+	cert := new(x509.Certificate)
+	assert.FatalError(t, pdj.Modify(cert, SignOptions{NotBefore: NewTimeDuration(nb), NotAfter: NewTimeDuration(na)}))
+	assert.Equals(t, cert.NotAfter, na)
+
+	// The same seed produces the same durations.
+	durationJitterInt63n = mathrand.New(mathrand.NewSource(1)).Int63n
+	c1 := new(x509.Certificate)
+	assert.FatalError(t, pdj.Modify(c1, SignOptions{NotBefore: NewTimeDuration(nb)}))
+	durationJitterInt63n = mathrand.New(mathrand.NewSource(1)).Int63n
+	c2 := new(x509.Certificate)
+	assert.FatalError(t, pdj.Modify(c2, SignOptions{NotBefore: NewTimeDuration(nb)}))
+	assert.Equals(t, c1.NotAfter, c2.NotAfter)
+}
+
+func Test_newDefaultDurationOption(t *testing.T) {
+	jitter := 10
+	c, err := NewClaimer(nil, globalProvisionerClaims)
+	assert.FatalError(t, err)
+	assert.Equals(t, newDefaultDurationOption(c), profileDefaultDuration(24*time.Hour))
+
+	c, err = NewClaimer(&Claims{TLSDurJitter: &jitter}, globalProvisionerClaims)
+	assert.FatalError(t, err)
+	assert.Equals(t, newDefaultDurationOption(c), &profileDurationJitter{
+		def:     profileDefaultDuration(24 * time.Hour),
+		percent: 10,
+		min:     5 * time.Minute,
+		max:     24 * time.Hour,
+	})
+
+	// The jitter never goes above the max duration.
+	durationJitterInt63n = func(n int64) int64 { return n - 1 }
+	t.Cleanup(func() { durationJitterInt63n = mathrand.Int63n })
+	cert := new(x509.Certificate)
+	assert.FatalError(t, newDefaultDurationOption(c).(CertificateModifier).Modify(cert, SignOptions{}))
+	assert.Equals(t, cert.NotAfter.Sub(cert.NotBefore), 24*time.Hour)
+}
+
 func Test_newProvisionerExtension_Option(t *testing.T) {
 	type test struct {
 		cert  *x509.Certificate
@@ -663,6 +734,29 @@ func Test_newProvisionerExtension_Option(t *testing.T) {
 	}
 }
 
+func TestMustStapleExtension(t *testing.T) {
+	mustStaple := pkix.Extension{Id: oidTLSFeature, Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05}}
+	tests := map[string]struct {
+		csr  *x509.CertificateRequest
+		want bool
+	}{
+		"ok/status-request":  {&x509.CertificateRequest{Extensions: []pkix.Extension{{Id: []int{1, 2, 3}}, mustStaple}}, true},
+		"ok/many-features":   {&x509.CertificateRequest{Extensions: []pkix.Extension{{Id: oidTLSFeature, Value: []byte{0x30, 0x06, 0x02, 0x01, 0x11, 0x02, 0x01, 0x05}}}}, true},
+		"ok/no-extensions":   {&x509.CertificateRequest{}, false},
+		"ok/other-feature":   {&x509.CertificateRequest{Extensions: []pkix.Extension{{Id: oidTLSFeature, Value: []byte{0x30, 0x03, 0x02, 0x01, 0x11}}}}, false},
+		"ok/invalid-feature": {&x509.CertificateRequest{Extensions: []pkix.Extension{{Id: oidTLSFeature, Value: []byte{0x05}}}}, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ext, ok := MustStapleExtension(tt.csr)
+			assert.Equals(t, ok, tt.want)
+			if tt.want {
+				assert.Equals(t, ext.Id, oidTLSFeature)
+			}
+		})
+	}
+}
+
 func Test_profileLimitDuration_Option(t *testing.T) {
 	n, fn := mockNow()
 	defer fn()
@@ -768,3 +862,43 @@ func Test_profileLimitDuration_Option(t *testing.T) {
 		})
 	}
 }
+
+func Test_withX509Options(t *testing.T) {
+	so := []SignOption{defaultPublicKeyValidator{}}
+	nc := &NameConstraints{PermittedDNSDomains: []string{"example.com"}}
+	cp := CertificatePolicies{{ID: "2.5.29.32.0", CPS: []string{"https://example.com/cps"}}}
+	tests := []struct {
+		name    string
+		options *Options
+		want    []SignOption
+		wantErr bool
+	}{
+		{"ok/nil", nil, so, false},
+		{"ok/empty", &Options{X509: &X509Options{}}, so, false},
+		{"ok/algorithm", &Options{X509: &X509Options{SignatureAlgorithm: "ECDSA-SHA384"}},
+			[]SignOption{defaultPublicKeyValidator{}, signatureAlgorithmEnforcer(x509.ECDSAWithSHA384)}, false},
+		{"ok/allowCA", &Options{X509: &X509Options{AllowCA: true}},
+			[]SignOption{defaultPublicKeyValidator{}, CAOption{}}, false},
+		{"ok/nameConstraints", &Options{X509: &X509Options{SignatureAlgorithm: "ECDSA-SHA384", AllowCA: true, NameConstraints: nc}},
+			[]SignOption{defaultPublicKeyValidator{}, signatureAlgorithmEnforcer(x509.ECDSAWithSHA384), CAOption{NameConstraints: nc}}, false},
+		{"ok/certificatePolicies", &Options{X509: &X509Options{CertificatePolicies: cp}},
+			[]SignOption{defaultPublicKeyValidator{}, certificatePoliciesEnforcer(cp)}, false},
+		{"fail/unsupported", &Options{X509: &X509Options{SignatureAlgorithm: "MD5-RSA"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withX509Options(tt.options, append([]SignOption{}, so...))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("withX509Options() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equals(t, got, tt.want)
+		})
+	}
+}
+
+func Test_signatureAlgorithmEnforcer_Enforce(t *testing.T) {
+	cert := &x509.Certificate{SignatureAlgorithm: x509.ECDSAWithSHA256}
+	assert.FatalError(t, signatureAlgorithmEnforcer(x509.ECDSAWithSHA384).Enforce(cert))
+	assert.Equals(t, cert.SignatureAlgorithm, x509.ECDSAWithSHA384)
+}
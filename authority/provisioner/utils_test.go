@@ -814,6 +814,43 @@ func generateOIDCToken(sub, iss, aud, email, preferredUsername string, iat time.
 	return jose.Signed(sig).Claims(claims).CompactSerialize()
 }
 
+func generateGitHubActionsToken(iss, aud, repository, ref, workflow string, iat time.Time, jwk *jose.JSONWebKey) (string, error) {
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("kid", jwk.KeyID)
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key}, so)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := randutil.ASCII(64)
+	if err != nil {
+		return "", err
+	}
+
+	claims := struct {
+		jose.Claims
+		Repository string `json:"repository"`
+		Ref        string `json:"ref"`
+		Workflow   string `json:"workflow"`
+	}{
+		Claims: jose.Claims{
+			ID:        id,
+			Subject:   "repo:" + repository + ":ref:" + ref,
+			Issuer:    iss,
+			IssuedAt:  jose.NewNumericDate(iat),
+			NotBefore: jose.NewNumericDate(iat),
+			Expiry:    jose.NewNumericDate(iat.Add(5 * time.Minute)),
+			Audience:  []string{aud},
+		},
+		Repository: repository,
+		Ref:        ref,
+		Workflow:   workflow,
+	}
+	return jose.Signed(sig).Claims(claims).CompactSerialize()
+}
+
 func generateX5CSSHToken(jwk *jose.JSONWebKey, claims *x5cPayload, tokOpts ...tokOption) (string, error) {
 	so := new(jose.SignerOptions)
 	so.WithType("JWT")
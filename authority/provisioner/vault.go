@@ -0,0 +1,318 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/errs"
+	"go.step.sm/crypto/jose"
+	"go.step.sm/crypto/x509util"
+)
+
+// DefaultVaultRoleClaim is the default claim of the Vault identity tokens
+// checked against the Roles of a Vault provisioner.
+const DefaultVaultRoleClaim = "role"
+
+// vaultPayload represents the fields of the Vault identity token payload, the
+// rest of the claims, like the ones added by the templates of the Vault role,
+// are available in the raw payload.
+type vaultPayload struct {
+	jose.Claims
+	Namespace string `json:"namespace"`
+}
+
+// Vault is the provisioner that authenticates the workloads using the identity
+// tokens issued by a HashiCorp Vault server, the tokens of the
+// identity/oidc/token/:role endpoint, or the ID tokens of a Vault OIDC
+// provider if Provider is set.
+//
+// The issuer and the keys of the tokens are discovered from the OpenID
+// configuration of the Vault server at Address, in the given Namespace. The
+// tokens must be issued for the given Audience, the client_id of the Vault
+// role, and if Roles is set, the RoleClaim of the token, "role" by default,
+// must match one of them. Each role can be an exact value or a glob pattern
+// using the syntax of path.Match.
+//
+// SANClaims is the list of claims of the token used as the SANs of the
+// certificate, usually claims added with the identity metadata templates of
+// the Vault role, e.g. "metadata.hostname" for the hostname key of the
+// metadata object, the subject is used by default. Claims with a list of
+// strings add all of them.
+//
+// Each token can only be used once.
+type Vault struct {
+	*base
+	ID            string   `json:"-"`
+	Type          string   `json:"type"`
+	Name          string   `json:"name"`
+	Address       string   `json:"address"`
+	Namespace     string   `json:"namespace,omitempty"`
+	Provider      string   `json:"provider,omitempty"`
+	Audience      string   `json:"audience"`
+	RoleClaim     string   `json:"roleClaim,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	SANClaims     []string `json:"sanClaims,omitempty"`
+	Claims        *Claims  `json:"claims,omitempty"`
+	Options       *Options `json:"options,omitempty"`
+	configuration openIDConfiguration
+	keyStore      *keyStore
+	claimer       *Claimer
+}
+
+// GetID returns the provisioner unique identifier, the Vault provisioner uses
+// the audience for this.
+func (p *Vault) GetID() string {
+	if p.ID != "" {
+		return p.ID
+	}
+	return p.GetIDForToken()
+}
+
+// GetIDForToken returns an identifier that will be used to load the provisioner
+// from a token.
+func (p *Vault) GetIDForToken() string {
+	return p.Audience
+}
+
+// GetTokenID returns an empty id, so the hash of the token is used to avoid
+// its reuse, the Vault identity tokens do not have a jti claim.
+func (p *Vault) GetTokenID(ott string) (string, error) {
+	if _, err := jose.ParseSigned(ott); err != nil {
+		return "", errors.Wrap(err, "error parsing token")
+	}
+	return "", nil
+}
+
+// GetName returns the name of the provisioner.
+func (p *Vault) GetName() string {
+	return p.Name
+}
+
+// GetType returns the type of provisioner.
+func (p *Vault) GetType() Type {
+	return TypeVault
+}
+
+// GetEncryptedKey is not available in a Vault provisioner.
+func (p *Vault) GetEncryptedKey() (kid, key string, ok bool) {
+	return "", "", false
+}
+
+// GetOptions returns the configured provisioner options.
+func (p *Vault) GetOptions() *Options {
+	return p.Options
+}
+
+// configurationEndpoint returns the url of the OpenID configuration of the
+// Vault identity tokens or of the Vault OIDC provider.
+func (p *Vault) configurationEndpoint() (string, error) {
+	u, err := url.Parse(p.Address)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing address %s", p.Address)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.Errorf("address %s is not a valid http or https url", p.Address)
+	}
+	elems := []string{"/", u.Path, "v1", p.Namespace, "identity/oidc"}
+	if p.Provider != "" {
+		elems = append(elems, "provider", p.Provider)
+	}
+	u.Path = path.Join(append(elems, ".well-known/openid-configuration")...)
+	return u.String(), nil
+}
+
+// Init validates and initializes the Vault provisioner.
+func (p *Vault) Init(config Config) (err error) {
+	switch {
+	case p.Type == "":
+		return errors.New("type cannot be empty")
+	case p.Name == "":
+		return errors.New("name cannot be empty")
+	case p.Address == "":
+		return errors.New("address cannot be empty")
+	case p.Audience == "":
+		return errors.New("audience cannot be empty")
+	}
+
+	for _, role := range p.Roles {
+		if _, err := path.Match(role, ""); err != nil {
+			return errors.Wrapf(err, "error parsing role %s", role)
+		}
+	}
+	for _, claim := range p.SANClaims {
+		if claim == "" || strings.HasPrefix(claim, ".") || strings.HasSuffix(claim, ".") {
+			return errors.Errorf("sanClaims %q is not valid", claim)
+		}
+	}
+
+	if err := p.Options.GetX509Options().Validate(); err != nil {
+		return err
+	}
+
+	// Update claims with global ones
+	if p.claimer, err = NewClaimer(p.Claims, config.Claims); err != nil {
+		return err
+	}
+
+	// Discover the issuer and the keys of the Vault server
+	endpoint, err := p.configurationEndpoint()
+	if err != nil {
+		return err
+	}
+	if err := getAndDecode(endpoint, &p.configuration); err != nil {
+		return err
+	}
+	if err := p.configuration.Validate(); err != nil {
+		return errors.Wrapf(err, "error parsing %s", endpoint)
+	}
+	p.keyStore, err = newKeyStore(p.configuration.JWKSetURI)
+	return err
+}
+
+// authorizeToken validates the signature and the claims of a Vault identity
+// token, and returns its payload and its raw claims.
+func (p *Vault) authorizeToken(token string) (*vaultPayload, map[string]interface{}, error) {
+	jwt, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, nil, errs.Wrap(http.StatusUnauthorized, err,
+			"vault.authorizeToken; error parsing vault token")
+	}
+
+	var (
+		found  bool
+		claims vaultPayload
+		raw    map[string]interface{}
+	)
+	for _, key := range p.keyStore.Get(jwt.Headers[0].KeyID) {
+		if err := jwt.Claims(key, &claims, &raw); err == nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil, errs.Unauthorized("vault.authorizeToken; cannot validate vault token")
+	}
+
+	// According to "rfc7519 JSON Web Token" acceptable skew should be no more
+	// than a few minutes.
+	if err := claims.ValidateWithLeeway(jose.Expected{
+		Issuer:   p.configuration.Issuer,
+		Audience: jose.Audience{p.Audience},
+		Time:     time.Now().UTC(),
+	}, time.Minute); err != nil {
+		return nil, nil, errs.Wrap(http.StatusUnauthorized, err,
+			"vault.authorizeToken; failed to validate vault token payload")
+	}
+
+	if len(p.Roles) > 0 {
+		roleClaim := p.RoleClaim
+		if roleClaim == "" {
+			roleClaim = DefaultVaultRoleClaim
+		}
+		var allowed bool
+		for _, role := range lookupClaim(raw, roleClaim) {
+			if matchAnyPattern(p.Roles, role) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, nil, errs.Unauthorized("vault.authorizeToken; failed to validate vault token payload: role is not allowed")
+		}
+	}
+
+	return &claims, raw, nil
+}
+
+// AuthorizeSign validates the given token and returns the sign options that
+// will be applied to the certificate.
+func (p *Vault) AuthorizeSign(ctx context.Context, token string) ([]SignOption, error) {
+	claims, raw, err := p.authorizeToken(token)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "vault.AuthorizeSign")
+	}
+
+	var sans []string
+	if len(p.SANClaims) == 0 {
+		sans = []string{claims.Subject}
+	}
+	for _, claim := range p.SANClaims {
+		sans = append(sans, lookupClaim(raw, claim)...)
+	}
+	if len(sans) == 0 || sans[0] == "" {
+		return nil, errs.Unauthorized("vault.AuthorizeSign; vault token does not contain any san claim")
+	}
+
+	// Certificate templates
+	data := x509util.CreateTemplateData(sans[0], sans)
+	if v, err := unsafeParseSigned(token); err == nil {
+		data.SetToken(v)
+	}
+	data.Set("Vault", map[string]string{
+		"Namespace": claims.Namespace,
+		"Subject":   claims.Subject,
+	})
+
+	templateOptions, err := TemplateOptions(p.Options, data)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "vault.AuthorizeSign")
+	}
+
+	return withX509Options(p.Options, []SignOption{
+		templateOptions,
+		// modifiers / withOptions
+		newProvisionerExtensionOption(TypeVault, p.Name, p.Audience),
+		newDefaultDurationOption(p.claimer),
+		// validators
+		commonNameSliceValidator(sans),
+		defaultSANsValidator(sans),
+		defaultPublicKeyValidator{},
+		newValidityValidator(p.claimer.MinTLSCertDuration(), p.claimer.MaxTLSCertDuration()),
+	})
+}
+
+// AuthorizeRenew returns an error if the renewal is disabled.
+func (p *Vault) AuthorizeRenew(ctx context.Context, cert *x509.Certificate) error {
+	if p.claimer.IsDisableRenewal() {
+		return errs.Unauthorized("vault.AuthorizeRenew; renew is disabled for vault provisioner '%s'", p.GetName())
+	}
+	return nil
+}
+
+// lookupClaim returns the string values of the claim with the given name. The
+// name can be a dot-separated path to a claim in a nested object, e.g.
+// "metadata.hostname", and the claim can be a string or a list of strings.
+func lookupClaim(claims map[string]interface{}, name string) []string {
+	var v interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if v, ok = m[key]; !ok {
+			return nil
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			if s, ok := e.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
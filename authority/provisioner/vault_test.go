@@ -0,0 +1,231 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/errs"
+	"go.step.sm/crypto/jose"
+)
+
+// generateVaultServer returns a server with the OpenID configuration and the
+// keys of the identity tokens of a Vault server, and the key used to sign
+// them.
+func generateVaultServer(t *testing.T) (*httptest.Server, *jose.JSONWebKey) {
+	t.Helper()
+	jwk, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{}
+		switch r.RequestURI {
+		case "/v1/identity/oidc/.well-known/openid-configuration":
+			v = openIDConfiguration{Issuer: srv.URL + "/v1/identity/oidc", JWKSetURI: srv.URL + "/v1/identity/oidc/.well-known/keys"}
+		case "/v1/identity/oidc/.well-known/keys":
+			v = jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk.Public()}}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+	srv.Start()
+	return srv, jwk
+}
+
+func generateVaultToken(iss, aud string, claims map[string]interface{}, jwk *jose.JSONWebKey) (string, error) {
+	so := new(jose.SignerOptions)
+	so.WithType("JWT")
+	so.WithHeader("kid", jwk.KeyID)
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key}, so)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return jose.Signed(sig).Claims(jose.Claims{
+		Subject:  "0b8d7f1e-entity-id",
+		Issuer:   iss,
+		IssuedAt: jose.NewNumericDate(now),
+		Expiry:   jose.NewNumericDate(now.Add(5 * time.Minute)),
+		Audience: []string{aud},
+	}).Claims(claims).CompactSerialize()
+}
+
+func TestVault_configurationEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		vault   *Vault
+		want    string
+		wantErr bool
+	}{
+		{"ok", &Vault{Address: "https://vault.example.com:8200"}, "https://vault.example.com:8200/v1/identity/oidc/.well-known/openid-configuration", false},
+		{"ok/path", &Vault{Address: "https://example.com/vault/"}, "https://example.com/vault/v1/identity/oidc/.well-known/openid-configuration", false},
+		{"ok/namespace", &Vault{Address: "https://vault.example.com", Namespace: "ns1"}, "https://vault.example.com/v1/ns1/identity/oidc/.well-known/openid-configuration", false},
+		{"ok/provider", &Vault{Address: "https://vault.example.com", Provider: "step"}, "https://vault.example.com/v1/identity/oidc/provider/step/.well-known/openid-configuration", false},
+		{"fail/scheme", &Vault{Address: "vault.example.com"}, "", true},
+		{"fail/parse", &Vault{Address: "https://vault.example.com:port"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.vault.configurationEndpoint()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Vault.configurationEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Vault.configurationEndpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVault_Init(t *testing.T) {
+	srv, _ := generateVaultServer(t)
+	defer srv.Close()
+	config := Config{Claims: globalProvisionerClaims}
+
+	tests := []struct {
+		name    string
+		vault   *Vault
+		wantErr bool
+	}{
+		{"ok", &Vault{Type: "Vault", Name: "vault", Address: srv.URL, Audience: "step"}, false},
+		{"ok/roles", &Vault{Type: "Vault", Name: "vault", Address: srv.URL, Audience: "step", Roles: []string{"web-*"}, SANClaims: []string{"metadata.hostname"}}, false},
+		{"fail/type", &Vault{Name: "vault", Address: srv.URL, Audience: "step"}, true},
+		{"fail/name", &Vault{Type: "Vault", Address: srv.URL, Audience: "step"}, true},
+		{"fail/address", &Vault{Type: "Vault", Name: "vault", Audience: "step"}, true},
+		{"fail/audience", &Vault{Type: "Vault", Name: "vault", Address: srv.URL}, true},
+		{"fail/roles", &Vault{Type: "Vault", Name: "vault", Address: srv.URL, Audience: "step", Roles: []string{"web-["}}, true},
+		{"fail/san-claims", &Vault{Type: "Vault", Name: "vault", Address: srv.URL, Audience: "step", SANClaims: []string{"metadata."}}, true},
+		{"fail/claims", &Vault{Type: "Vault", Name: "vault", Address: srv.URL, Audience: "step", Claims: &Claims{DefaultTLSDur: &Duration{0}}}, true},
+		{"fail/discovery", &Vault{Type: "Vault", Name: "vault", Address: srv.URL, Audience: "step", Provider: "missing"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.vault.Init(config); (err != nil) != tt.wantErr {
+				t.Errorf("Vault.Init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVault_AuthorizeSign(t *testing.T) {
+	srv, jwk := generateVaultServer(t)
+	defer srv.Close()
+	issuer := srv.URL + "/v1/identity/oidc"
+
+	p := &Vault{
+		Type:      "Vault",
+		Name:      "vault",
+		Address:   srv.URL,
+		Audience:  "step",
+		Roles:     []string{"web-*"},
+		SANClaims: []string{"metadata.hostname", "metadata.aliases"},
+	}
+	assert.FatalError(t, p.Init(Config{Claims: globalProvisionerClaims}))
+	assert.Equals(t, p.GetID(), "step")
+	assert.Equals(t, p.GetType(), TypeVault)
+
+	metadata := map[string]interface{}{
+		"role": "web-frontend",
+		"metadata": map[string]interface{}{
+			"hostname": "web1.example.com",
+			"aliases":  []string{"web.example.com", "10.0.0.1"},
+		},
+	}
+	ok, err := generateVaultToken(issuer, "step", metadata, jwk)
+	assert.FatalError(t, err)
+	wrongAudience, err := generateVaultToken(issuer, "other", metadata, jwk)
+	assert.FatalError(t, err)
+	wrongIssuer, err := generateVaultToken("https://vault.example.com/v1/identity/oidc", "step", metadata, jwk)
+	assert.FatalError(t, err)
+	wrongRole, err := generateVaultToken(issuer, "step", map[string]interface{}{
+		"role":     "db",
+		"metadata": metadata["metadata"],
+	}, jwk)
+	assert.FatalError(t, err)
+	noSANs, err := generateVaultToken(issuer, "step", map[string]interface{}{"role": "web-backend"}, jwk)
+	assert.FatalError(t, err)
+	otherKey, err := generateJSONWebKey()
+	assert.FatalError(t, err)
+	wrongKey, err := generateVaultToken(issuer, "step", metadata, otherKey)
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name    string
+		token   string
+		code    int
+		wantErr bool
+	}{
+		{"ok", ok, 0, false},
+		{"fail/audience", wrongAudience, http.StatusUnauthorized, true},
+		{"fail/issuer", wrongIssuer, http.StatusUnauthorized, true},
+		{"fail/role", wrongRole, http.StatusUnauthorized, true},
+		{"fail/no-sans", noSANs, http.StatusUnauthorized, true},
+		{"fail/key", wrongKey, http.StatusUnauthorized, true},
+		{"fail/token", "foo", http.StatusUnauthorized, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.AuthorizeSign(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Vault.AuthorizeSign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, sc.StatusCode(), tt.code)
+				return
+			}
+			assert.Len(t, 7, got)
+			for _, o := range got {
+				switch v := o.(type) {
+				case commonNameSliceValidator:
+					assert.Equals(t, []string(v), []string{"web1.example.com", "web.example.com", "10.0.0.1"})
+				case defaultSANsValidator:
+					assert.Equals(t, []string(v), []string{"web1.example.com", "web.example.com", "10.0.0.1"})
+				case *provisionerExtensionOption:
+					assert.Equals(t, v.Type, int(TypeVault))
+					assert.Equals(t, v.Name, "vault")
+					assert.Equals(t, v.CredentialID, "step")
+				}
+			}
+		})
+	}
+}
+
+func Test_lookupClaim(t *testing.T) {
+	claims := map[string]interface{}{
+		"sub":   "subject",
+		"empty": "",
+		"list":  []interface{}{"a", 1, "", "b"},
+		"metadata": map[string]interface{}{
+			"hostname": "web1.example.com",
+		},
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"sub", []string{"subject"}},
+		{"list", []string{"a", "b"}},
+		{"metadata.hostname", []string{"web1.example.com"}},
+		{"empty", nil},
+		{"metadata", nil},
+		{"metadata.missing", nil},
+		{"sub.missing", nil},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, lookupClaim(claims, tt.name), tt.want)
+		})
+	}
+}
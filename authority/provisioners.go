@@ -635,6 +635,8 @@ func ProvisionerToCertificates(p *linkedca.Provisioner) (provisioner.Interface,
 			Claims: claims,
 		}, nil
 	case *linkedca.ProvisionerDetails_ACME:
+		// linkedca.ACMEProvisioner does not have the Enabled field, the
+		// provisioners in the admin database are always enabled.
 		cfg := d.ACME
 		return &provisioner.ACME{
 			ID:      p.Id,
@@ -852,6 +854,8 @@ func ProvisionerToLinkedca(p provisioner.Interface) (*linkedca.Provisioner, erro
 			Type: linkedca.Provisioner_ACME,
 			Name: p.GetName(),
 			Details: &linkedca.ProvisionerDetails{
+				// Enabled cannot be converted, linkedca.ACMEProvisioner
+				// does not have the field.
 				Data: &linkedca.ProvisionerDetails_ACME{
 					ACME: &linkedca.ACMEProvisioner{
 						ForceCn: p.ForceCN,
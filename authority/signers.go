@@ -0,0 +1,39 @@
+package authority
+
+import (
+	"crypto/x509"
+	"sort"
+)
+
+// GetX509Signers returns the certificates of the active X.509 issuers, the
+// intermediate used by default, the issuers selected by key type, sorted by
+// key type, and the issuers configured in the provisioners, sorted by
+// provisioner id. The default intermediate is not included if it is managed by
+// an external CAS.
+func (a *Authority) GetX509Signers() ([]*x509.Certificate, error) {
+	var signers []*x509.Certificate
+	if a.intermediateX509 != nil {
+		signers = append(signers, a.intermediateX509)
+	}
+	signers = append(signers, sortedCertificates(a.x509KeyIssuerCerts)...)
+	// The issuers of the provisioners are replaced when the provisioners are
+	// reloaded.
+	a.adminMutex.RLock()
+	defer a.adminMutex.RUnlock()
+	signers = append(signers, sortedCertificates(a.x509IssuerCerts)...)
+	return signers, nil
+}
+
+// sortedCertificates returns the certificates in the map sorted by key.
+func sortedCertificates(issuers map[string]*x509.Certificate) []*x509.Certificate {
+	ids := make([]string, 0, len(issuers))
+	for id := range issuers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	signers := make([]*x509.Certificate, 0, len(ids))
+	for _, id := range ids {
+		signers = append(signers, issuers[id])
+	}
+	return signers
+}
@@ -3,20 +3,29 @@ package authority
 import (
 	"context"
 	"crypto"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/admin"
 	"github.com/smallstep/certificates/authority/config"
 	"github.com/smallstep/certificates/authority/provisioner"
 	casapi "github.com/smallstep/certificates/cas/apiv1"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/hooks"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/nosql"
 	"go.step.sm/crypto/jose"
 	"go.step.sm/crypto/keyutil"
 	"go.step.sm/crypto/pemutil"
@@ -29,6 +38,89 @@ func (a *Authority) GetTLSOptions() *config.TLSOptions {
 	return a.config.TLS
 }
 
+// setAuthorityKeyID sets the authority key identifier of the certificate to the
+// subject key identifier of the issuer, and removes the extension if it was set
+// as an extra extension. If the issuer has no subject key identifier the
+// certificate won't have an authority key identifier. Nothing is changed if the
+// issuer is not known, e.g. when it's managed by an external CAS.
+func setAuthorityKeyID(crt, issuer *x509.Certificate) {
+	if issuer == nil {
+		return
+	}
+	crt.AuthorityKeyId = issuer.SubjectKeyId
+	exts := crt.ExtraExtensions[:0]
+	for _, ext := range crt.ExtraExtensions {
+		if !ext.Id.Equal(oidAuthorityKeyIdentifier) {
+			exts = append(exts, ext)
+		}
+	}
+	crt.ExtraExtensions = exts
+}
+
+// deduplicateSANs removes the duplicated DNS names, IP addresses, email
+// addresses and URIs of the certificate, keeping the first occurrence. If
+// strict is true it returns an error instead.
+func deduplicateSANs(crt *x509.Certificate, strict bool) error {
+	var dup string
+	seen := make(map[string]bool)
+	keep := func(typ, key, value string) bool {
+		key = typ + ":" + key
+		if seen[key] {
+			if dup == "" {
+				dup = value
+			}
+			return false
+		}
+		seen[key] = true
+		return true
+	}
+
+	var dnsNames []string
+	for _, name := range crt.DNSNames {
+		if keep("dns", strings.ToLower(name), name) {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	var ips []net.IP
+	for _, ip := range crt.IPAddresses {
+		if keep("ip", ip.String(), ip.String()) {
+			ips = append(ips, ip)
+		}
+	}
+	var emails []string
+	for _, email := range crt.EmailAddresses {
+		key := email
+		if i := strings.LastIndex(email, "@"); i >= 0 {
+			key = email[:i] + strings.ToLower(email[i:])
+		}
+		if keep("email", key, email) {
+			emails = append(emails, email)
+		}
+	}
+	var uris []*url.URL
+	for _, u := range crt.URIs {
+		v := *u
+		v.Scheme = strings.ToLower(v.Scheme)
+		v.Host = strings.ToLower(v.Host)
+		if keep("uri", v.String(), u.String()) {
+			uris = append(uris, u)
+		}
+	}
+
+	switch {
+	case dup == "":
+		return nil
+	case strict:
+		return errors.Errorf("certificate request contains the duplicated SAN %s", dup)
+	default:
+		crt.DNSNames = dnsNames
+		crt.IPAddresses = ips
+		crt.EmailAddresses = emails
+		crt.URIs = uris
+		return nil
+	}
+}
+
 var oidAuthorityKeyIdentifier = asn1.ObjectIdentifier{2, 5, 29, 35}
 var oidSubjectKeyIdentifier = asn1.ObjectIdentifier{2, 5, 29, 14}
 
@@ -65,6 +157,30 @@ func withDefaultASN1DN(def *config.ASN1DN) provisioner.CertificateModifierFunc {
 	}
 }
 
+// GenerateKey generates a new key of the given type, curve and size, used
+// when the key of a certificate is generated on behalf of a client. The key is
+// always generated in memory, even if the authority keys are in a KMS, because
+// it has to be returned to the client, and it's never stored. RSA keys can
+// only be 2048, 3072 or 4096 bits, 2048 if the size is not set, as bigger keys
+// take too long to generate.
+func (a *Authority) GenerateKey(kty, crv string, size int) (crypto.Signer, error) {
+	if kty == "RSA" {
+		switch size {
+		case 0:
+			size = keyutil.DefaultKeySize
+		case 2048, 3072, 4096:
+		default:
+			return nil, errs.BadRequest("authority.GenerateKey: RSA key size %d is not supported; "+
+				"it must be 2048, 3072 or 4096", size)
+		}
+	}
+	signer, err := keyutil.GenerateSigner(kty, crv, size)
+	if err != nil {
+		return nil, errs.Wrap(http.StatusBadRequest, err, "authority.GenerateKey")
+	}
+	return signer, nil
+}
+
 // Sign creates a signed certificate from a certificate signing request.
 func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.SignOptions, extraOpts ...provisioner.SignOption) ([]*x509.Certificate, error) {
 	var (
@@ -72,6 +188,8 @@ func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.Sign
 		certValidators []provisioner.CertificateValidator
 		certModifiers  []provisioner.CertificateModifier
 		certEnforcers  []provisioner.CertificateEnforcer
+		certData       *db.CertificateData
+		caOption       *provisioner.CAOption
 	)
 
 	opts := []interface{}{errs.WithKeyVal("csr", csr), errs.WithKeyVal("signOptions", signOpts)}
@@ -85,8 +203,32 @@ func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.Sign
 	// Set backdate with the configured value
 	signOpts.Backdate = a.config.AuthorityConfig.Backdate.Duration
 
+	// Signs the certificate with the issuer for the key type of the request,
+	// unless the provisioner sets a different one.
+	x509CAService := a.x509CAServiceFor(csr.PublicKey)
+	issuerCert := a.x509IssuerCertFor(csr.PublicKey)
 	for _, op := range extraOpts {
 		switch k := op.(type) {
+		// Signs the certificate with the issuer configured in a provisioner.
+		case provisioner.IssuerOption:
+			srv, crt, ok := a.x509ProvisionerIssuer(k.ProvisionerID)
+			if !ok {
+				return nil, errs.InternalServer("authority.Sign; issuer for provisioner %s not found", append([]interface{}{k.ProvisionerID}, opts...)...)
+			}
+			x509CAService = srv
+			issuerCert = crt
+
+		// Stores the ACME account and order with the certificate.
+		case provisioner.ACMEOrderOption:
+			certData = &db.CertificateData{
+				AccountID: k.AccountID,
+				OrderID:   k.OrderID,
+			}
+
+		// Allows the issuance of CA certificates.
+		case provisioner.CAOption:
+			caOption = &k
+
 		// Adds new options to NewCertificate
 		case provisioner.CertificateOptions:
 			certOptions = append(certOptions, k.Options(signOpts)...)
@@ -140,6 +282,11 @@ func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.Sign
 		}
 	}
 
+	// Remove the duplicated SANs, or reject them in strict mode.
+	if err := deduplicateSANs(leaf, a.config.AuthorityConfig.StrictSANs); err != nil {
+		return nil, errs.ApplyOptions(errs.BadRequestErr(err, "%s", err.Error()), opts...)
+	}
+
 	// Certificate validation.
 	for _, v := range certValidators {
 		if err := v.Valid(leaf, signOpts); err != nil {
@@ -154,24 +301,61 @@ func (a *Authority) Sign(csr *x509.CertificateRequest, signOpts provisioner.Sign
 		}
 	}
 
+	// CA certificates require a provisioner that allows them, and get the
+	// name constraints configured in it.
+	if leaf.IsCA {
+		if caOption == nil {
+			return nil, errs.Unauthorized("authority.Sign; provisioner is not allowed to issue CA certificates", opts...)
+		}
+		if err := caOption.NameConstraints.Apply(leaf); err != nil {
+			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Sign; error applying name constraints", opts...)
+		}
+	}
+
+	// The authority key identifier must match the issuer that signs the
+	// certificate, regardless of the value set by the templates.
+	setAuthorityKeyID(leaf, issuerCert)
+
+	if err := a.setSerialNumber(leaf); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Sign", opts...)
+	}
+
 	lifetime := leaf.NotAfter.Sub(leaf.NotBefore.Add(signOpts.Backdate))
-	resp, err := a.x509CAService.CreateCertificate(&casapi.CreateCertificateRequest{
+	resp, err := x509CAService.CreateCertificate(&casapi.CreateCertificateRequest{
 		Template: leaf,
 		CSR:      csr,
 		Lifetime: lifetime,
 		Backdate: signOpts.Backdate,
 	})
 	if err != nil {
+		// Transient KMS errors are reported as a 503 so the client can retry.
+		if kmsapi.IsTransient(err) {
+			return nil, errs.Wrap(http.StatusServiceUnavailable, err, "authority.Sign; error creating certificate", opts...)
+		}
 		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Sign; error creating certificate", opts...)
 	}
 
 	fullchain := append([]*x509.Certificate{resp.Certificate}, resp.CertificateChain...)
+	if err := a.validateCertificateChain(fullchain); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Sign; invalid certificate chain", opts...)
+	}
 	if err = a.storeCertificate(fullchain); err != nil {
 		if err != db.ErrNotImplemented {
 			return nil, errs.Wrap(http.StatusInternalServerError, err,
 				"authority.Sign; error storing certificate in db", opts...)
 		}
 	}
+	if certData != nil {
+		if err = a.storeCertificateData(resp.Certificate, certData); err != nil {
+			if err != db.ErrNotImplemented {
+				return nil, errs.Wrap(http.StatusInternalServerError, err,
+					"authority.Sign; error storing certificate data in db", opts...)
+			}
+		}
+	}
+	if err := a.runIssuanceHooks(hooks.SignEvent, resp.Certificate, certData); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Sign", opts...)
+	}
 
 	return fullchain, nil
 }
@@ -262,7 +446,11 @@ func (a *Authority) Rekey(oldCert *x509.Certificate, pk crypto.PublicKey) ([]*x5
 		newCert.ExtraExtensions = append(newCert.ExtraExtensions, ext)
 	}
 
-	resp, err := a.x509CAService.RenewCertificate(&casapi.RenewCertificateRequest{
+	if err := a.setSerialNumber(newCert); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Rekey", opts...)
+	}
+
+	resp, err := a.x509CAServiceFor(newCert.PublicKey).RenewCertificate(&casapi.RenewCertificateRequest{
 		Template: newCert,
 		Lifetime: lifetime,
 		Backdate: backdate,
@@ -272,15 +460,45 @@ func (a *Authority) Rekey(oldCert *x509.Certificate, pk crypto.PublicKey) ([]*x5
 	}
 
 	fullchain := append([]*x509.Certificate{resp.Certificate}, resp.CertificateChain...)
+	if err := a.validateCertificateChain(fullchain); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Rekey; invalid certificate chain", opts...)
+	}
 	if err = a.storeRenewedCertificate(oldCert, fullchain); err != nil {
 		if err != db.ErrNotImplemented {
 			return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Rekey; error storing certificate in db", opts...)
 		}
 	}
+	event := hooks.RenewEvent
+	if isRekey {
+		event = hooks.RekeyEvent
+	}
+	if err := a.runIssuanceHooks(event, resp.Certificate, nil); err != nil {
+		return nil, errs.Wrap(http.StatusInternalServerError, err, "authority.Rekey", opts...)
+	}
 
 	return fullchain, nil
 }
 
+// serialNumberLimit is the upper bound of the serial numbers generated with
+// the random source of the authority, the same used by x509util.
+var serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// setSerialNumber sets the serial number of a certificate template using the
+// random source of the authority. If the source is not set, or the template
+// already has a serial number, the template is not modified, and the serial
+// number is generated by the CAS.
+func (a *Authority) setSerialNumber(crt *x509.Certificate) error {
+	if a.randomSource == nil || crt.SerialNumber != nil {
+		return nil
+	}
+	sn, err := rand.Int(a.randomSource, serialNumberLimit)
+	if err != nil {
+		return errors.Wrap(err, "error generating serial number")
+	}
+	crt.SerialNumber = sn
+	return nil
+}
+
 // storeCertificate allows to use an extension of the db.AuthDB interface that
 // can log the full chain of certificates.
 //
@@ -321,6 +539,199 @@ func (a *Authority) storeRenewedCertificate(oldCert *x509.Certificate, fullchain
 	return a.db.StoreCertificate(fullchain[0])
 }
 
+// storeCertificateData allows to use an extension of the db.AuthDB interface
+// that can store the issuance metadata of a certificate.
+func (a *Authority) storeCertificateData(crt *x509.Certificate, data *db.CertificateData) error {
+	type certificateDataStorer interface {
+		StoreCertificateData(string, *db.CertificateData) error
+	}
+	if s, ok := a.db.(certificateDataStorer); ok {
+		return s.StoreCertificateData(crt.SerialNumber.String(), data)
+	}
+	return db.ErrNotImplemented
+}
+
+// CertificateInfo contains the issuance metadata of a certificate.
+type CertificateInfo struct {
+	SerialNumber string                  `json:"serialNumber"`
+	Provisioner  *CertificateProvisioner `json:"provisioner,omitempty"`
+	Subject      string                  `json:"subject"`
+	SANs         []string                `json:"sans"`
+	NotBefore    time.Time               `json:"notBefore"`
+	NotAfter     time.Time               `json:"notAfter"`
+	Revoked      bool                    `json:"revoked"`
+	AccountID    string                  `json:"accountID,omitempty"`
+	OrderID      string                  `json:"orderID,omitempty"`
+}
+
+// CertificateProvisioner identifies the provisioner that authorized the
+// issuance of a certificate.
+type CertificateProvisioner struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// GetCertificateInfo returns the issuance metadata of the certificate with the
+// given serial number.
+func (a *Authority) GetCertificateInfo(serial string) (*CertificateInfo, error) {
+	crt, err := a.db.GetCertificate(serial)
+	switch {
+	case nosql.IsErrNotFound(err):
+		return nil, admin.NewError(admin.ErrorNotFoundType, "certificate %s not found", serial)
+	case err == db.ErrNotImplemented:
+		return nil, admin.NewError(admin.ErrorNotImplementedType, "certificate lookup is not supported by the configured database")
+	case err != nil:
+		return nil, admin.WrapErrorISE(err, "error loading certificate %s", serial)
+	}
+	return a.certificateInfo(serial, crt)
+}
+
+// GetCertificateChain returns the certificate with the given serial number
+// followed by the active X.509 issuer that signed it, and whether the
+// certificate has been revoked. If the issuer is no longer active only the
+// certificate is returned.
+func (a *Authority) GetCertificateChain(serial string) ([]*x509.Certificate, bool, error) {
+	crt, err := a.db.GetCertificate(serial)
+	switch {
+	case nosql.IsErrNotFound(err):
+		return nil, false, errs.NotFound("certificate %s not found", serial)
+	case err == db.ErrNotImplemented:
+		return nil, false, errs.NotImplemented("certificate lookup is not supported by the configured database")
+	case err != nil:
+		return nil, false, errs.Wrap(http.StatusInternalServerError, err, "authority.GetCertificateChain; error loading certificate %s", serial)
+	}
+
+	revoked, err := a.db.IsRevoked(serial)
+	if err != nil {
+		return nil, false, errs.Wrap(http.StatusInternalServerError, err, "authority.GetCertificateChain; error checking revocation status of certificate %s", serial)
+	}
+
+	chain := []*x509.Certificate{crt}
+	signers, err := a.GetX509Signers()
+	if err != nil {
+		return nil, false, errs.Wrap(http.StatusInternalServerError, err, "authority.GetCertificateChain")
+	}
+	for _, issuer := range signers {
+		if crt.CheckSignatureFrom(issuer) == nil {
+			chain = append(chain, issuer)
+			break
+		}
+	}
+	return chain, revoked, nil
+}
+
+// Default and maximum number of certificates returned by ListCertificates.
+const (
+	DefaultCertificatesLimit = 100
+	DefaultCertificatesMax   = 1000
+)
+
+// ListCertificates calls fn with the issuance metadata of the certificates
+// that have not expired, in order of expiration, starting after the given
+// cursor. It returns the cursor of the next page, or an empty string if there
+// are no more certificates. The database must be able to iterate over the
+// certificates from a cursor without loading all of them, see
+// db.IterateCertificates.
+func (a *Authority) ListCertificates(cursor string, limit int, fn func(*CertificateInfo) error) (string, error) {
+	type certificateIterator interface {
+		IterateCertificates(string, func(string, *x509.Certificate) (bool, error)) error
+	}
+	iter, ok := a.db.(certificateIterator)
+	if !ok {
+		return "", admin.NewError(admin.ErrorNotImplementedType, "certificate listing is not supported by the configured database")
+	}
+
+	switch {
+	case limit <= 0:
+		limit = DefaultCertificatesLimit
+	case limit > DefaultCertificatesMax:
+		limit = DefaultCertificatesMax
+	}
+
+	var (
+		n          int
+		last, next string
+	)
+	now := time.Now()
+	err := iter.IterateCertificates(cursor, func(serial string, crt *x509.Certificate) (bool, error) {
+		if now.After(crt.NotAfter) {
+			return true, nil
+		}
+		// There are more certificates, stop on the first one of the next page.
+		if n == limit {
+			next = last
+			return false, nil
+		}
+		info, err := a.certificateInfo(serial, crt)
+		if err != nil {
+			return false, err
+		}
+		if err := fn(info); err != nil {
+			return false, err
+		}
+		n++
+		last = serial
+		return true, nil
+	})
+	if err != nil {
+		return "", admin.WrapErrorISE(err, "error listing certificates")
+	}
+	return next, nil
+}
+
+// certificateInfo returns the issuance metadata of the given certificate.
+func (a *Authority) certificateInfo(serial string, crt *x509.Certificate) (*CertificateInfo, error) {
+	revoked, err := a.db.IsRevoked(serial)
+	if err != nil {
+		return nil, admin.WrapErrorISE(err, "error checking revocation status of certificate %s", serial)
+	}
+
+	info := &CertificateInfo{
+		SerialNumber: serial,
+		Subject:      crt.Subject.CommonName,
+		SANs:         []string{},
+		NotBefore:    crt.NotBefore,
+		NotAfter:     crt.NotAfter,
+		Revoked:      revoked,
+	}
+	info.SANs = append(info.SANs, crt.DNSNames...)
+	for _, ip := range crt.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.SANs = append(info.SANs, crt.EmailAddresses...)
+	for _, u := range crt.URIs {
+		info.SANs = append(info.SANs, u.String())
+	}
+
+	// The provisioner might have been removed after the certificate was issued,
+	// and the certificates without the provisioner extension load the noop
+	// provisioner.
+	if p, err := a.LoadProvisionerByCertificate(crt); err == nil && !provisioner.IsNoop(p) {
+		info.Provisioner = &CertificateProvisioner{
+			ID:   p.GetID(),
+			Name: p.GetName(),
+			Type: p.GetType().String(),
+		}
+	}
+
+	type certificateDataGetter interface {
+		GetCertificateData(string) (*db.CertificateData, error)
+	}
+	if g, ok := a.db.(certificateDataGetter); ok {
+		data, err := g.GetCertificateData(serial)
+		if err != nil {
+			return nil, admin.WrapErrorISE(err, "error loading data of certificate %s", serial)
+		}
+		if data != nil {
+			info.AccountID = data.AccountID
+			info.OrderID = data.OrderID
+		}
+	}
+
+	return info, nil
+}
+
 // RevokeOptions are the options for the Revoke API.
 type RevokeOptions struct {
 	Serial      string
@@ -463,6 +874,60 @@ func (a *Authority) revokeSSH(crt *ssh.Certificate, rci *db.RevokedCertificateIn
 	return a.db.Revoke(rci)
 }
 
+// RevokeByKeyFingerprint revokes all the certificates with the public key with
+// the given hex encoded SHA-256 fingerprint, e.g. after a key compromise, and
+// returns the serial numbers of the revoked certificates. The certificates
+// that are already revoked are skipped. The database must index the
+// certificates by public key, see db.PublicKeyFingerprint.
+func (a *Authority) RevokeByKeyFingerprint(ctx context.Context, fingerprint string, reasonCode int, reason string) ([]string, error) {
+	type certificatesByKeyGetter interface {
+		GetCertificatesByKey(fingerprint string) ([]string, error)
+	}
+	g, ok := a.db.(certificatesByKeyGetter)
+	if !ok {
+		return nil, admin.NewError(admin.ErrorNotImplementedType, "the database does not index the certificates by public key")
+	}
+	fingerprint = strings.ToLower(fingerprint)
+	serials, err := g.GetCertificatesByKey(fingerprint)
+	if err != nil {
+		return nil, admin.WrapErrorISE(err, "error loading certificates with public key %s", fingerprint)
+	}
+
+	revoked := []string{}
+	for _, serial := range serials {
+		crt, err := a.db.GetCertificate(serial)
+		if err != nil {
+			return revoked, admin.WrapErrorISE(err, "error loading certificate %s", serial)
+		}
+		rci := &db.RevokedCertificateInfo{
+			Serial:     serial,
+			ReasonCode: reasonCode,
+			Reason:     reason,
+			RevokedAt:  time.Now().UTC(),
+		}
+		if p, err := a.LoadProvisionerByCertificate(crt); err == nil {
+			rci.ProvisionerID = p.GetID()
+		}
+		if _, err := a.x509CAService.RevokeCertificate(&casapi.RevokeCertificateRequest{
+			Certificate:  crt,
+			SerialNumber: serial,
+			Reason:       reason,
+			ReasonCode:   reasonCode,
+			PassiveOnly:  true,
+		}); err != nil {
+			return revoked, admin.WrapErrorISE(err, "error revoking certificate %s", serial)
+		}
+		switch err := a.revoke(crt, rci); err {
+		case nil:
+			revoked = append(revoked, serial)
+		case db.ErrAlreadyExists:
+		default:
+			return revoked, admin.WrapErrorISE(err, "error revoking certificate %s", serial)
+		}
+	}
+	return revoked, nil
+}
+
 // GetTLSCertificate creates a new leaf certificate to be used by the CA HTTPS server.
 func (a *Authority) GetTLSCertificate() (*tls.Certificate, error) {
 	fatal := func(err error) (*tls.Certificate, error) {
@@ -1,6 +1,7 @@
 package authority
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
@@ -12,8 +13,17 @@ import (
 	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,13 +31,19 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/config"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/errs"
+	"github.com/smallstep/certificates/hooks"
+	"github.com/smallstep/certificates/kms"
+	kmsapi "github.com/smallstep/certificates/kms/apiv1"
+	"github.com/smallstep/nosql/database"
 	"go.step.sm/crypto/jose"
 	"go.step.sm/crypto/keyutil"
 	"go.step.sm/crypto/pemutil"
 	"go.step.sm/crypto/x509util"
+	"golang.org/x/crypto/ocsp"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
@@ -205,6 +221,21 @@ type basicConstraints struct {
 	MaxPathLen int  `asn1:"optional,default:-1"`
 }
 
+// transientSigner is a crypto.Signer that fails with a transient KMS error the
+// given number of times before signing.
+type transientSigner struct {
+	crypto.Signer
+	failures int
+}
+
+func (s *transientSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, kmsapi.ErrTransient{Message: "rate exceeded"}
+	}
+	return s.Signer.Sign(rand, digest, opts)
+}
+
 func TestAuthority_Sign(t *testing.T) {
 	pub, priv, err := keyutil.GenerateDefaultKeyPair()
 	assert.FatalError(t, err)
@@ -298,6 +329,22 @@ func TestAuthority_Sign(t *testing.T) {
 				code:      http.StatusInternalServerError,
 			}
 		},
+		"fail create cert kms unavailable": func(t *testing.T) *signTest {
+			_a := testAuthority(t)
+			softCAS := _a.x509CAService.(*softcas.SoftCAS)
+			softCAS.Signer = kms.NewRetrySigner(&transientSigner{Signer: softCAS.Signer, failures: 3}, &kmsapi.RetryOptions{
+				MaxAttempts: 2, Backoff: "1ms",
+			})
+			csr := getCSR(t, priv)
+			return &signTest{
+				auth:      _a,
+				csr:       csr,
+				extraOpts: extraOpts,
+				signOpts:  signOpts,
+				err:       errors.New("authority.Sign; error creating certificate"),
+				code:      http.StatusServiceUnavailable,
+			}
+		},
 		"fail provisioner duration claim": func(t *testing.T) *signTest {
 			csr := getCSR(t, priv)
 			_signOpts := provisioner.SignOptions{
@@ -414,6 +461,23 @@ ZYtQ9Ot36qc=
 				notAfter:  signOpts.NotAfter.Time().Truncate(time.Second),
 			}
 		},
+		"ok kms transient error": func(t *testing.T) *signTest {
+			csr := getCSR(t, priv)
+			_a := testAuthority(t)
+			_a.config.AuthorityConfig.Template = a.config.AuthorityConfig.Template
+			softCAS := _a.x509CAService.(*softcas.SoftCAS)
+			softCAS.Signer = kms.NewRetrySigner(&transientSigner{Signer: softCAS.Signer, failures: 2}, &kmsapi.RetryOptions{
+				MaxAttempts: 3, Backoff: "1ms",
+			})
+			return &signTest{
+				auth:      _a,
+				csr:       csr,
+				extraOpts: extraOpts,
+				signOpts:  signOpts,
+				notBefore: signOpts.NotBefore.Time().Truncate(time.Second),
+				notAfter:  signOpts.NotAfter.Time().Truncate(time.Second),
+			}
+		},
 		"ok with enforced modifier": func(t *testing.T) *signTest {
 			bcExt := pkix.Extension{}
 			bcExt.Id = asn1.ObjectIdentifier{2, 5, 29, 19}
@@ -603,6 +667,86 @@ ZYtQ9Ot36qc=
 	}
 }
 
+func Test_deduplicateSANs(t *testing.T) {
+	mustURL := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		assert.FatalError(t, err)
+		return u
+	}
+	crt := &x509.Certificate{
+		DNSNames:       []string{"test.smallstep.com", "TEST.smallstep.com", "other.smallstep.com", "test.smallstep.com"},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::ffff:127.0.0.1"), net.ParseIP("::1")},
+		EmailAddresses: []string{"jane@smallstep.com", "jane@SMALLSTEP.com", "Jane@smallstep.com"},
+		URIs:           []*url.URL{mustURL("https://smallstep.com/jane"), mustURL("HTTPS://SmallStep.com/jane"), mustURL("https://smallstep.com/Jane")},
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		c := *crt
+		assert.FatalError(t, deduplicateSANs(&c, false))
+		assert.Equals(t, c.DNSNames, []string{"test.smallstep.com", "other.smallstep.com"})
+		assert.Equals(t, c.IPAddresses, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")})
+		assert.Equals(t, c.EmailAddresses, []string{"jane@smallstep.com", "Jane@smallstep.com"})
+		assert.Equals(t, c.URIs, []*url.URL{mustURL("https://smallstep.com/jane"), mustURL("https://smallstep.com/Jane")})
+	})
+
+	t.Run("ok/no-duplicates", func(t *testing.T) {
+		c := &x509.Certificate{DNSNames: []string{"test.smallstep.com"}, IPAddresses: []net.IP{net.ParseIP("::1")}}
+		assert.FatalError(t, deduplicateSANs(c, true))
+		assert.Equals(t, c.DNSNames, []string{"test.smallstep.com"})
+		assert.Equals(t, c.IPAddresses, []net.IP{net.ParseIP("::1")})
+	})
+
+	t.Run("fail/strict", func(t *testing.T) {
+		c := *crt
+		err := deduplicateSANs(&c, true)
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "certificate request contains the duplicated SAN TEST.smallstep.com")
+		}
+		assert.Equals(t, c.DNSNames, crt.DNSNames)
+	})
+}
+
+func TestAuthority_Sign_duplicatedSANs(t *testing.T) {
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv, func(csr *x509.CertificateRequest) {
+		csr.DNSNames = []string{"test.smallstep.com", "test.smallstep.com"}
+	})
+
+	a := testAuthority(t)
+	key, err := jose.ReadKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	// The certificate SANs come from the token, so the token has the
+	// duplicated SANs too.
+	authorize := func() []provisioner.SignOption {
+		token, err := generateToken("smallstep test", "step-cli", testAudiences.Sign[0], csr.DNSNames, time.Now(), key)
+		assert.FatalError(t, err)
+		extraOpts, err := a.Authorize(provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod), token)
+		assert.FatalError(t, err)
+		return extraOpts
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		chain, err := a.Sign(csr, provisioner.SignOptions{}, authorize()...)
+		assert.FatalError(t, err)
+		assert.Equals(t, chain[0].DNSNames, []string{"test.smallstep.com"})
+	})
+
+	t.Run("fail/strict", func(t *testing.T) {
+		a.config.AuthorityConfig.StrictSANs = true
+		defer func() {
+			a.config.AuthorityConfig.StrictSANs = false
+		}()
+		_, err := a.Sign(csr, provisioner.SignOptions{}, authorize()...)
+		if assert.NotNil(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusBadRequest)
+			assert.HasPrefix(t, err.Error(), "certificate request contains the duplicated SAN test.smallstep.com")
+		}
+	})
+}
+
 func TestAuthority_Renew(t *testing.T) {
 	a := testAuthority(t)
 	a.config.AuthorityConfig.Template = &ASN1DN{
@@ -1297,3 +1441,1085 @@ func TestAuthority_Revoke(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthority_Sign_acmeIssuer(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, b []byte) string {
+		fn := filepath.Join(dir, name)
+		assert.FatalError(t, os.WriteFile(fn, b, 0600))
+		return fn
+	}
+
+	// The issuer is verified when the authority starts, so the certificates
+	// must be valid now.
+	newCA := func(t *testing.T, name string, parent *x509.Certificate, parentSigner crypto.Signer) (*x509.Certificate, crypto.Signer) {
+		signer, err := keyutil.GenerateDefaultSigner()
+		assert.FatalError(t, err)
+		cr, err := x509util.CreateCertificateRequest(name, nil, signer)
+		assert.FatalError(t, err)
+		template, err := x509util.NewCertificate(cr, x509util.WithTemplate(x509util.DefaultRootTemplate, x509util.CreateTemplateData(name, nil)))
+		assert.FatalError(t, err)
+		crt := template.GetCertificate()
+		crt.NotBefore = time.Now().Add(-time.Minute)
+		crt.NotAfter = crt.NotBefore.Add(24 * time.Hour)
+		if parent == nil {
+			parent, parentSigner = crt, signer
+		}
+		crt, err = x509util.CreateCertificate(crt, parent, signer.Public(), parentSigner)
+		assert.FatalError(t, err)
+		return crt, signer
+	}
+
+	root, rootSigner := newCA(t, "TestRootCA", nil, nil)
+	intermediate, intSigner := newCA(t, "TestIntermediateCA", root, rootSigner)
+	keyBlock, err := pemutil.Serialize(intSigner)
+	assert.FatalError(t, err)
+	rootFile := writeFile("root_ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}))
+	intFile := writeFile("intermediate_ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw}))
+	keyFile := writeFile("intermediate_ca_key", pem.EncodeToMemory(keyBlock))
+
+	clijwk, err := jose.ReadKey("testdata/secrets/step_cli_key_pub.jwk")
+	assert.FatalError(t, err)
+	newConfig := func(issuer *provisioner.ACMEIssuer, roots ...string) *Config {
+		return &Config{
+			Address:          "127.0.0.1:443",
+			Root:             roots,
+			IntermediateCert: "testdata/certs/intermediate_ca.crt",
+			IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+			DNSNames:         []string{"example.com"},
+			Password:         "pass",
+			AuthorityConfig: &AuthConfig{
+				Provisioners: provisioner.List{
+					&provisioner.JWK{Name: "step-cli", Type: "JWK", Key: clijwk},
+					&provisioner.ACME{Name: "acme", Type: "ACME", Issuer: issuer},
+				},
+			},
+		}
+	}
+
+	t.Run("fail/issuer-not-trusted", func(t *testing.T) {
+		_, err := New(newConfig(&provisioner.ACMEIssuer{Certificate: intFile, Key: keyFile}, "testdata/certs/root_ca.crt"))
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "error initializing issuer for provisioner acme: error verifying "+intFile)
+		}
+	})
+
+	t.Run("fail/issuer-key-mismatch", func(t *testing.T) {
+		_, err := New(newConfig(&provisioner.ACMEIssuer{Certificate: intFile, Key: "testdata/secrets/intermediate_ca_key"}, "testdata/certs/root_ca.crt", rootFile))
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "error initializing issuer for provisioner acme: key testdata/secrets/intermediate_ca_key does not match")
+		}
+	})
+
+	a, err := New(newConfig(&provisioner.ACMEIssuer{Certificate: intFile, Key: keyFile}, "testdata/certs/root_ca.crt", rootFile))
+	assert.FatalError(t, err)
+
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv)
+
+	t.Run("ok/acme", func(t *testing.T) {
+		p, err := a.LoadProvisionerByName("acme")
+		assert.FatalError(t, err)
+		extraOpts, err := p.AuthorizeSign(context.Background(), "")
+		assert.FatalError(t, err)
+		certs, err := a.Sign(csr, provisioner.SignOptions{}, extraOpts...)
+		assert.FatalError(t, err)
+		if assert.Len(t, 2, certs) {
+			assert.Equals(t, certs[1], intermediate)
+			assert.FatalError(t, certs[0].CheckSignatureFrom(intermediate))
+		}
+	})
+
+	t.Run("ok/acme-reload", func(t *testing.T) {
+		// The issuers are replaced by a reload while the certificate is signed.
+		p, err := a.LoadProvisionerByName("acme")
+		assert.FatalError(t, err)
+		extraOpts, err := p.AuthorizeSign(context.Background(), "")
+		assert.FatalError(t, err)
+		done := make(chan error)
+		go func() {
+			a.adminMutex.Lock()
+			defer a.adminMutex.Unlock()
+			done <- a.reloadAdminResources(context.Background())
+		}()
+		certs, err := a.Sign(csr, provisioner.SignOptions{}, extraOpts...)
+		assert.FatalError(t, err)
+		assert.FatalError(t, <-done)
+		if assert.Len(t, 2, certs) {
+			assert.FatalError(t, certs[0].CheckSignatureFrom(intermediate))
+		}
+	})
+
+	t.Run("ok/jwk", func(t *testing.T) {
+		key, err := jose.ReadKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+		assert.FatalError(t, err)
+		token, err := generateToken("smallstep test", "step-cli", testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), key)
+		assert.FatalError(t, err)
+		extraOpts, err := a.Authorize(provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod), token)
+		assert.FatalError(t, err)
+		certs, err := a.Sign(csr, provisioner.SignOptions{}, extraOpts...)
+		assert.FatalError(t, err)
+		if assert.Len(t, 2, certs) {
+			assert.Equals(t, certs[1], getDefaultIssuer(a))
+			assert.FatalError(t, certs[0].CheckSignatureFrom(getDefaultIssuer(a)))
+		}
+	})
+
+	t.Run("ok/signers", func(t *testing.T) {
+		signers, err := a.GetX509Signers()
+		assert.FatalError(t, err)
+		assert.Equals(t, signers, []*x509.Certificate{getDefaultIssuer(a), intermediate})
+	})
+
+	t.Run("ok/signers-reload", func(t *testing.T) {
+		done := make(chan error)
+		go func() {
+			a.adminMutex.Lock()
+			defer a.adminMutex.Unlock()
+			done <- a.reloadAdminResources(context.Background())
+		}()
+		signers, err := a.GetX509Signers()
+		assert.FatalError(t, err)
+		assert.FatalError(t, <-done)
+		assert.Equals(t, signers, []*x509.Certificate{getDefaultIssuer(a), intermediate})
+	})
+
+	t.Run("fail/unknown-issuer", func(t *testing.T) {
+		_, err := a.Sign(csr, provisioner.SignOptions{}, provisioner.IssuerOption{ProvisionerID: "foo"})
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "authority.Sign; issuer for provisioner foo not found")
+		}
+	})
+}
+
+func TestAuthority_Sign_keyTypeIssuers(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, b []byte) string {
+		fn := filepath.Join(dir, name)
+		assert.FatalError(t, os.WriteFile(fn, b, 0600))
+		return fn
+	}
+	newCA := func(t *testing.T, name string, parent *x509.Certificate, parentSigner crypto.Signer) (*x509.Certificate, crypto.Signer) {
+		signer, err := keyutil.GenerateSigner("RSA", "", 2048)
+		assert.FatalError(t, err)
+		cr, err := x509util.CreateCertificateRequest(name, nil, signer)
+		assert.FatalError(t, err)
+		template, err := x509util.NewCertificate(cr, x509util.WithTemplate(x509util.DefaultRootTemplate, x509util.CreateTemplateData(name, nil)))
+		assert.FatalError(t, err)
+		crt := template.GetCertificate()
+		crt.NotBefore = time.Now().Add(-time.Minute)
+		crt.NotAfter = crt.NotBefore.Add(24 * time.Hour)
+		if parent == nil {
+			parent, parentSigner = crt, signer
+		}
+		crt, err = x509util.CreateCertificate(crt, parent, signer.Public(), parentSigner)
+		assert.FatalError(t, err)
+		return crt, signer
+	}
+
+	rsaRoot, rsaRootSigner := newCA(t, "RSA Root CA", nil, nil)
+	rsaIntermediate, rsaSigner := newCA(t, "RSA Intermediate CA", rsaRoot, rsaRootSigner)
+	keyBlock, err := pemutil.Serialize(rsaSigner)
+	assert.FatalError(t, err)
+	rootFile := writeFile("rsa_root_ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rsaRoot.Raw}))
+	intFile := writeFile("rsa_intermediate_ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rsaIntermediate.Raw}))
+	keyFile := writeFile("rsa_intermediate_ca_key", pem.EncodeToMemory(keyBlock))
+
+	newConfig := func(issuers ...*config.X509IssuerOptions) *Config {
+		return &Config{
+			Address:          "127.0.0.1:443",
+			Root:             []string{"testdata/certs/root_ca.crt", rootFile},
+			IntermediateCert: "testdata/certs/intermediate_ca.crt",
+			IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+			Issuers:          issuers,
+			DNSNames:         []string{"example.com"},
+			Password:         "pass",
+			AuthorityConfig: &AuthConfig{
+				Provisioners: provisioner.List{
+					&provisioner.ACME{Name: "acme", Type: "ACME"},
+				},
+			},
+		}
+	}
+	sign := func(t *testing.T, a *Authority, kty string, size int) []*x509.Certificate {
+		signer, err := keyutil.GenerateSigner(kty, "P-256", size)
+		assert.FatalError(t, err)
+		p, err := a.LoadProvisionerByName("acme")
+		assert.FatalError(t, err)
+		extraOpts, err := p.AuthorizeSign(context.Background(), "")
+		assert.FatalError(t, err)
+		certs, err := a.Sign(getCSR(t, signer), provisioner.SignOptions{}, extraOpts...)
+		assert.FatalError(t, err)
+		return certs
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		a, err := New(newConfig(&config.X509IssuerOptions{Certificate: intFile, Key: keyFile}))
+		assert.FatalError(t, err)
+
+		certs := sign(t, a, "EC", 0)
+		if assert.Len(t, 2, certs) {
+			assert.Equals(t, certs[1], getDefaultIssuer(a))
+			assert.FatalError(t, certs[0].CheckSignatureFrom(getDefaultIssuer(a)))
+		}
+		certs = sign(t, a, "RSA", 2048)
+		if assert.Len(t, 2, certs) {
+			assert.Equals(t, certs[1], rsaIntermediate)
+			assert.FatalError(t, certs[0].CheckSignatureFrom(rsaIntermediate))
+		}
+
+		signers, err := a.GetX509Signers()
+		assert.FatalError(t, err)
+		assert.Equals(t, signers, []*x509.Certificate{getDefaultIssuer(a), rsaIntermediate})
+	})
+
+	t.Run("ok/key-type", func(t *testing.T) {
+		a, err := New(newConfig(&config.X509IssuerOptions{KeyType: "EC", Certificate: intFile, Key: keyFile}))
+		assert.FatalError(t, err)
+
+		certs := sign(t, a, "EC", 0)
+		if assert.Len(t, 2, certs) {
+			assert.Equals(t, certs[1], rsaIntermediate)
+			assert.FatalError(t, certs[0].CheckSignatureFrom(rsaIntermediate))
+		}
+		certs = sign(t, a, "RSA", 2048)
+		if assert.Len(t, 2, certs) {
+			assert.Equals(t, certs[1], getDefaultIssuer(a))
+			assert.FatalError(t, certs[0].CheckSignatureFrom(getDefaultIssuer(a)))
+		}
+	})
+
+	t.Run("ok/authority-key-id", func(t *testing.T) {
+		// The template sets a different authority key identifier, both in the
+		// field and as an extension.
+		c := newConfig(&config.X509IssuerOptions{Certificate: intFile, Key: keyFile})
+		c.AuthorityConfig.Provisioners[0].(*provisioner.ACME).Options = &provisioner.Options{
+			X509: &provisioner.X509Options{Template: `{
+				"subject": {{ toJson .Subject }},
+				"sans": {{ toJson .SANs }},
+				"authorityKeyId": "AQID",
+				"extensions": [{"id": "2.5.29.35", "value": "MASAAgQF"}]
+			}`},
+		}
+		a, err := New(c)
+		assert.FatalError(t, err)
+
+		for kty, issuer := range map[string]*x509.Certificate{"EC": getDefaultIssuer(a), "RSA": rsaIntermediate} {
+			assert.True(t, len(issuer.SubjectKeyId) > 0)
+			certs := sign(t, a, kty, 2048)
+			if assert.Len(t, 2, certs) {
+				assert.Equals(t, certs[1], issuer)
+				assert.Equals(t, certs[0].AuthorityKeyId, issuer.SubjectKeyId)
+				var n int
+				for _, ext := range certs[0].Extensions {
+					if ext.Id.Equal(oidAuthorityKeyIdentifier) {
+						n++
+					}
+				}
+				assert.Equals(t, n, 1)
+			}
+		}
+	})
+
+	t.Run("fail/duplicated", func(t *testing.T) {
+		_, err := New(newConfig(
+			&config.X509IssuerOptions{Certificate: intFile, Key: keyFile},
+			&config.X509IssuerOptions{KeyType: "RSA", Certificate: intFile, Key: keyFile},
+		))
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "error initializing issuer "+intFile+": there is already an issuer for RSA keys")
+		}
+	})
+
+	t.Run("fail/not-trusted", func(t *testing.T) {
+		c := newConfig(&config.X509IssuerOptions{Certificate: intFile, Key: keyFile})
+		c.Root = []string{"testdata/certs/root_ca.crt"}
+		_, err := New(c)
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "error initializing issuer "+intFile+": error verifying "+intFile)
+		}
+	})
+}
+
+func TestAuthority_Sign_signatureAlgorithm(t *testing.T) {
+	clijwk, err := jose.ReadKey("testdata/secrets/step_cli_key_pub.jwk")
+	assert.FatalError(t, err)
+	newConfig := func(alg string) *Config {
+		return &Config{
+			Address:          "127.0.0.1:443",
+			Root:             []string{"testdata/certs/root_ca.crt"},
+			IntermediateCert: "testdata/certs/intermediate_ca.crt",
+			IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+			DNSNames:         []string{"example.com"},
+			Password:         "pass",
+			AuthorityConfig: &AuthConfig{
+				Provisioners: provisioner.List{
+					&provisioner.JWK{Name: "step-cli", Type: "JWK", Key: clijwk},
+					&provisioner.ACME{Name: "acme", Type: "ACME", Options: &provisioner.Options{
+						X509: &provisioner.X509Options{SignatureAlgorithm: alg},
+					}},
+				},
+			},
+		}
+	}
+
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv)
+	sign := func(a *Authority) ([]*x509.Certificate, error) {
+		p, err := a.LoadProvisionerByName("acme")
+		assert.FatalError(t, err)
+		extraOpts, err := p.AuthorizeSign(context.Background(), "")
+		assert.FatalError(t, err)
+		return a.Sign(csr, provisioner.SignOptions{}, extraOpts...)
+	}
+
+	t.Run("fail/unsupported", func(t *testing.T) {
+		_, err := New(newConfig("SHA1-RSA"))
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "error initializing provisioner acme: unsupported signature algorithm SHA1-RSA")
+		}
+	})
+
+	t.Run("fail/unsupported-jwk", func(t *testing.T) {
+		c := newConfig("")
+		c.AuthorityConfig.Provisioners[0].(*provisioner.JWK).Options = &provisioner.Options{
+			X509: &provisioner.X509Options{SignatureAlgorithm: "SHA1-RSA"},
+		}
+		_, err := New(c)
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "error initializing provisioner step-cli: unsupported signature algorithm SHA1-RSA")
+		}
+	})
+
+	t.Run("fail/incompatible", func(t *testing.T) {
+		a, err := New(newConfig("SHA384-RSA"))
+		assert.FatalError(t, err)
+		_, err = sign(a)
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "authority.Sign; error creating certificate")
+			assert.True(t, strings.Contains(err.Error(), "signature algorithm SHA384-RSA is not compatible with the issuer ECDSA key"))
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusInternalServerError)
+		}
+	})
+
+	t.Run("ok/default", func(t *testing.T) {
+		a, err := New(newConfig(""))
+		assert.FatalError(t, err)
+		certs, err := sign(a)
+		assert.FatalError(t, err)
+		assert.Equals(t, certs[0].SignatureAlgorithm, x509.ECDSAWithSHA256)
+		assert.FatalError(t, certs[0].CheckSignatureFrom(getDefaultIssuer(a)))
+	})
+
+	t.Run("ok/ECDSA-SHA384", func(t *testing.T) {
+		a, err := New(newConfig("ECDSA-SHA384"))
+		assert.FatalError(t, err)
+		certs, err := sign(a)
+		assert.FatalError(t, err)
+		assert.Equals(t, certs[0].SignatureAlgorithm, x509.ECDSAWithSHA384)
+		assert.FatalError(t, certs[0].CheckSignatureFrom(getDefaultIssuer(a)))
+	})
+}
+
+func TestAuthority_Sign_nameConstraints(t *testing.T) {
+	a := testAuthority(t)
+	a.db = &db.MockAuthDB{
+		MStoreCertificate: func(crt *x509.Certificate) error {
+			return nil
+		},
+	}
+
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv, func(csr *x509.CertificateRequest) {
+		csr.Subject = pkix.Name{CommonName: "Constrained Intermediate"}
+		csr.DNSNames = nil
+	})
+	templateOption, err := provisioner.CustomTemplateOptions(nil, x509util.CreateTemplateData("Constrained Intermediate", nil), x509util.DefaultIntermediateTemplate)
+	assert.FatalError(t, err)
+	signOpts := provisioner.SignOptions{
+		NotBefore: provisioner.NewTimeDuration(time.Now()),
+		NotAfter:  provisioner.NewTimeDuration(time.Now().Add(time.Hour)),
+	}
+
+	t.Run("fail/not-allowed", func(t *testing.T) {
+		_, err := a.Sign(csr, signOpts, templateOption)
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "authority.Sign; provisioner is not allowed to issue CA certificates")
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		nc := &provisioner.NameConstraints{
+			PermittedDNSDomains:     []string{"example.com", ".internal.example.com"},
+			ExcludedDNSDomains:      []string{"secret.example.com"},
+			PermittedIPRanges:       []string{"10.0.0.0/8", "2001:db8::/32"},
+			ExcludedIPRanges:        []string{"10.10.0.0/16"},
+			PermittedEmailAddresses: []string{"example.com"},
+			ExcludedEmailAddresses:  []string{"root@example.com"},
+		}
+		certs, err := a.Sign(csr, signOpts, templateOption, provisioner.CAOption{NameConstraints: nc})
+		assert.FatalError(t, err)
+		crt := certs[0]
+		assert.True(t, crt.IsCA)
+		assert.True(t, crt.BasicConstraintsValid)
+		assert.True(t, crt.PermittedDNSDomainsCritical)
+		assert.Equals(t, crt.PermittedDNSDomains, nc.PermittedDNSDomains)
+		assert.Equals(t, crt.ExcludedDNSDomains, nc.ExcludedDNSDomains)
+		assert.Equals(t, crt.PermittedEmailAddresses, nc.PermittedEmailAddresses)
+		assert.Equals(t, crt.ExcludedEmailAddresses, nc.ExcludedEmailAddresses)
+		var permitted, excluded []string
+		for _, ipNet := range crt.PermittedIPRanges {
+			permitted = append(permitted, ipNet.String())
+		}
+		for _, ipNet := range crt.ExcludedIPRanges {
+			excluded = append(excluded, ipNet.String())
+		}
+		assert.Equals(t, permitted, nc.PermittedIPRanges)
+		assert.Equals(t, excluded, nc.ExcludedIPRanges)
+
+		var found bool
+		for _, ext := range crt.Extensions {
+			if ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 30}) {
+				found = true
+				assert.True(t, ext.Critical)
+			}
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("ok/no-constraints", func(t *testing.T) {
+		certs, err := a.Sign(csr, signOpts, templateOption, provisioner.CAOption{})
+		assert.FatalError(t, err)
+		assert.True(t, certs[0].IsCA)
+		assert.Equals(t, len(certs[0].PermittedDNSDomains), 0)
+		for _, ext := range certs[0].Extensions {
+			assert.NotEquals(t, ext.Id, asn1.ObjectIdentifier{2, 5, 29, 30})
+		}
+	})
+}
+
+type mockIssuanceHook struct {
+	events []*hooks.IssuanceEvent
+	err    error
+}
+
+func (m *mockIssuanceHook) Issued(ctx context.Context, e *hooks.IssuanceEvent) error {
+	m.events = append(m.events, e)
+	return m.err
+}
+
+func TestAuthority_Sign_issuanceHooks(t *testing.T) {
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv)
+	signOpts := provisioner.SignOptions{
+		NotBefore: provisioner.NewTimeDuration(time.Now()),
+		NotAfter:  provisioner.NewTimeDuration(time.Now().Add(time.Hour)),
+	}
+	templateOption, err := provisioner.TemplateOptions(nil, x509util.NewTemplateData())
+	assert.FatalError(t, err)
+	acmeOption := provisioner.ACMEOrderOption{AccountID: "accID", OrderID: "ordID"}
+
+	t.Run("ok", func(t *testing.T) {
+		h := &mockIssuanceHook{}
+		a := testAuthority(t, WithIssuanceHook(h, true))
+		a.db = &db.MockAuthDB{
+			MStoreCertificate: func(crt *x509.Certificate) error { return nil },
+		}
+		certs, err := a.Sign(csr, signOpts, templateOption, acmeOption)
+		assert.FatalError(t, err)
+		if assert.Len(t, 1, h.events) {
+			assert.Equals(t, h.events[0].Type, hooks.SignEvent)
+			assert.Equals(t, h.events[0].SerialNumber, certs[0].SerialNumber.String())
+			assert.Equals(t, h.events[0].ACMEAccountID, "accID")
+			assert.Equals(t, h.events[0].ACMEOrderID, "ordID")
+		}
+	})
+
+	t.Run("ok/ignore-error", func(t *testing.T) {
+		failing := &mockIssuanceHook{err: errors.New("force")}
+		h := &mockIssuanceHook{}
+		a := testAuthority(t, WithIssuanceHook(failing, false), WithIssuanceHook(h, false))
+		a.db = &db.MockAuthDB{
+			MStoreCertificate: func(crt *x509.Certificate) error { return nil },
+		}
+		certs, err := a.Sign(csr, signOpts, templateOption)
+		assert.FatalError(t, err)
+		assert.Len(t, 2, certs)
+		assert.Len(t, 1, failing.events)
+		assert.Len(t, 1, h.events)
+	})
+
+	t.Run("fail/fail-on-error", func(t *testing.T) {
+		failing := &mockIssuanceHook{err: errors.New("force")}
+		h := &mockIssuanceHook{}
+		a := testAuthority(t, WithIssuanceHook(failing, true), WithIssuanceHook(h, false))
+		a.db = &db.MockAuthDB{
+			MStoreCertificate: func(crt *x509.Certificate) error { return nil },
+		}
+		_, err := a.Sign(csr, signOpts, templateOption)
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "authority.Sign: error running issuance hook: force")
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusInternalServerError)
+		}
+		// All the hooks are called.
+		assert.Len(t, 1, h.events)
+	})
+
+	t.Run("fail/timeout", func(t *testing.T) {
+		tmp := issuanceHooksTimeout
+		t.Cleanup(func() { issuanceHooksTimeout = tmp })
+		issuanceHooksTimeout = 100 * time.Millisecond
+
+		// The hooks share the timeout, the second one gets an expired context.
+		var deadlines []error
+		blocking := hooks.IssuanceHookFunc(func(ctx context.Context, e *hooks.IssuanceEvent) error {
+			<-ctx.Done()
+			deadlines = append(deadlines, ctx.Err())
+			return ctx.Err()
+		})
+		a := testAuthority(t, WithIssuanceHook(blocking, false), WithIssuanceHook(blocking, true))
+		a.db = &db.MockAuthDB{
+			MStoreCertificate: func(crt *x509.Certificate) error { return nil },
+		}
+		start := time.Now()
+		_, err := a.Sign(csr, signOpts, templateOption)
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "authority.Sign: error running issuance hook: context deadline exceeded")
+		}
+		assert.True(t, time.Since(start) < 5*time.Second)
+		assert.Equals(t, deadlines, []error{context.DeadlineExceeded, context.DeadlineExceeded})
+	})
+}
+
+func TestAuthority_Sign_asyncIssuanceHooks(t *testing.T) {
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv)
+	signOpts := provisioner.SignOptions{
+		NotBefore: provisioner.NewTimeDuration(time.Now()),
+		NotAfter:  provisioner.NewTimeDuration(time.Now().Add(time.Hour)),
+	}
+	templateOption, err := provisioner.TemplateOptions(nil, x509util.NewTemplateData())
+	assert.FatalError(t, err)
+
+	// The failing hook does not fail the issuance.
+	events := make(chan *hooks.IssuanceEvent, 1)
+	a := testAuthority(t,
+		WithAsyncIssuanceHook(hooks.IssuanceHookFunc(func(ctx context.Context, e *hooks.IssuanceEvent) error {
+			events <- e
+			return nil
+		})),
+		WithAsyncIssuanceHook(hooks.IssuanceHookFunc(func(ctx context.Context, e *hooks.IssuanceEvent) error {
+			return errors.New("force")
+		})),
+	)
+	a.db = &db.MockAuthDB{
+		MStoreCertificate: func(crt *x509.Certificate) error { return nil },
+	}
+	certs, err := a.Sign(csr, signOpts, templateOption)
+	assert.FatalError(t, err)
+
+	select {
+	case e := <-events:
+		assert.Equals(t, e.Type, hooks.SignEvent)
+		assert.Equals(t, e.SerialNumber, certs[0].SerialNumber.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the issuance event")
+	}
+	a.issuanceQueue.Close()
+}
+
+func TestAuthority_Sign_randomSource(t *testing.T) {
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv)
+	signOpts := provisioner.SignOptions{
+		NotBefore: provisioner.NewTimeDuration(time.Now()),
+		NotAfter:  provisioner.NewTimeDuration(time.Now().Add(time.Hour)),
+	}
+	templateOption, err := provisioner.TemplateOptions(nil, x509util.NewTemplateData())
+	assert.FatalError(t, err)
+
+	serials := func(t *testing.T, seed int64) []string {
+		a := testAuthority(t, WithRandomSource(mathrand.New(mathrand.NewSource(seed))))
+		a.db = &db.MockAuthDB{
+			MStoreCertificate: func(crt *x509.Certificate) error { return nil },
+		}
+		var sns []string
+		for i := 0; i < 3; i++ {
+			certs, err := a.Sign(csr, signOpts, templateOption)
+			assert.FatalError(t, err)
+			sns = append(sns, certs[0].SerialNumber.String())
+		}
+		return sns
+	}
+
+	// The same seed generates the same serial numbers.
+	sns := serials(t, 1)
+	assert.Equals(t, serials(t, 1), sns)
+	assert.NotEquals(t, serials(t, 2), sns)
+	assert.NotEquals(t, sns[0], sns[1])
+
+	// The serial number set by a template is not modified.
+	a := testAuthority(t, WithRandomSource(mathrand.New(mathrand.NewSource(1))))
+	crt := &x509.Certificate{SerialNumber: big.NewInt(1234)}
+	assert.FatalError(t, a.setSerialNumber(crt))
+	assert.Equals(t, crt.SerialNumber, big.NewInt(1234))
+
+	// An exhausted source fails the issuance.
+	a = testAuthority(t, WithRandomSource(bytes.NewReader(nil)))
+	_, err = a.Sign(csr, signOpts, templateOption)
+	if assert.NotNil(t, err) {
+		assert.HasPrefix(t, err.Error(), "authority.Sign: error generating serial number")
+	}
+}
+
+func TestAuthority_RevokeByKeyFingerprint(t *testing.T) {
+	signOpts := provisioner.SignOptions{
+		NotBefore: provisioner.NewTimeDuration(time.Now()),
+		NotAfter:  provisioner.NewTimeDuration(time.Now().Add(time.Hour)),
+	}
+	templateOption, err := provisioner.TemplateOptions(nil, x509util.NewTemplateData())
+	assert.FatalError(t, err)
+
+	certs := map[string]*x509.Certificate{}
+	revoked := map[string]*db.RevokedCertificateInfo{}
+	a := testAuthority(t)
+	a.db = &db.MockAuthDB{
+		MStoreCertificate: func(crt *x509.Certificate) error {
+			certs[crt.SerialNumber.String()] = crt
+			return nil
+		},
+		MGetCertificate: func(serialNumber string) (*x509.Certificate, error) {
+			if crt, ok := certs[serialNumber]; ok {
+				return crt, nil
+			}
+			return nil, errors.New("not found")
+		},
+		MGetCertificatesByKey: func(fingerprint string) ([]string, error) {
+			var serials []string
+			for serial, crt := range certs {
+				if db.PublicKeyFingerprint(crt) == fingerprint {
+					serials = append(serials, serial)
+				}
+			}
+			sort.Strings(serials)
+			return serials, nil
+		},
+		MRevoke: func(rci *db.RevokedCertificateInfo) error {
+			if _, ok := revoked[rci.Serial]; ok {
+				return db.ErrAlreadyExists
+			}
+			revoked[rci.Serial] = rci
+			return nil
+		},
+	}
+	sign := func(priv interface{}) *x509.Certificate {
+		chain, err := a.Sign(getCSR(t, priv), signOpts, templateOption)
+		assert.FatalError(t, err)
+		return chain[0]
+	}
+
+	// Two certificates share the compromised key.
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	crt1, crt2 := sign(priv), sign(priv)
+	_, other, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	crt3 := sign(other)
+
+	want := []string{crt1.SerialNumber.String(), crt2.SerialNumber.String()}
+	sort.Strings(want)
+	fingerprint := strings.ToUpper(db.PublicKeyFingerprint(crt1))
+	got, err := a.RevokeByKeyFingerprint(context.Background(), fingerprint, ocsp.KeyCompromise, "key compromise")
+	assert.FatalError(t, err)
+	assert.Equals(t, got, want)
+	if assert.Len(t, 2, revoked) {
+		for _, serial := range want {
+			assert.Equals(t, revoked[serial].ReasonCode, ocsp.KeyCompromise)
+			assert.Equals(t, revoked[serial].Reason, "key compromise")
+		}
+	}
+	_, ok := revoked[crt3.SerialNumber.String()]
+	assert.False(t, ok)
+
+	// The certificates already revoked are skipped.
+	got, err = a.RevokeByKeyFingerprint(context.Background(), fingerprint, ocsp.KeyCompromise, "key compromise")
+	assert.FatalError(t, err)
+	assert.Equals(t, got, []string{})
+
+	// The database must index the certificates by key.
+	a.db = &db.SimpleDB{}
+	_, err = a.RevokeByKeyFingerprint(context.Background(), fingerprint, ocsp.KeyCompromise, "")
+	if assert.NotNil(t, err) {
+		assert.Equals(t, err.Error(), "the database does not index the certificates by public key")
+	}
+}
+
+func TestAuthority_GetCertificateInfo(t *testing.T) {
+	certs := map[string]*x509.Certificate{}
+	certsData := map[string]*db.CertificateData{}
+	revoked := map[string]bool{}
+	mockDB := &db.MockAuthDB{
+		MUseToken: func(id, tok string) (bool, error) {
+			return true, nil
+		},
+		MStoreCertificate: func(crt *x509.Certificate) error {
+			certs[crt.SerialNumber.String()] = crt
+			return nil
+		},
+		MGetCertificate: func(serialNumber string) (*x509.Certificate, error) {
+			if crt, ok := certs[serialNumber]; ok {
+				return crt, nil
+			}
+			return nil, errors.Wrap(database.ErrNotFound, "database Get error")
+		},
+		MStoreCertificateData: func(serialNumber string, data *db.CertificateData) error {
+			certsData[serialNumber] = data
+			return nil
+		},
+		MGetCertificateData: func(serialNumber string) (*db.CertificateData, error) {
+			return certsData[serialNumber], nil
+		},
+		MIsRevoked: func(sn string) (bool, error) {
+			return revoked[sn], nil
+		},
+	}
+
+	clijwk, err := jose.ReadKey("testdata/secrets/step_cli_key_pub.jwk")
+	assert.FatalError(t, err)
+	a, err := New(&Config{
+		Address:          "127.0.0.1:443",
+		Root:             []string{"testdata/certs/root_ca.crt"},
+		IntermediateCert: "testdata/certs/intermediate_ca.crt",
+		IntermediateKey:  "testdata/secrets/intermediate_ca_key",
+		DNSNames:         []string{"example.com"},
+		Password:         "pass",
+		AuthorityConfig: &AuthConfig{
+			Provisioners: provisioner.List{
+				&provisioner.JWK{Name: "step-cli", Type: "JWK", Key: clijwk},
+				&provisioner.ACME{Name: "acme", Type: "ACME"},
+			},
+		},
+	}, WithDatabase(mockDB))
+	assert.FatalError(t, err)
+
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv)
+
+	t.Run("ok/jwk", func(t *testing.T) {
+		key, err := jose.ReadKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+		assert.FatalError(t, err)
+		token, err := generateToken("smallstep test", "step-cli", testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), key)
+		assert.FatalError(t, err)
+		extraOpts, err := a.Authorize(provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod), token)
+		assert.FatalError(t, err)
+		chain, err := a.Sign(csr, provisioner.SignOptions{}, extraOpts...)
+		assert.FatalError(t, err)
+
+		p, err := a.LoadProvisionerByName("step-cli")
+		assert.FatalError(t, err)
+		serial := chain[0].SerialNumber.String()
+		info, err := a.GetCertificateInfo(serial)
+		assert.FatalError(t, err)
+		assert.Equals(t, info, &CertificateInfo{
+			SerialNumber: serial,
+			Provisioner: &CertificateProvisioner{
+				ID:   p.GetID(),
+				Name: "step-cli",
+				Type: "JWK",
+			},
+			Subject:   "smallstep test",
+			SANs:      []string{"test.smallstep.com"},
+			NotBefore: chain[0].NotBefore,
+			NotAfter:  chain[0].NotAfter,
+		})
+	})
+
+	t.Run("ok/acme", func(t *testing.T) {
+		p, err := a.LoadProvisionerByName("acme")
+		assert.FatalError(t, err)
+		extraOpts, err := p.AuthorizeSign(context.Background(), "")
+		assert.FatalError(t, err)
+		extraOpts = append(extraOpts, provisioner.ACMEOrderOption{
+			AccountID: "accID",
+			OrderID:   "ordID",
+		})
+		chain, err := a.Sign(csr, provisioner.SignOptions{}, extraOpts...)
+		assert.FatalError(t, err)
+
+		serial := chain[0].SerialNumber.String()
+		revoked[serial] = true
+		info, err := a.GetCertificateInfo(serial)
+		assert.FatalError(t, err)
+		assert.Equals(t, info, &CertificateInfo{
+			SerialNumber: serial,
+			Provisioner: &CertificateProvisioner{
+				ID:   p.GetID(),
+				Name: "acme",
+				Type: "ACME",
+			},
+			Subject:   "smallstep test",
+			SANs:      []string{"test.smallstep.com"},
+			NotBefore: chain[0].NotBefore,
+			NotAfter:  chain[0].NotAfter,
+			Revoked:   true,
+			AccountID: "accID",
+			OrderID:   "ordID",
+		})
+	})
+
+	t.Run("fail/not-found", func(t *testing.T) {
+		_, err := a.GetCertificateInfo("1234")
+		if assert.NotNil(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusNotFound)
+			assert.HasPrefix(t, err.Error(), "certificate 1234 not found")
+		}
+	})
+}
+
+func TestAuthority_GetCertificateChain(t *testing.T) {
+	certs := map[string]*x509.Certificate{}
+	revoked := map[string]bool{}
+	mockDB := &db.MockAuthDB{
+		MUseToken: func(id, tok string) (bool, error) {
+			return true, nil
+		},
+		MStoreCertificate: func(crt *x509.Certificate) error {
+			certs[crt.SerialNumber.String()] = crt
+			return nil
+		},
+		MGetCertificate: func(serialNumber string) (*x509.Certificate, error) {
+			if crt, ok := certs[serialNumber]; ok {
+				return crt, nil
+			}
+			return nil, errors.Wrap(database.ErrNotFound, "database Get error")
+		},
+		MIsRevoked: func(sn string) (bool, error) {
+			return revoked[sn], nil
+		},
+	}
+
+	a := testAuthority(t, WithDatabase(mockDB))
+	_, priv, err := keyutil.GenerateDefaultKeyPair()
+	assert.FatalError(t, err)
+	csr := getCSR(t, priv)
+
+	key, err := jose.ReadKey("testdata/secrets/step_cli_key_priv.jwk", jose.WithPassword([]byte("pass")))
+	assert.FatalError(t, err)
+	token, err := generateToken("smallstep test", "step-cli", testAudiences.Sign[0], []string{"test.smallstep.com"}, time.Now(), key)
+	assert.FatalError(t, err)
+	extraOpts, err := a.Authorize(provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod), token)
+	assert.FatalError(t, err)
+	chain, err := a.Sign(csr, provisioner.SignOptions{}, extraOpts...)
+	assert.FatalError(t, err)
+	serial := chain[0].SerialNumber.String()
+
+	t.Run("ok", func(t *testing.T) {
+		got, isRevoked, err := a.GetCertificateChain(serial)
+		assert.FatalError(t, err)
+		assert.False(t, isRevoked)
+		assert.Equals(t, got, []*x509.Certificate{chain[0], a.intermediateX509})
+	})
+
+	t.Run("ok/revoked", func(t *testing.T) {
+		revoked[serial] = true
+		defer delete(revoked, serial)
+		got, isRevoked, err := a.GetCertificateChain(serial)
+		assert.FatalError(t, err)
+		assert.True(t, isRevoked)
+		assert.Equals(t, got, []*x509.Certificate{chain[0], a.intermediateX509})
+	})
+
+	t.Run("ok/inactive-issuer", func(t *testing.T) {
+		// A certificate signed by an issuer that is no longer configured.
+		signer, ok := priv.(crypto.Signer)
+		assert.Fatal(t, ok, "key is not a crypto.Signer")
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(5678),
+			Subject:      pkix.Name{CommonName: "test.smallstep.com"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "Old Intermediate CA"},
+		}, signer.Public(), signer)
+		assert.FatalError(t, err)
+		crt, err := x509.ParseCertificate(der)
+		assert.FatalError(t, err)
+		certs[crt.SerialNumber.String()] = crt
+		got, isRevoked, err := a.GetCertificateChain(crt.SerialNumber.String())
+		assert.FatalError(t, err)
+		assert.False(t, isRevoked)
+		assert.Equals(t, got, []*x509.Certificate{crt})
+	})
+
+	t.Run("fail/not-found", func(t *testing.T) {
+		_, _, err := a.GetCertificateChain("1234")
+		if assert.NotNil(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusNotFound)
+			assert.HasPrefix(t, err.Error(), "certificate 1234 not found")
+		}
+	})
+}
+
+func TestAuthority_ListCertificates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	now := time.Now()
+
+	// Certificates 2 and 4 have expired.
+	certs := map[string]*x509.Certificate{}
+	for i := int64(1); i <= 5; i++ {
+		notAfter := now.Add(time.Hour)
+		if i%2 == 0 {
+			notAfter = now.Add(-time.Minute)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(i),
+			Subject:      pkix.Name{CommonName: fmt.Sprintf("test-%d", i)},
+			DNSNames:     []string{fmt.Sprintf("test-%d.smallstep.com", i)},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+		assert.FatalError(t, err)
+		crt, err := x509.ParseCertificate(der)
+		assert.FatalError(t, err)
+		certs[crt.SerialNumber.String()] = crt
+	}
+
+	a := testAuthority(t, WithDatabase(&db.MockAuthDB{
+		MIterateCertificates: func(cursor string, fn func(string, *x509.Certificate) (bool, error)) error {
+			serials := make([]string, 0, len(certs))
+			for serial := range certs {
+				if serial > cursor {
+					serials = append(serials, serial)
+				}
+			}
+			sort.Strings(serials)
+			for _, serial := range serials {
+				if ok, err := fn(serial, certs[serial]); err != nil || !ok {
+					return err
+				}
+			}
+			return nil
+		},
+		MIsRevoked: func(sn string) (bool, error) {
+			return sn == "3", nil
+		},
+	}))
+
+	list := func(cursor string, limit int) ([]string, string) {
+		var serials []string
+		next, err := a.ListCertificates(cursor, limit, func(info *CertificateInfo) error {
+			crt := certs[info.SerialNumber]
+			assert.Equals(t, info, &CertificateInfo{
+				SerialNumber: info.SerialNumber,
+				Subject:      crt.Subject.CommonName,
+				SANs:         crt.DNSNames,
+				NotBefore:    crt.NotBefore,
+				NotAfter:     crt.NotAfter,
+				Revoked:      info.SerialNumber == "3",
+			})
+			serials = append(serials, info.SerialNumber)
+			return nil
+		})
+		assert.FatalError(t, err)
+		return serials, next
+	}
+
+	t.Run("ok/all", func(t *testing.T) {
+		serials, next := list("", 0)
+		assert.Equals(t, serials, []string{"1", "3", "5"})
+		assert.Equals(t, next, "")
+	})
+
+	t.Run("ok/pagination", func(t *testing.T) {
+		serials, next := list("", 2)
+		assert.Equals(t, serials, []string{"1", "3"})
+		assert.Equals(t, next, "3")
+		serials, next = list(next, 2)
+		assert.Equals(t, serials, []string{"5"})
+		assert.Equals(t, next, "")
+	})
+
+	t.Run("ok/last-page-expired", func(t *testing.T) {
+		serials, next := list("3", 1)
+		assert.Equals(t, serials, []string{"5"})
+		assert.Equals(t, next, "")
+	})
+
+	t.Run("fail/callback-error", func(t *testing.T) {
+		_, err := a.ListCertificates("", 0, func(info *CertificateInfo) error {
+			return errors.New("force")
+		})
+		if assert.NotNil(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusInternalServerError)
+		}
+	})
+
+	t.Run("fail/not-implemented", func(t *testing.T) {
+		a := testAuthority(t, WithDatabase(&struct{ db.AuthDB }{&db.MockAuthDB{}}))
+		_, err := a.ListCertificates("", 0, func(info *CertificateInfo) error {
+			return nil
+		})
+		if assert.NotNil(t, err) {
+			sc, ok := err.(errs.StatusCoder)
+			assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+			assert.Equals(t, sc.StatusCode(), http.StatusNotImplemented)
+		}
+	})
+}
+
+func TestAuthority_GenerateKey(t *testing.T) {
+	a := testAuthority(t)
+	tests := []struct {
+		name     string
+		kty, crv string
+		size     int
+		wantErr  bool
+	}{
+		{"ok/EC", "EC", "P-256", 0, false},
+		{"ok/RSA", "RSA", "", 2048, false},
+		{"ok/RSA-default", "RSA", "", 0, false},
+		{"ok/OKP", "OKP", "Ed25519", 0, false},
+		{"fail/kty", "FOO", "", 0, true},
+		{"fail/crv", "EC", "P-111", 0, true},
+		{"fail/RSA-small", "RSA", "", 1024, true},
+		{"fail/RSA-large", "RSA", "", 16384, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.GenerateKey(tt.kty, tt.crv, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Authority.GenerateKey() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				sc, ok := err.(errs.StatusCoder)
+				assert.Fatal(t, ok, "error does not implement StatusCoder interface")
+				assert.Equals(t, sc.StatusCode(), http.StatusBadRequest)
+				return
+			}
+			assert.NotNil(t, got)
+		})
+	}
+}
@@ -1,24 +1,29 @@
 package ca
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/acme"
 	acmeAPI "github.com/smallstep/certificates/acme/api"
 	acmeNoSQL "github.com/smallstep/certificates/acme/db/nosql"
+	acmePostgreSQL "github.com/smallstep/certificates/acme/db/postgresql"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/authority"
 	adminAPI "github.com/smallstep/certificates/authority/admin/api"
 	"github.com/smallstep/certificates/authority/config"
+	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/certificates/db"
 	"github.com/smallstep/certificates/logging"
 	"github.com/smallstep/certificates/monitoring"
@@ -36,6 +41,10 @@ type options struct {
 	sshHostPassword []byte
 	sshUserPassword []byte
 	database        db.AuthDB
+	acmeDatabase    acme.DB
+	acmeAllowlist   acme.AccountAllowlistFunc
+	acmeRegistry    *acme.Registry
+	randomSource    io.Reader
 }
 
 func (o *options) apply(opts []Option) {
@@ -94,6 +103,37 @@ func WithDatabase(d db.AuthDB) Option {
 	}
 }
 
+// WithACMEDatabase sets the given ACME database to the CA options.
+func WithACMEDatabase(d acme.DB) Option {
+	return func(o *options) {
+		o.acmeDatabase = d
+	}
+}
+
+// WithACMEAccountAllowlist sets the hook that decides which clients can
+// register new ACME accounts.
+func WithACMEAccountAllowlist(fn acme.AccountAllowlistFunc) Option {
+	return func(o *options) {
+		o.acmeAllowlist = fn
+	}
+}
+
+// WithACMERegistry sets the registry with the custom identifier types and the
+// non-standard challenges supported by the ACME server.
+func WithACMERegistry(r *acme.Registry) Option {
+	return func(o *options) {
+		o.acmeRegistry = r
+	}
+}
+
+// WithRandomSource sets the source of randomness used to generate the serial
+// numbers and the ACME nonces, e.g. a deterministic one in tests.
+func WithRandomSource(r io.Reader) Option {
+	return func(o *options) {
+		o.randomSource = r
+	}
+}
+
 // WithLinkedCAToken sets the token used to authenticate with the linkedca.
 func WithLinkedCAToken(token string) Option {
 	return func(o *options) {
@@ -110,6 +150,10 @@ type CA struct {
 	insecureSrv *server.Server
 	opts        *options
 	renewer     *TLSRenewer
+	acmeDB      acme.DB
+	acmeGC      *acme.GC
+	acmeSweeper *acme.GC
+	acmeCancel  context.CancelFunc
 }
 
 // New creates and initializes the CA with the given configuration and options.
@@ -140,6 +184,10 @@ func (ca *CA) Init(cfg *config.Config) (*CA, error) {
 		opts = append(opts, authority.WithDatabase(ca.opts.database))
 	}
 
+	if ca.opts.randomSource != nil {
+		opts = append(opts, authority.WithRandomSource(ca.opts.randomSource))
+	}
+
 	auth, err := authority.New(cfg, opts...)
 	if err != nil {
 		return nil, err
@@ -179,21 +227,75 @@ func (ca *CA) Init(cfg *config.Config) (*CA, error) {
 	// ACME Router
 	prefix := "acme"
 	var acmeDB acme.DB
-	if cfg.DB == nil {
+	switch {
+	case cfg.DB == nil:
 		acmeDB = nil
-	} else {
+	case ca.opts.acmeDatabase != nil:
+		acmeDB = ca.opts.acmeDatabase
+	case cfg.DB.Type == acmePostgreSQL.Type:
+		acmeDB, err = acmePostgreSQL.Open(context.Background(), cfg.DB.DataSource, acmePostgreSQL.Options{
+			Database:     cfg.DB.Database,
+			MaxOpenConns: cfg.DB.MaxOpenConns,
+			MaxIdleConns: cfg.DB.MaxIdleConns,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error configuring ACME DB interface")
+		}
+	default:
 		acmeDB, err = acmeNoSQL.New(auth.GetDatabase().(nosql.DB))
 		if err != nil {
 			return nil, errors.Wrap(err, "error configuring ACME DB interface")
 		}
 	}
-	acmeHandler := acmeAPI.NewHandler(acmeAPI.HandlerOptions{
-		Backdate: *cfg.AuthorityConfig.Backdate,
-		DB:       acmeDB,
-		DNS:      dns,
-		Prefix:   prefix,
-		CA:       auth,
-	})
+	if r := auth.GetRandomSource(); r != nil {
+		if s, ok := acmeDB.(acme.RandomSourceSetter); ok {
+			s.SetRandomSource(r)
+		}
+	}
+	ca.acmeDB = acmeDB
+	ca.runACMECleanup(cfg.ACMECleanup)
+	directorySigner, directoryChain := auth.GetACMEDirectorySigner()
+	// The deferred challenge validations are canceled when the CA is stopped
+	// or reloaded.
+	acmeCtx, acmeCancel := context.WithCancel(context.Background())
+	ca.acmeCancel = acmeCancel
+	acmeOptions := acmeAPI.HandlerOptions{
+		Backdate:         *cfg.AuthorityConfig.Backdate,
+		DB:               acmeDB,
+		DNS:              dns,
+		Prefix:           prefix,
+		CA:               auth,
+		ListProvisioners: cfg.ACME != nil && cfg.ACME.ListProvisioners,
+		StrictAccept:     cfg.ACME != nil && cfg.ACME.StrictAccept,
+		PathPrefix:       acmePathPrefix(cfg.ACME),
+		DirectorySigner:  directorySigner,
+		DirectoryChain:   directoryChain,
+		AccountAllowlist: ca.opts.acmeAllowlist,
+		Context:          acmeCtx,
+		Registry:         ca.opts.acmeRegistry,
+	}
+	if cfg.ACME != nil {
+		if acmeOptions.ErrorStatusCodes, err = acme.ParseErrorStatusCodes(cfg.ACME.ErrorStatusCodes); err != nil {
+			return nil, errors.Wrap(err, "error parsing acme errorStatusCodes")
+		}
+		if acmeOptions.Registry, err = acmeRegistry(ca.opts.acmeRegistry, cfg.ACME); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ACME != nil && cfg.ACME.GlobalDirectory != nil && cfg.ACME.GlobalDirectory.Enabled {
+		name := cfg.ACME.GlobalDirectory.Provisioner
+		if p, err := auth.LoadProvisionerByName(name); err != nil || p.GetType() != provisioner.TypeACME {
+			return nil, errors.Errorf("acme globalDirectory provisioner %s is not an ACME provisioner", name)
+		}
+		acmeOptions.DefaultProvisioner = name
+	}
+	if cfg.ACME != nil && cfg.ACME.Validation != nil {
+		setACMEValidationOptions(&acmeOptions, cfg.ACME.Validation)
+	}
+	if cfg.ACME != nil && cfg.ACME.CircuitBreaker != nil && cfg.ACME.CircuitBreaker.Enabled && acmeDB != nil {
+		acmeOptions.DB = newACMECircuitBreakerDB(acmeDB, cfg.ACME.CircuitBreaker)
+	}
+	acmeHandler := acmeAPI.NewHandler(acmeOptions)
 	mux.Route("/"+prefix, func(r chi.Router) {
 		acmeHandler.Route(r)
 	})
@@ -207,7 +309,7 @@ func (ca *CA) Init(cfg *config.Config) (*CA, error) {
 	if cfg.AuthorityConfig.EnableAdmin {
 		adminDB := auth.GetAdminDatabase()
 		if adminDB != nil {
-			adminHandler := adminAPI.NewHandler(auth)
+			adminHandler := adminAPI.NewHandler(auth, acmeOptions.DB)
 			mux.Route("/admin", func(r chi.Router) {
 				adminHandler.Route(r)
 			})
@@ -247,6 +349,13 @@ func (ca *CA) Init(cfg *config.Config) (*CA, error) {
 	// helpful routine for logging all routes
 	//dumpRoutes(mux)
 
+	// Only the client certificates issued by the CA can be used to
+	// authenticate the TLS connection, the ones accepted for the MTLS
+	// provisioners are only used to sign certificates.
+	if len(auth.GetClientCertificateRoots()) > 0 {
+		handler = api.NewClientCertificateHandler(handler, auth.GetRootCertificates())
+	}
+
 	// Add monitoring if configured
 	if len(cfg.Monitoring) > 0 {
 		m, err := monitoring.New(cfg.Monitoring)
@@ -267,6 +376,13 @@ func (ca *CA) Init(cfg *config.Config) (*CA, error) {
 		insecureHandler = logger.Middleware(insecureHandler)
 	}
 
+	// Add compression if configured. It must wrap the logger middleware so the
+	// handlers can still access the response logger.
+	if c := cfg.Compression; c != nil && c.Enabled {
+		handler = api.NewCompressionHandler(handler, c.MinSize)
+		insecureHandler = api.NewCompressionHandler(insecureHandler, c.MinSize)
+	}
+
 	ca.srv = server.New(cfg.Address, handler, tlsConfig)
 
 	// only start the insecure server if the insecure address is configured
@@ -312,9 +428,23 @@ func (ca *CA) Run() error {
 // Stop stops the CA calling to the server Shutdown method.
 func (ca *CA) Stop() error {
 	ca.renewer.Stop()
+	if ca.acmeGC != nil {
+		ca.acmeGC.Stop()
+	}
+	if ca.acmeSweeper != nil {
+		ca.acmeSweeper.Stop()
+	}
+	if ca.acmeCancel != nil {
+		ca.acmeCancel()
+	}
 	if err := ca.auth.Shutdown(); err != nil {
 		log.Printf("error stopping ca.Authority: %+v\n", err)
 	}
+	if c, ok := ca.acmeDB.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("error closing ACME database: %+v\n", err)
+		}
+	}
 	var insecureShutdownErr error
 	if ca.insecureSrv != nil {
 		insecureShutdownErr = ca.insecureSrv.Shutdown()
@@ -356,12 +486,18 @@ func (ca *CA) Reload() error {
 		WithLinkedCAToken(ca.opts.linkedCAToken),
 		WithConfigFile(ca.opts.configFile),
 		WithDatabase(ca.auth.GetDatabase()),
+		WithACMEDatabase(ca.acmeDB),
+		WithACMEAccountAllowlist(ca.opts.acmeAllowlist),
+		WithACMERegistry(ca.opts.acmeRegistry),
 	)
 	if err != nil {
 		logContinue("Reload failed because the CA with new configuration could not be initialized.")
 		return errors.Wrap(err, "error reloading ca")
 	}
 
+	// Keep the maintenance mode set through the admin API.
+	newCA.auth.SetMaintenance(ca.auth.GetMaintenance())
+
 	if ca.insecureSrv != nil {
 		if err = ca.insecureSrv.Reload(newCA.insecureSrv); err != nil {
 			logContinue("Reload failed because insecure server could not be replaced.")
@@ -379,14 +515,141 @@ func (ca *CA) Reload() error {
 	// 3. Replace ca properties
 	// Do not replace ca.srv
 	ca.renewer.Stop()
+	if ca.acmeGC != nil {
+		ca.acmeGC.Stop()
+	}
+	if ca.acmeSweeper != nil {
+		ca.acmeSweeper.Stop()
+	}
+	if ca.acmeCancel != nil {
+		ca.acmeCancel()
+	}
 	ca.auth.CloseForReload()
 	ca.auth = newCA.auth
 	ca.config = newCA.config
 	ca.opts = newCA.opts
 	ca.renewer = newCA.renewer
+	ca.acmeGC = newCA.acmeGC
+	ca.acmeSweeper = newCA.acmeSweeper
+	ca.acmeCancel = newCA.acmeCancel
 	return nil
 }
 
+// acmeRegistry returns the registry of the ACME server, a copy of the given one
+// with the key authorization digests of the configuration. The given registry
+// is returned if there are none, so it's not modified on every reload.
+func acmeRegistry(reg *acme.Registry, o *config.ACMEOptions) (*acme.Registry, error) {
+	digests, err := acme.ParseKeyAuthorizationDigests(o.KeyAuthorizationDigests)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing acme keyAuthorizationDigests")
+	}
+	if len(digests) == 0 {
+		return reg, nil
+	}
+	reg = reg.Clone()
+	for typ, h := range digests {
+		if err := reg.RegisterKeyAuthorizationDigest(typ, h); err != nil {
+			return nil, errors.Wrap(err, "error parsing acme keyAuthorizationDigests")
+		}
+	}
+	return reg, nil
+}
+
+// setACMEValidationOptions sets the options of the clients used to validate
+// the ACME challenges.
+func setACMEValidationOptions(o *acmeAPI.HandlerOptions, v *config.ACMEValidationOptions) {
+	o.MaxIdleConns = v.MaxIdleConns
+	o.MaxIdleConnsPerHost = v.MaxIdleConnsPerHost
+	if v.TLSALPN01MinVersion != 0 {
+		o.TLSALPN01MinVersion = v.TLSALPN01MinVersion.Value()
+	}
+	o.MaxConcurrentValidations = v.MaxConcurrentValidations
+	o.HTTP01DisableRedirects = v.HTTP01DisableRedirects
+	o.HTTP01MaxRedirects = v.HTTP01MaxRedirects
+	o.HTTP01RedirectSchemes = v.HTTP01RedirectSchemes
+	if v.IdleConnTimeout != nil {
+		o.IdleConnTimeout = v.IdleConnTimeout.Duration
+	}
+	if v.DNSCache != nil && v.DNSCache.Enabled {
+		var minTTL, maxTTL time.Duration
+		if v.DNSCache.MinTTL != nil {
+			minTTL = v.DNSCache.MinTTL.Duration
+		}
+		if v.DNSCache.MaxTTL != nil {
+			maxTTL = v.DNSCache.MaxTTL.Duration
+		}
+		o.DNSCache = acme.NewDNSCache(v.DNSCache.MaxSize, minTTL, maxTTL, nil)
+	}
+}
+
+// acmePathPrefix returns the external path prefix of the ACME links.
+func acmePathPrefix(o *config.ACMEOptions) string {
+	if o == nil {
+		return ""
+	}
+	return o.PathPrefix
+}
+
+// newACMECircuitBreakerDB wraps the ACME database used by the ACME handler
+// with a circuit breaker. The cleanup uses the database directly.
+func newACMECircuitBreakerDB(db acme.DB, o *config.CircuitBreakerOptions) acme.DB {
+	opts := acme.CircuitBreakerOptions{
+		Threshold: o.Threshold,
+	}
+	if o.Cooldown != nil {
+		opts.Cooldown = o.Cooldown.Duration
+	}
+	return acme.NewCircuitBreakerDB(db, opts)
+}
+
+// runACMECleanup starts the periodic deletion of the expired ACME objects if
+// it's enabled and the ACME database supports it.
+func (ca *CA) runACMECleanup(opts *config.ACMECleanupOptions) {
+	if ca.acmeGC != nil {
+		ca.acmeGC.Stop()
+		ca.acmeGC = nil
+	}
+	if ca.acmeSweeper != nil {
+		ca.acmeSweeper.Stop()
+		ca.acmeSweeper = nil
+	}
+	if ca.acmeDB == nil {
+		return
+	}
+	if opts != nil && opts.Nonces != nil && opts.Nonces.Enabled {
+		sweeperOpts := acme.NonceSweeperOptions{
+			BatchSize: opts.Nonces.BatchSize,
+		}
+		if opts.Nonces.Interval != nil {
+			sweeperOpts.Interval = opts.Nonces.Interval.Duration
+		}
+		if opts.Nonces.MaxAge != nil {
+			sweeperOpts.MaxAge = opts.Nonces.MaxAge.Duration
+		}
+		if sweeper, ok := acme.NewNonceSweeper(ca.acmeDB, sweeperOpts); ok {
+			ca.acmeSweeper = sweeper
+			sweeper.Run()
+		}
+	}
+	if opts == nil || !opts.Enabled {
+		return
+	}
+	gcOpts := acme.GCOptions{
+		Retention: acme.DefaultGCRetention,
+		BatchSize: opts.BatchSize,
+	}
+	if opts.Interval != nil {
+		gcOpts.Interval = opts.Interval.Duration
+	}
+	if opts.Retention != nil {
+		gcOpts.Retention = opts.Retention.Duration
+	}
+	if gc, ok := acme.NewGC(ca.acmeDB, gcOpts); ok {
+		ca.acmeGC = gc
+		gc.Run()
+	}
+}
+
 // getTLSConfig returns a TLSConfig for the CA server with a self-renewing
 // server certificate.
 func (ca *CA) getTLSConfig(auth *authority.Authority) (*tls.Config, error) {
@@ -432,6 +695,13 @@ func (ca *CA) getTLSConfig(auth *authority.Authority) (*tls.Config, error) {
 	tlsConfig.Certificates = []tls.Certificate{}
 	tlsConfig.GetCertificate = ca.renewer.GetCertificateForCA
 
+	// Accept the client certificates of the PKIs trusted by the MTLS
+	// provisioners. The handler created with api.NewClientCertificateHandler
+	// makes sure that they can only be used to sign certificates.
+	for _, crt := range auth.GetClientCertificateRoots() {
+		certPool.AddCert(crt)
+	}
+
 	// Add support for mutual tls to renew certificates
 	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	tlsConfig.ClientCAs = certPool
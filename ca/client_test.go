@@ -357,7 +357,7 @@ func TestClient_Sign(t *testing.T) {
 				if err := api.ReadJSON(req.Body, body); err != nil {
 					e, ok := tt.response.(error)
 					assert.Fatal(t, ok, "response expected to be error type")
-					api.WriteError(w, e)
+					api.WriteError(w, req, e)
 					return
 				} else if !equalJSON(t, body, tt.request) {
 					if tt.request == nil {
@@ -429,7 +429,7 @@ func TestClient_Revoke(t *testing.T) {
 				if err := api.ReadJSON(req.Body, body); err != nil {
 					e, ok := tt.response.(error)
 					assert.Fatal(t, ok, "response expected to be error type")
-					api.WriteError(w, e)
+					api.WriteError(w, req, e)
 					return
 				} else if !equalJSON(t, body, tt.request) {
 					if tt.request == nil {
@@ -3,7 +3,11 @@ package softcas
 import (
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/x509"
+	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
@@ -219,6 +223,44 @@ func createCertificate(template, parent *x509.Certificate, pub crypto.PublicKey,
 		if sa, ok := signer.(apiv1.SignatureAlgorithmGetter); ok {
 			template.SignatureAlgorithm = sa.SignatureAlgorithm()
 		}
+	} else if !isCompatible(template.SignatureAlgorithm, signer.Public()) {
+		return nil, errors.Errorf("signature algorithm %s is not compatible with the issuer %s key",
+			template.SignatureAlgorithm, keyType(signer.Public()))
 	}
 	return x509util.CreateCertificate(template, parent, pub, signer)
 }
+
+// isCompatible returns true if the signature algorithm can be used with the
+// given issuer public key.
+func isCompatible(alg x509.SignatureAlgorithm, pub crypto.PublicKey) bool {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+			x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch alg {
+		case x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+			return true
+		}
+	case ed25519.PublicKey:
+		return alg == x509.PureEd25519
+	}
+	return false
+}
+
+// keyType returns a printable name of the type of the public key.
+func keyType(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "ECDSA"
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
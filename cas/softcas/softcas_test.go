@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"fmt"
@@ -257,6 +261,9 @@ func TestSoftCAS_CreateCertificate(t *testing.T) {
 	tmplNoSerial := *testTemplate
 	tmplNoSerial.SerialNumber = nil
 
+	tmplBadAlgorithm := *testTemplate
+	tmplBadAlgorithm.SignatureAlgorithm = x509.ECDSAWithSHA384
+
 	saTemplate := *testSignedTemplate
 	saTemplate.SignatureAlgorithm = 0
 	saSigner := &signatureAlgorithmSigner{
@@ -308,6 +315,10 @@ func TestSoftCAS_CreateCertificate(t *testing.T) {
 			Template: &tmplNoSerial,
 			Lifetime: 24 * time.Hour,
 		}}, nil, true},
+		{"fail incompatible signature algorithm", fields{testIssuer, testSigner}, args{&apiv1.CreateCertificateRequest{
+			Template: &tmplBadAlgorithm,
+			Lifetime: 24 * time.Hour,
+		}}, nil, true},
 	}
 
 	for _, tt := range tests {
@@ -609,3 +620,42 @@ func TestSoftCAS_CreateCertificateAuthority(t *testing.T) {
 		})
 	}
 }
+
+func Test_isCompatible(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		alg  x509.SignatureAlgorithm
+		pub  crypto.PublicKey
+		want bool
+	}{
+		{"ok rsa", x509.SHA384WithRSA, rsaKey.Public(), true},
+		{"ok rsa-pss", x509.SHA256WithRSAPSS, rsaKey.Public(), true},
+		{"ok ecdsa", x509.ECDSAWithSHA384, ecKey.Public(), true},
+		{"ok ed25519", x509.PureEd25519, edPub, true},
+		{"fail ecdsa with rsa", x509.ECDSAWithSHA384, rsaKey.Public(), false},
+		{"fail rsa with ecdsa", x509.SHA256WithRSA, ecKey.Public(), false},
+		{"fail ecdsa with ed25519", x509.ECDSAWithSHA256, edPub, false},
+		{"fail sha1", x509.SHA1WithRSA, rsaKey.Public(), false},
+		{"fail unknown key", x509.SHA256WithRSA, []byte("foo"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCompatible(tt.alg, tt.pub); got != tt.want {
+				t.Errorf("isCompatible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package db
 
 import (
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +19,9 @@ import (
 
 var (
 	certsTable             = []byte("x509_certs")
+	certsDataTable         = []byte("x509_certs_data")
+	certsByKeyTable        = []byte("x509_certs_by_key")
+	certsByExpiryTable     = []byte("x509_certs_by_expiry")
 	revokedCertsTable      = []byte("revoked_x509_certs")
 	revokedSSHCertsTable   = []byte("revoked_ssh_certs")
 	usedOTTTable           = []byte("used_ott")
@@ -35,6 +42,11 @@ type Config struct {
 	ValueDir   string `json:"valueDir,omitempty"`
 	Database   string `json:"database,omitempty"`
 
+	// MaxOpenConns and MaxIdleConns configure the pool of connections used by
+	// the PostgreSQL implementation of the ACME database.
+	MaxOpenConns int `json:"maxOpenConns,omitempty"`
+	MaxIdleConns int `json:"maxIdleConns,omitempty"`
+
 	// BadgerFileLoadingMode can be set to 'FileIO' (instead of the default
 	// 'MemoryMap') to avoid memory-mapping log files. This can be useful
 	// in environments with low RAM
@@ -80,9 +92,9 @@ func New(c *Config) (AuthDB, error) {
 	}
 
 	tables := [][]byte{
-		revokedCertsTable, certsTable, usedOTTTable,
+		revokedCertsTable, certsTable, certsDataTable, usedOTTTable,
 		sshCertsTable, sshHostsTable, sshHostPrincipalsTable, sshUsersTable,
-		revokedSSHCertsTable,
+		revokedSSHCertsTable, certsByKeyTable, certsByExpiryTable,
 	}
 	for _, b := range tables {
 		if err := db.CreateTable(b); err != nil {
@@ -201,9 +213,142 @@ func (db *DB) GetCertificate(serialNumber string) (*x509.Certificate, error) {
 	return cert, nil
 }
 
-// StoreCertificate stores a certificate PEM.
+// StoreCertificate stores a certificate PEM, and indexes its serial number by
+// the fingerprint of its public key and by its expiration. The certificate is
+// already stored when it's indexed, so the errors updating the indexes are
+// logged instead of returned.
 func (db *DB) StoreCertificate(crt *x509.Certificate) error {
-	if err := db.Set(certsTable, []byte(crt.SerialNumber.String()), crt.Raw); err != nil {
+	serial := crt.SerialNumber.String()
+	if err := db.Set(certsTable, []byte(serial), crt.Raw); err != nil {
+		return errors.Wrap(err, "database Set error")
+	}
+	if err := db.indexCertificateKey(crt); err != nil {
+		log.Printf("error indexing certificate %s by public key: %v", serial, err)
+	}
+	if err := db.indexCertificateExpiry(crt); err != nil {
+		log.Printf("error indexing certificate %s by expiration: %v", serial, err)
+	}
+	return nil
+}
+
+// PublicKeyFingerprint returns the hex encoded SHA-256 fingerprint of the
+// DER encoded public key of the certificate, the subject public key info.
+func PublicKeyFingerprint(crt *x509.Certificate) string {
+	sum := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// The certificates are indexed by the fingerprint of their public key using
+// one key per certificate, <fingerprint>/<n>, that stores its serial number,
+// and the key <fingerprint> stores the number of keys used. This way every
+// entry of the index stays small regardless of the number of certificates
+// with the same public key.
+func certKeyIndexKey(fingerprint string, n int) []byte {
+	return []byte(fmt.Sprintf("%s/%d", fingerprint, n))
+}
+
+// indexCertificateKey adds the serial number of the certificate to the index
+// of certificates by public key. A new key is reserved by incrementing the
+// count of the fingerprint with a compare-and-swap, retried if it was modified
+// concurrently, and then the serial number is stored in it.
+func (db *DB) indexCertificateKey(crt *x509.Certificate) error {
+	fingerprint := PublicKeyFingerprint(crt)
+	for {
+		n, old, err := db.getCertificateKeyCount(fingerprint)
+		if err != nil {
+			return err
+		}
+		_, swapped, err := db.CmpAndSwap(certsByKeyTable, []byte(fingerprint), old, []byte(strconv.Itoa(n+1)))
+		if err != nil {
+			return errors.Wrap(err, "database CmpAndSwap error")
+		}
+		if swapped {
+			if err := db.Set(certsByKeyTable, certKeyIndexKey(fingerprint, n), []byte(crt.SerialNumber.String())); err != nil {
+				return errors.Wrap(err, "database Set error")
+			}
+			return nil
+		}
+	}
+}
+
+// getCertificateKeyCount returns the number of keys used in the index by the
+// given fingerprint and its stored representation, nil if there are none.
+func (db *DB) getCertificateKeyCount(fingerprint string) (int, []byte, error) {
+	b, err := db.Get(certsByKeyTable, []byte(fingerprint))
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return 0, nil, nil
+		}
+		return 0, nil, errors.Wrap(err, "database Get error")
+	}
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "error parsing certificates by key %s", fingerprint)
+	}
+	return n, b, nil
+}
+
+// GetCertificatesByKey returns the serial numbers of the certificates with the
+// public key with the given SHA-256 fingerprint, see PublicKeyFingerprint.
+// Only the certificates stored after the index was added are returned.
+func (db *DB) GetCertificatesByKey(fingerprint string) ([]string, error) {
+	n, _, err := db.getCertificateKeyCount(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	var serials []string
+	seen := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		b, err := db.Get(certsByKeyTable, certKeyIndexKey(fingerprint, i))
+		if err != nil {
+			// The key is reserved before the serial number is stored.
+			if nosql.IsErrNotFound(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "database Get error")
+		}
+		if serial := string(b); !seen[serial] {
+			seen[serial] = true
+			serials = append(serials, serial)
+		}
+	}
+	return serials, nil
+}
+
+// CertificateData contains the issuance metadata stored alongside a
+// certificate. AccountID and OrderID are only set for certificates issued
+// using the ACME protocol.
+type CertificateData struct {
+	AccountID string `json:"accountID,omitempty"`
+	OrderID   string `json:"orderID,omitempty"`
+}
+
+// GetCertificateData retrieves the issuance metadata of the certificate with
+// the given serial number. It returns nil if the certificate does not have any
+// metadata.
+func (db *DB) GetCertificateData(serialNumber string) (*CertificateData, error) {
+	b, err := db.Get(certsDataTable, []byte(serialNumber))
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "database Get error")
+	}
+	data := new(CertificateData)
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling certificate data with serial number %s", serialNumber)
+	}
+	return data, nil
+}
+
+// StoreCertificateData stores the issuance metadata of the certificate with
+// the given serial number.
+func (db *DB) StoreCertificateData(serialNumber string, data *CertificateData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling certificate data")
+	}
+	if err := db.Set(certsDataTable, []byte(serialNumber), b); err != nil {
 		return errors.Wrap(err, "database Set error")
 	}
 	return nil
@@ -304,6 +449,10 @@ type MockAuthDB struct {
 	MRevokeSSH            func(rci *RevokedCertificateInfo) error
 	MGetCertificate       func(serialNumber string) (*x509.Certificate, error)
 	MStoreCertificate     func(crt *x509.Certificate) error
+	MGetCertificateData   func(serialNumber string) (*CertificateData, error)
+	MStoreCertificateData func(serialNumber string, data *CertificateData) error
+	MIterateCertificates  func(cursor string, fn func(serialNumber string, crt *x509.Certificate) (bool, error)) error
+	MGetCertificatesByKey func(fingerprint string) ([]string, error)
 	MUseToken             func(id, tok string) (bool, error)
 	MIsSSHHost            func(principal string) (bool, error)
 	MStoreSSHCertificate  func(crt *ssh.Certificate) error
@@ -370,6 +519,40 @@ func (m *MockAuthDB) StoreCertificate(crt *x509.Certificate) error {
 	return m.Err
 }
 
+// GetCertificateData mock.
+func (m *MockAuthDB) GetCertificateData(serialNumber string) (*CertificateData, error) {
+	if m.MGetCertificateData != nil {
+		return m.MGetCertificateData(serialNumber)
+	}
+	data, _ := m.Ret1.(*CertificateData)
+	return data, m.Err
+}
+
+// StoreCertificateData mock.
+func (m *MockAuthDB) StoreCertificateData(serialNumber string, data *CertificateData) error {
+	if m.MStoreCertificateData != nil {
+		return m.MStoreCertificateData(serialNumber, data)
+	}
+	return m.Err
+}
+
+// IterateCertificates mock.
+func (m *MockAuthDB) IterateCertificates(cursor string, fn func(serialNumber string, crt *x509.Certificate) (bool, error)) error {
+	if m.MIterateCertificates != nil {
+		return m.MIterateCertificates(cursor, fn)
+	}
+	return m.Err
+}
+
+// GetCertificatesByKey mock.
+func (m *MockAuthDB) GetCertificatesByKey(fingerprint string) ([]string, error) {
+	if m.MGetCertificatesByKey != nil {
+		return m.MGetCertificatesByKey(fingerprint)
+	}
+	serials, _ := m.Ret1.([]string)
+	return serials, m.Err
+}
+
 // IsSSHHost mock.
 func (m *MockAuthDB) IsSSHHost(principal string) (bool, error) {
 	if m.MIsSSHHost != nil {
@@ -1,8 +1,17 @@
 package db
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"math/big"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/smallstep/assert"
 	"github.com/smallstep/nosql/database"
@@ -158,3 +167,315 @@ func TestUseToken(t *testing.T) {
 		})
 	}
 }
+
+func TestDB_GetCertificateData(t *testing.T) {
+	tests := map[string]struct {
+		db   *DB
+		want *CertificateData
+		err  error
+	}{
+		"ok/not-found": {
+			db: &DB{&MockNoSQLDB{Err: database.ErrNotFound}, true},
+		},
+		"fail/get-error": {
+			db:  &DB{&MockNoSQLDB{Err: errors.New("force")}, true},
+			err: errors.New("database Get error: force"),
+		},
+		"fail/unmarshal-error": {
+			db:  &DB{&MockNoSQLDB{Ret1: []byte("foo")}, true},
+			err: errors.New("error unmarshaling certificate data with serial number 1234"),
+		},
+		"ok": {
+			db: &DB{&MockNoSQLDB{
+				MGet: func(bucket, key []byte) ([]byte, error) {
+					assert.Equals(t, bucket, certsDataTable)
+					assert.Equals(t, key, []byte("1234"))
+					return []byte(`{"accountID":"accID","orderID":"ordID"}`), nil
+				},
+			}, true},
+			want: &CertificateData{AccountID: "accID", OrderID: "ordID"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := tc.db.GetCertificateData("1234")
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+			} else {
+				assert.Nil(t, tc.err)
+				assert.Equals(t, data, tc.want)
+			}
+		})
+	}
+}
+
+func TestDB_StoreCertificateData(t *testing.T) {
+	tests := map[string]struct {
+		db  *DB
+		err error
+	}{
+		"fail/set-error": {
+			db: &DB{&MockNoSQLDB{
+				MSet: func(bucket, key, value []byte) error {
+					return errors.New("force")
+				},
+			}, true},
+			err: errors.New("database Set error: force"),
+		},
+		"ok": {
+			db: &DB{&MockNoSQLDB{
+				MSet: func(bucket, key, value []byte) error {
+					assert.Equals(t, bucket, certsDataTable)
+					assert.Equals(t, key, []byte("1234"))
+					assert.Equals(t, value, []byte(`{"accountID":"accID","orderID":"ordID"}`))
+					return nil
+				},
+			}, true},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.db.StoreCertificateData("1234", &CertificateData{AccountID: "accID", OrderID: "ordID"})
+			if err != nil {
+				if assert.NotNil(t, tc.err) {
+					assert.HasPrefix(t, err.Error(), tc.err.Error())
+				}
+			} else {
+				assert.Nil(t, tc.err)
+			}
+		})
+	}
+}
+
+func TestDB_StoreCertificate_keyIndex(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	newCert := func(serial int64) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "test"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+		assert.FatalError(t, err)
+		crt, err := x509.ParseCertificate(der)
+		assert.FatalError(t, err)
+		return crt
+	}
+
+	// An in-memory database, the first compare-and-swap of the index by key
+	// simulates a concurrent update and fails.
+	data := map[string]map[string][]byte{}
+	mdb := memoryNoSQLDB(data)
+	cmpAndSwap := mdb.MCmpAndSwap
+	conflict := true
+	mdb.MCmpAndSwap = func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+		if string(bucket) == string(certsByKeyTable) && conflict {
+			conflict = false
+			return nil, false, nil
+		}
+		return cmpAndSwap(bucket, key, old, nu)
+	}
+	db := &DB{mdb, true}
+
+	crt1, crt2 := newCert(1), newCert(2)
+	assert.FatalError(t, db.StoreCertificate(crt1))
+	assert.FatalError(t, db.StoreCertificate(crt2))
+	assert.FatalError(t, db.StoreCertificate(crt1))
+
+	fp := PublicKeyFingerprint(crt1)
+	assert.Equals(t, fp, PublicKeyFingerprint(crt2))
+	assert.Len(t, 64, fp)
+	serials, err := db.GetCertificatesByKey(fp)
+	assert.FatalError(t, err)
+	assert.Equals(t, serials, []string{"1", "2"})
+
+	// Every serial number is stored in its own key.
+	assert.Equals(t, data[string(certsByKeyTable)], map[string][]byte{
+		fp:        []byte("3"),
+		fp + "/0": []byte("1"),
+		fp + "/1": []byte("2"),
+		fp + "/2": []byte("1"),
+	})
+
+	serials, err = db.GetCertificatesByKey("unknown")
+	assert.FatalError(t, err)
+	assert.Len(t, 0, serials)
+
+	// A reserved key without a serial number is skipped.
+	data[string(certsByKeyTable)][fp] = []byte("4")
+	serials, err = db.GetCertificatesByKey(fp)
+	assert.FatalError(t, err)
+	assert.Equals(t, serials, []string{"1", "2"})
+
+	// Errors updating the index don't fail storing the certificate, but
+	// errors reading it are returned.
+	db = &DB{&MockNoSQLDB{
+		MSet: func(bucket, key, value []byte) error { return nil },
+		MGet: func(bucket, key []byte) ([]byte, error) {
+			return nil, errors.New("force")
+		},
+	}, true}
+	assert.FatalError(t, db.StoreCertificate(crt1))
+	_, err = db.GetCertificatesByKey(fp)
+	if assert.NotNil(t, err) {
+		assert.Equals(t, err.Error(), "database Get error: force")
+	}
+}
+
+// memoryNoSQLDB returns a mock that stores the data in the given map of
+// tables.
+func memoryNoSQLDB(data map[string]map[string][]byte) *MockNoSQLDB {
+	return &MockNoSQLDB{
+		MGet: func(bucket, key []byte) ([]byte, error) {
+			if b, ok := data[string(bucket)][string(key)]; ok {
+				return b, nil
+			}
+			return nil, database.ErrNotFound
+		},
+		MSet: func(bucket, key, value []byte) error {
+			if data[string(bucket)] == nil {
+				data[string(bucket)] = map[string][]byte{}
+			}
+			data[string(bucket)][string(key)] = value
+			return nil
+		},
+		MList: func(bucket []byte) ([]*database.Entry, error) {
+			keys := make([]string, 0, len(data[string(bucket)]))
+			for k := range data[string(bucket)] {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			entries := make([]*database.Entry, len(keys))
+			for i, k := range keys {
+				entries[i] = &database.Entry{Bucket: bucket, Key: []byte(k), Value: data[string(bucket)][k]}
+			}
+			return entries, nil
+		},
+		MCmpAndSwap: func(bucket, key, old, nu []byte) ([]byte, bool, error) {
+			cur, ok := data[string(bucket)][string(key)]
+			if ok != (old != nil) || !bytes.Equal(cur, old) {
+				return cur, false, nil
+			}
+			if data[string(bucket)] == nil {
+				data[string(bucket)] = map[string][]byte{}
+			}
+			data[string(bucket)][string(key)] = nu
+			return nu, true, nil
+		},
+	}
+}
+
+func TestDB_IterateCertificates(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	now := time.Now()
+	newCert := func(serial int64, notAfter time.Time) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "test"},
+			NotBefore:    now.Add(-48 * time.Hour),
+			NotAfter:     notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+		assert.FatalError(t, err)
+		crt, err := x509.ParseCertificate(der)
+		assert.FatalError(t, err)
+		return crt
+	}
+	// Certificates 1 to 4 expire in order, 5 has already expired.
+	crts := []*x509.Certificate{
+		newCert(3, now.Add(3*time.Hour)),
+		newCert(1, now.Add(time.Hour)),
+		newCert(4, now.Add(4*time.Hour)),
+		newCert(2, now.Add(2*time.Hour)),
+		newCert(5, now.Add(-2*time.Hour)),
+	}
+	iterate := func(t *testing.T, db *DB, cursor, stop string) ([]string, error) {
+		var got []string
+		err := db.IterateCertificates(cursor, func(serial string, crt *x509.Certificate) (bool, error) {
+			assert.Equals(t, crt.SerialNumber.String(), serial)
+			got = append(got, serial)
+			return serial != stop, nil
+		})
+		return got, err
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		data := map[string]map[string][]byte{}
+		mdb := memoryNoSQLDB(data)
+		db := &DB{mdb, true}
+		for _, crt := range crts {
+			assert.FatalError(t, db.StoreCertificate(crt))
+		}
+		// The certificates are found using the index only.
+		mdb.MList = func(bucket []byte) ([]*database.Entry, error) {
+			return nil, errors.New("force")
+		}
+		assert.FatalError(t, db.updateCertExpiryIndex(func(ei *certExpiryIndex) bool {
+			ei.Indexed = true
+			return true
+		}))
+
+		got, err := iterate(t, db, "", "")
+		assert.FatalError(t, err)
+		assert.Equals(t, got, []string{"1", "2", "3", "4"})
+
+		got, err = iterate(t, db, "2", "")
+		assert.FatalError(t, err)
+		assert.Equals(t, got, []string{"3", "4"})
+
+		got, err = iterate(t, db, "", "2")
+		assert.FatalError(t, err)
+		assert.Equals(t, got, []string{"1", "2"})
+
+		got, err = iterate(t, db, "4", "")
+		assert.FatalError(t, err)
+		assert.Len(t, 0, got)
+
+		_, err = iterate(t, db, "6", "")
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "error loading certificate 6")
+		}
+	})
+
+	t.Run("ok/bootstrap", func(t *testing.T) {
+		// Certificates stored before the index existed.
+		data := map[string]map[string][]byte{string(certsTable): {}}
+		for _, crt := range crts {
+			data[string(certsTable)][crt.SerialNumber.String()] = crt.Raw
+		}
+		db := &DB{memoryNoSQLDB(data), true}
+		got, err := iterate(t, db, "", "")
+		assert.FatalError(t, err)
+		assert.Equals(t, got, []string{"1", "2", "3", "4"})
+
+		ei, _, err := db.getCertExpiryIndex()
+		assert.FatalError(t, err)
+		assert.True(t, ei.Indexed)
+		assert.Len(t, 4, ei.Buckets)
+	})
+
+	t.Run("fail/parse-error", func(t *testing.T) {
+		data := map[string]map[string][]byte{string(certsTable): {"1": []byte("foo")}}
+		_, err := iterate(t, &DB{memoryNoSQLDB(data), true}, "", "")
+		if assert.NotNil(t, err) {
+			assert.HasPrefix(t, err.Error(), "error parsing certificate 1")
+		}
+	})
+
+	t.Run("fail/get-error", func(t *testing.T) {
+		db := &DB{&MockNoSQLDB{
+			MGet: func(bucket, key []byte) ([]byte, error) {
+				return nil, errors.New("force")
+			},
+		}, true}
+		_, err := iterate(t, db, "", "")
+		if assert.NotNil(t, err) {
+			assert.Equals(t, err.Error(), "database Get error: force")
+		}
+	})
+}
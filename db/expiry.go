@@ -0,0 +1,292 @@
+package db
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+)
+
+// The certificates are indexed by the hour they expire, and each hour is split
+// in shards so the concurrent writes rarely conflict and every entry of the
+// index stays small.
+const (
+	certExpiryBucketSize = time.Hour
+	certExpiryShards     = 16
+)
+
+// certExpiryIndexKey is the key of the list of buckets in the index.
+var certExpiryIndexKey = []byte("buckets")
+
+// certExpiryIndex is the sorted list of buckets that contain certificates that
+// have not expired. Indexed is set once the certificates stored before the
+// index existed have been added to it.
+type certExpiryIndex struct {
+	Buckets []int64 `json:"buckets"`
+	Indexed bool    `json:"indexed"`
+}
+
+func certExpiryBucket(t time.Time) int64 {
+	return t.Truncate(certExpiryBucketSize).Unix()
+}
+
+func certExpiryShard(serial string) uint32 {
+	return crc32.ChecksumIEEE([]byte(serial)) % certExpiryShards
+}
+
+func certExpiryKey(bucket int64, shard uint32) []byte {
+	return []byte(fmt.Sprintf("%d/%d", bucket, shard))
+}
+
+// bucketExpired returns true if all the certificates in the bucket have
+// expired at the given time.
+func bucketExpired(bucket int64, now time.Time) bool {
+	return !time.Unix(bucket, 0).Add(certExpiryBucketSize).After(now)
+}
+
+// getCertExpiryIndex returns the list of buckets of the index and its stored
+// representation, nil if the index does not exist.
+func (db *DB) getCertExpiryIndex() (*certExpiryIndex, []byte, error) {
+	b, err := db.Get(certsByExpiryTable, certExpiryIndexKey)
+	if nosql.IsErrNotFound(err) {
+		return new(certExpiryIndex), nil, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrap(err, "database Get error")
+	}
+	ei := new(certExpiryIndex)
+	if err := json.Unmarshal(b, ei); err != nil {
+		return nil, nil, errors.Wrap(err, "error unmarshaling certificates expiry index")
+	}
+	return ei, b, nil
+}
+
+// updateCertExpiryIndex changes the list of buckets of the index using fn,
+// that returns false if there is nothing to change. It's retried if the index
+// is updated concurrently.
+func (db *DB) updateCertExpiryIndex(fn func(ei *certExpiryIndex) bool) error {
+	for {
+		ei, old, err := db.getCertExpiryIndex()
+		if err != nil {
+			return err
+		}
+		if !fn(ei) {
+			return nil
+		}
+		b, err := json.Marshal(ei)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling certificates expiry index")
+		}
+		_, swapped, err := db.CmpAndSwap(certsByExpiryTable, certExpiryIndexKey, old, b)
+		if err != nil {
+			return errors.Wrap(err, "database CmpAndSwap error")
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// addCertExpiryBuckets adds the given buckets to the index, and removes the
+// buckets whose certificates have all expired.
+func (db *DB) addCertExpiryBuckets(buckets ...int64) error {
+	now := time.Now()
+	return db.updateCertExpiryIndex(func(ei *certExpiryIndex) bool {
+		changed := false
+		current := ei.Buckets[:0]
+		for _, bucket := range ei.Buckets {
+			if bucketExpired(bucket, now) {
+				changed = true
+			} else {
+				current = append(current, bucket)
+			}
+		}
+		ei.Buckets = current
+		for _, bucket := range buckets {
+			i := sort.Search(len(ei.Buckets), func(i int) bool { return ei.Buckets[i] >= bucket })
+			if i == len(ei.Buckets) || ei.Buckets[i] != bucket {
+				ei.Buckets = append(ei.Buckets, 0)
+				copy(ei.Buckets[i+1:], ei.Buckets[i:])
+				ei.Buckets[i] = bucket
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// getCertExpirySerials returns the serial numbers stored in the given key of
+// the index and its stored representation, nil if the key does not exist.
+func (db *DB) getCertExpirySerials(key []byte) ([]string, []byte, error) {
+	b, err := db.Get(certsByExpiryTable, key)
+	if nosql.IsErrNotFound(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, errors.Wrap(err, "database Get error")
+	}
+	var serials []string
+	if err := json.Unmarshal(b, &serials); err != nil {
+		return nil, nil, errors.Wrapf(err, "error unmarshaling certificates expiry index %s", key)
+	}
+	return serials, b, nil
+}
+
+// addCertExpirySerials adds the given serial numbers to a bucket of the index.
+// The bucket must have been added with addCertExpiryBuckets first.
+func (db *DB) addCertExpirySerials(bucket int64, serials ...string) error {
+	shards := make(map[uint32][]string)
+	for _, serial := range serials {
+		shard := certExpiryShard(serial)
+		shards[shard] = append(shards[shard], serial)
+	}
+	for shard, serials := range shards {
+		key := certExpiryKey(bucket, shard)
+		for {
+			cur, old, err := db.getCertExpirySerials(key)
+			if err != nil {
+				return err
+			}
+			seen := make(map[string]bool, len(cur))
+			for _, serial := range cur {
+				seen[serial] = true
+			}
+			nu := cur
+			for _, serial := range serials {
+				if !seen[serial] {
+					seen[serial] = true
+					nu = append(nu, serial)
+				}
+			}
+			if len(nu) == len(cur) {
+				break
+			}
+			b, err := json.Marshal(nu)
+			if err != nil {
+				return errors.Wrapf(err, "error marshaling certificates expiry index %s", key)
+			}
+			_, swapped, err := db.CmpAndSwap(certsByExpiryTable, key, old, b)
+			if err != nil {
+				return errors.Wrap(err, "database CmpAndSwap error")
+			}
+			if swapped {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// indexCertificateExpiry adds the certificate to the expiry index.
+func (db *DB) indexCertificateExpiry(crt *x509.Certificate) error {
+	bucket := certExpiryBucket(crt.NotAfter)
+	if err := db.addCertExpiryBuckets(bucket); err != nil {
+		return err
+	}
+	return db.addCertExpirySerials(bucket, crt.SerialNumber.String())
+}
+
+// loadCertExpiryIndex returns the list of buckets of the index. The first time
+// it's called, the certificates stored before the index existed are added to
+// it, which requires loading the whole table once.
+func (db *DB) loadCertExpiryIndex() (*certExpiryIndex, error) {
+	ei, _, err := db.getCertExpiryIndex()
+	if err != nil || ei.Indexed {
+		return ei, err
+	}
+
+	entries, err := db.List(certsTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "database List error")
+	}
+	now := time.Now()
+	serialsByBucket := make(map[int64][]string)
+	for _, e := range entries {
+		crt, err := x509.ParseCertificate(e.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing certificate %s", e.Key)
+		}
+		if bucket := certExpiryBucket(crt.NotAfter); !bucketExpired(bucket, now) {
+			serialsByBucket[bucket] = append(serialsByBucket[bucket], string(e.Key))
+		}
+	}
+	buckets := make([]int64, 0, len(serialsByBucket))
+	for bucket := range serialsByBucket {
+		buckets = append(buckets, bucket)
+	}
+	if err := db.addCertExpiryBuckets(buckets...); err != nil {
+		return nil, err
+	}
+	for bucket, serials := range serialsByBucket {
+		if err := db.addCertExpirySerials(bucket, serials...); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.updateCertExpiryIndex(func(ei *certExpiryIndex) bool {
+		ei.Indexed = true
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	ei, _, err = db.getCertExpiryIndex()
+	return ei, err
+}
+
+// IterateCertificates calls fn with the certificates that might not have
+// expired, starting after the certificate with the given serial number, until
+// fn returns false or an error. The certificates are visited in order of
+// expiration hour, and only one shard of an hour is loaded at a time. Expired
+// certificates in the current hour are also visited.
+func (db *DB) IterateCertificates(cursor string, fn func(serialNumber string, crt *x509.Certificate) (bool, error)) error {
+	ei, err := db.loadCertExpiryIndex()
+	if err != nil {
+		return err
+	}
+
+	var (
+		startBucket int64
+		startShard  uint32
+	)
+	if cursor != "" {
+		crt, err := db.GetCertificate(cursor)
+		if err != nil {
+			return errors.Wrapf(err, "error loading certificate %s", cursor)
+		}
+		startBucket = certExpiryBucket(crt.NotAfter)
+		startShard = certExpiryShard(cursor)
+	}
+
+	now := time.Now()
+	for _, bucket := range ei.Buckets {
+		if bucket < startBucket || bucketExpired(bucket, now) {
+			continue
+		}
+		for shard := uint32(0); shard < certExpiryShards; shard++ {
+			atCursor := cursor != "" && bucket == startBucket
+			if atCursor && shard < startShard {
+				continue
+			}
+			serials, _, err := db.getCertExpirySerials(certExpiryKey(bucket, shard))
+			if err != nil {
+				return err
+			}
+			sort.Strings(serials)
+			for _, serial := range serials {
+				if atCursor && shard == startShard && serial <= cursor {
+					continue
+				}
+				crt, err := db.GetCertificate(serial)
+				if err != nil {
+					return errors.Wrapf(err, "error loading certificate %s", serial)
+				}
+				if ok, err := fn(serial, crt); err != nil || !ok {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
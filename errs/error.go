@@ -56,16 +56,18 @@ func WithKeyVal(key string, val interface{}) Option {
 
 // Error represents the CA API errors.
 type Error struct {
-	Status  int
-	Err     error
-	Msg     string
-	Details map[string]interface{}
+	Status    int
+	Err       error
+	Msg       string
+	Details   map[string]interface{}
+	RequestID string
 }
 
 // ErrorResponse represents an error in JSON format.
 type ErrorResponse struct {
-	Status  int    `json:"status"`
-	Message string `json:"message"`
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
 }
 
 // Cause implements the errors.Causer interface and returns the original error.
@@ -132,7 +134,7 @@ func (e *Error) MarshalJSON() ([]byte, error) {
 	} else {
 		msg = http.StatusText(e.Status)
 	}
-	return json.Marshal(&ErrorResponse{Status: e.Status, Message: msg})
+	return json.Marshal(&ErrorResponse{Status: e.Status, Message: msg, RequestID: e.RequestID})
 }
 
 // UnmarshalJSON implements json.Unmarshaler interface for the Error struct.
@@ -143,6 +145,7 @@ func (e *Error) UnmarshalJSON(data []byte) error {
 	}
 	e.Status = er.Status
 	e.Err = fmt.Errorf(er.Message)
+	e.RequestID = er.RequestID
 	return nil
 }
 
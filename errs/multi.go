@@ -0,0 +1,76 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MultiError is a list of errors that are reported together, e.g. all the
+// problems found while validating a configuration.
+type MultiError []error
+
+// Error implements the error interface and returns all the error strings.
+func (e MultiError) Error() string {
+	switch len(e) {
+	case 0:
+		return "no errors"
+	case 1:
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = "\t* " + err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// Is returns true if any of the errors in the list matches the target, it
+// allows errors.Is to inspect all of them.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error in the list that matches the target, and if one
+// is found, sets the target to that error value and returns true. It allows
+// errors.As to inspect all of them.
+func (e MultiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Append adds the given error to the list, nil errors are ignored and the
+// errors in a MultiError are added one by one.
+func (e *MultiError) Append(err error) {
+	switch v := err.(type) {
+	case nil:
+	case MultiError:
+		for _, err := range v {
+			e.Append(err)
+		}
+	default:
+		*e = append(*e, err)
+	}
+}
+
+// ErrorOrNil returns nil if the list is empty, the error if there's only one,
+// and the MultiError otherwise.
+func (e MultiError) ErrorOrNil() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	default:
+		return e
+	}
+}
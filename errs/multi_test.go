@@ -0,0 +1,74 @@
+package errs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMultiError(t *testing.T) {
+	err1 := errors.New("first error")
+	err2 := errors.New("second error")
+	err3 := errors.New("third error")
+
+	tests := []struct {
+		name    string
+		errs    []error
+		want    string
+		wantNil bool
+	}{
+		{"empty", nil, "", true},
+		{"nil errors", []error{nil, nil}, "", true},
+		{"one error", []error{nil, err1}, "first error", false},
+		{"many errors", []error{err1, nil, err2}, "2 errors occurred:\n\t* first error\n\t* second error", false},
+		{"flattened", []error{err1, MultiError{err2, err3}}, "3 errors occurred:\n\t* first error\n\t* second error\n\t* third error", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var merr MultiError
+			for _, err := range tt.errs {
+				merr.Append(err)
+			}
+			err := merr.ErrorOrNil()
+			if tt.wantNil {
+				if err != nil {
+					t.Errorf("MultiError.ErrorOrNil() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("MultiError.ErrorOrNil() = %v, want %s", err, tt.want)
+			}
+			if !errors.Is(err, err1) {
+				t.Errorf("errors.Is(%v, %v) = false, want true", err, err1)
+			}
+			var target *testError
+			if errors.As(err, &target) {
+				t.Errorf("errors.As(%v, %T) = true, want false", err, target)
+			}
+		})
+	}
+}
+
+type testError struct {
+	msg string
+}
+
+func (e *testError) Error() string {
+	return e.msg
+}
+
+func TestMultiError_As(t *testing.T) {
+	want := &testError{"test error"}
+	merr := MultiError{errors.New("first error"), want, &testError{"other error"}}
+
+	var got *testError
+	if !errors.As(merr, &got) {
+		t.Fatalf("errors.As(%v, %T) = false, want true", merr, got)
+	}
+	if got != want {
+		t.Errorf("errors.As() target = %v, want %v", got, want)
+	}
+	if errors.Is(merr, errors.New("first error")) {
+		t.Errorf("errors.Is() = true, want false")
+	}
+}
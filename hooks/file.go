@@ -0,0 +1,44 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileHook is an issuance hook that appends the issuance events to a file in
+// JSON, one per line. The file is opened on every event, so it can be rotated
+// by an external process.
+type FileHook struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileHook creates a new FileHook that writes to the given path.
+func NewFileHook(path string) *FileHook {
+	return &FileHook{path: path}
+}
+
+// Issued appends the issuance event to the file.
+func (h *FileHook) Issued(ctx context.Context, e *IssuanceEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling issuance event")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %s", h.path)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "error writing %s", h.path)
+	}
+	return errors.Wrapf(f.Close(), "error closing %s", h.path)
+}
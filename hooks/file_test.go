@@ -0,0 +1,46 @@
+package hooks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func TestFileHook_Issued(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "issued.json")
+	crt := mustCertificate(t)
+
+	h := NewFileHook(path)
+	assert.FatalError(t, h.Issued(context.Background(), NewIssuanceEvent(SignEvent, crt)))
+	assert.FatalError(t, h.Issued(context.Background(), NewIssuanceEvent(RenewEvent, crt)))
+
+	f, err := os.Open(path)
+	assert.FatalError(t, err)
+	defer f.Close()
+
+	var types []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e IssuanceEvent
+		assert.FatalError(t, json.Unmarshal(scanner.Bytes(), &e))
+		assert.Equals(t, e.SerialNumber, crt.SerialNumber.String())
+		types = append(types, e.Type)
+	}
+	assert.FatalError(t, scanner.Err())
+	assert.Equals(t, types, []string{"sign", "renew"})
+
+	fi, err := f.Stat()
+	assert.FatalError(t, err)
+	assert.Equals(t, fi.Mode().Perm(), os.FileMode(0600))
+}
+
+func TestFileHook_Issued_error(t *testing.T) {
+	h := NewFileHook(filepath.Join(t.TempDir(), "missing", "issued.json"))
+	err := h.Issued(context.Background(), NewIssuanceEvent(SignEvent, mustCertificate(t)))
+	assert.NotNil(t, err)
+}
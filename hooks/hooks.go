@@ -0,0 +1,165 @@
+package hooks
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// Hook types.
+const (
+	// HTTPType is the type of the hooks that POST the issued certificates to
+	// an HTTP endpoint.
+	HTTPType = "http"
+	// FileType is the type of the hooks that append the issued certificates to
+	// a file.
+	FileType = "file"
+)
+
+// Issuance event types.
+const (
+	SignEvent  = "sign"
+	RenewEvent = "renew"
+	RekeyEvent = "rekey"
+)
+
+// IssuanceHook is the interface implemented by the hooks called after a
+// certificate has been issued and stored.
+type IssuanceHook interface {
+	Issued(ctx context.Context, e *IssuanceEvent) error
+}
+
+// IssuanceHookFunc is an adapter to use a function as an IssuanceHook.
+type IssuanceHookFunc func(ctx context.Context, e *IssuanceEvent) error
+
+// Issued implements the IssuanceHook interface.
+func (f IssuanceHookFunc) Issued(ctx context.Context, e *IssuanceEvent) error {
+	return f(ctx, e)
+}
+
+// IssuanceEvent contains the issued certificate and its metadata.
+type IssuanceEvent struct {
+	Type           string    `json:"type"`
+	SerialNumber   string    `json:"serialNumber"`
+	Subject        string    `json:"subject"`
+	DNSNames       []string  `json:"dnsNames,omitempty"`
+	IPAddresses    []string  `json:"ipAddresses,omitempty"`
+	EmailAddresses []string  `json:"emailAddresses,omitempty"`
+	URIs           []string  `json:"uris,omitempty"`
+	NotBefore      time.Time `json:"notBefore"`
+	NotAfter       time.Time `json:"notAfter"`
+	Provisioner    string    `json:"provisioner,omitempty"`
+	ACMEAccountID  string    `json:"acmeAccountID,omitempty"`
+	ACMEOrderID    string    `json:"acmeOrderID,omitempty"`
+	Certificate    string    `json:"certificate"`
+	IssuedAt       time.Time `json:"issuedAt"`
+}
+
+// NewIssuanceEvent creates an issuance event of the given type with the
+// details of the certificate. The certificate is PEM encoded.
+func NewIssuanceEvent(typ string, crt *x509.Certificate) *IssuanceEvent {
+	e := &IssuanceEvent{
+		Type:           typ,
+		SerialNumber:   crt.SerialNumber.String(),
+		Subject:        crt.Subject.String(),
+		DNSNames:       crt.DNSNames,
+		EmailAddresses: crt.EmailAddresses,
+		NotBefore:      crt.NotBefore,
+		NotAfter:       crt.NotAfter,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: crt.Raw,
+		})),
+		IssuedAt: time.Now().UTC(),
+	}
+	for _, ip := range crt.IPAddresses {
+		e.IPAddresses = append(e.IPAddresses, ip.String())
+	}
+	for _, u := range crt.URIs {
+		e.URIs = append(e.URIs, u.String())
+	}
+	return e
+}
+
+// Options are the options of an issuance hook. They represent an element of
+// the issuanceHooks array in the ca.json.
+//
+// The http hooks POST the issuance event in JSON to the given URL. If a Secret
+// is set, the request includes the X-Smallstep-Signature header with the
+// hex-encoded HMAC-SHA256 of the body. A request is attempted up to
+// MaxAttempts times, 3 by default, while the endpoint is not reachable or
+// responds with a 429 or 5xx status code. Each attempt times out after
+// Timeout, 10 seconds by default.
+//
+// The file hooks append the issuance event in JSON, one per line, to the file
+// in Path.
+//
+// By default hook failures are logged and the certificate is still returned
+// to the client. With FailOnError the failure is returned instead. The
+// synchronous hooks of a certificate must complete within 10 seconds in total,
+// after that the pending requests and retries are canceled and the hooks fail.
+//
+// The Async hooks are called in the background through the issuance Queue,
+// they cannot use FailOnError.
+type Options struct {
+	Type        string                `json:"type"`
+	URL         string                `json:"url,omitempty"`
+	Secret      string                `json:"secret,omitempty"`
+	MaxAttempts int                   `json:"maxAttempts,omitempty"`
+	Timeout     *provisioner.Duration `json:"timeout,omitempty"`
+	Path        string                `json:"path,omitempty"`
+	FailOnError bool                  `json:"failOnError,omitempty"`
+	Async       bool                  `json:"async,omitempty"`
+}
+
+// Validate validates the issuance hook options.
+func (o *Options) Validate() error {
+	if o == nil {
+		return errors.New("issuanceHooks cannot contain empty elements")
+	}
+	if o.Async && o.FailOnError {
+		return errors.New("issuanceHooks async hooks cannot use failOnError")
+	}
+	switch strings.ToLower(o.Type) {
+	case HTTPType:
+		if o.URL == "" {
+			return errors.New("issuanceHooks url cannot be empty")
+		}
+		u, err := url.Parse(o.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("issuanceHooks url %s is not a valid http or https url", o.URL)
+		}
+		if o.MaxAttempts < 0 {
+			return errors.New("issuanceHooks maxAttempts cannot be negative")
+		}
+		if o.Timeout != nil && o.Timeout.Duration < 0 {
+			return errors.New("issuanceHooks timeout cannot be negative")
+		}
+	case FileType:
+		if o.Path == "" {
+			return errors.New("issuanceHooks path cannot be empty")
+		}
+	default:
+		return errors.Errorf("unsupported issuanceHooks type '%s'", o.Type)
+	}
+	return nil
+}
+
+// New creates the issuance hook defined in the given options.
+func New(o *Options) (IssuanceHook, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(o.Type) {
+	case HTTPType:
+		return NewHTTPHook(o), nil
+	default:
+		return NewFileHook(o.Path), nil
+	}
+}
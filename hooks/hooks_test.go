@@ -0,0 +1,111 @@
+package hooks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+func mustCertificate(t *testing.T) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	now := time.Now().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1234),
+		Subject:        pkix.Name{CommonName: "test.smallstep.com"},
+		DNSNames:       []string{"test.smallstep.com"},
+		IPAddresses:    []net.IP{net.ParseIP("127.0.0.1")},
+		EmailAddresses: []string{"jane@smallstep.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "smallstep.com", Path: "/test"}},
+		NotBefore:      now,
+		NotAfter:       now.Add(time.Hour),
+	}
+	b, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.FatalError(t, err)
+	crt, err := x509.ParseCertificate(b)
+	assert.FatalError(t, err)
+	return crt
+}
+
+func TestNewIssuanceEvent(t *testing.T) {
+	crt := mustCertificate(t)
+	e := NewIssuanceEvent(RenewEvent, crt)
+	assert.Equals(t, e.Type, "renew")
+	assert.Equals(t, e.SerialNumber, "1234")
+	assert.Equals(t, e.Subject, "CN=test.smallstep.com")
+	assert.Equals(t, e.DNSNames, []string{"test.smallstep.com"})
+	assert.Equals(t, e.IPAddresses, []string{"127.0.0.1"})
+	assert.Equals(t, e.EmailAddresses, []string{"jane@smallstep.com"})
+	assert.Equals(t, e.URIs, []string{"spiffe://smallstep.com/test"})
+	assert.Equals(t, e.NotBefore, crt.NotBefore)
+	assert.Equals(t, e.NotAfter, crt.NotAfter)
+	assert.HasPrefix(t, e.Certificate, "-----BEGIN CERTIFICATE-----\n")
+}
+
+func TestOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *Options
+		wantErr bool
+	}{
+		{"ok/http", &Options{Type: "http", URL: "https://inventory.example.com/certs"}, false},
+		{"ok/HTTP", &Options{Type: "HTTP", URL: "http://localhost:8080", Secret: "secret", MaxAttempts: 5,
+			Timeout: &provisioner.Duration{Duration: time.Minute}}, false},
+		{"ok/file", &Options{Type: "file", Path: "/var/log/step/issued.json"}, false},
+		{"fail/nil", nil, true},
+		{"fail/type", &Options{Type: "smtp"}, true},
+		{"fail/http-no-url", &Options{Type: "http"}, true},
+		{"fail/http-bad-scheme", &Options{Type: "http", URL: "ftp://example.com"}, true},
+		{"fail/http-no-host", &Options{Type: "http", URL: "https://"}, true},
+		{"fail/http-max-attempts", &Options{Type: "http", URL: "https://example.com", MaxAttempts: -1}, true},
+		{"fail/http-timeout", &Options{Type: "http", URL: "https://example.com",
+			Timeout: &provisioner.Duration{Duration: -time.Second}}, true},
+		{"fail/file-no-path", &Options{Type: "file"}, true},
+		{"ok/async", &Options{Type: "file", Path: "issued.json", Async: true}, false},
+		{"fail/async-fail-on-error", &Options{Type: "file", Path: "issued.json", Async: true, FailOnError: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Options.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *Options
+		want    reflect.Type
+		wantErr bool
+	}{
+		{"ok/http", &Options{Type: "http", URL: "https://example.com"}, reflect.TypeOf(&HTTPHook{}), false},
+		{"ok/file", &Options{Type: "file", Path: "issued.json"}, reflect.TypeOf(&FileHook{}), false},
+		{"fail", &Options{Type: "file"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != nil {
+				assert.Equals(t, reflect.TypeOf(got), tt.want)
+			}
+		})
+	}
+}
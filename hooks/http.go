@@ -0,0 +1,112 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader is the header with the HMAC-SHA256 of the body sent by the
+// http hooks.
+const SignatureHeader = "X-Smallstep-Signature"
+
+const (
+	defaultHTTPMaxAttempts = 3
+	defaultHTTPTimeout     = 10 * time.Second
+	defaultHTTPBackoff     = time.Second
+)
+
+// HTTPHook is an issuance hook that POSTs the issuance events to an HTTP
+// endpoint.
+type HTTPHook struct {
+	url         string
+	secret      []byte
+	maxAttempts int
+	client      *http.Client
+	backoff     time.Duration
+}
+
+// NewHTTPHook creates a new HTTPHook with the given options.
+func NewHTTPHook(o *Options) *HTTPHook {
+	h := &HTTPHook{
+		url:         o.URL,
+		maxAttempts: o.MaxAttempts,
+		client:      &http.Client{Timeout: defaultHTTPTimeout},
+		backoff:     defaultHTTPBackoff,
+	}
+	if o.Secret != "" {
+		h.secret = []byte(o.Secret)
+	}
+	if h.maxAttempts == 0 {
+		h.maxAttempts = defaultHTTPMaxAttempts
+	}
+	if o.Timeout != nil && o.Timeout.Duration > 0 {
+		h.client.Timeout = o.Timeout.Duration
+	}
+	return h
+}
+
+// Issued sends the issuance event to the endpoint, retrying the request with
+// an exponential backoff while it fails with a temporary error.
+func (h *HTTPHook) Issued(ctx context.Context, e *IssuanceEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling issuance event")
+	}
+
+	backoff := h.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := h.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= h.maxAttempts {
+			return errors.Wrapf(err, "error sending issuance event to %s after %d attempts", h.url, attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "error sending issuance event to %s", h.url)
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// send POSTs the body to the endpoint. It returns true if the request failed
+// and it can be retried.
+func (h *HTTPHook) send(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.secret != nil {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "error doing request")
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	default:
+		return false, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
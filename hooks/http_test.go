@@ -0,0 +1,102 @@
+package hooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+func TestHTTPHook_Issued(t *testing.T) {
+	crt := mustCertificate(t)
+	event := NewIssuanceEvent(SignEvent, crt)
+	event.Provisioner = "acme"
+	event.ACMEAccountID = "accID"
+	event.ACMEOrderID = "ordID"
+
+	tests := []struct {
+		name         string
+		secret       string
+		responses    []int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"ok", "secret", []int{200}, 1, false},
+		{"ok/no-secret", "", []int{204}, 1, false},
+		{"ok/retry", "secret", []int{500, 429, 201}, 3, false},
+		{"fail/max-attempts", "secret", []int{503, 503, 503, 200}, 3, true},
+		{"fail/no-retry", "secret", []int{400, 200}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				assert.Equals(t, r.Method, "POST")
+				assert.Equals(t, r.URL.Path, "/inventory")
+				assert.Equals(t, r.Header.Get("Content-Type"), "application/json")
+
+				body, err := io.ReadAll(r.Body)
+				assert.FatalError(t, err)
+				if tt.secret == "" {
+					assert.Equals(t, r.Header.Get(SignatureHeader), "")
+				} else {
+					mac := hmac.New(sha256.New, []byte(tt.secret))
+					mac.Write(body)
+					assert.Equals(t, r.Header.Get(SignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)))
+				}
+
+				var got map[string]interface{}
+				assert.FatalError(t, json.Unmarshal(body, &got))
+				assert.Equals(t, got["type"], "sign")
+				assert.Equals(t, got["serialNumber"], crt.SerialNumber.String())
+				assert.Equals(t, got["subject"], "CN=test.smallstep.com")
+				assert.Equals(t, got["dnsNames"], []interface{}{"test.smallstep.com"})
+				assert.Equals(t, got["ipAddresses"], []interface{}{"127.0.0.1"})
+				assert.Equals(t, got["provisioner"], "acme")
+				assert.Equals(t, got["acmeAccountID"], "accID")
+				assert.Equals(t, got["acmeOrderID"], "ordID")
+				assert.Equals(t, got["notAfter"], crt.NotAfter.Format(time.RFC3339))
+				assert.True(t, strings.HasPrefix(got["certificate"].(string), "-----BEGIN CERTIFICATE-----\n"))
+
+				w.WriteHeader(tt.responses[attempts-1])
+			}))
+			defer srv.Close()
+
+			h := NewHTTPHook(&Options{
+				Type:    HTTPType,
+				URL:     srv.URL + "/inventory",
+				Secret:  tt.secret,
+				Timeout: &provisioner.Duration{Duration: time.Second},
+			})
+			h.backoff = time.Millisecond
+			err := h.Issued(context.Background(), event)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("HTTPHook.Issued() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equals(t, attempts, tt.wantAttempts)
+		})
+	}
+}
+
+func TestHTTPHook_Issued_unreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	h := NewHTTPHook(&Options{Type: HTTPType, URL: srv.URL, MaxAttempts: 2})
+	h.backoff = time.Millisecond
+	err := h.Issued(context.Background(), NewIssuanceEvent(SignEvent, mustCertificate(t)))
+	if assert.NotNil(t, err) {
+		assert.HasPrefix(t, err.Error(), "error sending issuance event to "+srv.URL+" after 2 attempts")
+	}
+}
@@ -0,0 +1,191 @@
+package hooks
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// Default values of the issuance queue options.
+const (
+	DefaultQueueWorkers     = 4
+	DefaultQueueSize        = 1000
+	DefaultQueueMaxAttempts = 5
+	DefaultQueueBackoff     = time.Second
+)
+
+// QueueOptions are the options of the issuance queue, the issuanceQueue object
+// in the ca.json. The queue delivers the events to the async hooks using
+// Workers goroutines, 4 by default, and holds up to Size events, 1000 by
+// default. Each hook is called up to MaxAttempts times, 5 by default, waiting
+// between attempts a Backoff, 1 second by default, that doubles after each
+// attempt. The events that cannot be delivered are logged and, if
+// DeadLetterPath is set, appended to that file.
+type QueueOptions struct {
+	Workers        int                   `json:"workers,omitempty"`
+	Size           int                   `json:"size,omitempty"`
+	MaxAttempts    int                   `json:"maxAttempts,omitempty"`
+	Backoff        *provisioner.Duration `json:"backoff,omitempty"`
+	DeadLetterPath string                `json:"deadLetterPath,omitempty"`
+}
+
+// Validate validates the issuance queue options, nil options are valid.
+func (o *QueueOptions) Validate() error {
+	switch {
+	case o == nil:
+		return nil
+	case o.Workers < 0:
+		return errors.New("issuanceQueue workers cannot be negative")
+	case o.Size < 0:
+		return errors.New("issuanceQueue size cannot be negative")
+	case o.MaxAttempts < 0:
+		return errors.New("issuanceQueue maxAttempts cannot be negative")
+	case o.Backoff != nil && o.Backoff.Duration < 0:
+		return errors.New("issuanceQueue backoff cannot be negative")
+	default:
+		return nil
+	}
+}
+
+// queueJob is the delivery of an event to a hook.
+type queueJob struct {
+	hook  IssuanceHook
+	event *IssuanceEvent
+}
+
+// Queue is an issuance hook that delivers the events to other hooks in the
+// background, so they do not delay the issuance of the certificates. The
+// failed deliveries are retried with an exponential backoff, and the events
+// that cannot be delivered, or that do not fit in the queue, are sent to the
+// dead-letter hook, if any.
+type Queue struct {
+	hooks       []IssuanceHook
+	jobs        chan queueJob
+	maxAttempts int
+	backoff     time.Duration
+	deadLetter  IssuanceHook
+	mu          sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewQueue creates a Queue that delivers the events to the given hooks, and
+// starts its workers. Nil options use the default values.
+func NewQueue(opts *QueueOptions, hks ...IssuanceHook) *Queue {
+	if opts == nil {
+		opts = &QueueOptions{}
+	}
+	workers := opts.Workers
+	if workers == 0 {
+		workers = DefaultQueueWorkers
+	}
+	size := opts.Size
+	if size == 0 {
+		size = DefaultQueueSize
+	}
+	q := &Queue{
+		hooks:       hks,
+		jobs:        make(chan queueJob, size),
+		maxAttempts: opts.MaxAttempts,
+		backoff:     DefaultQueueBackoff,
+		done:        make(chan struct{}),
+	}
+	if q.maxAttempts == 0 {
+		q.maxAttempts = DefaultQueueMaxAttempts
+	}
+	if opts.Backoff != nil && opts.Backoff.Duration > 0 {
+		q.backoff = opts.Backoff.Duration
+	}
+	if opts.DeadLetterPath != "" {
+		q.deadLetter = NewFileHook(opts.DeadLetterPath)
+	}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Issued queues the delivery of the event to each hook. It returns an error if
+// the queue is closed, or if it is full, in which case the event is sent to the
+// dead-letter hook.
+func (q *Queue) Issued(ctx context.Context, e *IssuanceEvent) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errors.New("issuance queue is closed")
+	}
+
+	var err error
+	for _, h := range q.hooks {
+		select {
+		case q.jobs <- queueJob{hook: h, event: e}:
+		default:
+			err = errors.New("issuance queue is full")
+			q.drop(queueJob{hook: h, event: e}, err)
+		}
+	}
+	return err
+}
+
+// Close stops accepting events and waits until the queued ones are delivered.
+// Once the queue is closed the failed deliveries are not retried, the events
+// are sent to the dead-letter hook right away.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.done)
+	close(q.jobs)
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		q.deliver(job)
+	}
+}
+
+// deliver calls the hook of the job until it succeeds or the attempts are
+// exhausted.
+func (q *Queue) deliver(job queueJob) {
+	backoff := q.backoff
+	for attempt := 1; ; attempt++ {
+		err := job.hook.Issued(context.Background(), job.event)
+		switch {
+		case err == nil:
+			return
+		case attempt >= q.maxAttempts:
+			q.drop(job, errors.Wrapf(err, "failed after %d attempts", attempt))
+			return
+		}
+		select {
+		case <-q.done:
+			q.drop(job, err)
+			return
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// drop logs the failed delivery and sends the event to the dead-letter hook.
+func (q *Queue) drop(job queueJob, err error) {
+	log.Printf("error delivering issuance event for certificate %s to %T: %v", job.event.SerialNumber, job.hook, err)
+	if q.deadLetter != nil {
+		if err := q.deadLetter.Issued(context.Background(), job.event); err != nil {
+			log.Printf("error writing issuance event for certificate %s to the dead-letter file: %v", job.event.SerialNumber, err)
+		}
+	}
+}
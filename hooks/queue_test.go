@@ -0,0 +1,162 @@
+package hooks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// mockHook is an issuance hook that fails the first failures calls.
+type mockHook struct {
+	mu       sync.Mutex
+	calls    int
+	failures int
+	events   []*IssuanceEvent
+}
+
+func (m *mockHook) Issued(ctx context.Context, e *IssuanceEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.calls <= m.failures {
+		return errors.New("force")
+	}
+	m.events = append(m.events, e)
+	return nil
+}
+
+// count returns the number of calls to the hook.
+func (m *mockHook) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+func readEvents(t *testing.T, path string) []*IssuanceEvent {
+	t.Helper()
+	f, err := os.Open(path)
+	assert.FatalError(t, err)
+	defer f.Close()
+
+	var events []*IssuanceEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := new(IssuanceEvent)
+		assert.FatalError(t, json.Unmarshal(scanner.Bytes(), e))
+		events = append(events, e)
+	}
+	assert.FatalError(t, scanner.Err())
+	return events
+}
+
+func TestQueueOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *QueueOptions
+		wantErr bool
+	}{
+		{"ok/nil", nil, false},
+		{"ok", &QueueOptions{Workers: 2, Size: 10, MaxAttempts: 3,
+			Backoff: &provisioner.Duration{Duration: time.Second}, DeadLetterPath: "dead.json"}, false},
+		{"fail/workers", &QueueOptions{Workers: -1}, true},
+		{"fail/size", &QueueOptions{Size: -1}, true},
+		{"fail/max-attempts", &QueueOptions{MaxAttempts: -1}, true},
+		{"fail/backoff", &QueueOptions{Backoff: &provisioner.Duration{Duration: -time.Second}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("QueueOptions.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueue_Issued(t *testing.T) {
+	crt := mustCertificate(t)
+	deadLetterPath := filepath.Join(t.TempDir(), "dead.json")
+	backoff := &provisioner.Duration{Duration: time.Millisecond}
+
+	ok := &mockHook{}
+	retried := &mockHook{failures: 2}
+	failing := &mockHook{failures: 10}
+	q := NewQueue(&QueueOptions{
+		Workers:        2,
+		MaxAttempts:    3,
+		Backoff:        backoff,
+		DeadLetterPath: deadLetterPath,
+	}, ok, retried, failing)
+
+	e := NewIssuanceEvent(SignEvent, crt)
+	assert.FatalError(t, q.Issued(context.Background(), e))
+
+	// The failed deliveries are not retried once the queue is closed, so wait
+	// for all the attempts first.
+	deadline := time.Now().Add(5 * time.Second)
+	for ok.count() < 1 || retried.count() < 3 || failing.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the issuance hooks")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.Close()
+
+	// The hooks receive the event, the failures are retried.
+	assert.Equals(t, ok.calls, 1)
+	assert.Equals(t, ok.events, []*IssuanceEvent{e})
+	assert.Equals(t, retried.calls, 3)
+	assert.Equals(t, retried.events, []*IssuanceEvent{e})
+
+	// The persistent failures are dead-lettered.
+	assert.Equals(t, failing.calls, 3)
+	assert.Len(t, 0, failing.events)
+	events := readEvents(t, deadLetterPath)
+	if assert.Len(t, 1, events) {
+		assert.Equals(t, events[0].SerialNumber, crt.SerialNumber.String())
+	}
+
+	// A closed queue does not accept events.
+	err := q.Issued(context.Background(), e)
+	if assert.NotNil(t, err) {
+		assert.Equals(t, err.Error(), "issuance queue is closed")
+	}
+	q.Close()
+}
+
+func TestQueue_Issued_full(t *testing.T) {
+	crt := mustCertificate(t)
+	deadLetterPath := filepath.Join(t.TempDir(), "dead.json")
+
+	// A hook that blocks the only worker.
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	blocking := IssuanceHookFunc(func(ctx context.Context, e *IssuanceEvent) error {
+		once.Do(func() { close(started) })
+		<-unblock
+		return nil
+	})
+	q := NewQueue(&QueueOptions{Workers: 1, Size: 1, DeadLetterPath: deadLetterPath}, blocking)
+
+	e := NewIssuanceEvent(SignEvent, crt)
+	assert.FatalError(t, q.Issued(context.Background(), e))
+	<-started
+	assert.FatalError(t, q.Issued(context.Background(), e))
+	err := q.Issued(context.Background(), e)
+	if assert.NotNil(t, err) {
+		assert.Equals(t, err.Error(), "issuance queue is full")
+	}
+	close(unblock)
+	q.Close()
+
+	assert.Len(t, 1, readEvents(t, deadLetterPath))
+}
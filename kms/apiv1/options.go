@@ -1,9 +1,12 @@
 package apiv1
 
 import (
+	"context"
 	"crypto"
 	"crypto/x509"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -61,6 +64,61 @@ func (e ErrAlreadyExists) Error() string {
 	return "key already exists"
 }
 
+// ErrTransient is the type of error returned if an operation fails because of
+// a condition that might go away if the operation is retried, e.g. throttling
+// or an internal error of a cloud KMS.
+type ErrTransient struct {
+	Message string
+	Err     error
+}
+
+func (e ErrTransient) Error() string {
+	switch {
+	case e.Message != "" && e.Err != nil:
+		return e.Message + ": " + e.Err.Error()
+	case e.Message != "":
+		return e.Message
+	case e.Err != nil:
+		return e.Err.Error()
+	default:
+		return "transient error"
+	}
+}
+
+// Unwrap returns the original error.
+func (e ErrTransient) Unwrap() error {
+	return e.Err
+}
+
+// ErrRetriesExhausted is the type of error returned if an operation still
+// fails with a transient error after all the attempts have been used.
+type ErrRetriesExhausted struct {
+	Attempts int
+	Err      error
+}
+
+func (e ErrRetriesExhausted) Error() string {
+	return fmt.Sprintf("operation failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e ErrRetriesExhausted) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns true if the given error is an ErrTransient or a timeout.
+func IsTransient(err error) bool {
+	var te ErrTransient
+	if errors.As(err, &te) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne interface{ Timeout() bool }
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 // Type represents the KMS type used.
 type Type string
 
@@ -116,6 +174,71 @@ type Options struct {
 
 	// Profile to use in AmazonKMS.
 	Profile string `json:"profile,omitempty"`
+
+	// Retry defines how the signing operations of the intermediate key that
+	// fail with a transient error are retried. They are not retried by
+	// default.
+	Retry *RetryOptions `json:"retry,omitempty"`
+}
+
+// Default retry options.
+const (
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBackoff     = 100 * time.Millisecond
+)
+
+// RetryOptions are the options used to retry the signing operations that fail
+// with a transient error. The wait between attempts starts with Backoff, and
+// it's doubled after every attempt.
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	// Defaults to 3.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+
+	// Backoff is the wait before the first retry, e.g. "200ms". Defaults to
+	// 100ms.
+	Backoff string `json:"backoff,omitempty"`
+}
+
+// Validate checks the fields in RetryOptions.
+func (o *RetryOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MaxAttempts < 0 {
+		return errors.Errorf("invalid retry maxAttempts %d: it cannot be negative", o.MaxAttempts)
+	}
+	if o.Backoff != "" {
+		d, err := time.ParseDuration(o.Backoff)
+		if err != nil {
+			return errors.Wrapf(err, "invalid retry backoff %s", o.Backoff)
+		}
+		if d < 0 {
+			return errors.Errorf("invalid retry backoff %s: it cannot be negative", o.Backoff)
+		}
+	}
+	return nil
+}
+
+// GetMaxAttempts returns the maximum number of attempts, or the default if it
+// has not been set.
+func (o *RetryOptions) GetMaxAttempts() int {
+	if o == nil || o.MaxAttempts <= 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+// GetBackoff returns the wait before the first retry, or the default if it has
+// not been set.
+func (o *RetryOptions) GetBackoff() time.Duration {
+	if o == nil || o.Backoff == "" {
+		return DefaultRetryBackoff
+	}
+	if d, err := time.ParseDuration(o.Backoff); err == nil {
+		return d
+	}
+	return DefaultRetryBackoff
 }
 
 // Validate checks the fields in Options.
@@ -133,5 +256,5 @@ func (o *Options) Validate() error {
 		return errors.Errorf("unsupported kms type %s", o.Type)
 	}
 
-	return nil
+	return o.Retry.Validate()
 }
@@ -1,7 +1,11 @@
 package apiv1
 
 import (
+	"context"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestOptions_Validate(t *testing.T) {
@@ -16,7 +20,11 @@ func TestOptions_Validate(t *testing.T) {
 		{"awskms", &Options{Type: "awskms"}, false},
 		{"sshagentkms", &Options{Type: "sshagentkms"}, false},
 		{"pkcs11", &Options{Type: "pkcs11"}, false},
+		{"retry", &Options{Type: "cloudkms", Retry: &RetryOptions{MaxAttempts: 5, Backoff: "200ms"}}, false},
 		{"unsupported", &Options{Type: "unsupported"}, true},
+		{"fail retry maxAttempts", &Options{Type: "cloudkms", Retry: &RetryOptions{MaxAttempts: -1}}, true},
+		{"fail retry backoff", &Options{Type: "cloudkms", Retry: &RetryOptions{Backoff: "foo"}}, true},
+		{"fail retry negative backoff", &Options{Type: "cloudkms", Retry: &RetryOptions{Backoff: "-1s"}}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -74,3 +82,54 @@ func TestErrAlreadyExists_Error(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryOptions_Getters(t *testing.T) {
+	tests := []struct {
+		name            string
+		options         *RetryOptions
+		wantMaxAttempts int
+		wantBackoff     time.Duration
+	}{
+		{"nil", nil, DefaultRetryMaxAttempts, DefaultRetryBackoff},
+		{"empty", &RetryOptions{}, DefaultRetryMaxAttempts, DefaultRetryBackoff},
+		{"custom", &RetryOptions{MaxAttempts: 5, Backoff: "1s"}, 5, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.GetMaxAttempts(); got != tt.wantMaxAttempts {
+				t.Errorf("RetryOptions.GetMaxAttempts() = %v, want %v", got, tt.wantMaxAttempts)
+			}
+			if got := tt.options.GetBackoff(); got != tt.wantBackoff {
+				t.Errorf("RetryOptions.GetBackoff() = %v, want %v", got, tt.wantBackoff)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"transient", ErrTransient{Message: "rate exceeded"}, true},
+		{"wrapped transient", errors.Wrap(ErrTransient{Message: "rate exceeded"}, "error creating certificate"), true},
+		{"deadline exceeded", errors.Wrap(context.DeadlineExceeded, "sign failed"), true},
+		{"timeout", timeoutError{}, true},
+		{"exhausted", ErrRetriesExhausted{Attempts: 3, Err: ErrTransient{}}, true},
+		{"other", errors.New("invalid key usage"), false},
+		{"not implemented", ErrNotImplemented{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"io"
+	"net/http"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/kms/apiv1"
 	"go.step.sm/crypto/pemutil"
 )
 
@@ -76,12 +80,33 @@ func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]
 
 	resp, err := s.service.SignWithContext(ctx, req)
 	if err != nil {
+		if isTransient(err) {
+			return nil, apiv1.ErrTransient{Message: "awsKMS SignWithContext failed", Err: err}
+		}
 		return nil, errors.Wrap(err, "awsKMS SignWithContext failed")
 	}
 
 	return resp.Signature, nil
 }
 
+// isTransient returns true if the error returned by AWS KMS is a throttling
+// error, a timeout, or a server error.
+func isTransient(err error) bool {
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	if e, ok := err.(awserr.Error); ok {
+		switch e.Code() {
+		case kms.ErrCodeDependencyTimeoutException, request.ErrCodeResponseTimeout:
+			return true
+		}
+	}
+	return false
+}
+
 func getSigningAlgorithm(key crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
 	switch key.(type) {
 	case *rsa.PublicKey:
@@ -11,8 +11,10 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/smallstep/certificates/kms/apiv1"
 	"go.step.sm/crypto/pemutil"
 )
 
@@ -152,6 +154,45 @@ func TestSigner_Sign(t *testing.T) {
 	}
 }
 
+func TestSigner_Sign_transient(t *testing.T) {
+	key, err := pemutil.ParseKey([]byte(publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throttling", awserr.NewRequestFailure(awserr.New("ThrottlingException", "rate exceeded", nil), 400, "request-id"), true},
+		{"internal", awserr.NewRequestFailure(awserr.New(kms.ErrCodeInternalException, "internal error", nil), 500, "request-id"), true},
+		{"dependency timeout", awserr.NewRequestFailure(awserr.New(kms.ErrCodeDependencyTimeoutException, "timeout", nil), 400, "request-id"), true},
+		{"invalid key usage", awserr.NewRequestFailure(awserr.New(kms.ErrCodeInvalidKeyUsageException, "invalid key usage", nil), 400, "request-id"), false},
+		{"other", fmt.Errorf("an error"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Signer{
+				service: &MockClient{
+					signWithContext: func(ctx aws.Context, input *kms.SignInput, opts ...request.Option) (*kms.SignOutput, error) {
+						return nil, tt.err
+					},
+				},
+				keyID:     keyID,
+				publicKey: key,
+			}
+			_, err := s.Sign(rand.Reader, []byte("digest"), crypto.SHA256)
+			if err == nil {
+				t.Fatal("Signer.Sign() error = nil, want an error")
+			}
+			if got := apiv1.IsTransient(err); got != tt.want {
+				t.Errorf("apiv1.IsTransient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_getSigningAlgorithm(t *testing.T) {
 	type args struct {
 		key  crypto.PublicKey
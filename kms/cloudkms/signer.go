@@ -6,8 +6,11 @@ import (
 	"io"
 
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/kms/apiv1"
 	"go.step.sm/crypto/pemutil"
 	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Signer implements a crypto.Signer using Google's Cloud KMS.
@@ -81,6 +84,9 @@ func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]
 
 	response, err := s.client.AsymmetricSign(ctx, req)
 	if err != nil {
+		if isTransient(err) {
+			return nil, apiv1.ErrTransient{Message: "cloudKMS AsymmetricSign failed", Err: err}
+		}
 		return nil, errors.Wrap(err, "cloudKMS AsymmetricSign failed")
 	}
 
@@ -93,3 +99,14 @@ func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]
 func (s *Signer) SignatureAlgorithm() x509.SignatureAlgorithm {
 	return s.algorithm
 }
+
+// isTransient returns true if the error returned by Cloud KMS is a throttling
+// error, a timeout, or a temporary unavailability of the service.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
@@ -12,8 +12,11 @@ import (
 	"testing"
 
 	gax "github.com/googleapis/gax-go/v2"
+	"github.com/smallstep/certificates/kms/apiv1"
 	"go.step.sm/crypto/pemutil"
 	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func Test_newSigner(t *testing.T) {
@@ -158,6 +161,41 @@ func Test_signer_Sign(t *testing.T) {
 	}
 }
 
+func Test_signer_Sign_transient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unavailable", status.Error(codes.Unavailable, "unavailable"), true},
+		{"resource exhausted", status.Error(codes.ResourceExhausted, "quota exceeded"), true},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "deadline exceeded"), true},
+		{"aborted", status.Error(codes.Aborted, "aborted"), true},
+		{"invalid argument", status.Error(codes.InvalidArgument, "invalid digest"), false},
+		{"permission denied", status.Error(codes.PermissionDenied, "permission denied"), false},
+		{"other", fmt.Errorf("an error"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Signer{
+				client: &MockClient{
+					asymmetricSign: func(_ context.Context, _ *kmspb.AsymmetricSignRequest, _ ...gax.CallOption) (*kmspb.AsymmetricSignResponse, error) {
+						return nil, tt.err
+					},
+				},
+				signingKey: "projects/p/locations/l/keyRings/k/cryptoKeys/c/cryptoKeyVersions/1",
+			}
+			_, err := s.Sign(rand.Reader, []byte("digest"), crypto.SHA256)
+			if err == nil {
+				t.Fatal("signer.Sign() error = nil, want an error")
+			}
+			if got := apiv1.IsTransient(err); got != tt.want {
+				t.Errorf("apiv1.IsTransient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestSigner_SignatureAlgorithm(t *testing.T) {
 	pemBytes, err := os.ReadFile("testdata/pub.pem")
 	if err != nil {
@@ -0,0 +1,75 @@
+package kms
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io"
+	"time"
+
+	"github.com/smallstep/certificates/kms/apiv1"
+)
+
+// RetrySigner is a crypto.Signer that retries the signing operations that fail
+// with a transient error, as defined by apiv1.IsTransient, with an exponential
+// backoff. Other errors are returned right away.
+type RetrySigner struct {
+	signer      crypto.Signer
+	maxAttempts int
+	backoff     time.Duration
+	sleep       func(time.Duration)
+}
+
+// NewRetrySigner returns a crypto.Signer that retries the signing operations of
+// the given signer using the given options. If the signer implements
+// SignatureAlgorithm, the returned signer implements it too.
+func NewRetrySigner(signer crypto.Signer, opts *apiv1.RetryOptions) crypto.Signer {
+	s := &RetrySigner{
+		signer:      signer,
+		maxAttempts: opts.GetMaxAttempts(),
+		backoff:     opts.GetBackoff(),
+		sleep:       time.Sleep,
+	}
+	if _, ok := signer.(signatureAlgorithmGetter); ok {
+		return &retrySignerWithAlgorithm{s}
+	}
+	return s
+}
+
+// Public returns the public key of the signer.
+func (s *RetrySigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+// Sign signs the digest with the underlying signer. If all the attempts fail
+// with a transient error it returns an apiv1.ErrRetriesExhausted error.
+func (s *RetrySigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		signature, err := s.signer.Sign(rand, digest, opts)
+		switch {
+		case err == nil:
+			return signature, nil
+		case !apiv1.IsTransient(err):
+			return nil, err
+		case attempt >= s.maxAttempts:
+			return nil, apiv1.ErrRetriesExhausted{Attempts: attempt, Err: err}
+		}
+		s.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+type signatureAlgorithmGetter interface {
+	SignatureAlgorithm() x509.SignatureAlgorithm
+}
+
+// retrySignerWithAlgorithm is a RetrySigner that forwards the
+// SignatureAlgorithm method of the underlying signer.
+type retrySignerWithAlgorithm struct {
+	*RetrySigner
+}
+
+// SignatureAlgorithm returns the signature algorithm of the underlying signer.
+func (s *retrySignerWithAlgorithm) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return s.signer.(signatureAlgorithmGetter).SignatureAlgorithm()
+}
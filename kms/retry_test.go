@@ -0,0 +1,115 @@
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/kms/apiv1"
+)
+
+type mockSigner struct {
+	crypto.Signer
+	errs  []error
+	calls int
+}
+
+func (s *mockSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return nil, err
+	}
+	return []byte("signature"), nil
+}
+
+type mockSignerWithAlgorithm struct {
+	*mockSigner
+}
+
+func (s *mockSignerWithAlgorithm) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return x509.ECDSAWithSHA384
+}
+
+func TestRetrySigner_Sign(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transient := apiv1.ErrTransient{Message: "rate exceeded"}
+	permanent := errors.New("invalid key usage")
+
+	tests := []struct {
+		name         string
+		opts         *apiv1.RetryOptions
+		errs         []error
+		want         []byte
+		wantErr      error
+		wantCalls    int
+		wantBackoffs []time.Duration
+	}{
+		{"ok", nil, nil, []byte("signature"), nil, 1, nil},
+		{"ok transient then success", nil, []error{transient, transient}, []byte("signature"), nil, 3, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}},
+		{"ok custom backoff", &apiv1.RetryOptions{MaxAttempts: 5, Backoff: "1s"}, []error{transient, transient, transient}, []byte("signature"), nil, 4, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{"fail permanent", nil, []error{permanent}, nil, permanent, 1, nil},
+		{"fail permanent after transient", nil, []error{transient, permanent}, nil, permanent, 2, []time.Duration{100 * time.Millisecond}},
+		{"fail exhausted", &apiv1.RetryOptions{MaxAttempts: 2}, []error{transient, transient, transient}, nil, apiv1.ErrRetriesExhausted{Attempts: 2, Err: transient}, 2, []time.Duration{100 * time.Millisecond}},
+		{"fail single attempt", &apiv1.RetryOptions{MaxAttempts: 1}, []error{transient}, nil, apiv1.ErrRetriesExhausted{Attempts: 1, Err: transient}, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := &mockSigner{Signer: key, errs: tt.errs}
+			s := NewRetrySigner(ms, tt.opts).(*RetrySigner)
+			var backoffs []time.Duration
+			s.sleep = func(d time.Duration) {
+				backoffs = append(backoffs, d)
+			}
+
+			got, err := s.Sign(rand.Reader, []byte("digest"), crypto.SHA256)
+			if !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("RetrySigner.Sign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RetrySigner.Sign() = %s, want %s", got, tt.want)
+			}
+			if ms.calls != tt.wantCalls {
+				t.Errorf("RetrySigner.Sign() calls = %d, want %d", ms.calls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(backoffs, tt.wantBackoffs) {
+				t.Errorf("RetrySigner.Sign() backoffs = %v, want %v", backoffs, tt.wantBackoffs)
+			}
+		})
+	}
+}
+
+func TestNewRetrySigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewRetrySigner(&mockSigner{Signer: key}, nil)
+	if _, ok := s.(*RetrySigner); !ok {
+		t.Errorf("NewRetrySigner() = %T, want *RetrySigner", s)
+	}
+	if !reflect.DeepEqual(s.Public(), key.Public()) {
+		t.Errorf("RetrySigner.Public() = %v, want %v", s.Public(), key.Public())
+	}
+
+	s = NewRetrySigner(&mockSignerWithAlgorithm{&mockSigner{Signer: key}}, nil)
+	sa, ok := s.(signatureAlgorithmGetter)
+	if !ok {
+		t.Fatalf("NewRetrySigner() = %T, want a signer with SignatureAlgorithm", s)
+	}
+	if got := sa.SignatureAlgorithm(); got != x509.ECDSAWithSHA384 {
+		t.Errorf("RetrySigner.SignatureAlgorithm() = %v, want %v", got, x509.ECDSAWithSHA384)
+	}
+}
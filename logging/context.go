@@ -16,23 +16,38 @@ const (
 	UserIDKey
 )
 
+// RequestIDHeader is the header used to accept a request id from the clients
+// if the trace header is not set, and to return the request id in the
+// responses.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the maximum length of the request ids accepted from
+// the clients.
+const maxRequestIDLength = 128
+
 // NewRequestID creates a new request id using github.com/rs/xid.
 func NewRequestID() string {
 	return xid.New().String()
 }
 
-// RequestID returns a new middleware that gets the given header and sets it
-// in the context so it can be written in the logger. If the header does not
-// exists or it's the empty string, it uses github.com/rs/xid to create a new
-// one.
+// RequestID returns a new middleware that gets the given header, or the
+// X-Request-Id header, and sets it in the context so it can be written in the
+// logger. If the headers do not exist or they are not valid, it uses
+// github.com/rs/xid to create a new one. The request id is returned in the
+// given header and in the X-Request-Id header of the response.
 func RequestID(headerName string) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, req *http.Request) {
 			requestID := req.Header.Get(headerName)
-			if requestID == "" {
+			if !validRequestID(requestID) {
+				requestID = req.Header.Get(RequestIDHeader)
+			}
+			if !validRequestID(requestID) {
 				requestID = NewRequestID()
-				req.Header.Set(headerName, requestID)
 			}
+			req.Header.Set(headerName, requestID)
+			w.Header().Set(headerName, requestID)
+			w.Header().Set(RequestIDHeader, requestID)
 
 			ctx := WithRequestID(req.Context(), requestID)
 			next.ServeHTTP(w, req.WithContext(ctx))
@@ -41,6 +56,20 @@ func RequestID(headerName string) func(next http.Handler) http.Handler {
 	}
 }
 
+// validRequestID returns true if the request id is not empty, is not too long,
+// and only contains printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
 // WithRequestID returns a new context with the given requestID added to the
 // context.
 func WithRequestID(ctx context.Context, requestID string) context.Context {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/smallstep/assert"
@@ -143,3 +144,65 @@ func TestHandlingRegardlessOfOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"ok/generated", nil, ""},
+		{"ok/trace-header", map[string]string{"X-Smallstep-Id": "trace-id"}, "trace-id"},
+		{"ok/request-id-header", map[string]string{"X-Request-Id": "request-id"}, "request-id"},
+		{"ok/trace-header-first", map[string]string{"X-Smallstep-Id": "trace-id", "X-Request-Id": "request-id"}, "trace-id"},
+		{"ok/invalid-characters", map[string]string{"X-Request-Id": "request id"}, ""},
+		{"ok/too-long", map[string]string{"X-Request-Id": strings.Repeat("a", 129)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := RequestID(defaultTraceIDHeader)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var ok bool
+				got, ok = GetRequestID(r.Context())
+				assert.True(t, ok)
+			}))
+			r := httptest.NewRequest("GET", "/health", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if tt.want == "" {
+				assert.True(t, validRequestID(got))
+				for _, v := range tt.headers {
+					assert.NotEquals(t, got, v)
+				}
+			} else {
+				assert.Equals(t, got, tt.want)
+			}
+			assert.Equals(t, w.Header().Get("X-Smallstep-Id"), got)
+			assert.Equals(t, w.Header().Get(RequestIDHeader), got)
+		})
+	}
+}
+
+// TestRequestIDLogging ensures that the request id in the log entry is the
+// same one returned to the client.
+func TestRequestIDLogging(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	h := NewLoggerHandler("test", &Logger{Logger: logger}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "{}")
+	}))
+
+	r := httptest.NewRequest("GET", "/sign", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	id := w.Header().Get(RequestIDHeader)
+	assert.True(t, id != "")
+	if assert.Equals(t, 1, len(hook.AllEntries())) {
+		assert.Equals(t, id, hook.LastEntry().Data["request-id"])
+	}
+}
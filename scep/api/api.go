@@ -75,7 +75,7 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 
 	request, err := decodeSCEPRequest(r)
 	if err != nil {
-		writeError(w, errors.Wrap(err, "invalid scep get request"))
+		writeError(w, r, errors.Wrap(err, "invalid scep get request"))
 		return
 	}
 
@@ -94,11 +94,11 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		writeError(w, errors.Wrap(err, "scep get request failed"))
+		writeError(w, r, errors.Wrap(err, "scep get request failed"))
 		return
 	}
 
-	writeSCEPResponse(w, response)
+	writeSCEPResponse(w, r, response)
 }
 
 // Post handles all SCEP POST requests
@@ -106,7 +106,7 @@ func (h *Handler) Post(w http.ResponseWriter, r *http.Request) {
 
 	request, err := decodeSCEPRequest(r)
 	if err != nil {
-		writeError(w, errors.Wrap(err, "invalid scep post request"))
+		writeError(w, r, errors.Wrap(err, "invalid scep post request"))
 		return
 	}
 
@@ -121,11 +121,11 @@ func (h *Handler) Post(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		writeError(w, errors.Wrap(err, "scep post request failed"))
+		writeError(w, r, errors.Wrap(err, "scep post request failed"))
 		return
 	}
 
-	writeSCEPResponse(w, response)
+	writeSCEPResponse(w, r, response)
 }
 
 func decodeSCEPRequest(r *http.Request) (SCEPRequest, error) {
@@ -187,19 +187,19 @@ func (h *Handler) lookupProvisioner(next nextHTTP) nextHTTP {
 		name := chi.URLParam(r, "provisionerID")
 		provisionerID, err := url.PathUnescape(name)
 		if err != nil {
-			api.WriteError(w, errors.Errorf("error url unescaping provisioner id '%s'", name))
+			api.WriteError(w, r, errors.Errorf("error url unescaping provisioner id '%s'", name))
 			return
 		}
 
 		p, err := h.Auth.LoadProvisionerByID("scep/" + provisionerID)
 		if err != nil {
-			api.WriteError(w, err)
+			api.WriteError(w, r, err)
 			return
 		}
 
 		prov, ok := p.(*provisioner.SCEP)
 		if !ok {
-			api.WriteError(w, errors.New("provisioner must be of type SCEP"))
+			api.WriteError(w, r, errors.New("provisioner must be of type SCEP"))
 			return
 		}
 
@@ -323,7 +323,7 @@ func formatCapabilities(caps []string) []byte {
 }
 
 // writeSCEPResponse writes a SCEP response back to the SCEP client.
-func writeSCEPResponse(w http.ResponseWriter, response SCEPResponse) {
+func writeSCEPResponse(w http.ResponseWriter, r *http.Request, response SCEPResponse) {
 
 	if response.Error != nil {
 		api.LogError(w, response.Error)
@@ -336,16 +336,16 @@ func writeSCEPResponse(w http.ResponseWriter, response SCEPResponse) {
 	w.Header().Set("Content-Type", contentHeader(response))
 	_, err := w.Write(response.Data)
 	if err != nil {
-		writeError(w, errors.Wrap(err, "error when writing scep response")) // This could end up as an error again
+		writeError(w, r, errors.Wrap(err, "error when writing scep response")) // This could end up as an error again
 	}
 }
 
-func writeError(w http.ResponseWriter, err error) {
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
 	scepError := &scep.Error{
 		Message: err.Error(),
 		Status:  http.StatusInternalServerError, // TODO: make this a param?
 	}
-	api.WriteError(w, scepError)
+	api.WriteError(w, r, scepError)
 }
 
 func (h *Handler) createFailureResponse(ctx context.Context, csr *x509.CertificateRequest, msg *scep.PKIMessage, info microscep.FailInfo, failError error) (SCEPResponse, error) {